@@ -0,0 +1,108 @@
+// Package alert tells operators about failures that need a human: a relayer
+// wallet running dry, an unreachable database, a failing vault, decryption
+// errors that point at a wrong key, or a certificate about to expire.
+//
+// Alerts are raised on a Bus, which deduplicates them by key and delivers
+// them to the configured sinks in the background.
+package alert
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Alert severities.
+const (
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+// Alert is one operator notification.
+type Alert struct {
+	Key        string    `json:"key"` // identifies the condition; repeats of a key are deduplicated
+	Severity   string    `json:"severity"`
+	Summary    string    `json:"summary"`
+	Detail     string    `json:"detail,omitempty"`
+	Time       time.Time `json:"time"`
+	Suppressed int       `json:"suppressed,omitempty"` // repeats of the key dropped since it was last sent
+}
+
+// Sink delivers alerts to operators.
+type Sink interface {
+	Send(ctx context.Context, a Alert) error
+}
+
+// queueSize bounds the alerts waiting for delivery.  Raise never blocks;
+// alerts that do not fit are logged and dropped.
+const queueSize = 100
+
+// Bus deduplicates alerts and hands them to its sinks.  An alert whose key
+// was sent less than the window ago is counted and dropped; the count is
+// reported on the next alert sent for that key.  A nil *Bus discards every
+// alert, so callers need not check whether alerting is configured.
+type Bus struct {
+	window time.Duration
+	sinks  []Sink
+	queue  chan Alert
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+	dropped  map[string]int
+}
+
+// NewBus returns a bus that sends each key at most once per window.
+func NewBus(window time.Duration, sinks ...Sink) *Bus {
+	return &Bus{
+		window:   window,
+		sinks:    sinks,
+		queue:    make(chan Alert, queueSize),
+		lastSent: make(map[string]time.Time),
+		dropped:  make(map[string]int),
+	}
+}
+
+// Raise queues a for delivery unless its key was sent within the window.
+func (b *Bus) Raise(a Alert) {
+	if b == nil {
+		return
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	if last, ok := b.lastSent[a.Key]; ok && a.Time.Sub(last) < b.window {
+		b.dropped[a.Key]++
+		b.mu.Unlock()
+		return
+	}
+	b.lastSent[a.Key] = a.Time
+	a.Suppressed = b.dropped[a.Key]
+	delete(b.dropped, a.Key)
+	b.mu.Unlock()
+
+	select {
+	case b.queue <- a:
+	default:
+		log.Printf("alert queue full, dropping %s: %s", a.Key, a.Summary)
+	}
+}
+
+// Run delivers queued alerts to every sink until ctx is cancelled.  A sink
+// that fails is logged; the other sinks still receive the alert.
+func (b *Bus) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case a := <-b.queue:
+			for _, s := range b.sinks {
+				if err := s.Send(ctx, a); err != nil {
+					log.Printf("alert %s: %T: %v", a.Key, s, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package alert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mulamail/config"
+)
+
+// drain returns the alerts queued on b without running its sinks.
+func drain(b *Bus) []Alert {
+	var out []Alert
+	for {
+		select {
+		case a := <-b.queue:
+			out = append(out, a)
+		default:
+			return out
+		}
+	}
+}
+
+func TestBus_DeduplicatesPerKey(t *testing.T) {
+	b := NewBus(time.Hour)
+	now := time.Now()
+	b.Raise(Alert{Key: "a", Time: now})
+	b.Raise(Alert{Key: "a", Time: now.Add(time.Minute)})
+	b.Raise(Alert{Key: "a", Time: now.Add(2 * time.Minute)})
+	b.Raise(Alert{Key: "b", Time: now.Add(2 * time.Minute)})
+	b.Raise(Alert{Key: "a", Time: now.Add(time.Hour)})
+
+	got := drain(b)
+	if len(got) != 3 {
+		t.Fatalf("want 3 alerts, got %+v", got)
+	}
+	if got[0].Key != "a" || got[0].Suppressed != 0 {
+		t.Errorf("first: unexpected %+v", got[0])
+	}
+	if got[1].Key != "b" {
+		t.Errorf("second: unexpected %+v", got[1])
+	}
+	if got[2].Key != "a" || got[2].Suppressed != 2 {
+		t.Errorf("after the window: want key a with 2 suppressed, got %+v", got[2])
+	}
+}
+
+func TestBus_NilDiscards(t *testing.T) {
+	var b *Bus
+	b.Raise(Alert{Key: "a"}) // must not panic
+}
+
+type recordingSink struct {
+	got chan Alert
+	err error
+}
+
+func (s *recordingSink) Send(_ context.Context, a Alert) error {
+	s.got <- a
+	return s.err
+}
+
+func TestBus_RunDeliversToEverySink(t *testing.T) {
+	failing := &recordingSink{got: make(chan Alert, 1), err: errors.New("down")}
+	ok := &recordingSink{got: make(chan Alert, 1)}
+	b := NewBus(time.Hour, failing, ok)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	b.Raise(Alert{Key: "a", Summary: "hello"})
+	for _, s := range []*recordingSink{failing, ok} {
+		select {
+		case a := <-s.got:
+			if a.Summary != "hello" || a.Time.IsZero() {
+				t.Errorf("unexpected alert %+v", a)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("alert not delivered")
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got Alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type: want application/json, got %q", ct)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		if got.Key == "fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	sink := &WebhookSink{URL: srv.URL}
+
+	if err := sink.Send(context.Background(), Alert{Key: "k", Severity: Critical, Summary: "s"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got.Key != "k" || got.Severity != Critical || got.Summary != "s" {
+		t.Errorf("unexpected payload %+v", got)
+	}
+	if err := sink.Send(context.Background(), Alert{Key: "fail"}); err == nil {
+		t.Error("expected an error for a non-2xx response")
+	}
+}
+
+func TestSinksFromConfig(t *testing.T) {
+	sinks, err := SinksFromConfig(&config.Config{AlertSinks: "log, webhook", AlertWebhookURL: "http://example.com"})
+	if err != nil || len(sinks) != 2 {
+		t.Fatalf("want 2 sinks, got %v, %v", sinks, err)
+	}
+	for _, cfg := range []*config.Config{
+		{AlertSinks: "pager"},
+		{AlertSinks: "webhook"},
+		{AlertSinks: "smtp", AlertSMTPHost: "smtp.example.com"},
+	} {
+		if _, err := SinksFromConfig(cfg); err == nil {
+			t.Errorf("%q: expected an error", cfg.AlertSinks)
+		}
+	}
+}
+
+func TestBalanceCheck(t *testing.T) {
+	balance := uint64(500)
+	check := BalanceCheck("wallet", 1000, func(context.Context) (uint64, error) { return balance, nil })
+	if got := check(context.Background()); len(got) != 1 || got[0].Key != "relayer.balance" {
+		t.Errorf("low balance: unexpected %+v", got)
+	}
+	balance = 1000
+	if got := check(context.Background()); len(got) != 0 {
+		t.Errorf("sufficient balance: unexpected %+v", got)
+	}
+}
+
+func TestPingCheck_Threshold(t *testing.T) {
+	var err error
+	check := PingCheck("mongo", 3, func(context.Context) error { return err })
+	ctx := context.Background()
+
+	err = errors.New("timeout")
+	for i := 1; i < 3; i++ {
+		if got := check(ctx); len(got) != 0 {
+			t.Fatalf("failure %d: alerted too early: %+v", i, got)
+		}
+	}
+	if got := check(ctx); len(got) != 1 || got[0].Key != "mongo.ping" {
+		t.Fatalf("failure 3: want an alert, got %+v", got)
+	}
+
+	err = nil
+	check(ctx)
+	err = errors.New("timeout")
+	if got := check(ctx); len(got) != 0 {
+		t.Errorf("a success must reset the count: %+v", got)
+	}
+}
+
+func TestDecryptFailureCheck(t *testing.T) {
+	count := uint64(7)
+	check := DecryptFailureCheck(5, func() uint64 { return count })
+	count += 4
+	if got := check(context.Background()); len(got) != 0 {
+		t.Errorf("below threshold: unexpected %+v", got)
+	}
+	count += 5
+	if got := check(context.Background()); len(got) != 1 || got[0].Key != "vault.decrypt" {
+		t.Errorf("spike: want an alert, got %+v", got)
+	}
+}
+
+func writeCert(t *testing.T, notAfter time.Time) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mail.example.com"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCertExpiryCheck(t *testing.T) {
+	fresh := writeCert(t, time.Now().Add(90*24*time.Hour))
+	soon := writeCert(t, time.Now().Add(3*24*time.Hour))
+	expired := writeCert(t, time.Now().Add(-time.Hour))
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	got := CertExpiryCheck([]string{fresh, soon, expired, missing}, 14*24*time.Hour)(context.Background())
+	if len(got) != 3 {
+		t.Fatalf("want 3 alerts, got %+v", got)
+	}
+	if got[0].Key != "tls.cert.expiry:"+soon || got[0].Severity != Warning {
+		t.Errorf("expiring soon: unexpected %+v", got[0])
+	}
+	if got[1].Key != "tls.cert.expiry:"+expired || got[1].Severity != Critical {
+		t.Errorf("expired: unexpected %+v", got[1])
+	}
+	if !strings.HasPrefix(got[2].Key, "tls.cert.unreadable:") {
+		t.Errorf("missing file: unexpected %+v", got[2])
+	}
+}
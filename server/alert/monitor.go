@@ -0,0 +1,219 @@
+package alert
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"mulamail/vault"
+)
+
+// Check inspects one dependency and returns the alerts it calls for, if any.
+type Check func(ctx context.Context) []Alert
+
+// Monitor runs checks periodically and raises what they report on a bus.
+type Monitor struct {
+	bus      *Bus
+	interval time.Duration
+	checks   []Check
+}
+
+// NewMonitor returns a monitor that runs checks every interval.
+func NewMonitor(bus *Bus, interval time.Duration, checks ...Check) *Monitor {
+	return &Monitor{bus: bus, interval: interval, checks: checks}
+}
+
+// Run checks once immediately and then every interval until ctx is
+// cancelled.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.runOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Monitor) runOnce(ctx context.Context) {
+	for _, check := range m.checks {
+		for _, a := range check(ctx) {
+			m.bus.Raise(a)
+		}
+	}
+}
+
+// BalanceCheck alerts when wallet holds fewer than min lamports, as
+// reported by balance.
+func BalanceCheck(wallet string, min uint64, balance func(ctx context.Context) (uint64, error)) Check {
+	return func(ctx context.Context) []Alert {
+		lamports, err := balance(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return []Alert{{
+				Key:      "relayer.balance.error",
+				Severity: Warning,
+				Summary:  fmt.Sprintf("cannot read the balance of %s", wallet),
+				Detail:   err.Error(),
+			}}
+		}
+		if lamports >= min {
+			return nil
+		}
+		return []Alert{{
+			Key:      "relayer.balance",
+			Severity: Critical,
+			Summary:  fmt.Sprintf("wallet %s balance is low", wallet),
+			Detail:   fmt.Sprintf("%d lamports, below the %d lamport threshold", lamports, min),
+		}}
+	}
+}
+
+// PingCheck alerts once ping has failed threshold times in a row.
+func PingCheck(name string, threshold int, ping func(ctx context.Context) error) Check {
+	failures := 0
+	return func(ctx context.Context) []Alert {
+		err := ping(ctx)
+		if err == nil {
+			failures = 0
+			return nil
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		failures++
+		if failures < threshold {
+			return nil
+		}
+		return []Alert{{
+			Key:      name + ".ping",
+			Severity: Critical,
+			Summary:  fmt.Sprintf("%s unreachable: %d failed pings in a row", name, failures),
+			Detail:   err.Error(),
+		}}
+	}
+}
+
+// DecryptFailureCheck alerts when the counter returned by count grows by at
+// least threshold between two checks.  A spike of failures usually means the
+// server is running with the wrong encryption key.
+func DecryptFailureCheck(threshold uint64, count func() uint64) Check {
+	last := count()
+	return func(context.Context) []Alert {
+		n := count()
+		delta := n - last
+		last = n
+		if delta < threshold {
+			return nil
+		}
+		return []Alert{{
+			Key:      "vault.decrypt",
+			Severity: Critical,
+			Summary:  fmt.Sprintf("%d decryption failures since the last check", delta),
+			Detail:   "check that ENCRYPTION_KEY matches the key the data was written with",
+		}}
+	}
+}
+
+// CertExpiryCheck alerts when a certificate in one of the PEM files expires
+// within the given duration, or when a file cannot be read.
+func CertExpiryCheck(paths []string, within time.Duration) Check {
+	return func(context.Context) []Alert {
+		var alerts []Alert
+		for _, path := range paths {
+			notAfter, err := certNotAfter(path)
+			if err != nil {
+				alerts = append(alerts, Alert{
+					Key:      "tls.cert.unreadable:" + path,
+					Severity: Warning,
+					Summary:  fmt.Sprintf("cannot check certificate %s", path),
+					Detail:   err.Error(),
+				})
+				continue
+			}
+			left := time.Until(notAfter)
+			if left > within {
+				continue
+			}
+			severity, summary := Warning, fmt.Sprintf("certificate %s expires in %s", path, left.Round(time.Hour))
+			if left <= 0 {
+				severity, summary = Critical, fmt.Sprintf("certificate %s has expired", path)
+			}
+			alerts = append(alerts, Alert{
+				Key:      "tls.cert.expiry:" + path,
+				Severity: severity,
+				Summary:  summary,
+				Detail:   "not after " + notAfter.UTC().Format(time.RFC3339),
+			})
+		}
+		return alerts
+	}
+}
+
+// certNotAfter returns the earliest expiry of the certificates in a PEM file.
+func certNotAfter(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var earliest time.Time
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+	if earliest.IsZero() {
+		return time.Time{}, errors.New("no certificate found")
+	}
+	return earliest, nil
+}
+
+// WatchStorage returns s with failed writes raised on bus.
+func WatchStorage(s vault.Storage, bus *Bus) vault.Storage {
+	return &watchedStorage{Storage: s, bus: bus}
+}
+
+type watchedStorage struct {
+	vault.Storage
+	bus *Bus
+}
+
+func (w *watchedStorage) Put(ctx context.Context, key string, data []byte) error {
+	err := w.Storage.Put(ctx, key, data)
+	if err != nil && ctx.Err() == nil {
+		w.bus.Raise(Alert{
+			Key:      "storage.write",
+			Severity: Critical,
+			Summary:  "vault storage write failed",
+			Detail:   err.Error(),
+		})
+	}
+	return err
+}
+
+// Verify checks the object at key in the watched storage; see
+// vault.Verifier.
+func (w *watchedStorage) Verify(ctx context.Context, key string) error {
+	return vault.VerifyObject(ctx, w.Storage, key)
+}
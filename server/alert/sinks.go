@@ -0,0 +1,156 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"mulamail/config"
+	"mulamail/mail"
+)
+
+// LogSink writes alerts to the server log.
+type LogSink struct{}
+
+func (LogSink) Send(_ context.Context, a Alert) error {
+	if a.Suppressed > 0 {
+		log.Printf("ALERT [%s] %s: %s (%d repeats suppressed) %s", a.Severity, a.Key, a.Summary, a.Suppressed, a.Detail)
+	} else {
+		log.Printf("ALERT [%s] %s: %s %s", a.Severity, a.Key, a.Summary, a.Detail)
+	}
+	return nil
+}
+
+// WebhookSink POSTs each alert as JSON to URL.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client // nil = a client with a 10s timeout
+}
+
+func (s *WebhookSink) Send(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SMTPSink mails each alert to the operators in To.
+type SMTPSink struct {
+	Host   string
+	Port   int
+	User   string // empty skips authentication
+	Pass   string
+	From   string
+	To     []string
+	Dialer mail.Dialer // nil = direct connection
+}
+
+func (s *SMTPSink) Send(ctx context.Context, a Alert) error {
+	client := mail.NewSMTPClient(mail.SMTPConfig{
+		Host:   s.Host,
+		Port:   s.Port,
+		User:   s.User,
+		Pass:   []byte(s.Pass), // the client zeroes its copy
+		UseSSL: s.Port == 465,
+		Dialer: s.Dialer,
+	})
+	defer client.Close()
+	if err := client.Connect(ctx); err != nil {
+		return err
+	}
+	if err := client.Handshake(ctx); err != nil {
+		return err
+	}
+	if s.User != "" {
+		if err := client.Auth(ctx); err != nil {
+			return err
+		}
+	}
+
+	to := make([]mail.Address, len(s.To))
+	for i, addr := range s.To {
+		to[i] = mail.Address{Email: addr}
+	}
+	body := fmt.Sprintf("%s\r\n\r\nKey: %s\r\nSeverity: %s\r\nTime: %s\r\n",
+		a.Summary, a.Key, a.Severity, a.Time.UTC().Format(time.RFC3339))
+	if a.Detail != "" {
+		body += "\r\n" + a.Detail + "\r\n"
+	}
+	if a.Suppressed > 0 {
+		body += fmt.Sprintf("\r\n%d repeats of this alert were suppressed.\r\n", a.Suppressed)
+	}
+	_, err := client.Send(ctx, mail.SendRequest{
+		From:     s.From,
+		FromName: "MulaMail alerts",
+		To:       to,
+		Subject:  fmt.Sprintf("[%s] %s", a.Severity, a.Summary),
+		Body:     body,
+	})
+	return err
+}
+
+// SinksFromConfig builds the sinks named in cfg.AlertSinks.
+func SinksFromConfig(cfg *config.Config) ([]Sink, error) {
+	var sinks []Sink
+	for _, name := range strings.Split(cfg.AlertSinks, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case "log":
+			sinks = append(sinks, LogSink{})
+		case "webhook":
+			if cfg.AlertWebhookURL == "" {
+				return nil, fmt.Errorf("alert sink webhook: ALERT_WEBHOOK_URL is not set")
+			}
+			sinks = append(sinks, &WebhookSink{URL: cfg.AlertWebhookURL.Reveal()})
+		case "smtp":
+			if cfg.AlertSMTPHost == "" || cfg.AlertSMTPFrom == "" || cfg.AlertSMTPTo == "" {
+				return nil, fmt.Errorf("alert sink smtp: ALERT_SMTP_HOST, ALERT_SMTP_FROM and ALERT_SMTP_TO are required")
+			}
+			dialer, err := mail.NewDialer(cfg.OutboundProxy.Reveal(), cfg.OutboundBindIP)
+			if err != nil {
+				return nil, fmt.Errorf("alert sink smtp: %s", cfg.OutboundProxy.Redact(err.Error()))
+			}
+			var to []string
+			for _, addr := range strings.Split(cfg.AlertSMTPTo, ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					to = append(to, addr)
+				}
+			}
+			sinks = append(sinks, &SMTPSink{
+				Host:   cfg.AlertSMTPHost,
+				Port:   cfg.AlertSMTPPort,
+				User:   cfg.AlertSMTPUser,
+				Pass:   cfg.AlertSMTPPass.Reveal(),
+				From:   cfg.AlertSMTPFrom,
+				To:     to,
+				Dialer: dialer,
+			})
+		default:
+			return nil, fmt.Errorf("unknown alert sink %q (must be log, webhook or smtp)", name)
+		}
+	}
+	return sinks, nil
+}
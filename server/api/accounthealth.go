@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"mulamail/db"
+)
+
+// Backoff after failed POP3 logins: 1m, 2m, 4m, ... capped at 6h.  An
+// account that keeps failing is reported as needing attention once it has
+// failed accountAttentionFailures times in a row.
+const (
+	accountBackoffBase       = time.Minute
+	accountBackoffMax        = 6 * time.Hour
+	accountAttentionFailures = 3
+)
+
+// accountBackoff returns the pause before an account that has failed to log
+// in failures times in a row is polled again.
+func accountBackoff(failures int) time.Duration {
+	d := accountBackoffBase
+	for i := 1; i < failures && d < accountBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, accountBackoffMax)
+}
+
+// recordLogin updates acc's health after a POP3 login attempt that ended
+// with err.  A failure extends the account's backoff; a success clears it.
+// Attempts cut short by the caller's context say nothing about the account
+// and are not recorded.  Health is advisory, so failures to store it are
+// only logged.
+func (s *Server) recordLogin(ctx context.Context, acc *db.MailAccount, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	h, getErr := s.db.GetAccountHealth(ctx, acc.OwnerPubKey, acc.AccountEmail)
+	switch {
+	case errors.Is(getErr, db.ErrNotFound):
+		if err == nil {
+			return // healthy and never failed
+		}
+		h = &db.AccountHealth{OwnerPubKey: acc.OwnerPubKey, AccountEmail: acc.AccountEmail}
+	case getErr != nil:
+		log.Printf("[%s] account health %s: %v", requestID(ctx), acc.AccountEmail, getErr)
+		return
+	case err == nil && h.ConsecutiveFailures == 0:
+		return
+	}
+
+	if err == nil {
+		h.ConsecutiveFailures = 0
+		h.LastError = ""
+		h.NextRetryAt = time.Time{}
+	} else {
+		now := time.Now()
+		h.ConsecutiveFailures++
+		h.LastError = publicError(err)
+		h.LastFailureAt = now
+		h.NextRetryAt = now.Add(accountBackoff(h.ConsecutiveFailures))
+	}
+	if err := s.db.SetAccountHealth(ctx, h); err != nil {
+		log.Printf("[%s] account health %s: %v", requestID(ctx), acc.AccountEmail, err)
+	}
+}
+
+// recordFetch stores the outcome of an inbox fetch of the owner's account in
+// its stats: err is why the login or LIST failed, or nil when count messages
+// were listed.  Like health, stats are advisory, so failures to store them
+// are only logged.
+func (s *Server) recordFetch(ctx context.Context, owner, account string, count int, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	status := db.FetchOK
+	if err != nil {
+		status = db.FetchFailed
+	}
+	if err := s.db.UpdateMailAccountStats(ctx, owner, account, time.Now(), status, count); err != nil {
+		log.Printf("[%s] account stats %s: %v", requestID(ctx), account, err)
+	}
+}
+
+// Account health states.
+const (
+	accountOK             = "ok"              // the last login succeeded
+	accountFailing        = "failing"         // recent logins failed; backing off
+	accountNeedsAttention = "needs_attention" // logins keep failing; check the credentials
+)
+
+// accountHealthView is one account's entry in GET /api/v1/accounts/health.
+type accountHealthView struct {
+	AccountEmail        string    `json:"account_email"`
+	Status              string    `json:"status"` // accountOK, accountFailing or accountNeedsAttention
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastFailureAt       time.Time `json:"last_failure_at,omitzero"`
+	NextRetryAt         time.Time `json:"next_retry_at,omitzero"` // the unified inbox skips the account until then
+}
+
+// GET /api/v1/accounts/health?owner=<pubkey>
+//
+// Reports the POP3 login health of each of the owner's accounts, so a
+// client can tell the user which credentials need attention.  Health is
+// updated by every login the server makes for the account.
+func (s *Server) accountHealth(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	accs, err := s.db.GetMailAccountsByOwner(r.Context(), owner)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	health, err := s.db.GetAccountHealthByOwner(r.Context(), owner)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	byEmail := make(map[string]db.AccountHealth, len(health))
+	for _, h := range health {
+		byEmail[h.AccountEmail] = h
+	}
+
+	views := make([]accountHealthView, len(accs))
+	for i, acc := range accs {
+		h := byEmail[acc.AccountEmail]
+		views[i] = accountHealthView{
+			AccountEmail:        acc.AccountEmail,
+			Status:              accountStatus(h.ConsecutiveFailures),
+			ConsecutiveFailures: h.ConsecutiveFailures,
+			LastError:           h.LastError,
+			LastFailureAt:       h.LastFailureAt,
+			NextRetryAt:         h.NextRetryAt,
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// accountStatus classifies an account by its consecutive login failures.
+func accountStatus(failures int) string {
+	switch {
+	case failures == 0:
+		return accountOK
+	case failures < accountAttentionFailures:
+		return accountFailing
+	default:
+		return accountNeedsAttention
+	}
+}
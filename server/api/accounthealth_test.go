@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mulamail/db"
+)
+
+func TestAccountBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := accountBackoff(tt.failures); got != tt.want {
+			t.Errorf("%d failures: want %v, got %v", tt.failures, tt.want, got)
+		}
+	}
+}
+
+func TestAccountHealth_BackoffAndRecovery(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	// A closed local port, so the login fails fast.
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", "127.0.0.1", 1)
+
+	inboxAll := func() map[string]string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.fetchInboxAll(w, httptest.NewRequest("GET", "/api/v1/mail/inbox/all?owner=owner", nil))
+		var response struct {
+			PerAccountErrors map[string]string `json:"per_account_errors"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		return response.PerAccountErrors
+	}
+	inbox := func() int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil))
+		return w.Code
+	}
+	health := func() accountHealthView {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.accountHealth(w, httptest.NewRequest("GET", "/api/v1/accounts/health?owner=owner", nil))
+		var views []accountHealthView
+		json.NewDecoder(w.Body).Decode(&views)
+		if len(views) != 1 {
+			t.Fatalf("want 1 account, got %+v", views)
+		}
+		return views[0]
+	}
+
+	if h := health(); h.Status != accountOK || !h.NextRetryAt.IsZero() {
+		t.Errorf("before any login: unexpected %+v", h)
+	}
+
+	if errs := inboxAll(); errs["me@example.com"] == "" {
+		t.Fatal("expected the failed login to be reported")
+	}
+	h := health()
+	if h.Status != accountFailing || h.ConsecutiveFailures != 1 || h.LastError == "" {
+		t.Errorf("after one failure: unexpected %+v", h)
+	}
+	if wait := time.Until(h.NextRetryAt); wait <= 0 || wait > accountBackoffBase {
+		t.Errorf("next retry in %v, want within %v", wait, accountBackoffBase)
+	}
+
+	// While backing off, the unified inbox skips the account...
+	if errs := inboxAll(); !strings.HasPrefix(errs["me@example.com"], "skipped until") {
+		t.Errorf("expected the account to be skipped, got %q", errs["me@example.com"])
+	}
+	if h := health(); h.ConsecutiveFailures != 1 {
+		t.Errorf("a skipped account must not be logged in to: %+v", h)
+	}
+
+	// ...but fetching it on its own still tries.
+	for range accountAttentionFailures - 1 {
+		if code := inbox(); code != http.StatusServiceUnavailable {
+			t.Fatalf("inbox: want %d, got %d", http.StatusServiceUnavailable, code)
+		}
+	}
+	if h := health(); h.Status != accountNeedsAttention || h.ConsecutiveFailures != accountAttentionFailures {
+		t.Errorf("after %d failures: unexpected %+v", accountAttentionFailures, h)
+	}
+
+	// A successful login resets the backoff at once.
+	pop := &fakePOP3{messages: map[int]string{1: "Subject: one\r\n"}}
+	host, port := pop.start(t)
+	mockDB.Accounts["owner"][0].POP3.Host, mockDB.Accounts["owner"][0].POP3.Port = host, port
+	if code := inbox(); code != http.StatusOK {
+		t.Fatalf("inbox: want %d, got %d", http.StatusOK, code)
+	}
+	if h := health(); h.Status != accountOK || h.ConsecutiveFailures != 0 || h.LastError != "" || !h.NextRetryAt.IsZero() {
+		t.Errorf("after recovery: unexpected %+v", h)
+	}
+	if errs := inboxAll(); len(errs) != 0 {
+		t.Errorf("after recovery: unexpected errors %v", errs)
+	}
+}
+
+func TestAccountHealth_MissingOwner(t *testing.T) {
+	server, _ := setupTestServer(t)
+	w := httptest.NewRecorder()
+	server.accountHealth(w, httptest.NewRequest("GET", "/api/v1/accounts/health", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAccountStats(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	pop := &fakePOP3{messages: map[int]string{1: "Subject: one\r\n", 2: "Subject: two\r\n", 3: "Subject: three\r\n"}}
+	host, port := pop.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	stats := func() db.MailAccount {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.listAccounts(w, httptest.NewRequest("GET", "/api/v1/accounts?owner=owner", nil))
+		var accs []db.MailAccount
+		json.NewDecoder(w.Body).Decode(&accs)
+		if len(accs) != 1 {
+			t.Fatalf("want 1 account, got %s", w.Body.String())
+		}
+		return accs[0]
+	}
+
+	if acc := stats(); !acc.LastFetchAt.IsZero() || acc.LastFetchStatus != "" || acc.MessageCount != 0 {
+		t.Errorf("before any fetch: unexpected %+v", acc)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com&limit=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("inbox: status %d: %s", w.Code, w.Body.String())
+	}
+	acc := stats()
+	if acc.LastFetchStatus != db.FetchOK || acc.MessageCount != 3 || acc.LastFetchAt.Before(start.Truncate(time.Second)) {
+		t.Errorf("after a fetch: want status ok and 3 messages, got %+v", acc)
+	}
+
+	// A failed fetch from the unified inbox keeps the last count.
+	mockDB.Accounts["owner"][0].POP3.Host, mockDB.Accounts["owner"][0].POP3.Port = "127.0.0.1", 1
+	server.fetchInboxAll(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/mail/inbox/all?owner=owner", nil))
+	failed := stats()
+	if failed.LastFetchStatus != db.FetchFailed || failed.MessageCount != 3 || failed.LastFetchAt.Before(acc.LastFetchAt) {
+		t.Errorf("after a failed fetch: want status failed and the count kept, got %+v", failed)
+	}
+}
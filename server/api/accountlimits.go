@@ -0,0 +1,65 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"mulamail/db"
+)
+
+// accountLimitReached is the error code of an account refused because the
+// owner has as many as they may register.
+const accountLimitReached = "account_limit"
+
+// accountLimitWarning is the response header that warns an owner nearing
+// their account limit.
+const accountLimitWarning = "X-Account-Limit-Warning"
+
+// accountLimitRefusal is the reply to an account refused by the hard cap.
+type accountLimitRefusal struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+	Limit int    `json:"limit"`
+}
+
+// checkAccountLimit refuses a new account with 403 once the owner has
+// limits.MaxAccounts of them, the count before the new one being n.  It
+// reports whether the account may be added, having written the reply when
+// it may not.
+func checkAccountLimit(w http.ResponseWriter, limits db.SendLimits, n int64) bool {
+	if limits.MaxAccounts <= 0 || n < int64(limits.MaxAccounts) {
+		return true
+	}
+	writeJSON(w, http.StatusForbidden, accountLimitRefusal{
+		Error: fmt.Sprintf("account limit reached: %d of %d accounts registered", n, limits.MaxAccounts),
+		Code:  accountLimitReached,
+		Limit: limits.MaxAccounts,
+	})
+	return false
+}
+
+// warnAccountLimit sets the X-Account-Limit-Warning header once the owner
+// has reached limits.WarnAccounts accounts, n of them in all.
+func warnAccountLimit(w http.ResponseWriter, limits db.SendLimits, n int64) {
+	if limits.WarnAccounts <= 0 || n < int64(limits.WarnAccounts) {
+		return
+	}
+	msg := fmt.Sprintf("%d accounts registered; the soft limit is %d", n, limits.WarnAccounts)
+	if limits.MaxAccounts > 0 {
+		msg += fmt.Sprintf(" and the hard limit %d", limits.MaxAccounts)
+	}
+	w.Header().Set(accountLimitWarning, msg)
+}
+
+// capAccounts keeps the owner's oldest limits.MaxAccounts accounts, so
+// that an owner over the cap, as after it was lowered, does not fan out to
+// the others.  It returns those kept and the emails of those left out.
+func capAccounts(accs []db.MailAccount, limits db.SendLimits) (kept []db.MailAccount, over []string) {
+	if limits.MaxAccounts <= 0 || len(accs) <= limits.MaxAccounts {
+		return accs, nil
+	}
+	for _, acc := range accs[limits.MaxAccounts:] {
+		over = append(over, acc.AccountEmail)
+	}
+	return accs[:limits.MaxAccounts], over
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mulamail/db"
+)
+
+func addOwnerAccount(server *Server, email string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey": "owner", "account_email": email,
+		"pop3": map[string]any{"host": "pop.example.com", "port": 995, "user": "u", "pass": "p"},
+		"smtp": map[string]any{"host": "smtp.example.com", "port": 587, "user": "u", "pass": "p"},
+	})
+	w := httptest.NewRecorder()
+	server.addAccount(w, httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewBuffer(body)))
+	return w
+}
+
+func TestAddAccount_AccountLimits(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.MaxAccounts, server.cfg.WarnAccounts = 3, 2
+
+	for i, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		w := addOwnerAccount(server, email)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: want 201, got %d: %s", email, w.Code, w.Body.String())
+		}
+		warning := w.Header().Get(accountLimitWarning)
+		if (i+1 >= 2) != (warning != "") {
+			t.Errorf("%s (account %d): unexpected warning %q", email, i+1, warning)
+		}
+		if i == 2 && !strings.Contains(warning, "hard limit 3") {
+			t.Errorf("warning should name the hard limit: %q", warning)
+		}
+	}
+
+	w := addOwnerAccount(server, "d@example.com")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("past the cap: want 403, got %d: %s", w.Code, w.Body.String())
+	}
+	var refusal accountLimitRefusal
+	json.NewDecoder(w.Body).Decode(&refusal)
+	if refusal.Code != accountLimitReached || refusal.Limit != 3 {
+		t.Errorf("unexpected refusal %+v", refusal)
+	}
+	if n := len(mockDB.Accounts["owner"]); n != 3 {
+		t.Errorf("want 3 accounts stored, got %d", n)
+	}
+
+	// A paying customer's override lifts the cap.
+	mockDB.SetSendLimits(context.Background(), &db.SendLimits{OwnerPubKey: "owner", MaxAccounts: 10, WarnAccounts: 8})
+	if w := addOwnerAccount(server, "d@example.com"); w.Code != http.StatusCreated || w.Header().Get(accountLimitWarning) != "" {
+		t.Errorf("with an override: want 201 without warning, got %d %q", w.Code, w.Header().Get(accountLimitWarning))
+	}
+}
+
+func TestFetchInboxAll_AccountCap(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.MaxAccounts = 2
+	passEnc, _ := server.cfg.EncryptionKey.EncryptString("pass")
+
+	// Closed local port: the connects fail fast.
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		mockDB.CreateMailAccount(context.Background(), &db.MailAccount{
+			OwnerPubKey:  "owner",
+			AccountEmail: email,
+			POP3:         db.POP3Settings{Host: "127.0.0.1", Port: 1, User: "u", PassEnc: passEnc},
+		})
+	}
+
+	w := httptest.NewRecorder()
+	server.fetchInboxAll(w, httptest.NewRequest("GET", "/api/v1/mail/inbox/all?owner=owner", nil))
+	var resp inboxAllResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	if got := resp.PerAccountErrors["c@example.com"]; !strings.Contains(got, "beyond the limit of 2 accounts") {
+		t.Errorf("the account over the cap must be skipped, got %q", got)
+	}
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		if got := resp.PerAccountErrors[email]; got == "" || strings.Contains(got, "beyond the limit") {
+			t.Errorf("%s is within the cap and must be fetched, got %q", email, got)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+// requireAdmin guards operator endpoints with the ADMIN_TOKEN bearer token.
+// When no token is configured the endpoints behave as if they don't exist.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken == "" {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken.Reveal())) != 1 {
+			writeError(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// sendLimitsResponse is an owner's effective send limits.
+type sendLimitsResponse struct {
+	OwnerPubKey     string   `json:"owner_pubkey"`
+	MaxRecipients   int      `json:"max_recipients"`
+	MaxMessageBytes int      `json:"max_message_bytes"`
+	MaxDailySends   int      `json:"max_daily_sends"` // per mail account and UTC day; 0 = no cap
+	MaxAccounts     int      `json:"max_accounts"`    // mail accounts the owner may register; 0 = no cap
+	WarnAccounts    int      `json:"warn_accounts"`   // adding an account once the owner has this many warns; 0 = never
+	Trusted         bool     `json:"trusted"`         // exempt from the unknown-recipient check
+	AllowedDomains  []string `json:"allowed_domains"` // the only recipient domains, subdomains included; empty allows all
+	BlockedDomains  []string `json:"blocked_domains"` // recipient domains refused, subdomains included
+	Override        bool     `json:"override"`        // true when set by a per-owner override
+}
+
+// GET /api/v1/admin/send-limits?owner=<pubkey>
+//
+// Returns the effective send limits for the owner and whether they come
+// from a per-owner override.
+func (s *Server) getSendLimits(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	limits, override, err := s.sendLimits(r.Context(), owner)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sendLimitsResponse{
+		OwnerPubKey:     owner,
+		MaxRecipients:   limits.MaxRecipients,
+		MaxMessageBytes: limits.MaxMessageBytes,
+		MaxDailySends:   limits.MaxDailySends,
+		MaxAccounts:     limits.MaxAccounts,
+		WarnAccounts:    limits.WarnAccounts,
+		Trusted:         limits.Trusted,
+		AllowedDomains:  limits.AllowedDomains,
+		BlockedDomains:  limits.BlockedDomains,
+		Override:        override,
+	})
+}
+
+// PUT /api/v1/admin/send-limits
+//
+// Sets per-owner overrides for trusted senders.  A zero or omitted value
+// falls back to the deployment default.  "trusted" lets the owner address
+// any number of recipients they have no contact history with.  Non-empty
+// "allowed_domains" and "blocked_domains" replace SEND_ALLOWED_DOMAINS and
+// SEND_BLOCKED_DOMAINS for the owner.
+//
+// Request: { "owner_pubkey": "...", "max_recipients": 500, "max_message_bytes": 52428800,
+// "max_daily_sends": 2000, "max_accounts": 100, "warn_accounts": 80, "trusted": true, "allowed_domains": ["example.com"], "blocked_domains": [] }
+func (s *Server) putSendLimits(w http.ResponseWriter, r *http.Request) {
+	var req db.SendLimits
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.OwnerPubKey == "" {
+		writeError(w, http.StatusBadRequest, "owner_pubkey required")
+		return
+	}
+	if req.MaxRecipients < 0 || req.MaxMessageBytes < 0 || req.MaxDailySends < 0 || req.MaxAccounts < 0 || req.WarnAccounts < 0 {
+		writeError(w, http.StatusBadRequest, "limits must not be negative")
+		return
+	}
+	for _, list := range []*[]string{&req.AllowedDomains, &req.BlockedDomains} {
+		domains, err := mail.NewDomainList(*list)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		*list = domains
+	}
+	if err := s.db.SetSendLimits(r.Context(), &req); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// sendLimits resolves the effective limits for owner: the deployment
+// defaults, with any non-zero per-owner override and the owner's trust
+// flag applied on top.  serve refuses to start with invalid domain lists,
+// so they parse here.
+func (s *Server) sendLimits(ctx context.Context, owner string) (db.SendLimits, bool, error) {
+	allowed, _ := mail.ParseDomainList(s.cfg.SendAllowedDomains)
+	blocked, _ := mail.ParseDomainList(s.cfg.SendBlockedDomains)
+	limits := db.SendLimits{
+		OwnerPubKey:     owner,
+		MaxRecipients:   s.cfg.MaxRecipients,
+		MaxMessageBytes: s.cfg.MaxMessageBytes,
+		MaxDailySends:   s.cfg.MaxDailySends,
+		MaxAccounts:     s.cfg.MaxAccounts,
+		WarnAccounts:    s.cfg.WarnAccounts,
+		AllowedDomains:  allowed,
+		BlockedDomains:  blocked,
+	}
+	o, err := s.db.GetSendLimits(ctx, owner)
+	if errors.Is(err, db.ErrNotFound) {
+		return limits, false, nil
+	}
+	if err != nil {
+		return limits, false, err
+	}
+	if o.MaxRecipients > 0 {
+		limits.MaxRecipients = o.MaxRecipients
+	}
+	if o.MaxMessageBytes > 0 {
+		limits.MaxMessageBytes = o.MaxMessageBytes
+	}
+	if o.MaxDailySends > 0 {
+		limits.MaxDailySends = o.MaxDailySends
+	}
+	if o.MaxAccounts > 0 {
+		limits.MaxAccounts = o.MaxAccounts
+	}
+	if o.WarnAccounts > 0 {
+		limits.WarnAccounts = o.WarnAccounts
+	}
+	if len(o.AllowedDomains) > 0 {
+		limits.AllowedDomains = o.AllowedDomains
+	}
+	if len(o.BlockedDomains) > 0 {
+		limits.BlockedDomains = o.BlockedDomains
+	}
+	limits.Trusted = o.Trusted
+	return limits, true, nil
+}
+
+// metricsResponse holds the server's in-process counters and the current
+// leader of each background worker role.
+type metricsResponse struct {
+	IdentityCache identityCacheStats       `json:"identity_cache"`
+	InFlight      map[string]inflightStats `json:"in_flight"`
+	CacheGC       cacheGCStats             `json:"cache_gc"`
+	Leaders       map[string]leaderStatus  `json:"leaders"`
+}
+
+// GET /api/v1/admin/metrics
+//
+// Reports in-process counters.  They reset when the server restarts and
+// cover this instance only.  Leaders are shared by every instance: each
+// worker role with a live lease is listed with the instance holding it.
+//
+// Response: { "identity_cache": { "hits": 0, "misses": 0, "entries": 0, "capacity": 10000 },
+// "in_flight": { "global": { "in_flight": 3, "limit": 512 }, "mail": { ... }, ... },
+// "cache_gc": { "runs": 1, "failures": 0, "deleted": 40, "last_run": "...", "last": { ... } },
+// "leaders": { "outbox": { "holder": "mail-1-42", "expires_at": "...", "this_instance": true }, ... } }
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	leaders, err := s.leaders(r.Context())
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, metricsResponse{
+		IdentityCache: s.identities.stats(),
+		InFlight:      s.inflight.stats(),
+		CacheGC:       cacheGCMetrics(),
+		Leaders:       leaders,
+	})
+}
+
+// auditEventsResponse lists an owner's audit events, newest first.
+type auditEventsResponse struct {
+	Owner  string          `json:"owner"`
+	Events []db.AuditEvent `json:"events"`
+}
+
+// GET /api/v1/admin/audit-events?owner=<pubkey>&limit=20
+//
+// Lists the owner's most recent audit events, such as deletion requests and
+// their outcome.  They are kept after the owner's data is erased.
+func (s *Server) listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	events, err := s.db.GetAuditEvents(r.Context(), owner, inboxLimit(r))
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, auditEventsResponse{Owner: owner, Events: events})
+}
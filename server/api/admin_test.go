@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"mulamail/config"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	server, _ := setupTestServer(t)
+	handler := server.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	testCases := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"disabled without token", "", "Bearer anything", http.StatusNotFound},
+		{"missing header", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer nope", http.StatusUnauthorized},
+		{"wrong scheme", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"valid token", "s3cret", "Bearer s3cret", http.StatusNoContent},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server.cfg.AdminToken = config.Secret(tc.token)
+			req := httptest.NewRequest("GET", "/api/v1/admin/send-limits", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if w.Code != tc.want {
+				t.Errorf("status code: want %d, got %d", tc.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestSendLimits_OverrideRoundTrip(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+
+	server.cfg.SendBlockedDomains = "spam.example.net"
+	body, _ := json.Marshal(map[string]any{"owner_pubkey": "trusted", "max_recipients": 500, "trusted": true, "allowed_domains": []string{"Corp.Example.com."}})
+	req := httptest.NewRequest("PUT", "/api/v1/admin/send-limits", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/admin/send-limits?owner=trusted", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var response struct {
+		MaxRecipients   int      `json:"max_recipients"`
+		MaxMessageBytes int      `json:"max_message_bytes"`
+		Trusted         bool     `json:"trusted"`
+		AllowedDomains  []string `json:"allowed_domains"`
+		BlockedDomains  []string `json:"blocked_domains"`
+		Override        bool     `json:"override"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.MaxRecipients != 500 || !response.Trusted || !response.Override {
+		t.Errorf("expected override of 500 recipients, got %+v", response)
+	}
+	if response.MaxMessageBytes != server.cfg.MaxMessageBytes {
+		t.Errorf("max_message_bytes: want default %d, got %d", server.cfg.MaxMessageBytes, response.MaxMessageBytes)
+	}
+	if !slices.Equal(response.AllowedDomains, []string{"corp.example.com"}) || !slices.Equal(response.BlockedDomains, []string{"spam.example.net"}) {
+		t.Errorf("domains: want the normalised override and the default blocklist, got %v and %v", response.AllowedDomains, response.BlockedDomains)
+	}
+}
+
+func TestPutSendLimits_Invalid(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	for _, body := range []string{`invalid`, `{"max_recipients": 5}`, `{"owner_pubkey": "o", "max_recipients": -1}`, `{"owner_pubkey": "o", "max_daily_sends": -1}`,
+		`{"owner_pubkey": "o", "allowed_domains": ["*.example.com"]}`, `{"owner_pubkey": "o", "blocked_domains": ["user@example.com"]}`} {
+		req := httptest.NewRequest("PUT", "/api/v1/admin/send-limits", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+
+		server.putSendLimits(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: want %d, got %d", body, http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+const (
+	// aggregateWorkers bounds how many POP3 sessions a single unified-inbox
+	// request keeps open at once.
+	aggregateWorkers = 4
+	// aggregateTimeout bounds how long the slowest account may hold up a
+	// unified-inbox response.
+	aggregateTimeout = 30 * time.Second
+)
+
+// accountMessage is an inbox preview annotated with the account it came from.
+type accountMessage struct {
+	*mail.Message
+	Account        string          `json:"account"`
+	SenderIdentity *senderIdentity `json:"sender_identity"`
+}
+
+// inboxAllResponse is the unified inbox.  PerAccountErrors maps an account
+// to the reason its previews are missing.
+type inboxAllResponse struct {
+	Owner            string            `json:"owner"`
+	Messages         []accountMessage  `json:"messages"`
+	PerAccountErrors map[string]string `json:"per_account_errors"`
+}
+
+// GET /api/v1/mail/inbox/all?owner=<pubkey>&limit=<N>[&preview_max_bytes=<N>][&include_duplicates=true]
+//
+// Fetches previews from every account owned by the pubkey concurrently and
+// merges them newest first.  An account that fails or exceeds the request
+// timeout is reported in per_account_errors instead of failing the response,
+// as is one skipped because recent logins to it failed (see accountHealth);
+// fetching that account on its own retries it at once.  Only the owner's
+// oldest MaxAccounts accounts are fetched (see capAccounts); the others
+// are reported as skipped.  Senders are
+// resolved to identities once, across all accounts; see resolveSenders.
+// Each account's duplicates are left out as in fetchInbox; the same message
+// in two accounts is listed under both.  snippets=true adds snippets as in
+// fetchInbox.
+func (s *Server) fetchInboxAll(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	accs, err := s.db.GetMailAccountsByOwner(r.Context(), owner)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	limits, _, err := s.sendLimits(r.Context(), owner)
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "account limits unavailable", err)
+		return
+	}
+	health, err := s.db.GetAccountHealthByOwner(r.Context(), owner)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	perAccountErrors := make(map[string]string)
+	accs, over := capAccounts(accs, limits)
+	for _, email := range over {
+		perAccountErrors[email] = fmt.Sprintf("skipped: beyond the limit of %d accounts", limits.MaxAccounts)
+	}
+	now := time.Now()
+	for _, h := range health {
+		if h.NextRetryAt.After(now) {
+			perAccountErrors[h.AccountEmail] = fmt.Sprintf("skipped until %s after %d failed logins: %s",
+				h.NextRetryAt.UTC().Format(time.RFC3339), h.ConsecutiveFailures, h.LastError)
+		}
+	}
+	accs = slices.DeleteFunc(accs, func(acc db.MailAccount) bool {
+		_, skip := perAccountErrors[acc.AccountEmail]
+		return skip
+	})
+	limit, dups, snippets := inboxLimit(r), includeDuplicates(r), includeSnippets(r)
+	maxBytes, err := s.previewMaxBytes(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), aggregateTimeout)
+	defer cancel()
+
+	type result struct {
+		account  string
+		messages []*mail.Message
+		err      error
+	}
+	// Buffered so workers never block after the deadline has passed.
+	results := make(chan result, len(accs))
+	sem := make(chan struct{}, aggregateWorkers)
+	for i := range accs {
+		acc := &accs[i]
+		go func() {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results <- result{account: acc.AccountEmail, err: ctx.Err()}
+				return
+			}
+			msgs, err := s.fetchAccountPreviews(ctx, acc, limit, maxBytes, dups, snippets)
+			results <- result{account: acc.AccountEmail, messages: msgs, err: err}
+		}()
+	}
+
+	merged := make([]accountMessage, 0)
+	done := make(map[string]bool, len(accs))
+collect:
+	for len(done) < len(accs) {
+		select {
+		case res := <-results:
+			done[res.account] = true
+			if res.err != nil {
+				perAccountErrors[res.account] = publicError(res.err)
+				continue
+			}
+			for _, m := range res.messages {
+				merged = append(merged, accountMessage{Message: m, Account: res.account})
+			}
+		case <-ctx.Done():
+			for _, acc := range accs {
+				if !done[acc.AccountEmail] {
+					perAccountErrors[acc.AccountEmail] = "timed out"
+				}
+			}
+			break collect
+		}
+	}
+
+	sortNewestFirst(merged)
+	if len(merged) > limit {
+		merged = merged[:limit]
+	}
+	froms := make([]string, len(merged))
+	for i, m := range merged {
+		froms[i] = m.From
+	}
+	senders := s.resolveSenders(r.Context(), froms)
+	for i := range merged {
+		merged[i].SenderIdentity = senders[merged[i].From]
+	}
+
+	writeJSON(w, http.StatusOK, inboxAllResponse{
+		Owner:            owner,
+		Messages:         merged,
+		PerAccountErrors: perAccountErrors,
+	})
+}
+
+// fetchAccountPreviews opens a POP3 session for acc and returns its most
+// recent previews, those of messages over maxBytes skipped, with snippets
+// if asked for and, unless dups is set, duplicates left out.
+func (s *Server) fetchAccountPreviews(ctx context.Context, acc *db.MailAccount, limit, maxBytes int, dups, snippets bool) ([]*mail.Message, error) {
+	client, err := s.dialPOP3(ctx, acc)
+	if err != nil {
+		s.recordFetch(ctx, acc.OwnerPubKey, acc.AccountEmail, 0, err)
+		return nil, err
+	}
+	defer client.Close()
+
+	p, err := fetchPreviews(ctx, client, limit, maxBytes, snippets)
+	if err != nil {
+		s.recordFetch(ctx, acc.OwnerPubKey, acc.AccountEmail, 0, err)
+		return nil, err
+	}
+	s.recordFetch(ctx, acc.OwnerPubKey, acc.AccountEmail, p.Total, nil)
+	s.cachePreviews(ctx, client, acc.OwnerPubKey, acc.AccountEmail, p.Messages)
+	if !dups {
+		return mail.Dedup(p.Messages), nil
+	}
+	return p.Messages, nil
+}
+
+// sortNewestFirst orders merged previews by their parsed Date, newest first.
+// Messages whose date could not be parsed sink to the end in their original
+// order, since POP3 indices are not comparable across accounts.
+func sortNewestFirst(msgs []accountMessage) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		ti, tj := msgs[i].DateParsed, msgs[j].DateParsed
+		if ti.IsZero() != tj.IsZero() {
+			return !ti.IsZero()
+		}
+		return ti.After(tj)
+	})
+}
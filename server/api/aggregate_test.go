@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+func TestFetchInboxAll_MissingOwner(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox/all", nil)
+	w := httptest.NewRecorder()
+
+	server.fetchInboxAll(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestFetchInboxAll_NoAccounts(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox/all?owner=nobody", nil)
+	w := httptest.NewRecorder()
+
+	server.fetchInboxAll(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response struct {
+		Messages         []any             `json:"messages"`
+		PerAccountErrors map[string]string `json:"per_account_errors"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(response.Messages) != 0 {
+		t.Errorf("expected no messages, got %d", len(response.Messages))
+	}
+	if len(response.PerAccountErrors) != 0 {
+		t.Errorf("expected no errors, got %v", response.PerAccountErrors)
+	}
+}
+
+func TestFetchInboxAll_PartialFailure(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	passEnc, err := server.cfg.EncryptionKey.EncryptString("pass")
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	// Both accounts point at a closed local port so the connect fails fast.
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		mockDB.CreateMailAccount(context.Background(), &db.MailAccount{
+			OwnerPubKey:  "owner",
+			AccountEmail: email,
+			POP3:         db.POP3Settings{Host: "127.0.0.1", Port: 1, User: "u", PassEnc: passEnc},
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox/all?owner=owner", nil)
+	w := httptest.NewRecorder()
+
+	server.fetchInboxAll(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response struct {
+		PerAccountErrors map[string]string `json:"per_account_errors"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		if response.PerAccountErrors[email] == "" {
+			t.Errorf("expected error for %s", email)
+		}
+	}
+}
+
+func TestSortNewestFirst(t *testing.T) {
+	preview := func(id int, date string) *mail.Message {
+		m := &mail.Message{ID: id, Date: date}
+		m.DateParsed, _ = mail.ParseDate(date)
+		return m
+	}
+	msgs := []accountMessage{
+		{Message: preview(1, "Mon, 02 Oct 2023 10:00:00 +0000"), Account: "a"},
+		{Message: preview(2, "garbage"), Account: "a"},
+		{Message: preview(3, "Tue, 03 Oct 2023 10:00:00 +0000"), Account: "b"},
+		{Message: preview(4, "Sun, 01 Oct 2023 10:00:00 +0000"), Account: "b"},
+	}
+
+	sortNewestFirst(msgs)
+
+	want := []int{3, 1, 4, 2}
+	for i, id := range want {
+		if msgs[i].ID != id {
+			t.Errorf("position %d: want id %d, got %d", i, id, msgs[i].ID)
+		}
+	}
+}
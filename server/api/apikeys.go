@@ -0,0 +1,330 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"mulamail/blockchain"
+	"mulamail/db"
+)
+
+// API key scopes.  A key may only call routes whose scope it carries.
+const (
+	scopeMailRead      = "mail:read"
+	scopeMailSend      = "mail:send"
+	scopeAccountsRead  = "accounts:read"
+	scopeAccountsWrite = "accounts:write"
+	scopeContactsRead  = "contacts:read"
+	scopeContactsWrite = "contacts:write"
+)
+
+var apiKeyScopes = []string{scopeMailRead, scopeMailSend, scopeAccountsRead, scopeAccountsWrite,
+	scopeContactsRead, scopeContactsWrite}
+
+const (
+	// apiKeyPrefix starts every key, so keys are recognisable in headers
+	// and secret scanners.
+	apiKeyPrefix = "mk_"
+
+	// apiKeySignatureMaxAge bounds how far signed_at may be from the server
+	// clock, limiting how long a captured key request can be replayed.
+	apiKeySignatureMaxAge = 5 * time.Minute
+
+	// apiKeyTouchInterval throttles last_used_at writes for busy keys.
+	apiKeyTouchInterval = time.Minute
+
+	// errKeyOwner is the error for requests naming an owner other than the
+	// API key's.
+	errKeyOwner = "API key belongs to a different owner"
+)
+
+// createKeyPayload is the part of POST /api/v1/keys the owner's wallet
+// signs, as blockchain.CanonicalJSON.  Times are RFC 3339 strings so the
+// signed bytes are exactly what the client sent.
+type createKeyPayload struct {
+	Action      string   `json:"action"` // always "create-api-key"
+	OwnerPubKey string   `json:"owner_pubkey"`
+	Name        string   `json:"name"`
+	Scopes      []string `json:"scopes"`
+	ExpiresAt   string   `json:"expires_at"` // RFC 3339; empty never expires
+	SignedAt    string   `json:"signed_at"`  // RFC 3339
+}
+
+// createKeyRequest is the body of POST /api/v1/keys.
+type createKeyRequest struct {
+	createKeyPayload
+	Signature string `json:"signature"` // wallet signature over the payload
+}
+
+// createKeyResponse carries a new key.  Key is shown only in this response.
+type createKeyResponse struct {
+	Key string `json:"key"`
+	db.APIKey
+}
+
+// deleteKeyPayload is the part of DELETE /api/v1/keys/{id} the owner's
+// wallet signs.
+type deleteKeyPayload struct {
+	Action      string `json:"action"` // always "delete-api-key"
+	OwnerPubKey string `json:"owner_pubkey"`
+	KeyID       string `json:"key_id"`
+	SignedAt    string `json:"signed_at"` // RFC 3339
+}
+
+// deleteKeyRequest is the body of DELETE /api/v1/keys/{id}.
+type deleteKeyRequest struct {
+	deleteKeyPayload
+	Signature string `json:"signature"`
+}
+
+// POST /api/v1/keys
+//
+// Mints an API key for a partner service.  The request must be signed by
+// the owner's wallet; the key itself is returned exactly once and only its
+// SHA-256 hash is stored.
+//
+// Request: { "action": "create-api-key", "owner_pubkey": "...", "name": "...",
+// "scopes": ["mail:read"], "expires_at": "", "signed_at": "...", "signature": "..." }
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Action != "create-api-key" {
+		writeError(w, http.StatusBadRequest, `action must be "create-api-key"`)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeError(w, http.StatusBadRequest, "at least one scope is required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			writeError(w, http.StatusBadRequest, "unknown scope: "+scope)
+			return
+		}
+	}
+	var expiresAt time.Time
+	if req.ExpiresAt != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "expires_at must be an RFC 3339 timestamp")
+			return
+		}
+		if !t.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, "expires_at must be in the future")
+			return
+		}
+		expiresAt = t.UTC()
+	}
+	if code, msg := checkWalletSignature(req.OwnerPubKey, req.SignedAt, req.createKeyPayload, req.Signature); code != 0 {
+		writeError(w, code, msg)
+		return
+	}
+	if !s.useWalletSignature(w, r, req.SignedAt, req.Signature) {
+		return
+	}
+
+	key, err := newAPIKey()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	k := &db.APIKey{
+		KeyHash:     hashAPIKey(key),
+		Prefix:      key[:len(apiKeyPrefix)+8],
+		OwnerPubKey: req.OwnerPubKey,
+		Name:        strings.TrimSpace(req.Name),
+		Scopes:      req.Scopes,
+		ExpiresAt:   expiresAt,
+	}
+	if err := s.db.CreateAPIKey(r.Context(), k); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, createKeyResponse{Key: key, APIKey: *k})
+}
+
+// DELETE /api/v1/keys/{id}
+//
+// Revokes an API key.  Like minting, revocation is signed by the owner's
+// wallet, so a leaked key can be revoked without holding it.
+//
+// Request: { "action": "delete-api-key", "owner_pubkey": "...", "key_id": "...",
+// "signed_at": "...", "signature": "..." }
+func (s *Server) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req deleteKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Action != "delete-api-key" {
+		writeError(w, http.StatusBadRequest, `action must be "delete-api-key"`)
+		return
+	}
+	if req.KeyID != r.PathValue("id") {
+		writeError(w, http.StatusBadRequest, "key_id does not match the path")
+		return
+	}
+	if code, msg := checkWalletSignature(req.OwnerPubKey, req.SignedAt, req.deleteKeyPayload, req.Signature); code != 0 {
+		writeError(w, code, msg)
+		return
+	}
+	if !s.useWalletSignature(w, r, req.SignedAt, req.Signature) {
+		return
+	}
+
+	err := s.db.DeleteAPIKey(r.Context(), req.OwnerPubKey, req.KeyID)
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "no API key with that id")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Status: "deleted"})
+}
+
+// checkWalletSignature verifies that owner's wallet signed payload recently.
+// It returns a zero code on success, otherwise the status and message to
+// answer with.
+func checkWalletSignature(owner, signedAt string, payload any, signature string) (int, string) {
+	if owner == "" || signature == "" {
+		return http.StatusBadRequest, "owner_pubkey and signature are required"
+	}
+	t, err := time.Parse(time.RFC3339, signedAt)
+	if err != nil {
+		return http.StatusBadRequest, "signed_at must be an RFC 3339 timestamp"
+	}
+	if age := time.Since(t); age > apiKeySignatureMaxAge || age < -apiKeySignatureMaxAge {
+		return http.StatusUnauthorized, "signed_at is too far from the server time"
+	}
+	ok, err := blockchain.VerifySignedJSON(owner, payload, []byte(signature))
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	if !ok {
+		return http.StatusUnauthorized, "signature does not match owner_pubkey"
+	}
+	return 0, ""
+}
+
+// useWalletSignature makes a signature checkWalletSignature accepted
+// single-use, so that a captured request cannot be replayed while signed_at
+// is still within apiKeySignatureMaxAge.  It reports whether this is the
+// signature's first use, having answered 409 when it is not.  The use is
+// remembered until the window closes, after which checkWalletSignature
+// refuses the signature anyway.
+func (s *Server) useWalletSignature(w http.ResponseWriter, r *http.Request, signedAt, signature string) bool {
+	t, _ := time.Parse(time.RFC3339, signedAt) // checked by checkWalletSignature
+	sum := sha256.Sum256([]byte(signature))
+	err := s.db.UseSignature(r.Context(), hex.EncodeToString(sum[:]), t.Add(apiKeySignatureMaxAge))
+	if errors.Is(err, db.ErrDuplicate) {
+		writeError(w, http.StatusConflict, "this signature has already been used; sign the request again")
+		return false
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// newAPIKey returns a fresh random key: apiKeyPrefix and 32 hex-encoded bytes.
+func newAPIKey() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("generate key: %w", err)
+	}
+	return apiKeyPrefix + hex.EncodeToString(b[:]), nil
+}
+
+// hashAPIKey is the form in which keys are stored and looked up.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// withAPIKey authenticates requests carrying "Authorization: Bearer mk_..."
+// and requires the key to hold scope.  Requests without an API key pass
+// through unchanged.  An authenticated request acts for the key's owner:
+// the owner query parameter is filled in, and one naming a different owner
+// is refused.  Handlers taking the owner from the body use actingOwner.
+func (s *Server) withAPIKey(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !strings.HasPrefix(token, apiKeyPrefix) {
+			next(w, r)
+			return
+		}
+		key, err := s.db.GetAPIKeyByHash(r.Context(), hashAPIKey(token))
+		if errors.Is(err, db.ErrNotFound) || (err == nil && !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt)) {
+			writeError(w, http.StatusUnauthorized, "invalid or expired API key")
+			return
+		}
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		if !slices.Contains(key.Scopes, scope) {
+			writeError(w, http.StatusForbidden, "API key lacks the "+scope+" scope")
+			return
+		}
+		s.touchAPIKey(key)
+
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyKey, key))
+		q := r.URL.Query()
+		owner, ok := actingOwner(r, q.Get("owner"))
+		if !ok {
+			writeError(w, http.StatusForbidden, errKeyOwner)
+			return
+		}
+		q.Set("owner", owner)
+		u := *r.URL
+		u.RawQuery = q.Encode()
+		r.URL = &u
+		next(w, r)
+	}
+}
+
+// actingOwner returns the owner a request acts for.  Requests made with an
+// API key act for the key's owner and report false if owner names someone
+// else; other requests act for owner as given.
+func actingOwner(r *http.Request, owner string) (string, bool) {
+	key, ok := r.Context().Value(apiKeyKey).(*db.APIKey)
+	if !ok {
+		return owner, true
+	}
+	if owner != "" && owner != key.OwnerPubKey {
+		return "", false
+	}
+	return key.OwnerPubKey, true
+}
+
+// touchAPIKey records the use of key in the background, so the write stays
+// off the request path.  Keys used within apiKeyTouchInterval are skipped.
+func (s *Server) touchAPIKey(key *db.APIKey) {
+	now := time.Now()
+	if now.Sub(key.LastUsedAt) < apiKeyTouchInterval {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.db.TouchAPIKey(ctx, key.ID, now); err != nil {
+			log.Printf("api key %s: record use: %v", key.Prefix, err)
+		}
+	}()
+}
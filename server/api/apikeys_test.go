@@ -0,0 +1,289 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/blockchain"
+	"mulamail/db"
+)
+
+// signPayload returns the wallet signature over payload's canonical JSON.
+func signPayload(t *testing.T, wallet solana.PrivateKey, payload any) string {
+	t.Helper()
+	msg, err := blockchain.CanonicalJSON(payload)
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %v", err)
+	}
+	sig, err := wallet.Sign(msg)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return sig.String()
+}
+
+// mintKey creates an API key for wallet through router and returns it.
+func mintKey(t *testing.T, router http.Handler, wallet solana.PrivateKey, scopes ...string) createKeyResponse {
+	t.Helper()
+	req := createKeyRequest{createKeyPayload: createKeyPayload{
+		Action:      "create-api-key",
+		OwnerPubKey: wallet.PublicKey().String(),
+		Name:        "partner",
+		Scopes:      scopes,
+		SignedAt:    time.Now().UTC().Format(time.RFC3339),
+	}}
+	req.Signature = signPayload(t, wallet, req.createKeyPayload)
+	body, _ := json.Marshal(req)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/keys", bytes.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /api/v1/keys: want 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp createKeyResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return resp
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	wallet := solana.NewWallet().PrivateKey
+
+	resp := mintKey(t, router, wallet, scopeMailRead, scopeMailSend)
+	if !strings.HasPrefix(resp.Key, apiKeyPrefix) || !strings.HasPrefix(resp.Key, resp.Prefix) {
+		t.Errorf("unexpected key %q with prefix %q", resp.Key, resp.Prefix)
+	}
+	if resp.OwnerPubKey != wallet.PublicKey().String() || len(resp.Scopes) != 2 {
+		t.Errorf("unexpected key metadata: %+v", resp.APIKey)
+	}
+
+	if len(mockDB.APIKeys) != 1 {
+		t.Fatalf("expected 1 stored key, got %d", len(mockDB.APIKeys))
+	}
+	stored := mockDB.APIKeys[0]
+	if stored.KeyHash != hashAPIKey(resp.Key) || strings.Contains(stored.KeyHash, resp.Key[len(apiKeyPrefix):]) {
+		t.Errorf("key must be stored only as its SHA-256 hash, got %q", stored.KeyHash)
+	}
+}
+
+func TestCreateAPIKey_Replay(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	wallet := solana.NewWallet().PrivateKey
+
+	req := createKeyRequest{createKeyPayload: createKeyPayload{
+		Action:      "create-api-key",
+		OwnerPubKey: wallet.PublicKey().String(),
+		Scopes:      []string{scopeMailRead},
+		SignedAt:    time.Now().UTC().Format(time.RFC3339),
+	}}
+	req.Signature = signPayload(t, wallet, req.createKeyPayload)
+	body, _ := json.Marshal(req)
+
+	for i, want := range []int{http.StatusCreated, http.StatusConflict} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/keys", bytes.NewReader(body)))
+		if w.Code != want {
+			t.Errorf("request %d: want %d, got %d: %s", i+1, want, w.Code, w.Body.String())
+		}
+	}
+	if len(mockDB.APIKeys) != 1 {
+		t.Errorf("a replayed request must not mint another key: %d stored", len(mockDB.APIKeys))
+	}
+}
+
+func TestCreateAPIKey_Rejects(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	wallet := solana.NewWallet().PrivateKey
+	other := solana.NewWallet().PrivateKey
+
+	valid := func() createKeyPayload {
+		return createKeyPayload{
+			Action:      "create-api-key",
+			OwnerPubKey: wallet.PublicKey().String(),
+			Scopes:      []string{scopeMailRead},
+			SignedAt:    time.Now().UTC().Format(time.RFC3339),
+		}
+	}
+	testCases := []struct {
+		name   string
+		modify func(p *createKeyPayload)
+		signer solana.PrivateKey
+		want   int
+	}{
+		{"wrong action", func(p *createKeyPayload) { p.Action = "delete-api-key" }, wallet, http.StatusBadRequest},
+		{"no scopes", func(p *createKeyPayload) { p.Scopes = nil }, wallet, http.StatusBadRequest},
+		{"unknown scope", func(p *createKeyPayload) { p.Scopes = []string{"admin"} }, wallet, http.StatusBadRequest},
+		{"past expiry", func(p *createKeyPayload) { p.ExpiresAt = "2000-01-01T00:00:00Z" }, wallet, http.StatusBadRequest},
+		{"stale signature", func(p *createKeyPayload) {
+			p.SignedAt = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+		}, wallet, http.StatusUnauthorized},
+		{"signed by another wallet", func(p *createKeyPayload) {}, other, http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createKeyRequest{createKeyPayload: valid()}
+			tc.modify(&req.createKeyPayload)
+			req.Signature = signPayload(t, tc.signer, req.createKeyPayload)
+			body, _ := json.Marshal(req)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/keys", bytes.NewReader(body)))
+			if w.Code != tc.want {
+				t.Errorf("status code: want %d, got %d: %s", tc.want, w.Code, w.Body.String())
+			}
+		})
+	}
+	if len(mockDB.APIKeys) != 0 {
+		t.Errorf("no key should have been stored, got %d", len(mockDB.APIKeys))
+	}
+}
+
+func TestWithAPIKey(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	wallet := solana.NewWallet().PrivateKey
+	owner := wallet.PublicKey().String()
+	addPOP3Account(t, server, mockDB, owner, "me@example.com", "pop.example.com", 995)
+
+	key := mintKey(t, router, wallet, scopeAccountsRead).Key
+	readOnly := mintKey(t, router, wallet, scopeMailRead).Key
+	expired := "mk_expired"
+	mockDB.CreateAPIKey(context.Background(), &db.APIKey{
+		KeyHash: hashAPIKey(expired), OwnerPubKey: owner, Scopes: []string{scopeAccountsRead},
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+
+	testCases := []struct {
+		name string
+		path string
+		auth string
+		want int
+	}{
+		{"owner filled from key", "/api/v1/accounts", "Bearer " + key, http.StatusOK},
+		{"matching owner", "/api/v1/accounts?owner=" + owner, "Bearer " + key, http.StatusOK},
+		{"other owner", "/api/v1/accounts?owner=someone-else", "Bearer " + key, http.StatusForbidden},
+		{"missing scope", "/api/v1/accounts", "Bearer " + readOnly, http.StatusForbidden},
+		{"unknown key", "/api/v1/accounts", "Bearer mk_unknown", http.StatusUnauthorized},
+		{"expired key", "/api/v1/accounts", "Bearer " + expired, http.StatusUnauthorized},
+		{"no key", "/api/v1/accounts", "", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.path, nil)
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tc.want {
+				t.Fatalf("status code: want %d, got %d: %s", tc.want, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusOK {
+				var accounts []db.MailAccount
+				json.NewDecoder(w.Body).Decode(&accounts)
+				if len(accounts) != 1 || accounts[0].OwnerPubKey != owner {
+					t.Errorf("expected the key owner's account, got %+v", accounts)
+				}
+			}
+		})
+	}
+
+	// last_used_at is recorded in the background.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		k, _ := mockDB.GetAPIKeyByHash(context.Background(), hashAPIKey(key))
+		if !k.LastUsedAt.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("last_used_at was not updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWithAPIKey_BodyOwner(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	wallet := solana.NewWallet().PrivateKey
+	key := mintKey(t, router, wallet, scopeAccountsWrite).Key
+
+	post := func(owner string) int {
+		body, _ := json.Marshal(map[string]any{
+			"owner_pubkey": owner, "account_email": "me@example.com",
+			"pop3": map[string]any{"host": "pop.example.com", "port": 995, "pass": "p"},
+			"smtp": map[string]any{"host": "smtp.example.com", "port": 465, "pass": "p"},
+		})
+		req := httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post("someone-else"); code != http.StatusForbidden {
+		t.Errorf("other owner: want 403, got %d", code)
+	}
+	if code := post(""); code != http.StatusCreated {
+		t.Fatalf("owner from key: want 201, got %d", code)
+	}
+	if _, err := mockDB.GetMailAccount(context.Background(), wallet.PublicKey().String(), "me@example.com"); err != nil {
+		t.Errorf("account should belong to the key owner: %v", err)
+	}
+}
+
+func TestDeleteAPIKey(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	wallet := solana.NewWallet().PrivateKey
+	created := mintKey(t, router, wallet, scopeAccountsRead)
+
+	now := time.Now()
+	del := func(signer solana.PrivateKey, id string, signedAt time.Time) int {
+		req := deleteKeyRequest{deleteKeyPayload: deleteKeyPayload{
+			Action:      "delete-api-key",
+			OwnerPubKey: wallet.PublicKey().String(),
+			KeyID:       id,
+			SignedAt:    signedAt.UTC().Format(time.RFC3339),
+		}}
+		req.Signature = signPayload(t, signer, req.deleteKeyPayload)
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/keys/"+id, bytes.NewReader(body)))
+		return w.Code
+	}
+
+	if code := del(solana.NewWallet().PrivateKey, created.ID.Hex(), now); code != http.StatusUnauthorized {
+		t.Errorf("foreign signature: want 401, got %d", code)
+	}
+	if code := del(wallet, created.ID.Hex(), now); code != http.StatusOK {
+		t.Fatalf("delete: want 200, got %d", code)
+	}
+	if code := del(wallet, created.ID.Hex(), now); code != http.StatusConflict {
+		t.Errorf("replayed delete: want 409, got %d", code)
+	}
+	if code := del(wallet, created.ID.Hex(), now.Add(-time.Second)); code != http.StatusNotFound {
+		t.Errorf("second delete: want 404, got %d", code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/accounts", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key: want 401, got %d", w.Code)
+	}
+}
@@ -0,0 +1,361 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"mulamail/config"
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+const (
+	// archiveBatchSize is how many messages an archive job retrieves per
+	// claim before it goes to the back of the queue, so that one large
+	// mailbox does not hold up the others.
+	archiveBatchSize = 50
+
+	// archiveLease is how long an archive job may go without a checkpoint
+	// before another worker assumes its worker died and resumes it.
+	archiveLease = 10 * time.Minute
+
+	// archiveMaxAttempts bounds the consecutive failed batches of one job.
+	archiveMaxAttempts = 5
+)
+
+// errArchiveGone fails an archive job for good: there is nothing left to
+// archive from.
+var errArchiveGone = errors.New("mail account not found")
+
+// POST /api/v1/mail/archive-all?owner=<pubkey>&account=<email>
+//
+// Queues an import of the account's whole mailbox into the vault.  While
+// the account has an archive job queued or running, that job is returned
+// instead.
+//
+// Response: the archive job (202)
+func (s *Server) createArchiveJob(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	account := r.URL.Query().Get("account")
+	if owner == "" || account == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey and account required")
+		return
+	}
+	if s.storage == nil {
+		writeError(w, http.StatusServiceUnavailable, "vault storage is not configured")
+		return
+	}
+	if _, err := s.db.GetMailAccount(r.Context(), owner, account); errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	job := &db.ArchiveJob{OwnerPubKey: owner, AccountEmail: account}
+	if _, err := s.db.CreateArchiveJob(r.Context(), job); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// GET /api/v1/mail/archive-all/{job}?owner=<pubkey>
+//
+// Reports the progress of a mailbox archive.
+func (s *Server) archiveJobStatus(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	job, err := s.db.GetArchiveJob(r.Context(), owner, r.PathValue("job"))
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "archive job not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// ---------- archive worker ----------
+
+// Archiver imports mailboxes into the vault in the background.  Like the
+// Exporter, several instances may run side by side: jobs are claimed
+// atomically a batch at a time, and a job whose worker stops checkpointing
+// for archiveLease is claimed again and resumed from its checkpoint.
+//
+// Every policyInterval it also applies the accounts' delete fetch policies;
+// see applyFetchPolicies.
+type Archiver struct {
+	srv            *Server
+	leader         *leader
+	worker         string
+	interval       time.Duration
+	policyInterval time.Duration
+	pace           *pacer
+	batchSize      int
+	maxAttempts    int
+	now            func() time.Time
+}
+
+// NewArchiver creates an archive worker storing messages in storage.
+func NewArchiver(database db.DB, storage vault.Storage, cfg *config.Config) *Archiver {
+	return &Archiver{
+		srv:            &Server{db: database, storage: storage, cfg: cfg},
+		leader:         newLeader(database, roleArchiver, cfg),
+		worker:         workerName(),
+		interval:       seconds(cfg.ArchiveIntervalSeconds),
+		policyInterval: time.Duration(cfg.FetchPolicyIntervalMinutes) * time.Minute,
+		pace:           newPacer(cfg.ArchiveMessagesPerMinute),
+		batchSize:      archiveBatchSize,
+		maxAttempts:    archiveMaxAttempts,
+		now:            time.Now,
+	}
+}
+
+// Run archives queued mailboxes until ctx is cancelled, and applies the
+// fetch policies once per policyInterval, the first time a full interval
+// after it starts.  Only the instance leading the archiver role does.
+func (ar *Archiver) Run(ctx context.Context) {
+	ar.leader.elect(ctx)
+	ticker := time.NewTicker(ar.interval)
+	defer ticker.Stop()
+	policiesDue := ar.now().Add(ar.policyInterval)
+	for {
+		ar.processQueued(ctx)
+		if ar.policyInterval > 0 && !ar.now().Before(policiesDue) && ar.leader.leads() && !ar.srv.paused(ctx) {
+			ar.applyFetchPolicies(ctx)
+			policiesDue = ar.now().Add(ar.policyInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processQueued runs batches until no archive job is waiting.
+func (ar *Archiver) processQueued(ctx context.Context) {
+	for ctx.Err() == nil && ar.leader.leads() && !ar.srv.paused(ctx) {
+		now := ar.now()
+		job, err := ar.srv.db.ClaimArchiveJob(ctx, now, now.Add(-archiveLease), ar.worker)
+		if errors.Is(err, db.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("archiver: claim: %v", err)
+			return
+		}
+		ar.run(ctx, job)
+	}
+}
+
+// run archives one batch of a claimed job and records the outcome: done,
+// pending for the next batch or a retry, or failed.
+func (ar *Archiver) run(ctx context.Context, job *db.ArchiveJob) {
+	finished, err := ar.batch(ctx, job)
+	if errors.Is(err, db.ErrNotFound) {
+		return // another worker took the job over
+	}
+	switch {
+	case err == nil:
+		job.Status, job.LastError, job.Attempts = db.ArchivePending, "", 0
+		if finished {
+			job.Status, job.CompletedAt = db.ArchiveDone, ar.now()
+		}
+	case errors.Is(err, errArchiveGone), errors.Is(err, mail.ErrNotSupported), job.Attempts >= ar.maxAttempts:
+		job.Status, job.LastError = db.ArchiveFailed, publicError(err)
+	default:
+		job.Status, job.LastError = db.ArchivePending, publicError(err)
+	}
+	if err != nil {
+		log.Printf("archiver: job %s attempt %d: %v", job.ID.Hex(), job.Attempts, err)
+	}
+	job.ClaimedAt = ar.now()
+	if err := ar.srv.db.SaveArchiveJob(ctx, job); err != nil {
+		log.Printf("archiver: record outcome of %s: %v", job.ID.Hex(), err)
+	}
+}
+
+// batch archives up to batchSize messages of the job's mailbox,
+// starting after its checkpoint, and reports whether it reached the end.
+// Messages whose body is already in the vault are not retrieved again; one
+// that is stored but not indexed is indexed from the vault.  The job is
+// checkpointed after every message it retrieves.
+func (ar *Archiver) batch(ctx context.Context, job *db.ArchiveJob) (bool, error) {
+	acc, err := ar.srv.db.GetMailAccount(ctx, job.OwnerPubKey, job.AccountEmail)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, errArchiveGone
+	}
+	if err != nil {
+		return false, err
+	}
+	fc, err := vault.NewFieldCipher(ar.srv.cfg.EncryptionKey)
+	if err != nil {
+		return false, err
+	}
+	indexed, err := ar.indexedUIDs(ctx, acc)
+	if err != nil {
+		return false, err
+	}
+	client, err := ar.srv.dialPOP3(ctx, acc)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+	uids, err := client.UIDLs(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	ids := slices.Sorted(maps.Keys(uids))
+	job.Total = len(ids)
+	// Resume after the checkpoint.  Should that message have been deleted,
+	// start over: everything archived since is skipped cheaply.
+	start := 0
+	if i := slices.IndexFunc(ids, func(id int) bool { return uids[id] == job.LastUID }); job.LastUID != "" && i >= 0 {
+		start = i + 1
+	}
+
+	retrieved, unsaved := 0, 0
+	for _, id := range ids[start:] {
+		if retrieved == ar.batchSize {
+			return false, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		uid := uids[id]
+		key := messageCacheKey(acc.OwnerPubKey, acc.AccountEmail, uid)
+		fetched := false
+		if _, err := ar.srv.storage.Stat(ctx, key); err == nil {
+			// Archived already, by a fetch policy, a message download or an
+			// earlier job.
+			if !indexed[uid] {
+				raw, err := ar.srv.storage.Get(ctx, key)
+				if err == nil {
+					err = ar.index(ctx, fc, acc, uid, raw)
+				}
+				if err != nil {
+					return false, fmt.Errorf("index message %d: %w", id, err)
+				}
+			}
+			job.Skipped++
+		} else {
+			if err := ar.pace.wait(ctx); err != nil {
+				return false, err
+			}
+			raw, err := client.Retrieve(ctx, id)
+			if err != nil {
+				return false, fmt.Errorf("retrieve message %d: %w", id, err)
+			}
+			if err := ar.srv.storage.Put(ctx, key, []byte(raw)); err != nil {
+				return false, fmt.Errorf("store message %d: %w", id, err)
+			}
+			if err := ar.index(ctx, fc, acc, uid, []byte(raw)); err != nil {
+				return false, fmt.Errorf("index message %d: %w", id, err)
+			}
+			job.Archived++
+			retrieved++
+			fetched = true
+		}
+		job.LastUID = uid
+		// Skipping is quick, so skipped messages are checkpointed a batch
+		// at a time.
+		if unsaved++; fetched || unsaved == ar.batchSize {
+			job.ClaimedAt = ar.now()
+			if err := ar.srv.db.SaveArchiveJob(ctx, job); err != nil {
+				return false, err
+			}
+			unsaved = 0
+		}
+	}
+	return true, nil
+}
+
+// indexedUIDs returns the UIDLs of the account's messages with a cached
+// preview.
+func (ar *Archiver) indexedUIDs(ctx context.Context, acc *db.MailAccount) (map[string]bool, error) {
+	cached, err := ar.srv.db.GetCachedMessagesByOwner(ctx, acc.OwnerPubKey)
+	if err != nil {
+		return nil, err
+	}
+	uids := make(map[string]bool)
+	for _, m := range cached {
+		if m.AccountEmail == acc.AccountEmail {
+			uids[m.UID] = true
+		}
+	}
+	return uids, nil
+}
+
+// index caches the preview of an archived message, as an inbox fetch
+// would, so that it is searchable and exported, and so that the vault
+// collector keeps its body.
+func (ar *Archiver) index(ctx context.Context, fc *vault.FieldCipher, acc *db.MailAccount, uid string, raw []byte) error {
+	m := mail.ParsePreview(0, string(raw))
+	doc, err := encryptPreview(fc, &db.CachedMessage{
+		OwnerPubKey: acc.OwnerPubKey, AccountEmail: acc.AccountEmail, UID: uid,
+		From: m.From, Subject: m.Subject, Date: m.DateParsed, Size: len(raw),
+		DedupIndex: dedupIndex(fc, m), MailingList: m.List != nil,
+	})
+	if err == nil && m.List != nil {
+		doc.ListEnc, err = encryptList(fc, m.List)
+	}
+	if err == nil && m.Snippet != "" {
+		doc.SnippetEnc, err = fc.Encrypt(m.Snippet)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = ar.srv.db.UpsertCachedMessage(ctx, doc)
+	return err
+}
+
+// pacer spaces out calls to wait so that at most perMinute return in any
+// minute.  A nil pacer never waits.
+type pacer struct {
+	every time.Duration
+	next  time.Time
+}
+
+// newPacer returns a pacer for perMinute calls a minute, or nil for no
+// limit.
+func newPacer(perMinute int) *pacer {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &pacer{every: time.Minute / time.Duration(perMinute)}
+}
+
+// wait blocks until the next call is due or ctx is cancelled.
+func (p *pacer) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	now := time.Now()
+	if p.next.After(now) {
+		t := time.NewTimer(p.next.Sub(now))
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		now = p.next
+	}
+	p.next = now.Add(p.every)
+	return nil
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+	"mulamail/vault"
+)
+
+// setupArchive gives the owner an account on a fake POP3 server holding n
+// messages, and the server a vault.
+func setupArchive(t *testing.T, n int) (*Server, *dbtest.Mock, *fakePOP3) {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	newTestVault(t, server)
+	fake := &fakePOP3{messages: make(map[int]string)}
+	for i := 1; i <= n; i++ {
+		fake.messages[i] = fmt.Sprintf("From: sender%d@example.com\r\nSubject: Message %d\r\nDate: Mon, 02 Oct 2023 10:00:00 +0000\r\n\r\nBody %d", i, i, i)
+	}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	return server, mockDB, fake
+}
+
+func newTestArchiver(server *Server) *Archiver {
+	return &Archiver{srv: server, worker: "test/0", batchSize: archiveBatchSize, maxAttempts: archiveMaxAttempts, now: time.Now}
+}
+
+func queueArchive(t *testing.T, server *Server) db.ArchiveJob {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.createArchiveJob(w, httptest.NewRequest("POST", "/api/v1/mail/archive-all?owner=owner&account=me@example.com", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body.String())
+	}
+	var job db.ArchiveJob
+	json.NewDecoder(w.Body).Decode(&job)
+	return job
+}
+
+func TestArchive_ImportMailbox(t *testing.T) {
+	server, mockDB, fake := setupArchive(t, 5)
+	ctx := context.Background()
+	fc, _ := vault.NewFieldCipher(server.cfg.EncryptionKey)
+
+	// Message 2 was archived by a fetch policy; message 3 was only cached
+	// by a download and has no preview yet.
+	for _, uid := range []string{"uid-2", "uid-3"} {
+		server.storage.Put(ctx, messageCacheKey("owner", "me@example.com", uid), []byte(fake.messages[2]))
+	}
+	m, _ := encryptPreview(fc, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: "uid-2", Subject: "Message 2"})
+	mockDB.UpsertCachedMessage(ctx, m)
+
+	job := queueArchive(t, server)
+	if job.Status != db.ArchivePending {
+		t.Errorf("new job: want pending, got %q", job.Status)
+	}
+	if again := queueArchive(t, server); again.ID != job.ID {
+		t.Errorf("archive while one is queued: want job %s, got %s", job.ID.Hex(), again.ID.Hex())
+	}
+
+	newTestArchiver(server).processQueued(ctx)
+
+	router := NewRouter(mockDB, server.solana, server.storage, server.cfg)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/mail/archive-all/"+job.ID.Hex()+"?owner=owner", nil))
+	var got db.ArchiveJob
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.Status != db.ArchiveDone || got.Total != 5 || got.Archived != 3 || got.Skipped != 2 {
+		t.Errorf("want done with 3 archived and 2 skipped of 5, got %+v", got)
+	}
+	if n := fake.retrieved.Load(); n != 3 {
+		t.Errorf("want only the 3 unarchived messages retrieved, got %d", n)
+	}
+	for i := 1; i <= 5; i++ {
+		if _, err := server.storage.Get(ctx, messageCacheKey("owner", "me@example.com", fmt.Sprintf("uid-%d", i))); err != nil {
+			t.Errorf("message %d not in the vault: %v", i, err)
+		}
+	}
+	cached, _ := mockDB.GetCachedMessagesByOwner(ctx, "owner")
+	if len(cached) != 5 {
+		t.Fatalf("want every message indexed, got %d", len(cached))
+	}
+	preview, _ := decryptExportedMessage(fc, cached[len(cached)-1])
+	if preview.Subject == "" || preview.Date.IsZero() {
+		t.Errorf("want the index to carry the headers, got %+v", preview)
+	}
+}
+
+func TestArchive_BatchesAndResumes(t *testing.T) {
+	server, mockDB, fake := setupArchive(t, 5)
+	ctx := context.Background()
+	queueArchive(t, server)
+	ar := newTestArchiver(server)
+	ar.batchSize = 2
+
+	job, _ := mockDB.ClaimArchiveJob(ctx, time.Now(), time.Now().Add(-archiveLease), ar.worker)
+	ar.run(ctx, job)
+	if a := mockDB.Archives[0]; a.Status != db.ArchivePending || a.Archived != 2 || a.LastUID != "uid-2" || a.Attempts != 0 {
+		t.Fatalf("after one batch: want pending at uid-2, got %+v", a)
+	}
+
+	// The worker dies mid-batch after a checkpoint.  Until its claim goes
+	// stale the job is left alone, then another worker resumes it.
+	claimed := time.Now()
+	job, _ = mockDB.ClaimArchiveJob(ctx, claimed, claimed.Add(-archiveLease), "dead/0")
+	job.Archived, job.LastUID = 3, "uid-3"
+	mockDB.SaveArchiveJob(ctx, job)
+	if _, err := mockDB.ClaimArchiveJob(ctx, claimed, claimed.Add(-archiveLease), ar.worker); err == nil {
+		t.Fatal("a job with a live claim must not be claimed")
+	}
+	ar.now = func() time.Time { return claimed.Add(archiveLease + time.Second) }
+	ar.processQueued(ctx)
+
+	if a := mockDB.Archives[0]; a.Status != db.ArchiveDone || a.Archived != 5 || a.Skipped != 0 {
+		t.Errorf("want the resumed job done with every message archived, got %+v", a)
+	}
+	if n := fake.retrieved.Load(); n != 4 {
+		t.Errorf("want 2 + 2 retrievals across the two workers, got %d", n)
+	}
+}
+
+func TestArchive_Failures(t *testing.T) {
+	t.Run("login refused", func(t *testing.T) {
+		server, mockDB, fake := setupArchive(t, 1)
+		fake.rejectPass = true
+		queueArchive(t, server)
+		ar := newTestArchiver(server)
+		ar.maxAttempts = 2
+		ctx := context.Background()
+
+		job, _ := mockDB.ClaimArchiveJob(ctx, time.Now(), time.Now(), ar.worker)
+		ar.run(ctx, job)
+		if a := mockDB.Archives[0]; a.Status != db.ArchivePending || a.LastError == "" {
+			t.Fatalf("first failure: want a retry, got %+v", a)
+		}
+		ar.processQueued(ctx)
+		if a := mockDB.Archives[0]; a.Status != db.ArchiveFailed || a.Attempts != 2 {
+			t.Errorf("out of attempts: want failed, got %+v", a)
+		}
+	})
+	t.Run("no UIDL", func(t *testing.T) {
+		server, mockDB, fake := setupArchive(t, 1)
+		fake.noUIDL = true
+		fake.capa = []string{"USER", "TOP"}
+		queueArchive(t, server)
+		newTestArchiver(server).processQueued(context.Background())
+		if a := mockDB.Archives[0]; a.Status != db.ArchiveFailed || fake.retrieved.Load() != 0 {
+			t.Errorf("want failed at once without retrieving, got %+v", a)
+		}
+	})
+	t.Run("account removed", func(t *testing.T) {
+		server, mockDB, _ := setupArchive(t, 1)
+		queueArchive(t, server)
+		mockDB.DeleteOwnerData(context.Background(), "owner", "mail_accounts")
+		newTestArchiver(server).processQueued(context.Background())
+		if a := mockDB.Archives[0]; a.Status != db.ArchiveFailed || a.LastError == "" {
+			t.Errorf("want failed at once, got %+v", a)
+		}
+	})
+}
+
+func TestArchive_Requests(t *testing.T) {
+	server, _, _ := setupArchive(t, 0)
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"POST", "/api/v1/mail/archive-all?owner=owner", http.StatusBadRequest},
+		{"POST", "/api/v1/mail/archive-all?owner=owner&account=other@example.com", http.StatusNotFound},
+		{"GET", "/api/v1/mail/archive-all/" + "0123456789abcdef01234567" + "?owner=owner", http.StatusNotFound},
+		{"GET", "/api/v1/mail/archive-all/x", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		NewRouter(server.db, server.solana, server.storage, server.cfg).ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: want %d, got %d: %s", tt.method, tt.path, tt.want, w.Code, w.Body.String())
+		}
+	}
+
+	server.storage = nil
+	w := httptest.NewRecorder()
+	server.createArchiveJob(w, httptest.NewRequest("POST", "/api/v1/mail/archive-all?owner=owner&account=me@example.com", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without a vault: want %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	if p := newPacer(0); p != nil || p.wait(context.Background()) != nil {
+		t.Fatal("a rate of 0 must not limit")
+	}
+	p := newPacer(1200) // one every 50ms
+	start := time.Now()
+	for range 3 {
+		p.wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("want 3 calls spread over at least 100ms, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newPacer(1).wait(ctx); err != nil {
+		t.Errorf("first call: want no wait, got %v", err)
+	}
+	p = newPacer(1)
+	p.wait(context.Background())
+	if err := p.wait(ctx); err == nil {
+		t.Error("want a cancelled wait to fail")
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"mulamail/mail"
+)
+
+// GET /api/v1/mail/attachment?owner=<pubkey>&account=<email>&id=<msg-id>&part=<index|content-id>
+//
+// Streams a single decoded MIME part of a message.  The raw message comes
+// from the vault cache when present, otherwise via RETR.  Parts at or below
+// cfg.AttachmentBufferBytes are buffered so a Content-Length can be sent;
+// larger parts are streamed.
+func (s *Server) fetchAttachment(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id, err := strconv.Atoi(q.Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+	selector := q.Get("part")
+	if selector == "" {
+		writeError(w, http.StatusBadRequest, "part index or content-id required")
+		return
+	}
+
+	client, err := s.connectPOP3(r)
+	if err != nil {
+		writeMailError(w, r, http.StatusServiceUnavailable, "", err)
+		return
+	}
+	defer client.Close()
+
+	raw, err := s.retrieveRaw(r.Context(), client, q.Get("owner"), q.Get("account"), id)
+	if err != nil {
+		writeMailError(w, r, http.StatusInternalServerError, "POP3 RETR", err)
+		return
+	}
+
+	part, err := mail.FindPart(raw, selector)
+	if errors.Is(err, mail.ErrPartNotFound) {
+		writeError(w, http.StatusNotFound, "part not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	contentType := part.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if part.Filename != "" {
+		disposition = mime.FormatMediaType("attachment", map[string]string{"filename": part.Filename})
+	}
+
+	if part.Size <= s.cfg.AttachmentBufferBytes {
+		data, err := io.ReadAll(part.Body)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "decode part: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", disposition)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data) //nolint:errcheck
+		return
+	}
+
+	// Too large to buffer: headers are committed before decoding, so a
+	// decode error can only be logged and the response truncated.
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", disposition)
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, part.Body); err != nil {
+		log.Printf("[%s] attachment: stream part %q of message %d: %v", requestID(r.Context()), selector, id, err)
+	}
+}
+
+// retrieveRaw returns the raw message, preferring the copy cached in the
+// vault under its UIDL.  A freshly RETRieved message is cached on a
+// best-effort basis; servers without UIDL are never cached since message
+// numbers are not stable across sessions.
+func (s *Server) retrieveRaw(ctx context.Context, client *mail.POP3Client, owner, account string, id int) (string, error) {
+	uid, uidErr := client.UIDL(ctx, id)
+	cacheable := uidErr == nil && s.storage != nil
+	key := messageCacheKey(owner, account, uid)
+
+	if cacheable {
+		if raw, err := s.storage.Get(ctx, key); err == nil {
+			return string(raw), nil
+		}
+	}
+
+	raw, err := client.Retrieve(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	if cacheable {
+		if err := s.storage.Put(ctx, key, []byte(raw)); err != nil {
+			log.Printf("[%s] message cache: store %s: %v", requestID(ctx), key, err)
+		}
+	}
+	return raw, nil
+}
+
+// messageCacheKey derives the vault key for a cached raw message.  Each
+// component is hashed so client-supplied owner/account values and
+// server-chosen UIDs can never escape the messages/ prefix.
+func messageCacheKey(owner, account, uid string) string {
+	return "messages/" + hashComponent(owner) + "/" + hashComponent(account) + "/" + hashComponent(uid)
+}
+
+func hashComponent(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:16])
+}
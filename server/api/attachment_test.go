@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const attachmentMessage = "From: a@example.com\r\n" +
+	"Subject: invoice\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b\"\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"see attached\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--b--"
+
+func TestFetchAttachment_Success(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AttachmentBufferBytes = 1 << 20
+
+	fake := &fakePOP3{messages: map[int]string{1: attachmentMessage}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/attachment?owner=owner&account=me@example.com&id=1&part=1", nil)
+	w := httptest.NewRecorder()
+
+	server.fetchAttachment(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/pdf" {
+		t.Errorf("Content-Type: want %q, got %q", "application/pdf", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename=invoice.pdf` {
+		t.Errorf("Content-Disposition: unexpected %q", got)
+	}
+	if got := w.Header().Get("Content-Length"); got != "9" {
+		t.Errorf("Content-Length: want %q, got %q", "9", got)
+	}
+	if w.Body.String() != "%PDF-1.4\n" {
+		t.Errorf("body: want %q, got %q", "%PDF-1.4\n", w.Body.String())
+	}
+}
+
+func TestFetchAttachment_StreamsLargeParts(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AttachmentBufferBytes = 4
+
+	fake := &fakePOP3{messages: map[int]string{1: attachmentMessage}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/attachment?owner=owner&account=me@example.com&id=1&part=1", nil)
+	w := httptest.NewRecorder()
+
+	server.fetchAttachment(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d", http.StatusOK, w.Code)
+	}
+	if got := w.Header().Get("Content-Length"); got != "" {
+		t.Errorf("expected no Content-Length for a streamed part, got %q", got)
+	}
+	if w.Body.String() != "%PDF-1.4\n" {
+		t.Errorf("body: want %q, got %q", "%PDF-1.4\n", w.Body.String())
+	}
+}
+
+func TestFetchAttachment_PartNotFound(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{messages: map[int]string{1: attachmentMessage}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/attachment?owner=owner&account=me@example.com&id=1&part=7", nil)
+	w := httptest.NewRecorder()
+
+	server.fetchAttachment(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status code: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestFetchAttachment_MissingParameters(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	for _, query := range []string{"id=x&part=0", "id=1"} {
+		req := httptest.NewRequest("GET", "/api/v1/mail/attachment?owner=o&account=a&"+query, nil)
+		w := httptest.NewRecorder()
+
+		server.fetchAttachment(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: want %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestFetchAttachment_UsesVaultCache(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	local := newTestVault(t, server)
+
+	fake := &fakePOP3{messages: map[int]string{1: attachmentMessage}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/api/v1/mail/attachment?owner=owner&account=me@example.com&id=1&part=0", nil)
+		w := httptest.NewRecorder()
+		server.fetchAttachment(w, req)
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "see attached") {
+			t.Fatalf("request %d: unexpected %d %q", i, w.Code, w.Body.String())
+		}
+	}
+
+	if n := fake.retrieved.Load(); n != 1 {
+		t.Errorf("RETR count: want 1 (second request served from cache), got %d", n)
+	}
+
+	// The cached copy must not be plaintext.
+	data, err := local.Get(context.Background(), messageCacheKey("owner", "me@example.com", "uid-1"))
+	if err != nil {
+		t.Fatalf("cached message missing: %v", err)
+	}
+	if strings.Contains(string(data), "see attached") {
+		t.Error("cached message is stored in plaintext")
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/blockchain"
+	"mulamail/db"
+)
+
+// PlanPremium is the plan tier granted by a verified payment.
+const PlanPremium = "premium"
+
+var errBillingDisabled = errors.New("billing is not enabled")
+
+// billingAccounts returns the configured payment mint and the treasury's
+// associated token account for it.
+func (s *Server) billingAccounts() (mint, treasury solana.PublicKey, err error) {
+	if s.cfg.BillingMint == "" || s.cfg.BillingTreasury == "" || s.cfg.PremiumPrice <= 0 {
+		return mint, treasury, errBillingDisabled
+	}
+	mint, err = solana.PublicKeyFromBase58(s.cfg.BillingMint)
+	if err != nil {
+		return mint, treasury, fmt.Errorf("invalid billing mint: %w", err)
+	}
+	wallet, err := solana.PublicKeyFromBase58(s.cfg.BillingTreasury)
+	if err != nil {
+		return mint, treasury, fmt.Errorf("invalid billing treasury: %w", err)
+	}
+	treasury, _, err = solana.FindAssociatedTokenAddress(wallet, mint)
+	return mint, treasury, err
+}
+
+// claimPaymentRequest is the body of POST /api/v1/billing/claim.
+type claimPaymentRequest struct {
+	OwnerPubKey string `json:"owner_pubkey"`
+	TxSig       string `json:"tx_sig"`
+}
+
+// claimPaymentResponse is the owner's plan after a successful claim.
+type claimPaymentResponse struct {
+	Plan *db.Plan `json:"plan"`
+}
+
+// POST /api/v1/billing/claim
+//
+// Upgrades the owner to the premium plan once the given transaction is
+// verified to have paid at least the premium price to the treasury and to
+// be signed by the owner's wallet, as its fee payer or the transfer's
+// authority; a payment cannot be claimed for anyone but its payer.  Each
+// transaction can be claimed once; repeating a claim for the same owner is
+// harmless.
+//
+// Request:  { "owner_pubkey": "...", "tx_sig": "<base58 signature>" }
+// Response: { "plan": {...} }
+func (s *Server) claimPayment(w http.ResponseWriter, r *http.Request) {
+	mint, treasury, err := s.billingAccounts()
+	if errors.Is(err, errBillingDisabled) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	var req claimPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if req.OwnerPubKey == "" || req.TxSig == "" {
+		writeError(w, http.StatusBadRequest, "owner_pubkey and tx_sig are required")
+		return
+	}
+	owner, err := solana.PublicKeyFromBase58(req.OwnerPubKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid owner_pubkey: "+err.Error())
+		return
+	}
+	sig, err := solana.SignatureFromBase58(req.TxSig)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid tx_sig: "+err.Error())
+		return
+	}
+
+	prior, err := s.db.GetPaymentByTxSig(r.Context(), sig.String())
+	switch {
+	case err == nil && prior.OwnerPubKey != req.OwnerPubKey:
+		writeError(w, http.StatusConflict, "payment already claimed")
+		return
+	case err == nil:
+		// Same owner: re-apply the plan below in case the first claim
+		// failed after recording the payment.
+	case errors.Is(err, db.ErrNotFound):
+		ok, err := s.solana.VerifyTokenTransfer(r.Context(), sig, owner, mint, treasury, uint64(s.cfg.PremiumPrice))
+		if errors.Is(err, blockchain.ErrTxNotFound) {
+			writeError(w, http.StatusNotFound, "transaction not found; it may not be finalized yet, retry shortly")
+			return
+		}
+		if err != nil {
+			writeFailure(w, r, http.StatusInternalServerError, "verify payment failed", fmt.Errorf("verify %s: %w", sig, err))
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusPaymentRequired,
+				fmt.Sprintf("transaction is not signed by %s or does not transfer at least %d of %s to %s", owner, s.cfg.PremiumPrice, mint, treasury))
+			return
+		}
+		err = s.db.CreatePayment(r.Context(), &db.Payment{TxSig: sig.String(), OwnerPubKey: req.OwnerPubKey, Plan: PlanPremium})
+		if errors.Is(err, db.ErrDuplicate) {
+			writeError(w, http.StatusConflict, "payment already claimed")
+			return
+		}
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+	default:
+		writeInternalError(w, r, err)
+		return
+	}
+
+	plan := &db.Plan{OwnerPubKey: req.OwnerPubKey, Tier: PlanPremium, PaymentTx: sig.String()}
+	if err := s.db.SetPlan(r.Context(), plan); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, claimPaymentResponse{Plan: plan})
+}
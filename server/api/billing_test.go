@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/blockchain"
+	"mulamail/db/dbtest"
+)
+
+// setupBillingServer enables billing and serves a transaction from payer
+// paying received base units to the treasury for every signature.
+func setupBillingServer(t *testing.T, payer solana.PublicKey, received uint64) (*Server, *dbtest.Mock) {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	mint, wallet := solana.NewWallet().PublicKey(), solana.NewWallet().PublicKey()
+	server.cfg.BillingMint, server.cfg.BillingTreasury, server.cfg.PremiumPrice = mint.String(), wallet.String(), 1000
+	treasury, _, _ := solana.FindAssociatedTokenAddress(wallet, mint)
+
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		tx, _ := solana.NewTransaction([]solana.Instruction{
+			solana.NewInstruction(solana.TokenProgramID,
+				solana.AccountMetaSlice{solana.Meta(payer).SIGNER().WRITE(), solana.Meta(treasury).WRITE()}, []byte{3}),
+		}, solana.Hash{1}, solana.TransactionPayer(payer))
+		raw, _ := tx.MarshalBinary()
+		balance := func(amount uint64) []map[string]any {
+			return []map[string]any{{
+				"accountIndex":  1,
+				"mint":          mint.String(),
+				"uiTokenAmount": map[string]any{"amount": strconv.FormatUint(amount, 10), "decimals": 6},
+			}}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": map[string]any{
+			"slot":        1,
+			"transaction": []string{base64.StdEncoding.EncodeToString(raw), "base64"},
+			"meta": map[string]any{
+				"err":               nil,
+				"preTokenBalances":  balance(0),
+				"postTokenBalances": balance(received),
+			},
+		}})
+	}))
+	t.Cleanup(rpcServer.Close)
+	server.solana = blockchain.NewClient(rpcServer.URL)
+	return server, mockDB
+}
+
+func claim(server *Server, owner, sig string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"owner_pubkey": owner, "tx_sig": sig})
+	req := httptest.NewRequest("POST", "/api/v1/billing/claim", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	server.claimPayment(w, req)
+	return w
+}
+
+func TestClaimPayment_UpgradesPlan(t *testing.T) {
+	payer := solana.NewWallet().PublicKey()
+	server, mockDB := setupBillingServer(t, payer, 1000)
+	owner := payer.String()
+	sig := solana.Signature{7}.String()
+
+	if w := claim(server, owner, sig); w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if p := mockDB.Plans[owner]; p == nil || p.Tier != PlanPremium || p.PaymentTx != sig {
+		t.Errorf("unexpected plan %+v", p)
+	}
+	if p := mockDB.Payments[sig]; p == nil || p.OwnerPubKey != owner {
+		t.Errorf("payment not recorded: %+v", p)
+	}
+
+	// Retrying the same claim is harmless; another owner cannot reuse it.
+	if w := claim(server, owner, sig); w.Code != http.StatusOK {
+		t.Errorf("repeat claim: want %d, got %d", http.StatusOK, w.Code)
+	}
+	thief := solana.NewWallet().PublicKey().String()
+	if w := claim(server, thief, sig); w.Code != http.StatusConflict {
+		t.Errorf("reuse by other owner: want %d, got %d", http.StatusConflict, w.Code)
+	}
+	if _, ok := mockDB.Plans[thief]; ok {
+		t.Error("reused payment must not upgrade another owner")
+	}
+}
+
+func TestClaimPayment_NotPayer(t *testing.T) {
+	server, mockDB := setupBillingServer(t, solana.NewWallet().PublicKey(), 1000)
+
+	// The first claim of a payment, made for a wallet that did not sign it.
+	if w := claim(server, solana.NewWallet().PublicKey().String(), solana.Signature{7}.String()); w.Code != http.StatusPaymentRequired {
+		t.Errorf("status code: want %d, got %d: %s", http.StatusPaymentRequired, w.Code, w.Body.String())
+	}
+	if len(mockDB.Payments) != 0 || len(mockDB.Plans) != 0 {
+		t.Error("another wallet's payment must not be recorded")
+	}
+}
+
+func TestClaimPayment_Insufficient(t *testing.T) {
+	owner := solana.NewWallet().PublicKey()
+	server, mockDB := setupBillingServer(t, owner, 999)
+
+	if w := claim(server, owner.String(), solana.Signature{7}.String()); w.Code != http.StatusPaymentRequired {
+		t.Errorf("status code: want %d, got %d: %s", http.StatusPaymentRequired, w.Code, w.Body.String())
+	}
+	if len(mockDB.Payments) != 0 || len(mockDB.Plans) != 0 {
+		t.Error("an insufficient payment must not be recorded")
+	}
+}
+
+func TestClaimPayment_Validation(t *testing.T) {
+	server, _ := setupTestServer(t)
+	if w := claim(server, "owner", solana.Signature{7}.String()); w.Code != http.StatusNotFound {
+		t.Errorf("billing disabled: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	owner := solana.NewWallet().PublicKey()
+	server, _ = setupBillingServer(t, owner, 1000)
+	for _, tc := range []struct{ owner, sig string }{
+		{"", solana.Signature{7}.String()}, {owner.String(), ""}, {owner.String(), "not-a-signature"}, {"owner", solana.Signature{7}.String()},
+	} {
+		if w := claim(server, tc.owner, tc.sig); w.Code != http.StatusBadRequest {
+			t.Errorf("%+v: want %d, got %d", tc, http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+// attachBounce retrieves a preview whose headers announce a delivery status
+// notification and sets its Bounce.  Failures are logged and leave the
+// preview as it was.
+func attachBounce(ctx context.Context, client *mail.POP3Client, msg *mail.Message) {
+	if !msg.DeliveryReport {
+		return
+	}
+	raw, err := client.Retrieve(ctx, msg.ID)
+	if err == nil {
+		msg.Bounce, err = mail.ParseBounce(raw)
+	}
+	if err != nil {
+		log.Printf("[%s] inbox: parse bounce %d: %v", requestID(ctx), msg.ID, err)
+	}
+}
+
+// recordBounces marks the owner's sent messages that failed bounces among
+// msgs refer to.  Bounces for mail not sent through MulaMail are ignored.
+func (s *Server) recordBounces(ctx context.Context, owner string, msgs []*mail.Message) {
+	for _, m := range msgs {
+		b := m.Bounce
+		if b == nil || b.Action != "failed" || b.OriginalMessageID == "" {
+			continue
+		}
+		err := s.db.MarkSentMessageBounced(ctx, owner, b.OriginalMessageID, &db.SentBounce{
+			Recipient:  b.Recipient,
+			Status:     b.Status,
+			Diagnostic: b.Diagnostic,
+			BouncedAt:  m.DateParsed,
+		})
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			log.Printf("[%s] bounce: mark %s: %v", requestID(ctx), b.OriginalMessageID, err)
+		}
+	}
+}
+
+// encryptBounce returns b as encrypted JSON for CachedMessage.BounceEnc.
+func encryptBounce(fc *vault.FieldCipher, b *mail.Bounce) (string, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+	return fc.Encrypt(string(data))
+}
+
+// bounceView is a cached bounce as returned to clients.
+type bounceView struct {
+	Account string    `json:"account"`
+	UID     string    `json:"uid"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date,omitzero"`
+	mail.Bounce
+}
+
+// bouncesResponse lists an owner's recent bounces.
+type bouncesResponse struct {
+	Owner   string       `json:"owner"`
+	Bounces []bounceView `json:"bounces"`
+}
+
+// GET /api/v1/mail/bounces?owner=<pubkey>[&account=<email>][&limit=20]
+//
+// Lists the most recent delivery status notifications from the message
+// cache, newest first.  Only bounces that have appeared in an inbox fetch
+// are listed.
+func (s *Server) listBounces(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	docs, err := s.db.GetBouncedCachedMessages(r.Context(), owner, q.Get("account"), inboxLimit(r))
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	results := make([]bounceView, 0, len(docs))
+	for _, d := range docs {
+		v := bounceView{Account: d.AccountEmail, UID: d.UID, Date: d.Date}
+		subject, err := fc.Decrypt(d.SubjectEnc)
+		if err == nil {
+			v.Subject = subject
+			var data string
+			if data, err = fc.Decrypt(d.BounceEnc); err == nil {
+				err = json.Unmarshal([]byte(data), &v.Bounce)
+			}
+		}
+		if err != nil {
+			log.Printf("[%s] bounces: decrypt cached message %s: %v", requestID(r.Context()), d.ID.Hex(), err)
+			continue
+		}
+		results = append(results, v)
+	}
+	writeJSON(w, http.StatusOK, bouncesResponse{Owner: owner, Bounces: results})
+}
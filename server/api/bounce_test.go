@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+const bounceMessage = "From: MAILER-DAEMON@mx.example.org\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"Date: Mon, 2 Jan 2006 15:04:05 -0700\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status;\r\n" +
+	"\tboundary=\"B1\"\r\n" +
+	"\r\n" +
+	"--B1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--B1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; nobody@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+	"\r\n" +
+	"--B1\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"Message-ID: <sent-1@example.com>\r\n" +
+	"Subject: hello\r\n" +
+	"--B1--"
+
+func TestFetchInbox_Bounces(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	mockDB.Sent = append(mockDB.Sent, &db.SentMessage{
+		OwnerPubKey: "owner", AccountEmail: "me@example.com",
+		To: []string{"nobody@example.org"}, MessageID: "<sent-1@example.com>",
+	})
+
+	fake := &fakePOP3{messages: map[int]string{
+		1: "From: bob@example.org\r\nSubject: Lunch\r\n\r\nbody",
+		2: bounceMessage,
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil)
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("inbox: status %d: %s", w.Code, w.Body.String())
+	}
+	var inbox struct {
+		Messages []mail.Message `json:"messages"`
+	}
+	json.NewDecoder(w.Body).Decode(&inbox)
+
+	bounces := 0
+	for _, m := range inbox.Messages {
+		if m.Bounce == nil {
+			continue
+		}
+		bounces++
+		if m.Bounce.Recipient != "nobody@example.org" || m.Bounce.Status != "5.1.1" || m.Bounce.OriginalMessageID != "<sent-1@example.com>" {
+			t.Errorf("unexpected bounce %+v", *m.Bounce)
+		}
+	}
+	if bounces != 1 {
+		t.Errorf("want exactly one message with a bounce, got %d", bounces)
+	}
+	if n := fake.retrieved.Load(); n != 1 {
+		t.Errorf("only the bounce should be retrieved in full, got %d RETRs", n)
+	}
+
+	if b := mockDB.Sent[0].Bounce; b == nil || b.Recipient != "nobody@example.org" || b.Status != "5.1.1" {
+		t.Errorf("sent message should be marked bounced, got %+v", b)
+	}
+
+	w = httptest.NewRecorder()
+	server.listBounces(w, httptest.NewRequest("GET", "/api/v1/mail/bounces?owner=owner&account=me@example.com", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("bounces: status %d: %s", w.Code, w.Body.String())
+	}
+	var resp bouncesResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Bounces) != 1 {
+		t.Fatalf("want 1 bounce, got %+v", resp.Bounces)
+	}
+	got := resp.Bounces[0]
+	if got.UID != "uid-2" || got.Subject != "Undelivered Mail Returned to Sender" ||
+		got.Recipient != "nobody@example.org" || got.Diagnostic != "550 5.1.1 User unknown" {
+		t.Errorf("unexpected bounce listing %+v", got)
+	}
+}
+
+func TestListBounces_MissingOwner(t *testing.T) {
+	server, _ := setupTestServer(t)
+	w := httptest.NewRecorder()
+	server.listBounces(w, httptest.NewRequest("GET", "/api/v1/mail/bounces", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want 400, got %d", w.Code)
+	}
+}
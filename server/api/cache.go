@@ -0,0 +1,267 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mulamail/config"
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+// migrateBatchSize bounds each pass of MigrateMessageCache.
+const migrateBatchSize = 100
+
+// cachePreviews stores encrypted copies of freshly fetched previews, keyed by
+// POP3 UIDL, so they can be searched without contacting the mail server, and
+// marks the sent messages that bounces among them report as failed.  The
+// senders of messages cached for the first time are added to the owner's
+// contacts.  The server's UIDL listing also records which cached previews
+// are still on the server, and which have vanished, for the cache sweep
+// (see sweepMessageCache).  Caching is best effort: failures are logged and never affect
+// the inbox response.
+func (s *Server) cachePreviews(ctx context.Context, client *mail.POP3Client, owner, account string, msgs []*mail.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	s.recordBounces(ctx, owner, msgs)
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		log.Printf("[%s] preview cache: %v", requestID(ctx), err)
+		return
+	}
+	uids, err := client.UIDLs(ctx)
+	if err != nil {
+		// Without UIDL there is no stable key to cache under.
+		return
+	}
+	seen := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		seen = append(seen, uid)
+	}
+	if err := s.db.MarkCachedMessagesSeen(ctx, owner, account, seen, time.Now()); err != nil {
+		log.Printf("[%s] preview cache: mark seen messages: %v", requestID(ctx), err)
+	}
+	for _, m := range msgs {
+		uid, ok := uids[m.ID]
+		if !ok || m.PreviewSkipped {
+			continue
+		}
+		doc, err := encryptPreview(fc, &db.CachedMessage{
+			OwnerPubKey: owner, AccountEmail: account, UID: uid,
+			From: m.From, Subject: m.Subject, Date: m.DateParsed, Size: m.Size,
+			Bounced: m.Bounce != nil, DedupIndex: dedupIndex(fc, m),
+			MailingList: m.List != nil,
+		})
+		if err == nil && m.Bounce != nil {
+			doc.BounceEnc, err = encryptBounce(fc, m.Bounce)
+		}
+		if err == nil && m.List != nil {
+			doc.ListEnc, err = encryptList(fc, m.List)
+		}
+		if err == nil && m.Snippet != "" {
+			doc.SnippetEnc, err = fc.Encrypt(m.Snippet)
+		}
+		inserted := false
+		if err == nil {
+			inserted, err = s.db.UpsertCachedMessage(ctx, doc)
+		}
+		if err != nil {
+			log.Printf("[%s] preview cache: store message %d: %v", requestID(ctx), m.ID, err)
+			continue
+		}
+		if sender, ok := senderAddress(m.From); inserted && ok && m.Bounce == nil && !strings.EqualFold(sender.Email, account) {
+			s.recordContacts(ctx, owner, []mail.Address{sender}, false, m.DateParsed)
+		}
+	}
+}
+
+// encryptPreview moves the plaintext From and Subject of m into their
+// encrypted fields and sets the sender blind index.
+func encryptPreview(fc *vault.FieldCipher, m *db.CachedMessage) (*db.CachedMessage, error) {
+	fromEnc, err := fc.Encrypt(m.From)
+	if err != nil {
+		return nil, err
+	}
+	subjectEnc, err := fc.Encrypt(m.Subject)
+	if err != nil {
+		return nil, err
+	}
+	m.FromEnc, m.SubjectEnc = fromEnc, subjectEnc
+	m.FromIndex = senderIndex(fc, m.From)
+	m.From, m.Subject = "", ""
+	return m, nil
+}
+
+// dedupIndex indexes a message's mail.DedupKey, or is empty when it has
+// none.
+func dedupIndex(fc *vault.FieldCipher, m *mail.Message) string {
+	if key := m.DedupKey(); key != "" {
+		return fc.BlindIndex(key)
+	}
+	return ""
+}
+
+// senderIndex indexes the bare address of a From header, so that
+// "Alice <alice@example.com>" and "alice@example.com" match alike.
+func senderIndex(fc *vault.FieldCipher, from string) string {
+	if addr, err := netmail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+	return fc.BlindIndex(from)
+}
+
+// cachedPreview is a decrypted cached message as returned to clients.
+type cachedPreview struct {
+	Account string    `json:"account"`
+	UID     string    `json:"uid"`
+	From    string    `json:"from"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date,omitzero"`
+	Size    int       `json:"size"`
+	Snippet string    `json:"snippet,omitempty"` // when one was fetched with snippets=true or archived
+
+	List *mail.MailingList `json:"list,omitempty"` // set for mail sent through a mailing list
+
+	Duplicates int `json:"duplicates,omitempty"` // copies left out by dedupCached
+}
+
+// searchResponse lists the cached previews matching a search.
+type searchResponse struct {
+	Owner    string          `json:"owner"`
+	Messages []cachedPreview `json:"messages"`
+}
+
+// GET /api/v1/mail/search?owner=<pubkey>&from=<address>[&account=<email>][&include_duplicates=true][&filter=lists|personal]
+//
+// Finds cached previews by exact sender address.  Only messages that have
+// appeared in an inbox fetch are searchable.  Their snippets are included
+// where one has been cached.  Copies of a message cached
+// under several UIDLs are listed once, as in the inbox, unless
+// include_duplicates=true.  filter=lists keeps only mailing list traffic,
+// filter=personal only the rest, as in the inbox.
+func (s *Server) searchMessages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner, from := q.Get("owner"), q.Get("from")
+	if owner == "" || from == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey and from address required")
+		return
+	}
+	filter, err := listFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	docs, err := s.db.GetCachedMessagesBySender(r.Context(), owner, q.Get("account"), senderIndex(fc, from))
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	duplicates := make(map[primitive.ObjectID]int)
+	if !includeDuplicates(r) {
+		docs, duplicates = dedupCached(docs)
+	}
+	docs = filterCached(docs, filter)
+
+	results := make([]cachedPreview, 0, len(docs))
+	for _, d := range docs {
+		from, err := fc.Decrypt(d.FromEnc)
+		if err != nil {
+			log.Printf("[%s] search: decrypt cached message %s: %v", requestID(r.Context()), d.ID.Hex(), err)
+			continue
+		}
+		subject, err := fc.Decrypt(d.SubjectEnc)
+		if err != nil {
+			log.Printf("[%s] search: decrypt cached message %s: %v", requestID(r.Context()), d.ID.Hex(), err)
+			continue
+		}
+		snippet := ""
+		if d.SnippetEnc != "" {
+			if snippet, err = fc.Decrypt(d.SnippetEnc); err != nil {
+				log.Printf("[%s] search: decrypt cached message %s: %v", requestID(r.Context()), d.ID.Hex(), err)
+				continue
+			}
+		}
+		list, err := decryptList(fc, d)
+		if err != nil {
+			log.Printf("[%s] search: decrypt cached message %s: %v", requestID(r.Context()), d.ID.Hex(), err)
+			continue
+		}
+		results = append(results, cachedPreview{
+			Account: d.AccountEmail, UID: d.UID,
+			From: from, Subject: subject, Date: d.Date, Size: d.Size, Snippet: snippet,
+			List: list, Duplicates: duplicates[d.ID],
+		})
+	}
+	writeJSON(w, http.StatusOK, searchResponse{Owner: owner, Messages: results})
+}
+
+// dedupCached is mail.Dedup for cached previews: of the copies of a message
+// in one account, the smallest is kept where the first stood, and the
+// returned map counts the copies left out by the ID of the one kept.
+func dedupCached(docs []db.CachedMessage) ([]db.CachedMessage, map[primitive.ObjectID]int) {
+	kept := make(map[[2]string]int) // account and dedup index -> index in out
+	duplicates := make(map[primitive.ObjectID]int)
+	out := make([]db.CachedMessage, 0, len(docs))
+	for _, d := range docs {
+		key := [2]string{d.AccountEmail, d.DedupIndex}
+		i, seen := kept[key]
+		if d.DedupIndex == "" || !seen {
+			if d.DedupIndex != "" {
+				kept[key] = len(out)
+			}
+			out = append(out, d)
+			continue
+		}
+		if d.Size < out[i].Size {
+			duplicates[d.ID] = duplicates[out[i].ID]
+			delete(duplicates, out[i].ID)
+			out[i] = d
+		}
+		duplicates[out[i].ID]++
+	}
+	return out, duplicates
+}
+
+// MigrateMessageCache encrypts cached previews written before field
+// encryption existed, replacing their plaintext sender and subject.  It is
+// safe to run repeatedly and returns the number of documents migrated.
+func MigrateMessageCache(ctx context.Context, database db.DB, cfg *config.Config) (int, error) {
+	fc, err := vault.NewFieldCipher(cfg.EncryptionKey)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for {
+		docs, err := database.GetPlaintextCachedMessages(ctx, migrateBatchSize)
+		if err != nil {
+			return migrated, err
+		}
+		if len(docs) == 0 {
+			return migrated, nil
+		}
+		for i := range docs {
+			doc, err := encryptPreview(fc, &docs[i])
+			if err != nil {
+				return migrated, err
+			}
+			if _, err := database.UpsertCachedMessage(ctx, doc); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mulamail/db"
+)
+
+func searchCache(t *testing.T, server *Server, query string) []cachedPreview {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/v1/mail/search?"+query, nil)
+	w := httptest.NewRecorder()
+	server.searchMessages(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("search: status %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Messages []cachedPreview `json:"messages"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return resp.Messages
+}
+
+func TestFetchInbox_CachesEncryptedPreviews(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{messages: map[int]string{
+		1: "From: Alice <alice@example.com>\r\nSubject: Secret plans\r\nDate: Mon, 2 Jan 2006 15:04:05 -0700\r\n\r\nbody",
+		2: "From: bob@example.org\r\nSubject: Lunch\r\n\r\nbody",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil)
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("inbox: status %d: %s", w.Code, w.Body.String())
+	}
+
+	if len(mockDB.Cached) != 2 {
+		t.Fatalf("expected 2 cached previews, got %d", len(mockDB.Cached))
+	}
+	for _, c := range mockDB.Cached {
+		if c.From != "" || c.Subject != "" {
+			t.Errorf("cached document holds plaintext: %+v", c)
+		}
+		if strings.Contains(c.FromEnc+c.SubjectEnc+c.FromIndex, "alice") {
+			t.Errorf("cached document leaks the sender: %+v", c)
+		}
+	}
+
+	got := searchCache(t, server, "owner=owner&from=ALICE@example.com")
+	if len(got) != 1 || got[0].Subject != "Secret plans" || got[0].From != "Alice <alice@example.com>" || got[0].UID != "uid-1" {
+		t.Errorf("unexpected search result %+v", got)
+	}
+	if got := searchCache(t, server, "owner=someone-else&from=alice@example.com"); len(got) != 0 {
+		t.Errorf("search must be scoped to the owner, got %+v", got)
+	}
+}
+
+func TestMigrateMessageCache(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+
+	for _, uid := range []string{"a", "b", "c"} {
+		mockDB.Cached = append(mockDB.Cached, &db.CachedMessage{
+			OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: uid,
+			From: "Carol <carol@example.net>", Subject: "legacy " + uid,
+		})
+	}
+
+	n, err := MigrateMessageCache(ctx, mockDB, server.cfg)
+	if err != nil {
+		t.Fatalf("MigrateMessageCache failed: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("migrated: want 3, got %d", n)
+	}
+	for _, c := range mockDB.Cached {
+		if c.From != "" || c.Subject != "" || c.FromEnc == "" {
+			t.Errorf("document not migrated: %+v", c)
+		}
+	}
+
+	if got := searchCache(t, server, "owner=owner&from=carol@example.net"); len(got) != 3 {
+		t.Errorf("migrated documents should be searchable, got %+v", got)
+	}
+
+	// Running again is a no-op.
+	if n, err := MigrateMessageCache(ctx, mockDB, server.cfg); err != nil || n != 0 {
+		t.Errorf("second run: want 0 migrated, got %d (%v)", n, err)
+	}
+}
+
+func TestSearchMessages_MissingParameters(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/search?owner=owner", nil)
+	w := httptest.NewRecorder()
+	server.searchMessages(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
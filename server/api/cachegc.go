@@ -0,0 +1,286 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mulamail/config"
+	"mulamail/db"
+	"mulamail/vault"
+)
+
+// CacheGCOptions controls one sweep of the preview cache.
+type CacheGCOptions struct {
+	DryRun           bool          // report what would be deleted, delete nothing
+	Retention        time.Duration // previews no fetch has seen for longer are deleted; 0 deletes only vanished ones
+	BatchSize        int           // previews read and deleted at a time
+	DeletesPerSecond int           // cap on previews deleted per second; 0 means no cap
+	Owner, Account   string        // when set, only this owner's, or this account's, previews are swept
+}
+
+// CacheGCReport summarises one sweep.
+type CacheGCReport struct {
+	DryRun   bool `json:"dry_run"`
+	Vanished int  `json:"vanished"` // previews whose UIDL a fetch found gone from the server
+	Unseen   int  `json:"unseen"`   // previews no fetch has seen within the retention
+	Archived int  `json:"archived"` // of those, kept because the message itself is stored in the vault
+	Deleted  int  `json:"deleted"`  // previews deleted (0 for a dry run)
+}
+
+// auditDetail returns the report as audit event detail.
+func (r CacheGCReport) auditDetail() map[string]any {
+	return map[string]any{
+		"dry_run":  r.DryRun,
+		"vanished": r.Vanished,
+		"unseen":   r.Unseen,
+		"archived": r.Archived,
+		"deleted":  r.Deleted,
+	}
+}
+
+// cacheGCStats totals this instance's sweeps for GET /api/v1/admin/metrics.
+type cacheGCStats struct {
+	Runs     int            `json:"runs"`
+	Failures int            `json:"failures"`
+	Deleted  int            `json:"deleted"`
+	LastRun  time.Time      `json:"last_run,omitzero"`
+	Last     *CacheGCReport `json:"last,omitempty"`
+}
+
+// cacheGCTotals is shared by the background sweeper and the admin
+// endpoint, which run on different Servers.
+var cacheGCTotals struct {
+	mu    sync.Mutex
+	stats cacheGCStats
+}
+
+// recordCacheGC adds a sweep to cacheGCTotals.
+func recordCacheGC(res CacheGCReport, err error) {
+	cacheGCTotals.mu.Lock()
+	defer cacheGCTotals.mu.Unlock()
+	st := &cacheGCTotals.stats
+	st.Runs++
+	if err != nil {
+		st.Failures++
+	}
+	st.Deleted += res.Deleted
+	st.LastRun, st.Last = time.Now(), &res
+}
+
+// cacheGCMetrics returns the totals of this instance's sweeps.
+func cacheGCMetrics() cacheGCStats {
+	cacheGCTotals.mu.Lock()
+	defer cacheGCTotals.mu.Unlock()
+	return cacheGCTotals.stats
+}
+
+// sweepMessageCache deletes cached previews of messages that are gone:
+// those whose UIDL an inbox fetch found missing from the server, and
+// those no fetch has seen within the retention.  A preview whose message
+// is stored in the vault, archived or read, is kept: it indexes the copy
+// the vault holds, which the vault collector would otherwise delete.  The
+// report is written to the audit log, under the swept owner if any.
+func (s *Server) sweepMessageCache(ctx context.Context, opts CacheGCOptions) (CacheGCReport, error) {
+	res := CacheGCReport{DryRun: opts.DryRun}
+	q := db.StaleMessageQuery{Owner: opts.Owner, Account: opts.Account, Limit: max(opts.BatchSize, 1)}
+	if opts.Retention > 0 {
+		q.SeenBefore = time.Now().Add(-opts.Retention)
+	}
+	archives := make(map[string]map[string]bool) // vault keys, by account prefix
+
+	err := func() error {
+		for {
+			batch, err := s.db.FindStaleCachedMessages(ctx, q)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				return nil
+			}
+			q.After = batch[len(batch)-1].ID
+
+			var ids []primitive.ObjectID
+			for _, m := range batch {
+				if !m.VanishedAt.IsZero() {
+					res.Vanished++
+				} else {
+					res.Unseen++
+				}
+				archived, err := s.archivedMessage(ctx, archives, messageCacheKey(m.OwnerPubKey, m.AccountEmail, m.UID))
+				if err != nil {
+					return err
+				}
+				if archived {
+					res.Archived++
+					continue
+				}
+				ids = append(ids, m.ID)
+			}
+			if !opts.DryRun && len(ids) > 0 {
+				n, err := s.db.DeleteCachedMessages(ctx, ids)
+				res.Deleted += int(n)
+				if err != nil {
+					return err
+				}
+				if opts.DeletesPerSecond > 0 {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-time.After(time.Duration(len(ids)) * time.Second / time.Duration(opts.DeletesPerSecond)):
+					}
+				}
+			}
+			if len(batch) < q.Limit {
+				return nil
+			}
+		}
+	}()
+
+	recordCacheGC(res, err)
+	detail := res.auditDetail()
+	if err != nil {
+		detail["error"] = sanitizeError(err)
+		s.audit(ctx, opts.Owner, "cache.gc.failed", opts.Account, detail)
+		return res, err
+	}
+	s.audit(ctx, opts.Owner, "cache.gc.completed", opts.Account, detail)
+	return res, nil
+}
+
+// archivedMessage reports whether the vault holds the message at key,
+// listing the keys of its account once per sweep.
+func (s *Server) archivedMessage(ctx context.Context, archives map[string]map[string]bool, key string) (bool, error) {
+	if s.storage == nil {
+		return false, nil
+	}
+	prefix := key[:strings.LastIndex(key, "/")+1]
+	keys, ok := archives[prefix]
+	if !ok {
+		keys = make(map[string]bool)
+		err := vault.ForEachPage(ctx, s.storage, prefix, func(page []string) error {
+			for _, k := range page {
+				keys[k] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return false, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		archives[prefix] = keys
+	}
+	return keys[key], nil
+}
+
+// ---------- background sweep ----------
+
+// CacheGC sweeps the preview cache periodically.
+type CacheGC struct {
+	srv      *Server
+	leader   *leader
+	interval time.Duration
+	opts     CacheGCOptions
+}
+
+// NewCacheGC creates a sweeper of the preview cache.  storage is where
+// messages are archived; previews of those are kept.
+func NewCacheGC(database db.DB, storage vault.Storage, cfg *config.Config) *CacheGC {
+	return &CacheGC{
+		srv:      &Server{db: database, storage: storage, cfg: cfg},
+		leader:   newLeader(database, roleCacheGC, cfg),
+		interval: time.Duration(cfg.CacheGCIntervalHours) * time.Hour,
+		opts:     cacheGCOptions(cfg),
+	}
+}
+
+// cacheGCOptions returns the sweep options configured in cfg.
+func cacheGCOptions(cfg *config.Config) CacheGCOptions {
+	return CacheGCOptions{
+		Retention:        time.Duration(cfg.CacheRetentionDays) * 24 * time.Hour,
+		BatchSize:        cfg.CacheGCBatchSize,
+		DeletesPerSecond: cfg.CacheGCDeletesPerSecond,
+	}
+}
+
+// Run sweeps once per interval until ctx is cancelled; like VaultGC.Run,
+// the first sweep waits a full interval, a zero interval disables the
+// sweeper, and only the instance leading the cache-gc role sweeps.
+func (gc *CacheGC) Run(ctx context.Context) {
+	if gc.interval <= 0 {
+		return
+	}
+	gc.leader.elect(ctx)
+	ticker := time.NewTicker(gc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !gc.leader.leads() || gc.srv.paused(ctx) {
+			continue
+		}
+		res, err := gc.srv.sweepMessageCache(ctx, gc.opts)
+		if err != nil {
+			log.Printf("cache gc: %v", err)
+			continue
+		}
+		if res.Deleted > 0 {
+			log.Printf("cache gc: deleted %d cached previews (%d vanished, %d unseen, %d kept as archived)",
+				res.Deleted, res.Vanished, res.Unseen, res.Archived)
+		}
+	}
+}
+
+// cacheGCRequest is the body of POST /api/v1/admin/cache-gc.
+type cacheGCRequest struct {
+	OwnerPubKey   string `json:"owner_pubkey"`
+	AccountEmail  string `json:"account_email"`
+	DryRun        bool   `json:"dry_run"`
+	RetentionDays *int   `json:"retention_days,omitempty"` // default CACHE_RETENTION_DAYS
+}
+
+// POST /api/v1/admin/cache-gc
+//
+// Sweeps one account's cached previews now, as the background sweep does
+// every account's, and reports what was found.  Previews are only marked
+// vanished by an inbox fetch, so fetch the account first to sweep the
+// messages just deleted from its server.
+//
+// Request:  { "owner_pubkey": "...", "account_email": "me@example.com", "dry_run": true, "retention_days": 30 }
+// Response: { "dry_run": true, "vanished": 12, "unseen": 3, "archived": 2, "deleted": 0 }
+func (s *Server) cacheGC(w http.ResponseWriter, r *http.Request) {
+	var req cacheGCRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if req.OwnerPubKey == "" || req.AccountEmail == "" {
+		writeError(w, http.StatusBadRequest, "owner_pubkey and account_email are required")
+		return
+	}
+	opts := cacheGCOptions(s.cfg)
+	opts.DryRun, opts.Owner, opts.Account = req.DryRun, req.OwnerPubKey, req.AccountEmail
+	if req.RetentionDays != nil {
+		if *req.RetentionDays < 0 {
+			writeError(w, http.StatusBadRequest, "retention_days must not be negative")
+			return
+		}
+		opts.Retention = time.Duration(*req.RetentionDays) * 24 * time.Hour
+	}
+
+	res, err := s.sweepMessageCache(r.Context(), opts)
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "cache gc failed", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+	"mulamail/vault"
+)
+
+// cachedUIDs returns the UIDs of the previews cached for account.
+func cachedUIDs(mockDB *dbtest.Mock, owner, account string) []string {
+	msgs, _ := mockDB.GetCachedMessagesByOwner(context.Background(), owner)
+	var uids []string
+	for _, m := range msgs {
+		if m.AccountEmail == account {
+			uids = append(uids, m.UID)
+		}
+	}
+	slices.Sort(uids)
+	return uids
+}
+
+func TestSweepMessageCache(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	storage, err := vault.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+	server.storage = storage
+	ctx := context.Background()
+
+	longAgo := time.Now().Add(-100 * 24 * time.Hour)
+	seed := func(account, uid string, tweak func(*db.CachedMessage)) {
+		mockDB.UpsertCachedMessage(ctx, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: account, UID: uid})
+		tweak(mockDB.Cached[len(mockDB.Cached)-1])
+	}
+	seed("me@example.com", "fresh", func(*db.CachedMessage) {})
+	seed("me@example.com", "old", func(c *db.CachedMessage) { c.LastSeenAt = longAgo })
+	seed("me@example.com", "legacy", func(c *db.CachedMessage) { c.LastSeenAt, c.CachedAt = time.Time{}, longAgo })
+	seed("me@example.com", "gone", func(c *db.CachedMessage) { c.VanishedAt = time.Now() })
+	seed("me@example.com", "archived", func(c *db.CachedMessage) { c.VanishedAt = time.Now() })
+	seed("other@example.com", "gone", func(c *db.CachedMessage) { c.VanishedAt = time.Now() })
+	storage.Put(ctx, messageCacheKey("owner", "me@example.com", "archived"), []byte("raw"))
+
+	before := cacheGCMetrics()
+	opts := CacheGCOptions{DryRun: true, Retention: 90 * 24 * time.Hour, BatchSize: 2, DeletesPerSecond: 1000}
+	res, err := server.sweepMessageCache(ctx, opts)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	want := CacheGCReport{DryRun: true, Vanished: 3, Unseen: 2, Archived: 1}
+	if res != want {
+		t.Errorf("dry run: want %+v, got %+v", want, res)
+	}
+	if len(mockDB.Cached) != 6 {
+		t.Errorf("dry run deleted previews, %d left", len(mockDB.Cached))
+	}
+
+	opts.DryRun = false
+	res, err = server.sweepMessageCache(ctx, opts)
+	if err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	want.DryRun, want.Deleted = false, 4
+	if res != want {
+		t.Errorf("sweep: want %+v, got %+v", want, res)
+	}
+	if got := cachedUIDs(mockDB, "owner", "me@example.com"); !slices.Equal(got, []string{"archived", "fresh"}) {
+		t.Errorf("left in the cache: %v", got)
+	}
+	if got := cachedUIDs(mockDB, "owner", "other@example.com"); len(got) != 0 {
+		t.Errorf("left in the other account's cache: %v", got)
+	}
+
+	last := mockDB.Audit[len(mockDB.Audit)-1]
+	if last.Action != "cache.gc.completed" || last.Detail["deleted"] != 4 {
+		t.Errorf("audit event: %+v", last)
+	}
+	after := cacheGCMetrics()
+	if after.Runs-before.Runs != 2 || after.Deleted-before.Deleted != 4 || after.Last == nil || after.Last.Deleted != 4 {
+		t.Errorf("metrics: before %+v, after %+v", before, after)
+	}
+}
+
+func TestSweepMessageCache_NoRetention(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+
+	mockDB.UpsertCachedMessage(ctx, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: "old"})
+	mockDB.Cached[0].LastSeenAt = time.Now().Add(-1000 * 24 * time.Hour)
+	mockDB.UpsertCachedMessage(ctx, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: "gone"})
+	mockDB.Cached[1].VanishedAt = time.Now()
+
+	res, err := server.sweepMessageCache(ctx, CacheGCOptions{BatchSize: 10})
+	if err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if res.Deleted != 1 || res.Unseen != 0 {
+		t.Errorf("without a retention only vanished previews go, got %+v", res)
+	}
+	if got := cachedUIDs(mockDB, "owner", "me@example.com"); !slices.Equal(got, []string{"old"}) {
+		t.Errorf("left in the cache: %v", got)
+	}
+}
+
+func TestFetchInbox_MarksVanishedPreviews(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+
+	fake := &fakePOP3{messages: map[int]string{1: "Subject: one\r\n\r\nbody", 2: "Subject: two\r\n\r\nbody"}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	// Deleted from the server since it was cached.
+	mockDB.UpsertCachedMessage(ctx, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: "uid-9"})
+
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("inbox: status %d: %s", w.Code, w.Body.String())
+	}
+	for _, c := range mockDB.Cached {
+		if vanished := !c.VanishedAt.IsZero(); vanished != (c.UID == "uid-9") {
+			t.Errorf("%s: vanished_at %v", c.UID, c.VanishedAt)
+		}
+	}
+
+	res, err := server.sweepMessageCache(ctx, CacheGCOptions{Retention: 90 * 24 * time.Hour, BatchSize: 100})
+	if err != nil || res.Deleted != 1 {
+		t.Fatalf("sweep: want 1 deleted, got %+v, %v", res, err)
+	}
+	if got := cachedUIDs(mockDB, "owner", "me@example.com"); !slices.Equal(got, []string{"uid-1", "uid-2"}) {
+		t.Errorf("left in the cache: %v", got)
+	}
+}
+
+func TestCacheGCEndpoint(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+	server.cfg.CacheRetentionDays = 90
+	server.cfg.CacheGCBatchSize = 100
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	ctx := context.Background()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/admin/cache-gc", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, body := range []string{`not json`, `{"owner_pubkey":"owner"}`,
+		`{"owner_pubkey":"owner","account_email":"me@example.com","retention_days":-1}`} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: want 400, got %d", body, w.Code)
+		}
+	}
+
+	for _, account := range []string{"me@example.com", "other@example.com"} {
+		mockDB.UpsertCachedMessage(ctx, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: account, UID: "1"})
+		mockDB.Cached[len(mockDB.Cached)-1].LastSeenAt = time.Now().Add(-48 * time.Hour)
+	}
+	w := post(`{"owner_pubkey":"owner","account_email":"me@example.com","retention_days":1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("sweep: status %d: %s", w.Code, w.Body.String())
+	}
+	var res CacheGCReport
+	json.NewDecoder(w.Body).Decode(&res)
+	if res.Deleted != 1 || res.Unseen != 1 {
+		t.Errorf("unexpected report %+v", res)
+	}
+	if got := cachedUIDs(mockDB, "owner", "other@example.com"); len(got) != 1 {
+		t.Errorf("only the named account is swept, other account left with %v", got)
+	}
+	last := mockDB.Audit[len(mockDB.Audit)-1]
+	if last.OwnerPubKey != "owner" || last.Target != "me@example.com" || last.Action != "cache.gc.completed" {
+		t.Errorf("audit event: %+v", last)
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"mulamail/config"
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+// canonicalRules returns the EMAIL_CANONICAL_RULES.  serve refuses to start
+// with invalid rules, so an error here can only come from a test config,
+// which then gets lower-casing alone.
+func (s *Server) canonicalRules() mail.CanonicalRules {
+	rules, _ := mail.ParseCanonicalRules(s.cfg.EmailCanonicalRules)
+	return rules
+}
+
+// canonicalEmails returns the canonical form of each of emails.
+func canonicalEmails(rules mail.CanonicalRules, emails []string) []string {
+	canonicals := make([]string, len(emails))
+	for i, email := range emails {
+		canonicals[i] = rules.Canonical(email)
+	}
+	return canonicals
+}
+
+// identitiesByEmail matches the identities GetIdentitiesByCanonicalEmails
+// found back to the addresses queried.
+type identitiesByEmail struct {
+	rules       mail.CanonicalRules
+	byCanonical map[string]*db.Identity
+	byEmail     map[string]*db.Identity // identities without a canonical email
+}
+
+func indexIdentities(rules mail.CanonicalRules, found []db.Identity) identitiesByEmail {
+	ix := identitiesByEmail{
+		rules:       rules,
+		byCanonical: make(map[string]*db.Identity, len(found)),
+		byEmail:     make(map[string]*db.Identity),
+	}
+	for i := range found {
+		if id := &found[i]; id.CanonicalEmail != "" {
+			ix.byCanonical[id.CanonicalEmail] = id
+		} else {
+			ix.byEmail[id.Email] = id
+		}
+	}
+	return ix
+}
+
+// find returns the identity email resolves to, as GetIdentityByCanonicalEmail
+// would: the one with its canonical form, else one without a canonical
+// email registered under exactly email.
+func (ix identitiesByEmail) find(email string) *db.Identity {
+	if id := ix.byCanonical[ix.rules.Canonical(email)]; id != nil {
+		return id
+	}
+	return ix.byEmail[email]
+}
+
+// IdentityCollision is a canonical email that several identities share.
+// The oldest keeps it; the others are left without a canonical email, so
+// they resolve by their exact email only, until an operator settles which
+// mapping is right.  Kept is empty when the canonical email went to an
+// identity registered while the run was in progress.
+type IdentityCollision struct {
+	CanonicalEmail string   `json:"canonical_email"`
+	Kept           string   `json:"kept"`
+	Skipped        []string `json:"skipped"`
+}
+
+// CanonicalizeResult summarises one identity canonicalisation run.
+type CanonicalizeResult struct {
+	Identities int                 `json:"identities"`
+	Updated    int                 `json:"updated"` // canonical emails set, changed or removed
+	Collisions []IdentityCollision `json:"collisions"`
+}
+
+// CanonicalizeIdentities brings the canonical email of every identity in
+// line with the current EMAIL_CANONICAL_RULES: it backfills identities
+// stored before canonicalisation and updates those canonicalised under
+// earlier rules.  Identities that collide on a canonical email are reported,
+// never merged.  It is safe to run repeatedly.
+func CanonicalizeIdentities(ctx context.Context, database db.DB, cfg *config.Config) (CanonicalizeResult, error) {
+	rules, err := mail.ParseCanonicalRules(cfg.EmailCanonicalRules)
+	if err != nil {
+		return CanonicalizeResult{}, err
+	}
+	ids, err := database.GetAllIdentities(ctx)
+	if err != nil {
+		return CanonicalizeResult{}, err
+	}
+	res := CanonicalizeResult{Identities: len(ids), Collisions: []IdentityCollision{}}
+
+	// Oldest first, the first identity with each canonical email keeps it.
+	want := make([]string, len(ids))
+	holder := make(map[string]int)
+	collisions := make(map[string]int) // canonical email -> index in res.Collisions
+	for i := range ids {
+		canonical := rules.Canonical(ids[i].Email)
+		k, taken := holder[canonical]
+		if !taken {
+			holder[canonical], want[i] = i, canonical
+			continue
+		}
+		c, seen := collisions[canonical]
+		if !seen {
+			c = len(res.Collisions)
+			collisions[canonical] = c
+			res.Collisions = append(res.Collisions, IdentityCollision{CanonicalEmail: canonical, Kept: ids[k].Email})
+		}
+		res.Collisions[c].Skipped = append(res.Collisions[c].Skipped, ids[i].Email)
+	}
+
+	// Release stale canonical emails before assigning any, so that a
+	// canonical email moving between identities is never held twice.
+	for i := range ids {
+		if ids[i].CanonicalEmail == "" || ids[i].CanonicalEmail == want[i] {
+			continue
+		}
+		if err := database.SetIdentityCanonicalEmail(ctx, ids[i].ID, ""); err != nil {
+			return res, err
+		}
+		res.Updated++
+	}
+	for i := range ids {
+		if want[i] == "" || ids[i].CanonicalEmail == want[i] {
+			continue
+		}
+		err := database.SetIdentityCanonicalEmail(ctx, ids[i].ID, want[i])
+		if errors.Is(err, db.ErrDuplicate) {
+			res.Collisions = append(res.Collisions, IdentityCollision{CanonicalEmail: want[i], Skipped: []string{ids[i].Email}})
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+		if ids[i].CanonicalEmail == "" {
+			res.Updated++ // otherwise counted when released
+		}
+	}
+	return res, nil
+}
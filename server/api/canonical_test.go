@@ -0,0 +1,146 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/db"
+)
+
+func resolveEmail(server *Server, email, extra string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/v1/identity/resolve?email="+url.QueryEscape(email)+extra, nil)
+	w := httptest.NewRecorder()
+	server.resolveIdentity(w, req)
+	return w
+}
+
+func TestResolveIdentity_Canonical(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.EmailCanonicalRules = "gmail.com:plus:dots"
+	ctx := context.Background()
+	mockDB.CreateIdentity(ctx, &db.Identity{Email: "alice@gmail.com", CanonicalEmail: "alice@gmail.com", PubKey: "pk-alice"})
+	mockDB.CreateIdentity(ctx, &db.Identity{Email: "bob+x@example.com", PubKey: "pk-bob"}) // not yet canonicalised
+
+	for _, email := range []string{"alice@gmail.com", "A.lice+invoices@gmail.com", "bob+x@example.com"} {
+		w := resolveEmail(server, email, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: want %d, got %d: %s", email, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	if w := resolveEmail(server, "A.lice+invoices@gmail.com", "&exact=true"); w.Code != http.StatusNotFound {
+		t.Errorf("exact sub-address: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := resolveEmail(server, "alice@gmail.com", "&exact=true"); w.Code != http.StatusOK {
+		t.Errorf("exact registered address: want %d, got %d", http.StatusOK, w.Code)
+	}
+	// No rules for example.com, so its plus-tags are part of the mailbox.
+	if w := resolveEmail(server, "bob@example.com", ""); w.Code != http.StatusNotFound {
+		t.Errorf("untagged address on a domain without rules: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestResolveIdentityBatch_Canonical(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.EmailCanonicalRules = "gmail.com:plus:dots"
+	mockDB.CreateIdentity(context.Background(), &db.Identity{Email: "alice@gmail.com", CanonicalEmail: "alice@gmail.com", PubKey: "pk-alice"})
+
+	pubkeys := func(exact string) []string {
+		body, _ := json.Marshal(map[string]any{"emails": []string{"a.lice+x@gmail.com", "alice@gmail.com"}})
+		w := httptest.NewRecorder()
+		server.resolveIdentityBatch(w, httptest.NewRequest("POST", "/api/v1/identity/resolve-batch"+exact, bytes.NewBuffer(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var response resolveBatchResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		var got []string
+		for _, r := range response.Results {
+			if r.Identity == nil {
+				got = append(got, r.Reason)
+			} else {
+				got = append(got, r.Identity.PubKey)
+			}
+		}
+		return got
+	}
+	if got := pubkeys(""); !reflect.DeepEqual(got, []string{"pk-alice", "pk-alice"}) {
+		t.Errorf("canonical: want both resolved, got %v", got)
+	}
+	if got := pubkeys("?exact=true"); !reflect.DeepEqual(got, []string{"not_found", "pk-alice"}) {
+		t.Errorf("exact: want only the registered address resolved, got %v", got)
+	}
+}
+
+func TestRegisterIdentity_CanonicalConflict(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.EmailCanonicalRules = "gmail.com:plus:dots"
+	mockDB.CreateIdentity(context.Background(), &db.Identity{Email: "alice@gmail.com", CanonicalEmail: "alice@gmail.com", PubKey: "pk-alice"})
+
+	body, _ := json.Marshal(map[string]string{"signed_tx": signedIdentityTx(t, solana.NewWallet(), "a.lice+new@gmail.com")})
+	w := httptest.NewRecorder()
+	server.registerIdentity(w, httptest.NewRequest("POST", "/api/v1/identity/register", bytes.NewBuffer(body)))
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status code: want %d, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+}
+
+func TestCanonicalizeIdentities(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.EmailCanonicalRules = "gmail.com:plus:dots"
+	ctx := context.Background()
+	t0 := time.Now().Add(-time.Hour)
+	for i, id := range []*db.Identity{
+		{Email: "A.Lice@gmail.com", PubKey: "pk-1"},
+		{Email: "alice+x@gmail.com", PubKey: "pk-2"},
+		{Email: "bob@example.com", PubKey: "pk-3"},
+		{Email: "carol@gmail.com", CanonicalEmail: "stale@gmail.com", PubKey: "pk-4"},
+	} {
+		id.CreatedAt = t0.Add(time.Duration(i) * time.Minute)
+		mockDB.CreateIdentity(ctx, id)
+	}
+
+	res, err := CanonicalizeIdentities(ctx, mockDB, server.cfg)
+	if err != nil {
+		t.Fatalf("CanonicalizeIdentities failed: %v", err)
+	}
+	wantCollisions := []IdentityCollision{{CanonicalEmail: "alice@gmail.com", Kept: "A.Lice@gmail.com", Skipped: []string{"alice+x@gmail.com"}}}
+	if res.Identities != 4 || res.Updated != 3 || !reflect.DeepEqual(res.Collisions, wantCollisions) {
+		t.Errorf("want 4 identities, 3 updated and the alice collision, got %+v", res)
+	}
+	for email, want := range map[string]string{
+		"A.Lice@gmail.com":  "alice@gmail.com",
+		"alice+x@gmail.com": "",
+		"bob@example.com":   "bob@example.com",
+		"carol@gmail.com":   "carol@gmail.com",
+	} {
+		if got := mockDB.Identities[email].CanonicalEmail; got != want {
+			t.Errorf("%s: want canonical email %q, got %q", email, want, got)
+		}
+	}
+
+	// A rerun changes nothing but still reports the collision.
+	res, err = CanonicalizeIdentities(ctx, mockDB, server.cfg)
+	if err != nil || res.Updated != 0 || !reflect.DeepEqual(res.Collisions, wantCollisions) {
+		t.Errorf("rerun: want nothing updated, got %+v, %v", res, err)
+	}
+
+	// Dropping the rules gives the skipped identity its own canonical email.
+	server.cfg.EmailCanonicalRules = ""
+	res, err = CanonicalizeIdentities(ctx, mockDB, server.cfg)
+	if err != nil || res.Updated != 2 || len(res.Collisions) != 0 {
+		t.Errorf("without rules: want 2 updated and no collisions, got %+v, %v", res, err)
+	}
+	if got := mockDB.Identities["A.Lice@gmail.com"].CanonicalEmail; got != "a.lice@gmail.com" {
+		t.Errorf("without rules: want only lower-casing, got %q", got)
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/alert"
+	"mulamail/blockchain"
+	"mulamail/config"
+	"mulamail/db"
+)
+
+// chainCheckBatch caps the identities checked in one run.  The least
+// recently checked go first, so a larger backlog is worked through over
+// several runs.
+const chainCheckBatch = 500
+
+// chainFinalityGrace is how long a broadcast transaction may be unknown to
+// the cluster before it is taken as dropped.  A recent blockhash expires
+// after 150 slots, about a minute; the rest is margin for slow propagation.
+const chainFinalityGrace = 10 * time.Minute
+
+// maxAlertedIdentities caps the identities listed in one alert.
+const maxAlertedIdentities = 20
+
+// ChainCheckResult summarises one check of identity transactions.
+type ChainCheckResult struct {
+	Checked    int `json:"checked"`
+	Anchored   int `json:"anchored"`
+	Pending    int `json:"pending"`
+	Missing    int `json:"missing"`
+	Downgraded int `json:"downgraded"` // verified identities found missing, and no longer verified
+}
+
+// ChainChecker re-validates identities against the chain periodically.  An
+// identity is stored verified as soon as its memo transaction is
+// broadcast, but the transaction may still be dropped, for example when
+// its blockhash expires first; the checker then clears Verified and raises
+// an operator alert.
+type ChainChecker struct {
+	srv      *Server
+	leader   *leader
+	alerts   *alert.Bus
+	interval time.Duration
+	window   time.Duration // identities registered this recently are checked until anchored
+	now      func() time.Time
+}
+
+// NewChainChecker creates a checker of identity transactions that reports
+// lost anchors on alerts.
+func NewChainChecker(database db.DB, client *blockchain.Client, alerts *alert.Bus, cfg *config.Config) *ChainChecker {
+	return &ChainChecker{
+		srv:      &Server{db: database, solana: client, cfg: cfg},
+		leader:   newLeader(database, roleChainCheck, cfg),
+		alerts:   alerts,
+		interval: seconds(cfg.IdentityChainCheckIntervalSeconds),
+		window:   time.Duration(cfg.IdentityChainCheckDays) * 24 * time.Hour,
+		now:      time.Now,
+	}
+}
+
+// Run checks once immediately and then every interval until ctx is
+// cancelled.  A zero interval disables the check.  Only the instance
+// leading the chain-check role checks.
+func (cc *ChainChecker) Run(ctx context.Context) {
+	if cc.interval <= 0 {
+		return
+	}
+	cc.leader.elect(ctx)
+	ticker := time.NewTicker(cc.interval)
+	defer ticker.Stop()
+	for {
+		res, err := cc.check(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("chain check: %v", err)
+		}
+		if res.Checked > 0 {
+			log.Printf("chain check: %d identities checked: %d anchored, %d pending, %d missing",
+				res.Checked, res.Anchored, res.Pending, res.Missing)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check looks up the transactions of one batch of identities and records
+// what it finds.  Identities registered before the window are still
+// checked once, so those stored before the checker existed get a status.
+func (cc *ChainChecker) check(ctx context.Context) (ChainCheckResult, error) {
+	var res ChainCheckResult
+	if !cc.leader.leads() || cc.srv.paused(ctx) {
+		return res, nil
+	}
+	now := cc.now()
+	ids, err := cc.srv.db.GetIdentitiesToCheck(ctx, now.Add(-cc.window), chainCheckBatch)
+	if err != nil || len(ids) == 0 {
+		return res, err
+	}
+
+	// An unparseable hash is no transaction at all, so it is looked up
+	// as the zero signature, which the cluster never knows.
+	sigs := make([]solana.Signature, len(ids))
+	for i, id := range ids {
+		sigs[i], _ = solana.SignatureFromBase58(id.TxHash)
+	}
+	statuses, err := cc.srv.solana.TxStatuses(ctx, sigs)
+	if err != nil {
+		return res, err
+	}
+
+	var lost []string
+	for i, id := range ids {
+		status := identityChainStatus(statuses[i], now.Sub(id.CreatedAt))
+		verified := id.Verified
+		switch status {
+		case db.ChainAnchored:
+			res.Anchored++
+			verified = true
+		case db.ChainPending:
+			res.Pending++
+		case db.ChainMissing:
+			res.Missing++
+			if verified {
+				verified = false
+				res.Downgraded++
+				lost = append(lost, fmt.Sprintf("%s (pubkey %s, tx %s)", id.ID.Hex(), id.PubKey, id.TxHash))
+			}
+		}
+		if err := cc.srv.db.SetIdentityChainStatus(ctx, id.ID, status, verified, now); err != nil {
+			return res, err
+		}
+		res.Checked++
+	}
+
+	if len(lost) > 0 {
+		log.Printf("chain check: %d verified identities have no transaction on-chain: %s", len(lost), strings.Join(lost, ", "))
+		detail := lost[:min(len(lost), maxAlertedIdentities)]
+		if len(lost) > len(detail) {
+			detail = append(detail, fmt.Sprintf("and %d more", len(lost)-len(detail)))
+		}
+		cc.alerts.Raise(alert.Alert{
+			Key:      "identity.chain.missing",
+			Severity: alert.Warning,
+			Summary:  fmt.Sprintf("%d verified identities have no transaction on-chain and are no longer verified", len(lost)),
+			Detail:   strings.Join(detail, "\n"),
+		})
+	}
+	return res, nil
+}
+
+// identityChainStatus maps the status of an identity's transaction, age
+// after registration, to the identity's chain status.  A transaction that
+// failed will never anchor the identity; one still unknown is only taken
+// as dropped after chainFinalityGrace.
+func identityChainStatus(txStatus string, age time.Duration) string {
+	switch txStatus {
+	case blockchain.TxFinalized:
+		return db.ChainAnchored
+	case blockchain.TxFailed:
+		return db.ChainMissing
+	case blockchain.TxMissing:
+		if age >= chainFinalityGrace {
+			return db.ChainMissing
+		}
+	}
+	return db.ChainPending
+}
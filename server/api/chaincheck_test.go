@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mulamail/alert"
+	"mulamail/blockchain"
+	"mulamail/db"
+)
+
+// recordingSink collects the alerts a bus delivers.
+type recordingSink struct{ alerts chan alert.Alert }
+
+func (s recordingSink) Send(_ context.Context, a alert.Alert) error {
+	s.alerts <- a
+	return nil
+}
+
+func TestChainChecker(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	finalized, confirmed, failed, dropped, late, settled :=
+		solana.Signature{1}, solana.Signature{2}, solana.Signature{3}, solana.Signature{4}, solana.Signature{5}, solana.Signature{6}
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var sigs []solana.Signature
+		json.Unmarshal(req.Params[0], &sigs)
+		value := make([]any, len(sigs))
+		for i, sig := range sigs {
+			switch sig {
+			case finalized:
+				value[i] = map[string]any{"slot": 1, "err": nil, "confirmationStatus": "finalized"}
+			case confirmed:
+				value[i] = map[string]any{"slot": 2, "err": nil, "confirmationStatus": "confirmed"}
+			case failed:
+				value[i] = map[string]any{"slot": 3, "err": map[string]any{"InstructionError": []any{0, "Custom"}}, "confirmationStatus": "finalized"}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID,
+			"result": map[string]any{"context": map[string]any{"slot": 10}, "value": value}})
+	}))
+	defer rpcServer.Close()
+	server.solana = blockchain.NewClient(rpcServer.URL)
+
+	now := time.Now()
+	ctx := context.Background()
+	for _, id := range []*db.Identity{
+		{Email: "finalized@example.com", TxHash: finalized.String(), CreatedAt: now.Add(-time.Hour)},
+		{Email: "confirmed@example.com", TxHash: confirmed.String(), CreatedAt: now.Add(-time.Minute)},
+		{Email: "failed@example.com", TxHash: failed.String(), CreatedAt: now.Add(-time.Minute)},
+		{Email: "dropped@example.com", TxHash: dropped.String(), CreatedAt: now.Add(-time.Hour)},
+		{Email: "recent@example.com", TxHash: late.String(), CreatedAt: now.Add(-time.Minute)},
+		{Email: "settled@example.com", TxHash: settled.String(), CreatedAt: now.Add(-time.Hour), ChainStatus: db.ChainAnchored},
+		{Email: "legacy@example.com", TxHash: finalized.String(), CreatedAt: now.AddDate(-1, 0, 0)},
+		{Email: "old@example.com", TxHash: dropped.String(), CreatedAt: now.AddDate(-1, 0, 0), ChainStatus: db.ChainMissing},
+	} {
+		id.PubKey, id.Verified = "pk-"+strings.TrimSuffix(id.Email, "@example.com"), true
+		id.ID = primitive.NewObjectID()
+		mockDB.Identities[id.Email] = id // seeded, as CreateIdentity stamps CreatedAt
+	}
+
+	sink := recordingSink{alerts: make(chan alert.Alert, 1)}
+	bus := alert.NewBus(time.Hour, sink)
+	busCtx, stopBus := context.WithCancel(ctx)
+	defer stopBus()
+	go bus.Run(busCtx)
+	cc := &ChainChecker{srv: server, alerts: bus, window: 7 * 24 * time.Hour, now: func() time.Time { return now }}
+
+	res, err := cc.check(ctx)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if want := (ChainCheckResult{Checked: 6, Anchored: 2, Pending: 2, Missing: 2, Downgraded: 2}); res != want {
+		t.Errorf("want %+v, got %+v", want, res)
+	}
+	for email, want := range map[string]struct {
+		status   string
+		verified bool
+	}{
+		"finalized@example.com": {db.ChainAnchored, true},
+		"confirmed@example.com": {db.ChainPending, true},
+		"failed@example.com":    {db.ChainMissing, false},
+		"dropped@example.com":   {db.ChainMissing, false},
+		"recent@example.com":    {db.ChainPending, true},
+		"settled@example.com":   {db.ChainAnchored, true},
+		"legacy@example.com":    {db.ChainAnchored, true},
+		"old@example.com":       {db.ChainMissing, true}, // outside the window and already checked
+	} {
+		id := mockDB.Identities[email]
+		if id.ChainStatus != want.status || id.Verified != want.verified {
+			t.Errorf("%s: want %s, verified %v, got %s, verified %v", email, want.status, want.verified, id.ChainStatus, id.Verified)
+		}
+	}
+
+	select {
+	case a := <-sink.alerts:
+		if a.Key != "identity.chain.missing" || !strings.Contains(a.Detail, "pk-dropped") || !strings.Contains(a.Detail, "pk-failed") {
+			t.Errorf("unexpected alert %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("want an alert for the identities that lost their anchor")
+	}
+
+	// The resolve endpoint reports the status.
+	w := resolveEmail(server, "dropped@example.com", "")
+	var got db.Identity
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.ChainStatus != db.ChainMissing || got.Verified {
+		t.Errorf("resolve: want chain_status missing and not verified, got %s, %v", got.ChainStatus, got.Verified)
+	}
+
+	// Anchored identities are not checked again; the rest are, and a late
+	// landing restores the identity.
+	finalized, dropped = dropped, finalized
+	res, err = cc.check(ctx)
+	if err != nil || res.Checked != 4 {
+		t.Fatalf("second check: want 4 identities checked, got %+v, %v", res, err)
+	}
+	if id := mockDB.Identities["dropped@example.com"]; id.ChainStatus != db.ChainAnchored || !id.Verified {
+		t.Errorf("late landing: want anchored and verified, got %s, %v", id.ChainStatus, id.Verified)
+	}
+}
+
+func TestIdentityChainStatus(t *testing.T) {
+	tests := []struct {
+		tx   string
+		age  time.Duration
+		want string
+	}{
+		{blockchain.TxFinalized, time.Second, db.ChainAnchored},
+		{blockchain.TxPending, time.Hour, db.ChainPending},
+		{blockchain.TxFailed, time.Second, db.ChainMissing},
+		{blockchain.TxMissing, time.Minute, db.ChainPending},
+		{blockchain.TxMissing, chainFinalityGrace, db.ChainMissing},
+	}
+	for _, tt := range tests {
+		if got := identityChainStatus(tt.tx, tt.age); got != tt.want {
+			t.Errorf("identityChainStatus(%s, %v): want %s, got %s", tt.tx, tt.age, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies reads TRUSTED_PROXIES: a comma-separated list of
+// CIDRs, or of bare addresses standing for themselves alone.  An empty spec
+// trusts no proxy.
+func ParseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a CIDR", entry)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address", entry)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// trusted reports whether addr belongs to one of the proxies.
+func trusted(proxies []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// withClientIP resolves the address of the client behind each request and
+// stores it in the request context, where clientIP finds it.
+func withClientIP(proxies []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(proxies, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey, ip)))
+	})
+}
+
+// clientIP returns the client address resolved by withClientIP, or the zero
+// Addr outside of it.
+func clientIP(ctx context.Context) netip.Addr {
+	ip, _ := ctx.Value(clientIPKey).(netip.Addr)
+	return ip
+}
+
+// resolveClientIP returns the address of the client that made r.  The
+// forwarding headers are only believed when the peer is a trusted proxy,
+// since anyone else can write them.  X-Forwarded-For is then read from the
+// right, each hop added by the proxy before it, and the first address that
+// is not a trusted proxy is the client's; an entry that is not an address
+// ends the walk at the last proxy trusted to have written it.  Without
+// X-Forwarded-For, X-Real-IP names the client.
+func resolveClientIP(proxies []netip.Prefix, r *http.Request) netip.Addr {
+	peer, ok := parseHop(r.RemoteAddr)
+	if !ok || !trusted(proxies, peer) {
+		return peer
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if ip, ok := parseHop(r.Header.Get("X-Real-IP")); ok {
+			return ip
+		}
+		return peer
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		client = ip
+		if !trusted(proxies, ip) {
+			break
+		}
+	}
+	return client
+}
+
+// parseHop reads an address as a peer or a proxy reports it: bare, or with
+// a port, IPv6 addresses in brackets when they have one.  IPv4-mapped IPv6
+// addresses are reduced to IPv4.
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
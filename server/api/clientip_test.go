@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.5, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		peer   string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{name: "direct", peer: "203.0.113.7:5000", want: "203.0.113.7"},
+		{name: "spoofed from untrusted peer", peer: "203.0.113.7:5000", xff: []string{"1.2.3.4"}, realIP: "5.6.7.8", want: "203.0.113.7"},
+		{name: "one trusted hop", peer: "10.0.0.1:5000", xff: []string{"198.51.100.9"}, want: "198.51.100.9"},
+		{name: "bare address proxy", peer: "192.168.1.5:5000", xff: []string{"198.51.100.9"}, want: "198.51.100.9"},
+		{name: "neighbour of a bare address proxy", peer: "192.168.1.6:5000", xff: []string{"198.51.100.9"}, want: "192.168.1.6"},
+		{name: "client-supplied prefix ignored", peer: "10.0.0.1:5000", xff: []string{"1.2.3.4, 198.51.100.9, 10.1.1.1"}, want: "198.51.100.9"},
+		{name: "several headers", peer: "10.0.0.1:5000", xff: []string{"1.2.3.4, 198.51.100.9", "10.1.1.1"}, want: "198.51.100.9"},
+		{name: "all hops trusted", peer: "10.0.0.1:5000", xff: []string{"10.2.2.2, 10.1.1.1"}, want: "10.2.2.2"},
+		{name: "garbage hop", peer: "10.0.0.1:5000", xff: []string{"198.51.100.9, unknown, 10.1.1.1"}, want: "10.1.1.1"},
+		{name: "hop with port", peer: "10.0.0.1:5000", xff: []string{"198.51.100.9:4711"}, want: "198.51.100.9"},
+		{name: "X-Real-IP", peer: "10.0.0.1:5000", realIP: "198.51.100.9", want: "198.51.100.9"},
+		{name: "X-Forwarded-For wins over X-Real-IP", peer: "10.0.0.1:5000", xff: []string{"198.51.100.9"}, realIP: "1.2.3.4", want: "198.51.100.9"},
+		{name: "bad X-Real-IP", peer: "10.0.0.1:5000", realIP: "nonsense", want: "10.0.0.1"},
+		{name: "IPv6 direct", peer: "[2001:db8::1]:5000", xff: []string{"1.2.3.4"}, want: "2001:db8::1"},
+		{name: "IPv6 chain", peer: "[fd00::1]:5000", xff: []string{"2001:db8::7, [fd00::2]:443"}, want: "2001:db8::7"},
+		{name: "IPv6 bracketed client", peer: "[fd00::1]:5000", xff: []string{"[2001:db8::7]"}, want: "2001:db8::7"},
+		{name: "IPv4-mapped peer", peer: "[::ffff:10.0.0.1]:5000", xff: []string{"198.51.100.9"}, want: "198.51.100.9"},
+		{name: "IPv4-mapped hop", peer: "10.0.0.1:5000", xff: []string{"::ffff:198.51.100.9"}, want: "198.51.100.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := resolveClientIP(proxies, r); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestResolveClientIP_NoProxies(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if got := resolveClientIP(nil, r); got != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("without trusted proxies the peer is the client, got %s", got)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies(" 10.1.2.3/8 ,, 192.168.0.1, ::ffff:172.16.0.1, 2001:db8::/32 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.0.1/32", "172.16.0.1/32", "2001:db8::/32"}
+	if len(proxies) != len(want) {
+		t.Fatalf("want %v, got %v", want, proxies)
+	}
+	for i, p := range proxies {
+		if p.String() != want[i] {
+			t.Errorf("entry %d: want %s, got %s", i, want[i], p)
+		}
+	}
+
+	if proxies, err := ParseTrustedProxies(""); err != nil || len(proxies) != 0 {
+		t.Errorf("empty: want no proxies, got %v, %v", proxies, err)
+	}
+	for _, spec := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0.1, 10.0.0"} {
+		if _, err := ParseTrustedProxies(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+}
+
+func TestWithClientIP(t *testing.T) {
+	proxies, _ := ParseTrustedProxies("10.0.0.0/8")
+	var got netip.Addr
+	h := withClientIP(proxies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIP(r.Context())
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.9")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got != netip.MustParseAddr("198.51.100.9") {
+		t.Errorf("want the forwarded client in the context, got %s", got)
+	}
+}
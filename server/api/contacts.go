@@ -0,0 +1,334 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+const (
+	// contactPrefixMax is the longest prefix indexed for typeahead search.
+	// Longer queries are looked up by their first contactPrefixMax
+	// characters and filtered after decryption.
+	contactPrefixMax = 16
+
+	// contactPrefixIndexLen is the number of hex digits of each prefix
+	// blind index kept, enough to make collisions rare while keeping the
+	// index small.  Collisions are filtered out after decryption.
+	contactPrefixIndexLen = 16
+
+	// contactsMaxLimit bounds the limit parameter of GET /api/v1/contacts.
+	contactsMaxLimit = 100
+)
+
+// contactTerms returns the lower-cased strings a contact can be found by:
+// its address, the address's domain and each word of its name.
+func contactTerms(email, name string) []string {
+	terms := []string{strings.ToLower(email)}
+	if _, domain, ok := strings.Cut(terms[0], "@"); ok && domain != "" {
+		terms = append(terms, domain)
+	}
+	for _, word := range strings.Fields(name) {
+		terms = append(terms, strings.ToLower(word))
+	}
+	return terms
+}
+
+// prefixIndex is the blind index of a typeahead prefix, kept apart from
+// the full-address index by its label.
+func prefixIndex(fc *vault.FieldCipher, prefix string) string {
+	return fc.BlindIndex("contact-prefix:" + prefix)[:contactPrefixIndexLen]
+}
+
+// contactPrefixes returns the prefix indexes of every prefix, up to
+// contactPrefixMax characters, of the contact's terms.
+func contactPrefixes(fc *vault.FieldCipher, email, name string) []string {
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, term := range contactTerms(email, name) {
+		runes := []rune(term)
+		for n := 1; n <= len(runes) && n <= contactPrefixMax; n++ {
+			idx := prefixIndex(fc, string(runes[:n]))
+			if !seen[idx] {
+				seen[idx] = true
+				prefixes = append(prefixes, idx)
+			}
+		}
+	}
+	return prefixes
+}
+
+// contactMatches reports whether one of the contact's terms starts with q,
+// which must be lower case.
+func contactMatches(email, name, q string) bool {
+	for _, term := range contactTerms(email, name) {
+		if strings.HasPrefix(term, q) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptContact returns a contact document for the address and name, with
+// its blind indexes set.
+func encryptContact(fc *vault.FieldCipher, owner, email, name string) (*db.Contact, error) {
+	emailEnc, err := fc.Encrypt(email)
+	if err != nil {
+		return nil, err
+	}
+	nameEnc := ""
+	if name != "" {
+		if nameEnc, err = fc.Encrypt(name); err != nil {
+			return nil, err
+		}
+	}
+	return &db.Contact{
+		OwnerPubKey: owner,
+		EmailEnc:    emailEnc,
+		NameEnc:     nameEnc,
+		EmailIndex:  fc.BlindIndex(email),
+		Prefixes:    contactPrefixes(fc, email, name),
+	}, nil
+}
+
+// recordContacts adds the addresses of a sent message's recipients, or of a
+// received message's sender, to the owner's contacts.  It is best effort:
+// failures are logged and never affect the request that saw the mail.
+func (s *Server) recordContacts(ctx context.Context, owner string, addrs []mail.Address, sent bool, at time.Time) {
+	if len(addrs) == 0 {
+		return
+	}
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		log.Printf("[%s] contacts: %v", requestID(ctx), err)
+		return
+	}
+	for _, a := range addrs {
+		c, err := encryptContact(fc, owner, a.Email, strings.TrimSpace(a.Name))
+		if err == nil {
+			c.LastSeen = at
+			err = s.db.RecordContactActivity(ctx, c, sent)
+		}
+		if err != nil {
+			log.Printf("[%s] contacts: record %s: %v", requestID(ctx), a.Email, err)
+		}
+	}
+}
+
+// senderAddress parses a From header into the sender's address, reporting
+// false for headers that do not hold a usable address.
+func senderAddress(from string) (mail.Address, bool) {
+	addr, err := netmail.ParseAddress(from)
+	if err != nil || mail.ValidateAddress(addr.Address) != nil {
+		return mail.Address{}, false
+	}
+	return mail.Address{Email: addr.Address, Name: addr.Name}, true
+}
+
+// contactView is a decrypted contact as returned to clients.
+type contactView struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+	db.Contact
+}
+
+// contactsResponse lists an owner's contacts.
+type contactsResponse struct {
+	Owner    string        `json:"owner"`
+	Contacts []contactView `json:"contacts"`
+}
+
+// contactRequest is the body of POST /api/v1/contacts and
+// PUT /api/v1/contacts/{id}.
+type contactRequest struct {
+	OwnerPubKey string `json:"owner_pubkey"`
+	Email       string `json:"email"`
+	Name        string `json:"name"`
+}
+
+// decryptContact returns the client view of c.
+func decryptContact(fc *vault.FieldCipher, c db.Contact) (contactView, error) {
+	v := contactView{Contact: c}
+	var err error
+	if v.Email, err = fc.Decrypt(c.EmailEnc); err != nil {
+		return v, err
+	}
+	if c.NameEnc != "" {
+		v.Name, err = fc.Decrypt(c.NameEnc)
+	}
+	return v, err
+}
+
+// GET /api/v1/contacts?owner=<pubkey>[&q=<prefix>][&limit=20]
+//
+// Lists the owner's contacts, most recently seen first.  With q, only
+// contacts whose address, domain or a word of whose name starts with q
+// (case-insensitively) are listed, for recipient autocomplete.
+func (s *Server) listContacts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner := q.Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	limit := min(inboxLimit(r), contactsMaxLimit)
+
+	search := strings.ToLower(strings.TrimSpace(q.Get("q")))
+	prefix := ""
+	if search != "" {
+		runes := []rune(search)
+		prefix = prefixIndex(fc, string(runes[:min(len(runes), contactPrefixMax)]))
+	}
+	docs, err := s.db.GetContacts(r.Context(), owner, prefix, limit)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	results := make([]contactView, 0, len(docs))
+	for _, d := range docs {
+		v, err := decryptContact(fc, d)
+		if err != nil {
+			log.Printf("[%s] contacts: decrypt contact %s: %v", requestID(r.Context()), d.ID.Hex(), err)
+			continue
+		}
+		if search != "" && !contactMatches(v.Email, v.Name, search) {
+			continue
+		}
+		results = append(results, v)
+	}
+	writeJSON(w, http.StatusOK, contactsResponse{Owner: owner, Contacts: results})
+}
+
+// decodeContactRequest reads and validates a contact body, writing the
+// error response and returning nil if it is unusable.
+func decodeContactRequest(w http.ResponseWriter, r *http.Request) *contactRequest {
+	var req contactRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	owner, ok := actingOwner(r, req.OwnerPubKey)
+	if !ok {
+		writeError(w, http.StatusForbidden, errKeyOwner)
+		return nil
+	}
+	req.OwnerPubKey = owner
+	req.Email = strings.TrimSpace(req.Email)
+	req.Name = strings.TrimSpace(req.Name)
+	if req.OwnerPubKey == "" {
+		writeError(w, http.StatusBadRequest, "owner_pubkey required")
+		return nil
+	}
+	if err := mail.ValidateAddress(req.Email); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	if strings.ContainsAny(req.Name, "\r\n") || !utf8.ValidString(req.Name) {
+		writeError(w, http.StatusBadRequest, "name must be valid UTF-8 without line breaks")
+		return nil
+	}
+	return &req
+}
+
+// POST /api/v1/contacts
+//
+// Adds a contact.  An address already known from mail activity, or one the
+// owner deleted, becomes an owner-created contact with the given name.
+//
+// Request:  { "owner_pubkey": "...", "email": "...", "name": "..." }
+// Response: the contact
+func (s *Server) createContact(w http.ResponseWriter, r *http.Request) {
+	req := decodeContactRequest(w, r)
+	if req == nil {
+		return
+	}
+	s.saveContact(w, r, req, "")
+}
+
+// PUT /api/v1/contacts/{id}
+//
+// Replaces a contact's address and name.  Edited contacts count as
+// owner-created.
+//
+// Request:  { "owner_pubkey": "...", "email": "...", "name": "..." }
+// Response: the contact
+func (s *Server) updateContact(w http.ResponseWriter, r *http.Request) {
+	req := decodeContactRequest(w, r)
+	if req == nil {
+		return
+	}
+	s.saveContact(w, r, req, r.PathValue("id"))
+}
+
+// saveContact creates the contact in req, or updates contact id if it is
+// not empty, and writes it back.
+func (s *Server) saveContact(w http.ResponseWriter, r *http.Request, req *contactRequest, id string) {
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	c, err := encryptContact(fc, req.OwnerPubKey, req.Email, req.Name)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if id == "" {
+		err = s.db.CreateContact(r.Context(), c)
+	} else {
+		status = http.StatusOK
+		err = s.db.UpdateContact(r.Context(), req.OwnerPubKey, id, c)
+	}
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		writeError(w, http.StatusNotFound, "contact not found")
+		return
+	case errors.Is(err, db.ErrDuplicate):
+		writeError(w, http.StatusConflict, "a contact with that address already exists")
+		return
+	case err != nil:
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, status, contactView{Email: req.Email, Name: req.Name, Contact: *c})
+}
+
+// DELETE /api/v1/contacts/{id}?owner=<pubkey>
+//
+// Deletes a contact.  The address is remembered so that mail activity does
+// not add it back; creating it again with POST restores it.
+func (s *Server) deleteContact(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	err := s.db.DeleteContact(r.Context(), owner, r.PathValue("id"))
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "contact not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Status: "deleted"})
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"mulamail/db"
+)
+
+// listContactsFor calls GET /api/v1/contacts with the given query string.
+func listContactsFor(t *testing.T, server *Server, query string) []contactView {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.listContacts(w, httptest.NewRequest("GET", "/api/v1/contacts?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list contacts: status %d: %s", w.Code, w.Body.String())
+	}
+	var resp contactsResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp.Contacts
+}
+
+func contactEmails(contacts []contactView) []string {
+	emails := make([]string, len(contacts))
+	for i, c := range contacts {
+		emails[i] = c.Email
+	}
+	return emails
+}
+
+func TestContacts_CRUDAndSearch(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	post := func(email, name string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(contactRequest{OwnerPubKey: "owner", Email: email, Name: name})
+		w := httptest.NewRecorder()
+		server.createContact(w, httptest.NewRequest("POST", "/api/v1/contacts", bytes.NewReader(body)))
+		return w
+	}
+	w := post("alice@example.com", "Alice Liddell")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body.String())
+	}
+	var alice contactView
+	json.NewDecoder(w.Body).Decode(&alice)
+	if alice.Email != "alice@example.com" || alice.Name != "Alice Liddell" || alice.Source != db.ContactUser {
+		t.Errorf("unexpected created contact %+v", alice)
+	}
+	if w := post("bob@example.org", ""); w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body.String())
+	}
+	if w := post("ALICE@example.com", "Again"); w.Code != http.StatusConflict {
+		t.Errorf("duplicate address: want 409, got %d", w.Code)
+	}
+	if w := post("Alice <alice@example.com>", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("display-name address: want 400, got %d", w.Code)
+	}
+
+	stored := mockDB.Contacts[0]
+	if stored.EmailEnc == "" || stored.EmailEnc == "alice@example.com" || stored.NameEnc == "Alice Liddell" {
+		t.Errorf("contact stored in plaintext: %+v", stored)
+	}
+
+	for q, want := range map[string][]string{
+		"ali":        {"alice@example.com"},
+		"ALI":        {"alice@example.com"},
+		"lid":        {"alice@example.com"},
+		"example.o":  {"bob@example.org"},
+		"bob@exampl": {"bob@example.org"},
+		"carol":      {},
+		// Longer than the indexed prefixes: matched by filtering.
+		"alice@example.com":  {"alice@example.com"},
+		"alice@example.comx": {},
+	} {
+		got := contactEmails(listContactsFor(t, server, "owner=owner&q="+q))
+		if len(got) != len(want) || (len(want) == 1 && got[0] != want[0]) {
+			t.Errorf("q=%s: want %v, got %v", q, want, got)
+		}
+	}
+	if got := listContactsFor(t, server, "owner=owner"); len(got) != 2 {
+		t.Errorf("list: want 2 contacts, got %v", contactEmails(got))
+	}
+
+	body, _ := json.Marshal(contactRequest{OwnerPubKey: "owner", Email: "alice@example.net", Name: "Alice"})
+	req := httptest.NewRequest("PUT", "/api/v1/contacts/"+alice.ID.Hex(), bytes.NewReader(body))
+	req.SetPathValue("id", alice.ID.Hex())
+	w = httptest.NewRecorder()
+	server.updateContact(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", w.Code, w.Body.String())
+	}
+	if got := contactEmails(listContactsFor(t, server, "owner=owner&q=lid")); len(got) != 0 {
+		t.Errorf("old name still indexed: %v", got)
+	}
+	if got := contactEmails(listContactsFor(t, server, "owner=owner&q=example.n")); len(got) != 1 || got[0] != "alice@example.net" {
+		t.Errorf("new address not indexed: %v", got)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/v1/contacts/"+alice.ID.Hex()+"?owner=someone-else", nil)
+	req.SetPathValue("id", alice.ID.Hex())
+	w = httptest.NewRecorder()
+	server.deleteContact(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("delete another owner's contact: want 404, got %d", w.Code)
+	}
+	req = httptest.NewRequest("DELETE", "/api/v1/contacts/"+alice.ID.Hex()+"?owner=owner", nil)
+	req.SetPathValue("id", alice.ID.Hex())
+	w = httptest.NewRecorder()
+	server.deleteContact(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body.String())
+	}
+	if got := contactEmails(listContactsFor(t, server, "owner=owner")); len(got) != 1 || got[0] != "bob@example.org" {
+		t.Errorf("after delete: want only bob, got %v", got)
+	}
+}
+
+func TestContacts_DerivedFromMail(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{messages: map[int]string{
+		1: "From: Carol Example <carol@example.org>\r\nSubject: Lunch\r\nDate: Mon, 2 Jan 2006 15:04:05 -0700\r\n\r\nbody",
+		2: "From: me@example.com\r\nSubject: Note to self\r\n\r\nbody",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	fetch := func() {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("inbox: status %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Fetching the same messages twice counts them once.
+	fetch()
+	fetch()
+	got := listContactsFor(t, server, "owner=owner&q=car")
+	if len(got) != 1 {
+		t.Fatalf("want the sender as a contact, got %v", contactEmails(got))
+	}
+	carol := got[0]
+	if carol.Email != "carol@example.org" || carol.Name != "Carol Example" || carol.Source != db.ContactAuto ||
+		carol.ReceivedCount != 1 || carol.SentCount != 0 || carol.LastSeen.IsZero() {
+		t.Errorf("unexpected derived contact %+v", carol)
+	}
+	if all := listContactsFor(t, server, "owner=owner"); len(all) != 1 {
+		t.Errorf("the account's own address should not become a contact, got %v", contactEmails(all))
+	}
+
+	acc := mockDB.Accounts["owner"][0]
+	smtpHost, smtpPort := (&fakeSMTP{}).start(t)
+	acc.SMTP = db.SMTPSettings{Host: smtpHost, Port: smtpPort, User: "u", PassEnc: acc.POP3.PassEnc}
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey":  "owner",
+		"account_email": "me@example.com",
+		"to":            []any{map[string]string{"email": "dave@example.net", "name": "Dave"}},
+		"cc":            []string{"carol@example.org"},
+		"subject":       "hello",
+		"body":          "hi",
+	})
+	w := httptest.NewRecorder()
+	server.sendMail(w, httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("send: status %d: %s", w.Code, w.Body.String())
+	}
+	for _, c := range listContactsFor(t, server, "owner=owner") {
+		switch c.Email {
+		case "dave@example.net":
+			if c.Name != "Dave" || c.SentCount != 1 {
+				t.Errorf("unexpected recipient contact %+v", c)
+			}
+		case "carol@example.org":
+			if c.SentCount != 1 || c.ReceivedCount != 1 || c.Name != "Carol Example" {
+				t.Errorf("unexpected contact after reply %+v", c)
+			}
+		default:
+			t.Errorf("unexpected contact %+v", c)
+		}
+	}
+
+	// A deleted contact is not re-added by new mail from the same sender.
+	req := httptest.NewRequest("DELETE", "/api/v1/contacts/"+carol.ID.Hex()+"?owner=owner", nil)
+	req.SetPathValue("id", carol.ID.Hex())
+	w = httptest.NewRecorder()
+	server.deleteContact(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body.String())
+	}
+	later := &fakePOP3{messages: map[int]string{
+		1: fake.messages[1],
+		2: fake.messages[2],
+		3: "From: carol@example.org\r\nSubject: Again\r\n\r\nbody",
+	}}
+	acc.POP3.Host, acc.POP3.Port = later.start(t)
+	fetch()
+	if n := later.topped.Load(); n != 3 {
+		t.Fatalf("want the new server's 3 messages fetched, got %d TOPs", n)
+	}
+	if got := contactEmails(listContactsFor(t, server, "owner=owner&q=carol")); len(got) != 0 {
+		t.Errorf("deleted contact came back: %v", got)
+	}
+}
+
+func TestListContacts_MissingOwner(t *testing.T) {
+	server, _ := setupTestServer(t)
+	w := httptest.NewRecorder()
+	server.listContacts(w, httptest.NewRequest("GET", "/api/v1/contacts?q=a", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"mulamail/db"
+)
+
+const (
+	// dashboardVersion is the version of the dashboard response.  Sections
+	// and fields may be added without changing it; it changes when one is
+	// removed or changes meaning.
+	dashboardVersion = 1
+	// dashboardTimeout bounds each section of the dashboard, and so the
+	// whole response, since the sections are fetched concurrently.
+	dashboardTimeout = 5 * time.Second
+	// dashboardRecentSent is how many sent messages the dashboard lists.
+	dashboardRecentSent = 5
+)
+
+// Dashboard section error codes.
+const (
+	dashboardTimedOut    = "timeout"     // the section did not load within dashboardTimeout
+	dashboardUnavailable = "unavailable" // the section failed to load; it is worth retrying
+)
+
+// dashboardResponse is everything a client shows on launch.  A section
+// that failed to load is null, with its error code in Errors; a section
+// that loaded empty is an empty list, or a null identity for an owner
+// without one.
+type dashboardResponse struct {
+	Version    int                `json:"version"`
+	Owner      string             `json:"owner"`
+	Accounts   []dashboardAccount `json:"accounts"`
+	Identity   *db.Identity       `json:"identity"` // the owner's primary identity
+	Storage    *dashboardStorage  `json:"storage"`
+	RecentSent []db.SentMessage   `json:"recent_sent"` // newest first
+	Errors     map[string]string  `json:"errors"`      // section name to dashboardTimedOut or dashboardUnavailable
+}
+
+// dashboardAccount summarises one mail account: its login health and the
+// outcome of its latest inbox fetch.
+type dashboardAccount struct {
+	AccountEmail        string    `json:"account_email"`
+	DisplayName         string    `json:"display_name,omitempty"`
+	Status              string    `json:"status"` // accountOK, accountFailing or accountNeedsAttention
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	NextRetryAt         time.Time `json:"next_retry_at,omitzero"`
+	LastFetchAt         time.Time `json:"last_fetch_at,omitzero"`
+	LastFetchStatus     string    `json:"last_fetch_status,omitempty"`
+	MessageCount        int       `json:"message_count"`   // on the POP3 server when last listed
+	CachedMessages      int       `json:"cached_messages"` // previews cached for the account
+}
+
+// dashboardStorage is what the server keeps for the owner's mail.
+type dashboardStorage struct {
+	CachedMessages int `json:"cached_messages"`
+	CachedBytes    int `json:"cached_bytes"` // sizes of the cached messages as listed by their servers
+}
+
+// GET /api/v1/dashboard?owner=<pubkey>
+//
+// Assembles the owner's accounts with their health, primary identity with
+// its chain status, storage usage and most recent sent messages in one
+// response.  The sections are fetched concurrently, each within
+// dashboardTimeout; one that fails or times out is null, with a code in
+// "errors", rather than failing the response.  "version" identifies the
+// response shape.
+func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), dashboardTimeout)
+	defer cancel()
+
+	sections := map[string]func(context.Context) (any, error){
+		"accounts":    func(ctx context.Context) (any, error) { return s.dashboardAccounts(ctx, owner) },
+		"identity":    func(ctx context.Context) (any, error) { return s.dashboardIdentity(ctx, owner) },
+		"storage":     func(ctx context.Context) (any, error) { return s.dashboardStorage(ctx, owner) },
+		"recent_sent": func(ctx context.Context) (any, error) { return s.dashboardRecentSent(ctx, owner) },
+	}
+	type result struct {
+		section string
+		value   any
+		err     error
+	}
+	// Buffered so fetches never block after the deadline has passed.
+	results := make(chan result, len(sections))
+	for name, fetch := range sections {
+		go func() {
+			v, err := fetch(ctx)
+			results <- result{section: name, value: v, err: err}
+		}()
+	}
+
+	resp := dashboardResponse{Version: dashboardVersion, Owner: owner, Errors: make(map[string]string)}
+	done := make(map[string]bool, len(sections))
+collect:
+	for len(done) < len(sections) {
+		select {
+		case res := <-results:
+			done[res.section] = true
+			if res.err != nil {
+				code := dashboardUnavailable
+				if errors.Is(res.err, context.DeadlineExceeded) {
+					code = dashboardTimedOut
+				}
+				log.Printf("[%s] dashboard: %s: %v", requestID(r.Context()), res.section, res.err)
+				resp.Errors[res.section] = code
+				continue
+			}
+			switch v := res.value.(type) {
+			case []dashboardAccount:
+				resp.Accounts = v
+			case *db.Identity:
+				resp.Identity = v
+			case *dashboardStorage:
+				resp.Storage = v
+			case []db.SentMessage:
+				resp.RecentSent = v
+			}
+		case <-ctx.Done():
+			for name := range sections {
+				if !done[name] {
+					resp.Errors[name] = dashboardTimedOut
+				}
+			}
+			break collect
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// dashboardAccounts joins the owner's accounts with their health and
+// cached message counts.
+func (s *Server) dashboardAccounts(ctx context.Context, owner string) ([]dashboardAccount, error) {
+	accs, err := s.db.GetMailAccountsByOwner(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	health, err := s.db.GetAccountHealthByOwner(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := s.db.GetCachedMessagesByOwner(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	byEmail := make(map[string]db.AccountHealth, len(health))
+	for _, h := range health {
+		byEmail[h.AccountEmail] = h
+	}
+	counts := make(map[string]int)
+	for _, m := range cached {
+		counts[m.AccountEmail]++
+	}
+
+	views := make([]dashboardAccount, len(accs))
+	for i, acc := range accs {
+		h := byEmail[acc.AccountEmail]
+		views[i] = dashboardAccount{
+			AccountEmail:        acc.AccountEmail,
+			DisplayName:         acc.DisplayName,
+			Status:              accountStatus(h.ConsecutiveFailures),
+			ConsecutiveFailures: h.ConsecutiveFailures,
+			LastError:           h.LastError,
+			NextRetryAt:         h.NextRetryAt,
+			LastFetchAt:         acc.LastFetchAt,
+			LastFetchStatus:     acc.LastFetchStatus,
+			MessageCount:        acc.MessageCount,
+			CachedMessages:      counts[acc.AccountEmail],
+		}
+	}
+	return views, nil
+}
+
+// dashboardIdentity returns the owner's primary identity, or a nil one
+// when the owner has none.
+func (s *Server) dashboardIdentity(ctx context.Context, owner string) (*db.Identity, error) {
+	id, err := s.db.GetIdentityByPubKey(ctx, owner)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	return id, err
+}
+
+// dashboardStorage totals the owner's cached messages.
+func (s *Server) dashboardStorage(ctx context.Context, owner string) (*dashboardStorage, error) {
+	cached, err := s.db.GetCachedMessagesByOwner(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	usage := &dashboardStorage{CachedMessages: len(cached)}
+	for _, m := range cached {
+		usage.CachedBytes += m.Size
+	}
+	return usage, nil
+}
+
+// dashboardRecentSent returns the owner's most recently sent messages.
+func (s *Server) dashboardRecentSent(ctx context.Context, owner string) ([]db.SentMessage, error) {
+	sent, err := s.db.GetRecentSentMessages(ctx, owner, dashboardRecentSent)
+	if sent == nil && err == nil {
+		sent = []db.SentMessage{}
+	}
+	return sent, err
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+)
+
+func getDashboard(t *testing.T, server *Server, ctx context.Context) dashboardResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.dashboard(w, httptest.NewRequest("GET", "/api/v1/dashboard?owner=owner", nil).WithContext(ctx))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp dashboardResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return resp
+}
+
+// setupDashboard gives the owner an account with failing logins, an
+// identity, two cached messages and seven sent ones.
+func setupDashboard(t *testing.T) (*Server, *dbtest.Mock) {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+	mockDB.CreateMailAccount(ctx, &db.MailAccount{OwnerPubKey: "owner", AccountEmail: "me@example.com", MessageCount: 12})
+	mockDB.SetAccountHealth(ctx, &db.AccountHealth{OwnerPubKey: "owner", AccountEmail: "me@example.com", ConsecutiveFailures: 1, LastError: "auth failed"})
+	mockDB.CreateIdentity(ctx, &db.Identity{Email: "me@example.com", PubKey: "owner", ChainStatus: db.ChainAnchored})
+	for i, size := range []int{100, 250} {
+		mockDB.UpsertCachedMessage(ctx, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: fmt.Sprint(i), Size: size})
+	}
+	t0 := time.Now().Add(-time.Hour)
+	for i := range 7 {
+		mockDB.CreateSentMessage(ctx, &db.SentMessage{OwnerPubKey: "owner", Subject: fmt.Sprint(i), SentAt: t0.Add(time.Duration(i) * time.Minute)})
+	}
+	return server, mockDB
+}
+
+func TestDashboard(t *testing.T) {
+	server, _ := setupDashboard(t)
+	resp := getDashboard(t, server, context.Background())
+
+	if resp.Version != dashboardVersion || resp.Owner != "owner" || len(resp.Errors) != 0 {
+		t.Errorf("unexpected envelope %+v", resp)
+	}
+	if len(resp.Accounts) != 1 || resp.Accounts[0].Status != accountFailing || resp.Accounts[0].MessageCount != 12 || resp.Accounts[0].CachedMessages != 2 {
+		t.Errorf("accounts: got %+v", resp.Accounts)
+	}
+	if resp.Identity == nil || resp.Identity.ChainStatus != db.ChainAnchored {
+		t.Errorf("identity: got %+v", resp.Identity)
+	}
+	if resp.Storage == nil || *resp.Storage != (dashboardStorage{CachedMessages: 2, CachedBytes: 350}) {
+		t.Errorf("storage: got %+v", resp.Storage)
+	}
+	var subjects []string
+	for _, m := range resp.RecentSent {
+		subjects = append(subjects, m.Subject)
+	}
+	if fmt.Sprint(subjects) != "[6 5 4 3 2]" {
+		t.Errorf("recent_sent: want the five newest, got %v", subjects)
+	}
+}
+
+func TestDashboard_Empty(t *testing.T) {
+	server, _ := setupTestServer(t)
+	w := httptest.NewRecorder()
+	server.dashboard(w, httptest.NewRequest("GET", "/api/v1/dashboard?owner=nobody", nil))
+	want := `"accounts":[],"identity":null,"storage":{"cached_messages":0,"cached_bytes":0},"recent_sent":[],"errors":{}`
+	if w.Code != http.StatusOK || !json.Valid(w.Body.Bytes()) || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("want empty sections, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	server.dashboard(w, httptest.NewRequest("GET", "/api/v1/dashboard", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("no owner: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestDashboard_PartialResults(t *testing.T) {
+	server, mockDB := setupDashboard(t)
+	// Cached messages fail, and sent mail is held until the request gives up.
+	mockDB.Fail("GetCachedMessagesByOwner", errors.New("cache collection unreachable"))
+	mockDB.FailWith("GetRecentSentMessages", func(ctx context.Context, _ ...any) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resp := getDashboard(t, server, ctx)
+
+	wantErrors := map[string]string{"accounts": dashboardUnavailable, "storage": dashboardUnavailable, "recent_sent": dashboardTimedOut}
+	if fmt.Sprint(resp.Errors) != fmt.Sprint(wantErrors) {
+		t.Errorf("errors: want %v, got %v", wantErrors, resp.Errors)
+	}
+	if resp.Accounts != nil || resp.Storage != nil || resp.RecentSent != nil {
+		t.Errorf("failed sections must be null, got %+v", resp)
+	}
+	if resp.Identity == nil {
+		t.Error("the identity section must still load")
+	}
+}
@@ -0,0 +1,289 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+// Caps on POST /api/v1/mail/inbox/delta.  A client tracking more messages
+// than maxDeltaUIDs should send the state token instead of its UIDL set.
+const (
+	maxDeltaBodyBytes = 2 << 20
+	maxDeltaUIDs      = 20000
+	defaultDeltaLimit = 20
+)
+
+// inboxDeltaRequest is the body of POST /api/v1/mail/inbox/delta.  The
+// client describes what it already holds either by listing its UIDLs or by
+// quoting the state token of an earlier response.
+type inboxDeltaRequest struct {
+	OwnerPubKey  string   `json:"owner_pubkey"`
+	AccountEmail string   `json:"account_email"`
+	KnownUIDs    []string `json:"known_uids"`
+	State        string   `json:"state"`
+	Limit        int      `json:"limit"` // most previews returned in added; default 20
+}
+
+// deltaMessage is a message added since the client's known state.  ID is
+// its message number in the listing the delta was computed from.
+type deltaMessage struct {
+	ID int `json:"id"`
+	cachedPreview
+	SenderIdentity *senderIdentity `json:"sender_identity"`
+}
+
+// inboxDeltaResponse reports the changes between the client's known state
+// and the mailbox.
+type inboxDeltaResponse struct {
+	Account string         `json:"account"`
+	Total   int            `json:"total"`
+	Added   []deltaMessage `json:"added"` // newest first
+	Removed []string       `json:"removed"`
+	// State identifies the UIDL set the client holds after applying this
+	// response.  It equals the mailbox's state unless Truncated is set or
+	// previews were skipped; it is empty when deltas are unavailable.
+	State      string           `json:"state"`
+	Truncated  bool             `json:"truncated,omitempty"`   // more messages were added than limit; ask again
+	FullSync   bool             `json:"full_sync,omitempty"`   // the known state was not usable: replace it with added
+	SkippedIDs []skippedMessage `json:"skipped_ids,omitempty"` // added messages whose preview could not be fetched
+	// DeltaUnavailable is set when the server does not support UIDL; the
+	// response then lists the most recent messages, as the inbox does.
+	DeltaUnavailable bool `json:"delta_unavailable,omitempty"`
+}
+
+// inboxState derives the state token of a UIDL set: its size and a hash of
+// the sorted UIDLs.
+func inboxState(uids []string) string {
+	sorted := slices.Clone(uids)
+	slices.Sort(sorted)
+	h := sha256.New()
+	for _, uid := range sorted {
+		h.Write([]byte(uid))
+		h.Write([]byte{'\n'})
+	}
+	return strconv.Itoa(len(sorted)) + ":" + hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+// POST /api/v1/mail/inbox/delta
+//
+// Reports what changed in the mailbox since a state the client already
+// holds: the UIDLs that are gone and previews of the messages that are new,
+// with a state token to quote next time.  The UIDL listing is always live;
+// previews of added messages come from the preview cache where possible and
+// via TOP otherwise.  Without known_uids or a current state the response is
+// a full sync.  A server without UIDL cannot report deltas and gets the
+// most recent messages instead, with delta_unavailable set.
+//
+// Request: { "owner_pubkey": "...", "account_email": "...", "known_uids": ["..."], "state": "...", "limit": 20 }
+func (s *Server) inboxDelta(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxDeltaBodyBytes)
+	var req inboxDeltaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeLimitError(w, http.StatusRequestEntityTooLarge, "request body too large", maxDeltaBodyBytes)
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	owner, ok := actingOwner(r, req.OwnerPubKey)
+	if !ok {
+		writeError(w, http.StatusForbidden, errKeyOwner)
+		return
+	}
+	if len(req.KnownUIDs) > maxDeltaUIDs {
+		writeLimitError(w, http.StatusBadRequest, fmt.Sprintf("at most %d known_uids; send the state token instead", maxDeltaUIDs), maxDeltaUIDs)
+		return
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultDeltaLimit
+	}
+
+	ctx := r.Context()
+	acc, err := s.db.GetMailAccount(ctx, owner, req.AccountEmail)
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	client, err := s.dialPOP3(ctx, acc)
+	if err != nil {
+		writeMailError(w, r, http.StatusServiceUnavailable, "", err)
+		return
+	}
+	defer client.Close()
+
+	list, err := client.List(ctx)
+	if err != nil {
+		writeMailError(w, r, http.StatusBadGateway, "POP3 LIST", err)
+		return
+	}
+	resp := inboxDeltaResponse{Account: acc.AccountEmail, Total: len(list), Added: []deltaMessage{}, Removed: []string{}}
+
+	uids, err := client.UIDLs(ctx)
+	if err != nil {
+		p := previewList(ctx, client, list, limit, 0, false)
+		s.cachePreviews(ctx, client, acc.OwnerPubKey, acc.AccountEmail, p.Messages)
+		for _, m := range p.Messages {
+			resp.Added = append(resp.Added, livePreview(acc.AccountEmail, "", m))
+		}
+		s.attachDeltaSenders(ctx, resp.Added)
+		resp.SkippedIDs = p.Skipped
+		resp.FullSync, resp.DeltaUnavailable = true, true
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	current := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		current = append(current, uid)
+	}
+	state := inboxState(current)
+	if req.State != "" && req.State == state {
+		resp.State = state
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	known := make(map[string]bool, len(req.KnownUIDs))
+	for _, uid := range req.KnownUIDs {
+		known[uid] = true
+	}
+	resp.FullSync = len(known) == 0
+
+	onServer := make(map[string]bool, len(uids))
+	var added []int
+	for id, uid := range uids {
+		onServer[uid] = true
+		if !known[uid] {
+			added = append(added, id)
+		}
+	}
+	for uid := range known {
+		if !onServer[uid] {
+			resp.Removed = append(resp.Removed, uid)
+		}
+	}
+	slices.Sort(resp.Removed)
+
+	// Newest (highest message number) first, at most limit of them.
+	slices.Sort(added)
+	slices.Reverse(added)
+	if len(added) > limit {
+		added, resp.Truncated = added[:limit], true
+	}
+
+	sizes := make(map[int]int, len(list))
+	for _, item := range list {
+		sizes[item.ID] = item.Size
+	}
+	previews, skipped := s.deltaPreviews(ctx, client, acc, uids, sizes, added)
+	s.attachDeltaSenders(ctx, previews)
+	resp.Added, resp.SkippedIDs = previews, skipped
+
+	if !resp.Truncated && len(skipped) == 0 {
+		resp.State = state
+	} else {
+		held := make([]string, 0, len(known)+len(previews))
+		for uid := range known {
+			if onServer[uid] {
+				held = append(held, uid)
+			}
+		}
+		for _, m := range previews {
+			held = append(held, m.UID)
+		}
+		resp.State = inboxState(held)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// deltaPreviews returns previews of the added messages, in the given order.
+// Cached previews are decrypted; the rest are fetched with TOP and cached.
+func (s *Server) deltaPreviews(ctx context.Context, client *mail.POP3Client, acc *db.MailAccount, uids map[int]string, sizes map[int]int, added []int) ([]deltaMessage, []skippedMessage) {
+	cached := make(map[string]db.CachedMessage)
+	if len(added) > 0 {
+		docs, err := s.db.GetCachedMessagesByOwner(ctx, acc.OwnerPubKey)
+		if err != nil {
+			log.Printf("[%s] inbox delta: preview cache: %v", requestID(ctx), err)
+		}
+		for _, d := range docs {
+			if d.AccountEmail == acc.AccountEmail {
+				cached[d.UID] = d
+			}
+		}
+	}
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		log.Printf("[%s] inbox delta: %v", requestID(ctx), err)
+		clear(cached)
+	}
+
+	previews := make([]deltaMessage, 0, len(added))
+	skipped := make([]skippedMessage, 0)
+	var fetched []*mail.Message
+	for _, id := range added {
+		uid := uids[id]
+		if d, ok := cached[uid]; ok {
+			from, fromErr := fc.Decrypt(d.FromEnc)
+			subject, subjectErr := fc.Decrypt(d.SubjectEnc)
+			if fromErr == nil && subjectErr == nil {
+				previews = append(previews, deltaMessage{ID: id, cachedPreview: cachedPreview{
+					Account: acc.AccountEmail, UID: uid,
+					From: from, Subject: subject, Date: d.Date, Size: d.Size,
+				}})
+				continue
+			}
+		}
+		msg, err := client.Top(ctx, id, 0)
+		if err != nil {
+			log.Printf("[%s] inbox delta: skipped message %d: %v", requestID(ctx), id, err)
+			skipped = append(skipped, skippedMessage{ID: id, Error: publicError(err)})
+			continue
+		}
+		msg.Size = sizes[id]
+		attachBounce(ctx, client, msg)
+		fetched = append(fetched, msg)
+		previews = append(previews, livePreview(acc.AccountEmail, uid, msg))
+	}
+	s.cachePreviews(ctx, client, acc.OwnerPubKey, acc.AccountEmail, fetched)
+	return previews, skipped
+}
+
+// attachDeltaSenders sets the sender identity of each added message, cached
+// or live, with one batch lookup.
+func (s *Server) attachDeltaSenders(ctx context.Context, msgs []deltaMessage) {
+	froms := make([]string, len(msgs))
+	for i, m := range msgs {
+		froms[i] = m.From
+	}
+	senders := s.resolveSenders(ctx, froms)
+	for i := range msgs {
+		msgs[i].SenderIdentity = senders[msgs[i].From]
+	}
+}
+
+// livePreview builds a delta entry from a message fetched with TOP.
+func livePreview(account, uid string, m *mail.Message) deltaMessage {
+	return deltaMessage{ID: m.ID, cachedPreview: cachedPreview{
+		Account: account, UID: uid,
+		From: m.From, Subject: m.Subject, Date: m.DateParsed, Size: m.Size,
+	}}
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestInboxState(t *testing.T) {
+	if inboxState([]string{"a", "b"}) != inboxState([]string{"b", "a"}) {
+		t.Error("state must not depend on order")
+	}
+	if inboxState([]string{"a", "b"}) == inboxState([]string{"a", "c"}) {
+		t.Error("different sets must have different states")
+	}
+	if got := inboxState(nil); got[:2] != "0:" {
+		t.Errorf("empty set: want a 0 count, got %q", got)
+	}
+}
+
+func postInboxDelta(t *testing.T, server *Server, payload map[string]any) (int, inboxDeltaResponse) {
+	t.Helper()
+	payload["owner_pubkey"], payload["account_email"] = "owner", "me@example.com"
+	body, _ := json.Marshal(payload)
+	w := httptest.NewRecorder()
+	server.inboxDelta(w, httptest.NewRequest("POST", "/api/v1/mail/inbox/delta", bytes.NewBuffer(body)))
+	var resp inboxDeltaResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func deltaUIDs(msgs []deltaMessage) []string {
+	uids := make([]string, len(msgs))
+	for i, m := range msgs {
+		uids[i] = m.UID
+	}
+	return uids
+}
+
+func TestInboxDelta(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	fake := &fakePOP3{messages: map[int]string{
+		1: "From: a@example.com\r\nSubject: one\r\n",
+		2: "From: b@example.com\r\nSubject: two\r\n",
+		3: "From: c@example.com\r\nSubject: three\r\n",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	all := []string{"uid-1", "uid-2", "uid-3"}
+
+	// A first sync lists everything, newest first.
+	code, resp := postInboxDelta(t, server, map[string]any{})
+	if code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d", http.StatusOK, code)
+	}
+	if !resp.FullSync || !slices.Equal(deltaUIDs(resp.Added), []string{"uid-3", "uid-2", "uid-1"}) || resp.State != inboxState(all) {
+		t.Fatalf("first sync: unexpected %+v", resp)
+	}
+	if resp.Added[0].Subject != "three" || resp.Added[0].ID != 3 || resp.Added[0].Size == 0 {
+		t.Errorf("preview: unexpected %+v", resp.Added[0])
+	}
+	topped := fake.topped.Load()
+
+	// Quoting the current state reports no changes.
+	code, resp = postInboxDelta(t, server, map[string]any{"state": inboxState(all)})
+	if code != http.StatusOK || resp.FullSync || len(resp.Added) != 0 || len(resp.Removed) != 0 || resp.State != inboxState(all) {
+		t.Errorf("unchanged state: unexpected %d %+v", code, resp)
+	}
+
+	// Known UIDLs yield the difference; previews come from the cache.
+	code, resp = postInboxDelta(t, server, map[string]any{"known_uids": []string{"uid-1", "uid-9"}})
+	if code != http.StatusOK || resp.FullSync {
+		t.Fatalf("delta: unexpected %d %+v", code, resp)
+	}
+	if !slices.Equal(deltaUIDs(resp.Added), []string{"uid-3", "uid-2"}) || !slices.Equal(resp.Removed, []string{"uid-9"}) {
+		t.Errorf("delta: added %v, removed %v", deltaUIDs(resp.Added), resp.Removed)
+	}
+	if resp.Added[1].From != "b@example.com" {
+		t.Errorf("cached preview: unexpected %+v", resp.Added[1])
+	}
+	if n := fake.topped.Load(); n != topped {
+		t.Errorf("cached previews must not be fetched again: TOP count %d, want %d", n, topped)
+	}
+
+	// A stale state token forces a full sync.
+	if _, resp = postInboxDelta(t, server, map[string]any{"state": inboxState([]string{"uid-1"})}); !resp.FullSync || len(resp.Added) != 3 {
+		t.Errorf("stale state: unexpected %+v", resp)
+	}
+
+	// With a limit the response is truncated and its state covers what was sent.
+	_, resp = postInboxDelta(t, server, map[string]any{"known_uids": []string{"uid-1"}, "limit": 1})
+	if !resp.Truncated || !slices.Equal(deltaUIDs(resp.Added), []string{"uid-3"}) || resp.State != inboxState([]string{"uid-1", "uid-3"}) {
+		t.Errorf("truncated: unexpected %+v", resp)
+	}
+}
+
+func TestInboxDelta_NoUIDL(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	fake := &fakePOP3{messages: map[int]string{1: "Subject: one\r\n"}, noUIDL: true}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	code, resp := postInboxDelta(t, server, map[string]any{"known_uids": []string{"x"}})
+	if code != http.StatusOK || !resp.DeltaUnavailable || !resp.FullSync || resp.State != "" || len(resp.Added) != 1 {
+		t.Errorf("unexpected %d %+v", code, resp)
+	}
+}
+
+func TestInboxDelta_TooManyKnownUIDs(t *testing.T) {
+	server, _ := setupTestServer(t)
+	known := make([]string, maxDeltaUIDs+1)
+	for i := range known {
+		known[i] = "u"
+	}
+	if code, _ := postInboxDelta(t, server, map[string]any{"known_uids": known}); code != http.StatusBadRequest {
+		t.Errorf("status code: want %d, got %d", http.StatusBadRequest, code)
+	}
+}
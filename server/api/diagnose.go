@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+// diagnoseTraceLines bounds each protocol trace of a diagnosis.  The
+// sessions are short; this only guards against a runaway server.
+const diagnoseTraceLines = 200
+
+// diagnoseAccountRequest is the body of POST /api/v1/admin/diagnose-account.
+type diagnoseAccountRequest struct {
+	OwnerPubKey  string `json:"owner_pubkey"`
+	AccountEmail string `json:"account_email"`
+	Trace        bool   `json:"trace"` // return the protocol trace of both sessions
+}
+
+// diagnosticStep is one step of a connectivity diagnosis.  Error is
+// sanitised: it never carries credentials or the account's user names.
+type diagnosticStep struct {
+	Protocol   string `json:"protocol"` // "pop3" or "smtp"
+	Step       string `json:"step"`     // "connect", "auth", "capabilities" or "handshake"
+	OK         bool   `json:"ok"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// diagnoseAccountResponse is the timeline of a diagnosis.  A protocol's
+// remaining steps are skipped once one of them fails.
+type diagnoseAccountResponse struct {
+	OwnerPubKey      string           `json:"owner_pubkey"`
+	AccountEmail     string           `json:"account_email"`
+	OK               bool             `json:"ok"`
+	Steps            []diagnosticStep `json:"steps"`
+	POP3Capabilities []string         `json:"pop3_capabilities,omitempty"`
+	SMTPExtensions   []string         `json:"smtp_extensions,omitempty"`
+
+	// The protocol traces, when asked for.  Besides what mail.Trace leaves
+	// out, the account's user names are redacted as in errors.
+	POP3Trace []mail.TraceEntry `json:"pop3_trace,omitempty"`
+	SMTPTrace []mail.TraceEntry `json:"smtp_trace,omitempty"`
+}
+
+// POST /api/v1/admin/diagnose-account
+//
+// Reproduces an account's mail connectivity for support staff without
+// anyone handling its passwords: the stored credentials are decrypted
+// server-side to run the POP3 connect, auth and CAPA sequence and the SMTP
+// connect, EHLO and auth sequence, and the response is a timeline of the
+// steps.  Nothing is listed, fetched or sent, and the account's login health
+// is left alone.  With "trace", the response also carries each session line
+// by line, with credentials redacted (see mail.Trace).  Every call is
+// audited against the owner, naming the admin principal (see
+// adminPrincipal).
+//
+// Request:  { "owner_pubkey": "...", "account_email": "...", "trace": false }
+// Response: { "ok": false, "steps": [{ "protocol": "pop3", "step": "connect", "ok": true, "duration_ms": 41 }, ...] }
+func (s *Server) diagnoseAccount(w http.ResponseWriter, r *http.Request) {
+	var req diagnoseAccountRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	outcome := "invalid"
+	defer func() {
+		s.audit(r.Context(), req.OwnerPubKey, "account.diagnose", req.AccountEmail,
+			map[string]any{"admin": adminPrincipal(r), "outcome": outcome})
+	}()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if req.OwnerPubKey == "" || req.AccountEmail == "" {
+		writeError(w, http.StatusBadRequest, "owner_pubkey and account_email required")
+		return
+	}
+
+	acc, err := s.db.GetMailAccount(r.Context(), req.OwnerPubKey, req.AccountEmail)
+	if errors.Is(err, db.ErrNotFound) {
+		outcome = "not_found"
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if err != nil {
+		outcome = "error"
+		writeInternalError(w, r, err)
+		return
+	}
+
+	resp := s.diagnose(r.Context(), acc, req.Trace)
+	outcome = "failed"
+	if resp.OK {
+		outcome = "ok"
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// diagnose runs the diagnosis of acc, tracing the sessions when trace is
+// set.
+func (s *Server) diagnose(ctx context.Context, acc *db.MailAccount, trace bool) *diagnoseAccountResponse {
+	resp := &diagnoseAccountResponse{OwnerPubKey: acc.OwnerPubKey, AccountEmail: acc.AccountEmail, Steps: []diagnosticStep{}}
+	redact := strings.NewReplacer(redactions(acc.AccountEmail, acc.POP3.User, acc.SMTP.User)...)
+	failed := false
+	// run times one step and reports whether the protocol may go on.
+	run := func(protocol, step string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		d := diagnosticStep{Protocol: protocol, Step: step, OK: err == nil, DurationMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			d.Error = redact.Replace(sanitizeError(err))
+			failed = true
+		}
+		resp.Steps = append(resp.Steps, d)
+		return err == nil
+	}
+
+	newTrace := func(protocol string) *mail.Trace {
+		if trace {
+			return s.mailTrace(protocol, acc, diagnoseTraceLines)
+		}
+		return s.debugTrace(protocol, acc)
+	}
+	// traced returns the redacted entries of a trace asked for.
+	traced := func(t *mail.Trace) []mail.TraceEntry {
+		if !trace {
+			return nil
+		}
+		entries := t.Entries()
+		for i := range entries {
+			entries[i].Line = redact.Replace(entries[i].Line)
+		}
+		return entries
+	}
+
+	pop3Trace := newTrace("pop3")
+	if pop3, err := s.newPOP3Client(acc, pop3Trace); err != nil {
+		run("pop3", "connect", func() error { return err })
+	} else {
+		if run("pop3", "connect", func() error { return pop3.Connect(ctx) }) &&
+			run("pop3", "auth", func() error { return pop3.Auth(ctx) }) {
+			run("pop3", "capabilities", func() error {
+				caps, err := pop3.Capabilities(ctx)
+				for _, line := range caps.List() {
+					resp.POP3Capabilities = append(resp.POP3Capabilities, redact.Replace(line))
+				}
+				return err
+			})
+		}
+		pop3.Close()
+	}
+	resp.POP3Trace = traced(pop3Trace)
+
+	smtpTrace := newTrace("smtp")
+	if smtp, err := s.newSMTPClient(acc, smtpTrace); err != nil {
+		run("smtp", "connect", func() error { return err })
+	} else {
+		if run("smtp", "connect", func() error { return smtp.Connect(ctx) }) &&
+			run("smtp", "handshake", func() error { return smtp.Handshake(ctx) }) {
+			for _, line := range smtp.Extensions() {
+				resp.SMTPExtensions = append(resp.SMTPExtensions, redact.Replace(line))
+			}
+			run("smtp", "auth", func() error { return smtp.Auth(ctx) })
+		}
+		smtp.Close()
+	}
+	resp.SMTPTrace = traced(smtpTrace)
+
+	resp.OK = !failed
+	return resp
+}
+
+// redactions returns strings.NewReplacer pairs masking each name.  Names
+// too short to identify anyone are left alone rather than shredding every
+// message they occur in.
+func redactions(names ...string) []string {
+	var pairs []string
+	for _, name := range names {
+		if len(name) >= 3 {
+			pairs = append(pairs, name, "[redacted]")
+		}
+	}
+	return pairs
+}
+
+// adminPrincipal names who made an admin request.  Operator endpoints share
+// ADMIN_TOKEN, so the principal is a fingerprint of the token presented: it
+// tells tokens apart across rotations without recording the token itself.
+func adminPrincipal(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	sum := sha256.Sum256([]byte(token))
+	return "admin-token:" + hex.EncodeToString(sum[:6])
+}
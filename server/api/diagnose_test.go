@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+	"mulamail/mail"
+)
+
+// addDiagnosedAccount registers an account whose POP3 and SMTP logins go to
+// the fakes, both as user mailbox-user@example.com.
+func addDiagnosedAccount(t *testing.T, server *Server, mockDB *dbtest.Mock, pop *fakePOP3, smtp *fakeSMTP) {
+	t.Helper()
+	popHost, popPort := pop.start(t)
+	smtpHost, smtpPort := smtp.start(t)
+	passEnc, _ := server.cfg.EncryptionKey.EncryptString("hunter2")
+	mockDB.CreateMailAccount(context.Background(), &db.MailAccount{
+		OwnerPubKey:  "owner",
+		AccountEmail: "me@example.com",
+		POP3:         db.POP3Settings{Host: popHost, Port: popPort, User: "mailbox-user@example.com", PassEnc: passEnc},
+		SMTP:         db.SMTPSettings{Host: smtpHost, Port: smtpPort, User: "mailbox-user@example.com", PassEnc: passEnc},
+	})
+}
+
+func postDiagnose(server *Server, payload any) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(payload)
+	req := httptest.NewRequest("POST", "/api/v1/admin/diagnose-account", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	server.requireAdmin(server.diagnoseAccount)(w, req)
+	return w
+}
+
+func diagnosedSteps(resp diagnoseAccountResponse) []string {
+	var steps []string
+	for _, s := range resp.Steps {
+		steps = append(steps, s.Protocol+" "+s.Step)
+	}
+	return steps
+}
+
+func TestDiagnoseAccount(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+	smtp := &fakeSMTP{ehlo: []string{"AUTH PLAIN LOGIN", "SIZE 1000"}}
+	addDiagnosedAccount(t, server, mockDB, &fakePOP3{capa: []string{"USER", "UIDL"}}, smtp)
+
+	w := postDiagnose(server, diagnoseAccountRequest{OwnerPubKey: "owner", AccountEmail: "me@example.com"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp diagnoseAccountResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	want := []string{"pop3 connect", "pop3 auth", "pop3 capabilities", "smtp connect", "smtp handshake", "smtp auth"}
+	if !resp.OK || !slices.Equal(diagnosedSteps(resp), want) {
+		t.Errorf("want all of %v to succeed, got %+v", want, resp)
+	}
+	if !slices.Equal(resp.POP3Capabilities, []string{"UIDL", "USER"}) || !slices.Equal(resp.SMTPExtensions, []string{"AUTH PLAIN LOGIN", "SIZE 1000"}) {
+		t.Errorf("capabilities: unexpected %v and %v", resp.POP3Capabilities, resp.SMTPExtensions)
+	}
+	if len(smtp.sent()) != 0 {
+		t.Error("a diagnosis must not send mail")
+	}
+
+	events, _ := mockDB.GetAuditEvents(context.Background(), "owner", 10)
+	if len(events) != 1 || events[0].Action != "account.diagnose" || events[0].Target != "me@example.com" ||
+		events[0].Detail["outcome"] != "ok" || !strings.HasPrefix(events[0].Detail["admin"].(string), "admin-token:") {
+		t.Errorf("unexpected audit events %+v", events)
+	}
+}
+
+func TestDiagnoseAccount_SanitisesFailures(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+	addDiagnosedAccount(t, server, mockDB, &fakePOP3{rejectPass: true}, &fakeSMTP{})
+
+	w := postDiagnose(server, diagnoseAccountRequest{OwnerPubKey: "owner", AccountEmail: "me@example.com"})
+	var resp diagnoseAccountResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.OK || !slices.Equal(diagnosedSteps(resp), []string{"pop3 connect", "pop3 auth", "smtp connect", "smtp handshake", "smtp auth"}) {
+		t.Fatalf("want the POP3 auth failure to end the POP3 steps, got %+v", resp)
+	}
+	auth := resp.Steps[1]
+	if auth.OK || !strings.Contains(auth.Error, "invalid password") {
+		t.Errorf("auth step: unexpected %+v", auth)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "mailbox-user") || strings.Contains(body, "hunter2") {
+		t.Errorf("response leaks credentials: %s", body)
+	}
+
+	events, _ := mockDB.GetAuditEvents(context.Background(), "owner", 10)
+	if len(events) != 1 || events[0].Detail["outcome"] != "failed" {
+		t.Errorf("unexpected audit events %+v", events)
+	}
+}
+
+func TestDiagnoseAccount_Trace(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+	addDiagnosedAccount(t, server, mockDB, &fakePOP3{echoPass: true}, &fakeSMTP{ehlo: []string{"AUTH PLAIN"}})
+
+	w := postDiagnose(server, diagnoseAccountRequest{OwnerPubKey: "owner", AccountEmail: "me@example.com", Trace: true})
+	var resp diagnoseAccountResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	lines := func(trace []mail.TraceEntry) []string {
+		var lines []string
+		for _, e := range trace {
+			lines = append(lines, e.Dir+" "+e.Line)
+		}
+		return lines
+	}
+	pop3, smtp := lines(resp.POP3Trace), lines(resp.SMTPTrace)
+	for _, want := range []string{"C USER [redacted]", "C PASS [redacted]", "S -ERR [AUTH] invalid password [redacted] for [redacted]", "C QUIT"} {
+		if !slices.Contains(pop3, want) {
+			t.Errorf("POP3 trace: want %q, got %q", want, pop3)
+		}
+	}
+	for _, want := range []string{"C EHLO " + mail.LocalHostname(), "C AUTH PLAIN [redacted]", "S 235 2.7.0 Authentication successful"} {
+		if !slices.Contains(smtp, want) {
+			t.Errorf("SMTP trace: want %q, got %q", want, smtp)
+		}
+	}
+	// The password is echoed back by the POP3 server, and would otherwise
+	// show in both the trace and the auth step's error.
+	body := w.Body.String()
+	for _, secret := range []string{"hunter2", "aHVudGVyMg", "mailbox-user", "bWFpbGJveC11c2Vy"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("response leaks %q: %s", secret, body)
+		}
+	}
+
+	// At debug level every session is logged instead.
+	server.cfg.LogLevel = "debug"
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	w = postDiagnose(server, diagnoseAccountRequest{OwnerPubKey: "owner", AccountEmail: "me@example.com"})
+	if strings.Contains(w.Body.String(), "_trace") {
+		t.Errorf("want no trace unless asked for, got %s", w.Body.String())
+	}
+	if !strings.Contains(logged.String(), "pop3 trace owner/me@example.com: C PASS [redacted]") || strings.Contains(logged.String(), "hunter2") {
+		t.Errorf("debug log: want the redacted sessions, got %s", logged.String())
+	}
+}
+
+func TestDiagnoseAccount_AuditsEveryCall(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+
+	if w := postDiagnose(server, diagnoseAccountRequest{OwnerPubKey: "owner", AccountEmail: "missing@example.com"}); w.Code != http.StatusNotFound {
+		t.Errorf("unknown account: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := postDiagnose(server, diagnoseAccountRequest{OwnerPubKey: "owner"}); w.Code != http.StatusBadRequest {
+		t.Errorf("missing account: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	events, _ := mockDB.GetAuditEvents(context.Background(), "owner", 10)
+	if len(events) != 2 {
+		t.Errorf("want both calls audited, got %+v", events)
+	}
+}
@@ -0,0 +1,396 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"mulamail/config"
+	"mulamail/db"
+	"mulamail/vault"
+)
+
+const (
+	// erasureChallengeTTL is how long a deletion challenge can be confirmed.
+	erasureChallengeTTL = 10 * time.Minute
+
+	// erasureLease is how long a worker may hold an erasure before another
+	// worker takes it over and resumes from the first unfinished step.
+	erasureLease = 15 * time.Minute
+
+	// erasureMaxAttempts bounds the attempts at one erasure.
+	erasureMaxAttempts = 5
+
+	// erasureCaveat is returned with every deletion request.
+	erasureCaveat = "The identity's registration memo is recorded on the Solana blockchain and cannot be erased; " +
+		"the identity is marked revoked instead. Payment records are kept for accounting, and an audit " +
+		"record of the deletion is kept."
+)
+
+// Erasure steps other than the owner data collections in db.OwnerCollections.
+const (
+	erasureIdentityStep = "identity" // mark the identity revoked
+	erasureVaultStep    = "vault"    // delete cached message bodies and export archives
+)
+
+// erasureSteps lists the steps of an erasure in the order they run.
+func erasureSteps() []db.ErasureStep {
+	names := append(append([]string{erasureIdentityStep}, db.OwnerCollections...), erasureVaultStep)
+	steps := make([]db.ErasureStep, len(names))
+	for i, name := range names {
+		steps[i] = db.ErasureStep{Name: name}
+	}
+	return steps
+}
+
+// erasureVaultPrefixes are the vault prefixes holding the owner's blobs.
+func erasureVaultPrefixes(owner string) []string {
+	return []string{
+		"messages/" + hashComponent(owner) + "/",
+		"exports/" + hashComponent(owner) + "/",
+	}
+}
+
+// erasureChallengeResponse carries the token POST /api/v1/owner/delete quotes.
+type erasureChallengeResponse struct {
+	Token     string    `json:"token"` // shown only in this response
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// erasePayload is the part of POST /api/v1/owner/delete the owner's wallet
+// signs.  DryRun is signed too, so a dry-run signature cannot be replayed to
+// delete anything.
+type erasePayload struct {
+	Action       string `json:"action"` // always "delete-owner"
+	OwnerPubKey  string `json:"owner_pubkey"`
+	Confirmation string `json:"confirmation"` // challenge token; may be empty for a dry run
+	DryRun       bool   `json:"dry_run"`
+	SignedAt     string `json:"signed_at"` // RFC 3339
+}
+
+// eraseRequest is the body of POST /api/v1/owner/delete.
+type eraseRequest struct {
+	erasePayload
+	Signature string `json:"signature"`
+}
+
+// eraseResponse answers POST /api/v1/owner/delete: the queued job, or for a
+// dry run the number of records each step would delete.
+type eraseResponse struct {
+	DryRun bool             `json:"dry_run"`
+	Job    *db.ErasureJob   `json:"job,omitempty"`
+	Counts map[string]int64 `json:"counts,omitempty"`
+	Caveat string           `json:"caveat"`
+}
+
+// POST /api/v1/owner/delete/challenge?owner=<pubkey>
+//
+// Issues the confirmation token a deletion must quote.  Only the latest
+// token for an owner is valid, for erasureChallengeTTL.
+//
+// Response: { "token": "...", "expires_at": "..." }
+func (s *Server) createErasureChallenge(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	token := hex.EncodeToString(b[:])
+	job := &db.ErasureJob{
+		OwnerPubKey:        owner,
+		ChallengeHash:      hashAPIKey(token),
+		ChallengeExpiresAt: time.Now().Add(erasureChallengeTTL).UTC(),
+	}
+	if err := s.db.CreateErasureChallenge(r.Context(), job); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, erasureChallengeResponse{Token: token, ExpiresAt: job.ChallengeExpiresAt})
+}
+
+// POST /api/v1/owner/delete?owner=<pubkey>
+//
+// Deletes everything stored for the owner: mail accounts, cached messages
+// and their bodies in the vault, sent history, scheduled mail, contacts,
+// exports and API keys, and marks the identity revoked.  The request must be
+// signed by the owner's wallet and quote the token from a challenge; the
+// deletion then runs in the background (poll /api/v1/owner/delete/{job}).
+// With dry_run set, nothing is deleted and no challenge is needed: the
+// response counts what would be.
+//
+// Request: { "action": "delete-owner", "owner_pubkey": "...", "confirmation": "...",
+// "dry_run": false, "signed_at": "...", "signature": "..." }
+// Response: { "dry_run": false, "job": {...}, "caveat": "..." } (202)
+func (s *Server) eraseOwner(w http.ResponseWriter, r *http.Request) {
+	var req eraseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Action != "delete-owner" {
+		writeError(w, http.StatusBadRequest, `action must be "delete-owner"`)
+		return
+	}
+	if req.OwnerPubKey != r.URL.Query().Get("owner") {
+		writeError(w, http.StatusBadRequest, "owner_pubkey does not match the owner parameter")
+		return
+	}
+	if !req.DryRun && req.Confirmation == "" {
+		writeError(w, http.StatusBadRequest, "confirmation token required; request one from /api/v1/owner/delete/challenge")
+		return
+	}
+	if code, msg := checkWalletSignature(req.OwnerPubKey, req.SignedAt, req.erasePayload, req.Signature); code != 0 {
+		writeError(w, code, msg)
+		return
+	}
+	owner := req.OwnerPubKey
+
+	if req.DryRun {
+		counts, err := s.erasureCounts(r.Context(), owner)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		s.audit(r.Context(), owner, "owner.delete.dry_run", "", map[string]any{"counts": counts})
+		writeJSON(w, http.StatusOK, eraseResponse{DryRun: true, Counts: counts, Caveat: erasureCaveat})
+		return
+	}
+
+	job, err := s.db.ConfirmErasureJob(r.Context(), owner, hashAPIKey(req.Confirmation), time.Now())
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusUnauthorized, "confirmation token is invalid or has expired")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	s.audit(r.Context(), owner, "owner.delete.requested", job.ID.Hex(), nil)
+	writeJSON(w, http.StatusAccepted, eraseResponse{Job: job, Caveat: erasureCaveat})
+}
+
+// GET /api/v1/owner/delete/{job}?owner=<pubkey>
+//
+// Reports the progress of a deletion, step by step.
+func (s *Server) erasureStatus(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	job, err := s.db.GetErasureJob(r.Context(), owner, r.PathValue("job"))
+	if errors.Is(err, db.ErrNotFound) || (err == nil && job.Status == db.ErasureChallenged) {
+		writeError(w, http.StatusNotFound, "deletion not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// erasureCounts returns the number of records each erasure step would
+// delete or, for the identity, revoke.
+func (s *Server) erasureCounts(ctx context.Context, owner string) (map[string]int64, error) {
+	counts, err := s.db.CountOwnerData(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := s.db.GetIdentitiesByPubKeys(ctx, []string{owner})
+	if err != nil {
+		return nil, fmt.Errorf("identities: %w", err)
+	}
+	counts[erasureIdentityStep] = 0
+	for _, id := range identities {
+		if id.RevokedAt.IsZero() {
+			counts[erasureIdentityStep]++
+		}
+	}
+	counts[erasureVaultStep] = 0
+	if s.storage != nil {
+		for _, prefix := range erasureVaultPrefixes(owner) {
+			err := vault.ForEachPage(ctx, s.storage, prefix, func(keys []string) error {
+				counts[erasureVaultStep] += int64(len(keys))
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("vault: %w", err)
+			}
+		}
+	}
+	return counts, nil
+}
+
+// eraseVault deletes the owner's blobs from the vault and returns how many
+// were deleted.
+func (s *Server) eraseVault(ctx context.Context, owner string) (int64, error) {
+	if s.storage == nil {
+		return 0, nil
+	}
+	var n int64
+	for _, prefix := range erasureVaultPrefixes(owner) {
+		err := vault.ForEachPage(ctx, s.storage, prefix, func(keys []string) error {
+			for _, key := range keys {
+				if err := s.storage.Delete(ctx, key); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// audit records an audit event.  A failure is logged rather than failing
+// the request, since the action it describes has already happened.
+func (s *Server) audit(ctx context.Context, owner, action, target string, detail map[string]any) {
+	e := &db.AuditEvent{OwnerPubKey: owner, Action: action, Target: target, Detail: detail}
+	if ip := clientIP(ctx); ip.IsValid() {
+		e.ClientIP = ip.String()
+	}
+	if err := s.db.CreateAuditEvent(ctx, e); err != nil {
+		log.Printf("audit: %s %s %s: %v", action, owner, target, err)
+	}
+}
+
+// ---------- erasure worker ----------
+
+// Eraser carries out confirmed deletions in the background.  Each step's
+// progress is saved as it finishes, so a failed attempt is retried from the
+// first unfinished step; steps are idempotent, so a step interrupted by a
+// dying worker is simply run again.
+type Eraser struct {
+	srv         *Server
+	leader      *leader
+	worker      string
+	interval    time.Duration
+	maxAttempts int
+	now         func() time.Time
+}
+
+// NewEraser creates an erasure worker deleting vault blobs from storage.
+func NewEraser(database db.DB, storage vault.Storage, cfg *config.Config) *Eraser {
+	return &Eraser{
+		srv:         &Server{db: database, storage: storage, cfg: cfg},
+		leader:      newLeader(database, roleEraser, cfg),
+		worker:      workerName(),
+		interval:    seconds(cfg.ErasureIntervalSeconds),
+		maxAttempts: erasureMaxAttempts,
+		now:         time.Now,
+	}
+}
+
+// Run carries out deletions until ctx is cancelled.  Only the instance
+// leading the eraser role does.
+func (er *Eraser) Run(ctx context.Context) {
+	er.leader.elect(ctx)
+	ticker := time.NewTicker(er.interval)
+	defer ticker.Stop()
+	for {
+		er.processQueued(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processQueued runs every deletion that is waiting for a worker.
+func (er *Eraser) processQueued(ctx context.Context) {
+	for ctx.Err() == nil && er.leader.leads() && !er.srv.paused(ctx) {
+		now := er.now()
+		job, err := er.srv.db.ClaimErasureJob(ctx, now, now.Add(-erasureLease), er.worker)
+		if errors.Is(err, db.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("eraser: claim: %v", err)
+			return
+		}
+		er.run(ctx, job)
+	}
+}
+
+// run makes one attempt at a claimed deletion and records the outcome:
+// done, queued again, or failed.
+func (er *Eraser) run(ctx context.Context, job *db.ErasureJob) {
+	if len(job.Steps) == 0 {
+		job.Steps = erasureSteps()
+	}
+	var err error
+	for i := range job.Steps {
+		step := &job.Steps[i]
+		if step.Done {
+			continue
+		}
+		n, stepErr := er.erase(ctx, job.OwnerPubKey, step.Name)
+		step.Deleted += n
+		if stepErr != nil {
+			step.Error = publicError(stepErr)
+			err = fmt.Errorf("%s: %w", step.Name, stepErr)
+			break
+		}
+		step.Done, step.Error = true, ""
+		if err := er.srv.db.UpdateErasureJob(ctx, job); err != nil {
+			// The claim was lost to another worker, which carries on.
+			log.Printf("eraser: record progress of %s: %v", job.ID.Hex(), err)
+			return
+		}
+	}
+
+	counts := make(map[string]any, len(job.Steps))
+	for _, step := range job.Steps {
+		counts[step.Name] = step.Deleted
+	}
+	switch {
+	case err == nil:
+		job.Status, job.LastError, job.CompletedAt = db.ErasureDone, "", er.now()
+	case job.Attempts >= er.maxAttempts:
+		job.Status, job.LastError = db.ErasureFailed, publicError(err)
+	default:
+		job.Status, job.LastError = db.ErasurePending, publicError(err)
+	}
+	if err != nil {
+		log.Printf("eraser: job %s attempt %d: %v", job.ID.Hex(), job.Attempts, err)
+	}
+	if err := er.srv.db.UpdateErasureJob(ctx, job); err != nil {
+		log.Printf("eraser: record outcome of %s: %v", job.ID.Hex(), err)
+		return
+	}
+	switch job.Status {
+	case db.ErasureDone:
+		er.srv.audit(ctx, job.OwnerPubKey, "owner.delete.completed", job.ID.Hex(), map[string]any{"deleted": counts})
+	case db.ErasureFailed:
+		er.srv.audit(ctx, job.OwnerPubKey, "owner.delete.failed", job.ID.Hex(),
+			map[string]any{"deleted": counts, "error": job.LastError})
+	}
+}
+
+// erase runs one step for owner and returns how many records it deleted.
+func (er *Eraser) erase(ctx context.Context, owner, step string) (int64, error) {
+	switch step {
+	case erasureIdentityStep:
+		return er.srv.db.RevokeIdentities(ctx, owner, er.now())
+	case erasureVaultStep:
+		return er.srv.eraseVault(ctx, owner)
+	default:
+		return er.srv.db.DeleteOwnerData(ctx, owner, step)
+	}
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/db"
+	"mulamail/vault"
+)
+
+// postErase signs and sends POST /api/v1/owner/delete for wallet.
+func postErase(t *testing.T, router http.Handler, wallet solana.PrivateKey, confirmation string, dryRun bool) *httptest.ResponseRecorder {
+	t.Helper()
+	owner := wallet.PublicKey().String()
+	req := eraseRequest{erasePayload: erasePayload{
+		Action:       "delete-owner",
+		OwnerPubKey:  owner,
+		Confirmation: confirmation,
+		DryRun:       dryRun,
+		SignedAt:     time.Now().UTC().Format(time.RFC3339),
+	}}
+	req.Signature = signPayload(t, wallet, req.erasePayload)
+	body, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/owner/delete?owner="+owner, bytes.NewReader(body)))
+	return w
+}
+
+// erasureChallenge requests a confirmation token for owner.
+func erasureChallenge(t *testing.T, router http.Handler, owner string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/owner/delete/challenge?owner="+owner, nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("challenge: status %d: %s", w.Code, w.Body.String())
+	}
+	var resp erasureChallengeResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	return resp.Token
+}
+
+func TestEraseOwner_DryRunThenDelete(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	storage, err := vault.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+	server.storage = storage
+	router := NewRouter(mockDB, server.solana, storage, server.cfg)
+	ctx := context.Background()
+
+	wallet := solana.NewWallet().PrivateKey
+	owner := wallet.PublicKey().String()
+	mockDB.CreateIdentity(ctx, &db.Identity{Email: "me@example.com", PubKey: owner, Verified: true})
+	mockDB.CreateMailAccount(ctx, &db.MailAccount{OwnerPubKey: owner, AccountEmail: "me@example.com"})
+	mockDB.UpsertCachedMessage(ctx, &db.CachedMessage{OwnerPubKey: owner, AccountEmail: "me@example.com", UID: "1"})
+	mockDB.CreateSentMessage(ctx, &db.SentMessage{OwnerPubKey: owner, AccountEmail: "me@example.com"})
+	mockDB.CreateSentMessage(ctx, &db.SentMessage{OwnerPubKey: "someone-else", AccountEmail: "x@example.com"})
+	mockDB.CreateContact(ctx, &db.Contact{OwnerPubKey: owner, EmailIndex: "bob"})
+	storage.Put(ctx, messageCacheKey(owner, "me@example.com", "1"), []byte("body"))
+	storage.Put(ctx, messageCacheKey("someone-else", "x@example.com", "1"), []byte("body"))
+
+	w := postErase(t, router, wallet, "", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("dry run: status %d: %s", w.Code, w.Body.String())
+	}
+	var dry eraseResponse
+	json.NewDecoder(w.Body).Decode(&dry)
+	want := map[string]int64{"identity": 1, "mail_accounts": 1, "messages": 1, "sent_messages": 1, "contacts": 1, "vault": 1}
+	for step, n := range want {
+		if dry.Counts[step] != n {
+			t.Errorf("dry run %s: want %d, got %d", step, n, dry.Counts[step])
+		}
+	}
+	if dry.Caveat == "" || len(mockDB.Sent) != 2 {
+		t.Errorf("dry run should report the caveat and delete nothing: %+v", dry)
+	}
+
+	if w := postErase(t, router, wallet, "", false); w.Code != http.StatusBadRequest {
+		t.Errorf("delete without confirmation: want 400, got %d", w.Code)
+	}
+	if w := postErase(t, router, wallet, "not-the-token", false); w.Code != http.StatusUnauthorized {
+		t.Errorf("delete with a wrong token: want 401, got %d", w.Code)
+	}
+
+	stale := erasureChallenge(t, router, owner)
+	token := erasureChallenge(t, router, owner)
+	if w := postErase(t, router, wallet, stale, false); w.Code != http.StatusUnauthorized {
+		t.Errorf("superseded token: want 401, got %d", w.Code)
+	}
+	w = postErase(t, router, wallet, token, false)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body.String())
+	}
+	var resp eraseResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Job == nil || resp.Job.Status != db.ErasurePending {
+		t.Fatalf("delete: want a pending job, got %+v", resp)
+	}
+	if w := postErase(t, router, wallet, token, false); w.Code != http.StatusUnauthorized {
+		t.Errorf("reused token: want 401, got %d", w.Code)
+	}
+
+	// The first attempt fails part-way and is retried from where it stopped.
+	var failed sync.Once
+	mockDB.FailWith("DeleteOwnerData", func(_ context.Context, args ...any) error {
+		var err error
+		if args[1] == "sent_messages" {
+			failed.Do(func() { err = errors.New("sent_messages: connection reset") })
+		}
+		return err
+	})
+	er := &Eraser{srv: server, worker: "w1", maxAttempts: erasureMaxAttempts, now: time.Now}
+	er.processQueued(ctx)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/owner/delete/"+resp.Job.ID.Hex()+"?owner="+owner, nil))
+	var job db.ErasureJob
+	json.NewDecoder(w.Body).Decode(&job)
+	if job.Status != db.ErasureDone || job.Attempts != 2 {
+		t.Fatalf("after retry: want done on the second attempt, got %+v", job)
+	}
+	for _, step := range job.Steps {
+		if !step.Done || step.Error != "" {
+			t.Errorf("step %s not finished: %+v", step.Name, step)
+		}
+		if n, ok := want[step.Name]; ok && step.Deleted != n {
+			t.Errorf("step %s: want %d deleted, got %d", step.Name, n, step.Deleted)
+		}
+	}
+
+	if len(mockDB.Accounts[owner]) != 0 || len(mockDB.Cached) != 0 || len(mockDB.Contacts) != 0 {
+		t.Error("owner data left behind")
+	}
+	if len(mockDB.Sent) != 1 || mockDB.Sent[0].OwnerPubKey != "someone-else" {
+		t.Errorf("another owner's sent history was touched: %+v", mockDB.Sent)
+	}
+	if mockDB.Identities["me@example.com"].RevokedAt.IsZero() {
+		t.Error("identity not revoked")
+	}
+	if _, err := storage.Get(ctx, messageCacheKey(owner, "me@example.com", "1")); err == nil {
+		t.Error("cached message body left in the vault")
+	}
+	if _, err := storage.Get(ctx, messageCacheKey("someone-else", "x@example.com", "1")); err != nil {
+		t.Errorf("another owner's vault blob was deleted: %v", err)
+	}
+
+	var actions []string
+	for _, e := range mockDB.Audit {
+		actions = append(actions, e.Action)
+	}
+	wantActions := []string{"owner.delete.dry_run", "owner.delete.requested", "owner.delete.completed"}
+	if len(actions) != len(wantActions) || actions[0] != wantActions[0] || actions[1] != wantActions[1] || actions[2] != wantActions[2] {
+		t.Errorf("audit events: want %v, got %v", wantActions, actions)
+	}
+}
+
+func TestEraseOwner_RejectsBadSignature(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	wallet := solana.NewWallet().PrivateKey
+	owner := wallet.PublicKey().String()
+	token := erasureChallenge(t, router, owner)
+
+	// Signed by another wallet.
+	req := eraseRequest{erasePayload: erasePayload{
+		Action: "delete-owner", OwnerPubKey: owner, Confirmation: token,
+		SignedAt: time.Now().UTC().Format(time.RFC3339),
+	}}
+	req.Signature = signPayload(t, solana.NewWallet().PrivateKey, req.erasePayload)
+	body, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/owner/delete?owner="+owner, bytes.NewReader(body)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("foreign signature: want 401, got %d", w.Code)
+	}
+	if mockDB.Erasures[0].Status != db.ErasureChallenged {
+		t.Errorf("challenge consumed by a rejected request: %+v", mockDB.Erasures[0])
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+// Upstream failures (from MongoDB, the mail servers, the Solana RPC node or
+// the vault) are never echoed to clients as they are: their text can name
+// internal hosts and addresses, the database URI, the bucket or driver
+// versions.  Handlers answer them with a public message instead, and the
+// full error is only logged, under the request ID that the response
+// carries in X-Request-ID, so a client report can be matched to it.
+
+// msgInternal is the public message for a failure the client can do
+// nothing about.
+const msgInternal = "internal error"
+
+// writeFailure answers err with code and the public message msg, logging
+// err in full.
+func writeFailure(w http.ResponseWriter, r *http.Request, code int, msg string, err error) {
+	log.Printf("[%s] %s %s: %d %s: %v", requestID(r.Context()), r.Method, r.URL.Path, code, msg, err)
+	writeError(w, code, msg)
+}
+
+// writeInternalError answers a failure of the server's own infrastructure
+// with 500.
+func writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	writeFailure(w, r, http.StatusInternalServerError, msgInternal, err)
+}
+
+// writeLockError answers a failure of lockOwner with 503: an owner kept
+// busy by another request is worth retrying, anything else is internal.
+func writeLockError(w http.ResponseWriter, r *http.Request, err error) {
+	msg := msgInternal
+	if errors.Is(err, errOwnerBusy) {
+		msg = errOwnerBusy.Error()
+	}
+	writeFailure(w, r, http.StatusServiceUnavailable, msg, err)
+}
+
+// writeMailError answers a failure to load an account or talk to its mail
+// server with code, prefixing the public message with stage if set.
+func writeMailError(w http.ResponseWriter, r *http.Request, code int, stage string, err error) {
+	msg := publicError(err)
+	if errors.Is(err, db.ErrNotFound) {
+		msg = "account not found"
+	}
+	if stage != "" {
+		msg = stage + ": " + msg
+	}
+	writeFailure(w, r, code, msg, err)
+}
+
+// publicError maps err to a message safe to show its owner.  What the
+// account's own mail server said (its replies, and size and address
+// problems) is kept, since that is what the user can act on, as are the
+// recipients a recipient domain policy refused; network
+// failures are reduced to their kind by sanitizeError.  Anything else may
+// come from the database, the vault or the RPC node and becomes
+// msgInternal.
+func publicError(err error) string {
+	var (
+		stageErr *smtpStageError
+		pop3Err  *mail.POP3Error
+		smtpErr  *mail.SMTPError
+		sizeErr  *mail.SizeLimitError
+		addrErr  *mail.AddressError
+		certErr  *tls.CertificateVerificationError
+		netErr   net.Error
+		rcptErr  *recipientDomainError
+	)
+	switch {
+	case errors.As(err, &stageErr):
+		return stageErr.stage + ": " + publicError(stageErr.err)
+	case errors.Is(err, mail.ErrDeliveryUncertain):
+		// The chain goes on to the connection error and its addresses.
+		return mail.ErrDeliveryUncertain.Error()
+	case errors.As(err, &pop3Err), errors.As(err, &smtpErr), errors.As(err, &sizeErr), errors.As(err, &addrErr),
+		errors.Is(err, mail.ErrNotSupported), errors.Is(err, mail.ErrDSNNotSupported), errors.Is(err, mail.ErrPartNotFound):
+		return sanitizeError(err)
+	case errors.As(err, &rcptErr):
+		return rcptErr.Error()
+	case errors.As(err, &certErr):
+		return "mail server certificate not trusted"
+	case errors.As(err, &netErr):
+		return sanitizeError(netErr)
+	case errors.Is(err, db.ErrNotFound):
+		return "not found"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	}
+	return msgInternal
+}
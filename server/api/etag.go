@@ -0,0 +1,57 @@
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+
+	"mulamail/mail"
+)
+
+// inboxETag derives a weak ETag for an inbox response from the mailbox
+// listing.  UIDs identify message content when the server supports UIDL;
+// otherwise message numbers and sizes stand in for them.  The limit, preview
+// size threshold, representation, list filter and whether duplicates and
+// snippets are included are folded in since they change the response body.
+func inboxETag(list []mail.Message, uids map[int]string, limit, maxBytes int, stream, duplicates, snippets bool, filter string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "limit=%d max=%d stream=%t duplicates=%t snippets=%t filter=%s\n", limit, maxBytes, stream, duplicates, snippets, filter)
+	for _, m := range list {
+		if uid, ok := uids[m.ID]; ok {
+			fmt.Fprintf(h, "%d uid %s\n", m.ID, uid)
+		} else {
+			fmt.Fprintf(h, "%d size %d\n", m.ID, m.Size)
+		}
+	}
+	return weakETag(h)
+}
+
+// messageETag derives a weak ETag for a raw message from its UIDL.
+func messageETag(uid string) string {
+	h := sha256.New()
+	h.Write([]byte(uid)) //nolint:errcheck
+	return weakETag(h)
+}
+
+func weakETag(h hash.Hash) string {
+	return fmt.Sprintf(`W/"%x"`, h.Sum(nil)[:16])
+}
+
+// etagMatches reports whether the request's If-None-Match header lists etag,
+// using the weak comparison RFC 9110 prescribes for If-None-Match.
+func etagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
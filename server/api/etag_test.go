@@ -0,0 +1,174 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"mulamail/mail"
+)
+
+// getWithETag issues a GET through handler with an optional If-None-Match.
+func getWithETag(handler http.HandlerFunc, url, ifNoneMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestFetchInbox_ETag(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{messages: map[int]string{
+		1: "Subject: one\r\n",
+		2: "Subject: two\r\n",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	url := "/api/v1/mail/inbox?owner=owner&account=me@example.com"
+
+	w := getWithETag(server.fetchInbox, url, "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first fetch: want 200 with ETag, got %d %q", w.Code, etag)
+	}
+	topped := fake.topped.Load()
+
+	w = getWithETag(server.fetchInbox, url, etag)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("matching If-None-Match: want 304, got %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("304 must have no body, got %q", w.Body.String())
+	}
+	if n := fake.topped.Load(); n != topped {
+		t.Errorf("304 path issued %d TOP commands", n-topped)
+	}
+
+	if w := getWithETag(server.fetchInbox, url+"&limit=1", etag); w.Code != http.StatusOK {
+		t.Errorf("different limit: want 200, got %d", w.Code)
+	}
+
+	// The same mailbox after a third message has arrived.
+	changed := &fakePOP3{messages: map[int]string{
+		1: "Subject: one\r\n",
+		2: "Subject: two\r\n",
+		3: "Subject: three\r\n",
+	}}
+	host, port = changed.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "changed@example.com", host, port)
+
+	w = getWithETag(server.fetchInbox, "/api/v1/mail/inbox?owner=owner&account=changed@example.com", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("changed mailbox: want 200, got %d", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("ETag did not change when the mailbox changed")
+	}
+}
+
+func TestInboxETag_WithoutUIDL(t *testing.T) {
+	list := []mail.Message{{ID: 1, Size: 100}, {ID: 2, Size: 200}}
+	base := inboxETag(list, nil, 20, 0, false, false, false, "")
+
+	resized := []mail.Message{{ID: 1, Size: 100}, {ID: 2, Size: 201}}
+	if inboxETag(resized, nil, 20, 0, false, false, false, "") == base {
+		t.Error("ETag did not change when a message size changed")
+	}
+	if inboxETag(list[:1], nil, 20, 0, false, false, false, "") == base {
+		t.Error("ETag did not change when a message was removed")
+	}
+	if inboxETag(list, nil, 20, 0, true, false, false, "") == base {
+		t.Error("streamed and buffered responses share an ETag")
+	}
+	if inboxETag(list, nil, 20, 0, false, true, false, "") == base {
+		t.Error("responses with and without duplicates share an ETag")
+	}
+	if inboxETag(list, nil, 20, 0, false, false, true, "") == base {
+		t.Error("responses with and without snippets share an ETag")
+	}
+	if inboxETag(list, nil, 20, 150, false, false, false, "") == base {
+		t.Error("responses with and without skipped previews share an ETag")
+	}
+	if inboxETag(list, nil, 20, 0, false, false, false, filterLists) == base {
+		t.Error("filtered and unfiltered responses share an ETag")
+	}
+	if inboxETag(list, nil, 20, 0, false, false, false, "") != base {
+		t.Error("ETag is not deterministic")
+	}
+}
+
+func TestFetchInbox_ETagWithoutUIDL(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{noUIDL: true, messages: map[int]string{1: "Subject: one\r\n"}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	url := "/api/v1/mail/inbox?owner=owner&account=me@example.com"
+
+	etag := getWithETag(server.fetchInbox, url, "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag from LIST when UIDL is unsupported")
+	}
+	if w := getWithETag(server.fetchInbox, url, etag); w.Code != http.StatusNotModified {
+		t.Errorf("matching If-None-Match: want 304, got %d", w.Code)
+	}
+}
+
+func TestFetchMessage_ETag(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{messages: map[int]string{
+		1: "Subject: one\r\n\r\nbody one",
+		2: "Subject: two\r\n\r\nbody two",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	url := "/api/v1/mail/message?owner=owner&account=me@example.com&id="
+
+	w := getWithETag(server.fetchMessage, url+"1", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first fetch: want 200 with ETag, got %d %q", w.Code, etag)
+	}
+
+	w = getWithETag(server.fetchMessage, url+"1", etag)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("matching If-None-Match: want 304, got %d", w.Code)
+	}
+	if n := fake.retrieved.Load(); n != 1 {
+		t.Errorf("want 1 RETR in total, got %d", n)
+	}
+
+	w = getWithETag(server.fetchMessage, url+"2", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("other message: want 200 with a different ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	etag := `W/"abc"`
+	testCases := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`"xyz", W/"abc"`, true},
+		{"*", true},
+		{`"xyz"`, false},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.header != "" {
+			req.Header.Set("If-None-Match", tc.header)
+		}
+		if got := etagMatches(req, etag); got != tc.want {
+			t.Errorf("If-None-Match %q: want %v, got %v", tc.header, tc.want, got)
+		}
+	}
+}
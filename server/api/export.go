@@ -0,0 +1,506 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mulamail/config"
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+const (
+	// exportMinPassphrase is the shortest passphrase accepted for an
+	// export archive.
+	exportMinPassphrase = 12
+
+	// exportLease is how long a worker may hold an export before another
+	// worker assumes it died and builds the archive again.
+	exportLease = 15 * time.Minute
+
+	// exportMaxAttempts bounds the builds of one export.
+	exportMaxAttempts = 3
+
+	// exportFormat identifies the archive layout in manifest.json.
+	exportFormat = "mulamail-export/1"
+)
+
+// exportStorageKey derives the vault key of an export archive.  It depends
+// only on the job, so a rebuilt archive replaces the earlier one.
+func exportStorageKey(owner string, id primitive.ObjectID) string {
+	return "exports/" + hashComponent(owner) + "/" + id.Hex() + ".zip.enc"
+}
+
+// exportRequest is the body of POST /api/v1/export.
+type exportRequest struct {
+	Passphrase string `json:"passphrase"` // encrypts the archive; never stored once the archive is built
+}
+
+// POST /api/v1/export?owner=<pubkey>
+//
+// Queues an export of everything stored for the owner: identity, account
+// settings without passwords, cached message metadata and bodies, sent
+// history and contacts.  The archive is encrypted with the passphrase
+// (Argon2id, AES-256-GCM) and can be downloaded once the job is done.  While
+// an export is queued or running, the existing job is returned and the new
+// passphrase is ignored.
+//
+// Request:  { "passphrase": "..." }
+// Response: the export job (202)
+func (s *Server) createExport(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len([]rune(req.Passphrase)) < exportMinPassphrase {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("passphrase must be at least %d characters", exportMinPassphrase))
+		return
+	}
+
+	passphraseEnc, err := s.cfg.EncryptionKey.EncryptString(req.Passphrase)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	job := &db.ExportJob{OwnerPubKey: owner, PassphraseEnc: passphraseEnc}
+	if _, err := s.db.CreateExportJob(r.Context(), job); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// GET /api/v1/export/{job}/status?owner=<pubkey>
+//
+// Reports the state of an export: pending, running, done, failed or
+// expired.
+func (s *Server) exportStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.ownerExportJob(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// GET /api/v1/export/{job}/download?owner=<pubkey>
+//
+// Downloads a finished export archive, still encrypted with the passphrase
+// it was requested with, or the file of an mbox export.
+func (s *Server) downloadExport(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.ownerExportJob(w, r)
+	if !ok {
+		return
+	}
+	switch job.Status {
+	case db.ExportDone:
+	case db.ExportExpired:
+		writeError(w, http.StatusGone, "export has expired")
+		return
+	default:
+		writeError(w, http.StatusConflict, "export is "+job.Status)
+		return
+	}
+	if job.Kind == db.ExportMbox {
+		s.downloadMbox(w, r, job)
+		return
+	}
+
+	data, err := s.storage.Get(r.Context(), job.StorageKey)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="mulamail-export-`+job.ID.Hex()+`.zip.enc"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data) //nolint:errcheck
+}
+
+// ownerExportJob loads the export named in the path for the owner in the
+// query, writing the error response and returning false if there is none.
+func (s *Server) ownerExportJob(w http.ResponseWriter, r *http.Request) (*db.ExportJob, bool) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return nil, false
+	}
+	job, err := s.db.GetExportJob(r.Context(), owner, r.PathValue("job"))
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "export not found")
+		return nil, false
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return nil, false
+	}
+	return job, true
+}
+
+// ---------- archive ----------
+
+// exportManifest is manifest.json, describing the rest of the archive.
+type exportManifest struct {
+	Format    string         `json:"format"`
+	Owner     string         `json:"owner"`
+	CreatedAt time.Time      `json:"created_at"`
+	Counts    map[string]int `json:"counts"`
+}
+
+// exportedMessage is a cached preview in messages.json.  Mbox names the
+// file under mbox/ holding the full message, if its body was cached.
+type exportedMessage struct {
+	cachedPreview
+	Bounce *mail.Bounce `json:"bounce,omitempty"`
+	Mbox   string       `json:"mbox,omitempty"`
+}
+
+// exportArchive gathers everything stored for owner into a zip archive:
+// JSON files for identities, accounts, cached message metadata, sent
+// history and contacts, and one mbox file per account for the messages
+// whose bodies are cached in the vault.  It returns the archive and the
+// number of records of each kind.
+func (s *Server) exportArchive(ctx context.Context, owner string) ([]byte, map[string]int, error) {
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	identities, err := s.db.GetIdentitiesByPubKeys(ctx, []string{owner})
+	if err != nil {
+		return nil, nil, fmt.Errorf("identities: %w", err)
+	}
+	accounts, err := s.db.GetMailAccountsByOwner(ctx, owner)
+	if err != nil {
+		return nil, nil, fmt.Errorf("accounts: %w", err)
+	}
+	cached, err := s.db.GetCachedMessagesByOwner(ctx, owner)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cached messages: %w", err)
+	}
+	sent, err := s.db.GetSentMessagesByOwner(ctx, owner)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sent messages: %w", err)
+	}
+	contacts, err := s.db.GetContacts(ctx, owner, "", 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("contacts: %w", err)
+	}
+
+	messages := make([]exportedMessage, 0, len(cached))
+	mboxes := make(map[string]*bytes.Buffer)
+	for _, d := range cached {
+		m, err := decryptExportedMessage(fc, d)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decrypt cached message %s: %w", d.ID.Hex(), err)
+		}
+		raw, err := s.cachedRaw(ctx, owner, d.AccountEmail, d.UID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cached body of %s: %w", d.ID.Hex(), err)
+		}
+		if raw != "" {
+			m.Mbox = "mbox/" + exportFileName(d.AccountEmail) + ".mbox"
+			if mboxes[m.Mbox] == nil {
+				mboxes[m.Mbox] = new(bytes.Buffer)
+			}
+			sender, _ := senderAddress(m.From)
+			mail.WriteMbox(mboxes[m.Mbox], sender.Email, mboxDate(d), raw) //nolint:errcheck // bytes.Buffer
+		}
+		messages = append(messages, m)
+	}
+
+	contactViews := make([]contactView, 0, len(contacts))
+	for _, c := range contacts {
+		v, err := decryptContact(fc, c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decrypt contact %s: %w", c.ID.Hex(), err)
+		}
+		contactViews = append(contactViews, v)
+	}
+
+	counts := map[string]int{
+		"identities":   len(identities),
+		"accounts":     len(accounts),
+		"messages":     len(messages),
+		"raw_messages": 0,
+		"sent":         len(sent),
+		"contacts":     len(contactViews),
+	}
+	for _, m := range messages {
+		if m.Mbox != "" {
+			counts["raw_messages"]++
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := []struct {
+		name string
+		v    any
+	}{
+		{"manifest.json", exportManifest{Format: exportFormat, Owner: owner, CreatedAt: time.Now().UTC(), Counts: counts}},
+		{"identities.json", nonNil(identities)},
+		{"accounts.json", nonNil(accounts)},
+		{"messages.json", messages},
+		{"sent.json", nonNil(sent)},
+		{"contacts.json", contactViews},
+	}
+	for _, f := range files {
+		data, err := json.MarshalIndent(f.v, "", "  ")
+		if err == nil {
+			err = writeZipFile(zw, f.name, data)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("write %s: %w", f.name, err)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(mboxes)) {
+		if err := writeZipFile(zw, name, mboxes[name].Bytes()); err != nil {
+			return nil, nil, fmt.Errorf("write %s: %w", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), counts, nil
+}
+
+// decryptExportedMessage returns the export view of a cached preview.
+func decryptExportedMessage(fc *vault.FieldCipher, d db.CachedMessage) (exportedMessage, error) {
+	m := exportedMessage{cachedPreview: cachedPreview{
+		Account: d.AccountEmail, UID: d.UID, Date: d.Date, Size: d.Size,
+		From: d.From, Subject: d.Subject, // only set on unmigrated documents
+	}}
+	var err error
+	if d.FromEnc != "" {
+		if m.From, err = fc.Decrypt(d.FromEnc); err != nil {
+			return m, err
+		}
+	}
+	if d.SubjectEnc != "" {
+		if m.Subject, err = fc.Decrypt(d.SubjectEnc); err != nil {
+			return m, err
+		}
+	}
+	if d.BounceEnc != "" {
+		data, err := fc.Decrypt(d.BounceEnc)
+		if err != nil {
+			return m, err
+		}
+		m.Bounce = new(mail.Bounce)
+		if err := json.Unmarshal([]byte(data), m.Bounce); err != nil {
+			return m, err
+		}
+	}
+	if m.List, err = decryptList(fc, d); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// cachedRaw returns the message body cached in the vault by retrieveRaw,
+// or "" if it was never cached.
+func (s *Server) cachedRaw(ctx context.Context, owner, account, uid string) (string, error) {
+	if s.storage == nil {
+		return "", nil
+	}
+	raw, err := s.storage.Get(ctx, messageCacheKey(owner, account, uid))
+	if err != nil {
+		// Storage backends do not share a not-found error; a missing
+		// body is the common case and not worth failing the export.
+		return "", nil
+	}
+	return string(raw), nil
+}
+
+// exportFileName makes an account address safe to use as a file name.
+func exportFileName(account string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("@._+-", r):
+			return r
+		}
+		return '_'
+	}, account)
+}
+
+// nonNil returns s, or an empty slice if it is nil, so JSON files always
+// hold an array.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// ---------- export worker ----------
+
+// Exporter builds queued exports in the background and deletes archives
+// once they expire.  Like the Scheduler, several instances may run side by
+// side: jobs are claimed atomically, and a job whose worker has held it
+// longer than exportLease is claimed again and rebuilt from scratch under
+// the same storage key.
+type Exporter struct {
+	srv         *Server
+	leader      *leader
+	worker      string
+	interval    time.Duration
+	ttl         time.Duration
+	maxAttempts int
+	now         func() time.Time
+}
+
+// NewExporter creates an export worker storing archives in storage.
+func NewExporter(database db.DB, storage vault.Storage, cfg *config.Config) *Exporter {
+	return &Exporter{
+		srv:         &Server{db: database, storage: storage, cfg: cfg},
+		leader:      newLeader(database, roleExporter, cfg),
+		worker:      workerName(),
+		interval:    seconds(cfg.ExportIntervalSeconds),
+		ttl:         time.Duration(cfg.ExportTTLHours) * time.Hour,
+		maxAttempts: exportMaxAttempts,
+		now:         time.Now,
+	}
+}
+
+// Run builds and expires exports until ctx is cancelled.  Only the
+// instance leading the exporter role does.
+func (ex *Exporter) Run(ctx context.Context) {
+	ex.leader.elect(ctx)
+	ticker := time.NewTicker(ex.interval)
+	defer ticker.Stop()
+	for {
+		ex.processQueued(ctx)
+		ex.expire(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processQueued builds every export that is waiting for a worker.
+func (ex *Exporter) processQueued(ctx context.Context) {
+	for ctx.Err() == nil && ex.leader.leads() && !ex.srv.paused(ctx) {
+		now := ex.now()
+		job, err := ex.srv.db.ClaimExportJob(ctx, now, now.Add(-exportLease), ex.worker)
+		if errors.Is(err, db.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("exporter: claim: %v", err)
+			return
+		}
+		ex.run(ctx, job)
+	}
+}
+
+// run makes one attempt at a claimed export and records the outcome: done,
+// queued again, or failed.  The passphrase is dropped once the job can no
+// longer be retried.
+func (ex *Exporter) run(ctx context.Context, job *db.ExportJob) {
+	err := ex.build(ctx, job)
+	now := ex.now()
+	switch {
+	case err == nil:
+		job.Status, job.LastError, job.PassphraseEnc = db.ExportDone, "", ""
+		job.CompletedAt, job.ExpiresAt = now, now.Add(ex.ttl)
+	case job.Attempts >= ex.maxAttempts:
+		job.Status, job.LastError, job.PassphraseEnc = db.ExportFailed, publicError(err), ""
+	default:
+		job.Status, job.LastError = db.ExportPending, publicError(err)
+	}
+	if err != nil {
+		log.Printf("exporter: job %s attempt %d: %v", job.ID.Hex(), job.Attempts, err)
+	}
+	if err := ex.srv.db.FinishExportJob(ctx, job); err != nil {
+		log.Printf("exporter: record outcome of %s: %v", job.ID.Hex(), err)
+	}
+}
+
+// build writes the encrypted archive, or the mbox file, for job to
+// storage.
+func (ex *Exporter) build(ctx context.Context, job *db.ExportJob) error {
+	if job.Kind == db.ExportMbox {
+		return ex.buildMbox(ctx, job)
+	}
+	passphrase, err := ex.srv.cfg.EncryptionKey.DecryptString(job.PassphraseEnc)
+	if err != nil {
+		return fmt.Errorf("decrypt passphrase: %w", err)
+	}
+	archive, counts, err := ex.srv.exportArchive(ctx, job.OwnerPubKey)
+	if err != nil {
+		return err
+	}
+	blob, err := vault.EncryptWithPassphrase(passphrase, archive)
+	if err != nil {
+		return fmt.Errorf("encrypt archive: %w", err)
+	}
+	key := exportStorageKey(job.OwnerPubKey, job.ID)
+	if err := ex.srv.storage.Put(ctx, key, blob); err != nil {
+		return fmt.Errorf("store archive: %w", err)
+	}
+	job.StorageKey, job.Size, job.Counts = key, len(blob), counts
+	return nil
+}
+
+// expire deletes the files of exports past their expiry.
+func (ex *Exporter) expire(ctx context.Context) {
+	if !ex.leader.leads() || ex.srv.paused(ctx) {
+		return
+	}
+	jobs, err := ex.srv.db.GetExpiredExportJobs(ctx, ex.now())
+	if err != nil {
+		log.Printf("exporter: list expired: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		if job.StorageKey != "" && !ex.deleteFile(ctx, job) {
+			continue
+		}
+		if err := ex.srv.db.ExpireExportJob(ctx, job.ID); err != nil {
+			log.Printf("exporter: expire %s: %v", job.ID.Hex(), err)
+		}
+	}
+}
+
+// deleteFile deletes the blobs of an export's file, and reports whether
+// they are all gone.
+func (ex *Exporter) deleteFile(ctx context.Context, job db.ExportJob) bool {
+	for _, key := range exportKeys(job) {
+		if err := ex.srv.storage.Delete(ctx, key); err != nil {
+			log.Printf("exporter: delete file of %s: %v", job.ID.Hex(), err)
+			return false
+		}
+	}
+	return true
+}
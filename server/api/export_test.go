@@ -0,0 +1,199 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mulamail/db"
+	"mulamail/vault"
+)
+
+func TestExport_BuildDownloadExpire(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	newTestVault(t, server)
+	storage := server.storage
+	router := NewRouter(mockDB, server.solana, storage, server.cfg)
+	ctx := context.Background()
+
+	passEnc, _ := server.cfg.EncryptionKey.EncryptString("pop3-password")
+	mockDB.CreateMailAccount(ctx, &db.MailAccount{
+		OwnerPubKey: "owner", AccountEmail: "me@example.com",
+		POP3: db.POP3Settings{Host: "pop.example.com", Port: 995, User: "me", PassEnc: passEnc},
+	})
+	fc, _ := vault.NewFieldCipher(server.cfg.EncryptionKey)
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, uid := range []string{"1", "2"} {
+		m, _ := encryptPreview(fc, &db.CachedMessage{
+			OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: uid,
+			From: "Alice <alice@example.com>", Subject: "Hello " + uid, Date: date,
+		})
+		mockDB.UpsertCachedMessage(ctx, m)
+	}
+	raw := "From: Alice <alice@example.com>\r\nSubject: Hello 1\r\n\r\nFrom the start\r\n"
+	storage.Put(ctx, messageCacheKey("owner", "me@example.com", "1"), []byte(raw))
+	mockDB.CreateSentMessage(ctx, &db.SentMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", To: []string{"bob@example.org"}, Subject: "Hi Bob"})
+	mockDB.CreateSentMessage(ctx, &db.SentMessage{OwnerPubKey: "other", AccountEmail: "x@example.com", Subject: "Not exported"})
+	ct, _ := encryptContact(fc, "owner", "bob@example.org", "Bob")
+	mockDB.CreateContact(ctx, ct)
+
+	do := func(method, path string, body any) *httptest.ResponseRecorder {
+		var rd io.Reader
+		if body != nil {
+			b, _ := json.Marshal(body)
+			rd = bytes.NewReader(b)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, rd))
+		return w
+	}
+
+	const passphrase = "correct horse battery staple"
+	w := do("POST", "/api/v1/export?owner=owner", exportRequest{Passphrase: passphrase})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body.String())
+	}
+	var job db.ExportJob
+	json.NewDecoder(w.Body).Decode(&job)
+	if job.Status != db.ExportPending {
+		t.Errorf("new export: want pending, got %q", job.Status)
+	}
+	if strings.Contains(w.Body.String(), "passphrase") {
+		t.Errorf("job response exposes the passphrase: %s", w.Body.String())
+	}
+
+	w = do("POST", "/api/v1/export?owner=owner", exportRequest{Passphrase: "another long passphrase"})
+	var again db.ExportJob
+	json.NewDecoder(w.Body).Decode(&again)
+	if again.ID != job.ID {
+		t.Errorf("export while one is queued: want job %s, got %s", job.ID.Hex(), again.ID.Hex())
+	}
+
+	base := "/api/v1/export/" + job.ID.Hex()
+	if w := do("GET", base+"/download?owner=owner", nil); w.Code != http.StatusConflict {
+		t.Errorf("download before build: want 409, got %d", w.Code)
+	}
+	if w := do("GET", base+"/status?owner=someone-else", nil); w.Code != http.StatusNotFound {
+		t.Errorf("status of another owner's export: want 404, got %d", w.Code)
+	}
+
+	now := time.Now()
+	ex := &Exporter{srv: server, worker: "w1", ttl: time.Hour, maxAttempts: exportMaxAttempts, now: func() time.Time { return now }}
+	ex.processQueued(ctx)
+
+	w = do("GET", base+"/status?owner=owner", nil)
+	json.NewDecoder(w.Body).Decode(&job)
+	if job.Status != db.ExportDone || job.Counts["messages"] != 2 || job.Counts["raw_messages"] != 1 || job.Counts["sent"] != 1 {
+		t.Fatalf("after build: unexpected job %+v", job)
+	}
+	if mockDB.Exports[0].PassphraseEnc != "" {
+		t.Error("passphrase kept after the archive was built")
+	}
+
+	w = do("GET", base+"/download?owner=owner", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: status %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := vault.DecryptWithPassphrase("another long passphrase", w.Body.Bytes()); err == nil {
+		t.Error("archive decrypted with the passphrase of the ignored request")
+	}
+	archive, err := vault.DecryptWithPassphrase(passphrase, w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("decrypt archive: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	for _, name := range []string{"manifest.json", "identities.json", "accounts.json", "messages.json", "sent.json", "contacts.json", "mbox/me@example.com.mbox"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("archive is missing %s", name)
+		}
+	}
+	if strings.Contains(files["accounts.json"], "pass") || !strings.Contains(files["accounts.json"], "pop.example.com") {
+		t.Errorf("accounts.json: %s", files["accounts.json"])
+	}
+	if !strings.Contains(files["messages.json"], "Hello 2") || strings.Contains(files["sent.json"], "Not exported") {
+		t.Errorf("unexpected messages.json or sent.json:\n%s\n%s", files["messages.json"], files["sent.json"])
+	}
+	if !strings.Contains(files["contacts.json"], "bob@example.org") {
+		t.Errorf("contacts.json: %s", files["contacts.json"])
+	}
+	wantMbox := "From alice@example.com Wed May  1 12:00:00 2024\n" +
+		"From: Alice <alice@example.com>\nSubject: Hello 1\n\n>From the start\n\n"
+	if files["mbox/me@example.com.mbox"] != wantMbox {
+		t.Errorf("mbox:\nwant %q\n got %q", wantMbox, files["mbox/me@example.com.mbox"])
+	}
+
+	now = now.Add(2 * time.Hour)
+	ex.expire(ctx)
+	if w := do("GET", base+"/download?owner=owner", nil); w.Code != http.StatusGone {
+		t.Errorf("download after expiry: want 410, got %d", w.Code)
+	}
+	if _, err := storage.Get(ctx, job.StorageKey); err == nil {
+		t.Error("expired archive still in storage")
+	}
+}
+
+func TestExport_FailedAfterMaxAttempts(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.storage = failingStorage{}
+	ctx := context.Background()
+
+	passphraseEnc, _ := server.cfg.EncryptionKey.EncryptString("a long enough passphrase")
+	mockDB.CreateExportJob(ctx, &db.ExportJob{OwnerPubKey: "owner", PassphraseEnc: passphraseEnc})
+
+	ex := &Exporter{srv: server, worker: "w1", ttl: time.Hour, maxAttempts: 2, now: time.Now}
+	ex.processQueued(ctx)
+	if got := mockDB.Exports[0]; got.Status != db.ExportFailed || got.Attempts != 2 || got.LastError == "" || got.PassphraseEnc != "" {
+		t.Errorf("after repeated failures: unexpected job %+v", got)
+	}
+}
+
+func TestExport_RejectsShortPassphrase(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	w := httptest.NewRecorder()
+	body, _ := json.Marshal(exportRequest{Passphrase: "too short"})
+	server.createExport(w, httptest.NewRequest("POST", "/api/v1/export?owner=owner", bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("short passphrase: want 400, got %d", w.Code)
+	}
+	if len(mockDB.Exports) != 0 {
+		t.Error("export queued despite the short passphrase")
+	}
+}
+
+// failingStorage is a vault that refuses every write.
+type failingStorage struct{}
+
+func (failingStorage) Put(ctx context.Context, key string, data []byte) error {
+	return errors.New("storage unavailable")
+}
+func (failingStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, errors.New("storage unavailable")
+}
+func (failingStorage) Delete(ctx context.Context, key string) error { return nil }
+func (failingStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, nil
+}
+func (failingStorage) ListPage(ctx context.Context, prefix string, limit int, token string) ([]string, string, error) {
+	return nil, "", nil
+}
+func (failingStorage) Stat(ctx context.Context, key string) (vault.ObjectInfo, error) {
+	return vault.ObjectInfo{}, errors.New("storage unavailable")
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakePOP3 is a minimal in-process POP3 server for handler tests.  Messages
+// are keyed by their 1-based index; an index present in failTop answers TOP
+// with -ERR, and one in dropTop hangs up instead.  With noUIDL set the
+// server rejects UIDL.  CAPA is answered with capa, or rejected when capa
+// is nil.  TOP returns the headers and the body lines asked for.  Every
+// TOP and RETR is counted in topped and retrieved.  Messages marked with DELE are recorded in deleted when the
+// session ends with QUIT.
+type fakePOP3 struct {
+	messages   map[int]string
+	failTop    map[int]bool
+	dropTop    map[int]bool
+	failList   bool
+	noUIDL     bool
+	capa       []string
+	rejectPass bool // answer PASS with an -ERR that names the user
+	echoPass   bool // and the password too
+	topped     atomic.Int32
+	retrieved  atomic.Int32
+
+	mu      sync.Mutex
+	deleted []int
+}
+
+// deletedIDs returns the messages deleted by completed sessions.
+func (f *fakePOP3) deletedIDs() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.deleted...)
+}
+
+// start listens on a loopback port and returns its host and port.
+func (f *fakePOP3) start(t *testing.T) (string, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func (f *fakePOP3) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "+OK fake POP3 ready\r\n")
+	var marked []int
+	var user string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(strings.TrimSpace(line))
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "USER":
+			user = fields[len(fields)-1]
+			fmt.Fprintf(conn, "+OK\r\n")
+		case "PASS":
+			if f.echoPass {
+				fmt.Fprintf(conn, "-ERR [AUTH] invalid password %s for %s\r\n", strings.Join(fields[1:], " "), user)
+				continue
+			}
+			if f.rejectPass {
+				fmt.Fprintf(conn, "-ERR [AUTH] invalid password for %s\r\n", user)
+				continue
+			}
+			fmt.Fprintf(conn, "+OK\r\n")
+		case "LIST":
+			if f.failList {
+				fmt.Fprintf(conn, "-ERR mailbox locked\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "+OK\r\n")
+			for i := 1; i <= len(f.messages); i++ {
+				fmt.Fprintf(conn, "%d %d\r\n", i, len(f.messages[i]))
+			}
+			fmt.Fprintf(conn, ".\r\n")
+		case "CAPA":
+			if f.capa == nil {
+				fmt.Fprintf(conn, "-ERR unknown command\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "+OK\r\n%s\r\n.\r\n", strings.Join(f.capa, "\r\n"))
+		case "UIDL":
+			if f.noUIDL {
+				fmt.Fprintf(conn, "-ERR unknown command\r\n")
+				continue
+			}
+			if len(fields) == 1 {
+				fmt.Fprintf(conn, "+OK\r\n")
+				for i := 1; i <= len(f.messages); i++ {
+					fmt.Fprintf(conn, "%d uid-%d\r\n", i, i)
+				}
+				fmt.Fprintf(conn, ".\r\n")
+				continue
+			}
+			id, _ := strconv.Atoi(fields[1])
+			if _, ok := f.messages[id]; !ok {
+				fmt.Fprintf(conn, "-ERR no such message\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "+OK %d uid-%d\r\n", id, id)
+		case "TOP", "RETR":
+			id, _ := strconv.Atoi(fields[1])
+			msg, ok := f.messages[id]
+			if fields[0] == "TOP" && f.dropTop[id] {
+				return
+			}
+			if !ok || (fields[0] == "TOP" && f.failTop[id]) {
+				fmt.Fprintf(conn, "-ERR no such message\r\n")
+				continue
+			}
+			if fields[0] == "RETR" {
+				f.retrieved.Add(1)
+			} else {
+				f.topped.Add(1)
+				if len(fields) > 2 {
+					n, _ := strconv.Atoi(fields[2])
+					msg = topLines(msg, n)
+				}
+			}
+			fmt.Fprintf(conn, "+OK\r\n%s\r\n.\r\n", msg)
+		case "DELE":
+			id, _ := strconv.Atoi(fields[1])
+			if _, ok := f.messages[id]; !ok {
+				fmt.Fprintf(conn, "-ERR no such message\r\n")
+				continue
+			}
+			marked = append(marked, id)
+			fmt.Fprintf(conn, "+OK message deleted\r\n")
+		case "QUIT":
+			f.mu.Lock()
+			f.deleted = append(f.deleted, marked...)
+			f.mu.Unlock()
+			fmt.Fprintf(conn, "+OK bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+// topLines cuts msg to its headers and first n body lines, as TOP does.
+func topLines(msg string, n int) string {
+	head, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		return msg
+	}
+	lines := strings.Split(body, "\r\n")
+	return head + "\r\n\r\n" + strings.Join(lines[:min(n, len(lines))], "\r\n")
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTP is a minimal in-process SMTP server for handler tests.  It
+// advertises ehlo as EHLO extensions, refuses STARTTLS, accepts any AUTH, and
+// records every envelope and message body it receives.
+type fakeSMTP struct {
+	ehlo          []string // extension lines advertised after the greeting line
+	dataDone      string   // final reply to the end of DATA; defaults to a queued reply
+	mailFromReply string   // reply to MAIL FROM; defaults to OK
+	busySessions  int      // the first busySessions connections are greeted with 421
+	dropAfterData bool     // hang up instead of replying to the end of DATA
+	rcptReplies   []string // replies to the first RCPT commands, across sessions; later ones are accepted
+
+	mu       sync.Mutex
+	sessions int
+	commands []string
+	messages []string
+}
+
+func (f *fakeSMTP) start(t *testing.T) (string, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	f.mu.Lock()
+	f.sessions++
+	busy := f.sessions <= f.busySessions
+	f.mu.Unlock()
+	if busy {
+		fmt.Fprintf(conn, "421 4.3.2 too busy, try again later\r\n")
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 fake ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		var rcptReply string
+		if verb == "RCPT" {
+			rcptReply = f.nextRcptReply()
+		}
+		switch {
+		case verb == "EHLO":
+			if len(f.ehlo) == 0 {
+				fmt.Fprintf(conn, "250 fake\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "250-fake\r\n")
+			for i, ext := range f.ehlo {
+				sep := "-"
+				if i == len(f.ehlo)-1 {
+					sep = " "
+				}
+				fmt.Fprintf(conn, "250%s%s\r\n", sep, ext)
+			}
+		case verb == "HELO":
+			fmt.Fprintf(conn, "250 fake\r\n")
+		case verb == "STARTTLS":
+			fmt.Fprintf(conn, "454 TLS not available\r\n")
+		case verb == "AUTH":
+			fmt.Fprintf(conn, "235 2.7.0 Authentication successful\r\n")
+		case verb == "MAIL" && f.mailFromReply != "":
+			fmt.Fprintf(conn, "%s\r\n", f.mailFromReply)
+		case verb == "RCPT" && rcptReply != "":
+			fmt.Fprintf(conn, "%s\r\n", rcptReply)
+		case verb == "MAIL" || verb == "RCPT":
+			fmt.Fprintf(conn, "250 2.1.0 OK\r\n")
+		case verb == "DATA":
+			fmt.Fprintf(conn, "354 go ahead\r\n")
+			var body []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				l = strings.TrimRight(l, "\r\n")
+				if l == "." {
+					break
+				}
+				body = append(body, strings.TrimPrefix(l, "."))
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, strings.Join(body, "\r\n"))
+			f.mu.Unlock()
+			if f.dropAfterData {
+				return
+			}
+			reply := f.dataDone
+			if reply == "" {
+				reply = "250 2.0.0 Ok: queued as ABC123"
+			}
+			fmt.Fprintf(conn, "%s\r\n", reply)
+		case verb == "QUIT":
+			fmt.Fprintf(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "502 command not implemented\r\n")
+		}
+	}
+}
+
+// nextRcptReply returns the scripted reply to the next RCPT command, or ""
+// once the script is used up.
+func (f *fakeSMTP) nextRcptReply() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.rcptReplies) == 0 {
+		return ""
+	}
+	reply := f.rcptReplies[0]
+	f.rcptReplies = f.rcptReplies[1:]
+	return reply
+}
+
+// sessionCount returns how many connections have been accepted.
+func (f *fakeSMTP) sessionCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sessions
+}
+
+// sent returns a copy of every message body received so far.
+func (f *fakeSMTP) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+// received returns a copy of every command line received so far.
+func (f *fakeSMTP) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
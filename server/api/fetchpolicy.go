@@ -0,0 +1,313 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+// Account fetch policies.  Under either delete policy the archive worker
+// archives the account's cached messages in the vault and removes them from
+// the POP3 server once the archive has been read back.  Inbox fetches never
+// apply a policy: they leave the mailbox as they found it.
+const (
+	fetchLeave              = "leave"                // never delete from the server (the default)
+	fetchDeleteAfterArchive = "delete_after_archive" // delete as soon as the message is archived
+	fetchDeleteAfterDays    = "delete_after_days:"   // followed by N: delete N days after archiving
+
+	maxFetchPolicyDays = 3650
+)
+
+// fetchPolicy is a parsed MailAccount.FetchPolicy.
+type fetchPolicy struct {
+	delete bool
+	after  time.Duration // how long an archived message stays on the server
+}
+
+// parseFetchPolicy parses a fetch policy; the empty string means "leave".
+func parseFetchPolicy(s string) (fetchPolicy, error) {
+	switch {
+	case s == "" || s == fetchLeave:
+		return fetchPolicy{}, nil
+	case s == fetchDeleteAfterArchive:
+		return fetchPolicy{delete: true}, nil
+	case strings.HasPrefix(s, fetchDeleteAfterDays):
+		n, err := strconv.Atoi(strings.TrimPrefix(s, fetchDeleteAfterDays))
+		if err != nil || n < 1 || n > maxFetchPolicyDays {
+			return fetchPolicy{}, fmt.Errorf("fetch_policy: days must be between 1 and %d", maxFetchPolicyDays)
+		}
+		return fetchPolicy{delete: true, after: time.Duration(n) * 24 * time.Hour}, nil
+	default:
+		return fetchPolicy{}, fmt.Errorf("fetch_policy must be %q, %q or %q", fetchLeave, fetchDeleteAfterArchive, fetchDeleteAfterDays+"N")
+	}
+}
+
+// policyDeletion is a message a fetch policy removes from the POP3 server.
+type policyDeletion struct {
+	ID         int       `json:"id"`
+	UID        string    `json:"uid"`
+	ArchivedAt time.Time `json:"archived_at,omitzero"` // zero for a message the next fetch archives first
+}
+
+// applyFetchPolicy applies policy to acc over client's session.  Messages
+// with a cached preview are archived in the vault if they are not already,
+// at the pace of pace, and those the policy no longer wants on the server
+// are marked with DELE; the server removes them when the session ends with
+// QUIT.  Only previewed messages are considered, since the vault collector
+// keeps exactly those archives.  A message is deleted only once its archive
+// has been read back from the vault and decrypted; any doubt leaves it on
+// the server.  With dryRun nothing is archived or deleted and the result
+// lists what the next pass would delete.
+func (s *Server) applyFetchPolicy(ctx context.Context, client *mail.POP3Client, acc *db.MailAccount, policy fetchPolicy, pace *pacer, dryRun bool) ([]policyDeletion, error) {
+	if !policy.delete || s.storage == nil {
+		return nil, nil
+	}
+	// Without UIDL there is no stable key to archive under, so nothing is
+	// deleted.
+	uids, err := client.UIDLs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := s.db.GetCachedMessagesByOwner(ctx, acc.OwnerPubKey)
+	if err != nil {
+		return nil, err
+	}
+	previewed := make(map[string]bool)
+	for _, m := range cached {
+		if m.AccountEmail == acc.AccountEmail {
+			previewed[m.UID] = true
+		}
+	}
+
+	ids := make([]int, 0, len(uids))
+	for id, uid := range uids {
+		if previewed[uid] {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	var deletions []policyDeletion
+	for _, id := range ids {
+		uid := uids[id]
+		key := messageCacheKey(acc.OwnerPubKey, acc.AccountEmail, uid)
+		archivedAt, err := s.verifiedArchiveTime(ctx, key)
+		switch {
+		case err == nil:
+		case dryRun:
+			if policy.after == 0 {
+				deletions = append(deletions, policyDeletion{ID: id, UID: uid})
+			}
+			continue
+		default:
+			if err := pace.wait(ctx); err != nil {
+				return deletions, err
+			}
+			if archivedAt, err = s.archiveMessage(ctx, client, key, id); err != nil {
+				log.Printf("[%s] fetch policy: archive message %d of %s: %v", requestID(ctx), id, acc.AccountEmail, err)
+				continue
+			}
+		}
+		if time.Since(archivedAt) < policy.after {
+			continue
+		}
+		if !dryRun {
+			if err := client.Dele(ctx, id); err != nil {
+				return deletions, err
+			}
+		}
+		deletions = append(deletions, policyDeletion{ID: id, UID: uid, ArchivedAt: archivedAt})
+	}
+	return deletions, nil
+}
+
+// verifiedArchiveTime returns when the archive at key was written, provided
+// it can be read back and decrypted.
+func (s *Server) verifiedArchiveTime(ctx context.Context, key string) (time.Time, error) {
+	info, err := s.storage.Stat(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, err := s.storage.Get(ctx, key); err != nil {
+		return time.Time{}, err
+	}
+	return info.Modified, nil
+}
+
+// archiveMessage RETRieves message id, stores it at key and reads it back
+// to check that the stored copy decrypts to the message.
+func (s *Server) archiveMessage(ctx context.Context, client *mail.POP3Client, key string, id int) (time.Time, error) {
+	raw, err := client.Retrieve(ctx, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := s.storage.Put(ctx, key, []byte(raw)); err != nil {
+		return time.Time{}, err
+	}
+	got, err := s.storage.Get(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !bytes.Equal(got, []byte(raw)) {
+		return time.Time{}, errors.New("archive does not match the message")
+	}
+	return time.Now(), nil
+}
+
+// applyFetchPolicies is the archive worker's periodic pass over the
+// accounts with a delete policy: each is applied in a POP3 session of its
+// own, whose QUIT removes the marked messages.  Failures are logged and
+// leave the account's mail on its server until the next pass.
+func (ar *Archiver) applyFetchPolicies(ctx context.Context) {
+	accounts, err := ar.srv.db.GetAllMailAccounts(ctx)
+	if err != nil {
+		log.Printf("fetch policy: list accounts: %v", err)
+		return
+	}
+	for i := range accounts {
+		if ctx.Err() != nil || !ar.leader.leads() {
+			return
+		}
+		acc := &accounts[i]
+		policy, err := parseFetchPolicy(acc.FetchPolicy)
+		if err != nil {
+			log.Printf("fetch policy %s: %v", acc.AccountEmail, err)
+			continue
+		}
+		if !policy.delete {
+			continue
+		}
+		deleted, err := ar.commitFetchPolicy(ctx, acc, policy)
+		if err != nil {
+			log.Printf("fetch policy %s: %v", acc.AccountEmail, err)
+		}
+		if deleted > 0 {
+			log.Printf("fetch policy %s: deleted %d archived messages from the server", acc.AccountEmail, deleted)
+		}
+	}
+}
+
+// commitFetchPolicy applies policy to acc in a new session and ends it,
+// reporting how many messages the server was asked to delete.
+func (ar *Archiver) commitFetchPolicy(ctx context.Context, acc *db.MailAccount, policy fetchPolicy) (int, error) {
+	client, err := ar.srv.dialPOP3(ctx, acc)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	deleted, err := ar.srv.applyFetchPolicy(ctx, client, acc, policy, ar.pace, false)
+	return len(deleted), err
+}
+
+// setFetchPolicyRequest is the body of PUT /api/v1/accounts/fetch-policy.
+type setFetchPolicyRequest struct {
+	OwnerPubKey  string `json:"owner_pubkey"`
+	AccountEmail string `json:"account_email"`
+	FetchPolicy  string `json:"fetch_policy"`
+	Confirm      bool   `json:"confirm"` // required for a policy that deletes mail
+	DryRun       bool   `json:"dry_run"` // report what the next pass would delete; change nothing
+}
+
+// fetchPolicyResponse reports the stored policy, or for a dry run, what it
+// would delete.
+type fetchPolicyResponse struct {
+	AccountEmail string           `json:"account_email"`
+	FetchPolicy  string           `json:"fetch_policy"`
+	DryRun       bool             `json:"dry_run,omitempty"`
+	WouldDelete  []policyDeletion `json:"would_delete,omitempty"`
+}
+
+// PUT /api/v1/accounts/fetch-policy
+//
+// Sets whether fetched mail is deleted from the POP3 server once archived.
+// The archive worker applies delete policies every
+// FETCH_POLICY_INTERVAL_MINUTES.  A policy that deletes mail is only stored
+// when the request sets "confirm".  With "dry_run" the policy is not
+// stored; the server logs in and reports which messages the next pass would
+// delete under it.
+//
+// Request: { "owner_pubkey": "...", "account_email": "...", "fetch_policy": "delete_after_days:30", "confirm": true }
+func (s *Server) setFetchPolicy(w http.ResponseWriter, r *http.Request) {
+	var req setFetchPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	owner, ok := actingOwner(r, req.OwnerPubKey)
+	if !ok {
+		writeError(w, http.StatusForbidden, errKeyOwner)
+		return
+	}
+	req.OwnerPubKey = owner
+	if req.FetchPolicy == "" {
+		req.FetchPolicy = fetchLeave
+	}
+	policy, err := parseFetchPolicy(req.FetchPolicy)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	acc, err := s.db.GetMailAccount(r.Context(), req.OwnerPubKey, req.AccountEmail)
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	if req.DryRun {
+		client, err := s.dialPOP3(r.Context(), acc)
+		if err != nil {
+			writeMailError(w, r, http.StatusServiceUnavailable, "", err)
+			return
+		}
+		defer client.Close()
+		deletions, err := s.applyFetchPolicy(r.Context(), client, acc, policy, nil, true)
+		if err != nil {
+			writeMailError(w, r, http.StatusBadGateway, "", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, fetchPolicyResponse{
+			AccountEmail: acc.AccountEmail,
+			FetchPolicy:  req.FetchPolicy,
+			DryRun:       true,
+			WouldDelete:  deletions,
+		})
+		return
+	}
+
+	if policy.delete && !req.Confirm {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("fetch_policy %q deletes archived mail from the POP3 server; "+
+			"preview it with \"dry_run\" and resend with \"confirm\": true", req.FetchPolicy))
+		return
+	}
+	unlock, err := s.lockOwner(r.Context(), req.OwnerPubKey)
+	if err != nil {
+		writeLockError(w, r, err)
+		return
+	}
+	defer unlock()
+	err = s.db.UpdateMailAccountProfile(r.Context(), req.OwnerPubKey, req.AccountEmail, db.MailAccountProfile{FetchPolicy: &req.FetchPolicy})
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fetchPolicyResponse{AccountEmail: acc.AccountEmail, FetchPolicy: req.FetchPolicy})
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"mulamail/db/dbtest"
+	"mulamail/vault"
+)
+
+func TestParseFetchPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    fetchPolicy
+		wantErr bool
+	}{
+		{"", fetchPolicy{}, false},
+		{"leave", fetchPolicy{}, false},
+		{"delete_after_archive", fetchPolicy{delete: true}, false},
+		{"delete_after_days:30", fetchPolicy{delete: true, after: 30 * 24 * time.Hour}, false},
+		{"delete_after_days:0", fetchPolicy{}, true},
+		{"delete_after_days:x", fetchPolicy{}, true},
+		{"delete_after_days:3651", fetchPolicy{}, true},
+		{"delete", fetchPolicy{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseFetchPolicy(tt.policy)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%q: want %+v (error %t), got %+v, %v", tt.policy, tt.want, tt.wantErr, got, err)
+		}
+	}
+}
+
+// agedStorage reports every object as modified age ago.
+type agedStorage struct {
+	vault.Storage
+	age time.Duration
+}
+
+func (s agedStorage) Stat(ctx context.Context, key string) (vault.ObjectInfo, error) {
+	info, err := s.Storage.Stat(ctx, key)
+	info.Modified = time.Now().Add(-s.age)
+	return info, err
+}
+
+// corruptStorage hands back data that does not decrypt.
+type corruptStorage struct {
+	vault.Storage
+}
+
+func (corruptStorage) Get(context.Context, string) ([]byte, error) {
+	return []byte("not an archive"), nil
+}
+
+// setupFetchPolicy starts a two-message POP3 server for an account with the
+// given fetch policy and gives the server local vault storage, which it
+// returns.
+func setupFetchPolicy(t *testing.T, policy string) (*Server, *dbtest.Mock, *fakePOP3, *vault.LocalStorage) {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	local := newTestVault(t, server)
+
+	fake := &fakePOP3{messages: map[int]string{
+		1: "From: a@example.com\r\nSubject: one\r\n\r\nfirst",
+		2: "From: b@example.com\r\nSubject: two\r\n\r\nsecond",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	mockDB.Accounts["owner"][0].FetchPolicy = policy
+	return server, mockDB, fake, local
+}
+
+func fetchInboxCode(server *Server) int {
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil))
+	return w.Code
+}
+
+// applyPolicies caches the account's previews with an inbox fetch, then
+// runs the archive worker's fetch policy pass.
+func applyPolicies(t *testing.T, server *Server) {
+	t.Helper()
+	if code := fetchInboxCode(server); code != http.StatusOK {
+		t.Fatalf("inbox: want %d, got %d", http.StatusOK, code)
+	}
+	newTestArchiver(server).applyFetchPolicies(context.Background())
+}
+
+func TestFetchInbox_NeverAppliesPolicy(t *testing.T) {
+	server, _, fake, _ := setupFetchPolicy(t, fetchDeleteAfterArchive)
+	for range 2 {
+		if code := fetchInboxCode(server); code != http.StatusOK {
+			t.Fatalf("status code: want %d, got %d", http.StatusOK, code)
+		}
+	}
+	if got := fake.deletedIDs(); len(got) != 0 {
+		t.Errorf("an inbox fetch deleted %v", got)
+	}
+	if n := fake.retrieved.Load(); n != 0 {
+		t.Errorf("an inbox fetch archived messages: RETR count %d", n)
+	}
+}
+
+func TestFetchPolicies_LeaveDeletesNothing(t *testing.T) {
+	server, _, fake, _ := setupFetchPolicy(t, "")
+	applyPolicies(t, server)
+	if got := fake.deletedIDs(); len(got) != 0 {
+		t.Errorf("deleted %v under the leave policy", got)
+	}
+	if n := fake.retrieved.Load(); n != 0 {
+		t.Errorf("RETR count: want 0, got %d", n)
+	}
+}
+
+func TestFetchPolicies_DeleteAfterArchive(t *testing.T) {
+	server, _, fake, _ := setupFetchPolicy(t, fetchDeleteAfterArchive)
+	applyPolicies(t, server)
+	if got := fake.deletedIDs(); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("deleted: want [1 2], got %v", got)
+	}
+	for id, uid := range map[int]string{1: "uid-1", 2: "uid-2"} {
+		raw, err := server.storage.Get(context.Background(), messageCacheKey("owner", "me@example.com", uid))
+		if err != nil || string(raw) != fake.messages[id] {
+			t.Errorf("archive of message %d: got %q, %v", id, raw, err)
+		}
+	}
+}
+
+func TestFetchPolicies_DeleteAfterDays(t *testing.T) {
+	server, _, fake, _ := setupFetchPolicy(t, "delete_after_days:7")
+	applyPolicies(t, server)
+	if got := fake.deletedIDs(); len(got) != 0 {
+		t.Errorf("deleted %v before the archives were 7 days old", got)
+	}
+	if n := fake.retrieved.Load(); n != 2 {
+		t.Errorf("RETR count: want 2 (both archived), got %d", n)
+	}
+
+	server.storage = agedStorage{Storage: server.storage, age: 8 * 24 * time.Hour}
+	applyPolicies(t, server)
+	if got := fake.deletedIDs(); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("deleted: want [1 2], got %v", got)
+	}
+	if n := fake.retrieved.Load(); n != 2 {
+		t.Errorf("existing archives must not be fetched again: RETR count %d", n)
+	}
+}
+
+func TestFetchPolicies_UnreadableArchiveIsNotDeleted(t *testing.T) {
+	server, _, fake, local := setupFetchPolicy(t, fetchDeleteAfterArchive)
+	server.storage = encryptStorage(t, server, corruptStorage{Storage: local})
+	applyPolicies(t, server)
+	if got := fake.deletedIDs(); len(got) != 0 {
+		t.Errorf("deleted %v although the archives could not be read back", got)
+	}
+}
+
+func TestSetFetchPolicy(t *testing.T) {
+	server, mockDB, fake, _ := setupFetchPolicy(t, "")
+	put := func(payload map[string]any) (int, fetchPolicyResponse) {
+		t.Helper()
+		payload["owner_pubkey"], payload["account_email"] = "owner", "me@example.com"
+		body, _ := json.Marshal(payload)
+		w := httptest.NewRecorder()
+		server.setFetchPolicy(w, httptest.NewRequest("PUT", "/api/v1/accounts/fetch-policy", bytes.NewBuffer(body)))
+		var resp fetchPolicyResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+	policy := func() string { return mockDB.Accounts["owner"][0].FetchPolicy }
+
+	if code, _ := put(map[string]any{"fetch_policy": "delete_after_weeks:2", "confirm": true}); code != http.StatusBadRequest {
+		t.Errorf("invalid policy: want %d, got %d", http.StatusBadRequest, code)
+	}
+	if code, _ := put(map[string]any{"fetch_policy": fetchDeleteAfterArchive}); code != http.StatusBadRequest || policy() != "" {
+		t.Errorf("unconfirmed: want %d and no change, got %d, %q", http.StatusBadRequest, code, policy())
+	}
+
+	// Previews are cached by a first fetch; the dry run then reports both.
+	if code := fetchInboxCode(server); code != http.StatusOK {
+		t.Fatalf("inbox: want %d, got %d", http.StatusOK, code)
+	}
+	code, resp := put(map[string]any{"fetch_policy": fetchDeleteAfterArchive, "dry_run": true})
+	if code != http.StatusOK || !resp.DryRun || len(resp.WouldDelete) != 2 {
+		t.Fatalf("dry run: unexpected %d %+v", code, resp)
+	}
+	if policy() != "" || len(fake.deletedIDs()) != 0 || fake.retrieved.Load() != 0 {
+		t.Errorf("a dry run must change nothing: policy %q, deleted %v, RETR %d", policy(), fake.deletedIDs(), fake.retrieved.Load())
+	}
+
+	if code, _ := put(map[string]any{"fetch_policy": fetchDeleteAfterArchive, "confirm": true}); code != http.StatusOK || policy() != fetchDeleteAfterArchive {
+		t.Errorf("confirmed: want %d and the policy stored, got %d, %q", http.StatusOK, code, policy())
+	}
+	if code, _ := put(map[string]any{"fetch_policy": fetchLeave}); code != http.StatusOK || policy() != fetchLeave {
+		t.Errorf("leave needs no confirmation: got %d, %q", code, policy())
+	}
+}
@@ -0,0 +1,229 @@
+//go:build testfixtures
+
+package api
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+// The fixture endpoints let front-end integration tests load deterministic
+// data without talking to MongoDB themselves.  They are compiled only with
+// -tags testfixtures, and even then registered only when ENV=test; every
+// other build gets the empty fixtureRoutes of nofixtures.go.
+
+// testEnv is the ENV value under which the fixture endpoints are served.
+const testEnv = "test"
+
+// fixtureRoutes returns the fixture endpoints, or none outside ENV=test.
+func (s *Server) fixtureRoutes() []route {
+	if s.cfg.Env != testEnv {
+		log.Printf("api: fixture endpoints not registered: ENV is %q, not %q", s.cfg.Env, testEnv)
+		return nil
+	}
+	return []route{
+		{method: "POST", path: "/api/test/seed", summary: "Load a declarative fixture (testfixtures builds with ENV=test only)", handler: s.seedFixture,
+			request:   fixture{},
+			responses: map[int]any{http.StatusCreated: seedResponse{}},
+			errors:    []int{http.StatusBadRequest, http.StatusConflict, http.StatusInternalServerError}},
+		{method: "POST", path: "/api/test/reset", summary: "Delete every document in the database (testfixtures builds with ENV=test only)", handler: s.resetFixtures,
+			responses: map[int]any{http.StatusNoContent: nil},
+			errors:    []int{http.StatusInternalServerError}},
+	}
+}
+
+// fixture is the body of a seed request.  Accounts carry plaintext
+// passwords, which are encrypted as addAccount would, and messages are
+// cached previews, encrypted as a fetch would cache them.
+type fixture struct {
+	Identities []fixtureIdentity `json:"identities"`
+	Accounts   []fixtureAccount  `json:"accounts"`
+	Messages   []fixtureMessage  `json:"messages"`
+}
+
+type fixtureIdentity struct {
+	Email  string `json:"email"`
+	PubKey string `json:"pubkey"`
+	TxHash string `json:"tx_hash"`
+}
+
+type fixtureAccount struct {
+	OwnerPubKey  string         `json:"owner_pubkey"`
+	AccountEmail string         `json:"account_email"`
+	DisplayName  string         `json:"display_name"`
+	Signature    string         `json:"signature"`
+	POP3         serverSettings `json:"pop3"`
+	SMTP         serverSettings `json:"smtp"`
+}
+
+type fixtureMessage struct {
+	OwnerPubKey  string    `json:"owner_pubkey"`
+	AccountEmail string    `json:"account_email"`
+	UID          string    `json:"uid"`
+	From         string    `json:"from"`
+	Subject      string    `json:"subject"`
+	Date         time.Time `json:"date"`
+	Size         int       `json:"size"`
+}
+
+// seedResponse counts what a seed request loaded.
+type seedResponse struct {
+	Identities int `json:"identities"`
+	Accounts   int `json:"accounts"`
+	Messages   int `json:"messages"`
+}
+
+// validate checks the whole fixture before anything is written.
+func (f *fixture) validate() error {
+	for i, id := range f.Identities {
+		if err := mail.ValidateAddress(id.Email); err != nil {
+			return fmt.Errorf("identities[%d].email: %w", i, err)
+		}
+		if id.PubKey == "" {
+			return fmt.Errorf("identities[%d]: pubkey required", i)
+		}
+	}
+	for i, acc := range f.Accounts {
+		if acc.OwnerPubKey == "" {
+			return fmt.Errorf("accounts[%d]: owner_pubkey required", i)
+		}
+		if err := mail.ValidateAddress(acc.AccountEmail); err != nil {
+			return fmt.Errorf("accounts[%d].account_email: %w", i, err)
+		}
+	}
+	for i, m := range f.Messages {
+		if m.OwnerPubKey == "" || m.AccountEmail == "" || m.UID == "" {
+			return fmt.Errorf("messages[%d]: owner_pubkey, account_email and uid required", i)
+		}
+	}
+	return nil
+}
+
+// POST /api/test/seed
+//
+// Loads a fixture through the same database and vault code paths as the
+// handlers that normally write it.  Unknown fields are rejected, so a typo
+// in a fixture fails loudly instead of seeding less than intended.
+func (s *Server) seedFixture(w http.ResponseWriter, r *http.Request) {
+	var f fixture
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := f.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx := r.Context()
+
+	rules := s.canonicalRules()
+	for i, fi := range f.Identities {
+		id := &db.Identity{Email: fi.Email, CanonicalEmail: rules.Canonical(fi.Email), PubKey: fi.PubKey, TxHash: fi.TxHash, Verified: true}
+		err := s.db.CreateIdentity(ctx, id)
+		if errors.Is(err, db.ErrDuplicate) {
+			writeError(w, http.StatusConflict, fmt.Sprintf("identities[%d]: email already registered", i))
+			return
+		}
+		if err != nil {
+			writeFailure(w, r, http.StatusInternalServerError, fmt.Sprintf("identities[%d]: seed failed", i), err)
+			return
+		}
+		s.identities.forget(id)
+	}
+
+	for i, fa := range f.Accounts {
+		if err := s.seedAccount(ctx, fa); err != nil {
+			writeFailure(w, r, http.StatusInternalServerError, fmt.Sprintf("accounts[%d]: seed failed", i), err)
+			return
+		}
+	}
+
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	for i, fm := range f.Messages {
+		doc, err := encryptPreview(fc, &db.CachedMessage{
+			OwnerPubKey: fm.OwnerPubKey, AccountEmail: fm.AccountEmail, UID: fm.UID,
+			From: fm.From, Subject: fm.Subject, Date: fm.Date, Size: fm.Size,
+		})
+		if err == nil {
+			_, err = s.db.UpsertCachedMessage(ctx, doc)
+		}
+		if err != nil {
+			writeFailure(w, r, http.StatusInternalServerError, fmt.Sprintf("messages[%d]: seed failed", i), err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusCreated, seedResponse{
+		Identities: len(f.Identities),
+		Accounts:   len(f.Accounts),
+		Messages:   len(f.Messages),
+	})
+}
+
+// seedAccount stores fa with its passwords encrypted, as addAccount does.
+func (s *Server) seedAccount(ctx context.Context, fa fixtureAccount) error {
+	pop3Enc, err := s.cfg.EncryptionKey.EncryptString(fa.POP3.Pass)
+	if err != nil {
+		return err
+	}
+	smtpEnc, err := s.cfg.EncryptionKey.EncryptString(fa.SMTP.Pass)
+	if err != nil {
+		return err
+	}
+	return s.db.CreateMailAccount(ctx, &db.MailAccount{
+		OwnerPubKey:  fa.OwnerPubKey,
+		AccountEmail: fa.AccountEmail,
+		DisplayName:  strings.TrimSpace(fa.DisplayName),
+		Signature:    fa.Signature,
+		POP3: db.POP3Settings{
+			Host: fa.POP3.Host, Port: fa.POP3.Port,
+			User: fa.POP3.User, PassEnc: pop3Enc, UseSSL: fa.POP3.useSSL(),
+			AuthMechanism: fa.POP3.AuthMechanism,
+		},
+		SMTP: db.SMTPSettings{
+			Host: fa.SMTP.Host, Port: fa.SMTP.Port,
+			User: fa.SMTP.User, PassEnc: smtpEnc, UseSSL: fa.SMTP.useSSL(),
+		},
+	})
+}
+
+// POST /api/test/reset
+//
+// Deletes every document in the database, keeping its indexes, and empties
+// the identity cache so wiped identities stop resolving.
+func (s *Server) resetFixtures(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.Reset(r.Context()); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	s.identities.purge()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purge drops every entry.
+func (c *identityCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order = list.New()
+	c.entries = make(map[string]*list.Element)
+}
@@ -0,0 +1,118 @@
+//go:build testfixtures
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mulamail/db/dbtest"
+)
+
+const testFixture = `{
+	"identities": [{"email": "alice@example.com", "pubkey": "owner"}],
+	"accounts": [{
+		"owner_pubkey": "owner", "account_email": "alice@example.com",
+		"pop3": {"host": "pop.example.com", "port": 995, "user": "alice", "pass": "pop-secret"},
+		"smtp": {"host": "smtp.example.com", "port": 465, "user": "alice", "pass": "smtp-secret"}
+	}],
+	"messages": [{
+		"owner_pubkey": "owner", "account_email": "alice@example.com", "uid": "uid-1",
+		"from": "Bob <bob@example.org>", "subject": "Lunch?", "date": "2026-01-02T15:04:05Z", "size": 512
+	}]
+}`
+
+// fixtureRouter returns a router for a server running under env.
+func fixtureRouter(t *testing.T, env string) (http.Handler, *Server, *dbtest.Mock) {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	server.cfg.Env = env
+	return NewRouter(mockDB, server.solana, nil, server.cfg), server, mockDB
+}
+
+func serveFixture(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestSeedFixture(t *testing.T) {
+	router, server, mockDB := fixtureRouter(t, "test")
+
+	w := serveFixture(router, "POST", "/api/test/seed", testFixture)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("seed: want %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var resp seedResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp != (seedResponse{Identities: 1, Accounts: 1, Messages: 1}) {
+		t.Errorf("counts: got %+v", resp)
+	}
+
+	if id := mockDB.Identities["alice@example.com"]; id == nil || id.PubKey != "owner" || !id.Verified {
+		t.Errorf("identity: got %+v", id)
+	}
+	acc := mockDB.Accounts["owner"][0]
+	key := server.cfg.EncryptionKey
+	if pass, err := key.DecryptString(acc.POP3.PassEnc); err != nil || pass != "pop-secret" {
+		t.Errorf("pop3 password: want it encrypted, decrypted %q, %v", pass, err)
+	}
+	if pass, err := key.DecryptString(acc.SMTP.PassEnc); err != nil || pass != "smtp-secret" {
+		t.Errorf("smtp password: want it encrypted, decrypted %q, %v", pass, err)
+	}
+	if m := mockDB.Cached[0]; m.From != "" || m.Subject != "" || m.FromEnc == "" {
+		t.Errorf("cached message: want it stored encrypted, got %+v", m)
+	}
+
+	// The seeded data is served by the normal endpoints.
+	w = serveFixture(router, "GET", "/api/v1/mail/search?owner=owner&from=bob@example.org", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Lunch?") {
+		t.Errorf("search: got %d %s", w.Code, w.Body.String())
+	}
+	w = serveFixture(router, "GET", "/api/v1/identity/resolve?email=alice@example.com", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("resolve: got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := serveFixture(router, "POST", "/api/test/reset", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("reset: want %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if len(mockDB.Identities) != 0 || len(mockDB.Accounts) != 0 || len(mockDB.Cached) != 0 {
+		t.Error("want the database empty after reset")
+	}
+	if w := serveFixture(router, "GET", "/api/v1/identity/resolve?email=alice@example.com", ""); w.Code != http.StatusNotFound {
+		t.Errorf("resolve after reset: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestSeedFixture_Invalid(t *testing.T) {
+	router, _, mockDB := fixtureRouter(t, "test")
+
+	for _, body := range []string{
+		`{"identities": [{"email": "alice@example.com", "pubkey": "owner", "verfied": true}]}`,
+		`{"identities": [{"email": "alice@example.com", "pubkey": "owner"}], "accounts": [{"owner_pubkey": "owner", "account_email": "not an address"}]}`,
+		`{"messages": [{"owner_pubkey": "owner", "account_email": "alice@example.com"}]}`,
+	} {
+		if w := serveFixture(router, "POST", "/api/test/seed", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: want %d, got %d", body, http.StatusBadRequest, w.Code)
+		}
+	}
+	if len(mockDB.Identities) != 0 {
+		t.Error("want nothing seeded from an invalid fixture")
+	}
+}
+
+func TestFixtureRoutes_RequireTestEnv(t *testing.T) {
+	for _, env := range []string{"", "production"} {
+		router, _, mockDB := fixtureRouter(t, env)
+		if w := serveFixture(router, "POST", "/api/test/seed", testFixture); w.Code != http.StatusNotFound {
+			t.Errorf("ENV=%q: want %d, got %d", env, http.StatusNotFound, w.Code)
+		}
+		if len(mockDB.Identities) != 0 {
+			t.Errorf("ENV=%q: want nothing seeded", env)
+		}
+	}
+}
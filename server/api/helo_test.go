@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"mulamail/mail"
+)
+
+func TestAddAccount_HELOHostname(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	add := func(email string, pop3, smtp map[string]any) int {
+		body, _ := json.Marshal(map[string]any{
+			"owner_pubkey":  "owner",
+			"account_email": email,
+			"pop3":          pop3,
+			"smtp":          smtp,
+		})
+		w := httptest.NewRecorder()
+		server.addAccount(w, httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewBuffer(body)))
+		return w.Code
+	}
+	pop3 := map[string]any{"host": "pop.example.com", "port": 995, "use_ssl": true}
+	smtp := func(helo string) map[string]any {
+		return map[string]any{"host": "smtp.example.com", "port": 587, "helo_hostname": helo}
+	}
+
+	if code := add("me@example.com", pop3, smtp("mx1.example.com")); code != http.StatusCreated {
+		t.Fatalf("add: want %d, got %d", http.StatusCreated, code)
+	}
+	if got := mockDB.Accounts["owner"][0].SMTP.HELOHostname; got != "mx1.example.com" {
+		t.Errorf("helo_hostname: want mx1.example.com, got %q", got)
+	}
+	for _, name := range []string{"mx1 example.com", "mx1.example.com\r\nRSET", "-mx.example.com"} {
+		if code := add("other@example.com", pop3, smtp(name)); code != http.StatusBadRequest {
+			t.Errorf("%q: want %d, got %d", name, http.StatusBadRequest, code)
+		}
+	}
+	pop3["helo_hostname"] = "mx1.example.com"
+	if code := add("other@example.com", pop3, smtp("")); code != http.StatusBadRequest {
+		t.Errorf("pop3 helo_hostname: want %d, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestUpdateAccount_SMTPHELOHostname(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", "127.0.0.1", 1)
+
+	patch := func(name string) int {
+		body, _ := json.Marshal(map[string]any{"owner_pubkey": "owner", "account_email": "me@example.com", "smtp_helo_hostname": name})
+		w := httptest.NewRecorder()
+		server.updateAccount(w, httptest.NewRequest("PATCH", "/api/v1/accounts", bytes.NewBuffer(body)))
+		return w.Code
+	}
+
+	if code := patch("mx1.example.com"); code != http.StatusOK || mockDB.Accounts["owner"][0].SMTP.HELOHostname != "mx1.example.com" {
+		t.Errorf("set: status %d, hostname %q", code, mockDB.Accounts["owner"][0].SMTP.HELOHostname)
+	}
+	if code := patch("mx1..example.com"); code != http.StatusBadRequest {
+		t.Errorf("invalid: want %d, got %d", http.StatusBadRequest, code)
+	}
+	if code := patch(""); code != http.StatusOK || mockDB.Accounts["owner"][0].SMTP.HELOHostname != "" {
+		t.Errorf("clear: status %d, hostname %q", code, mockDB.Accounts["owner"][0].SMTP.HELOHostname)
+	}
+}
+
+func TestSendMail_HELOHostname(t *testing.T) {
+	tests := []struct {
+		name                string
+		account, configured string
+		want                string
+	}{
+		{"account", "mx1.example.com", "relay.example.net", "mx1.example.com"},
+		{"configured", "", "relay.example.net", "relay.example.net"},
+		{"detected", "", "", mail.LocalHostname()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, mockDB := setupTestServer(t)
+			server.cfg.SMTPHELOHostname = tt.configured
+
+			fake := &fakeSMTP{}
+			host, port := fake.start(t)
+			addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+			mockDB.Accounts["owner"][0].SMTP.HELOHostname = tt.account
+
+			body, _ := json.Marshal(map[string]any{
+				"owner_pubkey":  "owner",
+				"account_email": "me@example.com",
+				"to":            []string{"you@example.org"},
+				"subject":       "hello",
+				"body":          "hi there",
+			})
+			w := httptest.NewRecorder()
+			server.sendMail(w, httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			if got := fake.received(); !slices.Contains(got, "EHLO "+tt.want) {
+				t.Errorf("want %q on the wire, got %q", "EHLO "+tt.want, got)
+			}
+		})
+	}
+}
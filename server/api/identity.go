@@ -1,28 +1,49 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/gagliardetto/solana-go"
 
 	"mulamail/blockchain"
 	"mulamail/db"
+	"mulamail/mail"
 )
 
+// createIdentityTxRequest is the body of POST /api/v1/identity/create-tx.
+type createIdentityTxRequest struct {
+	Email   string `json:"email"`
+	PubKey  string `json:"pubkey"`
+	Durable bool   `json:"durable"`
+}
+
+// createIdentityTxResponse carries the unsigned memo transaction.
+type createIdentityTxResponse struct {
+	Transaction string `json:"transaction"` // base64, unsigned
+}
+
 // POST /api/v1/identity/create-tx
 //
 // Creates an *unsigned* Solana memo transaction that the client will sign
 // locally before submitting via /register.  The memo embeds a JSON payload
 // that binds the email address to the signer's public key.
 //
-// Request:  { "email": "alice@example.com", "pubkey": "<base58>" }
+// Request:  { "email": "alice@example.com", "pubkey": "<base58>", "durable": false }
 // Response: { "transaction": "<base64 unsigned tx>" }
+//
+// With durable set, the transaction uses the configured durable nonce instead
+// of a recent blockhash, so it does not expire while the user signs.
+//
+// The email must be a valid address, internationalised ones included; its
+// domain is bound in Unicode form, as /register stores it.
+//
+// Answers 422 when the memo would exceed the Memo program's size limit.
 func (s *Server) createIdentityTx(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Email  string `json:"email"`
-		PubKey string `json:"pubkey"`
-	}
+	var req createIdentityTxRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
 		return
@@ -31,6 +52,12 @@ func (s *Server) createIdentityTx(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "email and pubkey are required")
 		return
 	}
+	email, err := mail.NormalizeAddress(req.Email)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid email: "+err.Error())
+		return
+	}
+	req.Email = email
 
 	pubkey, err := solana.PublicKeyFromBase58(req.PubKey)
 	if err != nil {
@@ -38,70 +65,204 @@ func (s *Server) createIdentityTx(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	txB64, err := blockchain.CreateIdentityMemoTx(r.Context(), s.solana, pubkey, req.Email)
+	var txB64 string
+	if req.Durable {
+		nonce, nerr := s.durableNonce()
+		if errors.Is(nerr, errNoDurableNonce) {
+			writeError(w, http.StatusBadRequest, nerr.Error())
+			return
+		}
+		if nerr != nil {
+			writeInternalError(w, r, nerr)
+			return
+		}
+		txB64, err = blockchain.CreateDurableIdentityMemoTx(r.Context(), s.solana, pubkey, req.Email, *nonce)
+	} else {
+		txB64, err = blockchain.CreateIdentityMemoTx(r.Context(), s.solana, pubkey, req.Email)
+	}
+	if errors.Is(err, blockchain.ErrMemoTooLarge) {
+		writeError(w, http.StatusUnprocessableEntity,
+			err.Error()+"; the email address is too long to anchor on-chain, use a shorter address")
+		return
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "create tx: "+err.Error())
+		writeFailure(w, r, http.StatusInternalServerError, "create tx failed", err)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]string{"transaction": txB64})
+	writeJSON(w, http.StatusOK, createIdentityTxResponse{Transaction: txB64})
+}
+
+var errNoDurableNonce = errors.New("durable nonces are not configured")
+
+// durableNonce returns the configured durable nonce account.
+func (s *Server) durableNonce() (*blockchain.DurableNonce, error) {
+	if s.cfg.SolanaNonceAccount == "" || s.cfg.SolanaNonceAuthorityKey == "" {
+		return nil, errNoDurableNonce
+	}
+	account, err := solana.PublicKeyFromBase58(s.cfg.SolanaNonceAccount)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce account: %w", err)
+	}
+	authority, err := solana.PrivateKeyFromBase58(s.cfg.SolanaNonceAuthorityKey.Reveal())
+	if err != nil {
+		return nil, errors.New("invalid nonce authority key")
+	}
+	return &blockchain.DurableNonce{Account: account, Authority: authority}, nil
+}
+
+// registerIdentityRequest is the body of POST /api/v1/identity/register.
+// Email and PubKey are optional; when given, they must match the memo.
+type registerIdentityRequest struct {
+	Email    string `json:"email,omitempty"`
+	PubKey   string `json:"pubkey,omitempty"`
+	SignedTx string `json:"signed_tx"`
+}
+
+// registerIdentityResponse is the stored identity and its memo transaction.
+type registerIdentityResponse struct {
+	Identity *db.Identity `json:"identity"`
+	TxHash   string       `json:"tx_hash"`
 }
 
 // POST /api/v1/identity/register
 //
 // Accepts the client-signed transaction, broadcasts it to Solana, and
-// persists the identity mapping in MongoDB.
+// persists the identity mapping in MongoDB.  The email and pubkey are those
+// of the transaction's identity memo, which the pubkey must have signed;
+// the body's email and pubkey, when given, must match them or the request
+// is answered 400.  A transaction registers one identity only: submitting
+// it again, for any email, is answered 409.  The email is stored as given
+// alongside its canonical form (see EMAIL_CANONICAL_RULES), and an email
+// whose canonical form is already registered is answered 409, so
+// alice+invoices@gmail.com cannot claim alice@gmail.com's mailbox.
+// Internationalised addresses are accepted, with the domain stored in its
+// Unicode form whichever form it is given in.
+//
+// A pubkey may register up to MAX_IDENTITIES_PER_PUBKEY unrevoked
+// identities; one more is answered 409 with the limit.  The first it
+// registers is its primary identity, which resolving the pubkey returns.
 //
-// Request:  { "email": "...", "pubkey": "...", "signed_tx": "<base64>" }
+// Request:  { "signed_tx": "<base64>", "email": "...", "pubkey": "..." }
 // Response: { "identity": {...}, "tx_hash": "<signature>" }
 func (s *Server) registerIdentity(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Email    string `json:"email"`
-		PubKey   string `json:"pubkey"`
-		SignedTx string `json:"signed_tx"`
-	}
+	var req registerIdentityRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if req.Email == "" || req.PubKey == "" || req.SignedTx == "" {
-		writeError(w, http.StatusBadRequest, "email, pubkey and signed_tx are required")
+	if req.SignedTx == "" {
+		writeError(w, http.StatusBadRequest, "signed_tx is required")
+		return
+	}
+	memo, txSig, err := blockchain.ParseIdentityTx(req.SignedTx)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	email, err := mail.NormalizeAddress(memo.Email)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid email in memo: "+err.Error())
+		return
+	}
+	if req.Email != "" {
+		if given, err := mail.NormalizeAddress(req.Email); err != nil || given != email {
+			writeError(w, http.StatusBadRequest, "email does not match the transaction's memo")
+			return
+		}
+	}
+	if req.PubKey != "" && req.PubKey != memo.Pubkey {
+		writeError(w, http.StatusBadRequest, "pubkey does not match the transaction's memo")
 		return
 	}
+	req.Email, req.PubKey = email, memo.Pubkey
 
-	// Duplicate guard.
-	if _, err := s.db.GetIdentityByEmail(r.Context(), req.Email); err == nil {
+	// Duplicate guard, held until the identity is stored.  Every request
+	// with the same transaction holds the same lock, as the memo's pubkey
+	// signed it.
+	unlock, err := s.lockOwner(r.Context(), req.PubKey)
+	if err != nil {
+		writeLockError(w, r, err)
+		return
+	}
+	defer unlock()
+	if _, err := s.db.GetIdentityByTxSig(r.Context(), txSig.String()); err == nil {
+		writeError(w, http.StatusConflict, "transaction already registered an identity")
+		return
+	} else if !errors.Is(err, db.ErrNotFound) {
+		writeInternalError(w, r, err)
+		return
+	}
+	canonical := s.canonicalRules().Canonical(req.Email)
+	if _, err := s.db.GetIdentityByCanonicalEmail(r.Context(), canonical, req.Email); err == nil {
 		writeError(w, http.StatusConflict, "email already registered")
 		return
+	} else if !errors.Is(err, db.ErrNotFound) {
+		writeInternalError(w, r, err)
+		return
+	}
+	owned, err := s.db.GetIdentitiesByPubKeys(r.Context(), []string{req.PubKey})
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	active := 0
+	for _, id := range owned {
+		if id.RevokedAt.IsZero() {
+			active++
+		}
+	}
+	if limit := s.cfg.MaxIdentitiesPerPubKey; limit > 0 && active >= limit {
+		writeLimitError(w, http.StatusConflict,
+			fmt.Sprintf("pubkey already has %d identities registered", active), limit)
+		return
 	}
 
 	// Broadcast to Solana.
 	sig, err := s.solana.SendTransaction(r.Context(), req.SignedTx)
+	if errors.Is(err, blockchain.ErrTxExpired) {
+		writeError(w, http.StatusConflict,
+			"transaction expired or its nonce was already used; request a new one from /identity/create-tx and sign again")
+		return
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "broadcast: "+err.Error())
+		writeFailure(w, r, http.StatusInternalServerError, "broadcast failed", err)
 		return
 	}
 
 	// Persist.
 	identity := &db.Identity{
-		Email:    req.Email,
-		PubKey:   req.PubKey,
-		TxHash:   sig.String(),
-		Verified: true,
+		Email:          req.Email,
+		CanonicalEmail: canonical,
+		PubKey:         req.PubKey,
+		TxHash:         sig.String(),
+		TxSig:          txSig.String(),
+		Verified:       true,
+		Primary:        active == 0,
+		ChainStatus:    db.ChainPending,
+	}
+	err = s.db.CreateIdentity(r.Context(), identity)
+	if errors.Is(err, db.ErrDuplicate) {
+		writeError(w, http.StatusConflict, "email or transaction already registered")
+		return
 	}
-	if err := s.db.CreateIdentity(r.Context(), identity); err != nil {
-		writeError(w, http.StatusInternalServerError, "store identity: "+err.Error())
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "store identity failed", err)
 		return
 	}
+	s.identities.forget(identity)
 
-	writeJSON(w, http.StatusCreated, map[string]any{
-		"identity": identity,
-		"tx_hash":  sig.String(),
-	})
+	writeJSON(w, http.StatusCreated, registerIdentityResponse{Identity: identity, TxHash: sig.String()})
 }
 
 // GET /api/v1/identity/resolve?email=...  OR  ?pubkey=...
 //
-// Looks up the stored identity mapping by either field.
+// Looks up the stored identity mapping by either field.  An email resolves
+// by its canonical form, so alice+invoices@gmail.com finds the identity
+// registered for alice@gmail.com; exact=true matches the stored email
+// exactly instead.  A pubkey with several identities resolves to its
+// primary one, or its oldest when none is marked.  Found mappings are served
+// from the in-process identity cache; nocache=true skips it and reads the
+// database, for debugging a stale answer.
 func (s *Server) resolveIdentity(w http.ResponseWriter, r *http.Request) {
 	email := r.URL.Query().Get("email")
 	pubkey := r.URL.Query().Get("pubkey")
@@ -110,18 +271,142 @@ func (s *Server) resolveIdentity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var (
-		identity *db.Identity
-		err      error
-	)
-	if email != "" {
-		identity, err = s.db.GetIdentityByEmail(r.Context(), email)
-	} else {
-		identity, err = s.db.GetIdentityByPubKey(r.Context(), pubkey)
+	var key string // empty for lookups the cache can't answer
+	var lookup func(ctx context.Context) (*db.Identity, error)
+	switch {
+	case email == "":
+		key = pubkeyCacheKey(pubkey)
+		lookup = func(ctx context.Context) (*db.Identity, error) { return s.db.GetIdentityByPubKey(ctx, pubkey) }
+	case r.URL.Query().Get("exact") == "true":
+		lookup = func(ctx context.Context) (*db.Identity, error) { return s.db.GetIdentityByEmail(ctx, email) }
+	default:
+		canonical := s.canonicalRules().Canonical(email)
+		key = emailCacheKey(canonical)
+		lookup = func(ctx context.Context) (*db.Identity, error) {
+			return s.db.GetIdentityByCanonicalEmail(ctx, canonical, email)
+		}
+	}
+	bypass := r.URL.Query().Get("nocache") == "true"
+	if !bypass && key != "" {
+		if identity, ok := s.identities.get(key); ok {
+			writeJSON(w, http.StatusOK, identity)
+			return
+		}
 	}
+
+	identity, err := lookup(r.Context())
 	if err != nil {
 		writeError(w, http.StatusNotFound, "identity not found")
 		return
 	}
+	if !bypass {
+		s.identities.put(identity, email == "")
+	}
 	writeJSON(w, http.StatusOK, identity)
 }
+
+// maxResolveBatch caps the queries in one resolve-batch request.
+const maxResolveBatch = 100
+
+// resolveBatchRequest is the body of POST /api/v1/identity/resolve-batch.
+type resolveBatchRequest struct {
+	Emails  []string `json:"emails"`
+	PubKeys []string `json:"pubkeys"`
+}
+
+// resolvedIdentity is the outcome for one query of a batch.  Identity is
+// null when nothing matched, and Reason says why.
+type resolvedIdentity struct {
+	Query    string       `json:"query"`
+	Identity *db.Identity `json:"identity"`
+	Reason   string       `json:"reason,omitempty"` // "not_found"
+}
+
+// resolveBatchResponse lists one result per query: the emails in request
+// order, then the pubkeys in request order.
+type resolveBatchResponse struct {
+	Results []resolvedIdentity `json:"results"`
+}
+
+// POST /api/v1/identity/resolve-batch
+//
+// Resolves many identities in one round trip, for example to render a
+// contact list.  Each kind of query is answered with a single database
+// lookup.  Emails resolve by their canonical form, as with
+// /identity/resolve, unless ?exact=true.
+//
+// Request:  { "emails": ["alice@example.com"], "pubkeys": ["<base58>"] }
+// Response: { "results": [{ "query": "alice@example.com", "identity": {...} }, ...] }
+func (s *Server) resolveIdentityBatch(w http.ResponseWriter, r *http.Request) {
+	var req resolveBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	n := len(req.Emails) + len(req.PubKeys)
+	if n == 0 {
+		writeError(w, http.StatusBadRequest, "provide emails or pubkeys")
+		return
+	}
+	if n > maxResolveBatch {
+		writeLimitError(w, http.StatusBadRequest, fmt.Sprintf("at most %d queries per batch", maxResolveBatch), maxResolveBatch)
+		return
+	}
+
+	results := make([]resolvedIdentity, 0, n)
+	if len(req.Emails) > 0 {
+		var found []db.Identity
+		var err error
+		rules := s.canonicalRules()
+		exact := r.URL.Query().Get("exact") == "true"
+		if exact {
+			found, err = s.db.GetIdentitiesByEmails(r.Context(), req.Emails)
+		} else {
+			found, err = s.db.GetIdentitiesByCanonicalEmails(r.Context(), canonicalEmails(rules, req.Emails), req.Emails)
+		}
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		find := indexIdentities(rules, found).find
+		if exact {
+			find = keyedIdentities(found, func(id *db.Identity) string { return id.Email })
+		}
+		results = appendResolved(results, req.Emails, find)
+	}
+	if len(req.PubKeys) > 0 {
+		found, err := s.db.GetIdentitiesByPubKeys(r.Context(), req.PubKeys)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		results = appendResolved(results, req.PubKeys, keyedIdentities(found, func(id *db.Identity) string { return id.PubKey }))
+	}
+	writeJSON(w, http.StatusOK, resolveBatchResponse{Results: results})
+}
+
+// appendResolved appends one result per query, in query order, using find
+// to match each to the identities found.
+func appendResolved(results []resolvedIdentity, queries []string, find func(string) *db.Identity) []resolvedIdentity {
+	for _, q := range queries {
+		res := resolvedIdentity{Query: q, Identity: find(q)}
+		if res.Identity == nil {
+			res.Reason = "not_found"
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// keyedIdentities returns a find function for appendResolved that matches
+// queries to found identities by key.  The first identity found for a key
+// wins, which for a pubkey is its primary one.
+func keyedIdentities(found []db.Identity, key func(*db.Identity) string) func(string) *db.Identity {
+	byKey := make(map[string]*db.Identity, len(found))
+	for i := range found {
+		if _, ok := byKey[key(&found[i])]; !ok {
+			byKey[key(&found[i])] = &found[i]
+		}
+	}
+	return func(q string) *db.Identity { return byKey[q] }
+}
@@ -5,12 +5,19 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gagliardetto/solana-go"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mulamail/blockchain"
 	"mulamail/db"
 )
 
@@ -21,6 +28,23 @@ func init() {
 	db.ErrNotFound = ErrNotFound
 }
 
+// signedIdentityTx returns an identity memo transaction binding email to
+// wallet, signed by it as a client would submit it to /register.
+func signedIdentityTx(t *testing.T, wallet *solana.Wallet, email string) string {
+	t.Helper()
+	memo, _ := json.Marshal(map[string]string{"action": "identity", "email": email, "pubkey": wallet.PublicKey().String()})
+	tx, err := solana.NewTransaction([]solana.Instruction{
+		solana.NewInstruction(blockchain.MemoV2ProgramID, solana.AccountMetaSlice{solana.Meta(wallet.PublicKey()).SIGNER()}, memo),
+	}, solana.Hash{1}, solana.TransactionPayer(wallet.PublicKey()))
+	if err != nil {
+		t.Fatalf("new tx: %v", err)
+	}
+	if _, err := tx.Sign(func(solana.PublicKey) *solana.PrivateKey { return &wallet.PrivateKey }); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return tx.MustToBase64()
+}
+
 func TestResolveIdentity_ByEmail_Success(t *testing.T) {
 	server, mockDB := setupTestServer(t)
 
@@ -150,6 +174,30 @@ func TestCreateIdentityTx_Success(t *testing.T) {
 	}
 }
 
+func TestCreateIdentityTx_MemoTooLarge(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	reqBody := map[string]string{
+		"email":  strings.Repeat("a", 500) + "@example.com",
+		"pubkey": "9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin",
+	}
+	body, _ := json.Marshal(reqBody)
+
+	req := httptest.NewRequest("POST", "/api/v1/identity/create-tx", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.createIdentityTx(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+	var response map[string]string
+	json.NewDecoder(w.Body).Decode(&response)
+	if !contains(response["error"], "limit is 566") {
+		t.Errorf("expected sizes in error, got: %s", response["error"])
+	}
+}
+
 func TestCreateIdentityTx_InvalidJSON(t *testing.T) {
 	server, _ := setupTestServer(t)
 
@@ -228,9 +276,7 @@ func TestRegisterIdentity_DuplicateEmail(t *testing.T) {
 
 	// Try to register with same email
 	reqBody := map[string]string{
-		"email":     "duplicate@example.com",
-		"pubkey":    "newkey",
-		"signed_tx": "dummytx",
+		"signed_tx": signedIdentityTx(t, solana.NewWallet(), "duplicate@example.com"),
 	}
 	body, _ := json.Marshal(reqBody)
 
@@ -250,6 +296,56 @@ func TestRegisterIdentity_DuplicateEmail(t *testing.T) {
 	}
 }
 
+func TestRegisterIdentity_LookupFailure(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	var broadcasts atomic.Int32
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		broadcasts.Add(1)
+		http.Error(w, "unexpected call", http.StatusInternalServerError)
+	}))
+	defer rpcServer.Close()
+	server.solana = blockchain.NewClient(rpcServer.URL)
+
+	// The email may well be taken; without the lookup nothing is broadcast.
+	mockDB.Fail("GetIdentityByCanonicalEmail", errors.New("mongo: connection reset"))
+	body, _ := json.Marshal(map[string]string{"signed_tx": signedIdentityTx(t, solana.NewWallet(), "alice@example.com")})
+	w := httptest.NewRecorder()
+	server.registerIdentity(w, httptest.NewRequest("POST", "/api/v1/identity/register", bytes.NewBuffer(body)))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status code: want %d, got %d: %s", http.StatusInternalServerError, w.Code, w.Body.String())
+	}
+	if n := broadcasts.Load(); n != 0 {
+		t.Errorf("want nothing broadcast, got %d calls", n)
+	}
+	if len(mockDB.Identities) != 0 {
+		t.Errorf("want no identity stored, got %v", mockDB.Identities)
+	}
+}
+
+func TestRegisterIdentity_InternationalisedEmail(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	mockDB.CreateIdentity(context.Background(), &db.Identity{Email: "josé@bücher.de", CanonicalEmail: "josé@bücher.de", PubKey: "pk-jose"})
+
+	// The A-label spelling of the domain is the same mailbox.
+	body, _ := json.Marshal(map[string]string{"signed_tx": signedIdentityTx(t, solana.NewWallet(), "josé@XN--BCHER-KVA.de")})
+	w := httptest.NewRecorder()
+	server.registerIdentity(w, httptest.NewRequest("POST", "/api/v1/identity/register", bytes.NewBuffer(body)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("A-label spelling: want %d, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	if w := resolveEmail(server, "josé@xn--bcher-kva.de", ""); w.Code != http.StatusOK {
+		t.Errorf("resolve by A-label: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	body, _ = json.Marshal(map[string]string{"signed_tx": signedIdentityTx(t, solana.NewWallet(), "josé@xn--zz.de")})
+	w = httptest.NewRecorder()
+	server.registerIdentity(w, httptest.NewRequest("POST", "/api/v1/identity/register", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid IDN: want %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+}
+
 func TestRegisterIdentity_MissingFields(t *testing.T) {
 	testCases := []struct {
 		name string
@@ -306,8 +402,55 @@ func TestRegisterIdentity_InvalidTransaction(t *testing.T) {
 
 	server.registerIdentity(w, req)
 
-	if w.Code != http.StatusInternalServerError {
-		t.Errorf("status code: want %d, got %d", http.StatusInternalServerError, w.Code)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestRegisterIdentity_ExpiredTransaction(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": map[string]any{
+			"code": -32002, "message": "Transaction simulation failed: Blockhash not found",
+		}})
+	}))
+	defer rpcServer.Close()
+	server.solana = blockchain.NewClient(rpcServer.URL)
+
+	signer := solana.NewWallet()
+	body, _ := json.Marshal(map[string]string{
+		"email": "slow@example.com", "pubkey": signer.PublicKey().String(), "signed_tx": signedIdentityTx(t, signer, "slow@example.com"),
+	})
+	req := httptest.NewRequest("POST", "/api/v1/identity/register", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.registerIdentity(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status code: want %d, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	if _, ok := mockDB.Identities["slow@example.com"]; ok {
+		t.Error("identity must not be stored when the broadcast fails")
+	}
+}
+
+func TestCreateIdentityTx_DurableNotConfigured(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	body, _ := json.Marshal(map[string]any{
+		"email": "test@example.com", "pubkey": "9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin", "durable": true,
+	})
+	req := httptest.NewRequest("POST", "/api/v1/identity/create-tx", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.createIdentityTx(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code: want %d, got %d", http.StatusBadRequest, w.Code)
 	}
 }
 
@@ -385,3 +528,320 @@ func containsHelper(s, substr string) bool {
 	}
 	return false
 }
+
+func TestResolveIdentityBatch(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+	mockDB.CreateIdentity(ctx, &db.Identity{Email: "alice@mulamail.com", PubKey: "pk-alice"})
+	mockDB.CreateIdentity(ctx, &db.Identity{Email: "bob@mulamail.com", PubKey: "pk-bob"})
+
+	body, _ := json.Marshal(map[string]any{
+		"emails":  []string{"bob@mulamail.com", "nobody@mulamail.com", "alice@mulamail.com"},
+		"pubkeys": []string{"pk-alice", "pk-unknown"},
+	})
+	req := httptest.NewRequest("POST", "/api/v1/identity/resolve-batch", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	server.resolveIdentityBatch(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response resolveBatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	want := []struct{ query, pubkey, reason string }{
+		{"bob@mulamail.com", "pk-bob", ""},
+		{"nobody@mulamail.com", "", "not_found"},
+		{"alice@mulamail.com", "pk-alice", ""},
+		{"pk-alice", "pk-alice", ""},
+		{"pk-unknown", "", "not_found"},
+	}
+	if len(response.Results) != len(want) {
+		t.Fatalf("expected %d results, got %+v", len(want), response.Results)
+	}
+	for i, wr := range want {
+		got := response.Results[i]
+		if got.Query != wr.query || got.Reason != wr.reason {
+			t.Errorf("result %d: want query %q reason %q, got %+v", i, wr.query, wr.reason, got)
+		}
+		if wr.pubkey == "" && got.Identity != nil || wr.pubkey != "" && (got.Identity == nil || got.Identity.PubKey != wr.pubkey) {
+			t.Errorf("result %d: want pubkey %q, got %+v", i, wr.pubkey, got.Identity)
+		}
+	}
+	if mockDB.IdentityQueries != 2 {
+		t.Errorf("expected one lookup per query kind, got %d", mockDB.IdentityQueries)
+	}
+}
+
+func TestResolveIdentityBatch_Limits(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	tooMany := make([]string, maxResolveBatch+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("user%d@mulamail.com", i)
+	}
+	for name, payload := range map[string]any{
+		"empty":    map[string]any{},
+		"too many": map[string]any{"emails": tooMany},
+		"split over the limit": map[string]any{
+			"emails": tooMany[:maxResolveBatch], "pubkeys": []string{"pk"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			body, _ := json.Marshal(payload)
+			req := httptest.NewRequest("POST", "/api/v1/identity/resolve-batch", bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+			server.resolveIdentityBatch(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status code: want %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
+
+func TestResolveIdentity_CachedUntilRotated(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.identities = newIdentityCache(100, time.Hour)
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": solana.Signature{1}.String()})
+	}))
+	defer rpcServer.Close()
+	server.solana = blockchain.NewClient(rpcServer.URL)
+
+	signer := solana.NewWallet()
+	oldKey, newKey := signer.PublicKey().String(), solana.NewWallet().PublicKey().String()
+	body, _ := json.Marshal(map[string]string{"email": "alice@example.com", "pubkey": oldKey, "signed_tx": signedIdentityTx(t, signer, "alice@example.com")})
+	w := httptest.NewRecorder()
+	server.registerIdentity(w, httptest.NewRequest("POST", "/api/v1/identity/register", bytes.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register: want 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	resolve := func(query string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.resolveIdentity(w, httptest.NewRequest("GET", "/api/v1/identity/resolve?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("resolve %s: want 200, got %d", query, w.Code)
+		}
+		var id db.Identity
+		json.NewDecoder(w.Body).Decode(&id)
+		return id.PubKey
+	}
+
+	resolve("email=alice@example.com")
+	if got := resolve("email=alice@example.com"); got != oldKey {
+		t.Fatalf("cached resolve: want %s, got %s", oldKey, got)
+	}
+	if stats := server.identities.stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("want 1 hit and 1 miss, got %+v", stats)
+	}
+
+	// Rotate: the mapping changes in the database and the writer forgets
+	// both the old and the new identity.
+	old := *mockDB.Identities["alice@example.com"]
+	rotated := &db.Identity{Email: old.Email, PubKey: newKey, Verified: true}
+	mockDB.CreateIdentity(context.Background(), rotated)
+	if got := resolve("email=alice@example.com&nocache=true"); got != newKey {
+		t.Errorf("nocache resolve: want %s, got %s", newKey, got)
+	}
+	server.identities.forget(&old, rotated)
+
+	if got := resolve("email=alice@example.com"); got != newKey {
+		t.Errorf("resolve after rotation: want %s, got %s", newKey, got)
+	}
+	if got := resolve("pubkey=" + newKey); got != newKey {
+		t.Errorf("resolve new pubkey: want %s, got %s", newKey, got)
+	}
+}
+
+func TestRegisterIdentity_PerPubKeyLimit(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.MaxIdentitiesPerPubKey = 2
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": solana.Signature{1}.String()})
+	}))
+	defer rpcServer.Close()
+	server.solana = blockchain.NewClient(rpcServer.URL)
+
+	signer := solana.NewWallet()
+	register := func(email string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"signed_tx": signedIdentityTx(t, signer, email)})
+		w := httptest.NewRecorder()
+		server.registerIdentity(w, httptest.NewRequest("POST", "/api/v1/identity/register", bytes.NewReader(body)))
+		return w
+	}
+
+	for _, email := range []string{"alice@example.com", "alice.work@example.com"} {
+		if w := register(email); w.Code != http.StatusCreated {
+			t.Fatalf("%s: want %d, got %d: %s", email, http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+	if !mockDB.Identities["alice@example.com"].Primary || mockDB.Identities["alice.work@example.com"].Primary {
+		t.Error("want only the first identity registered primary")
+	}
+
+	w := register("alice.spare@example.com")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("over the limit: want %d, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	var response struct {
+		Limit int `json:"limit"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Limit != 2 {
+		t.Errorf("want limit 2 reported, got %d", response.Limit)
+	}
+	if _, ok := mockDB.Identities["alice.spare@example.com"]; ok {
+		t.Error("identity over the limit must not be stored")
+	}
+
+	// Revoked identities do not count against the limit.
+	mockDB.RevokeIdentities(context.Background(), signer.PublicKey().String(), time.Now())
+	if w := register("alice.new@example.com"); w.Code != http.StatusCreated {
+		t.Fatalf("after revocation: want %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if !mockDB.Identities["alice.new@example.com"].Primary {
+		t.Error("want the first identity after revocation primary")
+	}
+}
+
+func TestResolveIdentity_PubKeyOrder(t *testing.T) {
+	t0 := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name string
+		ids  []db.Identity // stored in this order
+		want string
+	}{
+		{"oldest without a primary", []db.Identity{
+			{Email: "new@example.com", CreatedAt: t0.Add(time.Minute)},
+			{Email: "old@example.com", CreatedAt: t0},
+		}, "old@example.com"},
+		{"primary before older", []db.Identity{
+			{Email: "old@example.com", CreatedAt: t0},
+			{Email: "primary@example.com", CreatedAt: t0.Add(time.Minute), Primary: true},
+			{Email: "new@example.com", CreatedAt: t0.Add(2 * time.Minute)},
+		}, "primary@example.com"},
+		{"unrevoked before revoked primary", []db.Identity{
+			{Email: "primary@example.com", CreatedAt: t0, Primary: true, RevokedAt: t0.Add(time.Minute)},
+			{Email: "new@example.com", CreatedAt: t0.Add(2 * time.Minute)},
+			{Email: "newer@example.com", CreatedAt: t0.Add(3 * time.Minute)},
+		}, "new@example.com"},
+		{"same creation time", []db.Identity{
+			{Email: "first@example.com", CreatedAt: t0},
+			{Email: "second@example.com", CreatedAt: t0},
+		}, "first@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, mockDB := setupTestServer(t)
+			for _, id := range tt.ids {
+				id.ID, id.PubKey = primitive.NewObjectID(), "pk-multi"
+				mockDB.Identities[id.Email] = &id
+			}
+
+			w := httptest.NewRecorder()
+			server.resolveIdentity(w, httptest.NewRequest("GET", "/api/v1/identity/resolve?pubkey=pk-multi", nil))
+			var id db.Identity
+			json.NewDecoder(w.Body).Decode(&id)
+			if w.Code != http.StatusOK || id.Email != tt.want {
+				t.Errorf("resolve: want %s, got %d %s", tt.want, w.Code, id.Email)
+			}
+
+			body, _ := json.Marshal(map[string]any{"pubkeys": []string{"pk-multi"}})
+			w = httptest.NewRecorder()
+			server.resolveIdentityBatch(w, httptest.NewRequest("POST", "/api/v1/identity/resolve-batch", bytes.NewReader(body)))
+			var batch resolveBatchResponse
+			json.NewDecoder(w.Body).Decode(&batch)
+			if len(batch.Results) != 1 || batch.Results[0].Identity == nil || batch.Results[0].Identity.Email != tt.want {
+				t.Errorf("resolve-batch: want %s, got %+v", tt.want, batch.Results)
+			}
+		})
+	}
+}
+
+func TestRegisterIdentity_ReplayedTransaction(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	var broadcasts atomic.Int32
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		broadcasts.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": solana.Signature{1}.String()})
+	}))
+	defer rpcServer.Close()
+	server.solana = blockchain.NewClient(rpcServer.URL)
+
+	signer := solana.NewWallet()
+	signedTx := signedIdentityTx(t, signer, "alice@example.com")
+	register := func(body map[string]string) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		server.registerIdentity(w, httptest.NewRequest("POST", "/api/v1/identity/register", bytes.NewReader(b)))
+		return w
+	}
+	if w := register(map[string]string{"signed_tx": signedTx}); w.Code != http.StatusCreated {
+		t.Fatalf("first use: want %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if id := mockDB.Identities["alice@example.com"]; id == nil || id.PubKey != signer.PublicKey().String() || id.TxSig == "" {
+		t.Fatalf("want the memo's mapping stored with the transaction signature, got %+v", id)
+	}
+
+	for _, body := range []map[string]string{
+		{"signed_tx": signedTx},
+		{"signed_tx": signedTx, "email": "alice@example.com"},
+		{"signed_tx": signedTx, "email": "alice.other@example.com"},
+	} {
+		w := register(body)
+		wantCode, wantErr := http.StatusConflict, "transaction already registered"
+		if body["email"] == "alice.other@example.com" {
+			wantCode, wantErr = http.StatusBadRequest, "email does not match"
+		}
+		if w.Code != wantCode || !strings.Contains(w.Body.String(), wantErr) {
+			t.Errorf("replay %v: want %d %q, got %d: %s", body, wantCode, wantErr, w.Code, w.Body.String())
+		}
+	}
+	if n := broadcasts.Load(); n != 1 {
+		t.Errorf("want a replayed transaction never broadcast, got %d broadcasts", n)
+	}
+}
+
+func TestRegisterIdentity_BodyMismatch(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	signer := solana.NewWallet()
+	signedTx := signedIdentityTx(t, signer, "alice@example.com")
+
+	for _, tc := range []struct {
+		name string
+		body map[string]string
+		want string
+	}{
+		{"other email", map[string]string{"email": "mallory@example.com", "signed_tx": signedTx}, "email does not match"},
+		{"invalid email", map[string]string{"email": "not an address", "signed_tx": signedTx}, "email does not match"},
+		{"other pubkey", map[string]string{"pubkey": solana.NewWallet().PublicKey().String(), "signed_tx": signedTx}, "pubkey does not match"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body, _ := json.Marshal(tc.body)
+			w := httptest.NewRecorder()
+			server.registerIdentity(w, httptest.NewRequest("POST", "/api/v1/identity/register", bytes.NewReader(body)))
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tc.want) {
+				t.Errorf("want %d %q, got %d: %s", http.StatusBadRequest, tc.want, w.Code, w.Body.String())
+			}
+		})
+	}
+	if len(mockDB.Identities) != 0 {
+		t.Errorf("want nothing stored, got %v", mockDB.Identities)
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"mulamail/db"
+)
+
+// identityCache keeps recent identity lookups in memory, keyed by canonical
+// email and by pubkey: identities without a canonical email are not cached
+// by email, since their email may be another's canonical form, and only an
+// identity found by pubkey is cached by it, as a pubkey may have several.
+// Mappings only change when an identity is written, so entries are
+// served until they expire or the write path calls forget; the least
+// recently used entries are evicted once size is reached.  Misses are not
+// cached, so a newly registered or reconciled identity resolves at once.
+//
+// A nil *identityCache is a disabled cache: lookups miss and writes are
+// ignored.
+type identityCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // of *cachedIdentity, most recently used first
+	entries map[string]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+// cachedIdentity is one cache entry.
+type cachedIdentity struct {
+	key      string
+	identity db.Identity
+	expires  time.Time
+}
+
+// identityCacheStats reports the cache's counters.
+type identityCacheStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Entries  int    `json:"entries"`
+	Capacity int    `json:"capacity"`
+}
+
+// newIdentityCache returns a cache of up to size entries that live for ttl,
+// or nil (disabled) when either is not positive.
+func newIdentityCache(size int, ttl time.Duration) *identityCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &identityCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func emailCacheKey(canonical string) string { return "email:" + canonical }
+func pubkeyCacheKey(pubkey string) string   { return "pubkey:" + pubkey }
+
+// get returns a copy of the identity cached under key.
+func (c *identityCache) get(key string) (*db.Identity, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok && c.now().After(el.Value.(*cachedIdentity).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	id := el.Value.(*cachedIdentity).identity
+	return &id, true
+}
+
+// cacheKeys returns the keys id is cached under.
+func cacheKeys(id *db.Identity) []string {
+	if id.CanonicalEmail == "" {
+		return []string{pubkeyCacheKey(id.PubKey)}
+	}
+	return []string{emailCacheKey(id.CanonicalEmail), pubkeyCacheKey(id.PubKey)}
+}
+
+// put caches id under its canonical email and, when it was found by
+// pubkey, under its pubkey: a pubkey with several identities resolves to
+// only one of them.
+func (c *identityCache) put(id *db.Identity, byPubKey bool) {
+	if c == nil {
+		return
+	}
+	keys := cacheKeys(id)
+	if !byPubKey {
+		keys = keys[:len(keys)-1]
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+		c.entries[key] = c.order.PushFront(&cachedIdentity{key: key, identity: *id, expires: expires})
+	}
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// forget drops the entries for the canonical email and pubkey of each
+// identity.  Every write that changes a mapping calls it with the old and
+// new identities.
+func (c *identityCache) forget(ids ...*db.Identity) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		for _, key := range cacheKeys(id) {
+			if el, ok := c.entries[key]; ok {
+				c.remove(el)
+			}
+		}
+	}
+}
+
+func (c *identityCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cachedIdentity).key)
+}
+
+// stats returns the current counters; a disabled cache reports zeros.
+func (c *identityCache) stats() identityCacheStats {
+	if c == nil {
+		return identityCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return identityCacheStats{Hits: c.hits, Misses: c.misses, Entries: c.order.Len(), Capacity: c.size}
+}
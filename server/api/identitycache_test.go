@@ -0,0 +1,88 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"mulamail/db"
+)
+
+func TestIdentityCache(t *testing.T) {
+	now := time.Now()
+	c := newIdentityCache(4, time.Minute)
+	c.now = func() time.Time { return now }
+
+	alice := &db.Identity{Email: "alice@example.com", CanonicalEmail: "alice@example.com", PubKey: "alicePK"}
+	bob := &db.Identity{Email: "bob@example.com", CanonicalEmail: "bob@example.com", PubKey: "bobPK"}
+	c.put(alice, true)
+	c.put(bob, true)
+
+	if id, ok := c.get(pubkeyCacheKey("alicePK")); !ok || id.Email != alice.Email {
+		t.Fatalf("alice by pubkey: got %+v, %v", id, ok)
+	}
+	if _, ok := c.get(emailCacheKey("carol@example.com")); ok {
+		t.Error("unknown email must miss")
+	}
+
+	// Carol's two entries evict the two least recently used.
+	c.put(&db.Identity{Email: "carol@example.com", CanonicalEmail: "carol@example.com", PubKey: "carolPK"}, true)
+	if _, ok := c.get(emailCacheKey("bob@example.com")); ok {
+		t.Error("bob should have been evicted")
+	}
+	if _, ok := c.get(pubkeyCacheKey("alicePK")); !ok {
+		t.Error("recently used alice should have been kept")
+	}
+
+	c.forget(alice)
+	if _, ok := c.get(emailCacheKey("alice@example.com")); ok {
+		t.Error("forgotten identity must miss")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get(emailCacheKey("carol@example.com")); ok {
+		t.Error("expired entry must miss")
+	}
+
+	stats := c.stats()
+	if stats.Hits != 2 || stats.Misses != 4 || stats.Entries != 2 || stats.Capacity != 4 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestIdentityCache_WithoutCanonicalEmail(t *testing.T) {
+	c := newIdentityCache(4, time.Minute)
+	c.put(&db.Identity{Email: "alice@gmail.com", PubKey: "alicePK"}, true)
+	if _, ok := c.get(emailCacheKey("alice@gmail.com")); ok {
+		t.Error("an identity without a canonical email must not be cached by email")
+	}
+	if _, ok := c.get(pubkeyCacheKey("alicePK")); !ok {
+		t.Error("want the identity cached by pubkey")
+	}
+}
+
+func TestIdentityCache_FoundByEmail(t *testing.T) {
+	c := newIdentityCache(4, time.Minute)
+	c.put(&db.Identity{Email: "work@example.com", CanonicalEmail: "work@example.com", PubKey: "alicePK"}, false)
+	if _, ok := c.get(emailCacheKey("work@example.com")); !ok {
+		t.Error("want the identity cached by email")
+	}
+	if _, ok := c.get(pubkeyCacheKey("alicePK")); ok {
+		t.Error("an identity found by email need not be its pubkey's primary, so must not be cached by pubkey")
+	}
+}
+
+func TestIdentityCache_Disabled(t *testing.T) {
+	for _, c := range []*identityCache{newIdentityCache(0, time.Minute), newIdentityCache(10, 0)} {
+		if c != nil {
+			t.Fatal("a zero size or TTL must disable the cache")
+		}
+		c.put(&db.Identity{Email: "alice@example.com"}, true)
+		if _, ok := c.get(emailCacheKey("alice@example.com")); ok {
+			t.Error("disabled cache must always miss")
+		}
+		c.forget(&db.Identity{Email: "alice@example.com"})
+		if c.stats() != (identityCacheStats{}) {
+			t.Error("disabled cache must report zero stats")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"mulamail/config"
+)
+
+// errServerBusy answers a request refused by the in-flight limits.
+const errServerBusy = "server busy; retry shortly"
+
+// inflightGroups maps path prefixes to the route groups capped on their
+// own, within the global cap: mail operations each hold a POP3 or SMTP
+// connection, so a burst of them must not take every slot.
+var inflightGroups = []struct{ prefix, group string }{
+	{"/api/v1/mail/", "mail"},
+	{"/api/v1/identity/", "identity"},
+	{"/api/v1/accounts", "accounts"},
+}
+
+// inflightLimiter caps the requests served at once, globally and per route
+// group.  A request over a cap is refused at once rather than queued, so a
+// saturated server sheds load instead of piling up connections.
+type inflightLimiter struct {
+	global *inflightGauge
+	groups map[string]*inflightGauge
+}
+
+// inflightGauge counts the requests in flight against one cap.
+type inflightGauge struct {
+	limit int64 // 0 = no cap
+	n     atomic.Int64
+}
+
+// inflightStats reports one gauge.
+type inflightStats struct {
+	InFlight int64 `json:"in_flight"`
+	Limit    int64 `json:"limit"`
+}
+
+func newInflightLimiter(cfg *config.Config) *inflightLimiter {
+	return &inflightLimiter{
+		global: &inflightGauge{limit: int64(cfg.MaxInFlight)},
+		groups: map[string]*inflightGauge{
+			"mail":     {limit: int64(cfg.MaxInFlightMail)},
+			"identity": {limit: int64(cfg.MaxInFlightIdentity)},
+			"accounts": {limit: int64(cfg.MaxInFlightAccounts)},
+		},
+	}
+}
+
+// routeGroup returns the group of the route at path, or "" if it only
+// counts against the global cap.
+func routeGroup(path string) string {
+	for _, g := range inflightGroups {
+		if strings.HasPrefix(path, g.prefix) {
+			return g.group
+		}
+	}
+	return ""
+}
+
+func (g *inflightGauge) acquire() bool {
+	if n := g.n.Add(1); g.limit > 0 && n > g.limit {
+		g.n.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (g *inflightGauge) release() { g.n.Add(-1) }
+
+// wrap counts each call of next, the handler of the route at path, against
+// the global cap and its group's, and answers 503 with Retry-After while
+// either is reached.  The slots are released however next returns, panics
+// included.
+func (l *inflightLimiter) wrap(path string, next http.HandlerFunc) http.HandlerFunc {
+	gauges := []*inflightGauge{l.global}
+	if g := l.groups[routeGroup(path)]; g != nil {
+		gauges = append(gauges, g)
+	}
+	release := func(gauges []*inflightGauge) {
+		for _, g := range gauges {
+			g.release()
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i, g := range gauges {
+			if !g.acquire() {
+				release(gauges[:i])
+				w.Header().Set("Retry-After", "1")
+				writeError(w, http.StatusServiceUnavailable, errServerBusy)
+				return
+			}
+		}
+		defer release(gauges)
+		next(w, r)
+	}
+}
+
+// stats returns the in-flight count and cap of each gauge, the global one
+// as "global"; a nil limiter reports none.
+func (l *inflightLimiter) stats() map[string]inflightStats {
+	if l == nil {
+		return nil
+	}
+	out := map[string]inflightStats{"global": l.global.stats()}
+	for name, g := range l.groups {
+		out[name] = g.stats()
+	}
+	return out
+}
+
+func (g *inflightGauge) stats() inflightStats {
+	return inflightStats{InFlight: g.n.Load(), Limit: g.limit}
+}
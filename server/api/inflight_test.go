@@ -0,0 +1,138 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"mulamail/config"
+)
+
+// blockingHandlers serves requests that signal on entered once they hold
+// their slots and keep them until release is called.
+type blockingHandlers struct {
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func newBlockingHandlers() *blockingHandlers {
+	return &blockingHandlers{entered: make(chan struct{}, 100), unblock: make(chan struct{})}
+}
+
+func (b *blockingHandlers) handle(w http.ResponseWriter, r *http.Request) {
+	b.entered <- struct{}{}
+	<-b.unblock
+}
+
+func (b *blockingHandlers) release() { close(b.unblock) }
+
+func callLimited(h http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestInflightLimiter_EnforcesCaps(t *testing.T) {
+	l := newInflightLimiter(&config.Config{MaxInFlight: 3, MaxInFlightMail: 2})
+	b := newBlockingHandlers()
+	mail := l.wrap("/api/v1/mail/inbox", b.handle)
+	identity := l.wrap("/api/v1/identity/resolve", b.handle)
+
+	// Fill the mail group.
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			callLimited(mail, "/api/v1/mail/inbox")
+		}()
+		<-b.entered
+	}
+	w := callLimited(mail, "/api/v1/mail/inbox")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("mail over its cap: want %d with Retry-After, got %d %q", http.StatusServiceUnavailable, w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Other groups still get the global slot left, and no more.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		callLimited(identity, "/api/v1/identity/resolve")
+	}()
+	<-b.entered
+	if w := callLimited(identity, "/api/v1/identity/resolve"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("over the global cap: want %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	stats := l.stats()
+	if stats["global"].InFlight != 3 || stats["mail"].InFlight != 2 || stats["identity"].InFlight != 1 {
+		t.Errorf("in flight: got %+v", stats)
+	}
+
+	b.release()
+	wg.Wait()
+	for name, s := range l.stats() {
+		if s.InFlight != 0 {
+			t.Errorf("%s: want every slot released, %d in flight", name, s.InFlight)
+		}
+	}
+	if w := callLimited(mail, "/api/v1/mail/inbox"); w.Code != http.StatusOK {
+		t.Errorf("after release: want %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestInflightLimiter_ReleasesOnPanic(t *testing.T) {
+	l := newInflightLimiter(&config.Config{MaxInFlight: 1, MaxInFlightAccounts: 1})
+	h := l.wrap("/api/v1/accounts", func(http.ResponseWriter, *http.Request) { panic("handler bug") })
+
+	for range 5 {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("want the panic to reach the server")
+				}
+			}()
+			callLimited(h, "/api/v1/accounts")
+		}()
+	}
+	for name, s := range l.stats() {
+		if s.InFlight != 0 {
+			t.Errorf("%s: want the slot released after a panic, %d in flight", name, s.InFlight)
+		}
+	}
+}
+
+func TestRouter_HealthExemptFromInflightCap(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.MaxInFlight = 1
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+
+	// A request whose body trickles in holds the only slot.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/identity/resolve-batch", pr))
+	}()
+	pw.Write([]byte("{")) // returns once the handler reads the body
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/identity/resolve?email=alice@example.com", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("saturated: want %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("health while saturated: want %d, got %d", http.StatusOK, w.Code)
+	}
+
+	pw.Close()
+	<-done
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/identity/resolve?email=alice@example.com", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("after the slot is freed: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
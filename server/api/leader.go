@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"mulamail/config"
+	"mulamail/db"
+)
+
+// Background worker roles.  With WORKER_LEASE_SECONDS set, only the
+// instance holding a role's lease in MongoDB runs that worker; the others
+// stand by and take the role over once the lease is released or expires.
+const (
+	roleOutbox     = "outbox"
+	roleScheduler  = "scheduler"
+	roleExporter   = "exporter"
+	roleArchiver   = "archiver"
+	roleEraser     = "eraser"
+	roleVaultGC    = "vault-gc"
+	roleCacheGC    = "cache-gc"
+	roleChainCheck = "chain-check"
+)
+
+// leaderReleaseBy bounds releasing a role's lease on shutdown.
+const leaderReleaseBy = 5 * time.Second
+
+// leader keeps one worker role's lease for this instance.  A nil leader
+// always leads, so that without WORKER_LEASE_SECONDS every instance runs
+// every worker, as a single instance must.
+type leader struct {
+	db     db.DB
+	role   string
+	holder string
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	until time.Time // when this instance stops acting as leader; zero when it is not
+}
+
+// newLeader returns the leader of role for this instance, or nil when
+// worker leases are disabled.
+func newLeader(database db.DB, role string, cfg *config.Config) *leader {
+	ttl := seconds(cfg.WorkerLeaseSeconds)
+	if ttl <= 0 {
+		return nil
+	}
+	return &leader{db: database, role: role, holder: workerName(), ttl: ttl, now: time.Now}
+}
+
+// leads reports whether this instance may start another batch of the
+// role's work.  It goes by its own record of the lease, which lapses a
+// quarter of the lease before the lease itself, counted from before the
+// renewal was sent: a leader cut off from MongoDB stops taking batches
+// before another instance can take the role over.
+func (l *leader) leads() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.now().Before(l.until)
+}
+
+// elect takes the lease if it is free and then, until ctx is cancelled,
+// renews it while this instance leads or tries to take it while another
+// does.  Attempts come every third of the lease, with jitter so that
+// standby instances do not all try at once.  When ctx is cancelled the
+// lease is released, so that a standby takes over without waiting for it
+// to expire.
+func (l *leader) elect(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	l.renew(ctx)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				l.release(ctx)
+				return
+			case <-time.After(l.ttl / 3 * time.Duration(75+rand.IntN(50)) / 100):
+			}
+			l.renew(ctx)
+		}
+	}()
+}
+
+// renew takes or extends the lease and records the outcome.  When MongoDB
+// cannot be reached the record is left to lapse by itself.
+func (l *leader) renew(ctx context.Context) {
+	start := l.now()
+	ok, err := l.db.AcquireRoleLease(ctx, l.role, l.holder, l.ttl)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("leader %s: renew: %v", l.role, err)
+		}
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	led := l.now().Before(l.until)
+	if ok {
+		if !led {
+			log.Printf("leader %s: %s now leads", l.role, l.holder)
+		}
+		l.until = start.Add(l.ttl - l.ttl/4)
+		return
+	}
+	if led {
+		log.Printf("leader %s: %s lost the lease", l.role, l.holder)
+	}
+	l.until = time.Time{}
+}
+
+// release gives up the lease, if this instance holds it.
+func (l *leader) release(ctx context.Context) {
+	l.mu.Lock()
+	l.until = time.Time{}
+	l.mu.Unlock()
+	releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), leaderReleaseBy)
+	defer cancel()
+	if err := l.db.ReleaseRoleLease(releaseCtx, l.role, l.holder); err != nil {
+		log.Printf("leader %s: release: %v", l.role, err)
+	}
+}
+
+// leaderStatus is the current leader of one worker role.
+type leaderStatus struct {
+	Holder       string    `json:"holder"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	ThisInstance bool      `json:"this_instance"`
+}
+
+// leaders returns the current leader of each worker role that has one.
+func (s *Server) leaders(ctx context.Context) (map[string]leaderStatus, error) {
+	leases, err := s.db.GetRoleLeases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	self := workerName()
+	leaders := make(map[string]leaderStatus, len(leases))
+	for _, l := range leases {
+		leaders[l.Role] = leaderStatus{Holder: l.Holder, ExpiresAt: l.ExpiresAt, ThisInstance: l.Holder == self}
+	}
+	return leaders, nil
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+)
+
+func newTestLeader(database db.DB, holder string, now *time.Time) *leader {
+	return &leader{db: database, role: roleOutbox, holder: holder, ttl: 20 * time.Second,
+		now: func() time.Time { return *now }}
+}
+
+func TestLeader_Election(t *testing.T) {
+	_, mockDB := setupTestServer(t)
+	ctx := context.Background()
+	now := time.Now()
+	a := newTestLeader(mockDB, "instance-a", &now)
+	b := newTestLeader(mockDB, "instance-b", &now)
+
+	a.renew(ctx)
+	b.renew(ctx)
+	if !a.leads() || b.leads() {
+		t.Fatalf("want only the first instance leading, got a=%v b=%v", a.leads(), b.leads())
+	}
+
+	// The leader stops a quarter of the lease early, before anyone else
+	// could take over, unless it renews.
+	now = now.Add(16 * time.Second)
+	if a.leads() {
+		t.Error("want the leader to stop once its record of the lease lapses")
+	}
+	a.renew(ctx)
+	if !a.leads() {
+		t.Error("want a renewal to restore leadership")
+	}
+
+	// A leader that dies without releasing is replaced once its lease expires.
+	mockDB.RoleLeases[roleOutbox] = dbtest.Lease{Holder: "instance-a", Expires: time.Now().Add(-time.Second)}
+	b.renew(ctx)
+	a.renew(ctx)
+	if !b.leads() || a.leads() {
+		t.Errorf("expired lease: want the standby leading, got a=%v b=%v", a.leads(), b.leads())
+	}
+
+	// A leader that shuts down hands over at once.
+	b.release(ctx)
+	a.renew(ctx)
+	if !a.leads() || b.leads() {
+		t.Errorf("released lease: want the standby leading, got a=%v b=%v", a.leads(), b.leads())
+	}
+}
+
+func TestLeader_Disabled(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.WorkerLeaseSeconds = 0
+	l := newLeader(mockDB, roleOutbox, server.cfg)
+	if l != nil || !l.leads() {
+		t.Error("without worker leases every instance must lead")
+	}
+	l.elect(context.Background())
+	if len(mockDB.RoleLeases) != 0 {
+		t.Errorf("want no lease taken, got %v", mockDB.RoleLeases)
+	}
+}
+
+func TestOutbox_StandbyClaimsNothing(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	asyncSend(t, server, "?async=true")
+
+	now := time.Now()
+	mockDB.AcquireRoleLease(context.Background(), roleOutbox, "other-instance", time.Minute)
+	o := newTestOutbox(server, now.Add(time.Second))
+	o.leader = newTestLeader(mockDB, "this-instance", &now)
+	o.leader.renew(context.Background())
+	o.processQueued(context.Background(), "test/0")
+
+	if m := mockDB.Outbox[0]; m.Status != db.OutboxQueued || m.Attempts != 0 {
+		t.Errorf("a standby must not claim messages, got %+v", m)
+	}
+	if n := len(fake.sent()); n != 0 {
+		t.Errorf("want no delivery, got %d", n)
+	}
+}
+
+func TestMetrics_Leaders(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+	mockDB.AcquireRoleLease(ctx, roleOutbox, workerName(), time.Minute)
+	mockDB.AcquireRoleLease(ctx, roleVaultGC, "other-instance", time.Minute)
+	mockDB.AcquireRoleLease(ctx, roleScheduler, "dead-instance", -time.Second)
+
+	w := httptest.NewRecorder()
+	server.metrics(w, httptest.NewRequest("GET", "/api/v1/admin/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp metricsResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Leaders) != 2 || !resp.Leaders[roleOutbox].ThisInstance ||
+		resp.Leaders[roleVaultGC].Holder != "other-instance" || resp.Leaders[roleVaultGC].ThisInstance {
+		t.Errorf("want the outbox led here and vault-gc elsewhere, got %+v", resp.Leaders)
+	}
+}
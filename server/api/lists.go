@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+// Values of the filter query parameter of the inbox and search, which
+// tell mailing list traffic (see mail.MailingList) from personal mail.
+const (
+	filterLists    = "lists"
+	filterPersonal = "personal"
+)
+
+// listFilter parses the optional filter query parameter: "lists",
+// "personal", or empty for all mail.
+func listFilter(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("filter"); f {
+	case "", filterLists, filterPersonal:
+		return f, nil
+	}
+	return "", errors.New("filter must be 'lists' or 'personal'")
+}
+
+// passesFilter reports whether a message, list traffic or not, is listed
+// under filter.
+func passesFilter(filter string, list bool) bool {
+	return filter == "" || list == (filter == filterLists)
+}
+
+// filterMessages returns the previews of msgs listed under filter.  A
+// message listed by its size alone cannot be classified, so any filter
+// leaves it out.
+func filterMessages(msgs []*mail.Message, filter string) []*mail.Message {
+	if filter == "" {
+		return msgs
+	}
+	out := make([]*mail.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if !m.PreviewSkipped && passesFilter(filter, m.List != nil) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// filterCached is filterMessages for cached previews.
+func filterCached(docs []db.CachedMessage, filter string) []db.CachedMessage {
+	if filter == "" {
+		return docs
+	}
+	out := make([]db.CachedMessage, 0, len(docs))
+	for _, d := range docs {
+		if passesFilter(filter, d.MailingList) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// encryptList returns l as encrypted JSON for CachedMessage.ListEnc.
+func encryptList(fc *vault.FieldCipher, l *mail.MailingList) (string, error) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	return fc.Encrypt(string(data))
+}
+
+// decryptList returns the mailing list of a cached preview, or nil for
+// personal mail.
+func decryptList(fc *vault.FieldCipher, d db.CachedMessage) (*mail.MailingList, error) {
+	if !d.MailingList {
+		return nil, nil
+	}
+	l := new(mail.MailingList)
+	if d.ListEnc == "" {
+		return l, nil
+	}
+	data, err := fc.Decrypt(d.ListEnc)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(data), l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mulamail/mail"
+)
+
+// listMessages is a mailbox of one personal message and two from mailing
+// lists, all from the same sender.
+var listMessages = map[int]string{
+	1: "From: alice@example.com\r\nSubject: Lunch\r\n\r\nbody",
+	2: "From: alice@example.com\r\nSubject: [users] Release\r\nList-Id: Example Users (announcements) <users.example.org>\r\n" +
+		"List-Post: <mailto:users@example.org>\r\nList-Archive: <https://lists.example.org/users/>\r\n\r\nbody",
+	3: "From: alice@example.com\r\nSubject: Newsletter\r\nPrecedence: bulk\r\n\r\nbody",
+}
+
+func TestFetchInbox_ListFilter(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	fake := &fakePOP3{messages: listMessages}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	inbox := func(filter string) (int, []inboxMessage) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com&filter="+filter, nil))
+		var resp struct {
+			Fetched  int            `json:"fetched"`
+			Messages []inboxMessage `json:"messages"`
+		}
+		if w.Code == http.StatusOK {
+			json.NewDecoder(w.Body).Decode(&resp) //nolint:errcheck
+			if resp.Fetched != len(listMessages) {
+				t.Errorf("filter=%s: fetched: want %d, got %d", filter, len(listMessages), resp.Fetched)
+			}
+		}
+		return w.Code, resp.Messages
+	}
+	subjects := func(msgs []inboxMessage) string {
+		var s []string
+		for _, m := range msgs {
+			s = append(s, m.Subject)
+		}
+		return strings.Join(s, "|")
+	}
+
+	code, all := inbox("")
+	if code != http.StatusOK || len(all) != 3 {
+		t.Fatalf("no filter: status %d, %d messages", code, len(all))
+	}
+	for _, m := range all {
+		switch m.ID {
+		case 1:
+			if m.List != nil {
+				t.Errorf("personal message has list %+v", m.List)
+			}
+		case 2:
+			if want := (mail.MailingList{ID: "users.example.org", Post: "users@example.org", Archive: "https://lists.example.org/users/"}); m.List == nil || *m.List != want {
+				t.Errorf("list: want %+v, got %+v", want, m.List)
+			}
+		case 3:
+			if m.List == nil || *m.List != (mail.MailingList{}) {
+				t.Errorf("bulk message: want an empty list, got %+v", m.List)
+			}
+		}
+	}
+	if _, got := inbox("lists"); subjects(got) != "[users] Release|Newsletter" && subjects(got) != "Newsletter|[users] Release" {
+		t.Errorf("filter=lists: got %q", subjects(got))
+	}
+	if _, got := inbox("personal"); subjects(got) != "Lunch" {
+		t.Errorf("filter=personal: got %q", subjects(got))
+	}
+	if code, _ := inbox("everything"); code != http.StatusBadRequest {
+		t.Errorf("unknown filter: want %d, got %d", http.StatusBadRequest, code)
+	}
+
+	// The cached index keeps the classification, encrypted.
+	for _, c := range mockDB.Cached {
+		if c.MailingList != (c.UID != "uid-1") {
+			t.Errorf("%s: mailing_list %v", c.UID, c.MailingList)
+		}
+		if strings.Contains(c.ListEnc, "users") {
+			t.Errorf("%s: cached list is not encrypted: %q", c.UID, c.ListEnc)
+		}
+	}
+	got := searchCache(t, server, "owner=owner&from=alice@example.com&filter=lists")
+	if len(got) != 2 {
+		t.Fatalf("search filter=lists: want 2, got %+v", got)
+	}
+	for _, m := range got {
+		if m.List == nil || m.UID == "uid-2" && m.List.ID != "users.example.org" {
+			t.Errorf("search: %s has list %+v", m.UID, m.List)
+		}
+	}
+	if got := searchCache(t, server, "owner=owner&from=alice@example.com&filter=personal"); len(got) != 1 || got[0].UID != "uid-1" || got[0].List != nil {
+		t.Errorf("search filter=personal: got %+v", got)
+	}
+}
+
+func TestFetchInbox_ListFilterStream(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	fake := &fakePOP3{messages: listMessages}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com&stream=true&filter=personal", nil))
+	var ids []int
+	var fetched int
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		var line struct {
+			Type    string `json:"type"`
+			ID      int    `json:"id"`
+			Fetched int    `json:"fetched"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		switch line.Type {
+		case "message":
+			ids = append(ids, line.ID)
+		case "done":
+			fetched = line.Fetched
+		}
+	}
+	if len(ids) != 1 || ids[0] != 1 || fetched != 3 {
+		t.Errorf("want message 1 of 3 fetched, got %v of %d", ids, fetched)
+	}
+}
+
+func TestSearchMessages_InvalidFilter(t *testing.T) {
+	server, _ := setupTestServer(t)
+	w := httptest.NewRecorder()
+	server.searchMessages(w, httptest.NewRequest("GET", "/api/v1/mail/search?owner=owner&from=alice@example.com&filter=bulk", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -1,71 +1,376 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"mulamail/db"
 	"mulamail/mail"
-	"mulamail/vault"
+	"mulamail/mail/dkim"
 )
 
+// addAccountRequest is the body of POST /api/v1/accounts.
+type addAccountRequest struct {
+	OwnerPubKey  string         `json:"owner_pubkey"`
+	AccountEmail string         `json:"account_email"`
+	DisplayName  string         `json:"display_name"`
+	Signature    string         `json:"signature"`
+	Preset       string         `json:"preset"`
+	POP3         serverSettings `json:"pop3"`
+	SMTP         serverSettings `json:"smtp"`
+
+	// DefaultEnvelopeFrom is the MAIL FROM (bounce) address used when a
+	// send request has no envelope_from; empty means the account email.
+	DefaultEnvelopeFrom string `json:"default_envelope_from"`
+}
+
+// accountEmailResponse identifies the account a request created or changed.
+type accountEmailResponse struct {
+	AccountEmail string `json:"account_email"`
+}
+
 // POST /api/v1/accounts
 //
 // Registers a new legacy mail account (POP3 + SMTP) for the given owner.
-// Passwords are encrypted with AES-256-GCM before being stored.
+// Passwords are encrypted with AES-256-GCM before being stored.  With
+// "preset" (see accountPresets) any server field left out is filled from the
+// provider's settings; explicit fields always win.  An owner may register
+// up to MaxAccounts accounts (see sendLimits); beyond that the request is
+// refused with 403 and the code "account_limit", and from WarnAccounts on
+// the response carries an X-Account-Limit-Warning header.
 func (s *Server) addAccount(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		OwnerPubKey  string `json:"owner_pubkey"`
-		AccountEmail string `json:"account_email"`
-		POP3         struct {
-			Host   string `json:"host"`
-			Port   int    `json:"port"`
-			User   string `json:"user"`
-			Pass   string `json:"pass"`
-			UseSSL bool   `json:"use_ssl"`
-		} `json:"pop3"`
-		SMTP struct {
-			Host   string `json:"host"`
-			Port   int    `json:"port"`
-			User   string `json:"user"`
-			Pass   string `json:"pass"`
-			UseSSL bool   `json:"use_ssl"`
-		} `json:"smtp"`
-	}
+	var req addAccountRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	owner, ok := actingOwner(r, req.OwnerPubKey)
+	if !ok {
+		writeError(w, http.StatusForbidden, errKeyOwner)
+		return
+	}
+	req.OwnerPubKey = owner
+	if err := mail.ValidateAddress(req.AccountEmail); err != nil {
+		writeError(w, http.StatusBadRequest, "account_email: "+err.Error())
+		return
+	}
+	if strings.ContainsAny(req.DisplayName, "\r\n") {
+		writeError(w, http.StatusBadRequest, "display_name must not contain line breaks")
+		return
+	}
+	signature, err := cleanSignature(req.Signature)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.DefaultEnvelopeFrom != "" {
+		if err := mail.ValidateAddress(req.DefaultEnvelopeFrom); err != nil {
+			writeError(w, http.StatusBadRequest, "default_envelope_from: "+err.Error())
+			return
+		}
+	}
+	if req.Preset != "" {
+		preset, ok := lookupPreset(req.Preset)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "unknown preset: "+req.Preset)
+			return
+		}
+		req.POP3.applyPreset(preset.POP3, req.AccountEmail)
+		req.SMTP.applyPreset(preset.SMTP, req.AccountEmail)
+	}
 
-	pop3Enc, err := vault.EncryptAESGCM(s.cfg.EncryptionKey, req.POP3.Pass)
+	if err := mail.ValidatePOP3AuthMechanism(req.POP3.AuthMechanism); err != nil {
+		writeError(w, http.StatusBadRequest, "pop3: "+err.Error())
+		return
+	}
+	if req.SMTP.AuthMechanism != "" {
+		writeError(w, http.StatusBadRequest, "smtp: auth_mechanism is not supported")
+		return
+	}
+	if req.POP3.HELOHostname != "" {
+		writeError(w, http.StatusBadRequest, "pop3: helo_hostname is not supported")
+		return
+	}
+	if req.SMTP.HELOHostname != "" {
+		if err := mail.ValidateHostname(req.SMTP.HELOHostname); err != nil {
+			writeError(w, http.StatusBadRequest, "smtp: helo_hostname: "+err.Error())
+			return
+		}
+	}
+
+	// Everything from the duplicate check to the insert runs under the
+	// owner's lock, so concurrent requests cannot both pass the check.
+	unlock, err := s.lockOwner(r.Context(), req.OwnerPubKey)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "encrypt pop3 pass: "+err.Error())
+		writeLockError(w, r, err)
 		return
 	}
-	smtpEnc, err := vault.EncryptAESGCM(s.cfg.EncryptionKey, req.SMTP.Pass)
+	defer unlock()
+	if _, err := s.db.GetMailAccount(r.Context(), req.OwnerPubKey, req.AccountEmail); err == nil {
+		writeError(w, http.StatusConflict, "account already exists")
+		return
+	} else if !errors.Is(err, db.ErrNotFound) {
+		writeInternalError(w, r, err)
+		return
+	}
+	limits, _, err := s.sendLimits(r.Context(), req.OwnerPubKey)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "encrypt smtp pass: "+err.Error())
+		writeFailure(w, r, http.StatusInternalServerError, "account limits unavailable", err)
+		return
+	}
+	n, err := s.db.CountMailAccountsByOwner(r.Context(), req.OwnerPubKey)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if !checkAccountLimit(w, limits, n) {
+		return
+	}
+
+	pop3Enc, err := s.cfg.EncryptionKey.EncryptString(req.POP3.Pass)
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "encrypt pop3 pass failed", err)
+		return
+	}
+	smtpEnc, err := s.cfg.EncryptionKey.EncryptString(req.SMTP.Pass)
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "encrypt smtp pass failed", err)
 		return
 	}
 
 	acc := &db.MailAccount{
 		OwnerPubKey:  req.OwnerPubKey,
 		AccountEmail: req.AccountEmail,
+		DisplayName:  strings.TrimSpace(req.DisplayName),
+		Signature:    signature,
 		POP3: db.POP3Settings{
 			Host: req.POP3.Host, Port: req.POP3.Port,
-			User: req.POP3.User, PassEnc: pop3Enc, UseSSL: req.POP3.UseSSL,
+			User: req.POP3.User, PassEnc: pop3Enc, UseSSL: req.POP3.useSSL(),
+			AuthMechanism: req.POP3.AuthMechanism,
 		},
 		SMTP: db.SMTPSettings{
 			Host: req.SMTP.Host, Port: req.SMTP.Port,
-			User: req.SMTP.User, PassEnc: smtpEnc, UseSSL: req.SMTP.UseSSL,
+			User: req.SMTP.User, PassEnc: smtpEnc, UseSSL: req.SMTP.useSSL(),
+			HELOHostname: req.SMTP.HELOHostname,
 		},
+		DefaultEnvelopeFrom: req.DefaultEnvelopeFrom,
 	}
 	if err := s.db.CreateMailAccount(r.Context(), acc); err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeInternalError(w, r, err)
+		return
+	}
+	warnAccountLimit(w, limits, n+1)
+	writeJSON(w, http.StatusCreated, accountEmailResponse{AccountEmail: acc.AccountEmail})
+}
+
+// serverSettings is the POP3 or SMTP part of an addAccount request.  UseSSL
+// is a pointer so an explicit false can override a preset.
+type serverSettings struct {
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	User   string `json:"user"`
+	Pass   string `json:"pass"`
+	UseSSL *bool  `json:"use_ssl"`
+
+	// AuthMechanism selects POP3 authentication: "user" (USER/PASS, the
+	// default), "apop", or "auto" for APOP when the server offers it.
+	AuthMechanism string `json:"auth_mechanism,omitempty"`
+
+	// HELOHostname is the name the SMTP client announces in EHLO/HELO;
+	// empty means SMTP_HELO_HOSTNAME, or this host's detected FQDN.
+	HELOHostname string `json:"helo_hostname,omitempty"`
+}
+
+// applyPreset fills the fields the client left empty from p.  Providers
+// expect the full address as the username, so that is the default too.
+func (ss *serverSettings) applyPreset(p serverPreset, email string) {
+	if p.Host == "" {
+		return
+	}
+	if ss.Host == "" {
+		ss.Host = p.Host
+	}
+	if ss.Port == 0 {
+		ss.Port = p.Port
+	}
+	if ss.UseSSL == nil {
+		ss.UseSSL = &p.UseSSL
+	}
+	if ss.User == "" {
+		ss.User = email
+	}
+}
+
+func (ss *serverSettings) useSSL() bool {
+	return ss.UseSSL != nil && *ss.UseSSL
+}
+
+// updateAccountRequest is the body of PATCH /api/v1/accounts.
+type updateAccountRequest struct {
+	OwnerPubKey  string  `json:"owner_pubkey"`
+	AccountEmail string  `json:"account_email"`
+	DisplayName  *string `json:"display_name"`
+	Signature    *string `json:"signature"`
+
+	DefaultEnvelopeFrom *string `json:"default_envelope_from"`
+	SMTPMaxSessions     *int    `json:"smtp_max_sessions"`
+	SMTPHELOHostname    *string `json:"smtp_helo_hostname"`
+}
+
+// maxSMTPSessions caps smtp_max_sessions: relay services that allow
+// concurrent sessions still limit them.
+const maxSMTPSessions = 16
+
+// PATCH /api/v1/accounts
+//
+// Updates the display name, signature, default envelope sender, SMTP
+// session limit and/or EHLO hostname of an existing account.  Omitted
+// fields are left unchanged; an empty string clears the value, and
+// smtp_max_sessions 0 restores the default of one session at a time (see
+// acquireSMTPSession).
+//
+// Request: { "owner_pubkey": "...", "account_email": "...", "display_name": "...", "signature": "...", "default_envelope_from": "...", "smtp_max_sessions": 4, "smtp_helo_hostname": "mx1.example.com" }
+func (s *Server) updateAccount(w http.ResponseWriter, r *http.Request) {
+	var req updateAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusCreated, map[string]string{"account_email": acc.AccountEmail})
+	owner, ok := actingOwner(r, req.OwnerPubKey)
+	if !ok {
+		writeError(w, http.StatusForbidden, errKeyOwner)
+		return
+	}
+	req.OwnerPubKey = owner
+	if req.DisplayName == nil && req.Signature == nil && req.DefaultEnvelopeFrom == nil && req.SMTPMaxSessions == nil &&
+		req.SMTPHELOHostname == nil {
+		writeError(w, http.StatusBadRequest, "nothing to update")
+		return
+	}
+
+	var profile db.MailAccountProfile
+	if req.DisplayName != nil {
+		if strings.ContainsAny(*req.DisplayName, "\r\n") {
+			writeError(w, http.StatusBadRequest, "display_name must not contain line breaks")
+			return
+		}
+		name := strings.TrimSpace(*req.DisplayName)
+		profile.DisplayName = &name
+	}
+	if req.Signature != nil {
+		sig, err := cleanSignature(*req.Signature)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		profile.Signature = &sig
+	}
+	if req.DefaultEnvelopeFrom != nil {
+		if *req.DefaultEnvelopeFrom != "" {
+			if err := mail.ValidateAddress(*req.DefaultEnvelopeFrom); err != nil {
+				writeError(w, http.StatusBadRequest, "default_envelope_from: "+err.Error())
+				return
+			}
+		}
+		profile.DefaultEnvelopeFrom = req.DefaultEnvelopeFrom
+	}
+	if req.SMTPMaxSessions != nil {
+		if n := *req.SMTPMaxSessions; n < 0 || n > maxSMTPSessions {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("smtp_max_sessions must be between 0 and %d", maxSMTPSessions))
+			return
+		}
+		profile.SMTPMaxSessions = req.SMTPMaxSessions
+	}
+	if req.SMTPHELOHostname != nil {
+		if *req.SMTPHELOHostname != "" {
+			if err := mail.ValidateHostname(*req.SMTPHELOHostname); err != nil {
+				writeError(w, http.StatusBadRequest, "smtp_helo_hostname: "+err.Error())
+				return
+			}
+		}
+		profile.SMTPHELOHostname = req.SMTPHELOHostname
+	}
+
+	unlock, err := s.lockOwner(r.Context(), req.OwnerPubKey)
+	if err != nil {
+		writeLockError(w, r, err)
+		return
+	}
+	defer unlock()
+	err = s.db.UpdateMailAccountProfile(r.Context(), req.OwnerPubKey, req.AccountEmail, profile)
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, accountEmailResponse{AccountEmail: req.AccountEmail})
+}
+
+// maxSignatureBytes caps account signatures; anything longer is a letterhead,
+// not a signature.
+const maxSignatureBytes = 1024
+
+// cleanSignature validates a signature for storage.  Only printable text,
+// tabs and line breaks are allowed, and trailing whitespace is trimmed so the
+// appended block doesn't end in blank lines.
+func cleanSignature(sig string) (string, error) {
+	if len(sig) > maxSignatureBytes {
+		return "", fmt.Errorf("signature exceeds %d bytes", maxSignatureBytes)
+	}
+	for _, r := range sig {
+		if unicode.IsControl(r) && r != '\t' && r != '\r' && r != '\n' {
+			return "", errors.New("signature contains control characters")
+		}
+	}
+	return strings.TrimRightFunc(sig, unicode.IsSpace), nil
+}
+
+// appendSignature adds sig to a plain-text body below the conventional
+// "-- " separator line (RFC 3676 section 4.3).
+func appendSignature(body, sig string) string {
+	if sig == "" {
+		return body
+	}
+	if body != "" && !strings.HasSuffix(body, "\n") {
+		body += "\r\n"
+	}
+	return body + "-- \r\n" + sig
+}
+
+// appendHTMLSignature adds sig to an HTML body as a block of its own, with
+// the same separator, before the closing body tag if there is one.  The
+// signature is plain text: it is escaped and its line breaks become <br>.
+func appendHTMLSignature(body, sig string) string {
+	if sig == "" || body == "" {
+		return body
+	}
+	text := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(sig)
+	block := `<div class="signature">-- <br>` + strings.ReplaceAll(html.EscapeString(text), "\n", "<br>") + `</div>`
+	const closing = "</body>"
+	for i := len(body) - len(closing); i >= 0; i-- {
+		if strings.EqualFold(body[i:i+len(closing)], closing) {
+			return body[:i] + block + body[i:]
+		}
+	}
+	return body + block
 }
 
 // GET /api/v1/accounts?owner=<pubkey>
@@ -77,7 +382,7 @@ func (s *Server) listAccounts(w http.ResponseWriter, r *http.Request) {
 	}
 	accs, err := s.db.GetMailAccountsByOwner(r.Context(), owner)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeInternalError(w, r, err)
 		return
 	}
 	writeJSON(w, http.StatusOK, accs)
@@ -88,90 +393,630 @@ func (s *Server) listAccounts(w http.ResponseWriter, r *http.Request) {
 // connectPOP3 loads the account from the DB, decrypts the password, connects,
 // and authenticates.  The caller is responsible for calling client.Close().
 func (s *Server) connectPOP3(r *http.Request) (*mail.POP3Client, error) {
+	_, client, err := s.connectAccount(r)
+	return client, err
+}
+
+// connectAccount is connectPOP3 for callers that also need the account.
+func (s *Server) connectAccount(r *http.Request) (*db.MailAccount, *mail.POP3Client, error) {
 	owner := r.URL.Query().Get("owner")
 	account := r.URL.Query().Get("account")
 
 	acc, err := s.db.GetMailAccount(r.Context(), owner, account)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	client, err := s.dialPOP3(r.Context(), acc)
+	if err != nil {
+		return nil, nil, err
 	}
+	return acc, client, nil
+}
 
-	pass, err := vault.DecryptAESGCM(s.cfg.EncryptionKey, acc.POP3.PassEnc)
+// dialPOP3 decrypts the account's POP3 password, connects, and authenticates.
+// The outcome of the login is recorded in the account's health.  The caller
+// is responsible for calling client.Close().
+func (s *Server) dialPOP3(ctx context.Context, acc *db.MailAccount) (*mail.POP3Client, error) {
+	client, err := s.newPOP3Client(acc, s.debugTrace("pop3", acc))
 	if err != nil {
 		return nil, err
 	}
+	err = client.Connect(ctx)
+	if err == nil {
+		err = client.Auth(ctx)
+	}
+	s.recordLogin(ctx, acc, err)
+	if err != nil {
+		client.Close() // Auth zeroes the password; this covers connect failures
+		return nil, err
+	}
+	return client, nil
+}
 
-	client := mail.NewPOP3Client(mail.POP3Config{
+// newPOP3Client decrypts the account's POP3 password and prepares a client
+// for it, in the manner of newSMTPClient.
+func (s *Server) newPOP3Client(acc *db.MailAccount, trace *mail.Trace) (*mail.POP3Client, error) {
+	dialer, err := s.mailDialer()
+	if err != nil {
+		return nil, err
+	}
+	pass, err := s.cfg.EncryptionKey.Decrypt(acc.POP3.PassEnc)
+	if err != nil {
+		return nil, err
+	}
+	return mail.NewPOP3Client(mail.POP3Config{
 		Host: acc.POP3.Host, Port: acc.POP3.Port,
 		User: acc.POP3.User, Pass: pass, UseSSL: acc.POP3.UseSSL,
-	})
-	if err := client.Connect(); err != nil {
-		return nil, err
+		Dialer: dialer,
+		// An account set to "apop" never sends its password in the clear;
+		// "auto" prefers APOP but will.
+		AuthMechanism: acc.POP3.AuthMechanism,
+		APOPFallback:  acc.POP3.AuthMechanism == mail.POP3AuthAuto,
+		Trace:         trace,
+	}), nil
+}
+
+// newSMTPClient decrypts the account's SMTP password and prepares a client
+// for it, recording the session in trace when it is not nil.  The caller
+// connects, authenticates and eventually calls Close, which zeroes the
+// password if Auth has not already.
+func (s *Server) newSMTPClient(acc *db.MailAccount, trace *mail.Trace) (*mail.SMTPClient, error) {
+	dialer, err := s.mailDialer()
+	if err != nil {
+		return nil, fmt.Errorf("outbound dialer: %w", err)
 	}
-	if err := client.Auth(); err != nil {
-		client.Close()
+	keys, err := s.dkimKeys()
+	if err != nil {
 		return nil, err
 	}
-	return client, nil
+	pass, err := s.cfg.EncryptionKey.Decrypt(acc.SMTP.PassEnc)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return mail.NewSMTPClient(mail.SMTPConfig{
+		Host: acc.SMTP.Host, Port: acc.SMTP.Port,
+		User: acc.SMTP.User, Pass: pass, UseSSL: acc.SMTP.UseSSL,
+		Dialer: dialer, DKIM: keys, Trace: trace,
+		HELOHostname: s.heloHostname(acc),
+	}), nil
 }
 
-// GET /api/v1/mail/inbox?owner=<pubkey>&account=<email>&limit=<N>
-//
-// Connects to the POP3 server, lists messages, and fetches headers for the
-// most recent ones (newest first).  Default limit is 20.
-func (s *Server) fetchInbox(w http.ResponseWriter, r *http.Request) {
-	client, err := s.connectPOP3(r)
+// heloHostname returns the name acc's SMTP sessions announce in EHLO/HELO:
+// the account's own, else SMTP_HELO_HOSTNAME, else this host's FQDN.
+func (s *Server) heloHostname(acc *db.MailAccount) string {
+	if acc.SMTP.HELOHostname != "" {
+		return acc.SMTP.HELOHostname
+	}
+	if s.cfg.SMTPHELOHostname != "" {
+		return s.cfg.SMTPHELOHostname
+	}
+	return mail.LocalHostname()
+}
+
+// mailTrace returns a trace of a session with the account's POP3 or SMTP
+// server keeping its latest limit lines.  At LOG_LEVEL=debug the lines are
+// logged as well, as they are recorded.
+func (s *Server) mailTrace(protocol string, acc *db.MailAccount, limit int) *mail.Trace {
+	trace := mail.NewTrace(limit)
+	if s.cfg.LogLevel == "debug" {
+		trace.OnEntry = func(e mail.TraceEntry) {
+			log.Printf("%s trace %s/%s: %s %s", protocol, acc.OwnerPubKey, acc.AccountEmail, e.Dir, e.Line)
+		}
+	}
+	return trace
+}
+
+// debugTrace returns the trace logging a session at LOG_LEVEL=debug, and
+// nil otherwise.
+func (s *Server) debugTrace(protocol string, acc *db.MailAccount) *mail.Trace {
+	if s.cfg.LogLevel != "debug" {
+		return nil
+	}
+	return s.mailTrace(protocol, acc, 1)
+}
+
+// smtpStageError records which step of an SMTP exchange failed, so handlers
+// can map it to an HTTP status.
+type smtpStageError struct {
+	stage string // "SMTP connect", "SMTP handshake", "SMTP auth" or "SMTP send"
+	err   error
+}
+
+func (e *smtpStageError) Error() string { return e.stage + ": " + e.err.Error() }
+func (e *smtpStageError) Unwrap() error { return e.err }
+
+// deliverSMTP performs one complete SMTP session for req: connect,
+// handshake, authenticate, send and quit.
+func (s *Server) deliverSMTP(ctx context.Context, acc *db.MailAccount, req mail.SendRequest) (*mail.SendResult, error) {
+	client, err := s.newSMTPClient(acc, s.debugTrace("smtp", acc))
 	if err != nil {
-		writeError(w, http.StatusServiceUnavailable, err.Error())
-		return
+		return nil, err
 	}
 	defer client.Close()
 
+	if err := client.Connect(ctx); err != nil {
+		return nil, &smtpStageError{"SMTP connect", err}
+	}
+	if err := client.Handshake(ctx); err != nil {
+		return nil, &smtpStageError{"SMTP handshake", err}
+	}
+	if err := client.Auth(ctx); err != nil {
+		return nil, &smtpStageError{"SMTP auth", err}
+	}
+	res, err := client.Send(ctx, req)
+	if err != nil {
+		return nil, &smtpStageError{"SMTP send", err}
+	}
+	return res, nil
+}
+
+// sendRetryBackoff is the pause before the first retry of a transient send
+// failure; it doubles on each further retry.
+var sendRetryBackoff = 250 * time.Millisecond
+
+// sendWithRetry runs deliverSMTP, retrying transient and network failures
+// on a fresh session up to cfg.SMTPSendRetries times.  Failures where the
+// server may already hold the message are never retried, nor is
+// greylisting, which lasts minutes rather than milliseconds.  It returns
+// the number of attempts made.
+func (s *Server) sendWithRetry(ctx context.Context, acc *db.MailAccount, req mail.SendRequest) (*mail.SendResult, int, error) {
+	backoff := sendRetryBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := s.deliverSMTP(ctx, acc, req)
+		if err == nil || attempt > s.cfg.SMTPSendRetries || !mail.Retryable(err) {
+			return res, attempt, err
+		}
+		if _, ok := mail.Greylisted(err); ok {
+			return res, attempt, err
+		}
+		log.Printf("[%s] send: attempt %d failed, retrying in %v: %v", requestID(ctx), attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, attempt, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// mailDialer returns the outbound dialer configured for POP3/SMTP traffic.
+func (s *Server) mailDialer() (mail.Dialer, error) {
+	return mail.NewDialer(s.cfg.OutboundProxy.Reveal(), s.cfg.OutboundBindIP)
+}
+
+// dkimKeys returns the DKIM signing keys for outbound mail.
+func (s *Server) dkimKeys() (dkim.Keys, error) {
+	return dkim.LoadKeys(s.cfg.DKIMKeys)
+}
+
+// previewMaxBytes returns the size above which inbox messages are listed
+// without their headers: the preview_max_bytes query parameter, or
+// INBOX_PREVIEW_MAX_BYTES.  0 fetches every preview.
+func (s *Server) previewMaxBytes(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("preview_max_bytes")
+	if v == "" {
+		return s.cfg.InboxPreviewMaxBytes, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("preview_max_bytes must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// includeDuplicates reports whether the client asked for every copy of a
+// message listed more than once; see mail.Dedup.
+func includeDuplicates(r *http.Request) bool {
+	return r.URL.Query().Get("include_duplicates") == "true"
+}
+
+// includeSnippets reports whether the client asked for a snippet of each
+// message body, which costs the first mail.SnippetLines lines of each.
+func includeSnippets(r *http.Request) bool {
+	return r.URL.Query().Get("snippets") == "true"
+}
+
+// inboxLimit parses the optional limit query parameter (default 20).
+func inboxLimit(r *http.Request) int {
 	limit := 20
 	if l := r.URL.Query().Get("limit"); l != "" {
 		if n, e := strconv.Atoi(l); e == nil && n > 0 {
 			limit = n
 		}
 	}
+	return limit
+}
 
-	list, err := client.List()
+// skippedMessage records a preview that could not be fetched.
+type skippedMessage struct {
+	ID    int    `json:"id"`
+	Error string `json:"error"`
+}
+
+// inboxPreview is the result of fetchPreviews.
+type inboxPreview struct {
+	Total    int
+	Messages []*mail.Message
+	Skipped  []skippedMessage
+}
+
+// fetchPreviews lists the mailbox and fetches headers for the most recent
+// limit messages, ordered newest first by parsed Date, and with snippets
+// the start of their bodies for a Snippet (see topPreview).  Messages whose
+// TOP fails are logged and reported in Skipped rather than failing the
+// listing.  Messages larger than maxBytes, unless it is 0, are listed by
+// their size alone, with PreviewSkipped set: a huge message may have a
+// header block that takes seconds to TOP.
+func fetchPreviews(ctx context.Context, client *mail.POP3Client, limit, maxBytes int, snippets bool) (*inboxPreview, error) {
+	list, err := client.List(ctx)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "POP3 LIST: "+err.Error())
-		return
+		return nil, fmt.Errorf("POP3 LIST: %w", err)
+	}
+	return previewList(ctx, client, list, limit, maxBytes, snippets), nil
+}
+
+// previewList is fetchPreviews for an already retrieved LIST.
+func previewList(ctx context.Context, client *mail.POP3Client, list []mail.Message, limit, maxBytes int, snippets bool) *inboxPreview {
+	recent := recentMessages(list, limit)
+	p := &inboxPreview{
+		Total:    len(list),
+		Messages: make([]*mail.Message, 0, len(recent)),
+		Skipped:  make([]skippedMessage, 0),
+	}
+	for _, item := range recent {
+		if tooLargeToPreview(item, maxBytes) {
+			p.Messages = append(p.Messages, &mail.Message{ID: item.ID, Size: item.Size, PreviewSkipped: true})
+			continue
+		}
+		msg, err := topPreview(ctx, client, item.ID, snippets)
+		if err != nil {
+			log.Printf("[%s] inbox: skipped message %d: %v", requestID(ctx), item.ID, err)
+			p.Skipped = append(p.Skipped, skippedMessage{ID: item.ID, Error: publicError(err)})
+			continue
+		}
+		msg.Size = item.Size
+		attachBounce(ctx, client, msg)
+		p.Messages = append(p.Messages, msg)
+	}
+	mail.SortNewestFirst(p.Messages)
+	return p
+}
+
+// topPreview fetches the preview of message id: its headers and, with
+// snippets, the first mail.SnippetLines lines of its body, of which only
+// the Snippet is kept.
+func topPreview(ctx context.Context, client *mail.POP3Client, id int, snippets bool) (*mail.Message, error) {
+	lines := 0
+	if snippets {
+		lines = mail.SnippetLines
+	}
+	msg, err := client.Top(ctx, id, lines)
+	if err != nil {
+		return nil, err
 	}
+	msg.Body = ""
+	return msg, nil
+}
+
+// tooLargeToPreview reports whether a listed message is listed without its
+// headers under the size threshold maxBytes.
+func tooLargeToPreview(item mail.Message, maxBytes int) bool {
+	return maxBytes > 0 && item.Size > maxBytes
+}
 
+// recentMessages returns the most recent limit entries of a LIST, in
+// ascending index order.
+func recentMessages(list []mail.Message, limit int) []mail.Message {
 	// Take the tail of the list (POP3 indices ascend; newest = highest index).
 	start := len(list) - limit
 	if start < 0 {
 		start = 0
 	}
-	recent := list[start:]
+	return list[start:]
+}
+
+// sanitizeError reduces an upstream error to a short single-line string.
+// Network errors are collapsed so local and remote socket addresses are not
+// disclosed; anything else keeps its text, so errors that may not come from
+// a mail server reach clients through publicError instead.
+func sanitizeError(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return "network timeout"
+		}
+		return "network error"
+	}
+	msg := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, err.Error())
+	if len(msg) > 200 {
+		msg = msg[:200]
+	}
+	return msg
+}
+
+// inboxResponse is the buffered (non-streamed) inbox listing.
+type inboxResponse struct {
+	Account    string           `json:"account"`
+	Total      int              `json:"total"`
+	Fetched    int              `json:"fetched"`
+	Skipped    int              `json:"skipped"`
+	SkippedIDs []skippedMessage `json:"skipped_ids"`
+	Duplicates int              `json:"duplicates"` // fetched previews left out as copies of others
+	Messages   []inboxMessage   `json:"messages"`
+	Sizes      inboxSizes       `json:"sizes"`
+}
+
+// inboxSizeBounds are the upper bounds of the inbox size histogram's
+// buckets; a last bucket holds the larger messages.
+var inboxSizeBounds = []int{100 << 10, 1 << 20, 10 << 20}
+
+// sizeBucket counts the listed messages of at least MinBytes and under
+// MaxBytes; the last bucket has no MaxBytes.
+type sizeBucket struct {
+	MinBytes int `json:"min_bytes"`
+	MaxBytes int `json:"max_bytes,omitempty"`
+	Count    int `json:"count"`
+}
+
+// inboxSizes summarises the sizes of every message in the mailbox, not
+// just the previewed ones, so a client can warn before opening a large
+// message.
+type inboxSizes struct {
+	Buckets    []sizeBucket `json:"buckets"`
+	Largest    int          `json:"largest"`
+	TotalBytes int          `json:"total_bytes"`
+}
+
+// summarizeSizes builds the size histogram of a LIST.
+func summarizeSizes(list []mail.Message) inboxSizes {
+	sizes := inboxSizes{Buckets: make([]sizeBucket, len(inboxSizeBounds)+1)}
+	for i, bound := range inboxSizeBounds {
+		sizes.Buckets[i].MaxBytes = bound
+		sizes.Buckets[i+1].MinBytes = bound
+	}
+	for _, m := range list {
+		i := 0
+		for i < len(inboxSizeBounds) && m.Size >= inboxSizeBounds[i] {
+			i++
+		}
+		sizes.Buckets[i].Count++
+		sizes.Largest = max(sizes.Largest, m.Size)
+		sizes.TotalBytes += m.Size
+	}
+	return sizes
+}
+
+// GET /api/v1/mail/inbox?owner=<pubkey>&account=<email>&limit=<N>[&preview_max_bytes=<N>][&include_duplicates=true][&filter=lists|personal]
+//
+// Connects to the POP3 server, lists messages, and fetches headers for the
+// most recent ones (newest first).  Default limit is 20.  The response
+// reports how many previews were fetched and which were skipped; a failed
+// LIST is a 502 so it cannot be mistaken for an empty mailbox.
+//
+// Messages larger than preview_max_bytes (default INBOX_PREVIEW_MAX_BYTES;
+// 0 for no limit) come with only their size and preview_skipped set.  The
+// sizes histogram covers the whole mailbox.
+//
+// A message the server lists more than once, under the same Message-ID (see
+// mail.DedupKey), is shown once, the smallest copy standing for the others
+// with their number in duplicates; include_duplicates=true lists every
+// copy.  All copies are cached.
+//
+// With snippets=true each message also carries a snippet of its body (see
+// mail.Snippet), from the first mail.SnippetLines lines fetched with TOP;
+// snippets are cached with the previews.
+//
+// Each message sent through a mailing list carries list, its List-Id,
+// List-Post address and List-Archive URL (see mail.MailingList).
+// filter=lists keeps only such messages and filter=personal only the
+// others; both leave out messages listed by their size alone.  The filter
+// applies to the limit most recent messages, so fewer may be listed, and
+// every one fetched is still cached and counted in fetched.
+//
+// With Accept: application/x-ndjson or stream=true the previews are
+// streamed instead; see streamInbox.
+//
+// The response carries a weak ETag derived from the mailbox listing; when it
+// matches If-None-Match the handler answers 304 after only LIST and UIDL.
+//
+// Each message carries sender_identity, the pubkey and verified flag of the
+// MulaMail identity its From address resolves to, or null.
+func (s *Server) fetchInbox(w http.ResponseWriter, r *http.Request) {
+	owner, account := r.URL.Query().Get("owner"), r.URL.Query().Get("account")
+	maxBytes, err := s.previewMaxBytes(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := listFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	acc, client, err := s.connectAccount(r)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			s.recordFetch(r.Context(), owner, account, 0, err)
+		}
+		writeMailError(w, r, http.StatusServiceUnavailable, "", err)
+		return
+	}
+	defer client.Close()
+
+	list, err := client.List(r.Context())
+	s.recordFetch(r.Context(), owner, account, len(list), err)
+	if err != nil {
+		writeMailError(w, r, http.StatusBadGateway, "POP3 LIST", err)
+		return
+	}
+	limit, stream, dups, snippets := inboxLimit(r), wantsNDJSON(r), includeDuplicates(r), includeSnippets(r)
+	uids, _ := client.UIDLs(r.Context()) // nil when the server lacks UIDL
+	etag := inboxETag(list, uids, limit, maxBytes, stream, dups, snippets, filter)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if stream {
+		s.streamInbox(w, r, acc, client, list, limit, maxBytes, dups, snippets, filter)
+		return
+	}
+
+	p := previewList(r.Context(), client, list, limit, maxBytes, snippets)
+	s.cachePreviews(r.Context(), client, acc.OwnerPubKey, acc.AccountEmail, p.Messages)
+
+	msgs := p.Messages
+	if !dups {
+		msgs = mail.Dedup(msgs)
+	}
+	writeJSON(w, http.StatusOK, inboxResponse{
+		Account:    account,
+		Total:      p.Total,
+		Fetched:    len(p.Messages),
+		Skipped:    len(p.Skipped),
+		SkippedIDs: p.Skipped,
+		Duplicates: len(p.Messages) - len(msgs),
+		Messages:   s.withSenders(r.Context(), filterMessages(msgs, filter)),
+		Sizes:      summarizeSizes(list),
+	})
+}
+
+// wantsNDJSON reports whether the client asked for a streamed response.
+func wantsNDJSON(r *http.Request) bool {
+	return r.URL.Query().Get("stream") == "true" ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// streamedPreview is one message line of a streamed inbox.
+type streamedPreview struct {
+	Type string `json:"type"` // always "message"
+	*mail.Message
+}
+
+// streamInbox writes the inbox as newline-delimited JSON, flushing one
+// {"type":"message",...} object as each TOP completes, in descending index
+// order rather than by parsed Date.  A {"type":"done"} trailer carries the
+// same totals and sizes as the buffered response, and sender_identities,
+// mapping each From header to its sender identity: they are resolved in one
+// batch once the messages are known, not per line.  Once streaming has
+// begun, a lost connection or cancelled request ends the stream with a
+// {"type":"error"} object instead.
+//
+// Unless dups is set, a copy of a message already streamed is left out, so
+// the copy kept is the first streamed rather than the smallest; the
+// trailer's duplicate_ids maps the ID of each message kept to the number of
+// its copies left out.  Messages filter leaves out are not streamed, but
+// count in the trailer like the others.
+func (s *Server) streamInbox(w http.ResponseWriter, r *http.Request, acc *db.MailAccount, client *mail.POP3Client, list []mail.Message, limit, maxBytes int, dups, snippets bool, filter string) {
+	ctx := r.Context()
+	recent := recentMessages(list, limit)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	emit := func(v any) {
+		enc.Encode(v) //nolint:errcheck
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
 
-	// Fetch headers in reverse order so the response is newest-first.
-	messages := make([]any, 0, len(recent))
+	messages := make([]*mail.Message, 0, len(recent))
+	skipped := make([]skippedMessage, 0)
+	streamed := make(map[string]int)  // dedup key -> ID of the copy streamed
+	duplicateIDs := make(map[int]int) // streamed ID -> copies left out
 	for i := len(recent) - 1; i >= 0; i-- {
-		msg, err := client.Top(recent[i].ID, 0)
+		item := recent[i]
+		if tooLargeToPreview(item, maxBytes) {
+			msg := &mail.Message{ID: item.ID, Size: item.Size, PreviewSkipped: true}
+			messages = append(messages, msg)
+			if filter == "" {
+				emit(streamedPreview{Type: "message", Message: msg})
+			}
+			continue
+		}
+		msg, err := topPreview(ctx, client, item.ID, snippets)
 		if err != nil {
-			continue // skip messages that fail
+			if ctx.Err() != nil || mail.Classify(err) == mail.KindNetwork {
+				log.Printf("[%s] inbox: stream aborted at message %d: %v", requestID(ctx), item.ID, err)
+				emit(map[string]string{"type": "error", "error": publicError(err)})
+				return
+			}
+			log.Printf("[%s] inbox: skipped message %d: %v", requestID(ctx), item.ID, err)
+			skipped = append(skipped, skippedMessage{ID: item.ID, Error: publicError(err)})
+			continue
 		}
-		msg.Size = recent[i].Size
+		msg.Size = item.Size
+		attachBounce(ctx, client, msg)
 		messages = append(messages, msg)
+		if key := msg.DedupKey(); key != "" && !dups {
+			if id, ok := streamed[key]; ok {
+				duplicateIDs[id]++
+				continue
+			}
+			streamed[key] = msg.ID
+		}
+		if passesFilter(filter, msg.List != nil) {
+			emit(streamedPreview{Type: "message", Message: msg})
+		}
 	}
-
-	writeJSON(w, http.StatusOK, map[string]any{
-		"account":  r.URL.Query().Get("account"),
-		"total":    len(list),
-		"messages": messages,
+	froms := make([]string, len(messages))
+	for i, m := range messages {
+		froms[i] = m.From
+	}
+	duplicates := 0
+	for _, n := range duplicateIDs {
+		duplicates += n
+	}
+	emit(map[string]any{
+		"type":              "done",
+		"account":           r.URL.Query().Get("account"),
+		"total":             len(list),
+		"fetched":           len(messages),
+		"skipped":           len(skipped),
+		"skipped_ids":       skipped,
+		"duplicates":        duplicates,
+		"duplicate_ids":     duplicateIDs,
+		"sender_identities": s.resolveSenders(ctx, froms),
+		"sizes":             summarizeSizes(list),
 	})
+	s.cachePreviews(ctx, client, acc.OwnerPubKey, acc.AccountEmail, messages)
+}
+
+// rawMessageResponse carries a complete RFC 5322 message.  Raw is for
+// download and parsing; a web client renders HTMLSanitized.
+type rawMessageResponse struct {
+	Raw           string `json:"raw"`
+	HTMLSanitized string `json:"html_sanitized,omitempty"` // the HTML body made safe to render, when there is one
+	HTML          string `json:"html,omitempty"`           // the HTML body as sent, only with unsafe=true
 }
 
-// GET /api/v1/mail/message?owner=<pubkey>&account=<email>&id=<msg-id>
+// GET /api/v1/mail/message?owner=<pubkey>&account=<email>&id=<msg-id>[&unsafe=true][&format=eml]
 //
-// Downloads the full raw message via RETR.
+// Downloads the full raw message via RETR.  When the server supports UIDL
+// the response carries a weak ETag, and a matching If-None-Match is answered
+// with 304 without downloading the message.  A message with an HTML body
+// also carries it sanitized (see mail.SanitizeHTML), its cid: images
+// pointing at /api/v1/mail/attachment; the HTML as sent, which must never
+// be rendered as it stands, is included only with unsafe=true.  With
+// format=eml the message itself is the response, as a message/rfc822
+// attachment (see writeEML).
 func (s *Server) fetchMessage(w http.ResponseWriter, r *http.Request) {
-	client, err := s.connectPOP3(r)
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "eml" {
+		writeError(w, http.StatusBadRequest, "format must be json or eml")
+		return
+	}
+	acc, client, err := s.connectAccount(r)
 	if err != nil {
-		writeError(w, http.StatusServiceUnavailable, err.Error())
+		writeMailError(w, r, http.StatusServiceUnavailable, "", err)
 		return
 	}
 	defer client.Close()
@@ -182,29 +1027,288 @@ func (s *Server) fetchMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	raw, err := client.Retrieve(id)
+	uid, err := client.UIDL(r.Context(), id)
+	if err == nil {
+		etag := messageETag(uid)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if format == "eml" {
+		s.writeEML(w, r, client, acc, id, uid)
+		return
+	}
+	raw, err := client.Retrieve(r.Context(), id)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "POP3 RETR: "+err.Error())
+		writeMailError(w, r, http.StatusInternalServerError, "POP3 RETR", err)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]string{"raw": raw})
+	resp := rawMessageResponse{Raw: raw}
+	if body, ok := htmlBody(raw); ok {
+		q := r.URL.Query()
+		resp.HTMLSanitized = mail.SanitizeHTML(body, func(cid string) string {
+			return "/api/v1/mail/attachment?" + url.Values{
+				"owner": {q.Get("owner")}, "account": {q.Get("account")}, "id": {strconv.Itoa(id)}, "part": {cid},
+			}.Encode()
+		})
+		if q.Get("unsafe") == "true" {
+			resp.HTML = body
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// writeEML answers with message id as a download named after its UIDL (or,
+// on servers without UIDL, its number).  A copy cached in the vault is
+// served whole, with its length.  Otherwise the message is copied from RETR
+// as it arrives and never held in memory; headers are committed with the
+// first bytes, so a failure after that can only be logged and the response
+// truncated.
+func (s *Server) writeEML(w http.ResponseWriter, r *http.Request, client *mail.POP3Client, acc *db.MailAccount, id int, uid string) {
+	name := uid
+	if name == "" {
+		name = strconv.Itoa(id)
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name + ".eml"})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	header := func() {
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", disposition)
+	}
+
+	if uid != "" && s.storage != nil {
+		if raw, err := s.storage.Get(r.Context(), messageCacheKey(acc.OwnerPubKey, acc.AccountEmail, uid)); err == nil {
+			header()
+			w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(raw) //nolint:errcheck
+			return
+		}
+	}
+
+	out := &emlWriter{w: w, header: header}
+	if _, err := client.RetrieveTo(r.Context(), id, out); err != nil {
+		if !out.started {
+			writeMailError(w, r, http.StatusInternalServerError, "POP3 RETR", err)
+			return
+		}
+		log.Printf("[%s] message: stream message %d: %v", requestID(r.Context()), id, err)
+		return
+	}
+	if !out.started {
+		header() // an empty message
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// emlWriter sets the download headers on the first write, so that an error
+// before any of the message arrives can still be answered as one.
+type emlWriter struct {
+	w       http.ResponseWriter
+	header  func()
+	started bool
+}
+
+func (e *emlWriter) Write(p []byte) (int, error) {
+	if !e.started {
+		e.header()
+		e.w.WriteHeader(http.StatusOK)
+		e.started = true
+	}
+	return e.w.Write(p)
+}
+
+// htmlBody returns the decoded HTML body of a raw message, if it has one.
+// A message too malformed to find it in is still served raw.
+func htmlBody(raw string) (string, bool) {
+	part, err := mail.FindBody(raw, "text/html")
+	if err != nil {
+		return "", false
+	}
+	body, err := io.ReadAll(part.Body)
+	if err != nil {
+		return "", false
+	}
+	return string(body), true
+}
+
+// sendMailRequest is the body of POST /api/v1/mail/send.
+type sendMailRequest struct {
+	OwnerPubKey   string      `json:"owner_pubkey"`
+	AccountEmail  string      `json:"account_email"`
+	FromName      string      `json:"from_name"`
+	EnvelopeFrom  string      `json:"envelope_from"` // MAIL FROM address; default_envelope_from, then the account email
+	To            []recipient `json:"to"`
+	Cc            []recipient `json:"cc"`
+	Bcc           []recipient `json:"bcc"`
+	Subject       string      `json:"subject"`
+	Body          string      `json:"body"`
+	HTML          string      `json:"html"` // HTML alternative of body; its cid: images name inline attachments
+	OmitSignature bool        `json:"omit_signature"`
+	SendAt        string      `json:"send_at"` // RFC 3339; empty sends now
+
+	ListUnsubscribe     []string `json:"list_unsubscribe"`      // mailto: and/or https: URL
+	ListUnsubscribePost bool     `json:"list_unsubscribe_post"` // one-click unsubscribe via the https: URL
+
+	DSN        *dsnRequest `json:"dsn"`         // delivery status notifications to ask for
+	RequireDSN bool        `json:"require_dsn"` // fail rather than send without them
+
+	Attachments []attachmentRequest `json:"attachments"`
+}
+
+// attachmentRequest is a file sent with a message; data is base64 in JSON.
+// An inline attachment is an image the HTML body shows by its content_id.
+type attachmentRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+	Inline      bool   `json:"inline"`
+	ContentID   string `json:"content_id"` // without angle brackets
+}
+
+// missingImagesRefusal rejects HTML whose cid: images have no inline
+// attachment.
+type missingImagesRefusal struct {
+	Error   string   `json:"error"`
+	Missing []string `json:"missing_content_ids"`
+}
+
+// dsnRequest holds the DSN parameters (RFC 3461) of a send request.
+type dsnRequest struct {
+	Notify []string `json:"notify"` // "NEVER", or any of "SUCCESS", "FAILURE" and "DELAY"
+	Ret    string   `json:"ret"`    // "FULL" or "HDRS"
+}
+
+// sendMailResponse reports an immediately delivered message.
+type sendMailResponse struct {
+	Status       string `json:"status"` // always "sent"
+	MessageID    string `json:"message_id"`
+	SMTPResponse string `json:"smtp_response"`
+	QueueID      string `json:"queue_id"`
+	Attempts     int    `json:"attempts"`
 }
 
 // POST /api/v1/mail/send
 //
 // Sends a message via the SMTP server associated with the given account.
+// The account's signature, if any, is appended to the plain-text body, and
+// as a block of its own to the HTML body, unless the request sets
+// "omit_signature".  "envelope_from" sets the MAIL FROM
+// (bounce) address, overriding the account's default_envelope_from; the
+// From header is always the account email.  With "send_at" (RFC 3339) the
+// message is validated now, stored encrypted and delivered by the Scheduler
+// later; the response is then 202 with a schedule id.  With "?async=true"
+// (the default under SEND_ASYNC) the message is instead queued encrypted in
+// the outbox for the Outbox workers, which retry transient failures with
+// backoff; the response is 202 with an outbox id whose delivery state
+// GET /api/v1/mail/outbox/{id} reports.  A send waits for the account's
+// SMTP session (see acquireSMTPSession) and is answered 429 with
+// Retry-After if the account stays busy.  Sends that look like relay abuse
+// are refused before any of that (see guardSend).  "list_unsubscribe" and
+// "list_unsubscribe_post" add the List-Unsubscribe and one-click
+// List-Unsubscribe-Post headers that bulk senders need to stay deliverable.
+// "dsn" asks for delivery status notifications ("notify", "ret") when the
+// SMTP server supports them; with "require_dsn" a server that does not
+// fails the send with 422 instead.  Failure reports then mark the sent
+// message as bounced (see recordBounces).  "html" adds an HTML alternative
+// to the body; "attachments" with "inline" and "content_id" carry the
+// images it shows as cid: URLs, and a cid: URL without one is answered 422
+// listing the missing Content-IDs.  A send a greylisting server
+// defers is handed to the outbox, answering 202 with status
+// "deferred_greylist", or with SEND_GREYLIST_REQUEUE off fails with 503 and
+// the code "greylisted" (see deferGreylisted).
 func (s *Server) sendMail(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		OwnerPubKey  string   `json:"owner_pubkey"`
-		AccountEmail string   `json:"account_email"`
-		To           []string `json:"to"`
-		Subject      string   `json:"subject"`
-		Body         string   `json:"body"`
-	}
+	var req sendMailRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	owner, ok := actingOwner(r, req.OwnerPubKey)
+	if !ok {
+		writeError(w, http.StatusForbidden, errKeyOwner)
+		return
+	}
+	req.OwnerPubKey = owner
+	var sendAt time.Time
+	if req.SendAt != "" {
+		t, err := time.Parse(time.RFC3339, req.SendAt)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "send_at must be an RFC 3339 timestamp")
+			return
+		}
+		if !t.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, "send_at must be in the future")
+			return
+		}
+		sendAt = t.UTC()
+	}
+	if strings.ContainsAny(req.FromName, "\r\n") {
+		writeError(w, http.StatusBadRequest, "from_name must not contain line breaks")
+		return
+	}
+	if req.EnvelopeFrom != "" {
+		if err := mail.ValidateAddress(req.EnvelopeFrom); err != nil {
+			writeError(w, http.StatusBadRequest, "envelope_from: "+err.Error())
+			return
+		}
+	}
+	if err := mail.ValidateListUnsubscribe(req.ListUnsubscribe, req.ListUnsubscribePost); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var dsn *mail.DSN
+	if req.DSN != nil || req.RequireDSN {
+		dsn = &mail.DSN{Require: req.RequireDSN}
+		if req.DSN != nil {
+			dsn.Notify, dsn.Ret = req.DSN.Notify, req.DSN.Ret
+		}
+		if err := mail.ValidateDSN(dsn); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	attachments := make([]mail.Attachment, len(req.Attachments))
+	for i, a := range req.Attachments {
+		attachments[i] = mail.Attachment(a)
+	}
+	if err := mail.ValidateAttachments(req.HTML, attachments); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if missing := mail.MissingContentIDs(req.HTML, attachments); len(missing) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, missingImagesRefusal{
+			Error:   "html refers to images without an inline attachment",
+			Missing: missing,
+		})
+		return
+	}
+
+	// Only parsed addresses ever reach the SMTP envelope and headers.
+	to, err := parseRecipients(req.To)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cc, err := parseRecipients(req.Cc)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	bcc, err := parseRecipients(req.Bcc)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(to)+len(cc)+len(bcc) == 0 {
+		writeError(w, http.StatusBadRequest, "at least one recipient is required")
+		return
+	}
 
 	acc, err := s.db.GetMailAccount(r.Context(), req.OwnerPubKey, req.AccountEmail)
 	if err != nil {
@@ -212,37 +1316,161 @@ func (s *Server) sendMail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	smtpPass, err := vault.DecryptAESGCM(s.cfg.EncryptionKey, acc.SMTP.PassEnc)
+	fromName := req.FromName
+	if fromName == "" {
+		fromName = acc.DisplayName
+	}
+	envelopeFrom := req.EnvelopeFrom
+	if envelopeFrom == "" {
+		envelopeFrom = acc.DefaultEnvelopeFrom
+	}
+	body, htmlPart := req.Body, req.HTML
+	if !req.OmitSignature {
+		body = appendSignature(body, acc.Signature)
+		htmlPart = appendHTMLSignature(htmlPart, acc.Signature)
+	}
+	sendReq := mail.SendRequest{
+		From: req.AccountEmail, FromName: fromName, EnvelopeFrom: envelopeFrom,
+		To: to, Cc: cc, Bcc: bcc, Subject: req.Subject, Body: body,
+		HTML: htmlPart, Attachments: attachments,
+		ListUnsubscribe: req.ListUnsubscribe, ListUnsubscribePost: req.ListUnsubscribePost,
+		DSN: dsn,
+	}
+
+	// Enforce limits before touching the user's SMTP account so an abusive
+	// request can't get it throttled or banned by the provider.
+	limits, _, err := s.sendLimits(r.Context(), req.OwnerPubKey)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "decrypt: "+err.Error())
+		writeFailure(w, r, http.StatusInternalServerError, "send limits unavailable", err)
+		return
+	}
+	if n := len(sendReq.Recipients()); n > limits.MaxRecipients {
+		writeLimitError(w, http.StatusUnprocessableEntity,
+			fmt.Sprintf("too many recipients: %d", n), limits.MaxRecipients)
+		return
+	}
+	if size := mail.MessageSize(sendReq); size > limits.MaxMessageBytes {
+		writeLimitError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("message too large: %d bytes", size), limits.MaxMessageBytes)
+		return
+	}
+	if !s.guardSend(w, r, acc, sendReq, limits) {
 		return
 	}
 
-	client := mail.NewSMTPClient(mail.SMTPConfig{
-		Host: acc.SMTP.Host, Port: acc.SMTP.Port,
-		User: acc.SMTP.User, Pass: smtpPass, UseSSL: acc.SMTP.UseSSL,
-	})
-	defer client.Close()
-
-	if err := client.Connect(); err != nil {
-		writeError(w, http.StatusServiceUnavailable, "SMTP connect: "+err.Error())
+	if !sendAt.IsZero() {
+		s.scheduleMessage(w, r, req.OwnerPubKey, sendReq, sendAt)
+		return
+	}
+	if s.sendAsync(r) {
+		s.queueMessage(w, r, req.OwnerPubKey, sendReq)
 		return
 	}
-	if err := client.Handshake(); err != nil {
-		writeError(w, http.StatusServiceUnavailable, "SMTP handshake: "+err.Error())
+
+	waitCtx, cancel := context.WithTimeout(r.Context(), smtpSessionWait)
+	release, err := s.acquireSMTPSession(waitCtx, acc)
+	cancel()
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(smtpSessionWait/time.Second), 1)))
+		writeError(w, http.StatusTooManyRequests, errAccountBusy.Error())
 		return
 	}
-	if err := client.Auth(); err != nil {
-		writeError(w, http.StatusUnauthorized, "SMTP auth: "+err.Error())
+	res, attempts, err := s.sendWithRetry(r.Context(), acc, sendReq)
+	release()
+	if err != nil {
+		if delay, ok := mail.Greylisted(err); ok {
+			s.deferGreylisted(w, r, req.OwnerPubKey, sendReq, attempts, err, delay)
+			return
+		}
+		msg := publicError(err)
+		if attempts > 1 {
+			msg += fmt.Sprintf(" (after %d attempts)", attempts)
+		}
+		var sizeErr *mail.SizeLimitError
+		var addrErr *mail.AddressError
+		var stageErr *smtpStageError
+		switch {
+		case errors.As(err, &sizeErr):
+			writeLimitError(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("message too large for SMTP server: %d bytes", sizeErr.Size), sizeErr.Limit)
+		case errors.As(err, &addrErr), errors.Is(err, mail.ErrDSNNotSupported):
+			writeFailure(w, r, http.StatusUnprocessableEntity, msg, err)
+		case errors.As(err, &stageErr) && stageErr.stage == "SMTP auth":
+			writeFailure(w, r, http.StatusUnauthorized, msg, err)
+		case errors.As(err, &stageErr) && stageErr.stage != "SMTP send":
+			writeFailure(w, r, http.StatusServiceUnavailable, msg, err)
+		default:
+			writeFailure(w, r, http.StatusInternalServerError, msg, err)
+		}
 		return
 	}
-	if err := client.Send(mail.SendRequest{
-		From: req.AccountEmail, To: req.To,
-		Subject: req.Subject, Body: req.Body,
+
+	// The message is already out; a failed history write must not turn a
+	// successful send into an error the client might retry.
+	if err := s.db.CreateSentMessage(r.Context(), &db.SentMessage{
+		OwnerPubKey:  req.OwnerPubKey,
+		AccountEmail: req.AccountEmail,
+		EnvelopeFrom: sendReq.EnvelopeSender(),
+		To:           mail.Emails(to),
+		Cc:           mail.Emails(cc),
+		Bcc:          mail.Emails(bcc),
+		Subject:      req.Subject,
+		MessageID:    res.MessageID,
+		SMTPResponse: res.Response,
+		QueueID:      res.QueueID,
 	}); err != nil {
-		writeError(w, http.StatusInternalServerError, "SMTP send: "+err.Error())
-		return
+		log.Printf("[%s] send: record sent message %s: %v", requestID(r.Context()), res.MessageID, err)
 	}
+	s.recordContacts(r.Context(), req.OwnerPubKey, slices.Concat(to, cc, bcc), true, time.Now())
 
-	writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+	writeJSON(w, http.StatusOK, sendMailResponse{
+		Status:       "sent",
+		MessageID:    res.MessageID,
+		SMTPResponse: res.Response,
+		QueueID:      res.QueueID,
+		Attempts:     attempts,
+	})
+}
+
+// recipient is a send-request address: either a bare address string or an
+// object of the form {"email": "...", "name": "..."}.
+type recipient mail.Address
+
+func (rc *recipient) UnmarshalJSON(b []byte) error {
+	var email string
+	if err := json.Unmarshal(b, &email); err == nil {
+		*rc = recipient{Email: email}
+		return nil
+	}
+	var a mail.Address
+	if err := json.Unmarshal(b, &a); err != nil {
+		return errors.New(`recipient must be an address string or {"email": ..., "name": ...}`)
+	}
+	*rc = recipient(a)
+	return nil
+}
+
+// parseRecipients validates client-supplied recipients and returns them with
+// their bare addr-spec form.  CR, LF and angle brackets are rejected outright
+// in addresses, and line breaks in display names, since they are the building
+// blocks of SMTP command and header injection.
+func parseRecipients(list []recipient) ([]mail.Address, error) {
+	out := make([]mail.Address, 0, len(list))
+	for _, rc := range list {
+		if strings.ContainsAny(rc.Email, "\r\n<>") {
+			return nil, fmt.Errorf("invalid recipient %q: contains forbidden characters", rc.Email)
+		}
+		if strings.ContainsAny(rc.Name, "\r\n") {
+			return nil, fmt.Errorf("invalid recipient name %q: contains line breaks", rc.Name)
+		}
+		addr, err := netmail.ParseAddress(rc.Email)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %v", rc.Email, err)
+		}
+		out = append(out, mail.Address{Email: addr.Address, Name: strings.TrimSpace(rc.Name)})
+	}
+	return out, nil
 }
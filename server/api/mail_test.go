@@ -4,20 +4,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 
 	"mulamail/db"
-	"mulamail/vault"
+	"mulamail/db/dbtest"
+	"mulamail/mail"
 )
 
 func TestAddAccount_Success(t *testing.T) {
-	server, _ := setupTestServer(t)
+	server, mockDB := setupTestServer(t)
 
 	reqBody := map[string]any{
 		"owner_pubkey":  "ownerkey123",
 		"account_email": "mail@example.com",
+		"display_name":  "Mail User",
 		"pop3": map[string]any{
 			"host":    "pop.example.com",
 			"port":    995,
@@ -53,6 +62,9 @@ func TestAddAccount_Success(t *testing.T) {
 	if response["account_email"] != "mail@example.com" {
 		t.Errorf("account_email: want %q, got %q", "mail@example.com", response["account_email"])
 	}
+	if got := mockDB.Accounts["ownerkey123"][0].DisplayName; got != "Mail User" {
+		t.Errorf("display_name: want %q, got %q", "Mail User", got)
+	}
 }
 
 func TestAddAccount_InvalidJSON(t *testing.T) {
@@ -68,6 +80,25 @@ func TestAddAccount_InvalidJSON(t *testing.T) {
 	}
 }
 
+func TestAddAccount_RejectsInvalidEmail(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	for _, email := range []string{"", "me@example.com>\r\nRCPT TO:<evil@example.net", "Me <me@example.com>"} {
+		body, _ := json.Marshal(map[string]any{"owner_pubkey": "owner", "account_email": email})
+		req := httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+
+		server.addAccount(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status code: want %d, got %d", email, http.StatusBadRequest, w.Code)
+		}
+	}
+	if len(mockDB.Accounts) != 0 {
+		t.Errorf("expected no accounts stored, got %d", len(mockDB.Accounts))
+	}
+}
+
 func TestAddAccount_PasswordEncryption(t *testing.T) {
 	server, mockDB := setupTestServer(t)
 
@@ -119,7 +150,7 @@ func TestAddAccount_PasswordEncryption(t *testing.T) {
 	}
 
 	// Verify we can decrypt the passwords
-	pop3Pass, err := vault.DecryptAESGCM(server.cfg.EncryptionKey, acc.POP3.PassEnc)
+	pop3Pass, err := server.cfg.EncryptionKey.DecryptString(acc.POP3.PassEnc)
 	if err != nil {
 		t.Errorf("failed to decrypt POP3 password: %v", err)
 	}
@@ -127,7 +158,7 @@ func TestAddAccount_PasswordEncryption(t *testing.T) {
 		t.Errorf("POP3 password: want %q, got %q", "secret_pop3_password", pop3Pass)
 	}
 
-	smtpPass, err := vault.DecryptAESGCM(server.cfg.EncryptionKey, acc.SMTP.PassEnc)
+	smtpPass, err := server.cfg.EncryptionKey.DecryptString(acc.SMTP.PassEnc)
 	if err != nil {
 		t.Errorf("failed to decrypt SMTP password: %v", err)
 	}
@@ -390,6 +421,34 @@ func TestAddAccount_SSLFlags(t *testing.T) {
 	}
 }
 
+func TestAddAccount_POP3AuthMechanism(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	add := func(pop3, smtp map[string]any) int {
+		body, _ := json.Marshal(map[string]any{
+			"owner_pubkey": "owner_apop", "account_email": "apop@example.com",
+			"pop3": pop3, "smtp": smtp,
+		})
+		w := httptest.NewRecorder()
+		server.addAccount(w, httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewBuffer(body)))
+		return w.Code
+	}
+
+	if code := add(map[string]any{"auth_mechanism": "cram-md5"}, nil); code != http.StatusBadRequest {
+		t.Errorf("unknown mechanism: want 400, got %d", code)
+	}
+	if code := add(nil, map[string]any{"auth_mechanism": "apop"}); code != http.StatusBadRequest {
+		t.Errorf("SMTP mechanism: want 400, got %d", code)
+	}
+	if code := add(map[string]any{"host": "pop.example.com", "auth_mechanism": "apop"}, nil); code != http.StatusCreated {
+		t.Fatalf("apop: want 201, got %d", code)
+	}
+	acc, _ := mockDB.GetMailAccount(context.Background(), "owner_apop", "apop@example.com")
+	if acc.POP3.AuthMechanism != "apop" {
+		t.Errorf("stored mechanism: want apop, got %q", acc.POP3.AuthMechanism)
+	}
+}
+
 func TestSendMail_AccountNotFound(t *testing.T) {
 	server, _ := setupTestServer(t)
 
@@ -455,6 +514,119 @@ func TestFetchMessage_InvalidID(t *testing.T) {
 	}
 }
 
+func TestFetchMessage_EML(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	raw := "Subject: big\r\n\r\n" + strings.Repeat("line of body text\r\n", 10000) + "end"
+	fake := &fakePOP3{messages: map[int]string{1: raw}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	fetch := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.fetchMessage(w, httptest.NewRequest("GET", "/api/v1/mail/message?owner=owner&account=me@example.com"+query, nil))
+		return w
+	}
+
+	w := fetch("&id=1&format=eml")
+	if w.Code != http.StatusOK || w.Body.String() != raw {
+		t.Fatalf("want the raw message, got %d with %d bytes: %.100s", w.Code, w.Body.Len(), w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "message/rfc822" {
+		t.Errorf("Content-Type: want message/rfc822, got %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=uid-1.eml` {
+		t.Errorf("Content-Disposition: got %q", cd)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("a streamed message has no Content-Length, got %q", cl)
+	}
+
+	// A message cached in the vault is served from there, with its length.
+	newTestVault(t, server)
+	if err := server.storage.Put(context.Background(), messageCacheKey("owner", "me@example.com", "uid-1"), []byte(raw)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	retrieved := fake.retrieved.Load()
+	w = fetch("&id=1&format=eml")
+	if w.Code != http.StatusOK || w.Body.String() != raw || w.Header().Get("Content-Length") != strconv.Itoa(len(raw)) {
+		t.Errorf("cached: want the raw message with its length, got %d, Content-Length %q", w.Code, w.Header().Get("Content-Length"))
+	}
+	if fake.retrieved.Load() != retrieved {
+		t.Error("cached: want no RETR")
+	}
+
+	if w := fetch("&id=9&format=eml"); w.Code != http.StatusInternalServerError || w.Header().Get("Content-Type") == "message/rfc822" {
+		t.Errorf("missing message: want a %d error, got %d %q", http.StatusInternalServerError, w.Code, w.Header().Get("Content-Type"))
+	}
+	if w := fetch("&id=1&format=mbox"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestFetchMessage_HTML(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{messages: map[int]string{
+		1: "Subject: html\r\nContent-Type: text/html\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+			"<p onclick=3D\"x()\">Hi<script>alert(1)</script><img src=3D\"cid:logo@example.com\"></p>",
+		2: "Subject: plain\r\n\r\nno html here",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	fetch := func(query string) rawMessageResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.fetchMessage(w, httptest.NewRequest("GET", "/api/v1/mail/message?owner=owner&account=me@example.com"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var resp rawMessageResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+
+	resp := fetch("&id=1")
+	want := `<p>Hi<img src="/api/v1/mail/attachment?account=me%40example.com&amp;id=1&amp;owner=owner&amp;part=logo%40example.com"></p>`
+	if resp.HTMLSanitized != want {
+		t.Errorf("html_sanitized:\n got: %s\nwant: %s", resp.HTMLSanitized, want)
+	}
+	if resp.HTML != "" || resp.Raw == "" {
+		t.Errorf("want the raw message but not the unsanitized HTML by default, got %+v", resp)
+	}
+	if resp := fetch("&id=1&unsafe=true"); !strings.Contains(resp.HTML, "<script>") {
+		t.Errorf("unsafe=true: want the HTML as sent, got %q", resp.HTML)
+	}
+	if resp := fetch("&id=2&unsafe=true"); resp.HTMLSanitized != "" || resp.HTML != "" {
+		t.Errorf("plain-text message: want no HTML, got %+v", resp)
+	}
+}
+
+func TestAddAccount_DefaultEnvelopeFrom(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	add := func(envelopeFrom string) int {
+		body, _ := json.Marshal(map[string]any{
+			"owner_pubkey": "owner", "account_email": "me@example.com",
+			"default_envelope_from": envelopeFrom,
+		})
+		w := httptest.NewRecorder()
+		server.addAccount(w, httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewBuffer(body)))
+		return w.Code
+	}
+
+	if code := add("bounces@example.com\r\nBcc: evil@example.net"); code != http.StatusBadRequest {
+		t.Errorf("unsafe address: want 400, got %d", code)
+	}
+	if code := add("bounces@example.com"); code != http.StatusCreated {
+		t.Fatalf("want 201, got %d", code)
+	}
+	acc, _ := mockDB.GetMailAccount(context.Background(), "owner", "me@example.com")
+	if acc.DefaultEnvelopeFrom != "bounces@example.com" {
+		t.Errorf("default_envelope_from: want bounces@example.com, got %q", acc.DefaultEnvelopeFrom)
+	}
+}
+
 func TestAddAccount_SpecialCharactersInEmail(t *testing.T) {
 	server, mockDB := setupTestServer(t)
 
@@ -496,3 +668,1306 @@ func TestAddAccount_SpecialCharactersInEmail(t *testing.T) {
 		t.Errorf("expected %d accounts, got %d", len(emails), len(accounts))
 	}
 }
+
+// addPOP3Account registers an account for owner whose POP3 settings point at
+// host:port.
+func addPOP3Account(t *testing.T, server *Server, mockDB *dbtest.Mock, owner, email, host string, port int) {
+	t.Helper()
+	passEnc, err := server.cfg.EncryptionKey.EncryptString("pass")
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	mockDB.CreateMailAccount(context.Background(), &db.MailAccount{
+		OwnerPubKey:  owner,
+		AccountEmail: email,
+		POP3:         db.POP3Settings{Host: host, Port: port, User: "u", PassEnc: passEnc},
+	})
+}
+
+func TestFetchInbox_SkippedMessages(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{
+		messages: map[int]string{
+			1: "From: a@example.com\r\nSubject: one\r\nDate: Mon, 02 Oct 2023 10:00:00 +0000\r\n",
+			2: "From: b@example.com\r\nSubject: two\r\nDate: Tue, 03 Oct 2023 10:00:00 +0000\r\n",
+			3: "From: c@example.com\r\nSubject: three\r\nDate: Wed, 04 Oct 2023 10:00:00 +0000\r\n",
+		},
+		failTop: map[int]bool{2: true},
+	}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil)
+	w := httptest.NewRecorder()
+
+	server.fetchInbox(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Total      int `json:"total"`
+		Fetched    int `json:"fetched"`
+		Skipped    int `json:"skipped"`
+		SkippedIDs []struct {
+			ID    int    `json:"id"`
+			Error string `json:"error"`
+		} `json:"skipped_ids"`
+		Messages []struct {
+			ID int `json:"id"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if response.Total != 3 || response.Fetched != 2 || response.Skipped != 1 {
+		t.Errorf("counts: want total=3 fetched=2 skipped=1, got total=%d fetched=%d skipped=%d",
+			response.Total, response.Fetched, response.Skipped)
+	}
+	if len(response.SkippedIDs) != 1 || response.SkippedIDs[0].ID != 2 || response.SkippedIDs[0].Error == "" {
+		t.Errorf("skipped_ids: unexpected %+v", response.SkippedIDs)
+	}
+	if len(response.Messages) != 2 || response.Messages[0].ID != 3 || response.Messages[1].ID != 1 {
+		t.Errorf("messages: want ids [3 1], got %+v", response.Messages)
+	}
+}
+
+func TestFetchInbox_EmptyVersusListError(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	empty := &fakePOP3{messages: map[int]string{}}
+	host, port := empty.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "empty@example.com", host, port)
+
+	broken := &fakePOP3{failList: true}
+	host, port = broken.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "broken@example.com", host, port)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=empty@example.com", nil)
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("empty mailbox: want %d, got %d", http.StatusOK, w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=broken@example.com", nil)
+	w = httptest.NewRecorder()
+	server.fetchInbox(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("LIST failure: want %d, got %d", http.StatusBadGateway, w.Code)
+	}
+}
+
+// decodeNDJSON splits a streamed response into its JSON objects.
+func decodeNDJSON(t *testing.T, body string) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", line, err)
+		}
+		lines = append(lines, obj)
+	}
+	return lines
+}
+
+func TestFetchInbox_Stream(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{
+		messages: map[int]string{
+			1: "From: a@example.com\r\nSubject: one\r\n",
+			2: "From: b@example.com\r\nSubject: two\r\n",
+			3: "From: c@example.com\r\nSubject: three\r\n",
+		},
+		failTop: map[int]bool{2: true},
+	}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type: want application/x-ndjson, got %q", ct)
+	}
+	if !w.Flushed {
+		t.Error("expected the stream to be flushed")
+	}
+
+	lines := decodeNDJSON(t, w.Body.String())
+	if len(lines) != 3 {
+		t.Fatalf("want 2 messages and a trailer, got %v", lines)
+	}
+	if lines[0]["type"] != "message" || lines[0]["id"] != float64(3) || lines[0]["subject"] != "three" {
+		t.Errorf("first line: unexpected %v", lines[0])
+	}
+	if lines[1]["type"] != "message" || lines[1]["id"] != float64(1) {
+		t.Errorf("second line: unexpected %v", lines[1])
+	}
+	done := lines[2]
+	if done["type"] != "done" || done["total"] != float64(3) || done["fetched"] != float64(2) || done["skipped"] != float64(1) {
+		t.Errorf("trailer: unexpected %v", done)
+	}
+}
+
+func TestFetchInbox_PreviewMaxBytes(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.InboxPreviewMaxBytes = 1000
+
+	fake := &fakePOP3{messages: map[int]string{
+		1: "From: a@example.com\r\nSubject: one\r\n",
+		2: "From: b@example.com\r\nSubject: huge\r\n" + strings.Repeat("Received: from relay\r\n", 100),
+		3: "From: c@example.com\r\nSubject: three\r\n",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	inbox := func(query string) inboxResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var response inboxResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		return response
+	}
+	skipped := func(msgs []inboxMessage) []int {
+		var ids []int
+		for _, m := range msgs {
+			if m.PreviewSkipped {
+				ids = append(ids, m.ID)
+			}
+		}
+		return ids
+	}
+
+	response := inbox("")
+	if ids := skipped(response.Messages); !reflect.DeepEqual(ids, []int{2}) {
+		t.Errorf("want message 2 listed without a preview, got %v", ids)
+	}
+	for _, m := range response.Messages {
+		if m.ID == 2 && (m.Subject != "" || m.Size != len(fake.messages[2])) {
+			t.Errorf("skipped preview: want only the size, got %+v", m.Message)
+		}
+	}
+	if n := fake.topped.Load(); n != 2 {
+		t.Errorf("want 2 TOP commands, got %d", n)
+	}
+	if len(mockDB.Cached) != 2 {
+		t.Errorf("a skipped preview must not be cached: %d cached", len(mockDB.Cached))
+	}
+	if b := response.Sizes.Buckets; len(b) != 4 || b[0].Count != 3 || response.Sizes.Largest != len(fake.messages[2]) {
+		t.Errorf("sizes: unexpected %+v", response.Sizes)
+	}
+
+	if ids := skipped(inbox("&preview_max_bytes=0").Messages); len(ids) != 0 {
+		t.Errorf("preview_max_bytes=0: want every preview, got %v skipped", ids)
+	}
+	if ids := skipped(inbox("&preview_max_bytes=10").Messages); len(ids) != 3 {
+		t.Errorf("preview_max_bytes=10: want every preview skipped, got %v", ids)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com&stream=true", nil)
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, req)
+	lines := decodeNDJSON(t, w.Body.String())
+	if len(lines) != 4 || lines[1]["id"] != float64(2) || lines[1]["preview_skipped"] != true || lines[3]["sizes"] == nil {
+		t.Errorf("stream: want message 2 skipped and a sizes trailer, got %v", lines)
+	}
+
+	for _, v := range []string{"-1", "big"} {
+		w := httptest.NewRecorder()
+		server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com&preview_max_bytes="+v, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("preview_max_bytes=%s: want %d, got %d", v, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestSummarizeSizes(t *testing.T) {
+	list := []mail.Message{{Size: 0}, {Size: 100<<10 - 1}, {Size: 100 << 10}, {Size: 5 << 20}, {Size: 40 << 20}}
+	got := summarizeSizes(list)
+	want := inboxSizes{
+		Buckets: []sizeBucket{
+			{MinBytes: 0, MaxBytes: 100 << 10, Count: 2},
+			{MinBytes: 100 << 10, MaxBytes: 1 << 20, Count: 1},
+			{MinBytes: 1 << 20, MaxBytes: 10 << 20, Count: 1},
+			{MinBytes: 10 << 20, Count: 1},
+		},
+		Largest:    40 << 20,
+		TotalBytes: 100<<10 - 1 + 100<<10 + 5<<20 + 40<<20,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestFetchInbox_StreamErrorMidway(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakePOP3{
+		messages: map[int]string{
+			1: "Subject: one\r\n",
+			2: "Subject: two\r\n",
+			3: "Subject: three\r\n",
+		},
+		dropTop: map[int]bool{2: true},
+	}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com&stream=true", nil)
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, req)
+
+	lines := decodeNDJSON(t, w.Body.String())
+	if len(lines) != 2 {
+		t.Fatalf("want a message and an error object, got %v", lines)
+	}
+	if lines[0]["type"] != "message" || lines[0]["id"] != float64(3) {
+		t.Errorf("first line: unexpected %v", lines[0])
+	}
+	if lines[1]["type"] != "error" || lines[1]["error"] == "" {
+		t.Errorf("final line: want error object, got %v", lines[1])
+	}
+}
+
+func TestSanitizeError(t *testing.T) {
+	netErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	if got := sanitizeError(netErr); got != "network error" {
+		t.Errorf("network error: want %q, got %q", "network error", got)
+	}
+
+	got := sanitizeError(errors.New("pop3: -ERR bad\r\nthing"))
+	if strings.ContainsAny(got, "\r\n") {
+		t.Errorf("expected control characters to be stripped, got %q", got)
+	}
+
+	if got := sanitizeError(errors.New(strings.Repeat("x", 500))); len(got) != 200 {
+		t.Errorf("expected truncation to 200 chars, got %d", len(got))
+	}
+}
+
+// addSMTPAccount registers an account for owner whose SMTP settings point at
+// host:port.
+func addSMTPAccount(t *testing.T, server *Server, mockDB *dbtest.Mock, owner, email, host string, port int) {
+	t.Helper()
+	passEnc, err := server.cfg.EncryptionKey.EncryptString("pass")
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+	mockDB.CreateMailAccount(context.Background(), &db.MailAccount{
+		OwnerPubKey:  owner,
+		AccountEmail: email,
+		SMTP:         db.SMTPSettings{Host: host, Port: port, User: "u", PassEnc: passEnc},
+	})
+}
+
+func TestSendMail_ReportsServerResponse(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{ehlo: []string{"PIPELINING", "AUTH PLAIN LOGIN"}}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey":  "owner",
+		"account_email": "me@example.com",
+		"to":            []string{"you@example.org"},
+		"subject":       "hello",
+		"body":          "hi there",
+	})
+	req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.sendMail(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var response struct {
+		MessageID    string `json:"message_id"`
+		SMTPResponse string `json:"smtp_response"`
+		QueueID      string `json:"queue_id"`
+		Attempts     int    `json:"attempts"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.SMTPResponse != "250 2.0.0 Ok: queued as ABC123" {
+		t.Errorf("smtp_response: unexpected %q", response.SMTPResponse)
+	}
+	if response.Attempts != 1 {
+		t.Errorf("attempts: want 1, got %d", response.Attempts)
+	}
+	if response.QueueID != "ABC123" {
+		t.Errorf("queue_id: want %q, got %q", "ABC123", response.QueueID)
+	}
+	if !strings.HasSuffix(response.MessageID, "@example.com>") {
+		t.Errorf("message_id: unexpected %q", response.MessageID)
+	}
+
+	sent := fake.sent()
+	if len(sent) != 1 || !strings.Contains(sent[0], "Message-ID: "+response.MessageID) {
+		t.Errorf("sent message missing Message-ID header: %q", sent)
+	}
+
+	if len(mockDB.Sent) != 1 {
+		t.Fatalf("expected 1 sent-mail record, got %d", len(mockDB.Sent))
+	}
+	if rec := mockDB.Sent[0]; rec.MessageID != response.MessageID || rec.QueueID != "ABC123" {
+		t.Errorf("sent-mail record: unexpected %+v", rec)
+	}
+}
+
+func TestSendMail_Limits(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.MaxRecipients = 2
+	server.cfg.MaxMessageBytes = 1024
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	testCases := []struct {
+		name string
+		to   []string
+		body string
+		want int
+	}{
+		{"too many recipients", []string{"a@x.org", "b@x.org", "c@x.org"}, "hi", http.StatusUnprocessableEntity},
+		{"message too large", []string{"a@x.org"}, strings.Repeat("x", 2048), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]any{
+				"owner_pubkey": "owner", "account_email": "me@example.com",
+				"to": tc.to, "subject": "s", "body": tc.body,
+			})
+			req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+
+			server.sendMail(w, req)
+
+			if w.Code != tc.want {
+				t.Fatalf("status code: want %d, got %d", tc.want, w.Code)
+			}
+			var response map[string]any
+			json.NewDecoder(w.Body).Decode(&response)
+			if response["limit"] == nil {
+				t.Error("expected limit in error body")
+			}
+		})
+	}
+
+	if len(fake.received()) != 0 {
+		t.Error("limits must be enforced before connecting to SMTP")
+	}
+}
+
+func TestSendMail_PerOwnerOverride(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.MaxRecipients = 1
+	mockDB.SetSendLimits(context.Background(), &db.SendLimits{OwnerPubKey: "owner", MaxRecipients: 5})
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey": "owner", "account_email": "me@example.com",
+		"to": []string{"a@x.org", "b@x.org", "c@x.org"}, "subject": "s", "body": "hi",
+	})
+	req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.sendMail(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestSendMail_ServerSizeLimit(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{ehlo: []string{"SIZE 100", "AUTH PLAIN"}}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey": "owner", "account_email": "me@example.com",
+		"to": []string{"a@x.org"}, "subject": "s", "body": strings.Repeat("x", 200),
+	})
+	req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.sendMail(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	}
+	var response map[string]any
+	json.NewDecoder(w.Body).Decode(&response)
+	if response["limit"] != float64(100) {
+		t.Errorf("limit: want 100, got %v", response["limit"])
+	}
+	if len(fake.sent()) != 0 {
+		t.Error("oversized message must not reach DATA")
+	}
+}
+
+func TestSendMail_RejectsRecipientInjection(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	attempts := []struct {
+		field string
+		addr  string
+	}{
+		{"to", "victim@example.org>\r\nRCPT TO:<spam@example.net"},
+		{"to", "victim@example.org\r\nBcc: everyone@example.net"},
+		{"cc", "a@example.org> SIZE=1"},
+		{"bcc", "<a@example.org>"},
+		{"to", "not an address"},
+		{"cc", "\nDATA"},
+	}
+
+	for _, a := range attempts {
+		t.Run(a.field+" "+a.addr, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]any{
+				"owner_pubkey": "owner", "account_email": "me@example.com",
+				"to": []string{"ok@example.org"}, a.field: []string{a.addr},
+				"subject": "s", "body": "b",
+			})
+			req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+
+			server.sendMail(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status code: want %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+
+	if cmds := fake.received(); len(cmds) != 0 {
+		t.Errorf("no SMTP traffic expected, got %q", cmds)
+	}
+}
+
+func TestSendMail_SubjectInjectionNeutralised(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey": "owner", "account_email": "me@example.com",
+		"to":      []string{"you@example.org"},
+		"cc":      []string{"copy@example.org"},
+		"bcc":     []string{"hidden@example.org"},
+		"subject": "hello\r\nBcc: everyone@example.net",
+		"body":    "b",
+	})
+	req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.sendMail(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	sent := fake.sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(sent))
+	}
+	headers, _, _ := strings.Cut(sent[0], "\r\n\r\n")
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(strings.ToLower(line), "bcc:") {
+			t.Errorf("injected or leaked Bcc header: %q", line)
+		}
+	}
+	if !strings.Contains(headers, "Cc: copy@example.org") {
+		t.Error("expected Cc header")
+	}
+
+	var rcpts []string
+	for _, cmd := range fake.received() {
+		if strings.HasPrefix(cmd, "RCPT TO:") {
+			rcpts = append(rcpts, cmd)
+		}
+	}
+	want := []string{"RCPT TO:<you@example.org>", "RCPT TO:<copy@example.org>", "RCPT TO:<hidden@example.org>"}
+	if strings.Join(rcpts, "|") != strings.Join(want, "|") {
+		t.Errorf("envelope: want %q, got %q", want, rcpts)
+	}
+}
+
+func TestSendMail_InlineImages(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	send := func(html string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{
+			"owner_pubkey": "owner", "account_email": "me@example.com",
+			"to": []string{"you@example.org"}, "subject": "s", "body": "Hi",
+			"html": html,
+			"attachments": []map[string]any{
+				{"filename": "logo.png", "content_type": "image/png", "data": []byte("PNG"), "inline": true, "content_id": "logo"},
+			},
+		})
+		w := httptest.NewRecorder()
+		server.sendMail(w, httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body)))
+		return w
+	}
+
+	w := send(`<img src="cid:logo"><img src="cid:banner"><img src="cid:footer">`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+	var refusal missingImagesRefusal
+	json.NewDecoder(w.Body).Decode(&refusal)
+	if strings.Join(refusal.Missing, ",") != "banner,footer" {
+		t.Errorf("missing_content_ids: want [banner footer], got %q", refusal.Missing)
+	}
+	if len(fake.sent()) != 0 {
+		t.Fatal("a message with missing images must not be sent")
+	}
+
+	if w := send(`<p>Hi</p><img src="cid:logo">`); w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	sent := fake.sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(sent))
+	}
+	for _, want := range []string{"Content-Type: multipart/related;", "Content-Type: multipart/alternative;", "Content-ID: <logo>", "Content-Disposition: inline;"} {
+		if !strings.Contains(sent[0], want) {
+			t.Errorf("sent message lacks %q", want)
+		}
+	}
+}
+
+func TestParseRecipients(t *testing.T) {
+	got, err := parseRecipients([]recipient{{Email: "Alice@Example.com"}, {Email: " bob@example.org ", Name: " Bob "}})
+	if err != nil {
+		t.Fatalf("parseRecipients failed: %v", err)
+	}
+	if len(got) != 2 || got[1].Email != "bob@example.org" || got[1].Name != "Bob" {
+		t.Errorf("unexpected parsed recipients %+v", got)
+	}
+
+	if _, err := parseRecipients([]recipient{{Email: "bob@example.org", Name: "Bob\r\nBcc: evil@example.net"}}); err == nil {
+		t.Error("expected error for display name with line breaks")
+	}
+}
+
+func TestSendMail_DisplayNames(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	mockDB.Accounts["owner"][0].DisplayName = "Default Name"
+
+	send := func(extra map[string]any) string {
+		t.Helper()
+		payload := map[string]any{
+			"owner_pubkey": "owner", "account_email": "me@example.com",
+			"to": []any{
+				map[string]string{"email": "alice@example.org", "name": "Alice Johnson"},
+				"bob@example.org",
+			},
+			"subject": "s", "body": "b",
+		}
+		for k, v := range extra {
+			payload[k] = v
+		}
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+
+		server.sendMail(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		sent := fake.sent()
+		return sent[len(sent)-1]
+	}
+
+	msg := send(nil)
+	for _, want := range []string{
+		"From: \"Default Name\" <me@example.com>\r\n",
+		"To: \"Alice Johnson\" <alice@example.org>, bob@example.org\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("missing header %q in:\n%s", want, msg)
+		}
+	}
+
+	msg = send(map[string]any{"from_name": "Ünïcode Sender"})
+	if !strings.Contains(msg, "From: =?utf-8?q?=C3=9Cn=C3=AFcode_Sender?= <me@example.com>\r\n") {
+		t.Errorf("expected encoded From display name in:\n%s", msg)
+	}
+
+	for _, cmd := range fake.received() {
+		if strings.HasPrefix(cmd, "MAIL") && cmd != "MAIL FROM:<me@example.com>" {
+			t.Errorf("envelope sender must be bare, got %q", cmd)
+		}
+		if strings.HasPrefix(cmd, "RCPT") && cmd != "RCPT TO:<alice@example.org>" && cmd != "RCPT TO:<bob@example.org>" {
+			t.Errorf("envelope recipient must be bare, got %q", cmd)
+		}
+	}
+}
+
+func TestSendMail_RejectsStoredUnsafeAccountEmail(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	// Simulates an account stored before registration-time validation.
+	unsafe := "me@example.com>\r\nRCPT TO:<evil@example.net"
+	addSMTPAccount(t, server, mockDB, "owner", unsafe, host, port)
+
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey": "owner", "account_email": unsafe,
+		"to": []string{"you@example.org"}, "subject": "s", "body": "b",
+	})
+	req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.sendMail(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status code: want %d, got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+	for _, cmd := range fake.received() {
+		if strings.HasPrefix(cmd, "MAIL") || strings.HasPrefix(cmd, "RCPT") {
+			t.Errorf("unexpected envelope command %q", cmd)
+		}
+	}
+}
+
+func TestSendMail_EnvelopeFrom(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	send := func(extra map[string]any) *httptest.ResponseRecorder {
+		t.Helper()
+		payload := map[string]any{
+			"owner_pubkey": "owner", "account_email": "me@example.com",
+			"to": []string{"you@example.org"}, "subject": "s", "body": "b",
+		}
+		for k, v := range extra {
+			payload[k] = v
+		}
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		server.sendMail(w, req)
+		return w
+	}
+	lastMailFrom := func() string {
+		t.Helper()
+		var last string
+		for _, cmd := range fake.received() {
+			if strings.HasPrefix(cmd, "MAIL") {
+				last = cmd
+			}
+		}
+		return last
+	}
+
+	tests := []struct {
+		name         string
+		defaultFrom  string
+		envelopeFrom string
+		wantEnvelope string
+	}{
+		{"account email", "", "", "me@example.com"},
+		{"account default", "bounces@example.com", "", "bounces@example.com"},
+		{"request overrides default", "bounces@example.com", "bounce+42@example.com", "bounce+42@example.com"},
+	}
+	for _, tt := range tests {
+		mockDB.Accounts["owner"][0].DefaultEnvelopeFrom = tt.defaultFrom
+		var extra map[string]any
+		if tt.envelopeFrom != "" {
+			extra = map[string]any{"envelope_from": tt.envelopeFrom}
+		}
+		if w := send(extra); w.Code != http.StatusOK {
+			t.Fatalf("%s: status code: want %d, got %d: %s", tt.name, http.StatusOK, w.Code, w.Body.String())
+		}
+		if got, want := lastMailFrom(), "MAIL FROM:<"+tt.wantEnvelope+">"; got != want {
+			t.Errorf("%s: want %q, got %q", tt.name, want, got)
+		}
+		sent := fake.sent()
+		if !strings.Contains(sent[len(sent)-1], "From: me@example.com\r\n") {
+			t.Errorf("%s: From header must keep the account email:\n%s", tt.name, sent[len(sent)-1])
+		}
+		rec := mockDB.Sent[len(mockDB.Sent)-1]
+		if rec.AccountEmail != "me@example.com" || rec.EnvelopeFrom != tt.wantEnvelope {
+			t.Errorf("%s: sent-mail record: unexpected %+v", tt.name, rec)
+		}
+	}
+
+	sessions := fake.sessionCount()
+	if w := send(map[string]any{"envelope_from": "bounces@example.com>\r\nRCPT TO:<evil@example.net"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unsafe envelope_from: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if fake.sessionCount() != sessions {
+		t.Error("unsafe envelope_from must not reach the SMTP server")
+	}
+}
+
+func TestSendMail_EnvelopeFromRejected(t *testing.T) {
+	noSendBackoff(t)
+	server, mockDB := setupTestServer(t)
+	server.cfg.SMTPSendRetries = 2
+
+	fake := &fakeSMTP{mailFromReply: "553 5.7.1 sender address rejected: not owned by user"}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	mockDB.Accounts["owner"][0].DefaultEnvelopeFrom = "bounces@example.com"
+
+	w := sendSimple(t, server)
+
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "553 5.7.1 sender address rejected") {
+		t.Errorf("want the server's rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := fake.sessionCount(); n != 1 {
+		t.Errorf("must not retry a rejected envelope sender: %d sessions", n)
+	}
+	if len(mockDB.Sent) != 0 {
+		t.Errorf("a rejected message must not be recorded as sent: %+v", mockDB.Sent)
+	}
+}
+
+func TestUpdateAccount_DefaultEnvelopeFrom(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", "127.0.0.1", 1)
+
+	patch := func(value string) int {
+		body, _ := json.Marshal(map[string]any{"owner_pubkey": "owner", "account_email": "me@example.com", "default_envelope_from": value})
+		req := httptest.NewRequest("PATCH", "/api/v1/accounts", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		server.updateAccount(w, req)
+		return w.Code
+	}
+
+	if code := patch("bounces@example.com"); code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d", http.StatusOK, code)
+	}
+	if got := mockDB.Accounts["owner"][0].DefaultEnvelopeFrom; got != "bounces@example.com" {
+		t.Errorf("default_envelope_from: want %q, got %q", "bounces@example.com", got)
+	}
+	if code := patch("Bounces <bounces@example.com>"); code != http.StatusBadRequest {
+		t.Errorf("display-name form: want %d, got %d", http.StatusBadRequest, code)
+	}
+	if code := patch(""); code != http.StatusOK || mockDB.Accounts["owner"][0].DefaultEnvelopeFrom != "" {
+		t.Errorf("clearing: status %d, value %q", code, mockDB.Accounts["owner"][0].DefaultEnvelopeFrom)
+	}
+}
+
+func TestUpdateAccount_Signature(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", "127.0.0.1", 1)
+
+	patch := func(payload map[string]any) int {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest("PATCH", "/api/v1/accounts", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		server.updateAccount(w, req)
+		return w.Code
+	}
+
+	if code := patch(map[string]any{"owner_pubkey": "owner", "account_email": "me@example.com", "signature": "Me\n\n"}); code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d", http.StatusOK, code)
+	}
+	if got := mockDB.Accounts["owner"][0].Signature; got != "Me" {
+		t.Errorf("signature: want %q, got %q", "Me", got)
+	}
+
+	cases := []struct {
+		name    string
+		payload map[string]any
+		want    int
+	}{
+		{"too long", map[string]any{"owner_pubkey": "owner", "account_email": "me@example.com", "signature": strings.Repeat("x", maxSignatureBytes+1)}, http.StatusBadRequest},
+		{"control chars", map[string]any{"owner_pubkey": "owner", "account_email": "me@example.com", "signature": "a\x00b"}, http.StatusBadRequest},
+		{"empty update", map[string]any{"owner_pubkey": "owner", "account_email": "me@example.com"}, http.StatusBadRequest},
+		{"unknown account", map[string]any{"owner_pubkey": "owner", "account_email": "x@example.com", "signature": "s"}, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		if code := patch(tc.payload); code != tc.want {
+			t.Errorf("%s: status code: want %d, got %d", tc.name, tc.want, code)
+		}
+	}
+}
+
+func TestSendMail_AppendsSignature(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	mockDB.Accounts["owner"][0].Signature = "Alice\r\nexample.com"
+
+	send := func(omit bool) string {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{
+			"owner_pubkey": "owner", "account_email": "me@example.com",
+			"to": []string{"you@example.org"}, "subject": "s", "body": "Hello",
+			"omit_signature": omit,
+		})
+		req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+
+		server.sendMail(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		sent := fake.sent()
+		_, msgBody, _ := strings.Cut(sent[len(sent)-1], "\r\n\r\n")
+		return msgBody
+	}
+
+	if got, want := send(false), "Hello\r\n-- \r\nAlice\r\nexample.com\r\n"; got != want {
+		t.Errorf("body: want %q, got %q", want, got)
+	}
+	if got := send(true); got != "Hello\r\n" {
+		t.Errorf("body with omit_signature: want %q, got %q", "Hello\r\n", got)
+	}
+}
+
+func TestSendMail_AppendsSignatureToBothParts(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	mockDB.Accounts["owner"][0].Signature = "Alice <alice@example.com>\r\nR&D"
+
+	send := func(omit bool) (text, html string) {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{
+			"owner_pubkey": "owner", "account_email": "me@example.com",
+			"to": []string{"you@example.org"}, "subject": "s",
+			"body": "Hello", "html": "<html><body><p>Hello</p></body></html>",
+			"omit_signature": omit,
+		})
+		w := httptest.NewRecorder()
+		server.sendMail(w, httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		sent := fake.sent()
+		for _, part := range []struct {
+			mediaType string
+			out       *string
+		}{{"text/plain", &text}, {"text/html", &html}} {
+			p, err := mail.FindBody(sent[len(sent)-1], part.mediaType)
+			if err != nil {
+				t.Fatalf("%s part: %v", part.mediaType, err)
+			}
+			b, _ := io.ReadAll(p.Body)
+			*part.out = string(b)
+		}
+		return text, html
+	}
+
+	text, html := send(false)
+	if want := "Hello\r\n-- \r\nAlice <alice@example.com>\r\nR&D"; strings.TrimRight(text, "\r\n") != want {
+		t.Errorf("text part: want %q, got %q", want, text)
+	}
+	if want := `<html><body><p>Hello</p><div class="signature">-- <br>Alice &lt;alice@example.com&gt;<br>R&amp;D</div></body></html>`; strings.TrimRight(html, "\r\n") != want {
+		t.Errorf("HTML part: want %q, got %q", want, html)
+	}
+
+	text, html = send(true)
+	if strings.Contains(text, "Alice") || strings.Contains(html, "Alice") {
+		t.Errorf("omit_signature: signature sent anyway:\n%s\n%s", text, html)
+	}
+}
+
+func TestAppendHTMLSignature(t *testing.T) {
+	tests := []struct{ body, sig, want string }{
+		{"<p>Hi</p>", "", "<p>Hi</p>"},
+		{"", "Bob", ""},
+		{"<p>Hi</p>", "Bob", `<p>Hi</p><div class="signature">-- <br>Bob</div>`},
+		{"<BODY><p>Hi</p></BODY>", "Bob\r\n<b>", `<BODY><p>Hi</p><div class="signature">-- <br>Bob<br>&lt;b&gt;</div></BODY>`},
+	}
+	for _, tc := range tests {
+		if got := appendHTMLSignature(tc.body, tc.sig); got != tc.want {
+			t.Errorf("appendHTMLSignature(%q, %q): want %q, got %q", tc.body, tc.sig, tc.want, got)
+		}
+	}
+}
+
+func TestAppendSignature(t *testing.T) {
+	tests := []struct{ body, sig, want string }{
+		{"Hi", "", "Hi"},
+		{"Hi", "Bob", "Hi\r\n-- \r\nBob"},
+		{"Hi\r\n", "Bob", "Hi\r\n-- \r\nBob"},
+		{"", "Bob", "-- \r\nBob"},
+	}
+	for _, tc := range tests {
+		if got := appendSignature(tc.body, tc.sig); got != tc.want {
+			t.Errorf("appendSignature(%q, %q): want %q, got %q", tc.body, tc.sig, tc.want, got)
+		}
+	}
+}
+
+func TestSendMail_ListUnsubscribe(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	send := func(urls []string, oneClick bool) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{
+			"owner_pubkey": "owner", "account_email": "me@example.com",
+			"to": []string{"you@example.org"}, "subject": "s", "body": "b",
+			"list_unsubscribe": urls, "list_unsubscribe_post": oneClick,
+		})
+		w := httptest.NewRecorder()
+		server.sendMail(w, httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body)))
+		return w
+	}
+
+	w := send([]string{"mailto:unsubscribe@example.com", "https://example.com/u/1"}, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	msg := fake.sent()[0]
+	for _, want := range []string{
+		"\r\nList-Unsubscribe: <mailto:unsubscribe@example.com>, <https://example.com/u/1>\r\n",
+		"\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("missing header %q in:\n%s", want, msg)
+		}
+	}
+
+	for _, tt := range []struct {
+		urls     []string
+		oneClick bool
+	}{
+		{[]string{"http://example.com/u"}, false},
+		{[]string{"mailto:unsubscribe@example.com"}, true},
+		{[]string{"https://example.com/u>\r\nBcc: evil@example.net"}, false},
+	} {
+		if w := send(tt.urls, tt.oneClick); w.Code != http.StatusBadRequest {
+			t.Errorf("%v (one-click %v): want %d, got %d", tt.urls, tt.oneClick, http.StatusBadRequest, w.Code)
+		}
+	}
+	if n := fake.sessionCount(); n != 1 {
+		t.Errorf("invalid unsubscribe URLs must not reach the server: %d sessions", n)
+	}
+}
+
+func TestSendMail_DSN(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	withDSN := &fakeSMTP{ehlo: []string{"DSN", "AUTH PLAIN"}}
+	host, port := withDSN.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	without := &fakeSMTP{ehlo: []string{"AUTH PLAIN"}}
+	host, port = without.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "other@example.com", host, port)
+
+	send := func(account string, extra map[string]any) *httptest.ResponseRecorder {
+		t.Helper()
+		req := map[string]any{
+			"owner_pubkey": "owner", "account_email": account,
+			"to": []string{"you@example.org", "them@example.org"}, "subject": "s", "body": "b",
+		}
+		for k, v := range extra {
+			req[k] = v
+		}
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		server.sendMail(w, httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body)))
+		return w
+	}
+	envelope := func(f *fakeSMTP) []string {
+		var cmds []string
+		for _, c := range f.received() {
+			if strings.HasPrefix(c, "MAIL FROM") || strings.HasPrefix(c, "RCPT TO") {
+				cmds = append(cmds, c)
+			}
+		}
+		return cmds
+	}
+	dsn := map[string]any{"dsn": map[string]any{"notify": []string{"failure", "DELAY"}, "ret": "hdrs"}}
+
+	if w := send("me@example.com", dsn); w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	want := []string{
+		"MAIL FROM:<me@example.com> RET=HDRS",
+		"RCPT TO:<you@example.org> NOTIFY=FAILURE,DELAY",
+		"RCPT TO:<them@example.org> NOTIFY=FAILURE,DELAY",
+	}
+	if got := envelope(withDSN); !slices.Equal(got, want) {
+		t.Errorf("envelope: want %q, got %q", want, got)
+	}
+
+	if w := send("other@example.com", dsn); w.Code != http.StatusOK {
+		t.Fatalf("without DSN: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if got := envelope(without); len(got) != 3 || got[0] != "MAIL FROM:<other@example.com>" || got[1] != "RCPT TO:<you@example.org>" {
+		t.Errorf("without DSN: want the parameters left out, got %q", got)
+	}
+	dsn["require_dsn"] = true
+	if w := send("other@example.com", dsn); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("required without DSN: want %d, got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+	if n := len(without.sent()); n != 1 {
+		t.Errorf("required without DSN: want nothing sent, got %d messages", n)
+	}
+
+	for _, bad := range []map[string]any{
+		{"notify": []string{"NEVER", "FAILURE"}},
+		{"notify": []string{"FAILURE\r\nRCPT TO:<evil@example.net>"}},
+		{"ret": "BODY"},
+	} {
+		if w := send("me@example.com", map[string]any{"dsn": bad}); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: want %d, got %d", bad, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func sendSimple(t *testing.T, server *Server) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey": "owner", "account_email": "me@example.com",
+		"to": []string{"you@example.org"}, "subject": "s", "body": "b",
+	})
+	req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	server.sendMail(w, req)
+	return w
+}
+
+func noSendBackoff(t *testing.T) {
+	old := sendRetryBackoff
+	sendRetryBackoff = 0
+	t.Cleanup(func() { sendRetryBackoff = old })
+}
+
+func TestSendMail_RetriesTransientFailure(t *testing.T) {
+	noSendBackoff(t)
+	server, mockDB := setupTestServer(t)
+	server.cfg.SMTPSendRetries = 2
+
+	fake := &fakeSMTP{busySessions: 1}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	w := sendSimple(t, server)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response struct {
+		Attempts int `json:"attempts"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Attempts != 2 {
+		t.Errorf("attempts: want 2, got %d", response.Attempts)
+	}
+	if n := len(fake.sent()); n != 1 {
+		t.Errorf("expected 1 delivered message, got %d", n)
+	}
+}
+
+func TestSendMail_RetriesExhausted(t *testing.T) {
+	noSendBackoff(t)
+	server, mockDB := setupTestServer(t)
+	server.cfg.SMTPSendRetries = 2
+
+	fake := &fakeSMTP{busySessions: 10}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	w := sendSimple(t, server)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code: want %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "after 3 attempts") {
+		t.Errorf("expected attempt count in error, got %s", w.Body.String())
+	}
+	if n := fake.sessionCount(); n != 3 {
+		t.Errorf("sessions: want 3, got %d", n)
+	}
+}
+
+func TestSendMail_NoRetryWhenDeliveryUncertain(t *testing.T) {
+	noSendBackoff(t)
+	server, mockDB := setupTestServer(t)
+	server.cfg.SMTPSendRetries = 2
+
+	fake := &fakeSMTP{dropAfterData: true}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	w := sendSimple(t, server)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status code: want %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if n := fake.sessionCount(); n != 1 {
+		t.Errorf("must not retry after the end of DATA: %d sessions", n)
+	}
+}
+
+func TestSendMail_NoRetryOnPermanentFailure(t *testing.T) {
+	noSendBackoff(t)
+	server, mockDB := setupTestServer(t)
+	server.cfg.SMTPSendRetries = 2
+
+	fake := &fakeSMTP{dataDone: "554 5.7.1 rejected"}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	sendSimple(t, server)
+
+	if n := fake.sessionCount(); n != 1 {
+		t.Errorf("must not retry a permanent failure: %d sessions", n)
+	}
+}
+
+func TestFetchInbox_Duplicates(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	const date = "Date: Mon, 2 Jan 2006 15:04:05 -0700\r\n"
+	notification := "From: alerts@example.net\r\nTo: me@example.com\r\nSubject: Disk full\r\n" + date + "\r\nbody"
+	fake := &fakePOP3{messages: map[int]string{
+		// The same message under two sequence numbers, one copy carrying an
+		// extra header.
+		1: "X-Labels: Inbox\r\nFrom: alice@example.com\r\nMessage-ID: <m1@example.com>\r\nSubject: Hi\r\n" + date + "\r\nbody",
+		2: notification,
+		3: "From: alice@example.com\r\nMessage-ID: <m1@example.com>\r\nSubject: Hi\r\n" + date + "\r\nbody",
+		// Without a Message-ID: an identical copy of 2, and a distinct
+		// message alike but for its recipient.
+		4: notification,
+		5: "From: alerts@example.net\r\nTo: you@example.com\r\nSubject: Disk full\r\n" + date + "\r\nbody",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	inbox := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com"+query, nil))
+		return w
+	}
+
+	var resp inboxResponse
+	json.NewDecoder(inbox("").Body).Decode(&resp)
+	copies := make(map[int]int)
+	for _, m := range resp.Messages {
+		copies[m.ID] = m.Duplicates
+	}
+	if resp.Fetched != 5 || resp.Duplicates != 2 || !reflect.DeepEqual(copies, map[int]int{3: 1, 4: 1, 5: 0}) {
+		t.Errorf("want the smaller copy 3 and the first copy 4 kept, 5 kept apart; got %d fetched, %d duplicates, %v",
+			resp.Fetched, resp.Duplicates, copies)
+	}
+	if len(mockDB.Cached) != 5 {
+		t.Errorf("want every copy cached, got %d", len(mockDB.Cached))
+	}
+
+	json.NewDecoder(inbox("&include_duplicates=true").Body).Decode(&resp)
+	if len(resp.Messages) != 5 || resp.Duplicates != 0 {
+		t.Errorf("include_duplicates: want all 5 copies, got %d", len(resp.Messages))
+	}
+	if inbox("").Header().Get("ETag") == inbox("&include_duplicates=true").Header().Get("ETag") {
+		t.Error("responses with and without duplicates share an ETag")
+	}
+
+	lines := decodeNDJSON(t, inbox("&stream=true").Body.String())
+	done := lines[len(lines)-1]
+	if len(lines) != 4 || done["duplicates"] != float64(2) || done["fetched"] != float64(5) {
+		t.Errorf("stream: want 3 messages and 2 duplicates, got %v", lines)
+	}
+
+	got := searchCache(t, server, "owner=owner&from=alice@example.com")
+	if len(got) != 1 || got[0].UID != "uid-3" || got[0].Duplicates != 1 {
+		t.Errorf("search: want the smaller copy standing for the other, got %+v", got)
+	}
+	if got := searchCache(t, server, "owner=owner&from=alerts@example.net&include_duplicates=true"); len(got) != 3 {
+		t.Errorf("search with include_duplicates: want 3, got %+v", got)
+	}
+	if got := searchCache(t, server, "owner=owner&from=alerts@example.net"); len(got) != 2 {
+		t.Errorf("search: want the distinct alerts kept apart, got %+v", got)
+	}
+}
+
+func TestFetchInbox_Snippets(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	body := "Lunch at noon?\r\n\r\nOn Mon, 2 Jan 2006, Bob wrote:\r\n> Free tomorrow?\r\n" + strings.Repeat("> more\r\n", 20)
+	fake := &fakePOP3{messages: map[int]string{
+		1: "From: alice@example.com\r\nSubject: Lunch\r\n\r\n" + body,
+		2: "From: bob@example.com\r\nContent-Type: application/pdf\r\n\r\nJVBERi0=\r\n",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	inbox := func(query string) inboxResponse {
+		w := httptest.NewRecorder()
+		server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com"+query, nil))
+		var resp inboxResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+	snippets := func(resp inboxResponse) map[int]string {
+		got := make(map[int]string)
+		for _, m := range resp.Messages {
+			if m.Body != "" {
+				t.Errorf("message %d: the body must not be returned", m.ID)
+			}
+			got[m.ID] = m.Snippet
+		}
+		return got
+	}
+
+	if got := snippets(inbox("")); got[1] != "" || got[2] != "" {
+		t.Errorf("without snippets=true: want no snippets, got %q", got)
+	}
+	if got := snippets(inbox("&snippets=true")); !reflect.DeepEqual(got, map[int]string{1: "Lunch at noon?", 2: ""}) {
+		t.Errorf("snippets=true: got %q", got)
+	}
+
+	// The snippet is cached and kept by a later fetch without snippets.
+	inbox("")
+	if got := searchCache(t, server, "owner=owner&from=alice@example.com"); len(got) != 1 || got[0].Snippet != "Lunch at noon?" {
+		t.Errorf("search: want the cached snippet, got %+v", got)
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"mulamail/db"
+)
+
+// maintenanceCheckEvery is how long an instance goes by its last reading of
+// the maintenance switch, and so how long a change takes to reach every
+// instance.
+const maintenanceCheckEvery = 5 * time.Second
+
+// Unless the switch says otherwise, writes refused in maintenance mode are
+// answered with this message and Retry-After.
+const (
+	maintenanceMessage    = "the service is under maintenance; writes are paused, reads keep working"
+	maintenanceRetryAfter = 60
+)
+
+// maintenanceState is an instance's reading of the maintenance switch,
+// which lives in the database so that every instance sees it.  Its zero
+// value has not read the switch yet.
+type maintenanceState struct {
+	now func() time.Time // nil means time.Now
+
+	mu      sync.Mutex
+	flag    db.Maintenance
+	checked time.Time
+}
+
+// maintenance returns the maintenance switch as last read, reading it
+// again once maintenanceCheckEvery has passed.  Should the read fail, the
+// last reading stands: a database that cannot be read fails writes anyway.
+func (s *Server) maintenance(ctx context.Context) db.Maintenance {
+	m := &s.maint
+	now := time.Now
+	if m.now != nil {
+		now = m.now
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.checked.IsZero() && now().Sub(m.checked) < maintenanceCheckEvery {
+		return m.flag
+	}
+	flag, err := s.db.GetMaintenance(ctx)
+	if err != nil {
+		log.Printf("maintenance: read switch: %v", err)
+		return m.flag
+	}
+	if flag.Enabled != m.flag.Enabled {
+		log.Printf("maintenance: enabled=%t", flag.Enabled)
+	}
+	m.flag, m.checked = *flag, now()
+	return m.flag
+}
+
+// paused reports whether background workers should stand still: while
+// maintenance mode is on, they take no new work.
+func (s *Server) paused(ctx context.Context) bool {
+	return s.maintenance(ctx).Enabled
+}
+
+// withMaintenance refuses the request with 503, Retry-After and the
+// switch's message while maintenance mode is on.  NewRouter wraps every
+// route but GETs and those marked duringMaintenance with it.
+func (s *Server) withMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flag := s.maintenance(r.Context())
+		if !flag.Enabled {
+			next(w, r)
+			return
+		}
+		retryAfter, msg := flag.RetryAfter, flag.Message
+		if retryAfter <= 0 {
+			retryAfter = maintenanceRetryAfter
+		}
+		if msg == "" {
+			msg = maintenanceMessage
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, http.StatusServiceUnavailable, msg)
+	}
+}
+
+// GET /api/v1/admin/maintenance
+//
+// Returns the maintenance switch as stored.
+func (s *Server) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	flag, err := s.db.GetMaintenance(r.Context())
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, flag)
+}
+
+// PUT /api/v1/admin/maintenance
+//
+// Turns maintenance mode on or off for every instance.  While it is on,
+// requests other than GETs are refused with 503, "message" and Retry-After
+// "retry_after_seconds", and background workers pause.  Other instances
+// follow within maintenanceCheckEvery; this one at once.
+//
+// Request: { "enabled": true, "message": "Migrating storage, back by 14:00 UTC", "retry_after_seconds": 600 }
+func (s *Server) putMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req db.Maintenance
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.RetryAfter < 0 {
+		writeError(w, http.StatusBadRequest, "retry_after_seconds must not be negative")
+		return
+	}
+	if err := s.db.SetMaintenance(r.Context(), &req); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	s.maint.mu.Lock()
+	s.maint.checked = time.Time{}
+	s.maint.mu.Unlock()
+	log.Printf("[%s] maintenance: switch set: enabled=%t", requestID(r.Context()), req.Enabled)
+	writeJSON(w, http.StatusOK, req)
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mulamail/db"
+)
+
+// setMaintenance flips the switch through the admin endpoint.
+func setMaintenance(t *testing.T, router http.Handler, flag map[string]any) {
+	t.Helper()
+	body, _ := json.Marshal(flag)
+	req := httptest.NewRequest("PUT", "/api/v1/admin/maintenance", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT maintenance: want 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func serve(router http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewBufferString(body)))
+	return w
+}
+
+func TestMaintenance_RefusesWritesOnly(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	contact := `{"owner_pubkey": "owner", "email": "bob@example.com"}`
+
+	if w := serve(router, "POST", "/api/v1/contacts", contact); w.Code != http.StatusCreated {
+		t.Fatalf("before maintenance: want 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	setMaintenance(t, router, map[string]any{"enabled": true, "message": "migrating, back at 14:00", "retry_after_seconds": 600})
+	w := serve(router, "POST", "/api/v1/contacts", `{"owner_pubkey": "owner", "email": "carol@example.com"}`)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "600" {
+		t.Fatalf("write in maintenance: want 503 with Retry-After 600, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	var resp errorResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Error != "migrating, back at 14:00" {
+		t.Errorf("want the switch's message, got %q", resp.Error)
+	}
+	if len(mockDB.Contacts) != 1 {
+		t.Errorf("the refused write must not be stored, have %d contacts", len(mockDB.Contacts))
+	}
+
+	if w := serve(router, "GET", "/api/v1/contacts?owner=owner", ""); w.Code != http.StatusOK {
+		t.Errorf("read in maintenance: want 200, got %d", w.Code)
+	}
+	if w := serve(router, "POST", "/api/v1/identity/resolve-batch", `{"emails": ["a@example.com"]}`); w.Code != http.StatusOK {
+		t.Errorf("read-only POST in maintenance: want 200, got %d", w.Code)
+	}
+	if w := serve(router, "GET", "/api/health", ""); w.Code != http.StatusOK {
+		t.Errorf("health in maintenance: want 200, got %d", w.Code)
+	}
+
+	setMaintenance(t, router, map[string]any{"enabled": false})
+	if w := serve(router, "POST", "/api/v1/contacts", `{"owner_pubkey": "owner", "email": "carol@example.com"}`); w.Code != http.StatusCreated {
+		t.Errorf("after maintenance: want 201 at once, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMaintenance_DefaultMessage(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	mockDB.Maintenance = &db.Maintenance{Enabled: true}
+
+	w := httptest.NewRecorder()
+	server.withMaintenance(func(http.ResponseWriter, *http.Request) {
+		t.Error("handler must not run in maintenance mode")
+	})(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" || !bytes.Contains(w.Body.Bytes(), []byte("maintenance")) {
+		t.Errorf("want 503 with the default message and Retry-After, got %d %q %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+}
+
+// Another instance follows the switch once its last reading is older than
+// maintenanceCheckEvery, without a restart.
+func TestMaintenance_OtherInstanceFollows(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+
+	other := &Server{db: mockDB, cfg: server.cfg}
+	now := time.Now()
+	other.maint.now = func() time.Time { return now }
+	write := func() int {
+		w := httptest.NewRecorder()
+		other.withMaintenance(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })(w, httptest.NewRequest("POST", "/", nil))
+		return w.Code
+	}
+
+	if code := write(); code != http.StatusNoContent {
+		t.Fatalf("before maintenance: want 204, got %d", code)
+	}
+	setMaintenance(t, router, map[string]any{"enabled": true})
+	if code := write(); code != http.StatusNoContent {
+		t.Errorf("within maintenanceCheckEvery the last reading stands: want 204, got %d", code)
+	}
+	now = now.Add(maintenanceCheckEvery)
+	if code := write(); code != http.StatusServiceUnavailable {
+		t.Errorf("after maintenanceCheckEvery: want 503, got %d", code)
+	}
+}
+
+func TestMaintenance_PausesWorkers(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	now := time.Now()
+	server.maint.now = func() time.Time { return now }
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	asyncSend(t, server, "?async=true")
+
+	mockDB.Maintenance = &db.Maintenance{Enabled: true}
+	now = now.Add(maintenanceCheckEvery)
+	o := newTestOutbox(server, time.Now().Add(time.Second))
+	o.processQueued(context.Background(), "test/0")
+	if m := mockDB.Outbox[0]; m.Status != db.OutboxQueued || len(fake.sent()) != 0 {
+		t.Fatalf("in maintenance the outbox must not deliver, got %s and %d sent", m.Status, len(fake.sent()))
+	}
+
+	mockDB.Maintenance = &db.Maintenance{}
+	now = now.Add(maintenanceCheckEvery)
+	o.processQueued(context.Background(), "test/0")
+	if m := mockDB.Outbox[0]; m.Status != db.OutboxSent || len(fake.sent()) != 1 {
+		t.Errorf("after maintenance: want sent, got %s and %d sent", m.Status, len(fake.sent()))
+	}
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+// mboxPartSize is roughly how much of an mbox file built in the background
+// is stored per vault blob, so neither building nor downloading it holds the
+// whole file in memory.
+const mboxPartSize = 8 << 20
+
+// exportPartKey derives the vault key of part i of an mbox export.
+func exportPartKey(owner string, id primitive.ObjectID, i int) string {
+	return fmt.Sprintf("exports/%s/%s.mbox/%04d", hashComponent(owner), id.Hex(), i)
+}
+
+// exportKeys returns the vault keys holding an export's file.  Parts of an
+// mbox export still being built are not known yet; the vault collector's
+// grace period keeps them.
+func exportKeys(job db.ExportJob) []string {
+	if job.Kind != db.ExportMbox {
+		return []string{exportStorageKey(job.OwnerPubKey, job.ID)}
+	}
+	keys := make([]string, job.Parts)
+	for i := range keys {
+		keys[i] = exportPartKey(job.OwnerPubKey, job.ID, i)
+	}
+	return keys
+}
+
+// GET /api/v1/mail/export-mbox?owner=<pubkey>&account=<email>&since=<RFC3339>&until=<RFC3339>
+//
+// Downloads the account's messages archived in the vault as an mbox file,
+// oldest first, optionally only those dated from since and before until.
+// The file is streamed a message at a time.  When the archived messages are
+// estimated at more than MBOX_STREAM_MAX_BYTES, an export job is queued
+// instead, and its status URL returned in Location; the file is downloaded
+// from the export once it is done.  While the account has an mbox export
+// queued or running, that job is returned.
+//
+// Response: the mbox file (200), or the export job (202)
+func (s *Server) exportMbox(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	owner, account := q.Get("owner"), q.Get("account")
+	if owner == "" || account == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey and account required")
+		return
+	}
+	var since, until time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, p.name+" must be an RFC 3339 timestamp")
+				return
+			}
+			*p.t = t
+		}
+	}
+	if s.storage == nil {
+		writeError(w, http.StatusServiceUnavailable, "vault storage is not configured")
+		return
+	}
+	if _, err := s.db.GetMailAccount(r.Context(), owner, account); errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	msgs, err := s.mboxMessages(r.Context(), owner, account, since, until)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	estimate := 0
+	for _, m := range msgs {
+		estimate += m.Size
+	}
+	if limit := s.cfg.MboxStreamMaxBytes; limit > 0 && estimate > limit {
+		job := &db.ExportJob{OwnerPubKey: owner, Kind: db.ExportMbox, AccountEmail: account, Since: since, Until: until}
+		if _, err := s.db.CreateExportJob(r.Context(), job); err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		w.Header().Set("Location", "/api/v1/export/"+job.ID.Hex()+"/status?"+url.Values{"owner": {owner}}.Encode())
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/mbox")
+	w.Header().Set("Content-Disposition", mboxDisposition(account))
+	w.WriteHeader(http.StatusOK)
+	// Headers are committed; a failure from here on can only be logged and
+	// the file truncated.
+	flusher, _ := w.(http.Flusher)
+	for _, d := range msgs {
+		if _, err := s.writeMboxMessage(r.Context(), w, fc, d); err != nil {
+			log.Printf("[%s] export mbox: message %s: %v", requestID(r.Context()), d.ID.Hex(), err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// mboxDisposition names the mbox file of an account.
+func mboxDisposition(account string) string {
+	if d := mime.FormatMediaType("attachment", map[string]string{"filename": exportFileName(account) + ".mbox"}); d != "" {
+		return d
+	}
+	return "attachment"
+}
+
+// mboxDate is the date a cached message is filed under in an mbox file:
+// its Date header or, failing that, when it was cached.
+func mboxDate(d db.CachedMessage) time.Time {
+	if d.Date.IsZero() {
+		return d.CachedAt
+	}
+	return d.Date
+}
+
+// mboxMessages returns the account's cached messages dated from since and
+// before until (either zero for no bound), oldest first.
+func (s *Server) mboxMessages(ctx context.Context, owner, account string, since, until time.Time) ([]db.CachedMessage, error) {
+	cached, err := s.db.GetCachedMessagesByOwner(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []db.CachedMessage
+	for _, d := range cached {
+		date := mboxDate(d)
+		if d.AccountEmail != account || (!since.IsZero() && date.Before(since)) || (!until.IsZero() && !date.Before(until)) {
+			continue
+		}
+		msgs = append(msgs, d)
+	}
+	slices.SortStableFunc(msgs, func(a, b db.CachedMessage) int { return mboxDate(a).Compare(mboxDate(b)) })
+	return msgs, nil
+}
+
+// writeMboxMessage appends a cached message to an mbox file, and reports
+// whether it did: a message whose body is not in the vault is left out.
+func (s *Server) writeMboxMessage(ctx context.Context, w io.Writer, fc *vault.FieldCipher, d db.CachedMessage) (bool, error) {
+	raw, err := s.cachedRaw(ctx, d.OwnerPubKey, d.AccountEmail, d.UID)
+	if err != nil || raw == "" {
+		return false, err
+	}
+	m, err := decryptExportedMessage(fc, d)
+	if err != nil {
+		return false, fmt.Errorf("decrypt: %w", err)
+	}
+	sender, _ := senderAddress(m.From)
+	return true, mail.WriteMbox(w, sender.Email, mboxDate(d), raw)
+}
+
+// buildMbox writes the mbox file of an mbox export to storage, in parts
+// of about mboxPartSize.
+func (ex *Exporter) buildMbox(ctx context.Context, job *db.ExportJob) error {
+	fc, err := vault.NewFieldCipher(ex.srv.cfg.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	msgs, err := ex.srv.mboxMessages(ctx, job.OwnerPubKey, job.AccountEmail, job.Since, job.Until)
+	if err != nil {
+		return fmt.Errorf("cached messages: %w", err)
+	}
+	parts, size, count := 0, 0, 0
+	part := new(bytes.Buffer)
+	store := func() error {
+		if err := ex.srv.storage.Put(ctx, exportPartKey(job.OwnerPubKey, job.ID, parts), part.Bytes()); err != nil {
+			return fmt.Errorf("store part %d: %w", parts, err)
+		}
+		parts++
+		size += part.Len()
+		part = new(bytes.Buffer)
+		return nil
+	}
+	for _, d := range msgs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		written, err := ex.srv.writeMboxMessage(ctx, part, fc, d)
+		if err != nil {
+			return fmt.Errorf("message %s: %w", d.ID.Hex(), err)
+		}
+		if written {
+			count++
+		}
+		if part.Len() >= mboxPartSize {
+			if err := store(); err != nil {
+				return err
+			}
+		}
+	}
+	if part.Len() > 0 {
+		if err := store(); err != nil {
+			return err
+		}
+	}
+	job.StorageKey = fmt.Sprintf("exports/%s/%s.mbox", hashComponent(job.OwnerPubKey), job.ID.Hex())
+	job.Parts, job.Size, job.Counts = parts, size, map[string]int{"messages": count}
+	return nil
+}
+
+// downloadMbox streams the parts of a finished mbox export.  Once the
+// first part is sent, a part that cannot be read truncates the file.
+func (s *Server) downloadMbox(w http.ResponseWriter, r *http.Request, job *db.ExportJob) {
+	start := func() {
+		w.Header().Set("Content-Type", "application/mbox")
+		w.Header().Set("Content-Disposition", mboxDisposition(job.AccountEmail))
+		w.Header().Set("Content-Length", strconv.Itoa(job.Size))
+		w.WriteHeader(http.StatusOK)
+	}
+	if job.Parts == 0 {
+		start()
+		return
+	}
+	for i := range job.Parts {
+		data, err := s.storage.Get(r.Context(), exportPartKey(job.OwnerPubKey, job.ID, i))
+		if err != nil && i == 0 {
+			writeInternalError(w, r, err)
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] export %s: part %d: %v", requestID(r.Context()), job.ID.Hex(), i, err)
+			return
+		}
+		if i == 0 {
+			start()
+		}
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+	}
+}
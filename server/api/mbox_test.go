@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+	"mulamail/vault"
+)
+
+// setupMbox gives the owner an account with archived messages dated a day
+// apart from 1 May 2024, and the server a vault.  Message "missing" is
+// indexed but its body is not in the vault.
+func setupMbox(t *testing.T, bodies ...string) (*Server, *dbtest.Mock) {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	newTestVault(t, server)
+	ctx := context.Background()
+	mockDB.CreateMailAccount(ctx, &db.MailAccount{OwnerPubKey: "owner", AccountEmail: "me@example.com"})
+	fc, _ := vault.NewFieldCipher(server.cfg.EncryptionKey)
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// Indexed newest first, to check the file is sorted.
+	for i := len(bodies) - 1; i >= 0; i-- {
+		uid := string(rune('a' + i))
+		m, _ := encryptPreview(fc, &db.CachedMessage{
+			OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: uid,
+			From: "Alice <alice@example.com>", Date: day.AddDate(0, 0, i), Size: len(bodies[i]),
+		})
+		mockDB.UpsertCachedMessage(ctx, m)
+		server.storage.Put(ctx, messageCacheKey("owner", "me@example.com", uid), []byte(bodies[i]))
+	}
+	m, _ := encryptPreview(fc, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: "missing", Date: day, Size: 10})
+	mockDB.UpsertCachedMessage(ctx, m)
+	return server, mockDB
+}
+
+func getMbox(server *Server, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	NewRouter(server.db, server.solana, server.storage, server.cfg).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/mail/export-mbox?"+query, nil))
+	return w
+}
+
+func TestExportMbox_Stream(t *testing.T) {
+	server, _ := setupMbox(t,
+		"Subject: One\r\n\r\nFrom the start\r\n>From quoted\r\n",
+		"Subject: Two\r\n\r\nSecond\r\n",
+		"Subject: Three\r\n\r\nThird\r\n",
+	)
+
+	w := getMbox(server, "owner=owner&account=me@example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/mbox" {
+		t.Errorf("Content-Type: want application/mbox, got %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="me@example.com.mbox"` {
+		t.Errorf("Content-Disposition: got %q", cd)
+	}
+	want := "From alice@example.com Wed May  1 12:00:00 2024\nSubject: One\n\n>From the start\n>>From quoted\n\n" +
+		"From alice@example.com Thu May  2 12:00:00 2024\nSubject: Two\n\nSecond\n\n" +
+		"From alice@example.com Fri May  3 12:00:00 2024\nSubject: Three\n\nThird\n\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("mbox:\nwant %q\ngot  %q", want, got)
+	}
+
+	w = getMbox(server, "owner=owner&account=me@example.com&since=2024-05-02T00:00:00Z&until=2024-05-03T12:00:00Z")
+	if got := w.Body.String(); strings.Count(got, "From alice") != 1 || !strings.Contains(got, "Subject: Two") {
+		t.Errorf("date range: want only message two, got %q", got)
+	}
+}
+
+func TestExportMbox_LargeExportIsQueued(t *testing.T) {
+	big := strings.Repeat("x", 1000) + "\r\n"
+	body := "Subject: Big\r\n\r\n" + strings.Repeat(big, mboxPartSize/len(big)*2/3)
+	server, mockDB := setupMbox(t, body, body, body)
+	ctx := context.Background()
+
+	server.cfg.MboxStreamMaxBytes = 0
+	streamed := getMbox(server, "owner=owner&account=me@example.com").Body.String()
+
+	server.cfg.MboxStreamMaxBytes = len(body)
+	w := getMbox(server, "owner=owner&account=me@example.com")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status: want %d, got %d", http.StatusAccepted, w.Code)
+	}
+	var job db.ExportJob
+	json.NewDecoder(w.Body).Decode(&job)
+	if job.Kind != db.ExportMbox || job.AccountEmail != "me@example.com" {
+		t.Fatalf("want an mbox export of the account, got %+v", job)
+	}
+	if loc := w.Header().Get("Location"); loc != "/api/v1/export/"+job.ID.Hex()+"/status?owner=owner" {
+		t.Errorf("Location: got %q", loc)
+	}
+	if again := getMbox(server, "owner=owner&account=me@example.com"); !strings.Contains(again.Body.String(), job.ID.Hex()) {
+		t.Errorf("export while one is queued: want job %s, got %s", job.ID.Hex(), again.Body.String())
+	}
+
+	now := time.Now()
+	ex := &Exporter{srv: server, worker: "w1", ttl: time.Hour, maxAttempts: exportMaxAttempts, now: func() time.Time { return now }}
+	ex.processQueued(ctx)
+	done := mockDB.Exports[0]
+	if done.Status != db.ExportDone || done.Parts != 2 || done.Counts["messages"] != 3 {
+		t.Fatalf("want done in two parts with 3 messages, got %+v", done)
+	}
+
+	w = httptest.NewRecorder()
+	NewRouter(server.db, server.solana, server.storage, server.cfg).ServeHTTP(w,
+		httptest.NewRequest("GET", "/api/v1/export/"+job.ID.Hex()+"/download?owner=owner", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/mbox" {
+		t.Fatalf("download: got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if w.Body.String() != streamed {
+		t.Errorf("download: want the file streamed without the limit (%d bytes), got %d bytes", len(streamed), w.Body.Len())
+	}
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length: want %d, got %s", w.Body.Len(), cl)
+	}
+
+	refs, _ := referencedExportArchives(ctx, mockDB)
+	for _, key := range exportKeys(*done) {
+		if !refs[key] {
+			t.Errorf("vault collector: part %s not referenced", key)
+		}
+	}
+	now = now.Add(2 * time.Hour)
+	ex.expire(ctx)
+	for _, key := range exportKeys(*done) {
+		if _, err := server.storage.Get(ctx, key); err == nil {
+			t.Errorf("expired export: part %s not deleted", key)
+		}
+	}
+}
+
+func TestExportMbox_Requests(t *testing.T) {
+	server, _ := setupMbox(t)
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"owner=owner", http.StatusBadRequest},
+		{"owner=owner&account=me@example.com&since=yesterday", http.StatusBadRequest},
+		{"owner=owner&account=other@example.com", http.StatusNotFound},
+		{"owner=owner&account=me@example.com", http.StatusOK},
+	} {
+		if w := getMbox(server, tt.query); w.Code != tt.want {
+			t.Errorf("%s: want %d, got %d: %s", tt.query, tt.want, w.Code, w.Body.String())
+		}
+	}
+
+	server.storage = nil
+	if w := getMbox(server, "owner=owner&account=me@example.com"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without a vault: want %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !testfixtures
+
+package api
+
+// fixtureRoutes is empty outside testfixtures builds; see fixtures.go.
+func (s *Server) fixtureRoutes() []route { return nil }
@@ -0,0 +1,38 @@
+//go:build !testfixtures
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mulamail/db"
+)
+
+// TestRouter_NoFixtureRoutesByDefault checks that a default build serves
+// no fixture endpoints, even with ENV=test.
+func TestRouter_NoFixtureRoutesByDefault(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.Env = "test"
+	mockDB.CreateIdentity(context.Background(), &db.Identity{Email: "alice@example.com", PubKey: "owner"})
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+
+	for _, path := range []string{"/api/test/seed", "/api/test/reset"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(`{"identities":[]}`)))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("POST %s: want %d, got %d", path, http.StatusNotFound, w.Code)
+		}
+	}
+	if len(mockDB.Identities) != 1 {
+		t.Error("want the database left alone")
+	}
+	for route := range specRoutes(fetchSpec(t)) {
+		if strings.Contains(route, "/api/test/") {
+			t.Errorf("%s documented in a default build", route)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"embed"
+	"encoding"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// binaryBody marks a route whose success body is raw bytes rather than JSON.
+type binaryBody struct{}
+
+// htmlPage marks a route whose success body is an HTML page.
+type htmlPage struct{}
+
+// schemaProvider lets a type whose JSON form differs from its Go shape (for
+// example because of a custom UnmarshalJSON) describe itself.
+type schemaProvider interface {
+	openAPISchema() map[string]any
+}
+
+func (recipient) openAPISchema() map[string]any {
+	return map[string]any{
+		"description": `An address string or {"email": ..., "name": ...}`,
+		"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"email": map[string]any{"type": "string"},
+					"name":  map[string]any{"type": "string"},
+				},
+				"required": []string{"email"},
+			},
+		},
+	}
+}
+
+// GET /api/openapi.json
+func (s *Server) serveOpenAPI(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.openAPI) //nolint:errcheck
+}
+
+//go:embed docs.html
+var docsPage []byte
+
+// swaggerUI holds the swagger-ui-dist files the docs page loads, vendored
+// at the version in swaggerui/VERSION; "make swagger-ui" fetches them.
+//
+//go:embed swaggerui
+var swaggerUI embed.FS
+
+// GET /api/docs
+//
+// Serves Swagger UI pointed at /api/openapi.json.  The page and the Swagger
+// UI assets are embedded in the binary, so the docs load no third-party
+// code and work without internet access.
+func (s *Server) serveDocs(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage) //nolint:errcheck
+}
+
+// GET /api/docs/assets/{file}
+//
+// Serves a Swagger UI asset.  They change only with the binary, so clients
+// may cache them for a day.
+func (s *Server) serveDocsAsset(w http.ResponseWriter, r *http.Request) {
+	name := "swaggerui/" + r.PathValue("file")
+	if _, err := fs.Stat(swaggerUI, name); err != nil {
+		writeError(w, http.StatusNotFound, "no such asset")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFileFS(w, r, swaggerUI, name)
+}
+
+// pathParam matches a ServeMux wildcard such as {id}.
+var pathParam = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// openAPISpec builds an OpenAPI 3 document describing routes.  Request and
+// response schemas are derived from the Go types' JSON encoding.
+func openAPISpec(routes []route) map[string]any {
+	g := &schemaGen{components: make(map[string]any)}
+	errorSchema := g.schema(reflect.TypeOf(errorResponse{}))
+
+	paths := make(map[string]map[string]any)
+	for _, rt := range routes {
+		op := map[string]any{"summary": rt.summary}
+
+		var params []any
+		for _, m := range pathParam.FindAllStringSubmatch(rt.path, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, q := range rt.query {
+			params = append(params, map[string]any{
+				"name": q.name, "in": "query", "required": q.required,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if rt.request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(rt.request))}},
+			}
+		}
+
+		responses := make(map[string]any)
+		for code, body := range rt.responses {
+			resp := map[string]any{"description": http.StatusText(code)}
+			if body != nil {
+				resp["content"] = g.content(body)
+			}
+			responses[strconv.Itoa(code)] = resp
+		}
+		errs := rt.errors
+		if rt.admin {
+			op["security"] = []any{map[string]any{"adminToken": []string{}}}
+			errs = append([]int{http.StatusUnauthorized, http.StatusNotFound}, errs...)
+		}
+		if rt.scope != "" {
+			// Callable anonymously or with an API key holding the scope.
+			op["security"] = []any{map[string]any{}, map[string]any{"apiKey": []string{}}}
+			op["description"] = "API keys need the " + rt.scope + " scope."
+			errs = append(errs, http.StatusUnauthorized, http.StatusForbidden)
+		}
+		if !rt.unlimited || (rt.method != "GET" && !rt.duringMaintenance) {
+			errs = append(errs, http.StatusServiceUnavailable)
+		}
+		for _, code := range errs {
+			responses[strconv.Itoa(code)] = map[string]any{
+				"description": http.StatusText(code),
+				"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+			}
+		}
+		op["responses"] = responses
+
+		if paths[rt.path] == nil {
+			paths[rt.path] = make(map[string]any)
+		}
+		paths[rt.path][strings.ToLower(rt.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "MulaMail API",
+			"version":     "1.0.0",
+			"description": "Solana-identity email bridge: identities, legacy POP3/SMTP accounts, mail and billing.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.components,
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]any{"type": "http", "scheme": "bearer",
+					"description": "An mk_... key minted with POST /api/v1/keys"},
+			},
+		},
+	}
+}
+
+// schemaGen converts Go types to JSON schemas, collecting named structs
+// under components/schemas and referring to them by name.
+type schemaGen struct {
+	components map[string]any
+}
+
+var (
+	timeType           = reflect.TypeOf(time.Time{})
+	schemaProviderType = reflect.TypeOf((*schemaProvider)(nil)).Elem()
+	jsonMarshalerType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType  = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// content returns the media type map for a success body.
+func (g *schemaGen) content(body any) map[string]any {
+	switch body.(type) {
+	case binaryBody:
+		return map[string]any{"application/octet-stream": map[string]any{
+			"schema": map[string]any{"type": "string", "format": "binary"},
+		}}
+	case htmlPage:
+		return map[string]any{"text/html": map[string]any{
+			"schema": map[string]any{"type": "string"},
+		}}
+	}
+	return map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(body))}}
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	if t.Implements(schemaProviderType) {
+		return reflect.Zero(t).Interface().(schemaProvider).openAPISchema()
+	}
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	if t.Kind() != reflect.Pointer && (t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)) {
+		// Custom encodings in this codebase (e.g. ObjectIDs) are strings.
+		return map[string]any{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			g.components[t.Name()] = map[string]any{} // placeholder breaks cycles
+			g.components[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// object describes a struct by its JSON fields.
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	g.fields(t, props)
+	obj := map[string]any{"type": "object", "properties": props}
+	if len(props) == 0 {
+		delete(obj, "properties")
+	}
+	return obj
+}
+
+// fields adds t's JSON fields to props, flattening untagged embedded
+// structs the way encoding/json does.
+func (g *schemaGen) fields(t reflect.Type, props map[string]any) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			g.fields(ft, props)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+	}
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fetchSpec serves the OpenAPI document through a fresh router.
+func fetchSpec(t *testing.T) map[string]any {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/openapi.json: want 200, got %d", w.Code)
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("decode spec: %v", err)
+	}
+	return spec
+}
+
+// specRoutes returns the "METHOD /path" pairs the document covers.
+func specRoutes(spec map[string]any) map[string]bool {
+	out := make(map[string]bool)
+	for path, item := range spec["paths"].(map[string]any) {
+		for method := range item.(map[string]any) {
+			out[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+	return out
+}
+
+// TestOpenAPISpec_Valid checks the generated document against the
+// structural rules of the OpenAPI 3.0 schema that matter for it: required
+// top-level objects, operations keyed by HTTP method with described
+// responses, well-formed parameters, and $refs that resolve.
+func TestOpenAPISpec_Valid(t *testing.T) {
+	spec := fetchSpec(t)
+
+	if v, _ := spec["openapi"].(string); !strings.HasPrefix(v, "3.0.") {
+		t.Errorf("openapi: want 3.0.x, got %q", v)
+	}
+	info, _ := spec["info"].(map[string]any)
+	if info["title"] == "" || info["version"] == "" || info["title"] == nil || info["version"] == nil {
+		t.Errorf("info: title and version are required, got %v", info)
+	}
+	schemas, _ := spec["components"].(map[string]any)["schemas"].(map[string]any)
+
+	methods := map[string]bool{"get": true, "put": true, "post": true, "delete": true, "options": true, "head": true, "patch": true, "trace": true}
+	wildcard := regexp.MustCompile(`\{(\w+)\}`)
+	for path, item := range spec["paths"].(map[string]any) {
+		if !strings.HasPrefix(path, "/") {
+			t.Errorf("path %q must start with /", path)
+		}
+		for method, raw := range item.(map[string]any) {
+			where := strings.ToUpper(method) + " " + path
+			if !methods[method] {
+				t.Errorf("%s: %q is not an HTTP method", where, method)
+				continue
+			}
+			op := raw.(map[string]any)
+
+			responses, _ := op["responses"].(map[string]any)
+			if len(responses) == 0 {
+				t.Errorf("%s: no responses", where)
+			}
+			for code, resp := range responses {
+				if n, err := strconv.Atoi(code); err != nil || n < 100 || n > 599 {
+					t.Errorf("%s: invalid response code %q", where, code)
+				}
+				if d, _ := resp.(map[string]any)["description"].(string); d == "" {
+					t.Errorf("%s %s: response description is required", where, code)
+				}
+			}
+
+			pathParams := make(map[string]bool)
+			params, _ := op["parameters"].([]any)
+			for _, p := range params {
+				p := p.(map[string]any)
+				name, _ := p["name"].(string)
+				switch p["in"] {
+				case "path":
+					pathParams[name] = true
+					if p["required"] != true {
+						t.Errorf("%s: path parameter %q must be required", where, name)
+					}
+				case "query", "header", "cookie":
+				default:
+					t.Errorf("%s: parameter %q has invalid location %v", where, name, p["in"])
+				}
+				if name == "" || p["schema"] == nil {
+					t.Errorf("%s: parameter needs a name and schema: %v", where, p)
+				}
+			}
+			for _, m := range wildcard.FindAllStringSubmatch(path, -1) {
+				if !pathParams[m[1]] {
+					t.Errorf("%s: path parameter %q is not declared", where, m[1])
+				}
+			}
+		}
+	}
+
+	// Every $ref must point at a component schema.
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok {
+				name, found := strings.CutPrefix(ref, "#/components/schemas/")
+				if _, exists := schemas[name]; !found || !exists {
+					t.Errorf("unresolved $ref %q", ref)
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(spec)
+}
+
+func TestOpenAPISpec_Schemas(t *testing.T) {
+	spec := fetchSpec(t)
+	schemas := spec["components"].(map[string]any)["schemas"].(map[string]any)
+
+	props := func(name string) map[string]any {
+		t.Helper()
+		s, ok := schemas[name].(map[string]any)
+		if !ok {
+			t.Fatalf("schema %s missing", name)
+		}
+		p, _ := s["properties"].(map[string]any)
+		return p
+	}
+
+	// JSON tags name the properties; json:"-" fields stay out.
+	if p := props("sendMailRequest"); p["owner_pubkey"] == nil || p["send_at"] == nil || p["OwnerPubKey"] != nil {
+		t.Errorf("sendMailRequest: unexpected properties %v", p)
+	}
+	if p := props("POP3Settings"); p["pass_enc"] != nil || p["PassEnc"] != nil {
+		t.Errorf("POP3Settings must not expose the encrypted password: %v", p)
+	}
+	// Embedded structs are flattened as encoding/json does.
+	if p := props("accountMessage"); p["account"] == nil || p["subject"] == nil {
+		t.Errorf("accountMessage: want embedded Message fields, got %v", p)
+	}
+	if id := props("Identity")["id"].(map[string]any); id["type"] != "string" {
+		t.Errorf("ObjectID should be a string, got %v", id)
+	}
+	if at := props("Identity")["created_at"].(map[string]any); at["format"] != "date-time" {
+		t.Errorf("time.Time should be a date-time string, got %v", at)
+	}
+}
+
+func TestOpenAPISpec_CoversRoutes(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "secret"
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+	covered := specRoutes(fetchSpec(t))
+
+	// Every registry route is in the document and answered by the mux
+	// (the mux's own 404 is plain text; handlers answer JSON or HTML).
+	for _, rt := range server.routes() {
+		pattern := rt.method + " " + rt.path
+		if !covered[pattern] {
+			t.Errorf("%s missing from the OpenAPI document", pattern)
+		}
+		req := httptest.NewRequest(rt.method, pathParam.ReplaceAllString(rt.path, "x"), strings.NewReader("{}"))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code == http.StatusMethodNotAllowed || strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("%s not registered on the mux (status %d)", pattern, w.Code)
+		}
+	}
+
+	// Nothing registers on a mux directly, bypassing the registry.
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatalf("parse %s: %v", name, err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || (sel.Sel.Name != "HandleFunc" && sel.Sel.Name != "Handle") || len(call.Args) == 0 {
+				return true
+			}
+			lit, ok := call.Args[0].(*ast.BasicLit)
+			if !ok {
+				return true // the registry loop builds its patterns
+			}
+			pattern, _ := strconv.Unquote(lit.Value)
+			if !covered[pattern] {
+				t.Errorf("%s: %s is registered outside the route registry and missing from the OpenAPI document",
+					fset.Position(call.Pos()), pattern)
+			}
+			return true
+		})
+	}
+}
+
+func TestServeDocs(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/docs", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("GET /api/docs: want 200 HTML, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "/api/openapi.json") {
+		t.Error("Swagger UI page does not load /api/openapi.json")
+	}
+	if page := w.Body.String(); strings.Contains(page, "://") || !strings.Contains(page, `src="/api/docs/assets/`) {
+		t.Errorf("Swagger UI page must load its assets from this server:\n%s", page)
+	}
+
+	for path, want := range map[string]int{
+		"/api/docs/assets/VERSION":        http.StatusOK,
+		"/api/docs/assets/missing.js":     http.StatusNotFound,
+		"/api/docs/assets/..%2fdocs.html": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: want %d, got %d", path, want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"mulamail/config"
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+// Recording a delivered message is retried this many times, this far apart:
+// a message left in the sending state is delivered again once its claim
+// goes stale.
+const (
+	outboxFinishRetries = 5
+	outboxFinishBackoff = time.Second
+)
+
+// A greylisted message is tried again after the delay the server suggests,
+// up to greylistMaxDelay, or else after greylistMinDelay plus up to
+// greylistSpread, so that messages greylisted together do not all come back
+// at once.
+const (
+	greylistMinDelay = 5 * time.Minute
+	greylistSpread   = 10 * time.Minute
+	greylistMaxDelay = time.Hour
+)
+
+// sendGreylisted is the error code of a synchronous send a greylisting
+// server deferred while GreylistRequeue is off.
+const sendGreylisted = "greylisted"
+
+// sendAsync reports whether a send is queued in the outbox rather than
+// delivered within the request: the "async" query parameter when it is a
+// boolean, SEND_ASYNC otherwise.
+func (s *Server) sendAsync(r *http.Request) bool {
+	if async, err := strconv.ParseBool(r.URL.Query().Get("async")); err == nil {
+		return async
+	}
+	return s.cfg.SendAsync
+}
+
+// queueMessage stores req encrypted in the outbox and answers 202 with the
+// outbox id.
+func (s *Server) queueMessage(w http.ResponseWriter, r *http.Request, owner string, req mail.SendRequest) {
+	enc, err := s.encryptSendRequest(req)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	m := &db.OutboxMessage{
+		OwnerPubKey:  owner,
+		AccountEmail: req.From,
+		PayloadEnc:   enc,
+	}
+	if err := s.db.CreateOutboxMessage(r.Context(), m); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, scheduleResponse{
+		Status:   db.OutboxQueued,
+		OutboxID: m.ID.Hex(),
+	})
+}
+
+// greylistDelay returns how long to wait before offering a greylisted
+// message again, given the delay the server suggested (0 for none).
+func greylistDelay(suggested time.Duration) time.Duration {
+	if suggested > 0 {
+		return min(suggested, greylistMaxDelay)
+	}
+	return greylistMinDelay + rand.N(greylistSpread)
+}
+
+// deferGreylisted answers a synchronous send that a greylisting server
+// turned away after attempts tries.  With GreylistRequeue the message is
+// stored in the outbox as deferred_greylist, due once the greylisting delay
+// has passed, and the reply is 202 with the outbox id; otherwise it is 503
+// with Retry-After and the code "greylisted".
+func (s *Server) deferGreylisted(w http.ResponseWriter, r *http.Request, owner string, req mail.SendRequest, attempts int, err error, suggested time.Duration) {
+	delay := greylistDelay(suggested)
+	if !s.cfg.GreylistRequeue {
+		log.Printf("[%s] send: greylisted after %d attempts: %v", requestID(r.Context()), attempts, err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(delay/time.Second)))
+		writeJSON(w, http.StatusServiceUnavailable, sendRefusal{
+			Error: publicError(err),
+			Code:  sendGreylisted,
+		})
+		return
+	}
+	enc, encErr := s.encryptSendRequest(req)
+	if encErr != nil {
+		writeInternalError(w, r, encErr)
+		return
+	}
+	m := &db.OutboxMessage{
+		OwnerPubKey:   owner,
+		AccountEmail:  req.From,
+		PayloadEnc:    enc,
+		Status:        db.OutboxDeferredGreylist,
+		Attempts:      attempts,
+		LastError:     publicError(err),
+		NextAttemptAt: time.Now().Add(delay),
+	}
+	if err := s.db.CreateOutboxMessage(r.Context(), m); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	log.Printf("[%s] send: greylisted, deferred as outbox message %s until %s", requestID(r.Context()), m.ID.Hex(), m.NextAttemptAt.Format(time.RFC3339))
+	writeJSON(w, http.StatusAccepted, scheduleResponse{
+		Status:   db.OutboxDeferredGreylist,
+		OutboxID: m.ID.Hex(),
+		SendAt:   m.NextAttemptAt,
+		Hint:     "the recipient's server is greylisting this sender; the message will be retried from the outbox",
+	})
+}
+
+// GET /api/v1/mail/outbox/{id}?owner=<pubkey>
+//
+// Reports the delivery state of a queued message: its status, attempts and
+// last error, and once sent the SMTP server's final response.
+func (s *Server) getOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	m, err := s.db.GetOutboxMessage(r.Context(), owner, r.PathValue("id"))
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "no outbox message with that id")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// ---------- delivery worker ----------
+
+// Outbox delivers queued messages with a pool of workers.  Several
+// instances may run side by side: each message is claimed atomically and
+// the claim is renewed while the SMTP session lasts, so a live worker never
+// loses its message.  A claim left to go stale, by a worker that died or
+// stalled, is taken over and the message tried again.
+//
+// Once the SMTP server has answered 250 the message is never put back in
+// the queue, and recording the outcome is retried.  What remains is the
+// window between the 250 and that write: a worker that dies there leaves
+// its claim to go stale, and the message is delivered a second time.
+type Outbox struct {
+	srv         *Server
+	leader      *leader
+	worker      string
+	workers     int
+	interval    time.Duration
+	lease       time.Duration
+	maxAttempts int
+	now         func() time.Time
+}
+
+// NewOutbox creates a delivery worker pool backed by database.
+func NewOutbox(database db.DB, cfg *config.Config) *Outbox {
+	return &Outbox{
+		srv:         &Server{db: database, cfg: cfg},
+		leader:      newLeader(database, roleOutbox, cfg),
+		worker:      workerName(),
+		workers:     cfg.OutboxWorkers,
+		interval:    time.Duration(cfg.OutboxIntervalSeconds) * time.Second,
+		lease:       time.Duration(cfg.OutboxLeaseSeconds) * time.Second,
+		maxAttempts: cfg.OutboxMaxAttempts,
+		now:         time.Now,
+	}
+}
+
+// Run starts the workers and waits for them to stop once ctx is cancelled.
+// Only the instance leading the outbox role delivers.
+func (o *Outbox) Run(ctx context.Context) {
+	o.leader.elect(ctx)
+	var wg sync.WaitGroup
+	for i := range max(o.workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.work(ctx, fmt.Sprintf("%s/%d", o.worker, i))
+		}()
+	}
+	wg.Wait()
+}
+
+// work polls for queued messages on behalf of worker until ctx is
+// cancelled.  Each goroutine claims under its own name, so a stalled one
+// cannot renew or finish a claim another has taken over.
+func (o *Outbox) work(ctx context.Context, worker string) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		o.processQueued(ctx, worker)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processQueued delivers messages until none is waiting.
+func (o *Outbox) processQueued(ctx context.Context, worker string) {
+	for ctx.Err() == nil && o.leader.leads() && !o.srv.paused(ctx) {
+		now := o.now()
+		m, err := o.srv.db.ClaimOutboxMessage(ctx, now, now.Add(-o.lease), worker)
+		if errors.Is(err, db.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("outbox: claim: %v", err)
+			return
+		}
+		o.deliver(ctx, m)
+	}
+}
+
+// deliver makes one delivery attempt for a claimed message, holding the
+// claim meanwhile, and records the outcome: sent, queued again with
+// backoff, deferred for as long as a greylisting server asks, or failed.
+func (o *Outbox) deliver(ctx context.Context, m *db.OutboxMessage) {
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	release := o.holdClaim(attemptCtx, cancel, m)
+	res, err := o.send(attemptCtx, m)
+	release()
+
+	switch {
+	case err == nil:
+		m.Status = db.OutboxSent
+		m.LastError = ""
+		m.MessageID, m.SMTPResponse, m.QueueID = res.MessageID, res.Response, res.QueueID
+		m.SentAt = o.now()
+	case permanentSendFailure(err) || m.Attempts >= o.maxAttempts:
+		m.Status = db.OutboxFailed
+		m.LastError = publicError(err)
+	default:
+		m.Status = db.OutboxQueued
+		m.LastError = publicError(err)
+		m.NextAttemptAt = o.now().Add(scheduledBackoff(m.Attempts))
+		if delay, ok := mail.Greylisted(err); ok {
+			m.Status = db.OutboxDeferredGreylist
+			m.NextAttemptAt = o.now().Add(greylistDelay(delay))
+		}
+	}
+	if err != nil {
+		log.Printf("outbox: message %s attempt %d: %v", m.ID.Hex(), m.Attempts, err)
+	}
+	o.finish(context.WithoutCancel(ctx), m)
+}
+
+// holdClaim renews the claim on m every third of the lease until the
+// returned release is called.  Should the claim be lost, the attempt is
+// cancelled through cancel: another worker now owns the message.
+func (o *Outbox) holdClaim(ctx context.Context, cancel context.CancelFunc, m *db.OutboxMessage) (release func()) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(o.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := o.srv.db.RenewOutboxClaim(ctx, m.ID, m.ClaimedBy, o.now())
+			if errors.Is(err, db.ErrNotFound) {
+				log.Printf("outbox: message %s: claim lost, abandoning attempt", m.ID.Hex())
+				cancel()
+				return
+			}
+			if err != nil {
+				log.Printf("outbox: renew claim on %s: %v", m.ID.Hex(), err)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// finish records the outcome of an attempt.  It runs even while the
+// server shuts down, and retries for a delivered message.
+func (o *Outbox) finish(ctx context.Context, m *db.OutboxMessage) {
+	for i := 0; ; i++ {
+		err := o.srv.db.FinishOutboxAttempt(ctx, m)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) || m.Status != db.OutboxSent || i == outboxFinishRetries {
+			log.Printf("outbox: record outcome of %s: %v", m.ID.Hex(), err)
+			return
+		}
+		time.Sleep(outboxFinishBackoff)
+	}
+}
+
+// send decrypts the stored request and hands it to the account's SMTP
+// server, recording it in the sent-mail history on success.
+func (o *Outbox) send(ctx context.Context, m *db.OutboxMessage) (*mail.SendResult, error) {
+	req, err := o.srv.decryptSendRequest(m.PayloadEnc)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("decrypt message: %w", err))
+	}
+	acc, err := o.srv.db.GetMailAccount(ctx, m.OwnerPubKey, m.AccountEmail)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("account not found: %w", err))
+	}
+	if err := o.srv.checkRecipientDomains(ctx, m.OwnerPubKey, req); err != nil {
+		return nil, err
+	}
+
+	release, err := o.srv.acquireSMTPSession(ctx, acc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errAccountBusy, err)
+	}
+	res, err := o.srv.deliverSMTP(ctx, acc, *req)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	o.srv.recordDelivered(ctx, "outbox", m.OwnerPubKey, req, res)
+	return res, nil
+}
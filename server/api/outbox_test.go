@@ -0,0 +1,325 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mulamail/db"
+)
+
+func asyncSend(t *testing.T, server *Server, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey": "owner", "account_email": "me@example.com",
+		"to": []string{"you@example.org"}, "subject": "queued", "body": "b",
+	})
+	req := httptest.NewRequest("POST", "/api/v1/mail/send"+query, bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	server.sendMail(w, req)
+	return w
+}
+
+func newTestOutbox(server *Server, now time.Time) *Outbox {
+	return &Outbox{srv: server, worker: "test", lease: time.Minute, maxAttempts: 3, now: func() time.Time { return now }}
+}
+
+func TestSendMail_Async(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	w := asyncSend(t, server, "?async=true")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["status"] != "queued" || resp["outbox_id"] != mockDB.Outbox[0].ID.Hex() {
+		t.Errorf("unexpected response %v", resp)
+	}
+	if _, ok := resp["send_at"]; ok {
+		t.Errorf("a queued message has no send_at: %v", resp)
+	}
+	if strings.Contains(mockDB.Outbox[0].PayloadEnc, "queued") {
+		t.Error("outbox payload must be stored encrypted")
+	}
+	if cmds := fake.received(); len(cmds) != 0 {
+		t.Errorf("no SMTP traffic expected within the request, got %q", cmds)
+	}
+}
+
+func TestSendMail_AsyncDefault(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.SendAsync = true
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	if w := asyncSend(t, server, ""); w.Code != http.StatusAccepted {
+		t.Errorf("SEND_ASYNC: want %d, got %d", http.StatusAccepted, w.Code)
+	}
+	if w := asyncSend(t, server, "?async=false"); w.Code != http.StatusOK {
+		t.Errorf("async=false: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if len(mockDB.Outbox) != 1 || len(fake.sent()) != 1 {
+		t.Errorf("want one queued and one sent message, got %d and %d", len(mockDB.Outbox), len(fake.sent()))
+	}
+}
+
+func TestOutbox_DeliversQueuedMessages(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	asyncSend(t, server, "?async=true")
+
+	newTestOutbox(server, time.Now().Add(time.Second)).processQueued(context.Background(), "test/0")
+
+	m := mockDB.Outbox[0]
+	if m.Status != db.OutboxSent || m.Attempts != 1 || m.QueueID != "ABC123" || m.SentAt.IsZero() {
+		t.Errorf("unexpected state %+v", m)
+	}
+	if n := len(fake.sent()); n != 1 {
+		t.Errorf("expected exactly 1 delivery, got %d", n)
+	}
+	if len(mockDB.Sent) != 1 || mockDB.Sent[0].Subject != "queued" {
+		t.Errorf("expected delivery recorded in sent history, got %+v", mockDB.Sent)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/outbox/"+m.ID.Hex()+"?owner=owner", nil)
+	req.SetPathValue("id", m.ID.Hex())
+	w := httptest.NewRecorder()
+	server.getOutboxMessage(w, req)
+	var got db.OutboxMessage
+	json.NewDecoder(w.Body).Decode(&got)
+	if w.Code != http.StatusOK || got.Status != db.OutboxSent || !strings.Contains(got.SMTPResponse, "ABC123") {
+		t.Errorf("status: unexpected %d %+v", w.Code, got)
+	}
+	if strings.Contains(w.Body.String(), "payload") {
+		t.Errorf("status must not expose the payload: %s", w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/mail/outbox/"+m.ID.Hex()+"?owner=someone-else", nil)
+	req.SetPathValue("id", m.ID.Hex())
+	w = httptest.NewRecorder()
+	server.getOutboxMessage(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("another owner: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestOutbox_RetriesTransientFailures(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{dataDone: "451 4.3.0 try again later"}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	asyncSend(t, server, "?async=true")
+	m := mockDB.Outbox[0]
+
+	now := time.Now().Add(time.Second)
+	o := newTestOutbox(server, now)
+	o.processQueued(context.Background(), "test/0")
+	if m.Status != db.OutboxQueued || m.Attempts != 1 || !m.NextAttemptAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("after transient failure: want queued for a minute, got %+v", m)
+	}
+
+	for i := 0; i < 5; i++ {
+		o.now = func() time.Time { return m.NextAttemptAt }
+		o.processQueued(context.Background(), "test/0")
+	}
+	if m.Status != db.OutboxFailed || m.Attempts != 3 || !strings.Contains(m.LastError, "451") {
+		t.Errorf("after exhausting attempts: want failed/3, got %s/%d %q", m.Status, m.Attempts, m.LastError)
+	}
+}
+
+func TestOutbox_PermanentFailure(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{dataDone: "554 5.7.1 message rejected"}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	asyncSend(t, server, "?async=true")
+
+	newTestOutbox(server, time.Now().Add(time.Second)).processQueued(context.Background(), "test/0")
+
+	if m := mockDB.Outbox[0]; m.Status != db.OutboxFailed || m.Attempts != 1 {
+		t.Errorf("want failed after 1 attempt, got %s/%d", m.Status, m.Attempts)
+	}
+}
+
+func TestOutbox_ReclaimsStaleClaims(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	asyncSend(t, server, "?async=true")
+
+	// A worker claims the message and dies without renewing its claim.
+	now := time.Now().Add(time.Second)
+	if _, err := mockDB.ClaimOutboxMessage(context.Background(), now, now.Add(-time.Minute), "dead/0"); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	o := newTestOutbox(server, now.Add(30*time.Second))
+	o.processQueued(context.Background(), "test/0")
+	if n := len(fake.sent()); n != 0 {
+		t.Fatalf("a live claim must not be taken over, got %d deliveries", n)
+	}
+
+	o.now = func() time.Time { return now.Add(2 * time.Minute) }
+	o.processQueued(context.Background(), "test/0")
+	m := mockDB.Outbox[0]
+	if m.Status != db.OutboxSent || m.ClaimedBy != "test/0" || m.Attempts != 2 {
+		t.Errorf("stale claim: want sent by test/0 on attempt 2, got %+v", m)
+	}
+
+	// The dead worker can no longer record an outcome.
+	dead := *m
+	dead.ClaimedBy, dead.Status = "dead/0", db.OutboxQueued
+	if err := mockDB.FinishOutboxAttempt(context.Background(), &dead); err != db.ErrNotFound {
+		t.Errorf("finish by the old claimant: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestOutbox_RecipientDomainRefused(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	asyncSend(t, server, "?async=true")
+
+	// The policy changes while the message waits in the outbox.
+	server.cfg.SendBlockedDomains = "example.org"
+	newTestOutbox(server, time.Now().Add(time.Second)).processQueued(context.Background(), "test/0")
+
+	m := mockDB.Outbox[0]
+	if m.Status != db.OutboxFailed || m.Attempts != 1 || m.LastError != "recipient domains not allowed: you@example.org" {
+		t.Errorf("want failed after 1 attempt naming the recipient, got %s/%d %q", m.Status, m.Attempts, m.LastError)
+	}
+	if n := fake.sessionCount(); n != 0 {
+		t.Errorf("a refused message must not reach the SMTP server: %d sessions", n)
+	}
+}
+
+// greylistReply is what postgrey answers a sender it has not seen before.
+const greylistReply = "451 4.7.1 <you@example.org>: Recipient address rejected: Greylisted, please retry in 300 seconds"
+
+func TestSendMail_GreylistedDefersToOutbox(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.GreylistRequeue = true
+	server.cfg.SMTPSendRetries = 2
+
+	fake := &fakeSMTP{rcptReplies: []string{greylistReply}}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	before := time.Now()
+	w := asyncSend(t, server, "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	var resp scheduleResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Status != db.OutboxDeferredGreylist || resp.Hint == "" || resp.OutboxID != mockDB.Outbox[0].ID.Hex() {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if n := fake.sessionCount(); n != 1 {
+		t.Errorf("greylisting must not be retried within the request, got %d sessions", n)
+	}
+
+	m := mockDB.Outbox[0]
+	if m.Status != db.OutboxDeferredGreylist || m.Attempts != 1 || m.NextAttemptAt.Before(before.Add(300*time.Second)) {
+		t.Fatalf("want deferred for the suggested 300s after 1 attempt, got %+v", m)
+	}
+
+	o := newTestOutbox(server, time.Now().Add(time.Minute))
+	o.processQueued(context.Background(), "test/0")
+	if m.Status != db.OutboxDeferredGreylist || fake.sessionCount() != 1 {
+		t.Fatalf("a deferred message must wait out its delay, got %s after %d sessions", m.Status, fake.sessionCount())
+	}
+
+	o.now = func() time.Time { return m.NextAttemptAt }
+	o.processQueued(context.Background(), "test/0")
+	if m.Status != db.OutboxSent || m.Attempts != 2 {
+		t.Errorf("second attempt: want sent/2, got %s/%d %q", m.Status, m.Attempts, m.LastError)
+	}
+	if n := len(fake.sent()); n != 1 {
+		t.Errorf("expected exactly 1 delivery, got %d", n)
+	}
+}
+
+func TestSendMail_GreylistedWithoutRequeue(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{rcptReplies: []string{greylistReply}}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	w := asyncSend(t, server, "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusServiceUnavailable, w.Code, w.Body.String())
+	}
+	var resp sendRefusal
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Code != sendGreylisted || !strings.Contains(resp.Error, "Greylisted") {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if got := w.Header().Get("Retry-After"); got != "300" {
+		t.Errorf("Retry-After: want 300, got %q", got)
+	}
+	if len(mockDB.Outbox) != 0 {
+		t.Errorf("nothing must be queued, got %d outbox messages", len(mockDB.Outbox))
+	}
+
+	// The greylist now knows the sender, as it would after the delay.
+	if w := asyncSend(t, server, ""); w.Code != http.StatusOK {
+		t.Errorf("retry: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestOutbox_GreylistedAttemptDeferred(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{rcptReplies: []string{"450 4.2.0 <you@example.org>: Recipient address rejected: greylisted"}}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	asyncSend(t, server, "?async=true")
+	m := mockDB.Outbox[0]
+
+	now := time.Now().Add(time.Second)
+	o := newTestOutbox(server, now)
+	o.processQueued(context.Background(), "test/0")
+	if m.Status != db.OutboxDeferredGreylist || m.Attempts != 1 {
+		t.Fatalf("after greylisting: want deferred_greylist/1, got %s/%d", m.Status, m.Attempts)
+	}
+	if d := m.NextAttemptAt.Sub(now); d < greylistMinDelay || d >= greylistMinDelay+greylistSpread {
+		t.Errorf("with no suggested delay want 5-15 minutes, got %v", d)
+	}
+
+	o.now = func() time.Time { return m.NextAttemptAt }
+	o.processQueued(context.Background(), "test/0")
+	if m.Status != db.OutboxSent || m.Attempts != 2 || len(fake.sent()) != 1 {
+		t.Errorf("second attempt: want sent/2 with one delivery, got %s/%d and %d", m.Status, m.Attempts, len(fake.sent()))
+	}
+}
+
+func TestGreylistDelay(t *testing.T) {
+	if d := greylistDelay(300 * time.Second); d != 300*time.Second {
+		t.Errorf("suggested delay: got %v", d)
+	}
+	if d := greylistDelay(24 * time.Hour); d != greylistMaxDelay {
+		t.Errorf("suggested delay is capped: got %v", d)
+	}
+}
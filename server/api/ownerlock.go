@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Owner locks serialise the changes one owner makes, so that concurrent
+// requests cannot interleave a check with the write that depends on it.
+// Within an instance an in-memory lock per owner does this; across
+// instances each holder also takes a lease on the owner in MongoDB, and
+// renews it for as long as it holds the lock.
+const (
+	ownerLeaseRetry     = 50 * time.Millisecond // pause between attempts to take a held lease
+	ownerLeaseReleaseBy = 5 * time.Second       // bound on releasing or renewing a lease
+)
+
+// ownerLockWait is how long a change waits for a busy owner before it is
+// answered 503.
+var ownerLockWait = 10 * time.Second
+
+// errOwnerBusy is returned when another request keeps an owner locked for
+// longer than ownerLockWait.
+var errOwnerBusy = errors.New("another change for this owner is in progress; retry shortly")
+
+// ownerLocks hands out one lock per owner.  Entries are reference counted
+// and dropped once no request holds or waits for them, so the map only
+// grows with concurrent owners.  The zero value is ready to use.
+type ownerLocks struct {
+	mu    sync.Mutex
+	locks map[string]*ownerLock
+}
+
+type ownerLock struct {
+	held chan struct{} // holds a token while the lock is held
+	refs int           // requests holding or waiting for the lock; guarded by ownerLocks.mu
+}
+
+// lock blocks until the owner's lock is held or ctx is done, and returns
+// the function that releases it.
+func (l *ownerLocks) lock(ctx context.Context, owner string) (unlock func(), err error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*ownerLock)
+	}
+	ol := l.locks[owner]
+	if ol == nil {
+		ol = &ownerLock{held: make(chan struct{}, 1)}
+		l.locks[owner] = ol
+	}
+	ol.refs++
+	l.mu.Unlock()
+
+	unref := func() {
+		l.mu.Lock()
+		if ol.refs--; ol.refs == 0 {
+			delete(l.locks, owner)
+		}
+		l.mu.Unlock()
+	}
+	select {
+	case ol.held <- struct{}{}:
+		return func() {
+			<-ol.held
+			unref()
+		}, nil
+	case <-ctx.Done():
+		unref()
+		return nil, ctx.Err()
+	}
+}
+
+// lockOwner serialises a change for owner against every other change for
+// the same owner, on this instance and, with OWNER_LEASE_SECONDS set, on
+// any instance sharing the database.  It waits at most ownerLockWait in
+// all, and then fails with errOwnerBusy.  The caller must call the returned
+// function when the change is done.
+func (s *Server) lockOwner(ctx context.Context, owner string) (func(), error) {
+	waitCtx, cancel := context.WithTimeout(ctx, ownerLockWait)
+	defer cancel()
+	unlock, err := s.owners.lock(waitCtx, owner)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errOwnerBusy
+	}
+	ttl := seconds(s.cfg.OwnerLeaseSeconds)
+	if ttl <= 0 {
+		return unlock, nil
+	}
+
+	holder, err := newLeaseHolder()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	for {
+		ok, err := s.db.AcquireOwnerLease(waitCtx, owner, holder, ttl)
+		if err != nil && waitCtx.Err() == nil {
+			unlock()
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-waitCtx.Done():
+			unlock()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, errOwnerBusy
+		case <-time.After(ownerLeaseRetry):
+		}
+	}
+
+	// A change can outlast the lease, e.g. while a slow mail server is
+	// checked, so it is renewed until the change is done.
+	stop := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		s.renewOwnerLease(ctx, owner, holder, ttl, stop)
+	}()
+
+	return func() {
+		close(stop)
+		<-renewed
+		// The lease must go even when the request was cancelled; if this
+		// fails too it simply expires.
+		releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ownerLeaseReleaseBy)
+		defer cancel()
+		if err := s.db.ReleaseOwnerLease(releaseCtx, owner, holder); err != nil {
+			log.Printf("[%s] owner lease: release: %v", requestID(ctx), err)
+		}
+		unlock()
+	}, nil
+}
+
+// renewOwnerLease extends holder's lease on owner every third of ttl until
+// stop is closed.  A renewal that fails is logged and retried at the next
+// tick; the lease may lapse meanwhile, as it would for a dead instance.
+func (s *Server) renewOwnerLease(ctx context.Context, owner, holder string, ttl time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		renewCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ownerLeaseReleaseBy)
+		ok, err := s.db.AcquireOwnerLease(renewCtx, owner, holder, ttl)
+		cancel()
+		switch {
+		case err != nil:
+			log.Printf("[%s] owner lease: renew: %v", requestID(ctx), err)
+		case !ok:
+			log.Printf("[%s] owner lease: renew: lost to another holder", requestID(ctx))
+		}
+	}
+}
+
+// newLeaseHolder returns a random identifier for one lease acquisition.
+func newLeaseHolder() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
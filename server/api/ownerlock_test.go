@@ -0,0 +1,223 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOwnerLocks_DropsUnusedEntries(t *testing.T) {
+	var l ownerLocks
+	unlockA, _ := l.lock(context.Background(), "a")
+	unlockB, _ := l.lock(context.Background(), "b")
+	if len(l.locks) != 2 {
+		t.Fatalf("want 2 entries, got %d", len(l.locks))
+	}
+	unlockA()
+	unlockB()
+	if len(l.locks) != 0 {
+		t.Errorf("want no entries once released, got %d", len(l.locks))
+	}
+}
+
+func TestOwnerLocks_Serialises(t *testing.T) {
+	var l ownerLocks
+	unlock, _ := l.lock(context.Background(), "owner")
+	acquired := make(chan struct{})
+	go func() {
+		defer close(acquired)
+		unlock, _ := l.lock(context.Background(), "owner")
+		unlock()
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second lock acquired while the first was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Other owners are not held up.
+	unlockOther, _ := l.lock(context.Background(), "other")
+	unlockOther()
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("second lock not acquired after release")
+	}
+}
+
+func TestOwnerLocks_GivesUpWithContext(t *testing.T) {
+	var l ownerLocks
+	unlock, _ := l.lock(context.Background(), "owner")
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.lock(ctx, "owner"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want context.DeadlineExceeded, got %v", err)
+	}
+	if refs := l.locks["owner"].refs; refs != 1 {
+		t.Errorf("a waiter that gave up must drop its reference: %d refs", refs)
+	}
+}
+
+func TestLockOwner_BusyInstance(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer func(wait time.Duration) { ownerLockWait = wait }(ownerLockWait)
+	ownerLockWait = 50 * time.Millisecond
+
+	unlock, err := server.lockOwner(context.Background(), "owner")
+	if err != nil {
+		t.Fatalf("lockOwner: %v", err)
+	}
+	defer unlock()
+	if _, err := server.lockOwner(context.Background(), "owner"); !errors.Is(err, errOwnerBusy) {
+		t.Fatalf("want errOwnerBusy, got %v", err)
+	}
+
+	// The handlers answer a busy owner with 503.
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey": "owner", "account_email": "me@example.com",
+		"pop3": map[string]any{"host": "pop.example.com", "port": 995, "user": "u", "pass": "p"},
+		"smtp": map[string]any{"host": "smtp.example.com", "port": 587, "user": "u", "pass": "p"},
+	})
+	w := httptest.NewRecorder()
+	server.addAccount(w, httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewBuffer(body)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("want 503, got %d: %s", w.Code, w.Body)
+	}
+
+	// A cancelled request reports its own cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := server.lockOwner(ctx, "owner"); !errors.Is(err, context.Canceled) {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+}
+
+func TestLockOwner_RenewsLease(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.OwnerLeaseSeconds = 1
+
+	unlock, err := server.lockOwner(context.Background(), "owner")
+	if err != nil {
+		t.Fatalf("lockOwner: %v", err)
+	}
+	// Outlast the lease.
+	time.Sleep(1500 * time.Millisecond)
+	if ok, _ := mockDB.AcquireOwnerLease(context.Background(), "owner", "other-instance", time.Minute); ok {
+		t.Fatal("the lease lapsed while the lock was held")
+	}
+	unlock()
+	if ok, _ := mockDB.AcquireOwnerLease(context.Background(), "owner", "other-instance", time.Minute); !ok {
+		t.Error("the lease was not released")
+	}
+}
+
+func TestLockOwner_WaitsForLease(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.OwnerLeaseSeconds = 30
+
+	// Another instance holds the owner.
+	mockDB.AcquireOwnerLease(context.Background(), "owner", "other-instance", time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := server.lockOwner(ctx, "owner"); err == nil {
+		t.Fatal("expected the lock to fail while another instance holds the lease")
+	}
+
+	mockDB.ReleaseOwnerLease(context.Background(), "owner", "other-instance")
+	unlock, err := server.lockOwner(context.Background(), "owner")
+	if err != nil {
+		t.Fatalf("lockOwner: %v", err)
+	}
+	if len(mockDB.Leases) != 1 {
+		t.Errorf("want the lease held, got %v", mockDB.Leases)
+	}
+	unlock()
+	if len(mockDB.Leases) != 0 {
+		t.Errorf("want the lease released, got %v", mockDB.Leases)
+	}
+}
+
+// addAccountsConcurrently fires one addAccount request per email at once and
+// returns how many requests ended with each status code.
+func addAccountsConcurrently(server *Server, emails []string) map[int]int {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes = make(map[int]int)
+	)
+	for _, email := range emails {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _ := json.Marshal(map[string]any{
+				"owner_pubkey": "owner", "account_email": email,
+				"pop3": map[string]any{"host": "pop.example.com", "port": 995, "user": "u", "pass": "p"},
+				"smtp": map[string]any{"host": "smtp.example.com", "port": 587, "user": "u", "pass": "p"},
+			})
+			w := httptest.NewRecorder()
+			server.addAccount(w, httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewBuffer(body)))
+			mu.Lock()
+			codes[w.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return codes
+}
+
+func TestAddAccount_ConcurrentSameAccount(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.OwnerLeaseSeconds = 30
+
+	emails := make([]string, 50)
+	for i := range emails {
+		emails[i] = "me@example.com"
+	}
+	codes := addAccountsConcurrently(server, emails)
+
+	if codes[http.StatusCreated] != 1 || codes[http.StatusConflict] != 49 {
+		t.Errorf("want 1 created and 49 conflicts, got %v", codes)
+	}
+	if n := len(mockDB.Accounts["owner"]); n != 1 {
+		t.Errorf("want exactly 1 account document, got %d", n)
+	}
+	if mockDB.LeaseAcquires != 50 || len(mockDB.Leases) != 0 {
+		t.Errorf("every request must take and release the lease: %d taken, %d held", mockDB.LeaseAcquires, len(mockDB.Leases))
+	}
+}
+
+func TestAddAccount_ConcurrentDistinctAccounts(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	emails := make([]string, 50)
+	for i := range emails {
+		emails[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+	codes := addAccountsConcurrently(server, emails)
+
+	if codes[http.StatusCreated] != 50 {
+		t.Errorf("want 50 created, got %v", codes)
+	}
+	if n := len(mockDB.Accounts["owner"]); n != 50 {
+		t.Errorf("want 50 account documents, got %d", n)
+	}
+}
+
+func TestAddAccount_Duplicate(t *testing.T) {
+	server, _ := setupTestServer(t)
+	if codes := addAccountsConcurrently(server, []string{"me@example.com"}); codes[http.StatusCreated] != 1 {
+		t.Fatalf("first add: %v", codes)
+	}
+	if codes := addAccountsConcurrently(server, []string{"me@example.com"}); codes[http.StatusConflict] != 1 {
+		t.Errorf("second add: want a conflict, got %v", codes)
+	}
+}
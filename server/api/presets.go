@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serverPreset is a suggested POP3 or SMTP endpoint.  A zero Host means the
+// provider offers no such service.
+type serverPreset struct {
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	UseSSL bool   `json:"use_ssl"`
+}
+
+// providerPreset bundles the POP3 and SMTP settings for one mail provider.
+type providerPreset struct {
+	Provider string       `json:"provider,omitempty"`
+	POP3     serverPreset `json:"pop3"`
+	SMTP     serverPreset `json:"smtp"`
+	Source   string       `json:"source"` // "table", "srv" or "mx"
+	Note     string       `json:"note,omitempty"`
+}
+
+// providerPresets holds the well-known providers, keyed by preset name.
+var providerPresets = map[string]providerPreset{
+	"gmail": {
+		POP3: serverPreset{"pop.gmail.com", 995, true},
+		SMTP: serverPreset{"smtp.gmail.com", 465, true},
+		Note: "POP must be enabled in Gmail settings; accounts with 2-step verification need an app password",
+	},
+	"outlook": {
+		POP3: serverPreset{"outlook.office365.com", 995, true},
+		SMTP: serverPreset{"smtp-mail.outlook.com", 587, false},
+	},
+	"yahoo": {
+		POP3: serverPreset{"pop.mail.yahoo.com", 995, true},
+		SMTP: serverPreset{"smtp.mail.yahoo.com", 465, true},
+		Note: "requires an app password",
+	},
+	"icloud": {
+		SMTP: serverPreset{"smtp.mail.me.com", 587, false},
+		Note: "iCloud Mail does not offer POP3; requires an app-specific password",
+	},
+	"fastmail": {
+		POP3: serverPreset{"pop.fastmail.com", 995, true},
+		SMTP: serverPreset{"smtp.fastmail.com", 465, true},
+		Note: "requires an app password",
+	},
+	"zoho": {
+		POP3: serverPreset{"pop.zoho.com", 995, true},
+		SMTP: serverPreset{"smtp.zoho.com", 465, true},
+		Note: "POP access must be enabled in Zoho Mail settings",
+	},
+}
+
+// presetDomains maps consumer mail domains to their preset.
+var presetDomains = map[string]string{
+	"gmail.com": "gmail", "googlemail.com": "gmail",
+	"outlook.com": "outlook", "hotmail.com": "outlook", "live.com": "outlook", "msn.com": "outlook",
+	"yahoo.com": "yahoo", "ymail.com": "yahoo", "rocketmail.com": "yahoo",
+	"icloud.com": "icloud", "me.com": "icloud", "mac.com": "icloud",
+	"fastmail.com": "fastmail", "fastmail.fm": "fastmail",
+	"zoho.com": "zoho", "zohomail.com": "zoho",
+}
+
+// presetMXSuffixes recognises custom domains hosted by a known provider from
+// their MX hosts.
+var presetMXSuffixes = map[string]string{
+	"google.com.":                  "gmail",
+	"googlemail.com.":              "gmail",
+	"mail.protection.outlook.com.": "outlook",
+	"yahoodns.net.":                "yahoo",
+	"mail.icloud.com.":             "icloud",
+	"messagingengine.com.":         "fastmail",
+	"zoho.com.":                    "zoho",
+}
+
+// DNS lookups used by autodiscovery; replaced in tests.
+var (
+	lookupSRV = net.DefaultResolver.LookupSRV
+	lookupMX  = net.DefaultResolver.LookupMX
+)
+
+const presetLookupTimeout = 5 * time.Second
+
+var errNoPreset = errors.New("no settings found for domain")
+
+// GET /api/v1/accounts/presets?domain=<domain>
+//
+// Suggests POP3/SMTP settings for an email domain: from the built-in
+// provider table, else RFC 6186 SRV records, else the domain's MX hosts.
+func (s *Server) accountPresets(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if _, after, ok := strings.Cut(domain, "@"); ok {
+		domain = after
+	}
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if domain == "" {
+		writeError(w, http.StatusBadRequest, "domain required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), presetLookupTimeout)
+	defer cancel()
+	preset, err := discoverPreset(ctx, domain)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, preset)
+}
+
+// lookupPreset returns the named table preset.
+func lookupPreset(name string) (providerPreset, bool) {
+	p, ok := providerPresets[name]
+	p.Provider = name
+	p.Source = "table"
+	return p, ok
+}
+
+func discoverPreset(ctx context.Context, domain string) (providerPreset, error) {
+	if name, ok := presetDomains[domain]; ok {
+		p, _ := lookupPreset(name)
+		return p, nil
+	}
+	if p, ok := srvPreset(ctx, domain); ok {
+		return p, nil
+	}
+	if p, ok := mxPreset(ctx, domain); ok {
+		return p, nil
+	}
+	return providerPreset{}, errNoPreset
+}
+
+// srvPreset implements RFC 6186 discovery, preferring implicit TLS
+// (RFC 8314 _submissions, _pop3s) over STARTTLS and plaintext variants.
+func srvPreset(ctx context.Context, domain string) (providerPreset, bool) {
+	p := providerPreset{Source: "srv"}
+	p.SMTP = firstSRV(ctx, domain, []srvService{{"submissions", true}, {"submission", false}})
+	p.POP3 = firstSRV(ctx, domain, []srvService{{"pop3s", true}, {"pop3", false}})
+	return p, p.SMTP.Host != "" || p.POP3.Host != ""
+}
+
+type srvService struct {
+	name   string
+	useSSL bool
+}
+
+func firstSRV(ctx context.Context, domain string, services []srvService) serverPreset {
+	for _, svc := range services {
+		_, addrs, err := lookupSRV(ctx, svc.name, "tcp", domain)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		// A target of "." means the service is explicitly not offered.
+		target := strings.TrimSuffix(addrs[0].Target, ".")
+		if target == "" {
+			continue
+		}
+		return serverPreset{Host: target, Port: int(addrs[0].Port), UseSSL: svc.useSSL}
+	}
+	return serverPreset{}
+}
+
+// mxPreset matches the domain's MX hosts against known providers.
+func mxPreset(ctx context.Context, domain string) (providerPreset, bool) {
+	mxs, err := lookupMX(ctx, domain)
+	if err != nil {
+		return providerPreset{}, false
+	}
+	for _, mx := range mxs {
+		host := strings.ToLower(mx.Host)
+		if !strings.HasSuffix(host, ".") {
+			host += "."
+		}
+		for suffix, name := range presetMXSuffixes {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				p, _ := lookupPreset(name)
+				p.Source = "mx"
+				return p, true
+			}
+		}
+	}
+	return providerPreset{}, false
+}
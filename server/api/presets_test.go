@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeDNS replaces the autodiscovery lookups for the duration of a test.
+func fakeDNS(t *testing.T, srv map[string]*net.SRV, mx map[string][]*net.MX) {
+	t.Helper()
+	oldSRV, oldMX := lookupSRV, lookupMX
+	t.Cleanup(func() { lookupSRV, lookupMX = oldSRV, oldMX })
+
+	lookupSRV = func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if rec, ok := srv["_"+service+"._"+proto+"."+name]; ok {
+			return "", []*net.SRV{rec}, nil
+		}
+		return "", nil, errors.New("no such host")
+	}
+	lookupMX = func(_ context.Context, name string) ([]*net.MX, error) {
+		if recs, ok := mx[name]; ok {
+			return recs, nil
+		}
+		return nil, errors.New("no such host")
+	}
+}
+
+func getPreset(t *testing.T, server *Server, domain string) (int, providerPreset) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/v1/accounts/presets?domain="+domain, nil)
+	w := httptest.NewRecorder()
+	server.accountPresets(w, req)
+
+	var p providerPreset
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+	}
+	return w.Code, p
+}
+
+func TestAccountPresets_Table(t *testing.T) {
+	server, _ := setupTestServer(t)
+	fakeDNS(t, nil, nil)
+
+	code, p := getPreset(t, server, "user@GMail.com")
+	if code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d", http.StatusOK, code)
+	}
+	if p.Provider != "gmail" || p.Source != "table" || p.POP3.Host != "pop.gmail.com" || p.SMTP.Port != 465 {
+		t.Errorf("unexpected preset %+v", p)
+	}
+}
+
+func TestAccountPresets_SRV(t *testing.T) {
+	server, _ := setupTestServer(t)
+	fakeDNS(t, map[string]*net.SRV{
+		"_submission._tcp.example.org":  {Target: "mail.example.org.", Port: 587},
+		"_pop3s._tcp.example.org":       {Target: "pop.example.org.", Port: 995},
+		"_submissions._tcp.example.org": {Target: ".", Port: 0},
+	}, nil)
+
+	code, p := getPreset(t, server, "example.org")
+	if code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d", http.StatusOK, code)
+	}
+	want := providerPreset{
+		Source: "srv",
+		POP3:   serverPreset{"pop.example.org", 995, true},
+		SMTP:   serverPreset{"mail.example.org", 587, false},
+	}
+	if p != want {
+		t.Errorf("want %+v, got %+v", want, p)
+	}
+}
+
+func TestAccountPresets_MX(t *testing.T) {
+	server, _ := setupTestServer(t)
+	fakeDNS(t, nil, map[string][]*net.MX{
+		"corp.example": {{Host: "corp-example.mail.protection.outlook.com.", Pref: 0}},
+	})
+
+	code, p := getPreset(t, server, "corp.example")
+	if code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d", http.StatusOK, code)
+	}
+	if p.Provider != "outlook" || p.Source != "mx" {
+		t.Errorf("unexpected preset %+v", p)
+	}
+}
+
+func TestAccountPresets_Unknown(t *testing.T) {
+	server, _ := setupTestServer(t)
+	fakeDNS(t, nil, map[string][]*net.MX{"self.example": {{Host: "mx.self.example."}}})
+
+	if code, _ := getPreset(t, server, "self.example"); code != http.StatusNotFound {
+		t.Errorf("status code: want %d, got %d", http.StatusNotFound, code)
+	}
+	if code, _ := getPreset(t, server, ""); code != http.StatusBadRequest {
+		t.Errorf("empty domain: want %d, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestAddAccount_Preset(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey":  "owner",
+		"account_email": "me@gmail.com",
+		"preset":        "gmail",
+		"pop3":          map[string]any{"pass": "p"},
+		"smtp":          map[string]any{"pass": "p", "port": 587, "use_ssl": false},
+	})
+	req := httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.addAccount(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	acc := mockDB.Accounts["owner"][0]
+	if acc.POP3.Host != "pop.gmail.com" || acc.POP3.Port != 995 || !acc.POP3.UseSSL || acc.POP3.User != "me@gmail.com" {
+		t.Errorf("POP3 not filled from preset: %+v", acc.POP3)
+	}
+	// Explicit fields override the preset.
+	if acc.SMTP.Host != "smtp.gmail.com" || acc.SMTP.Port != 587 || acc.SMTP.UseSSL {
+		t.Errorf("SMTP overrides not applied: %+v", acc.SMTP)
+	}
+}
+
+func TestAddAccount_UnknownPreset(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	body, _ := json.Marshal(map[string]any{"owner_pubkey": "owner", "account_email": "me@example.com", "preset": "nope"})
+	req := httptest.NewRequest("POST", "/api/v1/accounts", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	server.addAccount(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/blockchain"
+	"mulamail/db"
+)
+
+// proofCacheSize caps the transactions kept by the identity proof cache.
+const proofCacheSize = 1024
+
+// A proof bundle is cached by clients and proxies for this long.  The
+// transaction never changes, but the identity record may, when its owner
+// revokes it; a bundle without a transaction is rechecked sooner, in case
+// the RPC node catches up.
+const (
+	proofMaxAge            = 24 * time.Hour
+	proofUnavailableMaxAge = 5 * time.Minute
+)
+
+// identityProofResponse is the reply to GET /api/v1/identity/proof.
+type identityProofResponse struct {
+	Identity       *db.Identity `json:"identity"`
+	ProofAvailable bool         `json:"proof_available"`
+	Transaction    *txEvidence  `json:"transaction,omitempty"`
+	ArchiveRPC     string       `json:"archive_rpc,omitempty"` // where to look for a transaction SOLANA_RPC no longer holds
+	Verification   []string     `json:"verification"`
+}
+
+// txEvidence is the on-chain half of a proof bundle.  Memo and RawTx are
+// base64 in JSON.
+type txEvidence struct {
+	Signature   string    `json:"tx_signature"`
+	Slot        uint64    `json:"slot"`
+	BlockTime   time.Time `json:"block_time,omitzero"`
+	Signers     []string  `json:"signers"`
+	Succeeded   bool      `json:"succeeded"`
+	MemoProgram string    `json:"memo_program"`
+	Memo        []byte    `json:"memo"`
+	RawTx       []byte    `json:"raw_transaction"`
+	Matches     bool      `json:"matches"` // the transaction succeeded, the pubkey signed it and its memo names this email and pubkey
+}
+
+// GET /api/v1/identity/proof?email=...
+//
+// Returns the identity registered for email, by its canonical form as
+// resolve does, together with the transaction that anchored it on-chain and
+// the steps to check one against the other on any Solana RPC node.  When
+// SOLANA_RPC no longer holds the transaction, proof_available is false and
+// archive_rpc names SOLANA_ARCHIVE_RPC, if set.  Transactions are cached
+// in-process, as finalized ones never change, and the reply carries a
+// long-lived Cache-Control.
+func (s *Server) identityProof(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		writeError(w, http.StatusBadRequest, "provide email query parameter")
+		return
+	}
+	identity, err := s.db.GetIdentityByCanonicalEmail(r.Context(), s.canonicalRules().Canonical(email), email)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "identity not found")
+		return
+	}
+
+	resp := identityProofResponse{Identity: identity, Verification: proofSteps(identity)}
+	ev, err := s.identityEvidence(r, identity.TxHash)
+	switch {
+	case errors.Is(err, blockchain.ErrTxNotFound):
+		resp.ArchiveRPC = s.cfg.SolanaArchiveRPC
+	case err != nil:
+		writeFailure(w, r, http.StatusBadGateway, "solana rpc unavailable", err)
+		return
+	default:
+		resp.ProofAvailable = true
+		resp.Transaction = &txEvidence{
+			Signature:   ev.Signature,
+			Slot:        ev.Slot,
+			BlockTime:   ev.BlockTime,
+			Signers:     ev.Signers,
+			Succeeded:   !ev.Failed,
+			MemoProgram: blockchain.MemoV2ProgramID.String(),
+			Memo:        ev.Memo,
+			RawTx:       ev.Transaction,
+			Matches:     proofMatches(identity, ev),
+		}
+	}
+
+	maxAge := proofMaxAge
+	if !resp.ProofAvailable {
+		maxAge = proofUnavailableMaxAge
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge/time.Second)))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// identityEvidence returns the transaction with signature txHash, from
+// the proof cache when it is there.  An identity without a usable
+// signature has no transaction, and reports blockchain.ErrTxNotFound.
+func (s *Server) identityEvidence(r *http.Request, txHash string) (*blockchain.IdentityEvidence, error) {
+	sig, err := solana.SignatureFromBase58(txHash)
+	if err != nil {
+		return nil, blockchain.ErrTxNotFound
+	}
+	if ev, ok := s.proofs.get(txHash); ok {
+		return ev, nil
+	}
+	ev, err := s.solana.IdentityEvidence(r.Context(), sig)
+	if err != nil {
+		return nil, err
+	}
+	s.proofs.put(txHash, ev)
+	return ev, nil
+}
+
+// proofMatches reports whether ev proves identity: it succeeded, the
+// identity's pubkey signed it, and its memo names the identity's email and
+// pubkey.
+func proofMatches(identity *db.Identity, ev *blockchain.IdentityEvidence) bool {
+	if ev.Failed || ev.Memo == nil || !slices.Contains(ev.Signers, identity.PubKey) {
+		return false
+	}
+	memo, err := blockchain.ParseIdentityMemo(string(ev.Memo))
+	return err == nil && memo.Email == identity.Email && memo.Pubkey == identity.PubKey
+}
+
+// proofSteps describes how to check identity against the chain without
+// trusting this server.
+func proofSteps(identity *db.Identity) []string {
+	return []string{
+		fmt.Sprintf(`Call getTransaction("%s", {"encoding": "base64", "commitment": "finalized", "maxSupportedTransactionVersion": 0}) on any Solana RPC node; nodes that prune history need an archival one.`, identity.TxHash),
+		"Check that meta.err is null: the transaction succeeded.",
+		fmt.Sprintf("Decode the transaction and check that %s is among its signers.", identity.PubKey),
+		fmt.Sprintf(`Find its instruction for the Memo program %s and check that the data is the JSON object {"action": "identity", "email": %q, "pubkey": %q}.`,
+			blockchain.MemoV2ProgramID, identity.Email, identity.PubKey),
+	}
+}
+
+// proofCache keeps the transactions of recent proof requests, keyed by
+// signature, evicting the least recently used beyond size.  Entries never
+// expire: a finalized transaction does not change.  A nil *proofCache
+// caches nothing.
+type proofCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // of *cachedProof, most recently used first
+	entries map[string]*list.Element
+}
+
+// cachedProof is one cache entry.
+type cachedProof struct {
+	sig string
+	ev  *blockchain.IdentityEvidence
+}
+
+func newProofCache(size int) *proofCache {
+	return &proofCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *proofCache) get(sig string) (*blockchain.IdentityEvidence, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[sig]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cachedProof).ev, true
+}
+
+func (c *proofCache) put(sig string, ev *blockchain.IdentityEvidence) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[sig]; ok {
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[sig] = c.order.PushFront(&cachedProof{sig: sig, ev: ev})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedProof).sig)
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/blockchain"
+	"mulamail/db"
+)
+
+// setupProofServer registers alice@example.com with a transaction that the
+// fake RPC node holds only when held is set, and counts getTransaction calls.
+func setupProofServer(t *testing.T, held bool) (*Server, *atomic.Int32, *db.Identity) {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	server.proofs = newProofCache(8)
+	wallet := solana.NewWallet()
+	signedTx := signedIdentityTx(t, wallet, "alice@example.com")
+	tx, _ := solana.TransactionFromBase64(signedTx)
+
+	var calls atomic.Int32
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		calls.Add(1)
+		var result any
+		if held {
+			result = map[string]any{
+				"slot":        1234,
+				"blockTime":   1700000000,
+				"transaction": []string{signedTx, "base64"},
+				"meta":        map[string]any{"err": nil},
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}))
+	t.Cleanup(rpcServer.Close)
+	server.solana = blockchain.NewClient(rpcServer.URL)
+
+	identity := &db.Identity{Email: "alice@example.com", PubKey: wallet.PublicKey().String(), TxHash: tx.Signatures[0].String(), Verified: true}
+	mockDB.CreateIdentity(context.Background(), identity)
+	return server, &calls, identity
+}
+
+func getProof(t *testing.T, server *Server, email string) (*httptest.ResponseRecorder, identityProofResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.identityProof(w, httptest.NewRequest("GET", "/api/v1/identity/proof?email="+email, nil))
+	var resp identityProofResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func TestIdentityProof(t *testing.T) {
+	server, calls, identity := setupProofServer(t, true)
+
+	w, resp := getProof(t, server, "alice@example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=86400" {
+		t.Errorf("Cache-Control: got %q", got)
+	}
+	tx := resp.Transaction
+	if !resp.ProofAvailable || tx == nil || resp.Identity.PubKey != identity.PubKey {
+		t.Fatalf("unexpected response %s", w.Body.String())
+	}
+	if tx.Signature != identity.TxHash || tx.Slot != 1234 || tx.BlockTime.Unix() != 1700000000 || !tx.Succeeded || !tx.Matches {
+		t.Errorf("unexpected evidence %+v", tx)
+	}
+	memo, err := blockchain.ParseIdentityMemo(string(tx.Memo))
+	if err != nil || memo.Email != "alice@example.com" || memo.Pubkey != identity.PubKey {
+		t.Errorf("memo: %q %v", tx.Memo, err)
+	}
+	if tx.MemoProgram != blockchain.MemoV2ProgramID.String() || len(tx.RawTx) == 0 || len(resp.Verification) == 0 {
+		t.Errorf("incomplete bundle %s", w.Body.String())
+	}
+
+	getProof(t, server, "alice@example.com")
+	if n := calls.Load(); n != 1 {
+		t.Errorf("a finalized transaction must be fetched once, got %d calls", n)
+	}
+}
+
+func TestIdentityProof_Mismatch(t *testing.T) {
+	server, _, identity := setupProofServer(t, true)
+	identity.PubKey = solana.NewWallet().PublicKey().String()
+
+	if _, resp := getProof(t, server, "alice@example.com"); !resp.ProofAvailable || resp.Transaction.Matches {
+		t.Errorf("a transaction another key signed must not match: %+v", resp.Transaction)
+	}
+}
+
+func TestIdentityProof_Pruned(t *testing.T) {
+	server, calls, _ := setupProofServer(t, false)
+	server.cfg.SolanaArchiveRPC = "https://archive.example.com"
+
+	w, resp := getProof(t, server, "alice@example.com")
+	if w.Code != http.StatusOK || resp.ProofAvailable || resp.Transaction != nil || resp.Identity == nil {
+		t.Fatalf("want the record without proof, got %d: %s", w.Code, w.Body.String())
+	}
+	if resp.ArchiveRPC != "https://archive.example.com" {
+		t.Errorf("archive_rpc: got %q", resp.ArchiveRPC)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=300" {
+		t.Errorf("Cache-Control: got %q", got)
+	}
+
+	getProof(t, server, "alice@example.com")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("a missing transaction must not be cached, got %d calls", n)
+	}
+}
+
+func TestIdentityProof_Errors(t *testing.T) {
+	server, _, _ := setupProofServer(t, true)
+
+	if w, _ := getProof(t, server, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("no email: want 400, got %d", w.Code)
+	}
+	if w, _ := getProof(t, server, "nobody@example.com"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown email: want 404, got %d", w.Code)
+	}
+}
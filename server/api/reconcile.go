@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/blockchain"
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+// ReconcileResult summarises one identity reconciliation run.
+type ReconcileResult struct {
+	PubKeys  int `json:"pubkeys"`
+	Found    int `json:"found"`    // identity memos found on-chain
+	Inserted int `json:"inserted"` // identities missing from the database
+}
+
+// ReconcileIdentities rebuilds identity mappings from the memo history of
+// pubkeys, inserting those missing from the database.  Memos are applied in
+// slot order so that, as with registration, the first claim on an email,
+// by its canonical form under rules, wins.  Existing mappings are never
+// modified, so runs are idempotent.
+func ReconcileIdentities(ctx context.Context, database db.DB, client *blockchain.Client, rules mail.CanonicalRules, pubkeys []solana.PublicKey) (ReconcileResult, error) {
+	res := ReconcileResult{PubKeys: len(pubkeys)}
+
+	var records []blockchain.IdentityRecord
+	for i, pk := range pubkeys {
+		recs, err := client.IdentityRecords(ctx, pk)
+		if err != nil {
+			return res, err
+		}
+		log.Printf("reconcile: [%d/%d] %s: %d identity memos", i+1, len(pubkeys), pk, len(recs))
+		records = append(records, recs...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Slot < records[j].Slot })
+	res.Found = len(records)
+
+	for _, rec := range records {
+		inserted, err := database.UpsertIdentity(ctx, &db.Identity{
+			Email:          rec.Email,
+			CanonicalEmail: rules.Canonical(rec.Email),
+			PubKey:         rec.Pubkey,
+			TxHash:         rec.TxHash,
+			Verified:       true,
+			ChainStatus:    db.ChainAnchored,
+			CreatedAt:      rec.BlockTime,
+		})
+		if err != nil {
+			return res, err
+		}
+		if inserted {
+			res.Inserted++
+			log.Printf("reconcile: restored %s -> %s (tx %s)", rec.Email, rec.Pubkey, rec.TxHash)
+		}
+	}
+	return res, nil
+}
+
+// ParsePubKeys decodes base58 public keys.
+func ParsePubKeys(keys []string) ([]solana.PublicKey, error) {
+	pubkeys := make([]solana.PublicKey, len(keys))
+	for i, k := range keys {
+		pk, err := solana.PublicKeyFromBase58(k)
+		if err != nil {
+			return nil, err
+		}
+		pubkeys[i] = pk
+	}
+	return pubkeys, nil
+}
+
+// reconcileRequest is the body of POST /api/v1/admin/reconcile-identities.
+type reconcileRequest struct {
+	PubKeys []string `json:"pubkeys"`
+}
+
+// POST /api/v1/admin/reconcile-identities
+//
+// Restores identity mappings from the on-chain memo history of the given
+// pubkeys.
+//
+// Request:  { "pubkeys": ["<base58>", ...] }
+// Response: { "pubkeys": 2, "found": 2, "inserted": 1 }
+func (s *Server) reconcileIdentities(w http.ResponseWriter, r *http.Request) {
+	var req reconcileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if len(req.PubKeys) == 0 {
+		writeError(w, http.StatusBadRequest, "pubkeys required")
+		return
+	}
+	pubkeys, err := ParsePubKeys(req.PubKeys)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid pubkey: "+err.Error())
+		return
+	}
+
+	res, err := ReconcileIdentities(r.Context(), s.db, s.solana, s.canonicalRules(), pubkeys)
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "reconcile failed", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/blockchain"
+)
+
+// chainIdentity is an identity memo transaction served by fakeIdentityChain.
+type chainIdentity struct {
+	signer solana.PublicKey
+	email  string
+	slot   uint64
+}
+
+// fakeIdentityChain serves each signer's identity memo transactions over
+// JSON-RPC.
+func fakeIdentityChain(t *testing.T, memos []chainIdentity) *blockchain.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var arg string
+		json.Unmarshal(req.Params[0], &arg)
+
+		var result any
+		switch req.Method {
+		case "getSignaturesForAddress":
+			sigs := []map[string]any{}
+			for i := len(memos) - 1; i >= 0; i-- {
+				if memos[i].signer.String() == arg {
+					sigs = append(sigs, map[string]any{"signature": solana.Signature{byte(i + 1)}.String(), "slot": memos[i].slot})
+				}
+			}
+			result = sigs
+		case "getTransaction":
+			sig := solana.MustSignatureFromBase58(arg)
+			m := memos[sig[0]-1]
+			memo, _ := json.Marshal(map[string]string{"action": "identity", "email": m.email, "pubkey": m.signer.String()})
+			tx, _ := solana.NewTransaction([]solana.Instruction{
+				solana.NewInstruction(blockchain.MemoV2ProgramID,
+					solana.AccountMetaSlice{solana.Meta(m.signer).SIGNER()}, memo),
+			}, solana.Hash{}, solana.TransactionPayer(m.signer))
+			raw, _ := tx.MarshalBinary()
+			result = map[string]any{
+				"slot":        m.slot,
+				"transaction": []string{base64.StdEncoding.EncodeToString(raw), "base64"},
+				"meta":        map[string]any{"err": nil},
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}))
+	t.Cleanup(srv.Close)
+	return blockchain.NewClient(srv.URL)
+}
+
+func TestReconcileIdentities(t *testing.T) {
+	_, mockDB := setupTestServer(t)
+	alice := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
+	bob := solana.MustPublicKeyFromBase58("7xKhMhVPYvZXZq9QKqZXZq9QKqZXZq9QKqZXZq9QKqZ")
+
+	client := fakeIdentityChain(t, []chainIdentity{
+		{signer: bob, email: "shared@example.com", slot: 20},
+		{signer: alice, email: "alice@example.com", slot: 5},
+		{signer: alice, email: "shared@example.com", slot: 10},
+	})
+
+	res, err := ReconcileIdentities(context.Background(), mockDB, client, nil, []solana.PublicKey{bob, alice})
+	if err != nil {
+		t.Fatalf("ReconcileIdentities: %v", err)
+	}
+	if res.Found != 3 || res.Inserted != 2 {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if id := mockDB.Identities["shared@example.com"]; id == nil || id.PubKey != alice.String() {
+		t.Errorf("earliest claim should win, got %+v", id)
+	}
+	if id := mockDB.Identities["alice@example.com"]; id == nil || !id.Verified || id.TxHash == "" {
+		t.Errorf("unexpected restored identity %+v", id)
+	}
+
+	res, err = ReconcileIdentities(context.Background(), mockDB, client, nil, []solana.PublicKey{bob, alice})
+	if err != nil {
+		t.Fatalf("second ReconcileIdentities: %v", err)
+	}
+	if res.Inserted != 0 {
+		t.Errorf("re-run should insert nothing, got %+v", res)
+	}
+}
+
+func TestReconcileIdentitiesEndpoint_Validation(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+	router := NewRouter(mockDB, server.solana, nil, server.cfg)
+
+	for _, body := range []string{`not json`, `{}`, `{"pubkeys":["not-a-key"]}`} {
+		req := httptest.NewRequest("POST", "/api/v1/admin/reconcile-identities", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status code: want %d, got %d", body, http.StatusBadRequest, w.Code)
+		}
+	}
+}
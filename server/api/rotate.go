@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"mulamail/db"
+	"mulamail/vault"
+)
+
+// RotateResult counts the records RotateEncryptionKey looked at.
+type RotateResult struct {
+	Accounts  int `json:"accounts"`  // mail accounts whose passwords were re-encrypted
+	Scheduled int `json:"scheduled"` // undelivered scheduled messages re-encrypted
+	Outbox    int `json:"outbox"`    // undelivered outbox messages re-encrypted
+	Skipped   int `json:"skipped"`   // records already encrypted under the new key
+}
+
+// RotateEncryptionKey re-encrypts stored mail credentials and undelivered
+// scheduled and outbox messages from oldKey to newKey.  Records that already decrypt
+// under newKey are skipped, so an interrupted rotation can simply be run
+// again.  Preview and message caches are not rotated: entries written under
+// the old key stop decrypting and are refetched from the mail server.
+func RotateEncryptionKey(ctx context.Context, database db.DB, oldKey, newKey vault.Key) (RotateResult, error) {
+	var res RotateResult
+	if newKey.IsZero() {
+		return res, errors.New("new key: not set")
+	}
+	if oldKey.Equal(newKey) {
+		return res, errors.New("new key is the same as the current key")
+	}
+
+	accounts, err := database.GetAllMailAccounts(ctx)
+	if err != nil {
+		return res, err
+	}
+	for _, acc := range accounts {
+		pop3, rotatedPOP3, err := reencrypt(oldKey, newKey, acc.POP3.PassEnc)
+		if err != nil {
+			return res, fmt.Errorf("account %s/%s POP3 password: %w", acc.OwnerPubKey, acc.AccountEmail, err)
+		}
+		smtp, rotatedSMTP, err := reencrypt(oldKey, newKey, acc.SMTP.PassEnc)
+		if err != nil {
+			return res, fmt.Errorf("account %s/%s SMTP password: %w", acc.OwnerPubKey, acc.AccountEmail, err)
+		}
+		if !rotatedPOP3 && !rotatedSMTP {
+			res.Skipped++
+			continue
+		}
+		if err := database.SetMailAccountPasswords(ctx, acc.OwnerPubKey, acc.AccountEmail, pop3, smtp); err != nil {
+			return res, err
+		}
+		res.Accounts++
+	}
+
+	msgs, err := database.GetUndeliveredScheduledMessages(ctx)
+	if err != nil {
+		return res, err
+	}
+	for _, m := range msgs {
+		payload, rotated, err := reencrypt(oldKey, newKey, m.PayloadEnc)
+		if err != nil {
+			return res, fmt.Errorf("scheduled message %s: %w", m.ID.Hex(), err)
+		}
+		if !rotated {
+			res.Skipped++
+			continue
+		}
+		if err := database.SetScheduledPayload(ctx, m.ID, payload); err != nil {
+			return res, err
+		}
+		res.Scheduled++
+	}
+
+	queued, err := database.GetUndeliveredOutboxMessages(ctx)
+	if err != nil {
+		return res, err
+	}
+	for _, m := range queued {
+		payload, rotated, err := reencrypt(oldKey, newKey, m.PayloadEnc)
+		if err != nil {
+			return res, fmt.Errorf("outbox message %s: %w", m.ID.Hex(), err)
+		}
+		if !rotated {
+			res.Skipped++
+			continue
+		}
+		if err := database.SetOutboxPayload(ctx, m.ID, payload); err != nil {
+			return res, err
+		}
+		res.Outbox++
+	}
+	return res, nil
+}
+
+// reencrypt moves ciphertext from oldKey to newKey.  It reports false, with
+// ciphertext unchanged, when ciphertext is empty or already under newKey.
+func reencrypt(oldKey, newKey vault.Key, ciphertext string) (string, bool, error) {
+	if ciphertext == "" {
+		return "", false, nil
+	}
+	plaintext, err := oldKey.Decrypt(ciphertext)
+	if err != nil {
+		if check, newErr := newKey.Decrypt(ciphertext); newErr == nil {
+			clear(check)
+			return ciphertext, false, nil
+		}
+		return "", false, fmt.Errorf("decrypt: %w", err)
+	}
+	defer clear(plaintext)
+	out, err := newKey.Encrypt(plaintext)
+	if err != nil {
+		return "", false, err
+	}
+	return out, true, nil
+}
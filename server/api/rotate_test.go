@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"mulamail/db"
+	"mulamail/vault"
+)
+
+var rotatedKey = vault.MustParseKey("fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210")
+
+func TestRotateEncryptionKey(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+	oldKey := server.cfg.EncryptionKey
+
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", "pop.example.com", 995)
+	payload, _ := oldKey.EncryptString(`{"to":["you@example.org"]}`)
+	mockDB.CreateScheduledMessage(ctx, &db.ScheduledMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", PayloadEnc: payload})
+	mockDB.CreateOutboxMessage(ctx, &db.OutboxMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", PayloadEnc: payload})
+
+	res, err := RotateEncryptionKey(ctx, mockDB, oldKey, rotatedKey)
+	if err != nil {
+		t.Fatalf("RotateEncryptionKey failed: %v", err)
+	}
+	if res.Accounts != 1 || res.Scheduled != 1 || res.Outbox != 1 || res.Skipped != 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	acc, _ := mockDB.GetMailAccount(ctx, "owner", "me@example.com")
+	if pass, err := rotatedKey.DecryptString(acc.POP3.PassEnc); err != nil || pass != "pass" {
+		t.Errorf("POP3 password not readable under new key: %q, %v", pass, err)
+	}
+	if acc.SMTP.PassEnc != "" {
+		t.Errorf("empty SMTP password must stay empty, got %q", acc.SMTP.PassEnc)
+	}
+	msgs, _ := mockDB.GetUndeliveredScheduledMessages(ctx)
+	if _, err := rotatedKey.DecryptString(msgs[0].PayloadEnc); err != nil {
+		t.Errorf("scheduled payload not readable under new key: %v", err)
+	}
+	queued, _ := mockDB.GetUndeliveredOutboxMessages(ctx)
+	if _, err := rotatedKey.DecryptString(queued[0].PayloadEnc); err != nil {
+		t.Errorf("outbox payload not readable under new key: %v", err)
+	}
+
+	// A second run finds everything already rotated.
+	res, err = RotateEncryptionKey(ctx, mockDB, oldKey, rotatedKey)
+	if err != nil {
+		t.Fatalf("second RotateEncryptionKey failed: %v", err)
+	}
+	if res.Accounts != 0 || res.Scheduled != 0 || res.Outbox != 0 || res.Skipped != 3 {
+		t.Errorf("expected rerun to skip everything, got %+v", res)
+	}
+}
+
+func TestRotateEncryptionKey_Errors(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+	oldKey := server.cfg.EncryptionKey
+
+	if _, err := RotateEncryptionKey(ctx, mockDB, oldKey, oldKey); err == nil {
+		t.Error("expected error when keys are equal")
+	}
+	if _, err := RotateEncryptionKey(ctx, mockDB, oldKey, vault.Key{}); err == nil {
+		t.Error("expected error for an unset new key")
+	}
+
+	mockDB.CreateMailAccount(ctx, &db.MailAccount{OwnerPubKey: "owner", AccountEmail: "me@example.com",
+		POP3: db.POP3Settings{PassEnc: "not-ciphertext"}})
+	if _, err := RotateEncryptionKey(ctx, mockDB, oldKey, rotatedKey); err == nil {
+		t.Error("expected error for a password readable under neither key")
+	}
+}
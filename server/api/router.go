@@ -1,8 +1,14 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"mulamail/blockchain"
 	"mulamail/config"
@@ -14,48 +20,524 @@ import (
 type Server struct {
 	db      db.DB
 	solana  *blockchain.Client
-	storage vault.Storage
+	storage vault.Storage // encrypts what it stores (vault.EncryptedStorage)
 	cfg     *config.Config
+	openAPI []byte // JSON OpenAPI document, built once by NewRouter
+
+	identities *identityCache   // recent identity lookups; nil when disabled
+	proofs     *proofCache      // transactions of recent identity proofs; nil caches nothing
+	inflight   *inflightLimiter // caps on concurrent requests; nil outside NewRouter
+	owners     ownerLocks       // serialises each owner's changes; see lockOwner
+	maint      maintenanceState // last reading of the maintenance switch
 }
 
 // NewRouter registers all routes and returns the top-level handler.
 func NewRouter(dbClient db.DB, solana *blockchain.Client, storage vault.Storage, cfg *config.Config) http.Handler {
-	s := &Server{db: dbClient, solana: solana, storage: storage, cfg: cfg}
+	s := &Server{db: dbClient, solana: solana, storage: storage, cfg: cfg,
+		identities: newIdentityCache(cfg.IdentityCacheSize, seconds(cfg.IdentityCacheTTLSeconds)),
+		proofs:     newProofCache(proofCacheSize),
+		inflight:   newInflightLimiter(cfg)}
+
+	routes := s.routes()
+	spec, err := json.Marshal(openAPISpec(routes))
+	if err != nil {
+		panic("api: build OpenAPI document: " + err.Error())
+	}
+	s.openAPI = spec
 
 	mux := http.NewServeMux()
+	for _, rt := range routes {
+		handler := rt.handler
+		if rt.method != "GET" && !rt.duringMaintenance {
+			handler = s.withMaintenance(handler)
+		}
+		if rt.admin {
+			handler = s.requireAdmin(handler)
+		}
+		if rt.scope != "" {
+			handler = s.withAPIKey(rt.scope, handler)
+		}
+		if rt.streaming {
+			handler = s.withStreamingDeadline(handler)
+		}
+		if !rt.unlimited {
+			handler = s.inflight.wrap(rt.path, handler)
+		}
+		mux.HandleFunc(rt.method+" "+rt.path, handler)
+	}
+	proxies, _ := ParseTrustedProxies(cfg.TrustedProxies) // validated at startup
+	return withRequestID(withClientIP(proxies, mux))
+}
+
+// route describes one endpoint.  NewRouter registers every route on the mux
+// and openAPISpec documents the same list, so the two cannot drift apart.
+type route struct {
+	method  string
+	path    string
+	summary string
+	handler http.HandlerFunc
+	admin   bool   // requires ADMIN_TOKEN (wrapped in requireAdmin)
+	scope   string // API key scope, if the route accepts API keys (wrapped in withAPIKey)
+
+	// streaming routes may write for longer than the server's write timeout
+	// while they make progress (wrapped in withStreamingDeadline)
+	streaming bool
+
+	// unlimited routes are exempt from the in-flight caps, so they answer
+	// even while the server is saturated (otherwise wrapped in inflight.wrap)
+	unlimited bool
+
+	// duringMaintenance routes are not GETs but write nothing, or are the
+	// maintenance switch itself, and so keep working in maintenance mode
+	// (other non-GET routes are wrapped in withMaintenance)
+	duringMaintenance bool
+
+	query     []queryParam
+	request   any         // zero value of the JSON request body, nil if none
+	responses map[int]any // success status -> zero value of its JSON body (nil for none)
+	errors    []int       // documented error statuses, answered with errorResponse
+}
+
+// queryParam documents one query string parameter.
+type queryParam struct {
+	name     string
+	required bool
+}
+
+var (
+	ownerParam   = queryParam{"owner", true}
+	accountParam = queryParam{"account", true}
+)
+
+// routes lists every endpoint the server exposes.
+func (s *Server) routes() []route {
+	const (
+		badRequest  = http.StatusBadRequest
+		notFound    = http.StatusNotFound
+		conflict    = http.StatusConflict
+		unprocessed = http.StatusUnprocessableEntity
+		internal    = http.StatusInternalServerError
+		badGateway  = http.StatusBadGateway
+		unavailable = http.StatusServiceUnavailable
+	)
+	routes := []route{
+		// Health and API description
+		{method: "GET", path: "/api/health", summary: "Liveness check", handler: s.health, unlimited: true,
+			responses: map[int]any{http.StatusOK: statusResponse{}}},
+		{method: "GET", path: "/api/openapi.json", summary: "This OpenAPI document", handler: s.serveOpenAPI,
+			responses: map[int]any{http.StatusOK: map[string]any{}}},
+		{method: "GET", path: "/api/docs", summary: "Swagger UI for this API", handler: s.serveDocs,
+			responses: map[int]any{http.StatusOK: htmlPage{}}},
+		{method: "GET", path: "/api/docs/assets/{file}", summary: "Swagger UI stylesheet and script", handler: s.serveDocsAsset,
+			responses: map[int]any{http.StatusOK: binaryBody{}},
+			errors:    []int{notFound}},
 
-	// Health
-	mux.HandleFunc("GET /api/health", s.health)
+		// Identity (email ↔ Solana pubkey)
+		{method: "POST", path: "/api/v1/identity/create-tx", summary: "Build an unsigned identity memo transaction", handler: s.createIdentityTx, duringMaintenance: true,
+			request:   createIdentityTxRequest{},
+			responses: map[int]any{http.StatusOK: createIdentityTxResponse{}},
+			errors:    []int{badRequest, unprocessed, internal}},
+		{method: "POST", path: "/api/v1/identity/register", summary: "Broadcast a signed identity transaction and store the identity", handler: s.registerIdentity,
+			request:   registerIdentityRequest{},
+			responses: map[int]any{http.StatusCreated: registerIdentityResponse{}},
+			errors:    []int{badRequest, conflict, internal, unavailable}},
+		{method: "GET", path: "/api/v1/identity/resolve", summary: "Resolve an identity by email or pubkey", handler: s.resolveIdentity,
+			query:     []queryParam{{"email", false}, {"pubkey", false}, {"exact", false}, {"nocache", false}},
+			responses: map[int]any{http.StatusOK: db.Identity{}},
+			errors:    []int{badRequest, notFound}},
+		{method: "POST", path: "/api/v1/identity/resolve-batch", summary: "Resolve up to 100 emails and pubkeys at once", handler: s.resolveIdentityBatch, duringMaintenance: true,
+			query:     []queryParam{{"exact", false}},
+			request:   resolveBatchRequest{},
+			responses: map[int]any{http.StatusOK: resolveBatchResponse{}},
+			errors:    []int{badRequest, internal}},
+		{method: "GET", path: "/api/v1/identity/proof", summary: "An identity with the on-chain transaction that proves it", handler: s.identityProof,
+			query:     []queryParam{{"email", true}},
+			responses: map[int]any{http.StatusOK: identityProofResponse{}},
+			errors:    []int{badRequest, notFound, badGateway}},
 
-	// Identity (email ↔ Solana pubkey)
-	mux.HandleFunc("POST /api/v1/identity/create-tx", s.createIdentityTx)
-	mux.HandleFunc("POST /api/v1/identity/register", s.registerIdentity)
-	mux.HandleFunc("GET /api/v1/identity/resolve", s.resolveIdentity)
+		// Legacy mail-account management
+		{method: "POST", path: "/api/v1/accounts", summary: "Add a mail account", handler: s.addAccount, scope: scopeAccountsWrite,
+			request:   addAccountRequest{},
+			responses: map[int]any{http.StatusCreated: accountEmailResponse{}},
+			errors:    []int{badRequest, conflict, internal, unavailable}},
+		{method: "GET", path: "/api/v1/accounts", summary: "List an owner's mail accounts", handler: s.listAccounts, scope: scopeAccountsRead,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: []db.MailAccount{}},
+			errors:    []int{badRequest, internal}},
+		{method: "PATCH", path: "/api/v1/accounts", summary: "Update an account's profile and SMTP settings", handler: s.updateAccount, scope: scopeAccountsWrite,
+			request:   updateAccountRequest{},
+			responses: map[int]any{http.StatusOK: accountEmailResponse{}},
+			errors:    []int{badRequest, notFound, internal, unavailable}},
+		{method: "PUT", path: "/api/v1/accounts/fetch-policy", summary: "Choose whether archived mail is deleted from the POP3 server", handler: s.setFetchPolicy, scope: scopeAccountsWrite,
+			request:   setFetchPolicyRequest{},
+			responses: map[int]any{http.StatusOK: fetchPolicyResponse{}},
+			errors:    []int{badRequest, notFound, internal, badGateway, unavailable}},
+		{method: "GET", path: "/api/v1/accounts/health", summary: "Report the login health of an owner's mail accounts", handler: s.accountHealth, scope: scopeAccountsRead,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: []accountHealthView{}},
+			errors:    []int{badRequest, internal}},
+		{method: "GET", path: "/api/v1/accounts/presets", summary: "Suggest POP3/SMTP settings for a domain", handler: s.accountPresets,
+			query:     []queryParam{{"domain", true}},
+			responses: map[int]any{http.StatusOK: providerPreset{}},
+			errors:    []int{badRequest, notFound}},
 
-	// Legacy mail-account management
-	mux.HandleFunc("POST /api/v1/accounts", s.addAccount)
-	mux.HandleFunc("GET /api/v1/accounts", s.listAccounts)
+		// Owner dashboard
+		{method: "GET", path: "/api/v1/dashboard", summary: "Accounts, identity, storage and recent sent mail in one call", handler: s.dashboard, scope: scopeMailRead,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: dashboardResponse{}},
+			errors:    []int{badRequest}},
 
-	// Mail operations (POP3 fetch / SMTP send)
-	mux.HandleFunc("GET /api/v1/mail/inbox", s.fetchInbox)
-	mux.HandleFunc("GET /api/v1/mail/message", s.fetchMessage)
-	mux.HandleFunc("POST /api/v1/mail/send", s.sendMail)
+		// Mail operations (POP3 fetch / SMTP send)
+		{method: "GET", path: "/api/v1/mail/inbox", summary: "Fetch inbox previews", handler: s.fetchInbox, scope: scopeMailRead, streaming: true,
+			query:     []queryParam{ownerParam, accountParam, {"limit", false}, {"stream", false}, {"preview_max_bytes", false}, {"include_duplicates", false}, {"snippets", false}, {"filter", false}},
+			responses: map[int]any{http.StatusOK: inboxResponse{}, http.StatusNotModified: nil},
+			errors:    []int{badRequest, badGateway, unavailable}},
+		{method: "GET", path: "/api/v1/mail/inbox/all", summary: "Unified inbox across all of an owner's accounts", handler: s.fetchInboxAll, scope: scopeMailRead,
+			query:     []queryParam{ownerParam, {"limit", false}, {"preview_max_bytes", false}, {"include_duplicates", false}, {"snippets", false}},
+			responses: map[int]any{http.StatusOK: inboxAllResponse{}},
+			errors:    []int{badRequest, internal}},
+		{method: "POST", path: "/api/v1/mail/inbox/delta", summary: "Report inbox changes since a known UIDL set", handler: s.inboxDelta, scope: scopeMailRead, duringMaintenance: true,
+			request:   inboxDeltaRequest{},
+			responses: map[int]any{http.StatusOK: inboxDeltaResponse{}},
+			errors:    []int{badRequest, notFound, http.StatusRequestEntityTooLarge, internal, badGateway, unavailable}},
+		{method: "GET", path: "/api/v1/mail/message", summary: "Download a raw message, as JSON or as message/rfc822", handler: s.fetchMessage, scope: scopeMailRead, streaming: true,
+			query:     []queryParam{ownerParam, accountParam, {"id", true}, {"unsafe", false}, {"format", false}},
+			responses: map[int]any{http.StatusOK: rawMessageResponse{}, http.StatusNotModified: nil},
+			errors:    []int{badRequest, internal, unavailable}},
+		{method: "GET", path: "/api/v1/mail/attachment", summary: "Download one decoded MIME part", handler: s.fetchAttachment, scope: scopeMailRead, streaming: true,
+			query:     []queryParam{ownerParam, accountParam, {"id", true}, {"part", true}},
+			responses: map[int]any{http.StatusOK: binaryBody{}},
+			errors:    []int{badRequest, notFound, unprocessed, internal, unavailable}},
+		{method: "GET", path: "/api/v1/mail/search", summary: "Search cached previews by exact sender", handler: s.searchMessages, scope: scopeMailRead,
+			query:     []queryParam{ownerParam, {"from", true}, {"account", false}, {"include_duplicates", false}, {"filter", false}},
+			responses: map[int]any{http.StatusOK: searchResponse{}},
+			errors:    []int{badRequest, internal}},
+		{method: "GET", path: "/api/v1/mail/bounces", summary: "List recent bounces from the message cache", handler: s.listBounces, scope: scopeMailRead,
+			query:     []queryParam{ownerParam, {"account", false}, {"limit", false}},
+			responses: map[int]any{http.StatusOK: bouncesResponse{}},
+			errors:    []int{badRequest, internal}},
+		{method: "POST", path: "/api/v1/mail/archive-all", summary: "Queue an import of a whole mailbox into the vault", handler: s.createArchiveJob, scope: scopeMailRead,
+			query:     []queryParam{ownerParam, accountParam},
+			responses: map[int]any{http.StatusAccepted: db.ArchiveJob{}},
+			errors:    []int{badRequest, notFound, internal, unavailable}},
+		{method: "GET", path: "/api/v1/mail/archive-all/{job}", summary: "Progress of a mailbox archive", handler: s.archiveJobStatus, scope: scopeMailRead,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: db.ArchiveJob{}},
+			errors:    []int{badRequest, notFound, internal}},
+		{method: "GET", path: "/api/v1/mail/export-mbox", summary: "Download archived messages as an mbox file, or queue a large one as an export", handler: s.exportMbox, scope: scopeMailRead, streaming: true,
+			query:     []queryParam{ownerParam, accountParam, {"since", false}, {"until", false}},
+			responses: map[int]any{http.StatusOK: binaryBody{}, http.StatusAccepted: db.ExportJob{}},
+			errors:    []int{badRequest, notFound, internal, unavailable}},
+		{method: "POST", path: "/api/v1/mail/send", summary: "Send mail now, queue it with async or schedule it with send_at", handler: s.sendMail, scope: scopeMailSend,
+			query:     []queryParam{{"async", false}},
+			request:   sendMailRequest{},
+			responses: map[int]any{http.StatusOK: sendMailResponse{}, http.StatusAccepted: scheduleResponse{}},
+			errors: []int{badRequest, http.StatusUnauthorized, notFound, http.StatusRequestEntityTooLarge,
+				unprocessed, http.StatusTooManyRequests, internal, unavailable}},
+		{method: "GET", path: "/api/v1/mail/outbox/{id}", summary: "Get the delivery state of a queued message", handler: s.getOutboxMessage, scope: scopeMailRead,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: db.OutboxMessage{}},
+			errors:    []int{badRequest, notFound, internal}},
+		{method: "GET", path: "/api/v1/mail/scheduled", summary: "List scheduled messages", handler: s.listScheduled, scope: scopeMailRead,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: []scheduledView{}},
+			errors:    []int{badRequest, internal}},
+		{method: "DELETE", path: "/api/v1/mail/scheduled/{id}", summary: "Cancel a scheduled message before delivery", handler: s.cancelScheduled, scope: scopeMailSend,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: statusResponse{}},
+			errors:    []int{badRequest, notFound, internal}},
+
+		// Contacts (recipient autocomplete)
+		{method: "GET", path: "/api/v1/contacts", summary: "List or prefix-search an owner's contacts", handler: s.listContacts, scope: scopeContactsRead,
+			query:     []queryParam{ownerParam, {"q", false}, {"limit", false}},
+			responses: map[int]any{http.StatusOK: contactsResponse{}},
+			errors:    []int{badRequest, internal}},
+		{method: "POST", path: "/api/v1/contacts", summary: "Add a contact", handler: s.createContact, scope: scopeContactsWrite,
+			request:   contactRequest{},
+			responses: map[int]any{http.StatusCreated: contactView{}},
+			errors:    []int{badRequest, conflict, internal}},
+		{method: "PUT", path: "/api/v1/contacts/{id}", summary: "Replace a contact's address and name", handler: s.updateContact, scope: scopeContactsWrite,
+			request:   contactRequest{},
+			responses: map[int]any{http.StatusOK: contactView{}},
+			errors:    []int{badRequest, notFound, conflict, internal}},
+		{method: "DELETE", path: "/api/v1/contacts/{id}", summary: "Delete a contact so mail activity does not re-add it", handler: s.deleteContact, scope: scopeContactsWrite,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: statusResponse{}},
+			errors:    []int{badRequest, notFound, internal}},
+
+		// Data export
+		{method: "POST", path: "/api/v1/export", summary: "Queue an encrypted archive of everything stored for an owner", handler: s.createExport,
+			query:     []queryParam{ownerParam},
+			request:   exportRequest{},
+			responses: map[int]any{http.StatusAccepted: db.ExportJob{}},
+			errors:    []int{badRequest, internal}},
+		{method: "GET", path: "/api/v1/export/{job}/status", summary: "State of an export job", handler: s.exportStatus,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: db.ExportJob{}},
+			errors:    []int{badRequest, notFound, internal}},
+		{method: "GET", path: "/api/v1/export/{job}/download", summary: "Download a finished export archive (passphrase-encrypted)", handler: s.downloadExport,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: binaryBody{}},
+			errors:    []int{badRequest, notFound, conflict, http.StatusGone, internal}},
+
+		// Owner deletion (right to erasure)
+		{method: "POST", path: "/api/v1/owner/delete/challenge", summary: "Issue the confirmation token a deletion must quote", handler: s.createErasureChallenge,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusCreated: erasureChallengeResponse{}},
+			errors:    []int{badRequest, internal}},
+		{method: "POST", path: "/api/v1/owner/delete", summary: "Delete everything stored for an owner, or count it with dry_run", handler: s.eraseOwner,
+			query:     []queryParam{ownerParam},
+			request:   eraseRequest{},
+			responses: map[int]any{http.StatusOK: eraseResponse{}, http.StatusAccepted: eraseResponse{}},
+			errors:    []int{badRequest, http.StatusUnauthorized, internal}},
+		{method: "GET", path: "/api/v1/owner/delete/{job}", summary: "Per-step progress of a deletion", handler: s.erasureStatus,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: db.ErasureJob{}},
+			errors:    []int{badRequest, notFound, internal}},
+
+		// Billing
+		{method: "POST", path: "/api/v1/billing/claim", summary: "Claim a premium plan with an on-chain payment", handler: s.claimPayment,
+			request:   claimPaymentRequest{},
+			responses: map[int]any{http.StatusOK: claimPaymentResponse{}},
+			errors:    []int{badRequest, http.StatusPaymentRequired, notFound, conflict, internal}},
+
+		// Tips
+		{method: "POST", path: "/api/v1/tips/create-tx", summary: "Build an unsigned SOL transfer tipping the sender of an email", handler: s.createTipTx, duringMaintenance: true,
+			request:   createTipTxRequest{},
+			responses: map[int]any{http.StatusOK: createTipTxResponse{}},
+			errors:    []int{badRequest, notFound, http.StatusGone, unprocessed, internal}},
+		{method: "POST", path: "/api/v1/tips/send", summary: "Broadcast a signed tip and record it against the email", handler: s.sendTip,
+			request:   sendTipRequest{},
+			responses: map[int]any{http.StatusCreated: sendTipResponse{}},
+			errors:    []int{badRequest, notFound, conflict, http.StatusGone, internal}},
+
+		// API keys for partner services (signed by the owner's wallet)
+		{method: "POST", path: "/api/v1/keys", summary: "Mint an API key; the key is returned only once", handler: s.createAPIKey,
+			request:   createKeyRequest{},
+			responses: map[int]any{http.StatusCreated: createKeyResponse{}},
+			errors:    []int{badRequest, http.StatusUnauthorized, internal}},
+		{method: "DELETE", path: "/api/v1/keys/{id}", summary: "Revoke an API key", handler: s.deleteAPIKey,
+			request:   deleteKeyRequest{},
+			responses: map[int]any{http.StatusOK: statusResponse{}},
+			errors:    []int{badRequest, http.StatusUnauthorized, notFound, internal}},
+
+		// Operator endpoints (require ADMIN_TOKEN)
+		{method: "GET", path: "/api/v1/admin/send-limits", summary: "Effective send limits for an owner", handler: s.getSendLimits, admin: true,
+			query:     []queryParam{ownerParam},
+			responses: map[int]any{http.StatusOK: sendLimitsResponse{}},
+			errors:    []int{badRequest, internal}},
+		{method: "PUT", path: "/api/v1/admin/send-limits", summary: "Override send limits for a trusted owner", handler: s.putSendLimits, admin: true,
+			request:   db.SendLimits{},
+			responses: map[int]any{http.StatusOK: db.SendLimits{}},
+			errors:    []int{badRequest, internal}},
+		{method: "GET", path: "/api/v1/admin/metrics", summary: "In-process counters such as identity cache hits and misses, and worker leaders", handler: s.metrics, admin: true,
+			responses: map[int]any{http.StatusOK: metricsResponse{}},
+			errors:    []int{internal}},
+		{method: "GET", path: "/api/v1/admin/weak-key-report", summary: "Count stored credentials encrypted under a weak key", handler: s.weakKeyReport, admin: true,
+			responses: map[int]any{http.StatusOK: weakKeyReport{}},
+			errors:    []int{internal}},
+		{method: "POST", path: "/api/v1/admin/reconcile-identities", summary: "Restore identities from on-chain memo history", handler: s.reconcileIdentities, admin: true,
+			request:   reconcileRequest{},
+			responses: map[int]any{http.StatusOK: ReconcileResult{}},
+			errors:    []int{badRequest, internal}},
+		{method: "POST", path: "/api/v1/admin/vault-gc", summary: "Delete vault blobs no record refers to", handler: s.vaultGC, admin: true,
+			request:   vaultGCRequest{},
+			responses: map[int]any{http.StatusOK: VaultGCReport{}},
+			errors:    []int{badRequest, internal, unavailable}},
+		{method: "POST", path: "/api/v1/admin/cache-gc", summary: "Delete one account's cached previews of messages gone from its server", handler: s.cacheGC, admin: true,
+			request:   cacheGCRequest{},
+			responses: map[int]any{http.StatusOK: CacheGCReport{}},
+			errors:    []int{badRequest, internal}},
+		{method: "POST", path: "/api/v1/admin/scrub-storage", summary: "Check vault objects against their stored checksums", handler: s.scrubStorage, admin: true, duringMaintenance: true,
+			request:   scrubRequest{},
+			responses: map[int]any{http.StatusOK: ScrubReport{}},
+			errors:    []int{badRequest, internal, unavailable}},
+		{method: "GET", path: "/api/v1/admin/audit-events", summary: "An owner's recent audit events", handler: s.listAuditEvents, admin: true,
+			query:     []queryParam{ownerParam, {"limit", false}},
+			responses: map[int]any{http.StatusOK: auditEventsResponse{}},
+			errors:    []int{badRequest, internal}},
+		{method: "GET", path: "/api/v1/admin/maintenance", summary: "The maintenance switch", handler: s.getMaintenance, admin: true,
+			responses: map[int]any{http.StatusOK: db.Maintenance{}},
+			errors:    []int{internal}},
+		{method: "PUT", path: "/api/v1/admin/maintenance", summary: "Turn maintenance mode on or off for every instance", handler: s.putMaintenance, admin: true, duringMaintenance: true,
+			request:   db.Maintenance{},
+			responses: map[int]any{http.StatusOK: db.Maintenance{}},
+			errors:    []int{badRequest, internal}},
+		{method: "POST", path: "/api/v1/admin/diagnose-account", summary: "Run an account's POP3 and SMTP login sequence and time each step", handler: s.diagnoseAccount, admin: true, duringMaintenance: true,
+			request:   diagnoseAccountRequest{},
+			responses: map[int]any{http.StatusOK: diagnoseAccountResponse{}},
+			errors:    []int{badRequest, notFound, internal}},
+	}
+	return append(routes, s.fixtureRoutes()...)
+}
+
+// NewHTTPServer returns the HTTP server for handler, with the timeouts and
+// header limit from cfg.  The read timeout covers the request headers, so a
+// client trickling them in (slowloris) is disconnected; the write timeout
+// stops a stalled client from holding a handler forever.
+func NewHTTPServer(addr string, handler http.Handler, cfg *config.Config) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    seconds(cfg.HTTPReadTimeoutSeconds),
+		WriteTimeout:   seconds(cfg.HTTPWriteTimeoutSeconds),
+		IdleTimeout:    seconds(cfg.HTTPIdleTimeoutSeconds),
+		MaxHeaderBytes: cfg.HTTPMaxHeaderBytes,
+	}
+}
+
+func seconds(n int) time.Duration { return time.Duration(n) * time.Second }
+
+// withStreamingDeadline lets a streaming route outlive the server's write
+// timeout: the deadline is pushed out by a full write timeout when the
+// handler starts and again on every write, so only a response that stops
+// making progress is cut off.
+func (s *Server) withStreamingDeadline(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := seconds(s.cfg.HTTPWriteTimeoutSeconds)
+		if timeout <= 0 {
+			next(w, r)
+			return
+		}
+		sw := &streamingWriter{ResponseWriter: w, rc: http.NewResponseController(w), timeout: timeout}
+		sw.extend()
+		next(sw, r)
+	}
+}
 
-	return mux
+// streamingWriter extends the write deadline before every write.
+type streamingWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (sw *streamingWriter) extend() {
+	sw.rc.SetWriteDeadline(time.Now().Add(sw.timeout)) //nolint:errcheck // unsupported outside a real connection
+}
+
+func (sw *streamingWriter) Write(p []byte) (int, error) {
+	sw.extend()
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *streamingWriter) Flush() {
+	sw.extend()
+	sw.rc.Flush() //nolint:errcheck
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *streamingWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+// ---------- request IDs ----------
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	apiKeyKey           // *db.APIKey set by withAPIKey
+	clientIPKey         // netip.Addr set by withClientIP
+)
+
+// withRequestID tags every request with an ID, reusing the caller's
+// X-Request-ID when present, and echoes it back in the response headers so
+// log lines can be correlated with client reports.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			var b [8]byte
+			rand.Read(b[:]) //nolint:errcheck
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// requestID returns the ID assigned by withRequestID, or "-" outside of it.
+func requestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return "-"
 }
 
 // ---------- shared helpers ----------
 
+// A JSON body up to jsonStreamThreshold bytes is sent whole; a larger one
+// is streamed in writes of jsonStreamChunk bytes.
+const (
+	jsonStreamThreshold = 1 << 20
+	jsonStreamChunk     = 64 << 10
+)
+
+// writeJSON answers with code and data as JSON.  data is encoded before
+// anything is written, so a value that cannot be encoded (a channel, a NaN)
+// is answered 500 with the error envelope rather than under a status its
+// body does not back; the encoding error is logged under the request ID.
+// A body up to jsonStreamThreshold carries a Content-Length.  A larger one
+// is streamed without it, flushing after each jsonStreamChunk, so that a
+// streaming route's write deadline moves with the body rather than having
+// to cover one huge write.  The status is committed by then: a client that
+// stops reading gets a truncated body, which no longer parses, and the
+// failed write is logged.
 func writeJSON(w http.ResponseWriter, code int, data any) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[%s] encode %T response: %v", responseRequestID(w), data, err)
+		code = http.StatusInternalServerError
+		body, _ = json.Marshal(errorResponse{Error: msgInternal})
+	}
+	body = append(body, '\n')
 	w.Header().Set("Content-Type", "application/json")
+	if len(body) <= jsonStreamThreshold {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(code)
+		w.Write(body) //nolint:errcheck
+		return
+	}
+
 	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(data) //nolint:errcheck
+	rc := http.NewResponseController(w)
+	for sent := 0; sent < len(body); sent += jsonStreamChunk {
+		if _, err := w.Write(body[sent:min(sent+jsonStreamChunk, len(body))]); err != nil {
+			log.Printf("[%s] stream %T response: %d of %d bytes sent: %v", responseRequestID(w), data, sent, len(body), err)
+			return
+		}
+		rc.Flush() //nolint:errcheck
+	}
+}
+
+// responseRequestID returns the request ID withRequestID set on w, or "-"
+// outside of it.
+func responseRequestID(w http.ResponseWriter) string {
+	if id := w.Header().Get("X-Request-ID"); id != "" {
+		return id
+	}
+	return "-"
+}
+
+// errorResponse is the body of every error reply.
+type errorResponse struct {
+	Error string `json:"error"`
 }
 
 func writeError(w http.ResponseWriter, code int, msg string) {
-	writeJSON(w, code, map[string]string{"error": msg})
+	writeJSON(w, code, errorResponse{Error: msg})
+}
+
+// writeLimitError reports a violated limit together with the limit itself so
+// clients can adjust without guessing.
+func writeLimitError(w http.ResponseWriter, code int, msg string, limit int) {
+	writeJSON(w, code, map[string]any{"error": msg, "limit": limit})
+}
+
+// statusResponse reports the state of a resource or of the server.
+type statusResponse struct {
+	Status string `json:"status"`
 }
 
 func (s *Server) health(w http.ResponseWriter, _ *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	writeJSON(w, http.StatusOK, statusResponse{Status: "ok"})
 }
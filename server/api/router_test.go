@@ -4,84 +4,35 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"mulamail/blockchain"
 	"mulamail/config"
 	"mulamail/db"
+	"mulamail/db/dbtest"
 	"mulamail/vault"
 )
 
-// mockDB implements a simple in-memory mock for testing
-type mockDB struct {
-	identities   map[string]*db.Identity // keyed by email
-	identitiesPK map[string]*db.Identity // keyed by pubkey
-	accounts     map[string][]*db.MailAccount
-}
-
-func newMockDB() *mockDB {
-	return &mockDB{
-		identities:   make(map[string]*db.Identity),
-		identitiesPK: make(map[string]*db.Identity),
-		accounts:     make(map[string][]*db.MailAccount),
-	}
-}
-
-func (m *mockDB) CreateIdentity(ctx context.Context, id *db.Identity) error {
-	m.identities[id.Email] = id
-	m.identitiesPK[id.PubKey] = id
-	return nil
-}
-
-func (m *mockDB) GetIdentityByEmail(ctx context.Context, email string) (*db.Identity, error) {
-	if id, ok := m.identities[email]; ok {
-		return id, nil
-	}
-	return nil, db.ErrNotFound
-}
-
-func (m *mockDB) GetIdentityByPubKey(ctx context.Context, pubkey string) (*db.Identity, error) {
-	if id, ok := m.identitiesPK[pubkey]; ok {
-		return id, nil
-	}
-	return nil, db.ErrNotFound
-}
-
-func (m *mockDB) CreateMailAccount(ctx context.Context, acc *db.MailAccount) error {
-	m.accounts[acc.OwnerPubKey] = append(m.accounts[acc.OwnerPubKey], acc)
-	return nil
-}
-
-func (m *mockDB) GetMailAccountsByOwner(ctx context.Context, owner string) ([]db.MailAccount, error) {
-	accs := m.accounts[owner]
-	result := make([]db.MailAccount, len(accs))
-	for i, a := range accs {
-		result[i] = *a
-	}
-	return result, nil
-}
-
-func (m *mockDB) GetMailAccount(ctx context.Context, owner, email string) (*db.MailAccount, error) {
-	for _, acc := range m.accounts[owner] {
-		if acc.AccountEmail == email {
-			return acc, nil
-		}
-	}
-	return nil, db.ErrNotFound
-}
-
 // setupTestServer creates a test server with mocked dependencies
-func setupTestServer(t *testing.T) (*Server, *mockDB) {
+func setupTestServer(t *testing.T) (*Server, *dbtest.Mock) {
 	t.Helper()
 
-	mockDB := newMockDB()
+	mockDB := dbtest.New()
 
 	// Use a test encryption key (64 hex chars = 32 bytes)
 	cfg := &config.Config{
-		EncryptionKey: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
-		SolanaRPC:     "https://api.devnet.solana.com",
+		EncryptionKey:   vault.MustParseKey("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"),
+		SolanaRPC:       "https://api.devnet.solana.com",
+		MaxRecipients:   50,
+		MaxMessageBytes: 25 << 20,
 	}
 
 	server := &Server{
@@ -94,6 +45,29 @@ func setupTestServer(t *testing.T) (*Server, *mockDB) {
 	return server, mockDB
 }
 
+// encryptStorage wraps inner in the vault encryption the server uses in
+// production, under the test server's key.
+func encryptStorage(t *testing.T, server *Server, inner vault.Storage) vault.Storage {
+	t.Helper()
+	ring, err := vault.NewKeyRing(server.cfg.EncryptionKey)
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+	return vault.NewEncryptedStorage(inner, ring)
+}
+
+// newTestVault gives server encrypted vault storage over a fresh local
+// store and returns the local store, which holds the bytes at rest.
+func newTestVault(t *testing.T, server *Server) *vault.LocalStorage {
+	t.Helper()
+	local, err := vault.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+	server.storage = encryptStorage(t, server, local)
+	return local
+}
+
 func TestHealth(t *testing.T) {
 	server, _ := setupTestServer(t)
 
@@ -144,6 +118,90 @@ func TestWriteJSON(t *testing.T) {
 	}
 }
 
+func TestWriteJSON_Unencodable(t *testing.T) {
+	for name, data := range map[string]any{
+		"channel": map[string]any{"ch": make(chan int)},
+		"NaN":     struct{ Ratio float64 }{math.NaN()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			w.Header().Set("X-Request-ID", "req-1")
+			writeJSON(w, http.StatusOK, data)
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("status code: want %d, got %d", http.StatusInternalServerError, w.Code)
+			}
+			var resp errorResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Error != msgInternal {
+				t.Errorf("want the error envelope, got %+v, %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestWriteJSON_ContentLength(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSON(w, http.StatusCreated, map[string]string{"id": "1"})
+	if w.Code != http.StatusCreated {
+		t.Errorf("status code: want %d, got %d", http.StatusCreated, w.Code)
+	}
+	if got, want := w.Header().Get("Content-Length"), fmt.Sprint(w.Body.Len()); got != want {
+		t.Errorf("Content-Length: want %s, got %q", want, got)
+	}
+}
+
+func TestWriteJSON_Huge(t *testing.T) {
+	items := make([]string, 0, 3*jsonStreamThreshold/100)
+	for i := range cap(items) {
+		items = append(items, fmt.Sprintf("%090d", i))
+	}
+
+	w := httptest.NewRecorder()
+	writeJSON(w, http.StatusOK, items)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status code: want %d, got %d", http.StatusOK, w.Code)
+	}
+	if w.Body.Len() <= jsonStreamThreshold {
+		t.Fatalf("body of %d bytes is not past the threshold", w.Body.Len())
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("a streamed body carries no Content-Length, got %s", cl)
+	}
+	if !w.Flushed {
+		t.Error("a streamed body should be flushed as it goes")
+	}
+	var got []string
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || len(got) != len(items) || got[len(got)-1] != items[len(items)-1] {
+		t.Errorf("streamed body does not round-trip: %d items, %v", len(got), err)
+	}
+}
+
+// failingWriter fails every write after the first.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if fw.writes++; fw.writes > 1 {
+		return 0, io.ErrClosedPipe
+	}
+	return fw.ResponseRecorder.Write(p)
+}
+
+func TestWriteJSON_HugeClientGone(t *testing.T) {
+	fw := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	writeJSON(fw, http.StatusOK, strings.Repeat("x", 2*jsonStreamThreshold))
+
+	if fw.writes != 2 {
+		t.Errorf("want streaming to stop at the failed write, got %d writes", fw.writes)
+	}
+	if fw.Body.Len() != jsonStreamChunk {
+		t.Errorf("want one chunk sent, got %d bytes", fw.Body.Len())
+	}
+}
+
 func TestWriteError(t *testing.T) {
 	w := httptest.NewRecorder()
 
@@ -191,14 +249,27 @@ func TestRouter_AllEndpoints(t *testing.T) {
 		path   string
 	}{
 		{"GET", "/api/health"},
+		{"GET", "/api/openapi.json"},
+		{"GET", "/api/docs"},
 		{"POST", "/api/v1/identity/create-tx"},
 		{"POST", "/api/v1/identity/register"},
 		{"GET", "/api/v1/identity/resolve"},
+		{"POST", "/api/v1/identity/resolve-batch"},
 		{"POST", "/api/v1/accounts"},
 		{"GET", "/api/v1/accounts"},
+		{"PATCH", "/api/v1/accounts"},
+		{"GET", "/api/v1/accounts/presets"},
 		{"GET", "/api/v1/mail/inbox"},
+		{"GET", "/api/v1/mail/inbox/all"},
 		{"GET", "/api/v1/mail/message"},
+		{"GET", "/api/v1/mail/attachment"},
+		{"GET", "/api/v1/mail/search"},
 		{"POST", "/api/v1/mail/send"},
+		{"GET", "/api/v1/mail/outbox/abc"},
+		{"GET", "/api/v1/mail/scheduled"},
+		{"DELETE", "/api/v1/mail/scheduled/abc"},
+		{"POST", "/api/v1/keys"},
+		{"DELETE", "/api/v1/keys/abc"},
 	}
 
 	for _, ep := range endpoints {
@@ -288,17 +359,19 @@ func TestServer_Dependencies(t *testing.T) {
 
 func TestVaultEncryptionIntegration(t *testing.T) {
 	// Test that vault encryption works with config key
+	const hexKey = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
 	cfg := &config.Config{
-		EncryptionKey: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		EncryptionKey: vault.MustParseKey(hexKey),
 	}
 
 	plaintext := "test password"
-	encrypted, err := vault.EncryptAESGCM(cfg.EncryptionKey, plaintext)
+	encrypted, err := cfg.EncryptionKey.Encrypt([]byte(plaintext))
 	if err != nil {
 		t.Fatalf("encryption failed: %v", err)
 	}
 
-	decrypted, err := vault.DecryptAESGCM(cfg.EncryptionKey, encrypted)
+	// Values stored before the key was parsed once at startup still decrypt.
+	decrypted, err := vault.DecryptAESGCM(hexKey, encrypted)
 	if err != nil {
 		t.Fatalf("decryption failed: %v", err)
 	}
@@ -307,3 +380,110 @@ func TestVaultEncryptionIntegration(t *testing.T) {
 		t.Errorf("round-trip failed: want %q, got %q", plaintext, decrypted)
 	}
 }
+
+func TestWithRequestID(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if seen == "" || seen == "-" {
+		t.Fatal("expected a generated request ID")
+	}
+	if got := w.Header().Get("X-Request-ID"); got != seen {
+		t.Errorf("X-Request-ID: want %q, got %q", seen, got)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "client-supplied")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if seen != "client-supplied" {
+		t.Errorf("request ID: want %q, got %q", "client-supplied", seen)
+	}
+
+	if got := requestID(context.Background()); got != "-" {
+		t.Errorf("requestID outside middleware: want %q, got %q", "-", got)
+	}
+}
+
+// serveHTTP runs NewHTTPServer for handler on a loopback port.
+func serveHTTP(t *testing.T, handler http.Handler, cfg *config.Config) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := NewHTTPServer(ln.Addr().String(), handler, cfg)
+	go srv.Serve(ln) //nolint:errcheck
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestNewHTTPServer_DropsSlowHeaders(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.HTTPReadTimeoutSeconds = 1
+	addr := serveHTTP(t, NewRouter(mockDB, server.solana, nil, server.cfg), server.cfg)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Start a request and never finish its headers.
+	start := time.Now()
+	if _, err := conn.Write([]byte("GET /api/health HTTP/1.1\r\nHost: localhost\r\nX-Slow: ")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("server kept the slow-header connection open")
+	}
+	if err == nil {
+		t.Fatal("expected the server to close the connection")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("disconnected after %v, want about the 1s read timeout", elapsed)
+	}
+}
+
+func TestWithStreamingDeadline(t *testing.T) {
+	server, _ := setupTestServer(t)
+	server.cfg.HTTPWriteTimeoutSeconds = 1
+
+	// Writes a line every 400ms for 1.6s, longer than the write timeout.
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			time.Sleep(400 * time.Millisecond)
+			fmt.Fprintf(w, "line %d\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plain", slow)
+	mux.HandleFunc("/streaming", server.withStreamingDeadline(slow))
+	addr := serveHTTP(t, mux, server.cfg)
+
+	get := func(path string) (string, error) {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	body, err := get("/streaming")
+	if err != nil || strings.Count(body, "\n") != 4 {
+		t.Errorf("streaming route: want 4 lines, got %q (err %v)", body, err)
+	}
+	if body, err := get("/plain"); err == nil && strings.Count(body, "\n") == 4 {
+		t.Error("route without deadline extension outlived the write timeout")
+	}
+}
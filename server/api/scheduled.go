@@ -0,0 +1,358 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"mulamail/config"
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+// Retry backoff for scheduled deliveries: 1m, 2m, 4m, ... capped at 1h.
+const (
+	scheduledBackoffBase = time.Minute
+	scheduledBackoffMax  = time.Hour
+)
+
+const (
+	// scheduledLease is how long a delivery may stay claimed before its
+	// worker is assumed dead and the message is marked stuck.  A delivery
+	// takes at most a few minutes of SMTP timeouts.
+	scheduledLease = 30 * time.Minute
+
+	// scheduledFinishBy bounds recording the outcome of a delivery, which
+	// outlives the worker's context so that a shutdown mid-send cannot
+	// leave the message claimed.
+	scheduledFinishBy = 10 * time.Second
+)
+
+// errScheduledStuck is the last error of a message marked stuck.
+var errScheduledStuck = errors.New("delivery was interrupted and may or may not have been sent; check the sent folder and cancel or resend it")
+
+// scheduleResponse acknowledges a message accepted for later delivery:
+// scheduled for send_at, or queued in the outbox.
+type scheduleResponse struct {
+	Status     string    `json:"status"` // "scheduled", "queued" or "deferred_greylist"
+	ScheduleID string    `json:"schedule_id,omitempty"`
+	OutboxID   string    `json:"outbox_id,omitempty"`
+	SendAt     time.Time `json:"send_at,omitzero"`
+	Hint       string    `json:"hint,omitempty"`
+}
+
+// scheduleMessage stores req encrypted for delivery at sendAt and answers
+// 202 with the schedule id.
+func (s *Server) scheduleMessage(w http.ResponseWriter, r *http.Request, owner string, req mail.SendRequest, sendAt time.Time) {
+	enc, err := s.encryptSendRequest(req)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	m := &db.ScheduledMessage{
+		OwnerPubKey:  owner,
+		AccountEmail: req.From,
+		PayloadEnc:   enc,
+		SendAt:       sendAt,
+	}
+	if err := s.db.CreateScheduledMessage(r.Context(), m); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, scheduleResponse{
+		Status:     "scheduled",
+		ScheduleID: m.ID.Hex(),
+		SendAt:     m.SendAt,
+	})
+}
+
+// scheduledView is a scheduled message as listed to its owner, with the
+// envelope and subject decrypted for display.
+type scheduledView struct {
+	db.ScheduledMessage
+	To      []string `json:"to,omitempty"`
+	Subject string   `json:"subject,omitempty"`
+}
+
+// GET /api/v1/mail/scheduled?owner=<pubkey>
+func (s *Server) listScheduled(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	msgs, err := s.db.GetScheduledMessagesByOwner(r.Context(), owner)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	views := make([]scheduledView, len(msgs))
+	for i, m := range msgs {
+		views[i].ScheduledMessage = m
+		if req, err := s.decryptScheduled(&m); err == nil {
+			views[i].To = req.Recipients()
+			views[i].Subject = req.Subject
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// DELETE /api/v1/mail/scheduled/{id}?owner=<pubkey>
+//
+// Cancels a scheduled message that has not yet been picked up for delivery,
+// or whose delivery was interrupted (status "stuck").
+func (s *Server) cancelScheduled(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		writeError(w, http.StatusBadRequest, "owner pubkey required")
+		return
+	}
+	err := s.db.CancelScheduledMessage(r.Context(), owner, r.PathValue("id"))
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "no pending or stuck scheduled message with that id")
+		return
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Status: db.ScheduledCancelled})
+}
+
+// encryptSendRequest seals req for storage until delivery.
+func (s *Server) encryptSendRequest(req mail.SendRequest) (string, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("encode message: %w", err)
+	}
+	enc, err := s.cfg.EncryptionKey.EncryptString(string(payload))
+	if err != nil {
+		return "", fmt.Errorf("encrypt message: %w", err)
+	}
+	return enc, nil
+}
+
+func (s *Server) decryptScheduled(m *db.ScheduledMessage) (*mail.SendRequest, error) {
+	return s.decryptSendRequest(m.PayloadEnc)
+}
+
+// decryptSendRequest opens a payload sealed by encryptSendRequest.
+func (s *Server) decryptSendRequest(enc string) (*mail.SendRequest, error) {
+	payload, err := s.cfg.EncryptionKey.DecryptString(enc)
+	if err != nil {
+		return nil, err
+	}
+	var req mail.SendRequest
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// ---------- delivery worker ----------
+
+// Scheduler delivers scheduled messages once they fall due.  Several
+// instances may run side by side: each message is claimed atomically before
+// delivery, so it is sent at most once.  A worker that dies mid-delivery
+// leaves its message in the sending state rather than risk a duplicate.
+type Scheduler struct {
+	srv         *Server
+	leader      *leader
+	worker      string
+	interval    time.Duration
+	maxAttempts int
+	now         func() time.Time
+}
+
+// NewScheduler creates a delivery worker backed by database.
+func NewScheduler(database db.DB, cfg *config.Config) *Scheduler {
+	return &Scheduler{
+		srv:         &Server{db: database, cfg: cfg},
+		leader:      newLeader(database, roleScheduler, cfg),
+		worker:      workerName(),
+		interval:    time.Duration(cfg.SchedulerIntervalSeconds) * time.Second,
+		maxAttempts: cfg.ScheduledMaxAttempts,
+		now:         time.Now,
+	}
+}
+
+// workerName identifies this process in job claims.
+func workerName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Run polls for due messages until ctx is cancelled.  Only the instance
+// leading the scheduler role delivers.
+func (sc *Scheduler) Run(ctx context.Context) {
+	sc.leader.elect(ctx)
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+	for {
+		sc.processDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processDue marks stale claims stuck, then delivers every message that is
+// currently due.
+func (sc *Scheduler) processDue(ctx context.Context) {
+	if sc.leader.leads() {
+		n, err := sc.srv.db.MarkStuckScheduledMessages(ctx, sc.now().Add(-scheduledLease), errScheduledStuck.Error())
+		if err != nil {
+			log.Printf("scheduler: mark stuck messages: %v", err)
+		}
+		if n > 0 {
+			log.Printf("scheduler: %d messages claimed for over %v marked stuck", n, scheduledLease)
+		}
+	}
+	for ctx.Err() == nil && sc.leader.leads() && !sc.srv.paused(ctx) {
+		m, err := sc.srv.db.ClaimDueScheduledMessage(ctx, sc.now(), sc.worker)
+		if errors.Is(err, db.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("scheduler: claim: %v", err)
+			return
+		}
+		sc.deliver(ctx, m)
+	}
+}
+
+// deliver makes one delivery attempt for a claimed message and records the
+// outcome: sent, rescheduled with backoff, or failed.  An attempt that
+// found the account busy reached no SMTP server and does not count against
+// maxAttempts.
+func (sc *Scheduler) deliver(ctx context.Context, m *db.ScheduledMessage) {
+	res, err := sc.send(ctx, m)
+	if !errors.Is(err, errAccountBusy) {
+		m.Attempts++
+	}
+	switch {
+	case err == nil:
+		m.Status = db.ScheduledSent
+		m.LastError = ""
+		m.MessageID, m.SMTPResponse, m.QueueID = res.MessageID, res.Response, res.QueueID
+	case permanentSendFailure(err) || m.Attempts >= sc.maxAttempts:
+		m.Status = db.ScheduledFailed
+		m.LastError = publicError(err)
+	default:
+		m.Status = db.ScheduledPending
+		m.LastError = publicError(err)
+		m.NextAttemptAt = sc.now().Add(scheduledBackoff(m.Attempts))
+	}
+	if err != nil {
+		log.Printf("scheduler: message %s attempt %d: %v", m.ID.Hex(), m.Attempts, err)
+	}
+
+	finishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), scheduledFinishBy)
+	defer cancel()
+	if err := sc.srv.db.FinishScheduledAttempt(finishCtx, m); err != nil {
+		log.Printf("scheduler: record outcome of %s: %v", m.ID.Hex(), err)
+	}
+}
+
+// send decrypts the stored request and hands it to the account's SMTP
+// server, recording it in the sent-mail history on success.
+func (sc *Scheduler) send(ctx context.Context, m *db.ScheduledMessage) (*mail.SendResult, error) {
+	req, err := sc.srv.decryptScheduled(m)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("decrypt message: %w", err))
+	}
+	acc, err := sc.srv.db.GetMailAccount(ctx, m.OwnerPubKey, m.AccountEmail)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, permanent(fmt.Errorf("account not found: %w", err))
+	}
+	if err != nil {
+		return nil, transient(fmt.Errorf("load account: %w", err))
+	}
+	if err := sc.srv.checkRecipientDomains(ctx, m.OwnerPubKey, req); err != nil {
+		return nil, err
+	}
+
+	release, err := sc.srv.acquireSMTPSession(ctx, acc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errAccountBusy, err)
+	}
+	res, err := sc.srv.deliverSMTP(ctx, acc, *req)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	sc.srv.recordDelivered(ctx, "scheduler", m.OwnerPubKey, req, res)
+	return res, nil
+}
+
+// recordDelivered adds a message delivered in the background to the owner's
+// sent-mail history and contacts.  Failures are only logged, under the
+// worker's name: the message is already out.
+func (s *Server) recordDelivered(ctx context.Context, worker, owner string, req *mail.SendRequest, res *mail.SendResult) {
+	if err := s.db.CreateSentMessage(ctx, &db.SentMessage{
+		OwnerPubKey:  owner,
+		AccountEmail: req.From,
+		EnvelopeFrom: req.EnvelopeSender(),
+		To:           mail.Emails(req.To),
+		Cc:           mail.Emails(req.Cc),
+		Bcc:          mail.Emails(req.Bcc),
+		Subject:      req.Subject,
+		MessageID:    res.MessageID,
+		SMTPResponse: res.Response,
+		QueueID:      res.QueueID,
+	}); err != nil {
+		log.Printf("%s: record sent message %s: %v", worker, res.MessageID, err)
+	}
+	s.recordContacts(ctx, owner, slices.Concat(req.To, req.Cc, req.Bcc), true, time.Now())
+}
+
+// permanentError marks a failure that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error { return &permanentError{err} }
+
+// transientError marks a failure before the SMTP exchange that a later
+// attempt may not meet, such as a database error.
+type transientError struct{ err error }
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+func transient(err error) error { return &transientError{err} }
+
+// permanentSendFailure reports whether err should end delivery attempts:
+// a problem with the stored message or account, a permanent SMTP failure,
+// or a failure after which the server may already have the message.  An
+// attempt that never got an SMTP session (errAccountBusy) sent nothing and
+// is always retried, as is one that failed before SMTP on a transient error.
+func permanentSendFailure(err error) bool {
+	var temp *transientError
+	if errors.Is(err, errAccountBusy) || errors.As(err, &temp) {
+		return false
+	}
+	var perm *permanentError
+	return errors.As(err, &perm) || !mail.Retryable(err)
+}
+
+// scheduledBackoff returns the delay before the next attempt once attempts
+// deliveries have failed.
+func scheduledBackoff(attempts int) time.Duration {
+	d := scheduledBackoffBase
+	for i := 1; i < attempts && d < scheduledBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, scheduledBackoffMax)
+}
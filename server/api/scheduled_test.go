@@ -0,0 +1,318 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mulamail/db"
+)
+
+func scheduleSend(t *testing.T, server *Server, sendAt string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{
+		"owner_pubkey": "owner", "account_email": "me@example.com",
+		"to": []string{"you@example.org"}, "subject": "later", "body": "b",
+		"send_at": sendAt,
+	})
+	req := httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	server.sendMail(w, req)
+	return w
+}
+
+func TestSendMail_Scheduled(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	w := scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339))
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	var resp map[string]any
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["schedule_id"] == "" || resp["status"] != "scheduled" {
+		t.Errorf("unexpected response %v", resp)
+	}
+
+	if len(mockDB.Scheduled) != 1 {
+		t.Fatalf("expected 1 scheduled message, got %d", len(mockDB.Scheduled))
+	}
+	if strings.Contains(mockDB.Scheduled[0].PayloadEnc, "later") {
+		t.Error("scheduled payload must be stored encrypted")
+	}
+	if cmds := fake.received(); len(cmds) != 0 {
+		t.Errorf("no SMTP traffic expected before send_at, got %q", cmds)
+	}
+}
+
+func TestSendMail_ScheduledInvalidSendAt(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", "127.0.0.1", 1)
+
+	for _, sendAt := range []string{"tomorrow 9am", time.Now().Add(-time.Minute).Format(time.RFC3339)} {
+		if w := scheduleSend(t, server, sendAt); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status code: want %d, got %d", sendAt, http.StatusBadRequest, w.Code)
+		}
+	}
+	if len(mockDB.Scheduled) != 0 {
+		t.Errorf("expected nothing scheduled, got %d", len(mockDB.Scheduled))
+	}
+}
+
+func TestListAndCancelScheduled(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", "127.0.0.1", 1)
+
+	if w := scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339)); w.Code != http.StatusAccepted {
+		t.Fatalf("schedule: status %d: %s", w.Code, w.Body.String())
+	}
+	id := mockDB.Scheduled[0].ID.Hex()
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/scheduled?owner=owner", nil)
+	w := httptest.NewRecorder()
+	server.listScheduled(w, req)
+
+	var list []map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	if len(list) != 1 || list[0]["subject"] != "later" || list[0]["status"] != db.ScheduledPending {
+		t.Errorf("unexpected list %v", list)
+	}
+	if _, ok := list[0]["payload_enc"]; ok {
+		t.Error("encrypted payload must not be listed")
+	}
+
+	router := NewRouter(mockDB, nil, nil, server.cfg)
+	cancel := func(owner string) int {
+		req := httptest.NewRequest("DELETE", "/api/v1/mail/scheduled/"+id+"?owner="+owner, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := cancel("someone-else"); code != http.StatusNotFound {
+		t.Errorf("cancel by other owner: want %d, got %d", http.StatusNotFound, code)
+	}
+	if code := cancel("owner"); code != http.StatusOK {
+		t.Errorf("cancel: want %d, got %d", http.StatusOK, code)
+	}
+	if code := cancel("owner"); code != http.StatusNotFound {
+		t.Errorf("second cancel: want %d, got %d", http.StatusNotFound, code)
+	}
+	if mockDB.Scheduled[0].Status != db.ScheduledCancelled {
+		t.Errorf("status: want %q, got %q", db.ScheduledCancelled, mockDB.Scheduled[0].Status)
+	}
+}
+
+func newTestScheduler(server *Server, now time.Time) *Scheduler {
+	return &Scheduler{srv: server, worker: "test", maxAttempts: 3, now: func() time.Time { return now }}
+}
+
+func TestScheduler_DeliversDueMessages(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339))
+	scheduleSend(t, server, time.Now().Add(3*time.Hour).Format(time.RFC3339))
+
+	newTestScheduler(server, time.Now().Add(2*time.Hour)).processDue(context.Background())
+
+	due, later := mockDB.Scheduled[0], mockDB.Scheduled[1]
+	if due.Status != db.ScheduledSent || due.Attempts != 1 || due.QueueID != "ABC123" {
+		t.Errorf("due message: unexpected state %+v", due)
+	}
+	if later.Status != db.ScheduledPending {
+		t.Errorf("message not yet due: want %q, got %q", db.ScheduledPending, later.Status)
+	}
+	if n := len(fake.sent()); n != 1 {
+		t.Errorf("expected exactly 1 delivery, got %d", n)
+	}
+	if len(mockDB.Sent) != 1 || mockDB.Sent[0].Subject != "later" {
+		t.Errorf("expected delivery recorded in sent history, got %+v", mockDB.Sent)
+	}
+}
+
+func TestScheduler_RetriesTransientFailures(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{dataDone: "451 4.3.0 try again later"}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339))
+	m := mockDB.Scheduled[0]
+
+	now := time.Now().Add(2 * time.Hour)
+	sc := newTestScheduler(server, now)
+	sc.processDue(context.Background())
+
+	if m.Status != db.ScheduledPending || m.Attempts != 1 {
+		t.Fatalf("after transient failure: want pending/1 attempt, got %s/%d", m.Status, m.Attempts)
+	}
+	if !m.NextAttemptAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("next attempt: want %v, got %v", now.Add(time.Minute), m.NextAttemptAt)
+	}
+	if !strings.Contains(m.LastError, "451") {
+		t.Errorf("last error should carry the SMTP reply, got %q", m.LastError)
+	}
+
+	// Not due again until the backoff elapses.
+	sc.processDue(context.Background())
+	if m.Attempts != 1 {
+		t.Fatalf("retried before backoff elapsed: %d attempts", m.Attempts)
+	}
+
+	for i := 0; i < 5; i++ {
+		sc.now = func() time.Time { return m.NextAttemptAt }
+		sc.processDue(context.Background())
+	}
+	if m.Status != db.ScheduledFailed || m.Attempts != 3 {
+		t.Errorf("after exhausting attempts: want failed/3, got %s/%d", m.Status, m.Attempts)
+	}
+}
+
+func TestScheduler_PermanentFailure(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{dataDone: "554 5.7.1 message rejected"}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339))
+
+	newTestScheduler(server, time.Now().Add(2*time.Hour)).processDue(context.Background())
+
+	if m := mockDB.Scheduled[0]; m.Status != db.ScheduledFailed || m.Attempts != 1 {
+		t.Errorf("want failed after 1 attempt, got %s/%d", m.Status, m.Attempts)
+	}
+}
+
+func TestScheduler_BusyAccountUsesNoAttempts(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339))
+	m := mockDB.Scheduled[0]
+	release, _ := server.acquireSMTPSession(context.Background(), mockDB.Accounts["owner"][0])
+	defer release()
+	// The outcome is recorded although the worker's context has ended.
+	mockDB.FailWith("FinishScheduledAttempt", func(ctx context.Context, _ ...any) error { return ctx.Err() })
+
+	sc := newTestScheduler(server, time.Now().Add(2*time.Hour))
+	for range sc.maxAttempts + 2 {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		sc.processDue(ctx)
+		cancel()
+		if m.Status != db.ScheduledPending {
+			t.Fatalf("busy account: want %q, got %q %q", db.ScheduledPending, m.Status, m.LastError)
+		}
+		sc.now = func() time.Time { return m.NextAttemptAt }
+	}
+	if m.Attempts != 0 || len(fake.sent()) != 0 {
+		t.Errorf("busy attempts must not count: %d attempts, %d sent", m.Attempts, len(fake.sent()))
+	}
+}
+
+func TestScheduler_RetriesAccountLookupErrors(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339))
+	m := mockDB.Scheduled[0]
+
+	mockDB.FailOnce("GetMailAccount", errors.New("mongo: connection reset"))
+	sc := newTestScheduler(server, time.Now().Add(2*time.Hour))
+	sc.processDue(context.Background())
+	if m.Status != db.ScheduledPending || m.Attempts != 1 {
+		t.Fatalf("after a database error: want pending/1 attempt, got %s/%d %q", m.Status, m.Attempts, m.LastError)
+	}
+
+	sc.now = func() time.Time { return m.NextAttemptAt }
+	sc.processDue(context.Background())
+	if m.Status != db.ScheduledSent || len(fake.sent()) != 1 {
+		t.Errorf("retry: want sent, got %s/%d %q", m.Status, m.Attempts, m.LastError)
+	}
+
+	// A deleted account cannot come back.
+	scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339))
+	gone := mockDB.Scheduled[1]
+	mockDB.Accounts["owner"] = nil
+	sc.now = func() time.Time { return gone.NextAttemptAt }
+	sc.processDue(context.Background())
+	if gone.Status != db.ScheduledFailed {
+		t.Errorf("deleted account: want %q, got %q", db.ScheduledFailed, gone.Status)
+	}
+}
+
+func TestScheduler_MarksStaleClaimsStuck(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339))
+	scheduleSend(t, server, time.Now().Add(time.Hour).Format(time.RFC3339))
+	now := time.Now().Add(2 * time.Hour)
+
+	// A worker died mid-delivery of the first message, long ago; another is
+	// delivering the second right now.
+	dead, live := mockDB.Scheduled[0], mockDB.Scheduled[1]
+	dead.Status, dead.ClaimedBy, dead.UpdatedAt = db.ScheduledSending, "gone", now.Add(-scheduledLease-time.Minute)
+	live.Status, live.ClaimedBy, live.UpdatedAt = db.ScheduledSending, "other", now.Add(-time.Minute)
+
+	newTestScheduler(server, now).processDue(context.Background())
+	if dead.Status != db.ScheduledStuck || dead.LastError == "" {
+		t.Errorf("stale claim: want %q with an explanation, got %q %q", db.ScheduledStuck, dead.Status, dead.LastError)
+	}
+	if live.Status != db.ScheduledSending {
+		t.Errorf("fresh claim: want %q, got %q", db.ScheduledSending, live.Status)
+	}
+	if len(fake.sent()) != 0 {
+		t.Error("a stuck message must not be delivered again")
+	}
+
+	router := NewRouter(mockDB, nil, nil, server.cfg)
+	for id, want := range map[string]int{dead.ID.Hex(): http.StatusOK, live.ID.Hex(): http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/mail/scheduled/"+id+"?owner=owner", nil))
+		if w.Code != want {
+			t.Errorf("cancel %s: want %d, got %d", id, want, w.Code)
+		}
+	}
+	if dead.Status != db.ScheduledCancelled {
+		t.Errorf("stuck message: want %q after cancel, got %q", db.ScheduledCancelled, dead.Status)
+	}
+}
+
+func TestScheduledBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{20, time.Hour},
+	}
+	for _, tc := range tests {
+		if got := scheduledBackoff(tc.attempts); got != tc.want {
+			t.Errorf("scheduledBackoff(%d): want %v, got %v", tc.attempts, tc.want, got)
+		}
+	}
+}
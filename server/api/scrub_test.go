@@ -0,0 +1,69 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"mulamail/vault"
+)
+
+func TestScrubStorageEndpoint(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+
+	post := func(router http.Handler, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/admin/scrub-storage", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(NewRouter(mockDB, server.solana, nil, server.cfg), `{}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without storage: want 503, got %d", w.Code)
+	}
+
+	dir := t.TempDir()
+	local, _ := vault.NewLocalStorage(dir)
+	storage := encryptStorage(t, server, local)
+	router := NewRouter(mockDB, server.solana, storage, server.cfg)
+	if w := post(router, `not json`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid body: want 400, got %d", w.Code)
+	}
+
+	ctx := context.Background()
+	for _, key := range []string{"messages/ok", "messages/rotten", "messages/old", "exports/ok"} {
+		storage.Put(ctx, key, []byte("body of "+key))
+	}
+	rotten := filepath.Join(dir, "messages", "rotten")
+	data, _ := os.ReadFile(rotten)
+	os.WriteFile(rotten, data[:len(data)-3], 0600) // a partial write
+	os.Remove(filepath.Join(dir, "messages", "old.meta"))
+
+	w := post(router, `{"prefix":"messages/"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("scrub: status %d: %s", w.Code, w.Body.String())
+	}
+	var res ScrubReport
+	json.NewDecoder(w.Body).Decode(&res)
+	if res.Prefix != "messages/" || res.Scanned != 3 || res.Verified != 1 || res.Unverified != 1 ||
+		!slices.Equal(res.Corrupted, []string{"messages/rotten"}) || len(res.Failed) != 0 {
+		t.Errorf("unexpected report %+v", res)
+	}
+
+	w = post(router, `{}`)
+	json.NewDecoder(w.Body).Decode(&res)
+	if res.Scanned != 4 || res.Verified != 2 {
+		t.Errorf("whole vault: unexpected report %+v", res)
+	}
+	if n := len(mockDB.Audit); n != 2 || mockDB.Audit[n-1].Action != "vault.scrub.completed" || mockDB.Audit[n-1].Detail["corrupted"] != 1 {
+		t.Errorf("audit events: %+v", mockDB.Audit)
+	}
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"log"
+	netmail "net/mail"
+
+	"mulamail/db"
+	"mulamail/mail"
+)
+
+// senderIdentity is the MulaMail identity the sender of a preview resolves
+// to, so that clients can mark mail from on-chain identities.
+type senderIdentity struct {
+	PubKey   string `json:"pubkey"`
+	Verified bool   `json:"verified"`
+}
+
+// resolveSenders maps each From header in froms to the identity its
+// address resolves to by canonical form, or nil when the header does not
+// parse or the address has no live identity.  Identities are served from
+// the identity cache where possible; the remaining addresses are looked up
+// with a single query and cached.  A failed lookup is logged and leaves
+// those senders unresolved rather than failing the listing.
+func (s *Server) resolveSenders(ctx context.Context, froms []string) map[string]*senderIdentity {
+	rules := s.canonicalRules()
+	resolved := make(map[string]*senderIdentity, len(froms))
+	addrs := make(map[string][]string) // address -> From headers naming it
+	var missing []string
+	for _, from := range froms {
+		if _, done := resolved[from]; done {
+			continue
+		}
+		resolved[from] = nil
+		addr, err := netmail.ParseAddress(from)
+		if err != nil {
+			continue
+		}
+		if id, ok := s.identities.get(emailCacheKey(rules.Canonical(addr.Address))); ok {
+			resolved[from] = liveSender(id)
+			continue
+		}
+		if _, pending := addrs[addr.Address]; !pending {
+			missing = append(missing, addr.Address)
+		}
+		addrs[addr.Address] = append(addrs[addr.Address], from)
+	}
+	if len(missing) == 0 {
+		return resolved
+	}
+
+	found, err := s.db.GetIdentitiesByCanonicalEmails(ctx, canonicalEmails(rules, missing), missing)
+	if err != nil {
+		log.Printf("[%s] inbox: resolve senders: %v", requestID(ctx), err)
+		return resolved
+	}
+	for i := range found {
+		s.identities.put(&found[i], false)
+	}
+	ix := indexIdentities(rules, found)
+	for _, addr := range missing {
+		if id := ix.find(addr); id != nil {
+			for _, from := range addrs[addr] {
+				resolved[from] = liveSender(id)
+			}
+		}
+	}
+	return resolved
+}
+
+// liveSender returns the sender identity for id, or nil once it is revoked.
+func liveSender(id *db.Identity) *senderIdentity {
+	if !id.RevokedAt.IsZero() {
+		return nil
+	}
+	return &senderIdentity{PubKey: id.PubKey, Verified: id.Verified}
+}
+
+// inboxMessage is an inbox preview annotated with its sender's identity.
+type inboxMessage struct {
+	*mail.Message
+	SenderIdentity *senderIdentity `json:"sender_identity"`
+}
+
+// withSenders annotates msgs with their senders' identities.
+func (s *Server) withSenders(ctx context.Context, msgs []*mail.Message) []inboxMessage {
+	froms := make([]string, len(msgs))
+	for i, m := range msgs {
+		froms[i] = m.From
+	}
+	senders := s.resolveSenders(ctx, froms)
+	out := make([]inboxMessage, len(msgs))
+	for i, m := range msgs {
+		out[i] = inboxMessage{Message: m, SenderIdentity: senders[m.From]}
+	}
+	return out
+}
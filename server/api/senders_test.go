@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+)
+
+// setupSenders serves a mailbox whose messages come from a verified
+// identity (twice, once with a display name), a revoked one, an unknown
+// address and a malformed From header.
+func setupSenders(t *testing.T) (*Server, *dbtest.Mock) {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+	mockDB.CreateIdentity(ctx, &db.Identity{Email: "alice@example.com", CanonicalEmail: "alice@example.com", PubKey: "alice-pubkey", Verified: true})
+	mockDB.CreateIdentity(ctx, &db.Identity{Email: "gone@example.com", CanonicalEmail: "gone@example.com", PubKey: "gone-pubkey", Verified: true, RevokedAt: time.Now()})
+
+	fake := &fakePOP3{messages: map[int]string{
+		1: "From: Alice <alice@example.com>\r\nSubject: one\r\n",
+		2: "From: alice@example.com\r\nSubject: two\r\n",
+		3: "From: gone@example.com\r\nSubject: three\r\n",
+		4: "From: bob@example.com\r\nSubject: four\r\n",
+		5: "From: not an address\r\nSubject: five\r\n",
+	}}
+	host, port := fake.start(t)
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", host, port)
+	return server, mockDB
+}
+
+func TestFetchInbox_SenderIdentity(t *testing.T) {
+	server, mockDB := setupSenders(t)
+
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp struct {
+		Messages []struct {
+			ID             int             `json:"id"`
+			SenderIdentity *senderIdentity `json:"sender_identity"`
+		} `json:"messages"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Messages) != 5 {
+		t.Fatalf("want 5 messages, got %+v", resp.Messages)
+	}
+	for _, m := range resp.Messages {
+		got := m.SenderIdentity
+		if m.ID <= 2 {
+			if got == nil || *got != (senderIdentity{PubKey: "alice-pubkey", Verified: true}) {
+				t.Errorf("message %d: want alice's identity, got %+v", m.ID, got)
+			}
+		} else if got != nil {
+			t.Errorf("message %d: want no identity, got %+v", m.ID, got)
+		}
+	}
+	if mockDB.IdentityQueries != 1 {
+		t.Errorf("want one batch lookup, got %d", mockDB.IdentityQueries)
+	}
+}
+
+func TestFetchInbox_SenderIdentityCached(t *testing.T) {
+	server, mockDB := setupSenders(t)
+	server.identities = newIdentityCache(10, time.Minute)
+	fetch := func() {
+		w := httptest.NewRecorder()
+		server.fetchInbox(w, httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com", nil))
+	}
+
+	fetch()
+	if got := server.identities.stats().Entries; got != 2 {
+		t.Errorf("want alice and gone cached by email, got %d entries", got)
+	}
+	// Only bob, who has no identity, is looked up again.
+	fetch()
+	if mockDB.IdentityQueries != 2 {
+		t.Errorf("want one lookup per response, got %d", mockDB.IdentityQueries)
+	}
+	if hits := server.identities.stats().Hits; hits != 3 {
+		t.Errorf("want 3 cache hits on the second fetch, got %d", hits)
+	}
+}
+
+func TestFetchInbox_StreamSenderIdentities(t *testing.T) {
+	server, mockDB := setupSenders(t)
+
+	req := httptest.NewRequest("GET", "/api/v1/mail/inbox?owner=owner&account=me@example.com&stream=true", nil)
+	w := httptest.NewRecorder()
+	server.fetchInbox(w, req)
+
+	lines := decodeNDJSON(t, w.Body.String())
+	done := lines[len(lines)-1]
+	senders, _ := done["sender_identities"].(map[string]any)
+	alice, _ := senders["Alice <alice@example.com>"].(map[string]any)
+	if alice["pubkey"] != "alice-pubkey" || alice["verified"] != true {
+		t.Errorf("alice: unexpected %v", senders)
+	}
+	if v, ok := senders["not an address"]; !ok || v != nil {
+		t.Errorf("malformed From: want null, got %v", v)
+	}
+	if mockDB.IdentityQueries != 1 {
+		t.Errorf("want one batch lookup, got %d", mockDB.IdentityQueries)
+	}
+}
+
+func TestInboxDelta_SenderIdentity(t *testing.T) {
+	server, mockDB := setupSenders(t)
+
+	// The first sync fetches live; the second serves the same previews
+	// from the cache.
+	for _, pass := range []string{"live", "cached"} {
+		_, resp := postInboxDelta(t, server, map[string]any{})
+		if len(resp.Added) != 5 {
+			t.Fatalf("%s: want 5 previews, got %+v", pass, resp.Added)
+		}
+		for _, m := range resp.Added {
+			if (m.SenderIdentity != nil) != (m.ID <= 2) {
+				t.Errorf("%s: message %d: unexpected sender identity %+v", pass, m.ID, m.SenderIdentity)
+			}
+		}
+	}
+	if mockDB.IdentityQueries != 2 {
+		t.Errorf("want one batch lookup per response, got %d", mockDB.IdentityQueries)
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/vault"
+)
+
+// Codes of the sends the guard refuses, reported in the "code" of the
+// reply and the "reason" of the audit event.
+const (
+	refusedSenderDomain      = "sender_domain_mismatch"
+	refusedRecipientDomain   = "recipient_domain_not_allowed"
+	refusedUnknownRecipients = "unknown_recipients"
+	refusedDailySends        = "daily_send_cap"
+)
+
+// sendRefusal is the reply to a send the guard refuses.
+type sendRefusal struct {
+	Error    string   `json:"error"`
+	Code     string   `json:"code"`
+	Limit    int      `json:"limit,omitempty"`
+	Rejected []string `json:"rejected,omitempty"` // recipients outside the allowed domains
+}
+
+// guardSend keeps an account from being used as an open relay, which
+// would get the server's outbound IP blocklisted for every user.  It
+// refuses a send whose From or envelope sender is outside the account's
+// domain (403), one with any recipient the owner's recipient domain policy
+// refuses, so that nothing is sent to the others either (403), one
+// addressing more than MaxUnknownRecipients addresses the owner has no
+// contact history with, unless the owner is trusted (403), and one past
+// the account's daily send cap (429 with Retry-After).  Each
+// refusal is audited.  A send that passes is counted against the cap, even
+// if its delivery later fails.  guardSend reports whether the send may go
+// ahead, having written the reply when it may not.
+func (s *Server) guardSend(w http.ResponseWriter, r *http.Request, acc *db.MailAccount, req mail.SendRequest, limits db.SendLimits) bool {
+	domain := addressDomain(acc.AccountEmail)
+	for _, addr := range []string{req.From, req.EnvelopeSender()} {
+		if addressDomain(addr) != domain {
+			s.refuseSend(w, r, acc, http.StatusForbidden, sendRefusal{
+				Error: "sender address must be in the account's domain " + domain,
+				Code:  refusedSenderDomain,
+			}, nil)
+			return false
+		}
+	}
+
+	if rejected := recipientPolicy(limits).Rejected(req.Recipients()); len(rejected) > 0 {
+		s.refuseSend(w, r, acc, http.StatusForbidden, sendRefusal{
+			Error:    "recipient domains not allowed: " + strings.Join(rejected, ", "),
+			Code:     refusedRecipientDomain,
+			Rejected: rejected,
+		}, map[string]any{"rejected_recipients": len(rejected)})
+		return false
+	}
+
+	if maxUnknown := s.cfg.MaxUnknownRecipients; maxUnknown > 0 && !limits.Trusted {
+		unknown, err := s.unknownRecipients(r.Context(), acc.OwnerPubKey, req.Recipients())
+		if err != nil {
+			writeFailure(w, r, http.StatusInternalServerError, "contact history unavailable", err)
+			return false
+		}
+		if unknown > maxUnknown {
+			s.refuseSend(w, r, acc, http.StatusForbidden, sendRefusal{
+				Error: strconv.Itoa(unknown) + " recipients have no contact history with this account",
+				Code:  refusedUnknownRecipients,
+				Limit: maxUnknown,
+			}, map[string]any{"unknown_recipients": unknown})
+			return false
+		}
+	}
+
+	if limits.MaxDailySends > 0 {
+		now := time.Now().UTC()
+		counted, err := s.db.CountDailySend(r.Context(), acc.OwnerPubKey, acc.AccountEmail, now.Format(time.DateOnly), limits.MaxDailySends)
+		if err != nil {
+			writeFailure(w, r, http.StatusInternalServerError, "send limits unavailable", err)
+			return false
+		}
+		if !counted {
+			midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+			w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+			s.refuseSend(w, r, acc, http.StatusTooManyRequests, sendRefusal{
+				Error: "daily send limit reached for this account",
+				Code:  refusedDailySends,
+				Limit: limits.MaxDailySends,
+			}, nil)
+			return false
+		}
+	}
+	return true
+}
+
+// recipientPolicy returns the recipient domain policy of limits.
+func recipientPolicy(limits db.SendLimits) mail.RecipientPolicy {
+	return mail.RecipientPolicy{Allowed: limits.AllowedDomains, Blocked: limits.BlockedDomains}
+}
+
+// recipientDomainError is a queued or scheduled message the owner's
+// recipient domain policy refuses by the time it is delivered.
+type recipientDomainError struct {
+	rejected []string
+}
+
+func (e *recipientDomainError) Error() string {
+	return "recipient domains not allowed: " + strings.Join(e.rejected, ", ")
+}
+
+// checkRecipientDomains applies the owner's recipient domain policy to a
+// message delivered in the background, which may have been accepted under
+// an earlier policy.  A refused message fails for good, all recipients
+// alike.
+func (s *Server) checkRecipientDomains(ctx context.Context, owner string, req *mail.SendRequest) error {
+	limits, _, err := s.sendLimits(ctx, owner)
+	if err != nil {
+		return fmt.Errorf("send limits: %w", err)
+	}
+	if rejected := recipientPolicy(limits).Rejected(req.Recipients()); len(rejected) > 0 {
+		return permanent(&recipientDomainError{rejected})
+	}
+	return nil
+}
+
+// refuseSend writes the refusal and audits it against the account.
+func (s *Server) refuseSend(w http.ResponseWriter, r *http.Request, acc *db.MailAccount, code int, refusal sendRefusal, detail map[string]any) {
+	if detail == nil {
+		detail = make(map[string]any)
+	}
+	detail["reason"] = refusal.Code
+	s.audit(r.Context(), acc.OwnerPubKey, "mail.send.refused", acc.AccountEmail, detail)
+	writeJSON(w, code, refusal)
+}
+
+// unknownRecipients counts the distinct addresses among recipients that
+// are not among the owner's contacts, which hold everyone the owner has
+// sent mail to or received it from.
+func (s *Server) unknownRecipients(ctx context.Context, owner string, recipients []string) (int, error) {
+	fc, err := vault.NewFieldCipher(s.cfg.EncryptionKey)
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool, len(recipients))
+	var indexes []string
+	for _, addr := range recipients {
+		idx := fc.BlindIndex(addr)
+		if !seen[idx] {
+			seen[idx] = true
+			indexes = append(indexes, idx)
+		}
+	}
+	known, err := s.db.GetContactsByIndexes(ctx, owner, indexes)
+	if err != nil {
+		return 0, err
+	}
+	return len(indexes) - len(known), nil
+}
+
+// addressDomain returns the lower-cased domain of an email address.
+func addressDomain(addr string) string {
+	return strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+}
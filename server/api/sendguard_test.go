@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+	"mulamail/mail"
+)
+
+// sendTo sends a message from me@example.com to the recipients, with the
+// extra request fields set.
+func sendTo(t *testing.T, server *Server, to []string, extra map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	payload := map[string]any{
+		"owner_pubkey": "owner", "account_email": "me@example.com",
+		"to": to, "subject": "s", "body": "b",
+	}
+	for k, v := range extra {
+		payload[k] = v
+	}
+	body, _ := json.Marshal(payload)
+	w := httptest.NewRecorder()
+	server.sendMail(w, httptest.NewRequest("POST", "/api/v1/mail/send", bytes.NewBuffer(body)))
+	return w
+}
+
+// wantRefusal checks that w refuses a send with status and code, and that
+// the refusal was audited.
+func wantRefusal(t *testing.T, mockDB *dbtest.Mock, w *httptest.ResponseRecorder, status int, code string) sendRefusal {
+	t.Helper()
+	var refusal sendRefusal
+	json.Unmarshal(w.Body.Bytes(), &refusal)
+	if w.Code != status || refusal.Code != code {
+		t.Fatalf("want %d %s, got %d: %s", status, code, w.Code, w.Body.String())
+	}
+	last := mockDB.Audit[len(mockDB.Audit)-1]
+	if last.Action != "mail.send.refused" || last.Target != "me@example.com" || last.Detail["reason"] != code {
+		t.Errorf("want the refusal audited, got %+v", last)
+	}
+	return refusal
+}
+
+func TestSendMail_SenderDomainMismatch(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	w := sendTo(t, server, []string{"you@example.org"}, map[string]any{"envelope_from": "bounces@example.net"})
+	wantRefusal(t, mockDB, w, http.StatusForbidden, refusedSenderDomain)
+
+	mockDB.Accounts["owner"][0].DefaultEnvelopeFrom = "bounces@mailer.example.com"
+	w = sendTo(t, server, []string{"you@example.org"}, nil)
+	wantRefusal(t, mockDB, w, http.StatusForbidden, refusedSenderDomain)
+	if n := fake.sessionCount(); n != 0 {
+		t.Errorf("a refused send must not reach the SMTP server: %d sessions", n)
+	}
+
+	if w := sendTo(t, server, []string{"you@example.org"}, map[string]any{"envelope_from": "Bounces@EXAMPLE.com"}); w.Code != http.StatusOK {
+		t.Errorf("same domain in another case: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestSendMail_UnknownRecipients(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.MaxUnknownRecipients = 2
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	server.recordContacts(context.Background(), "owner", []mail.Address{{Email: "friend@example.org"}}, false, time.Now())
+
+	w := sendTo(t, server, []string{"friend@example.org", "a@example.net", "b@example.net", "c@example.net"}, nil)
+	refusal := wantRefusal(t, mockDB, w, http.StatusForbidden, refusedUnknownRecipients)
+	if refusal.Limit != 2 || mockDB.Audit[len(mockDB.Audit)-1].Detail["unknown_recipients"] != 3 {
+		t.Errorf("want 3 unknown recipients over a limit of 2, got %+v", refusal)
+	}
+	if n := fake.sessionCount(); n != 0 {
+		t.Errorf("a refused send must not reach the SMTP server: %d sessions", n)
+	}
+
+	// An address counts once however it is written, and known ones not at all.
+	if w := sendTo(t, server, []string{"Friend@example.org", "a@example.net", "A@example.net", "b@example.net"}, nil); w.Code != http.StatusOK {
+		t.Fatalf("two unknown recipients: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	// Recipients of a sent message become contacts.
+	if w := sendTo(t, server, []string{"a@example.net", "b@example.net", "c@example.net"}, nil); w.Code != http.StatusOK {
+		t.Errorf("recipients of an earlier send: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	mockDB.SetSendLimits(context.Background(), &db.SendLimits{OwnerPubKey: "owner", Trusted: true})
+	if w := sendTo(t, server, []string{"d@example.net", "e@example.net", "f@example.net"}, nil); w.Code != http.StatusOK {
+		t.Errorf("trusted owner: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestSendMail_DailySendCap(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.MaxDailySends = 2
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	for i := range 2 {
+		if w := sendSimple(t, server); w.Code != http.StatusOK {
+			t.Fatalf("send %d: want %d, got %d: %s", i+1, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	w := sendSimple(t, server)
+	if refusal := wantRefusal(t, mockDB, w, http.StatusTooManyRequests, refusedDailySends); refusal.Limit != 2 {
+		t.Errorf("limit: want 2, got %d", refusal.Limit)
+	}
+	if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || secs < 1 || secs > 86400+1 {
+		t.Errorf("Retry-After: want the seconds until the next UTC day, got %q", w.Header().Get("Retry-After"))
+	}
+	if n := fake.sessionCount(); n != 2 {
+		t.Errorf("want only the counted sends delivered, got %d sessions", n)
+	}
+
+	// Each account has its own count, and an override raises the cap.
+	addSMTPAccount(t, server, mockDB, "owner", "other@example.com", host, port)
+	if w := sendTo(t, server, []string{"you@example.org"}, map[string]any{"account_email": "other@example.com"}); w.Code != http.StatusOK {
+		t.Errorf("another account: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	mockDB.SetSendLimits(context.Background(), &db.SendLimits{OwnerPubKey: "owner", MaxDailySends: 3})
+	if w := sendSimple(t, server); w.Code != http.StatusOK {
+		t.Errorf("raised cap: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestSendMail_RecipientDomains(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.SendAllowedDomains = "example.org,partner.net"
+	server.cfg.SendBlockedDomains = "spam.example.org"
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+
+	w := sendTo(t, server, []string{"you@example.org", "x@Spam.Example.org", "y@elsewhere.com"}, map[string]any{"cc": []string{"z@sales.partner.net"}})
+	refusal := wantRefusal(t, mockDB, w, http.StatusForbidden, refusedRecipientDomain)
+	if !slices.Equal(refusal.Rejected, []string{"x@Spam.Example.org", "y@elsewhere.com"}) {
+		t.Errorf("rejected: want the blocked and the unlisted recipient, got %v", refusal.Rejected)
+	}
+	if n := fake.sessionCount(); n != 0 {
+		t.Errorf("no recipient may get a partly refused send: %d sessions", n)
+	}
+
+	if w := sendTo(t, server, []string{"you@EXAMPLE.org"}, map[string]any{"cc": []string{"z@sales.partner.net"}}); w.Code != http.StatusOK {
+		t.Errorf("allowed domains: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// An owner's lists replace the deployment's.
+	mockDB.SetSendLimits(context.Background(), &db.SendLimits{OwnerPubKey: "owner", AllowedDomains: []string{"elsewhere.com"}})
+	if w := sendTo(t, server, []string{"y@elsewhere.com", "x@spam.example.org"}, nil); w.Code != http.StatusForbidden {
+		t.Errorf("deployment blocklist still applies: want %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := sendTo(t, server, []string{"y@elsewhere.com"}, nil); w.Code != http.StatusOK {
+		t.Errorf("owner's allowed domain: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	w = sendTo(t, server, []string{"you@example.org"}, nil)
+	wantRefusal(t, mockDB, w, http.StatusForbidden, refusedRecipientDomain)
+}
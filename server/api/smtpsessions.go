@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"mulamail/db"
+)
+
+// smtpSessionWait is how long an interactive send waits for a busy account
+// before it is answered 429; background deliveries wait as long as it takes.
+var smtpSessionWait = 5 * time.Second
+
+// errAccountBusy is returned when an account's SMTP sessions stay in use
+// for longer than smtpSessionWait.
+var errAccountBusy = errors.New("another message is being sent through this account; retry shortly")
+
+// smtpSessions limits the SMTP sessions each account has open in this
+// process.  It is shared by the request handlers and the background
+// workers, which each have a Server of their own.
+var smtpSessions accountSessions
+
+// accountSessions hands out a counting semaphore per account.  Like
+// ownerLocks, entries are reference counted and dropped once nothing holds
+// or waits for them.  A semaphore keeps the limit it was created with, so a
+// changed limit applies once the account's sessions are idle.  The zero
+// value is ready to use.
+type accountSessions struct {
+	mu       sync.Mutex
+	accounts map[string]*accountSlots
+}
+
+type accountSlots struct {
+	slots chan struct{}
+	refs  int // sessions holding or waiting for a slot; guarded by accountSessions.mu
+}
+
+// acquire blocks until one of key's limit slots is free or ctx is done, and
+// returns the function that frees it.
+func (a *accountSessions) acquire(ctx context.Context, key string, limit int) (release func(), err error) {
+	a.mu.Lock()
+	if a.accounts == nil {
+		a.accounts = make(map[string]*accountSlots)
+	}
+	as := a.accounts[key]
+	if as == nil {
+		as = &accountSlots{slots: make(chan struct{}, max(limit, 1))}
+		a.accounts[key] = as
+	}
+	as.refs++
+	a.mu.Unlock()
+
+	unref := func() {
+		a.mu.Lock()
+		if as.refs--; as.refs == 0 {
+			delete(a.accounts, key)
+		}
+		a.mu.Unlock()
+	}
+	select {
+	case as.slots <- struct{}{}:
+		return func() {
+			<-as.slots
+			unref()
+		}, nil
+	case <-ctx.Done():
+		unref()
+		return nil, ctx.Err()
+	}
+}
+
+// acquireSMTPSession waits until acc may open another SMTP session and
+// returns the function that ends it.  Consumer providers treat concurrent
+// sessions from one account as abuse, so an account gets one at a time
+// unless its smtp.max_sessions allows more.  The limit holds per instance.
+func (s *Server) acquireSMTPSession(ctx context.Context, acc *db.MailAccount) (func(), error) {
+	return smtpSessions.acquire(ctx, acc.OwnerPubKey+"\x00"+acc.AccountEmail, acc.SMTP.MaxSessions)
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mulamail/db"
+)
+
+func TestAccountSessions(t *testing.T) {
+	var sessions accountSessions
+	ctx := context.Background()
+	busy := func(limit int) bool {
+		t.Helper()
+		waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		release, err := sessions.acquire(waitCtx, "owner\x00me@example.com", limit)
+		if err == nil {
+			release()
+		}
+		return err != nil
+	}
+
+	release, err := sessions.acquire(ctx, "owner\x00me@example.com", 0)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if !busy(0) {
+		t.Error("want a second session refused under the default limit")
+	}
+	other, err := sessions.acquire(ctx, "owner\x00other@example.com", 0)
+	if err != nil {
+		t.Fatalf("another account must not wait: %v", err)
+	}
+	other()
+	release()
+	if busy(0) {
+		t.Error("want the session free once released")
+	}
+	if len(sessions.accounts) != 0 {
+		t.Errorf("want idle accounts dropped, got %d", len(sessions.accounts))
+	}
+
+	release, _ = sessions.acquire(ctx, "owner\x00me@example.com", 2)
+	if busy(2) {
+		t.Error("want a second session allowed with a limit of 2")
+	}
+	release()
+}
+
+func TestSendMail_AccountBusy(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	defer func(d time.Duration) { smtpSessionWait = d }(smtpSessionWait)
+	smtpSessionWait = 20 * time.Millisecond
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	acc := mockDB.Accounts["owner"][0]
+	release, _ := server.acquireSMTPSession(context.Background(), acc)
+
+	w := asyncSend(t, server, "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("busy account: want %d with Retry-After, got %d %q", http.StatusTooManyRequests, w.Code, w.Header().Get("Retry-After"))
+	}
+	if cmds := fake.received(); len(cmds) != 0 {
+		t.Errorf("no SMTP traffic expected while the account is busy, got %q", cmds)
+	}
+
+	// An async send is queued without waiting for the session.
+	if w := asyncSend(t, server, "?async=true"); w.Code != http.StatusAccepted {
+		t.Errorf("async send: want %d, got %d", http.StatusAccepted, w.Code)
+	}
+
+	acc.SMTP.MaxSessions = 2
+	release()
+	release, _ = server.acquireSMTPSession(context.Background(), acc)
+	defer release()
+	if w := asyncSend(t, server, ""); w.Code != http.StatusOK {
+		t.Errorf("second session allowed: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestOutbox_RequeuesWhileAccountBusy(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+
+	fake := &fakeSMTP{}
+	host, port := fake.start(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", host, port)
+	asyncSend(t, server, "?async=true")
+	release, _ := server.acquireSMTPSession(context.Background(), mockDB.Accounts["owner"][0])
+	defer release()
+
+	// The worker waits for the session until it is stopped.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	newTestOutbox(server, time.Now().Add(time.Second)).processQueued(ctx, "test/0")
+
+	if m := mockDB.Outbox[0]; m.Status != db.OutboxQueued || m.Attempts != 1 {
+		t.Errorf("want the message queued again, got %s/%d %q", m.Status, m.Attempts, m.LastError)
+	}
+	if len(fake.sent()) != 0 {
+		t.Error("no delivery expected while the account is busy")
+	}
+}
+
+func TestUpdateAccount_SMTPMaxSessions(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	addSMTPAccount(t, server, mockDB, "owner", "me@example.com", "127.0.0.1", 1)
+
+	patch := func(n int) int {
+		body, _ := json.Marshal(map[string]any{"owner_pubkey": "owner", "account_email": "me@example.com", "smtp_max_sessions": n})
+		w := httptest.NewRecorder()
+		server.updateAccount(w, httptest.NewRequest("PATCH", "/api/v1/accounts", bytes.NewBuffer(body)))
+		return w.Code
+	}
+
+	if code := patch(4); code != http.StatusOK || mockDB.Accounts["owner"][0].SMTP.MaxSessions != 4 {
+		t.Errorf("set: status %d, limit %d", code, mockDB.Accounts["owner"][0].SMTP.MaxSessions)
+	}
+	for _, n := range []int{-1, maxSMTPSessions + 1} {
+		if code := patch(n); code != http.StatusBadRequest {
+			t.Errorf("%d: want %d, got %d", n, http.StatusBadRequest, code)
+		}
+	}
+	if code := patch(0); code != http.StatusOK || mockDB.Accounts["owner"][0].SMTP.MaxSessions != 0 {
+		t.Errorf("reset: status %d, limit %d", code, mockDB.Accounts["owner"][0].SMTP.MaxSessions)
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/blockchain"
+	"mulamail/db"
+)
+
+var errTipsDisabled = errors.New("tipping is not enabled")
+
+// maxTipMessageID bounds the message ID a tip memo carries.
+const maxTipMessageID = 256
+
+// tipRecipient resolves the wallet that tips for email go to, finding the
+// identity by canonical email.  Only a live identity can be tipped: an
+// erased owner's mapping stays on-chain, but nobody should still be paying
+// it.
+func (s *Server) tipRecipient(w http.ResponseWriter, r *http.Request, email string) (*db.Identity, bool) {
+	identity, err := s.db.GetIdentityByCanonicalEmail(r.Context(), s.canonicalRules().Canonical(email), email)
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "no identity is registered for "+email)
+		return nil, false
+	}
+	if err != nil {
+		writeInternalError(w, r, err)
+		return nil, false
+	}
+	if !identity.RevokedAt.IsZero() {
+		writeError(w, http.StatusGone, "the identity for "+email+" has been revoked")
+		return nil, false
+	}
+	return identity, true
+}
+
+// checkTipAmount enforces TIP_MAX_LAMPORTS.
+func (s *Server) checkTipAmount(w http.ResponseWriter, lamports uint64) bool {
+	if lamports == 0 {
+		writeError(w, http.StatusBadRequest, "lamports must be positive")
+		return false
+	}
+	if lamports > uint64(s.cfg.TipMaxLamports) {
+		writeLimitError(w, http.StatusBadRequest,
+			fmt.Sprintf("a tip is at most %d lamports", s.cfg.TipMaxLamports), s.cfg.TipMaxLamports)
+		return false
+	}
+	return true
+}
+
+// createTipTxRequest is the body of POST /api/v1/tips/create-tx.
+type createTipTxRequest struct {
+	SenderEmail  string `json:"sender_email"`
+	MessageID    string `json:"message_id"`
+	Lamports     uint64 `json:"lamports"`
+	TipperPubKey string `json:"tipper_pubkey"`
+}
+
+// createTipTxResponse carries the unsigned tip transaction.
+type createTipTxResponse struct {
+	Transaction     string `json:"transaction"` // base64, unsigned
+	RecipientPubKey string `json:"recipient_pubkey"`
+}
+
+// POST /api/v1/tips/create-tx
+//
+// Creates an *unsigned* transaction tipping the sender of an email: a SOL
+// transfer from the tipper to the wallet the sender's identity resolves to,
+// and a memo naming the email's Message-ID.  The client signs it locally
+// and submits it via /tips/send.
+//
+// Request:  { "sender_email": "alice@example.com", "message_id": "<...>", "lamports": 1000000, "tipper_pubkey": "<base58>" }
+// Response: { "transaction": "<base64 unsigned tx>", "recipient_pubkey": "<base58>" }
+func (s *Server) createTipTx(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.TipMaxLamports <= 0 {
+		writeError(w, http.StatusNotFound, errTipsDisabled.Error())
+		return
+	}
+	var req createTipTxRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if req.SenderEmail == "" || req.MessageID == "" || req.TipperPubKey == "" {
+		writeError(w, http.StatusBadRequest, "sender_email, message_id and tipper_pubkey are required")
+		return
+	}
+	if len(req.MessageID) > maxTipMessageID {
+		writeLimitError(w, http.StatusBadRequest, fmt.Sprintf("message_id is at most %d bytes", maxTipMessageID), maxTipMessageID)
+		return
+	}
+	if !s.checkTipAmount(w, req.Lamports) {
+		return
+	}
+	tipper, err := solana.PublicKeyFromBase58(req.TipperPubKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid tipper_pubkey: "+err.Error())
+		return
+	}
+
+	identity, ok := s.tipRecipient(w, r, req.SenderEmail)
+	if !ok {
+		return
+	}
+	recipient, err := solana.PublicKeyFromBase58(identity.PubKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "stored identity has an invalid pubkey")
+		return
+	}
+	if recipient.Equals(tipper) {
+		writeError(w, http.StatusBadRequest, "cannot tip yourself")
+		return
+	}
+
+	txB64, err := blockchain.BuildTipTx(r.Context(), s.solana, blockchain.Tip{
+		From: tipper, To: recipient, Lamports: req.Lamports, MessageID: req.MessageID,
+	})
+	if errors.Is(err, blockchain.ErrMemoTooLarge) {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "create tx failed", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, createTipTxResponse{Transaction: txB64, RecipientPubKey: recipient.String()})
+}
+
+// sendTipRequest is the body of POST /api/v1/tips/send.
+type sendTipRequest struct {
+	SenderEmail string `json:"sender_email"`
+	SignedTx    string `json:"signed_tx"`
+}
+
+// sendTipResponse is the recorded tip and its transaction.
+type sendTipResponse struct {
+	Tip    *db.Tip `json:"tip"`
+	TxHash string  `json:"tx_hash"`
+}
+
+// POST /api/v1/tips/send
+//
+// Broadcasts a signed tip transaction and records the tip against the
+// email's Message-ID.  The recipient, amount and Message-ID are read from
+// the transaction itself and checked again: it must pay the wallet
+// sender_email currently resolves to, no more than TIP_MAX_LAMPORTS.
+//
+// Request:  { "sender_email": "alice@example.com", "signed_tx": "<base64>" }
+// Response: { "tip": {...}, "tx_hash": "<signature>" }
+func (s *Server) sendTip(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.TipMaxLamports <= 0 {
+		writeError(w, http.StatusNotFound, errTipsDisabled.Error())
+		return
+	}
+	var req sendTipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if req.SenderEmail == "" || req.SignedTx == "" {
+		writeError(w, http.StatusBadRequest, "sender_email and signed_tx are required")
+		return
+	}
+	tip, err := blockchain.ParseTipTx(req.SignedTx)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.checkTipAmount(w, tip.Lamports) {
+		return
+	}
+	identity, ok := s.tipRecipient(w, r, req.SenderEmail)
+	if !ok {
+		return
+	}
+	if tip.To.String() != identity.PubKey {
+		writeError(w, http.StatusBadRequest, "transaction does not pay the wallet of "+req.SenderEmail)
+		return
+	}
+
+	sig, err := s.solana.SendTransaction(r.Context(), req.SignedTx)
+	if errors.Is(err, blockchain.ErrTxExpired) {
+		writeError(w, http.StatusConflict,
+			"transaction expired; request a new one from /tips/create-tx and sign again")
+		return
+	}
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "broadcast failed", err)
+		return
+	}
+
+	record := &db.Tip{
+		TxSig:          sig.String(),
+		FromPubKey:     tip.From.String(),
+		ToPubKey:       tip.To.String(),
+		RecipientEmail: identity.Email,
+		Lamports:       tip.Lamports,
+		MessageID:      tip.MessageID,
+	}
+	err = s.db.CreateTip(r.Context(), record)
+	if errors.Is(err, db.ErrDuplicate) {
+		writeError(w, http.StatusConflict, "tip already recorded")
+		return
+	}
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "store tip failed", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sendTipResponse{Tip: record, TxHash: sig.String()})
+}
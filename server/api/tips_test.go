@@ -0,0 +1,178 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/blockchain"
+	"mulamail/db"
+	"mulamail/db/dbtest"
+)
+
+// setupTipServer enables tipping up to 1000 lamports against an RPC
+// endpoint that hands out a blockhash and accepts every transaction.  It
+// registers alice@example.com, whose wallet it returns.
+func setupTipServer(t *testing.T) (*Server, *dbtest.Mock, solana.PublicKey) {
+	t.Helper()
+	server, mockDB := setupTestServer(t)
+	server.cfg.TipMaxLamports = 1000
+
+	rpcServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var result any
+		switch req.Method {
+		case "getLatestBlockhash":
+			result = map[string]any{
+				"context": map[string]any{"slot": 1},
+				"value":   map[string]any{"blockhash": solana.Hash{1}.String(), "lastValidBlockHeight": 100},
+			}
+		case "sendTransaction":
+			result = solana.Signature{9}.String()
+		}
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}))
+	t.Cleanup(rpcServer.Close)
+	server.solana = blockchain.NewClient(rpcServer.URL)
+
+	alice := solana.NewWallet().PublicKey()
+	mockDB.CreateIdentity(context.Background(), &db.Identity{Email: "alice@example.com", PubKey: alice.String()})
+	return server, mockDB, alice
+}
+
+func postTip(server *Server, handler func(http.ResponseWriter, *http.Request), payload any) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(payload)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/api/v1/tips", bytes.NewBuffer(body)))
+	return w
+}
+
+// signedTip asks the server for a tip transaction from tipper and signs it.
+func signedTip(t *testing.T, server *Server, tipper solana.PrivateKey, lamports uint64) string {
+	t.Helper()
+	w := postTip(server, server.createTipTx, map[string]any{
+		"sender_email": "alice@example.com", "message_id": "<m1@example.com>",
+		"lamports": lamports, "tipper_pubkey": tipper.PublicKey().String(),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("create-tx: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp createTipTxResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	tx, err := solana.TransactionFromBase64(resp.Transaction)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if _, err := tx.Sign(func(key solana.PublicKey) *solana.PrivateKey {
+		if key.Equals(tipper.PublicKey()) {
+			return &tipper
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return tx.MustToBase64()
+}
+
+func TestCreateTipTx(t *testing.T) {
+	server, _, alice := setupTipServer(t)
+	tipper := solana.NewWallet().PrivateKey
+
+	w := postTip(server, server.createTipTx, map[string]any{
+		"sender_email": "alice@example.com", "message_id": "<m1@example.com>",
+		"lamports": 500, "tipper_pubkey": tipper.PublicKey().String(),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp createTipTxResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	tip, err := blockchain.ParseTipTx(resp.Transaction)
+	if err != nil {
+		t.Fatalf("ParseTipTx: %v", err)
+	}
+	want := blockchain.Tip{From: tipper.PublicKey(), To: alice, Lamports: 500, MessageID: "<m1@example.com>"}
+	if tip != want || resp.RecipientPubKey != alice.String() {
+		t.Errorf("want %+v to %s, got %+v to %s", want, alice, tip, resp.RecipientPubKey)
+	}
+}
+
+func TestCreateTipTx_Rejected(t *testing.T) {
+	server, mockDB, alice := setupTipServer(t)
+	tipper := solana.NewWallet().PublicKey().String()
+	mockDB.CreateIdentity(context.Background(), &db.Identity{Email: "gone@example.com", PubKey: solana.NewWallet().PublicKey().String(), RevokedAt: time.Now()})
+
+	cases := []struct {
+		name    string
+		payload map[string]any
+		want    int
+	}{
+		{"unknown sender", map[string]any{"sender_email": "nobody@example.com", "lamports": 1, "tipper_pubkey": tipper}, http.StatusNotFound},
+		{"revoked sender", map[string]any{"sender_email": "gone@example.com", "lamports": 1, "tipper_pubkey": tipper}, http.StatusGone},
+		{"over the maximum", map[string]any{"sender_email": "alice@example.com", "lamports": 1001, "tipper_pubkey": tipper}, http.StatusBadRequest},
+		{"zero", map[string]any{"sender_email": "alice@example.com", "lamports": 0, "tipper_pubkey": tipper}, http.StatusBadRequest},
+		{"self", map[string]any{"sender_email": "alice@example.com", "lamports": 1, "tipper_pubkey": alice.String()}, http.StatusBadRequest},
+		{"bad pubkey", map[string]any{"sender_email": "alice@example.com", "lamports": 1, "tipper_pubkey": "nope"}, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		tc.payload["message_id"] = "<m1@example.com>"
+		if w := postTip(server, server.createTipTx, tc.payload); w.Code != tc.want {
+			t.Errorf("%s: want %d, got %d: %s", tc.name, tc.want, w.Code, w.Body.String())
+		}
+	}
+
+	server.cfg.TipMaxLamports = 0
+	if w := postTip(server, server.createTipTx, map[string]any{}); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestSendTip(t *testing.T) {
+	server, mockDB, alice := setupTipServer(t)
+	tipper := solana.NewWallet().PrivateKey
+	signed := signedTip(t, server, tipper, 700)
+
+	w := postTip(server, server.sendTip, map[string]string{"sender_email": "alice@example.com", "signed_tx": signed})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status code: want %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	sig := solana.Signature{9}.String()
+	tip := mockDB.Tips[sig]
+	if tip == nil || tip.FromPubKey != tipper.PublicKey().String() || tip.ToPubKey != alice.String() ||
+		tip.Lamports != 700 || tip.MessageID != "<m1@example.com>" || tip.RecipientEmail != "alice@example.com" {
+		t.Errorf("unexpected tip record %+v", tip)
+	}
+
+	if w := postTip(server, server.sendTip, map[string]string{"sender_email": "alice@example.com", "signed_tx": signed}); w.Code != http.StatusConflict {
+		t.Errorf("repeat: want %d, got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestSendTip_ChecksTransaction(t *testing.T) {
+	server, mockDB, _ := setupTipServer(t)
+	signed := signedTip(t, server, solana.NewWallet().PrivateKey, 700)
+	mockDB.CreateIdentity(context.Background(), &db.Identity{Email: "bob@example.com", PubKey: solana.NewWallet().PublicKey().String()})
+
+	// Alice's tip cannot be recorded as a tip to Bob.
+	if w := postTip(server, server.sendTip, map[string]string{"sender_email": "bob@example.com", "signed_tx": signed}); w.Code != http.StatusBadRequest {
+		t.Errorf("other recipient: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	// The maximum applies to what the transaction sends.
+	server.cfg.TipMaxLamports = 500
+	if w := postTip(server, server.sendTip, map[string]string{"sender_email": "alice@example.com", "signed_tx": signed}); w.Code != http.StatusBadRequest {
+		t.Errorf("over the maximum: want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if len(mockDB.Tips) != 0 {
+		t.Errorf("no tip should be recorded, got %v", mockDB.Tips)
+	}
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"mulamail/config"
+	"mulamail/db"
+	"mulamail/vault"
+)
+
+// vaultPrefix ties a vault key prefix to the records that keep its blobs
+// alive.  references returns every key under the prefix that a record in
+// the database still points to.
+type vaultPrefix struct {
+	prefix     string
+	references func(ctx context.Context, database db.DB) (map[string]bool, error)
+}
+
+// vaultPrefixes lists every prefix the server writes blobs under.  A feature
+// that stores blobs in the vault registers its prefix here; the collector
+// only looks inside these prefixes, so blobs under an unregistered prefix
+// are kept rather than collected.  Scheduled messages keep their payload in
+// MongoDB and store nothing in the vault.
+var vaultPrefixes = []vaultPrefix{
+	{prefix: "messages/", references: referencedMessageBodies},
+	{prefix: "exports/", references: referencedExportArchives},
+}
+
+// referencedMessageBodies returns the cache keys of the raw messages whose
+// preview is still cached for an existing mail account.
+func referencedMessageBodies(ctx context.Context, database db.DB) (map[string]bool, error) {
+	accounts, err := database.GetAllMailAccounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]map[string]bool)
+	for _, acc := range accounts {
+		if owners[acc.OwnerPubKey] == nil {
+			owners[acc.OwnerPubKey] = make(map[string]bool)
+		}
+		owners[acc.OwnerPubKey][acc.AccountEmail] = true
+	}
+
+	keys := make(map[string]bool)
+	for owner, emails := range owners {
+		msgs, err := database.GetCachedMessagesByOwner(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if emails[m.AccountEmail] {
+				keys[messageCacheKey(owner, m.AccountEmail, m.UID)] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+// referencedExportArchives returns the storage keys of exports that are
+// queued, being built or downloadable.
+func referencedExportArchives(ctx context.Context, database db.DB) (map[string]bool, error) {
+	jobs, err := database.GetUnexpiredExportJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool, len(jobs))
+	for _, j := range jobs {
+		for _, key := range exportKeys(j) {
+			keys[key] = true
+		}
+	}
+	return keys, nil
+}
+
+// VaultGCOptions controls one collection of unreferenced vault blobs.
+type VaultGCOptions struct {
+	DryRun           bool          // report what would be deleted, delete nothing
+	Grace            time.Duration // unreferenced blobs modified more recently are kept
+	DeletesPerSecond int           // cap on delete calls; 0 means no cap
+}
+
+// VaultGCReport summarises one collection.
+type VaultGCReport struct {
+	DryRun         bool  `json:"dry_run"`
+	Scanned        int   `json:"scanned"`         // keys listed under registered prefixes
+	Recent         int   `json:"recent"`          // unreferenced, but within the grace period
+	Orphaned       int   `json:"orphaned"`        // unreferenced and past the grace period
+	Deleted        int   `json:"deleted"`         // orphans deleted (0 for a dry run)
+	BytesReclaimed int64 `json:"bytes_reclaimed"` // size of the deleted orphans, or of all orphans for a dry run
+}
+
+// auditDetail returns the report as audit event detail.
+func (r VaultGCReport) auditDetail() map[string]any {
+	return map[string]any{
+		"dry_run":         r.DryRun,
+		"scanned":         r.Scanned,
+		"recent":          r.Recent,
+		"orphaned":        r.Orphaned,
+		"deleted":         r.Deleted,
+		"bytes_reclaimed": r.BytesReclaimed,
+	}
+}
+
+// CollectVaultGarbage deletes vault blobs that no record refers to any
+// more, such as the cached bodies of a deleted account or the archive of an
+// export that expired while its delete failed.  The report is written to
+// the audit log, under no owner.
+func CollectVaultGarbage(ctx context.Context, database db.DB, storage vault.Storage, opts VaultGCOptions) (VaultGCReport, error) {
+	return (&Server{db: database, storage: storage}).collectVaultGarbage(ctx, opts)
+}
+
+// collectVaultGarbage runs one collection over every registered prefix.
+// References are loaded before a prefix is listed, so a blob stored during
+// the run may be missing from them; the grace period keeps it, as it does a
+// blob whose record is written only after the blob is stored.
+func (s *Server) collectVaultGarbage(ctx context.Context, opts VaultGCOptions) (VaultGCReport, error) {
+	res := VaultGCReport{DryRun: opts.DryRun}
+	cutoff := time.Now().Add(-opts.Grace)
+
+	var throttle <-chan time.Time
+	if opts.DeletesPerSecond > 0 && !opts.DryRun {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.DeletesPerSecond))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	err := func() error {
+		for _, p := range vaultPrefixes {
+			refs, err := p.references(ctx, s.db)
+			if err != nil {
+				return fmt.Errorf("%s references: %w", p.prefix, err)
+			}
+			err = vault.ForEachPage(ctx, s.storage, p.prefix, func(keys []string) error {
+				for _, key := range keys {
+					res.Scanned++
+					if refs[key] {
+						continue
+					}
+					info, err := s.storage.Stat(ctx, key)
+					if err != nil {
+						return err
+					}
+					if info.Modified.After(cutoff) {
+						res.Recent++
+						continue
+					}
+					res.Orphaned++
+					if opts.DryRun {
+						res.BytesReclaimed += info.Size
+						continue
+					}
+					if throttle != nil {
+						select {
+						case <-ctx.Done():
+							return ctx.Err()
+						case <-throttle:
+						}
+					}
+					if err := s.storage.Delete(ctx, key); err != nil {
+						return err
+					}
+					res.Deleted++
+					res.BytesReclaimed += info.Size
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", p.prefix, err)
+			}
+		}
+		return nil
+	}()
+
+	detail := res.auditDetail()
+	if err != nil {
+		detail["error"] = sanitizeError(err)
+		s.audit(ctx, "", "vault.gc.failed", "", detail)
+		return res, err
+	}
+	s.audit(ctx, "", "vault.gc.completed", "", detail)
+	return res, nil
+}
+
+// ---------- background collection ----------
+
+// VaultGC collects unreferenced vault blobs periodically.
+type VaultGC struct {
+	srv      *Server
+	leader   *leader
+	interval time.Duration
+	opts     VaultGCOptions
+}
+
+// NewVaultGC creates a collector of unreferenced blobs in storage.
+func NewVaultGC(database db.DB, storage vault.Storage, cfg *config.Config) *VaultGC {
+	return &VaultGC{
+		srv:      &Server{db: database, storage: storage, cfg: cfg},
+		leader:   newLeader(database, roleVaultGC, cfg),
+		interval: time.Duration(cfg.VaultGCIntervalHours) * time.Hour,
+		opts:     vaultGCOptions(cfg),
+	}
+}
+
+// vaultGCOptions returns the collection options configured in cfg.
+func vaultGCOptions(cfg *config.Config) VaultGCOptions {
+	return VaultGCOptions{
+		Grace:            time.Duration(cfg.VaultGCGraceHours) * time.Hour,
+		DeletesPerSecond: cfg.VaultGCDeletesPerSecond,
+	}
+}
+
+// Run collects once per interval until ctx is cancelled.  The first run
+// waits a full interval, so restarts do not trigger a collection each.  A
+// zero interval disables background collection.  Only the instance leading
+// the vault-gc role collects.
+func (gc *VaultGC) Run(ctx context.Context) {
+	if gc.interval <= 0 {
+		return
+	}
+	gc.leader.elect(ctx)
+	ticker := time.NewTicker(gc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !gc.leader.leads() || gc.srv.paused(ctx) {
+			continue
+		}
+		res, err := gc.srv.collectVaultGarbage(ctx, gc.opts)
+		if err != nil {
+			log.Printf("vault gc: %v", err)
+			continue
+		}
+		if res.Deleted > 0 {
+			log.Printf("vault gc: deleted %d unreferenced blobs (%d bytes)", res.Deleted, res.BytesReclaimed)
+		}
+	}
+}
+
+// vaultGCRequest is the body of POST /api/v1/admin/vault-gc.
+type vaultGCRequest struct {
+	DryRun     bool `json:"dry_run"`
+	GraceHours *int `json:"grace_hours,omitempty"` // default VAULT_GC_GRACE_HOURS
+}
+
+// POST /api/v1/admin/vault-gc
+//
+// Collects unreferenced vault blobs now and reports what was found.  Deletes
+// are rate limited to VAULT_GC_DELETES_PER_SECOND, so a large collection
+// can take a while; use a dry run to size it first.
+//
+// Request:  { "dry_run": true, "grace_hours": 72 }
+// Response: { "dry_run": true, "scanned": 120, "recent": 1, "orphaned": 4, "deleted": 0, "bytes_reclaimed": 81920 }
+func (s *Server) vaultGC(w http.ResponseWriter, r *http.Request) {
+	var req vaultGCRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	opts := vaultGCOptions(s.cfg)
+	opts.DryRun = req.DryRun
+	if req.GraceHours != nil {
+		if *req.GraceHours < 0 {
+			writeError(w, http.StatusBadRequest, "grace_hours must not be negative")
+			return
+		}
+		opts.Grace = time.Duration(*req.GraceHours) * time.Hour
+	}
+	if s.storage == nil {
+		writeError(w, http.StatusServiceUnavailable, "vault storage not configured")
+		return
+	}
+
+	res, err := s.collectVaultGarbage(r.Context(), opts)
+	if err != nil {
+		writeFailure(w, r, http.StatusInternalServerError, "vault gc failed", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mulamail/db"
+	"mulamail/vault"
+)
+
+func TestCollectVaultGarbage(t *testing.T) {
+	_, mockDB := setupTestServer(t)
+	dir := t.TempDir()
+	storage, err := vault.NewLocalStorage(dir)
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+	ctx := context.Background()
+
+	mockDB.CreateMailAccount(ctx, &db.MailAccount{OwnerPubKey: "owner", AccountEmail: "me@example.com"})
+	mockDB.UpsertCachedMessage(ctx, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: "1"})
+	// A cached preview whose account has been removed keeps nothing alive.
+	mockDB.UpsertCachedMessage(ctx, &db.CachedMessage{OwnerPubKey: "owner", AccountEmail: "gone@example.com", UID: "1"})
+	mockDB.CreateExportJob(ctx, &db.ExportJob{OwnerPubKey: "owner"})
+	job := mockDB.Exports[0]
+
+	old := time.Now().Add(-100 * time.Hour)
+	put := func(key string, modified time.Time) {
+		storage.Put(ctx, key, []byte("0123456789"))
+		os.Chtimes(filepath.Join(dir, key), modified, modified)
+	}
+	live := []string{
+		messageCacheKey("owner", "me@example.com", "1"),
+		exportStorageKey("owner", job.ID),
+		"unregistered/blob", // outside every registered prefix
+	}
+	for _, key := range live {
+		put(key, old)
+	}
+	recent := messageCacheKey("owner", "me@example.com", "2")
+	put(recent, time.Now())
+	orphans := []string{
+		messageCacheKey("owner", "me@example.com", "3"),
+		messageCacheKey("owner", "gone@example.com", "1"),
+		exportStorageKey("owner", primitive.NewObjectID()),
+	}
+	for _, key := range orphans {
+		put(key, old)
+	}
+
+	opts := VaultGCOptions{DryRun: true, Grace: 72 * time.Hour, DeletesPerSecond: 1000}
+	res, err := CollectVaultGarbage(ctx, mockDB, storage, opts)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	want := VaultGCReport{DryRun: true, Scanned: 6, Recent: 1, Orphaned: 3, Deleted: 0, BytesReclaimed: 30}
+	if res != want {
+		t.Errorf("dry run: want %+v, got %+v", want, res)
+	}
+	if keys, _ := storage.List(ctx, ""); len(keys) != 7 {
+		t.Errorf("dry run deleted blobs, %d left", len(keys))
+	}
+
+	opts.DryRun = false
+	res, err = CollectVaultGarbage(ctx, mockDB, storage, opts)
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	want.DryRun, want.Deleted = false, 3
+	if res != want {
+		t.Errorf("collect: want %+v, got %+v", want, res)
+	}
+	keys, _ := storage.List(ctx, "")
+	slices.Sort(keys)
+	wantKeys := append(slices.Clone(live), recent)
+	slices.Sort(wantKeys)
+	if !slices.Equal(keys, wantKeys) {
+		t.Errorf("left in the vault:\nwant %v\n got %v", wantKeys, keys)
+	}
+
+	if len(mockDB.Audit) != 2 || mockDB.Audit[1].Action != "vault.gc.completed" || mockDB.Audit[1].Detail["bytes_reclaimed"] != int64(30) {
+		t.Errorf("audit events: %+v", mockDB.Audit)
+	}
+}
+
+func TestVaultGCEndpoint(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	server.cfg.AdminToken = "s3cret"
+	server.cfg.VaultGCGraceHours = 72
+
+	post := func(router http.Handler, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/admin/vault-gc", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(NewRouter(mockDB, server.solana, nil, server.cfg), `{"dry_run":true}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without storage: want 503, got %d", w.Code)
+	}
+
+	storage, _ := vault.NewLocalStorage(t.TempDir())
+	router := NewRouter(mockDB, server.solana, storage, server.cfg)
+	for _, body := range []string{`not json`, `{"grace_hours":-1}`} {
+		if w := post(router, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: want 400, got %d", body, w.Code)
+		}
+	}
+
+	storage.Put(context.Background(), messageCacheKey("owner", "me@example.com", "1"), []byte("body"))
+	w := post(router, `{"dry_run":true,"grace_hours":0}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("dry run: status %d: %s", w.Code, w.Body.String())
+	}
+	var res VaultGCReport
+	json.NewDecoder(w.Body).Decode(&res)
+	if !res.DryRun || res.Orphaned != 1 || res.BytesReclaimed != 4 {
+		t.Errorf("dry run: unexpected report %+v", res)
+	}
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"context"
+
+	"mulamail/config"
+	"mulamail/db"
+)
+
+// AccountCheck is the outcome of VerifyAccount.  An empty error field means
+// that side of the account works.
+type AccountCheck struct {
+	OwnerPubKey  string `json:"owner_pubkey"`
+	AccountEmail string `json:"account_email"`
+	POP3Error    string `json:"pop3_error,omitempty"`
+	Messages     int    `json:"messages"` // messages in the maildrop, when POP3 works
+	// POP3Capabilities is the server's CAPA reply once logged in, empty when
+	// the server does not support CAPA.
+	POP3Capabilities []string `json:"pop3_capabilities,omitempty"`
+	SMTPError        string   `json:"smtp_error,omitempty"`
+}
+
+// OK reports whether both POP3 and SMTP login succeeded.
+func (c *AccountCheck) OK() bool { return c.POP3Error == "" && c.SMTPError == "" }
+
+// VerifyAccount checks that a stored mail account's credentials still work:
+// it logs in to the POP3 server, lists the maildrop and records the server's
+// capabilities, then connects and
+// authenticates to the SMTP server without sending anything.  The error
+// return is reserved for failures to load the account itself.
+func VerifyAccount(ctx context.Context, database db.DB, cfg *config.Config, owner, email string) (*AccountCheck, error) {
+	acc, err := database.GetMailAccount(ctx, owner, email)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{db: database, cfg: cfg}
+	check := &AccountCheck{OwnerPubKey: owner, AccountEmail: email}
+
+	if pop3, err := s.dialPOP3(ctx, acc); err != nil {
+		check.POP3Error = err.Error()
+	} else {
+		if list, err := pop3.List(ctx); err != nil {
+			check.POP3Error = "POP3 LIST: " + err.Error()
+		} else {
+			check.Messages = len(list)
+		}
+		if caps, err := pop3.Capabilities(ctx); err == nil {
+			check.POP3Capabilities = caps.List()
+		}
+		pop3.Close()
+	}
+
+	smtp, err := s.newSMTPClient(acc, s.debugTrace("smtp", acc))
+	if err != nil {
+		check.SMTPError = err.Error()
+		return check, nil
+	}
+	defer smtp.Close()
+	if err := smtp.Connect(ctx); err != nil {
+		check.SMTPError = (&smtpStageError{"SMTP connect", err}).Error()
+	} else if err := smtp.Handshake(ctx); err != nil {
+		check.SMTPError = (&smtpStageError{"SMTP handshake", err}).Error()
+	} else if err := smtp.Auth(ctx); err != nil {
+		check.SMTPError = (&smtpStageError{"SMTP auth", err}).Error()
+	}
+	return check, nil
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"mulamail/db"
+)
+
+func TestVerifyAccount(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+
+	pop := &fakePOP3{
+		messages: map[int]string{1: "Subject: one\r\n", 2: "Subject: two\r\n"},
+		capa:     []string{"USER", "UIDL", "TOP"},
+	}
+	popHost, popPort := pop.start(t)
+	smtp := &fakeSMTP{ehlo: []string{"AUTH PLAIN LOGIN"}}
+	smtpHost, smtpPort := smtp.start(t)
+
+	passEnc, _ := server.cfg.EncryptionKey.EncryptString("pass")
+	mockDB.CreateMailAccount(ctx, &db.MailAccount{
+		OwnerPubKey:  "owner",
+		AccountEmail: "me@example.com",
+		POP3:         db.POP3Settings{Host: popHost, Port: popPort, User: "u", PassEnc: passEnc},
+		SMTP:         db.SMTPSettings{Host: smtpHost, Port: smtpPort, User: "u", PassEnc: passEnc},
+	})
+
+	check, err := VerifyAccount(ctx, mockDB, server.cfg, "owner", "me@example.com")
+	if err != nil {
+		t.Fatalf("VerifyAccount failed: %v", err)
+	}
+	if !check.OK() {
+		t.Fatalf("expected account to verify, got %+v", check)
+	}
+	if check.Messages != 2 {
+		t.Errorf("expected 2 messages, got %d", check.Messages)
+	}
+	if want := []string{"TOP", "UIDL", "USER"}; !slices.Equal(check.POP3Capabilities, want) {
+		t.Errorf("capabilities: want %v, got %v", want, check.POP3Capabilities)
+	}
+	if len(smtp.sent()) != 0 {
+		t.Error("verification must not send mail")
+	}
+}
+
+func TestVerifyAccount_Failures(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	ctx := context.Background()
+
+	if _, err := VerifyAccount(ctx, mockDB, server.cfg, "owner", "missing@example.com"); err != db.ErrNotFound {
+		t.Errorf("expected ErrNotFound for unknown account, got %v", err)
+	}
+
+	// Nothing listens on port 1, so both sides fail to connect.
+	addPOP3Account(t, server, mockDB, "owner", "me@example.com", "127.0.0.1", 1)
+	check, err := VerifyAccount(ctx, mockDB, server.cfg, "owner", "me@example.com")
+	if err != nil {
+		t.Fatalf("VerifyAccount failed: %v", err)
+	}
+	if check.OK() || check.POP3Error == "" || check.SMTPError == "" {
+		t.Errorf("expected POP3 and SMTP errors, got %+v", check)
+	}
+}
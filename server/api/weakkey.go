@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+
+	"mulamail/vault"
+)
+
+// weakKeyReport counts the stored mail credentials encrypted under a weak
+// key.  Any of them means the passwords are readable by whoever holds the
+// database, and must be moved to a strong key with rotate-keys.
+type weakKeyReport struct {
+	CurrentKeyWeak  bool `json:"current_key_weak"`
+	Accounts        int  `json:"accounts"`
+	WeakAccounts    int  `json:"weak_accounts"`
+	WeakCredentials int  `json:"weak_credentials"`
+	RotateRequired  bool `json:"rotate_required"`
+}
+
+// GET /api/v1/admin/weak-key-report
+//
+// Reports whether the server's ENCRYPTION_KEY is weak and how many stored
+// POP3 and SMTP passwords are encrypted under a weak key.  Credentials do
+// not record the key they were encrypted under, so each is tried against
+// the current key, when it is weak, and the well-known weak keys
+// (vault.WeakKeys): a few hundred trial decryptions per credential, which
+// scan every account.  The key itself is never reported or logged.
+func (s *Server) weakKeyReport(w http.ResponseWriter, r *http.Request) {
+	keys := vault.WeakKeys()
+	if s.cfg.WeakEncryptionKey {
+		keys = append([]vault.Key{s.cfg.EncryptionKey}, keys...)
+	}
+	accounts, err := s.db.GetAllMailAccounts(r.Context())
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	report := weakKeyReport{CurrentKeyWeak: s.cfg.WeakEncryptionKey, Accounts: len(accounts)}
+	for _, acc := range accounts {
+		if err := r.Context().Err(); err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		weak := 0
+		for _, enc := range []string{acc.POP3.PassEnc, acc.SMTP.PassEnc} {
+			if enc != "" && opensUnderAny(keys, enc) {
+				weak++
+			}
+		}
+		report.WeakCredentials += weak
+		if weak > 0 {
+			report.WeakAccounts++
+		}
+	}
+	report.RotateRequired = report.CurrentKeyWeak || report.WeakCredentials > 0
+	writeJSON(w, http.StatusOK, report)
+}
+
+// opensUnderAny reports whether enc was encrypted under one of keys.
+func opensUnderAny(keys []vault.Key, enc string) bool {
+	for _, k := range keys {
+		if k.Opens(enc) {
+			return true
+		}
+	}
+	return false
+}
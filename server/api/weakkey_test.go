@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+	"mulamail/vault"
+)
+
+// addAccountUnder stores an account whose passwords are encrypted under
+// pop3Key and smtpKey.
+func addAccountUnder(t *testing.T, mockDB *dbtest.Mock, email string, pop3Key, smtpKey vault.Key) {
+	t.Helper()
+	pop3Enc, err := pop3Key.EncryptString("pop3-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpEnc, err := smtpKey.EncryptString("smtp-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockDB.CreateMailAccount(context.Background(), &db.MailAccount{
+		OwnerPubKey: "owner", AccountEmail: email,
+		POP3: db.POP3Settings{PassEnc: pop3Enc},
+		SMTP: db.SMTPSettings{PassEnc: smtpEnc},
+	})
+}
+
+func getWeakKeyReport(t *testing.T, server *Server) weakKeyReport {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.weakKeyReport(w, httptest.NewRequest("GET", "/api/v1/admin/weak-key-report", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var report weakKeyReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	return report
+}
+
+func TestWeakKeyReport(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	strong := vault.MustParseKey("6f1c0e9a4b27d3855e21a7c9f0b3648d1a9e57c2b80f4d36e5a1c7092bd4f368")
+	zero := vault.MustParseKey(strings.Repeat("00", vault.KeySize))
+	server.cfg.EncryptionKey = strong
+
+	addAccountUnder(t, mockDB, "strong@example.com", strong, strong)
+	addAccountUnder(t, mockDB, "default@example.com", zero, strong)
+
+	want := weakKeyReport{Accounts: 2, WeakAccounts: 1, WeakCredentials: 1, RotateRequired: true}
+	if got := getWeakKeyReport(t, server); got != want {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+
+	// A weak current key is found even when no list knows it.
+	guessable := vault.MustParseKey("a1b2c3d4e5f6a7b8c9d0e1f2a1b2c3d4e5f6a7b8c9d0e1f2f2e1d0c9b8a7f6e5")
+	server.cfg.EncryptionKey, server.cfg.WeakEncryptionKey = guessable, true
+	addAccountUnder(t, mockDB, "guessable@example.com", guessable, guessable)
+	want = weakKeyReport{CurrentKeyWeak: true, Accounts: 3, WeakAccounts: 2, WeakCredentials: 3, RotateRequired: true}
+	if got := getWeakKeyReport(t, server); got != want {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestWeakKeyReport_AllStrong(t *testing.T) {
+	server, mockDB := setupTestServer(t)
+	strong := vault.MustParseKey("6f1c0e9a4b27d3855e21a7c9f0b3648d1a9e57c2b80f4d36e5a1c7092bd4f368")
+	server.cfg.EncryptionKey = strong
+	addAccountUnder(t, mockDB, "strong@example.com", strong, strong)
+
+	if got := getWeakKeyReport(t, server); got.RotateRequired || got.WeakCredentials != 0 || got.Accounts != 1 {
+		t.Errorf("want nothing flagged, got %+v", got)
+	}
+}
@@ -2,21 +2,54 @@ package blockchain
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/gagliardetto/solana-go"
 	"github.com/gagliardetto/solana-go/rpc"
 )
 
+// DefaultRPCTimeout bounds a single RPC round trip unless Client.Timeout
+// says otherwise.
+const DefaultRPCTimeout = 15 * time.Second
+
 // Client wraps the Solana RPC endpoint used by MulaMail.
 type Client struct {
-	RPC *rpc.Client
+	RPC     *rpc.Client
+	Timeout time.Duration // per-call RPC timeout; <= 0 leaves calls bounded only by their ctx
 }
 
 func NewClient(rpcURL string) *Client {
-	return &Client{RPC: rpc.New(rpcURL)}
+	return &Client{RPC: rpc.New(rpcURL), Timeout: DefaultRPCTimeout}
+}
+
+// withTimeout derives the context for one RPC round trip, bounded by
+// c.Timeout as well as by ctx.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
+// GetBalance returns the lamports held by pubkey.
+func (c *Client) GetBalance(ctx context.Context, pubkey solana.PublicKey) (uint64, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	res, err := c.RPC.GetBalance(ctx, pubkey, rpc.CommitmentConfirmed)
+	if err != nil {
+		return 0, fmt.Errorf("get balance: %w", err)
+	}
+	return res.Value, nil
 }
 
+// ErrTxExpired is returned by SendTransaction when the cluster no longer
+// accepts the transaction's blockhash: a recent blockhash has aged out, or a
+// durable nonce has been advanced by another transaction.
+var ErrTxExpired = errors.New("transaction blockhash expired or nonce advanced")
+
 // SendTransaction broadcasts a base64-encoded, already-signed transaction
 // and returns its signature (transaction ID).
 func (c *Client) SendTransaction(ctx context.Context, signedTxBase64 string) (solana.Signature, error) {
@@ -24,9 +57,50 @@ func (c *Client) SendTransaction(ctx context.Context, signedTxBase64 string) (so
 	if err != nil {
 		return solana.Signature{}, fmt.Errorf("parse tx: %w", err)
 	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
 	sig, err := c.RPC.SendTransaction(ctx, tx)
 	if err != nil {
+		if blockhashNotFound(err) {
+			return solana.Signature{}, fmt.Errorf("send tx: %w: %w", ErrTxExpired, err)
+		}
 		return solana.Signature{}, fmt.Errorf("send tx: %w", err)
 	}
 	return sig, nil
 }
+
+// ErrTxNotFound is returned when the cluster has no finalized transaction
+// with the requested signature.
+var ErrTxNotFound = errors.New("transaction not found")
+
+// getTransaction fetches and decodes a finalized transaction.
+func (c *Client) getTransaction(ctx context.Context, sig solana.Signature) (*rpc.GetTransactionResult, *solana.Transaction, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	maxVersion := rpc.MaxSupportedTransactionVersion0
+	res, err := c.RPC.GetTransaction(ctx, sig, &rpc.GetTransactionOpts{
+		Encoding:                       solana.EncodingBase64,
+		MaxSupportedTransactionVersion: &maxVersion,
+	})
+	if errors.Is(err, rpc.ErrNotFound) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTxNotFound, sig)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("get transaction %s: %w", sig, err)
+	}
+	if res.Transaction == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTxNotFound, sig)
+	}
+	tx, err := res.Transaction.GetTransaction()
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode transaction %s: %w", sig, err)
+	}
+	return res, tx, nil
+}
+
+// blockhashNotFound reports whether err is the preflight failure for an
+// unknown blockhash, which is also how a consumed durable nonce surfaces.
+func blockhashNotFound(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "BlockhashNotFound") || strings.Contains(msg, "Blockhash not found")
+}
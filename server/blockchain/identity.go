@@ -2,59 +2,70 @@ package blockchain
 
 import (
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
 
 	"github.com/gagliardetto/solana-go"
-	"github.com/gagliardetto/solana-go/rpc"
 )
 
-// MemoV2ProgramID is the address of the Solana Memo v2 program.
-var MemoV2ProgramID = solana.MustPublicKeyFromBase58("MemoSq4gqABAXKbbz9qDC7y18fHFoqnuGc2DUCfEJTg")
-
-// memoInstruction implements solana.Instruction for a Memo v2 write.
-type memoInstruction struct {
-	memo   string
-	signer solana.PublicKey
-}
-
-func (i *memoInstruction) ProgramID() solana.PublicKey { return MemoV2ProgramID }
-
-func (i *memoInstruction) Accounts() []*solana.AccountMeta {
-	return []*solana.AccountMeta{
-		{
-			PublicKey:  i.signer,
-			IsSigner:  true,
-			IsWritable: false,
-		},
-	}
+// IdentityMemo anchors an email↔pubkey mapping on-chain.
+type IdentityMemo struct {
+	Email  string `json:"email"`
+	Pubkey string `json:"pubkey"`
 }
 
-func (i *memoInstruction) Data() ([]byte, error) { return []byte(i.memo), nil }
+func (IdentityMemo) MemoAction() string { return "identity" }
 
 // CreateIdentityMemoTx builds an *unsigned* memo transaction that anchors the
-// email↔pubkey mapping.  The returned base64 string is meant to be sent to
-// the client, signed there, and submitted back via SendTransaction.
+// email↔pubkey mapping.  It is a convenience wrapper around BuildMemoTx.
 func CreateIdentityMemoTx(ctx context.Context, c *Client, pubkey solana.PublicKey, email string) (string, error) {
-	latest, err := c.RPC.GetLatestBlockhash(ctx, rpc.CommitmentFinalized)
-	if err != nil {
-		return "", fmt.Errorf("get blockhash: %w", err)
-	}
+	return BuildMemoTx(ctx, c, pubkey, IdentityMemo{Email: email, Pubkey: pubkey.String()})
+}
 
-	memoText := fmt.Sprintf(`{"action":"identity","email":"%s","pubkey":"%s"}`, email, pubkey.String())
+// CreateDurableIdentityMemoTx is CreateIdentityMemoTx using a durable nonce,
+// for signers that may take longer than a blockhash lifetime to sign.
+func CreateDurableIdentityMemoTx(ctx context.Context, c *Client, pubkey solana.PublicKey, email string, nonce DurableNonce) (string, error) {
+	return BuildDurableMemoTx(ctx, c, pubkey, nonce, IdentityMemo{Email: email, Pubkey: pubkey.String()})
+}
 
-	tx, err := solana.NewTransaction(
-		[]solana.Instruction{&memoInstruction{memo: memoText, signer: pubkey}},
-		latest.Value.Blockhash,
-		solana.TransactionPayer(pubkey),
-	)
-	if err != nil {
-		return "", fmt.Errorf("new tx: %w", err)
-	}
+// ErrNotIdentityTx is returned by ParseIdentityTx for transactions that do
+// not anchor exactly one identity.
+var ErrNotIdentityTx = errors.New("not an identity transaction")
 
-	txBytes, err := tx.MarshalBinary()
+// ParseIdentityTx decodes a signed base64 transaction built by
+// CreateIdentityMemoTx or CreateDurableIdentityMemoTx and returns the
+// identity memo it carries and its signature, so that an identity can be
+// registered from what the transaction anchors rather than from what the
+// client says it does.  The memo must name a pubkey that signed the
+// transaction, and every signature must verify.
+func ParseIdentityTx(txBase64 string) (IdentityMemo, solana.Signature, error) {
+	tx, err := solana.TransactionFromBase64(txBase64)
 	if err != nil {
-		return "", fmt.Errorf("marshal tx: %w", err)
+		return IdentityMemo{}, solana.Signature{}, fmt.Errorf("parse tx: %w", err)
+	}
+	var memos []IdentityMemo
+	for _, inst := range tx.Message.Instructions {
+		program, err := tx.Message.Program(inst.ProgramIDIndex)
+		if err != nil || !program.Equals(MemoV2ProgramID) {
+			continue
+		}
+		if memo, err := ParseIdentityMemo(string(inst.Data)); err == nil {
+			memos = append(memos, memo)
+		}
+	}
+	if len(memos) != 1 {
+		return IdentityMemo{}, solana.Signature{}, fmt.Errorf("%w: want one identity memo, found %d", ErrNotIdentityTx, len(memos))
+	}
+	memo := memos[0]
+	signer, err := solana.PublicKeyFromBase58(memo.Pubkey)
+	if err != nil || !tx.IsSigner(signer) {
+		return IdentityMemo{}, solana.Signature{}, fmt.Errorf("%w: memo pubkey did not sign it", ErrNotIdentityTx)
+	}
+	if len(tx.Signatures) == 0 || tx.Signatures[0].IsZero() {
+		return IdentityMemo{}, solana.Signature{}, fmt.Errorf("%w: transaction is not signed", ErrNotIdentityTx)
+	}
+	if err := tx.VerifySignatures(); err != nil {
+		return IdentityMemo{}, solana.Signature{}, fmt.Errorf("%w: %v", ErrNotIdentityTx, err)
 	}
-	return base64.StdEncoding.EncodeToString(txBytes), nil
+	return memo, tx.Signatures[0], nil
 }
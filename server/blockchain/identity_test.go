@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"strings"
 	"testing"
 
@@ -80,23 +81,16 @@ func TestMemoInstruction_Data(t *testing.T) {
 }
 
 func TestCreateIdentityMemoTx_TransactionStructure(t *testing.T) {
-	// Note: This test requires a real RPC connection to get blockhash
-	// For unit testing, we'll skip if RPC is not available
-	// In CI/CD, you might want to use a local validator or mock
-
 	ctx := context.Background()
 
-	// Use a devnet endpoint for testing (or skip if not available)
-	client := NewClient("https://api.devnet.solana.com")
+	client := newTestClient(t)
 
 	pubkey := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
 	email := "alice@mulamail.com"
 
 	txBase64, err := CreateIdentityMemoTx(ctx, client, pubkey, email)
 	if err != nil {
-		// Skip test if devnet is unavailable
-		t.Skipf("CreateIdentityMemoTx failed (devnet may be unavailable): %v", err)
-		return
+		t.Fatalf("CreateIdentityMemoTx failed: %v", err)
 	}
 
 	if txBase64 == "" {
@@ -133,15 +127,14 @@ func TestCreateIdentityMemoTx_TransactionStructure(t *testing.T) {
 
 func TestCreateIdentityMemoTx_MemoContent(t *testing.T) {
 	ctx := context.Background()
-	client := NewClient("https://api.devnet.solana.com")
+	client := newTestClient(t)
 
 	pubkey := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
 	email := "bob@example.com"
 
 	txBase64, err := CreateIdentityMemoTx(ctx, client, pubkey, email)
 	if err != nil {
-		t.Skipf("CreateIdentityMemoTx failed (devnet may be unavailable): %v", err)
-		return
+		t.Fatalf("CreateIdentityMemoTx failed: %v", err)
 	}
 
 	// Decode transaction
@@ -210,7 +203,7 @@ func TestCreateIdentityMemoTx_DifferentInputs(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	client := NewClient("https://api.devnet.solana.com")
+	client := newTestClient(t)
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -218,8 +211,7 @@ func TestCreateIdentityMemoTx_DifferentInputs(t *testing.T) {
 
 			txBase64, err := CreateIdentityMemoTx(ctx, client, pubkey, tc.email)
 			if err != nil {
-				t.Skipf("CreateIdentityMemoTx failed: %v", err)
-				return
+				t.Fatalf("CreateIdentityMemoTx failed: %v", err)
 			}
 
 			if txBase64 == "" {
@@ -246,15 +238,14 @@ func TestMemoV2ProgramID_Constant(t *testing.T) {
 
 func TestCreateIdentityMemoTx_Base64Encoding(t *testing.T) {
 	ctx := context.Background()
-	client := NewClient("https://api.devnet.solana.com")
+	client := newTestClient(t)
 
 	pubkey := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
 	email := "test@example.com"
 
 	txBase64, err := CreateIdentityMemoTx(ctx, client, pubkey, email)
 	if err != nil {
-		t.Skipf("CreateIdentityMemoTx failed: %v", err)
-		return
+		t.Fatalf("CreateIdentityMemoTx failed: %v", err)
 	}
 
 	// Verify it's valid base64
@@ -276,16 +267,9 @@ func TestCreateIdentityMemoTx_Base64Encoding(t *testing.T) {
 }
 
 func TestCreateIdentityMemoTx_EmailJSONEscaping(t *testing.T) {
-	// NOTE: This test documents a known limitation: emails with special JSON characters
-	// (quotes, backslashes) will not be properly escaped in the current implementation.
-	// The implementation uses fmt.Sprintf instead of json.Marshal.
-	// This is acceptable for Phase 1 since valid email addresses don't contain these characters.
-	// Future enhancement: use json.Marshal for proper escaping.
-
-	t.Skip("Known limitation: current implementation doesn't escape JSON special chars in emails")
-
+	// The memo is built with json.Marshal, so special characters are escaped.
 	ctx := context.Background()
-	client := NewClient("https://api.devnet.solana.com")
+	client := newTestClient(t)
 
 	pubkey := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
 
@@ -294,21 +278,24 @@ func TestCreateIdentityMemoTx_EmailJSONEscaping(t *testing.T) {
 
 	txBase64, err := CreateIdentityMemoTx(ctx, client, pubkey, email)
 	if err != nil {
-		t.Skipf("CreateIdentityMemoTx failed: %v", err)
-		return
+		t.Fatalf("CreateIdentityMemoTx failed: %v", err)
 	}
 
 	// Decode and extract memo
 	tx, _ := solana.TransactionFromBase64(txBase64)
 
-	if len(tx.Message.Instructions) > 0 {
-		memoData := string(tx.Message.Instructions[0].Data)
+	if len(tx.Message.Instructions) == 0 {
+		t.Fatal("no instructions in transaction")
+	}
+	memoData := string(tx.Message.Instructions[0].Data)
 
-		// Verify it's valid JSON despite special characters
-		var memoJSON map[string]string
-		if err := json.Unmarshal([]byte(memoData), &memoJSON); err != nil {
-			t.Errorf("memo with special chars is not valid JSON: %v", err)
-		}
+	// Verify it's valid JSON despite special characters
+	var memoJSON map[string]string
+	if err := json.Unmarshal([]byte(memoData), &memoJSON); err != nil {
+		t.Errorf("memo with special chars is not valid JSON: %v", err)
+	}
+	if memoJSON["email"] != email {
+		t.Errorf("email: want %q, got %q", email, memoJSON["email"])
 	}
 }
 
@@ -316,3 +303,85 @@ func TestMemoInstruction_Interface(t *testing.T) {
 	// Verify memoInstruction implements solana.Instruction interface
 	var _ solana.Instruction = (*memoInstruction)(nil)
 }
+
+func TestCreateIdentityMemoTx_EmailTooLong(t *testing.T) {
+	pubkey := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
+	email := strings.Repeat("a", 500) + "@example.com"
+
+	_, err := CreateIdentityMemoTx(context.Background(), newTestClient(t), pubkey, email)
+	if !errors.Is(err, ErrMemoTooLarge) {
+		t.Fatalf("want ErrMemoTooLarge, got %v", err)
+	}
+
+	var tooLarge *MemoTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("want *MemoTooLargeError, got %T", err)
+	}
+	if tooLarge.Max != MaxMemoSize || tooLarge.Size <= len(email) {
+		t.Errorf("unexpected sizes %+v", tooLarge)
+	}
+}
+
+func TestParseIdentityTx(t *testing.T) {
+	client := newTestClient(t)
+	wallet := solana.NewWallet()
+	sign := func(txB64 string) (string, solana.Signature) {
+		t.Helper()
+		tx, err := solana.TransactionFromBase64(txB64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs, err := tx.Sign(func(key solana.PublicKey) *solana.PrivateKey {
+			if key.Equals(wallet.PublicKey()) {
+				return &wallet.PrivateKey
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx.MustToBase64(), sigs[0]
+	}
+
+	unsigned, err := CreateIdentityMemoTx(context.Background(), client, wallet.PublicKey(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, wantSig := sign(unsigned)
+	memo, sig, err := ParseIdentityTx(signed)
+	if err != nil {
+		t.Fatalf("ParseIdentityTx failed: %v", err)
+	}
+	if memo != (IdentityMemo{Email: "alice@example.com", Pubkey: wallet.PublicKey().String()}) || sig != wantSig {
+		t.Errorf("want alice's memo signed %s, got %+v signed %s", wantSig, memo, sig)
+	}
+
+	if _, _, err := ParseIdentityTx(unsigned); !errors.Is(err, ErrNotIdentityTx) {
+		t.Errorf("unsigned: want ErrNotIdentityTx, got %v", err)
+	}
+	tampered, _ := solana.TransactionFromBase64(signed)
+	tampered.Signatures[0][0] ^= 0xff
+	if _, _, err := ParseIdentityTx(tampered.MustToBase64()); !errors.Is(err, ErrNotIdentityTx) {
+		t.Errorf("bad signature: want ErrNotIdentityTx, got %v", err)
+	}
+
+	// A memo claiming someone else's pubkey, signed by the wallet.
+	other := solana.NewWallet().PublicKey()
+	tx, _ := solana.NewTransaction([]solana.Instruction{
+		&memoInstruction{memo: `{"action":"identity","email":"bob@example.com","pubkey":"` + other.String() + `"}`, signer: wallet.PublicKey()},
+	}, solana.Hash{1}, solana.TransactionPayer(wallet.PublicKey()))
+	if _, _, err := ParseIdentityTx(tx.MustToBase64()); !errors.Is(err, ErrNotIdentityTx) {
+		t.Errorf("foreign pubkey: want ErrNotIdentityTx, got %v", err)
+	}
+
+	tip, err := BuildTipTx(context.Background(), client, Tip{From: wallet.PublicKey(), To: other, Lamports: 1, MessageID: "<m@example.com>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ParseIdentityTx(tip); !errors.Is(err, ErrNotIdentityTx) {
+		t.Errorf("tip transaction: want ErrNotIdentityTx, got %v", err)
+	}
+	if _, _, err := ParseIdentityTx("not base64"); err == nil {
+		t.Error("garbage: want an error")
+	}
+}
@@ -0,0 +1,166 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// MemoV2ProgramID is the address of the Solana Memo v2 program.
+var MemoV2ProgramID = solana.MustPublicKeyFromBase58("MemoSq4gqABAXKbbz9qDC7y18fHFoqnuGc2DUCfEJTg")
+
+// MaxMemoSize is the largest memo, in bytes, that fits in a transaction with
+// a single signer.  Transactions with more signers or instructions, such as
+// durable-nonce transactions, leave less room.
+const MaxMemoSize = 566
+
+// maxTransactionSize is the largest serialized transaction the cluster
+// accepts.
+const maxTransactionSize = 1232
+
+// MemoPayload is the body of a MulaMail memo.  It is serialized with
+// json.Marshal and must encode as a JSON object; the memo written on-chain is
+// that object with an "action" field naming the payload type prepended.
+type MemoPayload interface {
+	MemoAction() string
+}
+
+// ErrMemoTooLarge matches, via errors.Is, every *MemoTooLargeError.
+var ErrMemoTooLarge = errors.New("memo too large")
+
+// MemoTooLargeError reports a memo that exceeds MaxMemoSize.  The Memo
+// program would otherwise reject it only after the client signed and the
+// transaction was broadcast.
+type MemoTooLargeError struct {
+	Size int
+	Max  int
+}
+
+func (e *MemoTooLargeError) Error() string {
+	return fmt.Sprintf("%v: %d bytes, limit is %d", ErrMemoTooLarge, e.Size, e.Max)
+}
+
+func (e *MemoTooLargeError) Is(target error) bool { return target == ErrMemoTooLarge }
+
+// memoInstruction implements solana.Instruction for a Memo v2 write.
+type memoInstruction struct {
+	memo   string
+	signer solana.PublicKey
+}
+
+func (i *memoInstruction) ProgramID() solana.PublicKey { return MemoV2ProgramID }
+
+func (i *memoInstruction) Accounts() []*solana.AccountMeta {
+	return []*solana.AccountMeta{
+		{
+			PublicKey:  i.signer,
+			IsSigner:   true,
+			IsWritable: false,
+		},
+	}
+}
+
+func (i *memoInstruction) Data() ([]byte, error) { return []byte(i.memo), nil }
+
+// BuildMemoTx builds an *unsigned* transaction writing payload as a memo,
+// signed and paid for by signer.  The returned base64 string is meant to be
+// sent to the client, signed there, and submitted back via SendTransaction.
+// A payload that encodes to more than MaxMemoSize bytes is rejected with a
+// *MemoTooLargeError before any RPC call is made.
+func BuildMemoTx(ctx context.Context, c *Client, signer solana.PublicKey, payload MemoPayload) (string, error) {
+	memo, err := encodeMemo(payload)
+	if err != nil {
+		return "", err
+	}
+	return buildMemoTx(ctx, c, signer, memo)
+}
+
+// CreateMemoTx builds an *unsigned* transaction carrying payload, encoded as
+// JSON, as a memo signed and paid for by signer.  Unlike BuildMemoTx it
+// writes the JSON as it stands, without an "action" field, unless payload is
+// a MemoPayload, in which case it is equivalent to BuildMemoTx.  The same
+// MaxMemoSize limit applies.
+func CreateMemoTx(ctx context.Context, c *Client, signer solana.PublicKey, payload any) (string, error) {
+	if p, ok := payload.(MemoPayload); ok {
+		return BuildMemoTx(ctx, c, signer, p)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("encode memo: %w", err)
+	}
+	if len(body) > MaxMemoSize {
+		return "", &MemoTooLargeError{Size: len(body), Max: MaxMemoSize}
+	}
+	return buildMemoTx(ctx, c, signer, string(body))
+}
+
+// buildMemoTx builds the unsigned transaction writing an already encoded
+// memo.
+func buildMemoTx(ctx context.Context, c *Client, signer solana.PublicKey, memo string) (string, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	latest, err := c.RPC.GetLatestBlockhash(ctx, rpc.CommitmentFinalized)
+	if err != nil {
+		return "", fmt.Errorf("get blockhash: %w", err)
+	}
+
+	tx, err := solana.NewTransaction(
+		[]solana.Instruction{&memoInstruction{memo: memo, signer: signer}},
+		latest.Value.Blockhash,
+		solana.TransactionPayer(signer),
+	)
+	if err != nil {
+		return "", fmt.Errorf("new tx: %w", err)
+	}
+	return encodeMemoTx(tx, memo)
+}
+
+// encodeMemoTx serializes a transaction carrying memo as base64, rejecting
+// it if it would not fit in a packet.
+func encodeMemoTx(tx *solana.Transaction, memo string) (string, error) {
+	txBytes, err := tx.MarshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("marshal tx: %w", err)
+	}
+	if over := len(txBytes) - maxTransactionSize; over > 0 {
+		return "", &MemoTooLargeError{Size: len(memo), Max: len(memo) - over}
+	}
+	return base64.StdEncoding.EncodeToString(txBytes), nil
+}
+
+// encodeMemo renders payload as the memo text and enforces MaxMemoSize.
+func encodeMemo(payload MemoPayload) (string, error) {
+	action, err := json.Marshal(payload.MemoAction())
+	if err != nil {
+		return "", fmt.Errorf("encode memo: %w", err)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("encode memo: %w", err)
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) < 2 || body[0] != '{' {
+		return "", fmt.Errorf("encode memo: %s payload is not a JSON object", payload.MemoAction())
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"action":`)
+	buf.Write(action)
+	if fields := body[1:]; fields[0] != '}' {
+		buf.WriteByte(',')
+		buf.Write(fields)
+	} else {
+		buf.WriteByte('}')
+	}
+
+	if buf.Len() > MaxMemoSize {
+		return "", &MemoTooLargeError{Size: buf.Len(), Max: MaxMemoSize}
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,191 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+// rpcError makes a newFakeRPC handler answer with a JSON-RPC error.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// newFakeRPC returns a Client backed by a JSON-RPC endpoint that answers
+// each method with the result of its handler.
+func newFakeRPC(t *testing.T, handlers map[string]func(params json.RawMessage) any) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		handler, ok := handlers[req.Method]
+		if !ok {
+			http.Error(w, "unexpected method "+req.Method, http.StatusBadRequest)
+			return
+		}
+		resp := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+		if result := handler(req.Params); isRPCError(result) {
+			resp["error"] = result
+		} else {
+			resp["result"] = result
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL)
+}
+
+func isRPCError(v any) bool {
+	_, ok := v.(rpcError)
+	return ok
+}
+
+// newTestClient returns a Client that can build transactions without a
+// network.
+func newTestClient(t *testing.T) *Client {
+	return newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"getLatestBlockhash": latestBlockhashResult,
+	})
+}
+
+func latestBlockhashResult(json.RawMessage) any {
+	return map[string]any{
+		"context": map[string]any{"slot": 1},
+		"value": map[string]any{
+			"blockhash":            "EkSnNWid2cvwEVnVx9aBqawnmiCNiDgp3gUdkDPTKN1N",
+			"lastValidBlockHeight": 100,
+		},
+	}
+}
+
+type testMemo struct {
+	Note string `json:"note,omitempty"`
+}
+
+func (testMemo) MemoAction() string { return "test" }
+
+func TestEncodeMemo(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload MemoPayload
+		want    string
+	}{
+		{"identity", IdentityMemo{Email: "a@example.com", Pubkey: "abc"}, `{"action":"identity","email":"a@example.com","pubkey":"abc"}`},
+		{"no fields", testMemo{}, `{"action":"test"}`},
+		{"escaping", testMemo{Note: `say "hi"`}, `{"action":"test","note":"say \"hi\""}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := encodeMemo(tc.payload)
+			if err != nil {
+				t.Fatalf("encodeMemo: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBuildMemoTx(t *testing.T) {
+	signer := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
+
+	txBase64, err := BuildMemoTx(context.Background(), newTestClient(t), signer, testMemo{Note: "hello"})
+	if err != nil {
+		t.Fatalf("BuildMemoTx: %v", err)
+	}
+	tx, err := solana.TransactionFromBase64(txBase64)
+	if err != nil {
+		t.Fatalf("decode tx: %v", err)
+	}
+	if tx.Message.AccountKeys[0] != signer {
+		t.Errorf("payer: want %s, got %s", signer, tx.Message.AccountKeys[0])
+	}
+	if memo := string(tx.Message.Instructions[0].Data); memo != `{"action":"test","note":"hello"}` {
+		t.Errorf("unexpected memo %s", memo)
+	}
+}
+
+func TestBuildMemoTx_TooLarge(t *testing.T) {
+	signer := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
+
+	_, err := BuildMemoTx(context.Background(), newTestClient(t), signer, testMemo{Note: strings.Repeat("x", MaxMemoSize)})
+
+	var tooLarge *MemoTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("want *MemoTooLargeError, got %v", err)
+	}
+	if tooLarge.Max != MaxMemoSize || tooLarge.Size <= MaxMemoSize {
+		t.Errorf("unexpected sizes %+v", tooLarge)
+	}
+}
+
+func TestCreateMemoTx(t *testing.T) {
+	signer := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
+	c := newTestClient(t)
+
+	tests := []struct {
+		name    string
+		payload any
+		want    string
+	}{
+		{"raw", map[string]string{"note": "hello"}, `{"note":"hello"}`},
+		{"typed", testMemo{Note: "hello"}, `{"action":"test","note":"hello"}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			txBase64, err := CreateMemoTx(context.Background(), c, signer, tc.payload)
+			if err != nil {
+				t.Fatalf("CreateMemoTx: %v", err)
+			}
+			tx, err := solana.TransactionFromBase64(txBase64)
+			if err != nil {
+				t.Fatalf("decode tx: %v", err)
+			}
+			if memo := string(tx.Message.Instructions[0].Data); memo != tc.want {
+				t.Errorf("want memo %s, got %s", tc.want, memo)
+			}
+		})
+	}
+
+	_, err := CreateMemoTx(context.Background(), c, signer, strings.Repeat("x", MaxMemoSize))
+	if !errors.Is(err, ErrMemoTooLarge) {
+		t.Errorf("oversized payload: want ErrMemoTooLarge, got %v", err)
+	}
+}
+
+func TestBuildMemoTx_RPCTimeout(t *testing.T) {
+	signer := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
+
+	release := make(chan struct{})
+	c := newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"getLatestBlockhash": func(params json.RawMessage) any {
+			<-release
+			return latestBlockhashResult(params)
+		},
+	})
+	t.Cleanup(func() { close(release) }) // runs before the fake server shuts down
+	c.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := BuildMemoTx(context.Background(), c, signer, testMemo{Note: "hello"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("BuildMemoTx took %v to time out", elapsed)
+	}
+}
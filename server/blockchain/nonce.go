@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/system"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// nonceAccountSize is the length of a system nonce account's data: version,
+// state, authority, nonce value and fee calculator.
+const nonceAccountSize = 4 + 4 + 32 + 32 + 8
+
+// ErrNonceUninitialized is returned for accounts that are not initialized
+// nonce accounts.
+var ErrNonceUninitialized = errors.New("not an initialized nonce account")
+
+// NonceAccount is the current state of a durable nonce account.
+type NonceAccount struct {
+	Authority solana.PublicKey
+	Nonce     solana.Hash
+}
+
+// GetNonceAccount reads the authority and current nonce value of a durable
+// nonce account.
+func (c *Client) GetNonceAccount(ctx context.Context, pubkey solana.PublicKey) (*NonceAccount, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	res, err := c.RPC.GetAccountInfoWithOpts(ctx, pubkey, &rpc.GetAccountInfoOpts{
+		Encoding:   solana.EncodingBase64,
+		Commitment: rpc.CommitmentFinalized,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get nonce account: %w", err)
+	}
+	if res.Value == nil || !res.Value.Owner.Equals(solana.SystemProgramID) {
+		return nil, ErrNonceUninitialized
+	}
+	data := res.Value.Data.GetBinary()
+	// State 1 is Initialized; 0 is Uninitialized.
+	if len(data) != nonceAccountSize || binary.LittleEndian.Uint32(data[4:8]) != 1 {
+		return nil, ErrNonceUninitialized
+	}
+	acc := &NonceAccount{}
+	copy(acc.Authority[:], data[8:40])
+	copy(acc.Nonce[:], data[40:72])
+	return acc, nil
+}
+
+// DurableNonce is a nonce account whose authority the server holds, used
+// to build transactions that stay valid until the nonce is advanced rather
+// than for the ~60s lifetime of a recent blockhash.
+type DurableNonce struct {
+	Account   solana.PublicKey
+	Authority solana.PrivateKey
+}
+
+// BuildDurableMemoTx is like BuildMemoTx but uses nonce in place of a recent
+// blockhash.  The first instruction advances the nonce, and the transaction
+// is returned already signed by the nonce authority; only signer's signature
+// is missing.  Any other transaction using the same nonce account
+// invalidates it.
+func BuildDurableMemoTx(ctx context.Context, c *Client, signer solana.PublicKey, nonce DurableNonce, payload MemoPayload) (string, error) {
+	memo, err := encodeMemo(payload)
+	if err != nil {
+		return "", err
+	}
+
+	acc, err := c.GetNonceAccount(ctx, nonce.Account)
+	if err != nil {
+		return "", err
+	}
+	authority := nonce.Authority.PublicKey()
+	if !acc.Authority.Equals(authority) {
+		return "", fmt.Errorf("nonce account authority is %s, not the configured key %s", acc.Authority, authority)
+	}
+
+	tx, err := solana.NewTransaction(
+		[]solana.Instruction{
+			system.NewAdvanceNonceAccountInstruction(nonce.Account, solana.SysVarRecentBlockHashesPubkey, authority).Build(),
+			&memoInstruction{memo: memo, signer: signer},
+		},
+		acc.Nonce,
+		solana.TransactionPayer(signer),
+	)
+	if err != nil {
+		return "", fmt.Errorf("new tx: %w", err)
+	}
+	if _, err := tx.PartialSign(func(key solana.PublicKey) *solana.PrivateKey {
+		if key.Equals(authority) {
+			return &nonce.Authority
+		}
+		return nil
+	}); err != nil {
+		return "", fmt.Errorf("sign with nonce authority: %w", err)
+	}
+	return encodeMemoTx(tx, memo)
+}
@@ -0,0 +1,131 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+// nonceAccountResult is a getAccountInfo result for an initialized nonce
+// account.
+func nonceAccountResult(authority solana.PublicKey, nonce solana.Hash) func(json.RawMessage) any {
+	return func(json.RawMessage) any {
+		data := make([]byte, nonceAccountSize)
+		binary.LittleEndian.PutUint32(data[0:4], 1)
+		binary.LittleEndian.PutUint32(data[4:8], 1)
+		copy(data[8:40], authority[:])
+		copy(data[40:72], nonce[:])
+		return map[string]any{
+			"context": map[string]any{"slot": 1},
+			"value": map[string]any{
+				"data":       []string{base64.StdEncoding.EncodeToString(data), "base64"},
+				"executable": false,
+				"lamports":   1447680,
+				"owner":      solana.SystemProgramID.String(),
+				"rentEpoch":  0,
+			},
+		}
+	}
+}
+
+func TestGetNonceAccount(t *testing.T) {
+	authority := solana.NewWallet().PublicKey()
+	nonce := solana.Hash{1, 2, 3}
+	client := newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"getAccountInfo": nonceAccountResult(authority, nonce),
+	})
+
+	acc, err := client.GetNonceAccount(context.Background(), solana.NewWallet().PublicKey())
+	if err != nil {
+		t.Fatalf("GetNonceAccount: %v", err)
+	}
+	if acc.Authority != authority || acc.Nonce != nonce {
+		t.Errorf("unexpected nonce account %+v", acc)
+	}
+}
+
+func TestBuildDurableMemoTx(t *testing.T) {
+	authority := solana.NewWallet().PrivateKey
+	nonce := DurableNonce{Account: solana.NewWallet().PublicKey(), Authority: authority}
+	nonceValue := solana.Hash{9, 9, 9}
+	client := newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"getAccountInfo": nonceAccountResult(authority.PublicKey(), nonceValue),
+	})
+	signer := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
+
+	txBase64, err := CreateDurableIdentityMemoTx(context.Background(), client, signer, "slow@example.com", nonce)
+	if err != nil {
+		t.Fatalf("CreateDurableIdentityMemoTx: %v", err)
+	}
+	tx, err := solana.TransactionFromBase64(txBase64)
+	if err != nil {
+		t.Fatalf("decode tx: %v", err)
+	}
+
+	if tx.Message.RecentBlockhash != nonceValue {
+		t.Errorf("blockhash: want nonce value %s, got %s", nonceValue, tx.Message.RecentBlockhash)
+	}
+	if tx.Message.AccountKeys[0] != signer {
+		t.Errorf("payer: want %s, got %s", signer, tx.Message.AccountKeys[0])
+	}
+	if len(tx.Message.Instructions) != 2 {
+		t.Fatalf("expected advance-nonce and memo instructions, got %d", len(tx.Message.Instructions))
+	}
+	if program, _ := tx.Message.Program(tx.Message.Instructions[0].ProgramIDIndex); program != solana.SystemProgramID {
+		t.Errorf("first instruction should advance the nonce, got program %s", program)
+	}
+	if program, _ := tx.Message.Program(tx.Message.Instructions[1].ProgramIDIndex); program != MemoV2ProgramID {
+		t.Errorf("second instruction should be the memo, got program %s", program)
+	}
+
+	// The authority has signed; the user's signature is still missing.
+	message, _ := tx.Message.MarshalBinary()
+	for i, key := range tx.Message.AccountKeys[:tx.Message.Header.NumRequiredSignatures] {
+		switch key {
+		case signer:
+			if !tx.Signatures[i].IsZero() {
+				t.Error("user signature slot should be empty")
+			}
+		case authority.PublicKey():
+			if !tx.Signatures[i].Verify(key, message) {
+				t.Error("missing or invalid nonce authority signature")
+			}
+		}
+	}
+}
+
+func TestBuildDurableMemoTx_WrongAuthority(t *testing.T) {
+	nonce := DurableNonce{Account: solana.NewWallet().PublicKey(), Authority: solana.NewWallet().PrivateKey}
+	client := newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"getAccountInfo": nonceAccountResult(solana.NewWallet().PublicKey(), solana.Hash{1}),
+	})
+
+	if _, err := BuildDurableMemoTx(context.Background(), client, solana.NewWallet().PublicKey(), nonce, testMemo{}); err == nil {
+		t.Error("expected an error when the configured key is not the nonce authority")
+	}
+}
+
+func TestSendTransaction_Expired(t *testing.T) {
+	client := newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"sendTransaction": func(json.RawMessage) any {
+			return rpcError{Code: -32002, Message: "Transaction simulation failed: Blockhash not found"}
+		},
+	})
+	tx, err := solana.NewTransaction(
+		[]solana.Instruction{&memoInstruction{memo: "x", signer: solana.NewWallet().PublicKey()}},
+		solana.Hash{1})
+	if err != nil {
+		t.Fatalf("new tx: %v", err)
+	}
+	raw, _ := tx.MarshalBinary()
+
+	_, err = client.SendTransaction(context.Background(), base64.StdEncoding.EncodeToString(raw))
+	if !errors.Is(err, ErrTxExpired) {
+		t.Errorf("want ErrTxExpired, got %v", err)
+	}
+}
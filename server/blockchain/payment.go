@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// VerifyTokenTransfer reports whether the finalized transaction sig was
+// signed by signer, succeeded and increased the expectedMint balance of the
+// token account expectedDest by at least minAmount base units.  Requiring
+// signer's signature, as the fee payer or the transfer's authority, ties the
+// payment to the wallet that made it.  Balances are compared
+// before and after the whole transaction, so several transfers to
+// expectedDest are summed and transfers back out are netted off.
+//
+// For wrapped SOL the lamport balance of expectedDest is used when the
+// account existed beforehand, which also counts plain SOL transfers into it
+// that have not yet been synced into its token amount.
+func (c *Client) VerifyTokenTransfer(ctx context.Context, sig solana.Signature, signer, expectedMint, expectedDest solana.PublicKey, minAmount uint64) (bool, error) {
+	res, tx, err := c.getTransaction(ctx, sig)
+	if err != nil {
+		return false, err
+	}
+	if res.Meta == nil {
+		return false, fmt.Errorf("transaction %s has no status metadata", sig)
+	}
+	if res.Meta.Err != nil {
+		return false, nil
+	}
+	signers := tx.Message.AccountKeys[:min(int(tx.Message.Header.NumRequiredSignatures), len(tx.Message.AccountKeys))]
+	if !signers.Contains(signer) {
+		return false, nil
+	}
+
+	keys := append(solana.PublicKeySlice{}, tx.Message.AccountKeys...)
+	keys = append(keys, res.Meta.LoadedAddresses.Writable...)
+	keys = append(keys, res.Meta.LoadedAddresses.ReadOnly...)
+	index := -1
+	for i, k := range keys {
+		if k.Equals(expectedDest) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return false, nil
+	}
+
+	pre, existed, err := tokenBalance(res.Meta.PreTokenBalances, index, expectedMint)
+	if err != nil {
+		return false, err
+	}
+	post, _, err := tokenBalance(res.Meta.PostTokenBalances, index, expectedMint)
+	if err != nil {
+		return false, err
+	}
+	received := saturatingSub(post, pre)
+
+	if expectedMint.Equals(solana.WrappedSol) && existed &&
+		index < len(res.Meta.PreBalances) && index < len(res.Meta.PostBalances) {
+		received = max(received, saturatingSub(res.Meta.PostBalances[index], res.Meta.PreBalances[index]))
+	}
+	return received >= minAmount, nil
+}
+
+// tokenBalance returns the mint balance of the account at index, and
+// whether the account held that mint at all.
+func tokenBalance(balances []rpc.TokenBalance, index int, mint solana.PublicKey) (uint64, bool, error) {
+	for _, b := range balances {
+		if int(b.AccountIndex) != index || !b.Mint.Equals(mint) || b.UiTokenAmount == nil {
+			continue
+		}
+		amount, err := strconv.ParseUint(b.UiTokenAmount.Amount, 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("parse token amount %q: %w", b.UiTokenAmount.Amount, err)
+		}
+		return amount, true, nil
+	}
+	return 0, false, nil
+}
+
+func saturatingSub(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
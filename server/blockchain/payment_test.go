@@ -0,0 +1,153 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+// paymentTx describes the balances reported for a fake payment transaction.
+type paymentTx struct {
+	mint          solana.PublicKey
+	pre, post     string // token amounts of the destination; "" = no entry
+	preLamports   uint64
+	postLamports  uint64
+	failed        bool
+	destInMessage bool
+	payer         solana.PublicKey // signs the transaction; zero for a random wallet
+}
+
+// newFakePaymentChain serves tx as every requested transaction, paying dest.
+func newFakePaymentChain(t *testing.T, dest solana.PublicKey, tx *paymentTx) *Client {
+	t.Helper()
+	return newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"getTransaction": func(json.RawMessage) any {
+			if tx == nil {
+				return nil
+			}
+			payer := tx.payer
+			if payer.IsZero() {
+				payer = solana.NewWallet().PublicKey()
+			}
+			accounts := solana.AccountMetaSlice{solana.Meta(payer).SIGNER().WRITE()}
+			if tx.destInMessage {
+				accounts = append(accounts, solana.Meta(dest).WRITE())
+			}
+			built, err := solana.NewTransaction([]solana.Instruction{
+				solana.NewInstruction(solana.TokenProgramID, accounts, []byte{3}),
+			}, solana.Hash{1}, solana.TransactionPayer(payer))
+			if err != nil {
+				t.Errorf("build tx: %v", err)
+				return nil
+			}
+			raw, _ := built.MarshalBinary()
+
+			index := -1
+			for i, k := range built.Message.AccountKeys {
+				if k == dest {
+					index = i
+				}
+			}
+			balances := func(amount string) []map[string]any {
+				if amount == "" || index < 0 {
+					return []map[string]any{}
+				}
+				return []map[string]any{{
+					"accountIndex":  index,
+					"mint":          tx.mint.String(),
+					"uiTokenAmount": map[string]any{"amount": amount, "decimals": 6},
+				}}
+			}
+			lamports := func(dest uint64) []uint64 {
+				l := make([]uint64, len(built.Message.AccountKeys))
+				if index >= 0 {
+					l[index] = dest
+				}
+				return l
+			}
+			var txErr any
+			if tx.failed {
+				txErr = map[string]any{"InstructionError": []any{0, "Custom"}}
+			}
+			return map[string]any{
+				"slot":        1,
+				"transaction": []string{base64.StdEncoding.EncodeToString(raw), "base64"},
+				"meta": map[string]any{
+					"err":               txErr,
+					"preBalances":       lamports(tx.preLamports),
+					"postBalances":      lamports(tx.postLamports),
+					"preTokenBalances":  balances(tx.pre),
+					"postTokenBalances": balances(tx.post),
+				},
+			}
+		},
+	})
+}
+
+func TestVerifyTokenTransfer(t *testing.T) {
+	mint := solana.NewWallet().PublicKey()
+	dest := solana.NewWallet().PublicKey()
+	payer := solana.NewWallet().PublicKey()
+
+	tests := []struct {
+		name string
+		tx   paymentTx
+		want bool
+	}{
+		{"exact amount", paymentTx{mint: mint, pre: "500", post: "1500", destInMessage: true, payer: payer}, true},
+		{"account created in tx", paymentTx{mint: mint, post: "2000", destInMessage: true, payer: payer}, true},
+		{"insufficient", paymentTx{mint: mint, pre: "500", post: "1499", destInMessage: true, payer: payer}, false},
+		{"net outflow", paymentTx{mint: mint, pre: "5000", post: "4000", destInMessage: true, payer: payer}, false},
+		{"wrong mint", paymentTx{mint: solana.NewWallet().PublicKey(), pre: "0", post: "5000", destInMessage: true, payer: payer}, false},
+		{"failed transaction", paymentTx{mint: mint, pre: "0", post: "5000", destInMessage: true, failed: true, payer: payer}, false},
+		{"destination not involved", paymentTx{mint: mint, pre: "0", post: "5000", payer: payer}, false},
+		{"signed by another wallet", paymentTx{mint: mint, pre: "500", post: "1500", destInMessage: true}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakePaymentChain(t, dest, &tc.tx)
+			got, err := client.VerifyTokenTransfer(context.Background(), solana.Signature{1}, payer, mint, dest, 1000)
+			if err != nil {
+				t.Fatalf("VerifyTokenTransfer: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenTransfer_WrappedSol(t *testing.T) {
+	dest := solana.NewWallet().PublicKey()
+	payer := solana.NewWallet().PublicKey()
+
+	// SOL sent straight to the wrapped-SOL account without a sync: the
+	// token amount is unchanged but the lamports arrived.
+	unsynced := &paymentTx{mint: solana.WrappedSol, pre: "10", post: "10",
+		preLamports: 2_039_290, postLamports: 2_039_290 + 5000, destInMessage: true, payer: payer}
+	ok, err := newFakePaymentChain(t, dest, unsynced).VerifyTokenTransfer(context.Background(), solana.Signature{1}, payer, solana.WrappedSol, dest, 5000)
+	if err != nil || !ok {
+		t.Errorf("unsynced wrapped SOL: want true, got %v (%v)", ok, err)
+	}
+
+	// A wrapped-SOL account created in the transaction: its rent reserve
+	// must not count as payment.
+	created := &paymentTx{mint: solana.WrappedSol, post: "0",
+		postLamports: 2_039_280, destInMessage: true, payer: payer}
+	ok, err = newFakePaymentChain(t, dest, created).VerifyTokenTransfer(context.Background(), solana.Signature{1}, payer, solana.WrappedSol, dest, 5000)
+	if err != nil || ok {
+		t.Errorf("rent reserve counted as payment: got %v (%v)", ok, err)
+	}
+}
+
+func TestVerifyTokenTransfer_NotFound(t *testing.T) {
+	client := newFakePaymentChain(t, solana.NewWallet().PublicKey(), nil)
+	_, err := client.VerifyTokenTransfer(context.Background(), solana.Signature{1}, solana.NewWallet().PublicKey(), solana.WrappedSol, solana.NewWallet().PublicKey(), 1)
+	if !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("want ErrTxNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+// IdentityEvidence is the finalized transaction an identity was registered
+// with, as any RPC node holding its slot would return it: enough for a third
+// party to check an email↔pubkey binding without trusting MulaMail.
+type IdentityEvidence struct {
+	Signature   string
+	Slot        uint64
+	BlockTime   time.Time // zero when the node does not know it
+	Signers     []string
+	Failed      bool   // the transaction landed with an error, and so proves nothing
+	Memo        []byte // raw data of the identity memo instruction; nil when there is none
+	Transaction []byte // the transaction in wire format
+}
+
+// IdentityEvidence fetches the finalized transaction sig and picks out its
+// identity memo.  It returns ErrTxNotFound when the node does not hold the
+// transaction, as when its history has been pruned.  A finalized
+// transaction never changes, so the result may be cached indefinitely.
+func (c *Client) IdentityEvidence(ctx context.Context, sig solana.Signature) (*IdentityEvidence, error) {
+	res, tx, err := c.getTransaction(ctx, sig)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("encode transaction %s: %w", sig, err)
+	}
+	ev := &IdentityEvidence{
+		Signature:   sig.String(),
+		Slot:        res.Slot,
+		Failed:      res.Meta != nil && res.Meta.Err != nil,
+		Transaction: raw,
+	}
+	if res.BlockTime != nil {
+		ev.BlockTime = res.BlockTime.Time()
+	}
+	for _, signer := range tx.Message.Signers() {
+		ev.Signers = append(ev.Signers, signer.String())
+	}
+	for _, inst := range tx.Message.Instructions {
+		programID, err := tx.Message.Program(inst.ProgramIDIndex)
+		if err != nil || !programID.Equals(MemoV2ProgramID) {
+			continue
+		}
+		if _, err := ParseIdentityMemo(string(inst.Data)); err == nil {
+			ev.Memo = inst.Data
+			break
+		}
+	}
+	return ev, nil
+}
@@ -0,0 +1,44 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+func TestIdentityEvidence(t *testing.T) {
+	alice := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
+	memo, _ := encodeMemo(IdentityMemo{Email: "alice@example.com", Pubkey: alice.String()})
+	sig := solana.Signature{7}
+	client := newFakeChain(t, []fakeChainTx{{sig: sig, slot: 42, signer: alice, memo: memo}})
+
+	ev, err := client.IdentityEvidence(context.Background(), sig)
+	if err != nil {
+		t.Fatalf("IdentityEvidence: %v", err)
+	}
+	if ev.Signature != sig.String() || ev.Slot != 42 || ev.BlockTime.Unix() != 1700000042 || ev.Failed {
+		t.Errorf("unexpected metadata %+v", ev)
+	}
+	if string(ev.Memo) != memo {
+		t.Errorf("memo: want %s, got %s", memo, ev.Memo)
+	}
+	if len(ev.Signers) != 1 || ev.Signers[0] != alice.String() {
+		t.Errorf("signers: %v", ev.Signers)
+	}
+	tx, err := solana.TransactionFromBytes(ev.Transaction)
+	if err != nil || !tx.IsSigner(alice) {
+		t.Errorf("raw transaction does not decode to alice's: %v", err)
+	}
+}
+
+func TestIdentityEvidence_NotFound(t *testing.T) {
+	client := newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"getTransaction": func(json.RawMessage) any { return nil },
+	})
+	if _, err := client.IdentityEvidence(context.Background(), solana.Signature{1}); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("want ErrTxNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// signaturePageSize is the number of signatures requested per
+// getSignaturesForAddress call (the RPC maximum).
+const signaturePageSize = 1000
+
+// ErrNotIdentityMemo is returned by ParseIdentityMemo for memos that are not
+// MulaMail identity memos.
+var ErrNotIdentityMemo = errors.New("not an identity memo")
+
+// IdentityRecord is an identity memo found on-chain.
+type IdentityRecord struct {
+	IdentityMemo
+	TxHash    string
+	Slot      uint64
+	BlockTime time.Time
+}
+
+// ParseIdentityMemo decodes memo text written by CreateIdentityMemoTx.
+func ParseIdentityMemo(memo string) (IdentityMemo, error) {
+	var m struct {
+		Action string `json:"action"`
+		IdentityMemo
+	}
+	if err := json.Unmarshal([]byte(memo), &m); err != nil || m.Action != (IdentityMemo{}).MemoAction() {
+		return IdentityMemo{}, ErrNotIdentityMemo
+	}
+	if m.Email == "" || m.Pubkey == "" {
+		return IdentityMemo{}, fmt.Errorf("%w: missing email or pubkey", ErrNotIdentityMemo)
+	}
+	return m.IdentityMemo, nil
+}
+
+// IdentityRecords reads the transaction history of pubkey and returns the
+// identity memos it signed, oldest first.  Failed transactions and memos
+// claiming a different pubkey than the one that signed them are ignored.
+func (c *Client) IdentityRecords(ctx context.Context, pubkey solana.PublicKey) ([]IdentityRecord, error) {
+	var (
+		records []IdentityRecord
+		before  solana.Signature
+	)
+	for {
+		limit := signaturePageSize
+		rctx, cancel := c.withTimeout(ctx)
+		sigs, err := c.RPC.GetSignaturesForAddressWithOpts(rctx, pubkey, &rpc.GetSignaturesForAddressOpts{
+			Limit:  &limit,
+			Before: before,
+		})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("get signatures: %w", err)
+		}
+		for _, sig := range sigs {
+			if sig.Err != nil {
+				continue
+			}
+			recs, err := c.identityRecordsInTx(ctx, sig.Signature, pubkey)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, recs...)
+		}
+		if len(sigs) < signaturePageSize {
+			break
+		}
+		before = sigs[len(sigs)-1].Signature
+	}
+
+	// Signatures arrive newest first.
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// identityRecordsInTx returns the identity memos for pubkey in one
+// transaction.
+func (c *Client) identityRecordsInTx(ctx context.Context, sig solana.Signature, pubkey solana.PublicKey) ([]IdentityRecord, error) {
+	res, tx, err := c.getTransaction(ctx, sig)
+	if errors.Is(err, ErrTxNotFound) {
+		// History no longer held by this RPC node.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.Meta != nil && res.Meta.Err != nil {
+		return nil, nil
+	}
+	if !tx.IsSigner(pubkey) {
+		return nil, nil
+	}
+
+	var records []IdentityRecord
+	for _, inst := range tx.Message.Instructions {
+		programID, err := tx.Message.Program(inst.ProgramIDIndex)
+		if err != nil || !programID.Equals(MemoV2ProgramID) {
+			continue
+		}
+		memo, err := ParseIdentityMemo(string(inst.Data))
+		if err != nil || memo.Pubkey != pubkey.String() {
+			continue
+		}
+		rec := IdentityRecord{IdentityMemo: memo, TxHash: sig.String(), Slot: res.Slot}
+		if res.BlockTime != nil {
+			rec.BlockTime = res.BlockTime.Time()
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
@@ -0,0 +1,122 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+func TestParseIdentityMemo(t *testing.T) {
+	m, err := ParseIdentityMemo(`{"action":"identity","email":"a@example.com","pubkey":"abc"}`)
+	if err != nil {
+		t.Fatalf("ParseIdentityMemo: %v", err)
+	}
+	if m.Email != "a@example.com" || m.Pubkey != "abc" {
+		t.Errorf("unexpected memo %+v", m)
+	}
+
+	for _, memo := range []string{
+		"hello",
+		`{"action":"receipt","email":"a@example.com","pubkey":"abc"}`,
+		`{"action":"identity","email":"a@example.com"}`,
+	} {
+		if _, err := ParseIdentityMemo(memo); !errors.Is(err, ErrNotIdentityMemo) {
+			t.Errorf("%s: want ErrNotIdentityMemo, got %v", memo, err)
+		}
+	}
+}
+
+// fakeChainTx is a confirmed transaction served by newFakeChain.
+type fakeChainTx struct {
+	sig    solana.Signature
+	slot   uint64
+	signer solana.PublicKey
+	memo   string
+	failed bool
+}
+
+// newFakeChain serves txs, newest first, as the history of every address.
+func newFakeChain(t *testing.T, txs []fakeChainTx) *Client {
+	t.Helper()
+	bySig := make(map[string]fakeChainTx)
+	for _, tx := range txs {
+		bySig[tx.sig.String()] = tx
+	}
+	return newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"getSignaturesForAddress": func(json.RawMessage) any {
+			sigs := make([]map[string]any, len(txs))
+			for i, tx := range txs {
+				var txErr any
+				if tx.failed {
+					txErr = map[string]any{"InstructionError": []any{0, "Custom"}}
+				}
+				sigs[i] = map[string]any{"signature": tx.sig.String(), "slot": tx.slot, "err": txErr}
+			}
+			return sigs
+		},
+		"getTransaction": func(params json.RawMessage) any {
+			var p []json.RawMessage
+			json.Unmarshal(params, &p)
+			var sig string
+			json.Unmarshal(p[0], &sig)
+			ftx := bySig[sig]
+
+			tx, err := solana.NewTransaction(
+				[]solana.Instruction{&memoInstruction{memo: ftx.memo, signer: ftx.signer}},
+				solana.Hash{}, solana.TransactionPayer(ftx.signer))
+			if err != nil {
+				t.Errorf("build tx: %v", err)
+				return nil
+			}
+			raw, _ := tx.MarshalBinary()
+			return map[string]any{
+				"slot":        ftx.slot,
+				"blockTime":   1700000000 + int64(ftx.slot),
+				"transaction": []string{base64.StdEncoding.EncodeToString(raw), "base64"},
+				"meta":        map[string]any{"err": nil},
+			}
+		},
+	})
+}
+
+func TestIdentityRecords(t *testing.T) {
+	alice := solana.MustPublicKeyFromBase58("9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin")
+	mallory := solana.MustPublicKeyFromBase58("7xKhMhVPYvZXZq9QKqZXZq9QKqZXZq9QKqZXZq9QKqZ")
+	identity := func(email string, pk solana.PublicKey) string {
+		memo, _ := encodeMemo(IdentityMemo{Email: email, Pubkey: pk.String()})
+		return memo
+	}
+	sig := func(b byte) solana.Signature { return solana.Signature{b} }
+
+	client := newFakeChain(t, []fakeChainTx{
+		{sig: sig(4), slot: 40, signer: alice, memo: identity("alice@new.example", alice)},
+		{sig: sig(3), slot: 30, signer: alice, memo: identity("failed@example.com", alice), failed: true},
+		{sig: sig(2), slot: 20, signer: mallory, memo: identity("forged@example.com", alice)},
+		{sig: sig(1), slot: 10, signer: alice, memo: `{"action":"other"}`},
+		{sig: sig(0), slot: 5, signer: alice, memo: identity("alice@example.com", alice)},
+	})
+
+	records, err := client.IdentityRecords(context.Background(), alice)
+	if err != nil {
+		t.Fatalf("IdentityRecords: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", records)
+	}
+	if records[0].Email != "alice@example.com" || records[1].Email != "alice@new.example" {
+		t.Errorf("records not oldest first: %+v", records)
+	}
+	if records[0].TxHash != sig(0).String() || records[0].Slot != 5 || records[0].BlockTime.Unix() != 1700000005 {
+		t.Errorf("unexpected record metadata %+v", records[0])
+	}
+	for _, r := range records {
+		if strings.Contains(r.Email, "forged") || strings.Contains(r.Email, "failed") {
+			t.Errorf("unexpected record %+v", r)
+		}
+	}
+}
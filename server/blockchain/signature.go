@@ -0,0 +1,85 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+// ErrInvalidSignature is returned for signatures that cannot be decoded to
+// 64 bytes.
+var ErrInvalidSignature = errors.New("invalid signature encoding")
+
+// VerifySignature reports whether signature is a valid ed25519 signature by
+// pubkeyBase58 over message, as produced by a wallet's signMessage.
+//
+// The message is verified byte for byte: no trimming, Unicode normalisation
+// or line-ending conversion is applied, so callers must pass exactly the
+// bytes that were shown to the wallet.  The signature may be the raw 64
+// bytes or their base58 or base64 (padded, unpadded or URL-safe) text.
+//
+// An error is returned only for a malformed pubkey or signature; a
+// well-formed signature that does not verify yields false.
+func VerifySignature(pubkeyBase58 string, message, signature []byte) (bool, error) {
+	pubkey, err := solana.PublicKeyFromBase58(pubkeyBase58)
+	if err != nil {
+		return false, fmt.Errorf("invalid pubkey: %w", err)
+	}
+	sig, err := decodeSignature(signature)
+	if err != nil {
+		return false, err
+	}
+	return ed25519.Verify(pubkey[:], message, sig), nil
+}
+
+// decodeSignature returns the raw bytes of a signature in any accepted
+// encoding.  Padded base64 always ends in "=", which base58 cannot contain,
+// so it is tried first; base58 is preferred over unpadded base64 because
+// that is how Solana renders signatures.
+func decodeSignature(signature []byte) ([]byte, error) {
+	if len(signature) == ed25519.SignatureSize {
+		return signature, nil
+	}
+	text := string(bytes.TrimSpace(signature))
+	if !strings.HasSuffix(text, "=") {
+		if sig, err := solana.SignatureFromBase58(text); err == nil {
+			return sig[:], nil
+		}
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if raw, err := enc.DecodeString(text); err == nil && len(raw) == ed25519.SignatureSize {
+			return raw, nil
+		}
+	}
+	return nil, ErrInvalidSignature
+}
+
+// CanonicalJSON returns the encoding of v that VerifySignedJSON checks
+// signatures against: compact JSON with struct fields in declaration order,
+// map keys sorted, no HTML escaping and no trailing newline.  This matches
+// JSON.stringify for objects whose keys are in the same order.
+func CanonicalJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, fmt.Errorf("encode payload: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// VerifySignedJSON reports whether signature is a detached signature by
+// pubkeyBase58 over CanonicalJSON(v).
+func VerifySignedJSON(pubkeyBase58 string, v any, signature []byte) (bool, error) {
+	message, err := CanonicalJSON(v)
+	if err != nil {
+		return false, err
+	}
+	return VerifySignature(pubkeyBase58, message, signature)
+}
@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+func TestVerifySignature(t *testing.T) {
+	key := solana.NewWallet().PrivateKey
+	other := solana.NewWallet().PrivateKey
+	message := []byte("Sign in to MulaMail\nnonce: 42")
+
+	sig, err := key.Sign(message)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	otherSig, _ := other.Sign(message)
+	flipped := append([]byte(nil), message...)
+	flipped[0] ^= 0x01
+
+	tests := []struct {
+		name      string
+		pubkey    string
+		message   []byte
+		signature []byte
+		want      bool
+	}{
+		{"raw bytes", key.PublicKey().String(), message, sig[:], true},
+		{"base58", key.PublicKey().String(), message, []byte(sig.String()), true},
+		{"base64", key.PublicKey().String(), message, []byte(base64.StdEncoding.EncodeToString(sig[:])), true},
+		{"base64 unpadded", key.PublicKey().String(), message, []byte(base64.RawStdEncoding.EncodeToString(sig[:])), true},
+		{"base64 url-safe", key.PublicKey().String(), message, []byte(base64.URLEncoding.EncodeToString(sig[:])), true},
+		{"wrong key", other.PublicKey().String(), message, sig[:], false},
+		{"signed by other key", key.PublicKey().String(), message, otherSig[:], false},
+		{"bit-flipped message", key.PublicKey().String(), flipped, sig[:], false},
+		{"trailing newline", key.PublicKey().String(), append(message, '\n'), sig[:], false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := VerifySignature(tc.pubkey, tc.message, tc.signature)
+			if err != nil {
+				t.Fatalf("VerifySignature: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestVerifySignature_Malformed(t *testing.T) {
+	key := solana.NewWallet().PrivateKey
+	sig, _ := key.Sign([]byte("m"))
+
+	if _, err := VerifySignature("not-a-pubkey", []byte("m"), sig[:]); err == nil {
+		t.Error("expected an error for an invalid pubkey")
+	}
+	for _, bad := range [][]byte{nil, sig[:63], []byte("not a signature"), []byte(base64.StdEncoding.EncodeToString(sig[:32]))} {
+		if _, err := VerifySignature(key.PublicKey().String(), []byte("m"), bad); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%q: want ErrInvalidSignature, got %v", bad, err)
+		}
+	}
+}
+
+func TestVerifySignedJSON(t *testing.T) {
+	type challenge struct {
+		Action string `json:"action"`
+		Email  string `json:"email"`
+		Nonce  int    `json:"nonce"`
+	}
+	key := solana.NewWallet().PrivateKey
+	payload := challenge{Action: "login", Email: "a&b<c>@example.com", Nonce: 7}
+
+	canonical, err := CanonicalJSON(payload)
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %v", err)
+	}
+	if want := `{"action":"login","email":"a&b<c>@example.com","nonce":7}`; string(canonical) != want {
+		t.Fatalf("canonical JSON: want %s, got %s", want, canonical)
+	}
+	sig, _ := key.Sign(canonical)
+
+	ok, err := VerifySignedJSON(key.PublicKey().String(), payload, []byte(sig.String()))
+	if err != nil || !ok {
+		t.Errorf("valid signature: got %v (%v)", ok, err)
+	}
+
+	payload.Nonce = 8
+	ok, err = VerifySignedJSON(key.PublicKey().String(), payload, []byte(sig.String()))
+	if err != nil || ok {
+		t.Errorf("modified payload: got %v (%v)", ok, err)
+	}
+}
@@ -0,0 +1,67 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// Transaction statuses reported by TxStatuses.
+const (
+	TxFinalized = "finalized" // landed without error and finalized
+	TxPending   = "pending"   // processed or confirmed, not yet finalized
+	TxFailed    = "failed"    // landed, but with an error
+	TxMissing   = "missing"   // unknown to the cluster
+)
+
+// maxStatusBatch is the most signatures getSignatureStatuses accepts in
+// one call.
+const maxStatusBatch = 256
+
+// TxStatuses returns the status of each of sigs, in order, searching the
+// cluster's full transaction history rather than only recent blocks.  A
+// transaction that has not landed is TxMissing; once its blockhash has
+// expired it never will.
+func (c *Client) TxStatuses(ctx context.Context, sigs []solana.Signature) ([]string, error) {
+	statuses := make([]string, 0, len(sigs))
+	for start := 0; start < len(sigs); start += maxStatusBatch {
+		batch := sigs[start:min(start+maxStatusBatch, len(sigs))]
+		res, err := c.signatureStatuses(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) != len(batch) {
+			return nil, fmt.Errorf("get signature statuses: %d results for %d signatures", len(res), len(batch))
+		}
+		for _, st := range res {
+			statuses = append(statuses, txStatus(st))
+		}
+	}
+	return statuses, nil
+}
+
+func (c *Client) signatureStatuses(ctx context.Context, sigs []solana.Signature) ([]*rpc.SignatureStatusesResult, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	res, err := c.RPC.GetSignatureStatuses(ctx, true, sigs...)
+	if err != nil {
+		return nil, fmt.Errorf("get signature statuses: %w", err)
+	}
+	return res.Value, nil
+}
+
+// txStatus maps one getSignatureStatuses result, null for an unknown
+// signature, to a status.
+func txStatus(st *rpc.SignatureStatusesResult) string {
+	switch {
+	case st == nil:
+		return TxMissing
+	case st.Err != nil:
+		return TxFailed
+	case st.ConfirmationStatus == rpc.ConfirmationStatusFinalized:
+		return TxFinalized
+	}
+	return TxPending
+}
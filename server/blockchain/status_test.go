@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+func TestTxStatuses(t *testing.T) {
+	known := map[solana.Signature]any{
+		{1}: map[string]any{"slot": 10, "confirmations": nil, "err": nil, "confirmationStatus": "finalized"},
+		{2}: map[string]any{"slot": 11, "confirmations": 3, "err": nil, "confirmationStatus": "confirmed"},
+		{3}: map[string]any{"slot": 12, "confirmations": nil, "err": map[string]any{"InstructionError": []any{0, "Custom"}}, "confirmationStatus": "finalized"},
+	}
+	var calls, largest int
+	var searched bool
+	client := newFakeRPC(t, map[string]func(json.RawMessage) any{
+		"getSignatureStatuses": func(params json.RawMessage) any {
+			var p []json.RawMessage
+			json.Unmarshal(params, &p)
+			var sigs []solana.Signature
+			json.Unmarshal(p[0], &sigs)
+			searched = len(p) > 1
+			calls++
+			largest = max(largest, len(sigs))
+			value := make([]any, len(sigs))
+			for i, sig := range sigs {
+				value[i] = known[sig]
+			}
+			return map[string]any{"context": map[string]any{"slot": 20}, "value": value}
+		},
+	})
+
+	got, err := client.TxStatuses(context.Background(), []solana.Signature{{1}, {2}, {3}, {4}})
+	if err != nil {
+		t.Fatalf("TxStatuses: %v", err)
+	}
+	if want := []string{TxFinalized, TxPending, TxFailed, TxMissing}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if !searched {
+		t.Error("want the transaction history searched")
+	}
+
+	calls = 0
+	got, err = client.TxStatuses(context.Background(), make([]solana.Signature, 600))
+	if err != nil || len(got) != 600 {
+		t.Fatalf("600 signatures: want 600 statuses, got %d, %v", len(got), err)
+	}
+	if calls != 3 || largest != maxStatusBatch {
+		t.Errorf("want 3 calls of at most %d signatures, got %d calls, largest %d", maxStatusBatch, calls, largest)
+	}
+}
@@ -0,0 +1,108 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/system"
+	"github.com/gagliardetto/solana-go/rpc"
+)
+
+// TipMemo ties a tip to the email it thanks the sender for.
+type TipMemo struct {
+	MessageID string `json:"message_id"`
+}
+
+func (TipMemo) MemoAction() string { return "tip" }
+
+// ErrNotTip is returned by ParseTipTx for transactions that are not tips.
+var ErrNotTip = errors.New("not a tip transaction")
+
+// Tip is the transfer a tip transaction makes.
+type Tip struct {
+	From      solana.PublicKey
+	To        solana.PublicKey
+	Lamports  uint64
+	MessageID string
+}
+
+// BuildTipTx builds an *unsigned* transaction that transfers lamports from
+// one wallet to another with a tip memo naming messageID.  The sender pays
+// the fee and signs both instructions.
+func BuildTipTx(ctx context.Context, c *Client, tip Tip) (string, error) {
+	memo, err := encodeMemo(TipMemo{MessageID: tip.MessageID})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	latest, err := c.RPC.GetLatestBlockhash(ctx, rpc.CommitmentFinalized)
+	if err != nil {
+		return "", fmt.Errorf("get blockhash: %w", err)
+	}
+
+	tx, err := solana.NewTransaction(
+		[]solana.Instruction{
+			system.NewTransferInstruction(tip.Lamports, tip.From, tip.To).Build(),
+			&memoInstruction{memo: memo, signer: tip.From},
+		},
+		latest.Value.Blockhash,
+		solana.TransactionPayer(tip.From),
+	)
+	if err != nil {
+		return "", fmt.Errorf("new tx: %w", err)
+	}
+	return encodeMemoTx(tx, memo)
+}
+
+// ParseTipTx decodes a base64 transaction of the shape BuildTipTx builds
+// and returns the tip it makes, so that a tip can be recorded from what the
+// transaction does rather than from what the client says it does.
+func ParseTipTx(txBase64 string) (Tip, error) {
+	tx, err := solana.TransactionFromBase64(txBase64)
+	if err != nil {
+		return Tip{}, fmt.Errorf("parse tx: %w", err)
+	}
+	if len(tx.Message.Instructions) != 2 {
+		return Tip{}, fmt.Errorf("%w: want a transfer and a memo", ErrNotTip)
+	}
+	transfer, memo := tx.Message.Instructions[0], tx.Message.Instructions[1]
+
+	if program, err := tx.Message.Program(transfer.ProgramIDIndex); err != nil || !program.Equals(solana.SystemProgramID) {
+		return Tip{}, fmt.Errorf("%w: first instruction is not a system transfer", ErrNotTip)
+	}
+	accounts, err := transfer.ResolveInstructionAccounts(&tx.Message)
+	if err != nil {
+		return Tip{}, fmt.Errorf("%w: %v", ErrNotTip, err)
+	}
+	inst, err := system.DecodeInstruction(accounts, transfer.Data)
+	if err != nil {
+		return Tip{}, fmt.Errorf("%w: %v", ErrNotTip, err)
+	}
+	t, ok := inst.Impl.(*system.Transfer)
+	if !ok || t.Lamports == nil {
+		return Tip{}, fmt.Errorf("%w: first instruction is not a system transfer", ErrNotTip)
+	}
+	tip := Tip{
+		From:     t.GetFundingAccount().PublicKey,
+		To:       t.GetRecipientAccount().PublicKey,
+		Lamports: *t.Lamports,
+	}
+
+	if program, err := tx.Message.Program(memo.ProgramIDIndex); err != nil || !program.Equals(MemoV2ProgramID) {
+		return Tip{}, fmt.Errorf("%w: second instruction is not a memo", ErrNotTip)
+	}
+	var m struct {
+		Action string `json:"action"`
+		TipMemo
+	}
+	if err := json.Unmarshal(memo.Data, &m); err != nil || m.Action != (TipMemo{}).MemoAction() || m.MessageID == "" {
+		return Tip{}, fmt.Errorf("%w: memo is not a tip memo", ErrNotTip)
+	}
+	tip.MessageID = m.MessageID
+	return tip, nil
+}
@@ -0,0 +1,70 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/programs/system"
+)
+
+func TestBuildTipTx_RoundTrip(t *testing.T) {
+	client := newTestClient(t)
+	want := Tip{
+		From:      solana.NewWallet().PublicKey(),
+		To:        solana.NewWallet().PublicKey(),
+		Lamports:  5000,
+		MessageID: "<abc@example.com>",
+	}
+
+	txB64, err := BuildTipTx(context.Background(), client, want)
+	if err != nil {
+		t.Fatalf("BuildTipTx failed: %v", err)
+	}
+	tx, err := solana.TransactionFromBase64(txB64)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if tx.Message.AccountKeys[0] != want.From {
+		t.Errorf("payer: want %s, got %s", want.From, tx.Message.AccountKeys[0])
+	}
+
+	got, err := ParseTipTx(txB64)
+	if err != nil {
+		t.Fatalf("ParseTipTx failed: %v", err)
+	}
+	if got != want {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestParseTipTx_RejectsOtherTransactions(t *testing.T) {
+	client := newTestClient(t)
+	pubkey := solana.NewWallet().PublicKey()
+	txB64, err := CreateIdentityMemoTx(context.Background(), client, pubkey, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseTipTx(txB64); !errors.Is(err, ErrNotTip) {
+		t.Errorf("identity transaction: want ErrNotTip, got %v", err)
+	}
+
+	// A transfer whose memo is not a tip memo.
+	tx, _ := solana.NewTransaction([]solana.Instruction{
+		system.NewTransferInstruction(1, pubkey, solana.NewWallet().PublicKey()).Build(),
+		&memoInstruction{memo: `{"action":"identity"}`, signer: pubkey},
+	}, solana.Hash{1}, solana.TransactionPayer(pubkey))
+	if _, err := ParseTipTx(tx.MustToBase64()); !errors.Is(err, ErrNotTip) {
+		t.Errorf("foreign memo: want ErrNotTip, got %v", err)
+	}
+}
+
+func TestBuildTipTx_MessageIDTooLarge(t *testing.T) {
+	client := newTestClient(t)
+	tip := Tip{From: solana.NewWallet().PublicKey(), To: solana.NewWallet().PublicKey(), Lamports: 1, MessageID: strings.Repeat("x", 600)}
+	if _, err := BuildTipTx(context.Background(), client, tip); !errors.Is(err, ErrMemoTooLarge) {
+		t.Errorf("want ErrMemoTooLarge, got %v", err)
+	}
+}
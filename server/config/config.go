@@ -1,32 +1,349 @@
 package config
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"mulamail/mail"
+	"mulamail/vault"
+)
 
 // Config holds all runtime configuration, populated from environment variables.
 type Config struct {
+	Env           string // deployment environment; "test" enables the fixture endpoints of testfixtures builds
 	Port          string
-	MongoURI      string
+	LogLevel      string // "info" or "debug"; debug also logs a trace of every POP3 and SMTP session, credentials and messages redacted
+	MongoURI      Secret // may carry the database credentials
 	MongoDBName   string
 	SolanaRPC     string
 	StorageType   string // "local" or "s3"
 	LocalDataPath string // Path for local storage (when StorageType=local)
 	AWSRegion     string
 	S3Bucket      string
-	EncryptionKey string // hex-encoded 32-byte key for AES-256-GCM credential storage
+	StorageRoutes []vault.StorageRoute // per-prefix backends ("local" or "s3"); overrides StorageType when set
+	EncryptionKey vault.Key            // AES-256-GCM key for credential storage, parsed from hex or derived from a passphrase
+
+	EncryptionSaltFile string // Argon2id salt and parameters for ENCRYPTION_PASSPHRASE
+	WeakEncryptionKey  bool   // ENCRYPTION_KEY is publicly known or guessable (vault.IsWeakKey); serve refuses it outside DevMode
+
+	MongoDurableWriteConcern    string // write concern for identities, mail accounts, API keys and payments: "majority" or a member count
+	MongoDurableWTimeoutSeconds int    // such a write fails if its write concern is not met in time; 0 = wait indefinitely
+	MongoRetryWrites            bool   // retry a write once after a failover or network error
+
+	HTTPReadTimeoutSeconds  int // time allowed to read a whole request, headers included
+	HTTPWriteTimeoutSeconds int // time allowed to write a response; streaming routes extend it as they progress
+	HTTPIdleTimeoutSeconds  int // keep-alive connections idle for longer are closed
+	HTTPMaxHeaderBytes      int // cap on the size of request headers
+
+	TrustedProxies string // comma-separated CIDRs or addresses of proxies whose X-Forwarded-For and X-Real-IP are believed
+
+	MaxInFlight         int // requests served at once on all routes but /api/health; 0 = no cap
+	MaxInFlightMail     int // of which /api/v1/mail requests, most holding a POP3 or SMTP connection; 0 = no cap
+	MaxInFlightIdentity int // of which /api/v1/identity requests; 0 = no cap
+	MaxInFlightAccounts int // of which /api/v1/accounts requests; 0 = no cap
+
+	SolanaRPCTimeoutSeconds int    // per-call timeout for Solana RPC requests
+	SolanaNonceAccount      string // optional durable nonce account (base58) for slow signers
+	SolanaNonceAuthorityKey Secret // base58 private key of the nonce account's authority
+	SolanaArchiveRPC        string // optional public RPC with full history, named in identity proofs SOLANA_RPC can no longer serve
+
+	OutboundProxy  Secret // optional socks5://[user:pass@]host:port for POP3/SMTP connections
+	OutboundBindIP string // optional local source IP for POP3/SMTP connections
+
+	DKIMKeys string // comma-separated domain:selector:path entries of PEM keys for signing outbound mail
+
+	AttachmentBufferBytes int // attachments larger than this are streamed instead of buffered
+	InboxPreviewMaxBytes  int // inbox messages larger than this are listed without fetching their headers; 0 = no limit
+
+	IdentityCacheSize       int // identity lookups kept in memory; 0 disables the cache
+	IdentityCacheTTLSeconds int // how long a cached identity is served before it is looked up again
+
+	EmailCanonicalRules string // comma-separated domain:rule[:rule] entries (rules: plus, dots) canonicalising identity emails
+
+	MaxIdentitiesPerPubKey int // active identities one public key may register; 0 = no cap
+
+	IdentityChainCheckIntervalSeconds int // how often identities are checked for a landed memo transaction; 0 disables the check
+	IdentityChainCheckDays            int // identities registered this recently are checked until their transaction is finalized
+
+	MaxRecipients        int // default per-message recipient cap for sends
+	MaxMessageBytes      int // default per-message size cap for sends
+	MaxDailySends        int // default messages each mail account may send per UTC day; 0 = no cap
+	MaxUnknownRecipients int // recipients without contact history a send may address, unless the owner is trusted; 0 = no check
+	MaxAccounts          int // default mail accounts one owner may register; 0 = no cap
+	WarnAccounts         int // default account count from which adding another warns in a response header; 0 = never
+	SMTPSendRetries      int // immediate retries of a send after a transient SMTP failure
+
+	SendAllowedDomains string // comma-separated domains, subdomains included, the only ones mail may be sent to; empty allows all
+	SendBlockedDomains string // comma-separated domains, subdomains included, mail may never be sent to
+	SMTPHELOHostname   string // name announced in EHLO/HELO by accounts that set none; empty = this host's detected FQDN
+
+	AdminToken Secret // bearer token for /api/v1/admin endpoints; empty disables them
+
+	BillingMint     string // SPL mint (base58) accepted for premium plans; empty disables billing
+	BillingTreasury string // wallet (base58) whose associated token account receives payments
+	PremiumPrice    int    // minimum payment for the premium plan, in the mint's base units
+
+	TipMaxLamports int // largest SOL tip to an email sender, in lamports; 0 disables tipping
+
+	SchedulerIntervalSeconds int // how often the scheduled-send worker polls for due messages
+	ScheduledMaxAttempts     int // delivery attempts per scheduled message before giving up
+
+	SendAsync             bool // queue sends in the outbox by default instead of delivering during the request
+	OutboxWorkers         int  // concurrent outbox deliveries per instance
+	OutboxIntervalSeconds int  // how often idle outbox workers poll for queued messages
+	OutboxLeaseSeconds    int  // how long a worker's claim on a message lasts without renewal
+	OutboxMaxAttempts     int  // delivery attempts per outbox message before giving up
+	GreylistRequeue       bool // queue a synchronous send a greylisting server defers in the outbox instead of failing it
+
+	ExportIntervalSeconds int // how often the export worker polls for queued and expired exports
+	ExportTTLHours        int // how long a finished export archive can be downloaded
+	MboxStreamMaxBytes    int // largest estimated mbox export streamed in the response; larger ones are built in the background; 0 = always stream
+
+	ArchiveIntervalSeconds     int // how often the archive worker polls for mailbox archive jobs
+	ArchiveMessagesPerMinute   int // messages the archive worker retrieves from POP3 servers per minute; 0 = no limit
+	FetchPolicyIntervalMinutes int // how often the archive worker applies accounts' delete fetch policies; 0 disables them
+
+	ErasureIntervalSeconds int // how often the erasure worker polls for confirmed owner deletions
+
+	VaultGCIntervalHours    int // how often unreferenced vault blobs are collected; 0 disables the background run
+	VaultGCGraceHours       int // unreferenced blobs younger than this are kept, as their record may not be written yet
+	VaultGCDeletesPerSecond int // cap on vault delete calls during a collection; 0 means no cap
+
+	CacheRetentionDays      int // cached previews no inbox fetch has seen for this long are swept; 0 keeps them
+	CacheGCIntervalHours    int // how often the preview cache is swept; 0 disables the background run
+	CacheGCBatchSize        int // previews a sweep reads and deletes at a time
+	CacheGCDeletesPerSecond int // cap on previews a sweep deletes per second; 0 means no cap
+
+	VaultAllowLegacyBlobs bool // read vault objects stored before storage-level encryption, during migration
+	VaultVerifyChecksums  bool // check each vault object read against the checksum stored with it
+
+	OwnerLeaseSeconds int // MongoDB lease serialising an owner's changes across instances; 0 = this instance only
+
+	WorkerLeaseSeconds int // MongoDB lease electing one instance per background worker role; 0 = every instance runs every worker
+
+	AlertSinks                string // comma-separated operator alert sinks: log, webhook, smtp
+	AlertDedupMinutes         int    // an alert with the same key is sent at most once per window
+	AlertCheckIntervalSeconds int    // how often dependencies are checked for alert conditions
+	AlertWebhookURL           Secret // receives each alert as a JSON POST (webhook sink); such URLs usually embed a token
+	AlertSMTPHost             string // SMTP server for the smtp sink; port 465 uses implicit TLS
+	AlertSMTPPort             int
+	AlertSMTPUser             string // empty skips authentication
+	AlertSMTPPass             Secret
+	AlertSMTPFrom             string
+	AlertSMTPTo               string // comma-separated operator addresses
+	AlertRelayerWallet        string // base58 wallet whose SOL balance is watched; empty disables the check
+	AlertRelayerMinLamports   int    // alert when the watched wallet holds less
+	AlertMongoPingFailures    int    // consecutive failed MongoDB pings before alerting
+	AlertDecryptFailures      int    // decrypt failures within one check interval before alerting
+	AlertTLSCerts             string // comma-separated PEM certificate files checked for expiry
+	AlertCertExpiryDays       int    // alert when a certificate expires within this many days
 }
 
-func Load() *Config {
+// Load reads the configuration from the environment.  It fails only on
+// values that cannot be used at all, such as a malformed ENCRYPTION_KEY.
+func Load() (*Config, error) {
+	saltFile := env("ENCRYPTION_SALT_FILE", "./data/encryption.salt")
+	key, weak, err := loadEncryptionKey(saltFile)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := loadStorageRoutes()
+	if err != nil {
+		return nil, err
+	}
+	heloHostname := env("SMTP_HELO_HOSTNAME", "")
+	if heloHostname != "" {
+		if err := mail.ValidateHostname(heloHostname); err != nil {
+			return nil, fmt.Errorf("SMTP_HELO_HOSTNAME: %w", err)
+		}
+	}
 	return &Config{
+		Env:           env("ENV", ""),
 		Port:          env("PORT", "8080"),
-		MongoURI:      env("MONGO_URI", "mongodb://localhost:27017"),
+		LogLevel:      env("LOG_LEVEL", "info"),
+		MongoURI:      envSecret("MONGO_URI", "mongodb://localhost:27017"),
 		MongoDBName:   env("MONGO_DB", "mulamail"),
 		SolanaRPC:     env("SOLANA_RPC", "https://api.mainnet-beta.solana.com"),
 		StorageType:   env("STORAGE_TYPE", "local"),
 		LocalDataPath: env("LOCAL_DATA_PATH", "./data/vault"),
 		AWSRegion:     env("AWS_REGION", "us-east-1"),
 		S3Bucket:      env("S3_BUCKET", "mulamail-vault"),
-		EncryptionKey: env("ENCRYPTION_KEY", "0000000000000000000000000000000000000000000000000000000000000000"),
+		StorageRoutes: routes,
+		EncryptionKey: key,
+
+		EncryptionSaltFile: saltFile,
+		WeakEncryptionKey:  weak,
+
+		MongoDurableWriteConcern:    env("MONGO_DURABLE_WRITE_CONCERN", "majority"),
+		MongoDurableWTimeoutSeconds: envInt("MONGO_DURABLE_WTIMEOUT_SECONDS", 10),
+		MongoRetryWrites:            envBool("MONGO_RETRY_WRITES", true),
+
+		HTTPReadTimeoutSeconds:  envInt("HTTP_READ_TIMEOUT_SECONDS", 15),
+		HTTPWriteTimeoutSeconds: envInt("HTTP_WRITE_TIMEOUT_SECONDS", 60),
+		HTTPIdleTimeoutSeconds:  envInt("HTTP_IDLE_TIMEOUT_SECONDS", 120),
+		HTTPMaxHeaderBytes:      envInt("HTTP_MAX_HEADER_BYTES", 1<<20),
+
+		TrustedProxies: env("TRUSTED_PROXIES", ""),
+
+		MaxInFlight:         envInt("MAX_IN_FLIGHT", 512),
+		MaxInFlightMail:     envInt("MAX_IN_FLIGHT_MAIL", 128),
+		MaxInFlightIdentity: envInt("MAX_IN_FLIGHT_IDENTITY", 256),
+		MaxInFlightAccounts: envInt("MAX_IN_FLIGHT_ACCOUNTS", 64),
+
+		SolanaRPCTimeoutSeconds: envInt("SOLANA_RPC_TIMEOUT_SECONDS", 15),
+		SolanaNonceAccount:      env("SOLANA_NONCE_ACCOUNT", ""),
+		SolanaNonceAuthorityKey: envSecret("SOLANA_NONCE_AUTHORITY_KEY", ""),
+		SolanaArchiveRPC:        env("SOLANA_ARCHIVE_RPC", ""),
+
+		OutboundProxy:  envSecret("OUTBOUND_PROXY", ""),
+		OutboundBindIP: env("OUTBOUND_BIND_IP", ""),
+
+		DKIMKeys: env("DKIM_KEYS", ""),
+
+		AttachmentBufferBytes: envInt("ATTACHMENT_BUFFER_BYTES", 10<<20),
+		InboxPreviewMaxBytes:  envInt("INBOX_PREVIEW_MAX_BYTES", 10<<20),
+
+		IdentityCacheSize:       envInt("IDENTITY_CACHE_SIZE", 10000),
+		IdentityCacheTTLSeconds: envInt("IDENTITY_CACHE_TTL_SECONDS", 300),
+
+		EmailCanonicalRules: env("EMAIL_CANONICAL_RULES", "gmail.com:plus:dots,googlemail.com:plus:dots"),
+
+		MaxIdentitiesPerPubKey: envInt("MAX_IDENTITIES_PER_PUBKEY", 5),
+
+		IdentityChainCheckIntervalSeconds: envInt("IDENTITY_CHAIN_CHECK_INTERVAL_SECONDS", 300),
+		IdentityChainCheckDays:            envInt("IDENTITY_CHAIN_CHECK_DAYS", 7),
+
+		MaxRecipients:        envInt("MAX_RECIPIENTS", 50),
+		MaxMessageBytes:      envInt("MAX_MESSAGE_BYTES", 25<<20),
+		MaxDailySends:        envInt("MAX_DAILY_SENDS", 500),
+		MaxUnknownRecipients: envInt("MAX_UNKNOWN_RECIPIENTS", 10),
+		MaxAccounts:          envInt("MAX_ACCOUNTS_PER_OWNER", 20),
+		WarnAccounts:         envInt("WARN_ACCOUNTS_PER_OWNER", 10),
+		SMTPSendRetries:      envInt("SMTP_SEND_RETRIES", 2),
+
+		SendAllowedDomains: env("SEND_ALLOWED_DOMAINS", ""),
+		SendBlockedDomains: env("SEND_BLOCKED_DOMAINS", ""),
+		SMTPHELOHostname:   heloHostname,
+
+		AdminToken: envSecret("ADMIN_TOKEN", ""),
+
+		BillingMint:     env("BILLING_MINT", ""),
+		BillingTreasury: env("BILLING_TREASURY", ""),
+		PremiumPrice:    envInt("PREMIUM_PRICE", 0),
+
+		TipMaxLamports: envInt("TIP_MAX_LAMPORTS", 1_000_000_000),
+
+		SchedulerIntervalSeconds: envInt("SCHEDULER_INTERVAL_SECONDS", 30),
+		ScheduledMaxAttempts:     envInt("SCHEDULED_MAX_ATTEMPTS", 5),
+
+		SendAsync:             envBool("SEND_ASYNC", false),
+		OutboxWorkers:         envInt("OUTBOX_WORKERS", 4),
+		OutboxIntervalSeconds: envInt("OUTBOX_INTERVAL_SECONDS", 5),
+		OutboxLeaseSeconds:    envInt("OUTBOX_LEASE_SECONDS", 300),
+		OutboxMaxAttempts:     envInt("OUTBOX_MAX_ATTEMPTS", 5),
+		GreylistRequeue:       envBool("SEND_GREYLIST_REQUEUE", true),
+
+		ExportIntervalSeconds: envInt("EXPORT_INTERVAL_SECONDS", 10),
+		ExportTTLHours:        envInt("EXPORT_TTL_HOURS", 168),
+		MboxStreamMaxBytes:    envInt("MBOX_STREAM_MAX_BYTES", 100<<20),
+
+		ArchiveIntervalSeconds:     envInt("ARCHIVE_INTERVAL_SECONDS", 10),
+		ArchiveMessagesPerMinute:   envInt("ARCHIVE_MESSAGES_PER_MINUTE", 60),
+		FetchPolicyIntervalMinutes: envInt("FETCH_POLICY_INTERVAL_MINUTES", 15),
+
+		ErasureIntervalSeconds: envInt("ERASURE_INTERVAL_SECONDS", 10),
+
+		VaultGCIntervalHours:    envInt("VAULT_GC_INTERVAL_HOURS", 24),
+		VaultGCGraceHours:       envInt("VAULT_GC_GRACE_HOURS", 72),
+		VaultGCDeletesPerSecond: envInt("VAULT_GC_DELETES_PER_SECOND", 50),
+
+		CacheRetentionDays:      envInt("CACHE_RETENTION_DAYS", 90),
+		CacheGCIntervalHours:    envInt("CACHE_GC_INTERVAL_HOURS", 24),
+		CacheGCBatchSize:        envInt("CACHE_GC_BATCH_SIZE", 500),
+		CacheGCDeletesPerSecond: envInt("CACHE_GC_DELETES_PER_SECOND", 500),
+
+		VaultAllowLegacyBlobs: envBool("VAULT_ALLOW_LEGACY_BLOBS", false),
+		VaultVerifyChecksums:  envBool("VAULT_VERIFY_CHECKSUMS", false),
+
+		OwnerLeaseSeconds: envInt("OWNER_LEASE_SECONDS", 30),
+
+		WorkerLeaseSeconds: envInt("WORKER_LEASE_SECONDS", 15),
+
+		AlertSinks:                env("ALERT_SINKS", "log"),
+		AlertDedupMinutes:         envInt("ALERT_DEDUP_MINUTES", 60),
+		AlertCheckIntervalSeconds: envInt("ALERT_CHECK_INTERVAL_SECONDS", 60),
+		AlertWebhookURL:           envSecret("ALERT_WEBHOOK_URL", ""),
+		AlertSMTPHost:             env("ALERT_SMTP_HOST", ""),
+		AlertSMTPPort:             envInt("ALERT_SMTP_PORT", 587),
+		AlertSMTPUser:             env("ALERT_SMTP_USER", ""),
+		AlertSMTPPass:             envSecret("ALERT_SMTP_PASS", ""),
+		AlertSMTPFrom:             env("ALERT_SMTP_FROM", ""),
+		AlertSMTPTo:               env("ALERT_SMTP_TO", ""),
+		AlertRelayerWallet:        env("ALERT_RELAYER_WALLET", ""),
+		AlertRelayerMinLamports:   envInt("ALERT_RELAYER_MIN_LAMPORTS", 100_000_000),
+		AlertMongoPingFailures:    envInt("ALERT_MONGO_PING_FAILURES", 3),
+		AlertDecryptFailures:      envInt("ALERT_DECRYPT_FAILURES", 20),
+		AlertTLSCerts:             env("ALERT_TLS_CERTS", ""),
+		AlertCertExpiryDays:       envInt("ALERT_CERT_EXPIRY_DAYS", 14),
+	}, nil
+}
+
+// loadEncryptionKey reads the key from ENCRYPTION_KEY (hex) or derives it
+// from ENCRYPTION_PASSPHRASE and the salt in saltFile, and reports whether
+// it is weak.  Setting both is an error rather than a precedence rule, so a
+// forgotten variable can never silently switch the server to a different
+// key.  A derived key is never weak: the passphrase is stretched with a
+// random salt.
+func loadEncryptionKey(saltFile string) (key vault.Key, weak bool, err error) {
+	hexKey, hasKey := os.LookupEnv("ENCRYPTION_KEY")
+	passphrase, hasPassphrase := os.LookupEnv("ENCRYPTION_PASSPHRASE")
+	switch {
+	case hasKey && hasPassphrase:
+		return vault.Key{}, false, fmt.Errorf("set only one of ENCRYPTION_KEY and ENCRYPTION_PASSPHRASE")
+	case hasPassphrase:
+		key, err := vault.KeyFromPassphrase(passphrase, saltFile)
+		if err != nil {
+			return vault.Key{}, false, fmt.Errorf("ENCRYPTION_PASSPHRASE: %w", err)
+		}
+		return key, false, nil
+	}
+	if !hasKey {
+		hexKey = "0000000000000000000000000000000000000000000000000000000000000000"
+	}
+	key, err = vault.ParseKey(hexKey)
+	if err != nil {
+		return vault.Key{}, false, fmt.Errorf("ENCRYPTION_KEY: %w", err)
 	}
+	return key, vault.IsWeakKey(hexKey), nil
+}
+
+// DevMode reports whether the server runs for development or tests
+// (ENV=dev or ENV=test), where safeguards meant for real users' data, such
+// as the refusal of a weak encryption key, are relaxed.
+func (c *Config) DevMode() bool {
+	return c.Env == "dev" || c.Env == "test"
+}
+
+// loadStorageRoutes parses STORAGE_ROUTES.  Every route must name a backend
+// the server can open, so a typo fails at startup rather than on the first
+// key that reaches it.
+func loadStorageRoutes() ([]vault.StorageRoute, error) {
+	routes, err := vault.ParseStorageRoutes(env("STORAGE_ROUTES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("STORAGE_ROUTES: %w", err)
+	}
+	for _, r := range routes {
+		if r.Backend != "local" && r.Backend != "s3" {
+			return nil, fmt.Errorf("STORAGE_ROUTES: route %q: backend must be 'local' or 's3', not %q", r.Prefix, r.Backend)
+		}
+	}
+	return routes, nil
+}
+
+// envSecret is env for a Secret.
+func envSecret(key, fallback string) Secret {
+	return Secret(env(key, fallback))
 }
 
 func env(key, fallback string) string {
@@ -35,3 +352,24 @@ func env(key, fallback string) string {
 	}
 	return fallback
 }
+
+// envInt reads an integer variable, falling back when unset or malformed.
+func envInt(key string, fallback int) int {
+	if v, ok := os.LookupEnv(key); ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+// envBool reads a boolean variable ("true", "1", ...), falling back when
+// unset or malformed.
+func envBool(key string, fallback bool) bool {
+	if v, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
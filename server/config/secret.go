@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// redacted stands in for a Secret wherever it is printed.
+const redacted = "[redacted]"
+
+// Secret is a configuration value that must never reach a log, an error
+// message or a response: a connection string with credentials, a token, a
+// password or a private key.  It prints as "[redacted]" under every fmt
+// verb and in JSON, or as "" when unset, so a dump of the Config tells set
+// from unset without showing either.  Reveal returns the value, for the
+// one place that uses it.
+type Secret string
+
+// Reveal returns the secret value.
+func (s Secret) Reveal() string { return string(s) }
+
+// String redacts the value.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// GoString redacts the value from %#v.
+func (s Secret) GoString() string { return fmt.Sprintf("config.Secret(%q)", s.String()) }
+
+// Format redacts the value under every verb, including %x and %d, which
+// would otherwise print the string's bytes.
+func (s Secret) Format(f fmt.State, verb rune) {
+	if verb == 'v' && f.Flag('#') {
+		io.WriteString(f, s.GoString()) //nolint:errcheck
+		return
+	}
+	io.WriteString(f, s.String()) //nolint:errcheck
+}
+
+// MarshalJSON redacts the value.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return fmt.Appendf(nil, "%q", s.String()), nil
+}
+
+// Redact masks the secret in text, such as the error of a call it was
+// passed to.  When the secret is a URL, the password of its user info is
+// masked on its own too, since errors often quote it apart from the URL.
+func (s Secret) Redact(text string) string {
+	if s == "" {
+		return text
+	}
+	pairs := []string{string(s), redacted}
+	if u, err := url.Parse(string(s)); err == nil && u.User != nil {
+		if pass, ok := u.User.Password(); ok && len(pass) >= 3 {
+			pairs = append(pairs, pass, redacted)
+		}
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
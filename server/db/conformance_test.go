@@ -0,0 +1,24 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+
+	"mulamail/db"
+	"mulamail/db/dbtest"
+)
+
+func TestMongoConformance(t *testing.T) {
+	client, cleanup := db.SetupTestDB(t)
+	if client == nil {
+		return // MongoDB not available, test skipped
+	}
+	defer cleanup()
+
+	dbtest.RunConformance(t, func(t *testing.T) db.DB {
+		if err := client.Reset(context.Background()); err != nil {
+			t.Fatalf("Reset: %v", err)
+		}
+		return client
+	})
+}
@@ -0,0 +1,717 @@
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mulamail/db"
+)
+
+// RunConformance checks that a db.DB behaves as the API relies on: which
+// calls report ErrNotFound and ErrDuplicate, what they return for data
+// never stored, and how jobs are claimed and finished.  It runs against
+// the Mock and the MongoDB client alike, so the two cannot drift apart.
+// open returns an empty DB for each subtest.
+func RunConformance(t *testing.T, open func(t *testing.T) db.DB) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, ctx context.Context, d db.DB)
+	}{
+		{"Identities", conformIdentities},
+		{"MailAccounts", conformMailAccounts},
+		{"FindMailAccounts", conformFindMailAccounts},
+		{"SentMessages", conformSentMessages},
+		{"CachedMessages", conformCachedMessages},
+		{"ScheduledMessages", conformScheduledMessages},
+		{"Outbox", conformOutbox},
+		{"ExportJobs", conformExportJobs},
+		{"Erasure", conformErasure},
+		{"UniqueRecords", conformUniqueRecords},
+		{"Contacts", conformContacts},
+		{"DailySends", conformDailySends},
+		{"Leases", conformLeases},
+		{"OwnerData", conformOwnerData},
+		{"AuditEvents", conformAuditEvents},
+		{"Settings", conformSettings},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, context.Background(), open(t))
+		})
+	}
+}
+
+func conformIdentities(t *testing.T, ctx context.Context, d db.DB) {
+	if _, err := d.GetIdentityByEmail(ctx, "nobody@example.com"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetIdentityByEmail of an unknown email: want ErrNotFound, got %v", err)
+	}
+	if _, err := d.GetIdentityByPubKey(ctx, "nobody"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetIdentityByPubKey of an unknown key: want ErrNotFound, got %v", err)
+	}
+	if _, err := d.GetIdentityByTxSig(ctx, "nosig"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetIdentityByTxSig of an unknown signature: want ErrNotFound, got %v", err)
+	}
+
+	alice := &db.Identity{Email: "alice@example.com", CanonicalEmail: "alice@example.com", PubKey: "pk-alice", TxSig: "sig-1"}
+	if err := d.CreateIdentity(ctx, alice); err != nil {
+		t.Fatalf("CreateIdentity: %v", err)
+	}
+	if alice.CreatedAt.IsZero() {
+		t.Error("CreateIdentity should set CreatedAt")
+	}
+	dupCanonical := &db.Identity{Email: "Alice@example.com", CanonicalEmail: "alice@example.com", PubKey: "pk-other", TxSig: "sig-2"}
+	if err := d.CreateIdentity(ctx, dupCanonical); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("CreateIdentity of a taken canonical email: want ErrDuplicate, got %v", err)
+	}
+	dupSig := &db.Identity{Email: "bob@example.com", CanonicalEmail: "bob@example.com", PubKey: "pk-bob", TxSig: "sig-1"}
+	if err := d.CreateIdentity(ctx, dupSig); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("CreateIdentity with a used transaction: want ErrDuplicate, got %v", err)
+	}
+	if got, err := d.GetIdentityByTxSig(ctx, "sig-1"); err != nil || got.Email != alice.Email {
+		t.Errorf("GetIdentityByTxSig: got %+v, %v", got, err)
+	}
+
+	inserted, err := d.UpsertIdentity(ctx, &db.Identity{Email: "carol@example.com", PubKey: "pk-carol"})
+	if err != nil || !inserted {
+		t.Errorf("UpsertIdentity of a new email: want inserted, got %v, %v", inserted, err)
+	}
+	inserted, err = d.UpsertIdentity(ctx, &db.Identity{Email: "carol@example.com", PubKey: "pk-mallory"})
+	if err != nil || inserted {
+		t.Errorf("UpsertIdentity of a known email: want left alone, got %v, %v", inserted, err)
+	}
+	if got, err := d.GetIdentityByEmail(ctx, "carol@example.com"); err != nil || got.PubKey != "pk-carol" {
+		t.Errorf("UpsertIdentity replaced the stored mapping: got %+v, %v", got, err)
+	}
+
+	second := &db.Identity{Email: "alice@work.example", CanonicalEmail: "alice@work.example", PubKey: "pk-alice", Primary: true}
+	if err := d.CreateIdentity(ctx, second); err != nil {
+		t.Fatalf("CreateIdentity: %v", err)
+	}
+	if got, err := d.GetIdentityByPubKey(ctx, "pk-alice"); err != nil || got.Email != second.Email {
+		t.Errorf("GetIdentityByPubKey should prefer the primary identity, got %+v, %v", got, err)
+	}
+}
+
+func conformMailAccounts(t *testing.T, ctx context.Context, d db.DB) {
+	for _, owner := range []string{"", "pk-nobody"} {
+		accounts, err := d.GetMailAccountsByOwner(ctx, owner)
+		if err != nil || len(accounts) != 0 {
+			t.Errorf("GetMailAccountsByOwner(%q): want none, got %v, %v", owner, accounts, err)
+		}
+		if n, err := d.CountMailAccountsByOwner(ctx, owner); err != nil || n != 0 {
+			t.Errorf("CountMailAccountsByOwner(%q): want 0, got %d, %v", owner, n, err)
+		}
+	}
+	if _, err := d.GetMailAccount(ctx, "pk-nobody", "a@example.com"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetMailAccount of an unknown account: want ErrNotFound, got %v", err)
+	}
+	if err := d.SetMailAccountPasswords(ctx, "pk-nobody", "a@example.com", "p", "s"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("SetMailAccountPasswords of an unknown account: want ErrNotFound, got %v", err)
+	}
+	name := "Alice"
+	if err := d.UpdateMailAccountProfile(ctx, "pk-nobody", "a@example.com", db.MailAccountProfile{DisplayName: &name}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("UpdateMailAccountProfile of an unknown account: want ErrNotFound, got %v", err)
+	}
+	if err := d.UpdateMailAccountStats(ctx, "pk-nobody", "a@example.com", time.Now(), db.FetchOK, 3); err != nil {
+		t.Errorf("UpdateMailAccountStats of an unknown account: want nil, got %v", err)
+	}
+
+	acc := &db.MailAccount{OwnerPubKey: "pk-alice", AccountEmail: "a@example.com"}
+	if err := d.CreateMailAccount(ctx, acc); err != nil {
+		t.Fatalf("CreateMailAccount: %v", err)
+	}
+	if acc.CreatedAt.IsZero() {
+		t.Error("CreateMailAccount should set CreatedAt")
+	}
+	if err := d.SetMailAccountPasswords(ctx, "pk-alice", "a@example.com", "pop3-enc", "smtp-enc"); err != nil {
+		t.Fatalf("SetMailAccountPasswords: %v", err)
+	}
+	got, err := d.GetMailAccount(ctx, "pk-alice", "a@example.com")
+	if err != nil || got.POP3.PassEnc != "pop3-enc" || got.SMTP.PassEnc != "smtp-enc" {
+		t.Errorf("GetMailAccount: got %+v, %v", got, err)
+	}
+	if _, err := d.GetMailAccount(ctx, "pk-mallory", "a@example.com"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetMailAccount of another owner's account: want ErrNotFound, got %v", err)
+	}
+	if accounts, err := d.GetMailAccountsByOwner(ctx, "pk-alice"); err != nil || len(accounts) != 1 {
+		t.Errorf("GetMailAccountsByOwner: want 1 account, got %v, %v", accounts, err)
+	}
+	if err := d.CreateMailAccount(ctx, &db.MailAccount{OwnerPubKey: "pk-alice", AccountEmail: "b@example.com"}); err != nil {
+		t.Fatalf("CreateMailAccount: %v", err)
+	}
+	if n, err := d.CountMailAccountsByOwner(ctx, "pk-alice"); err != nil || n != 2 {
+		t.Errorf("CountMailAccountsByOwner: want 2, got %d, %v", n, err)
+	}
+}
+
+func conformFindMailAccounts(t *testing.T, ctx context.Context, d db.DB) {
+	for _, acc := range []struct{ owner, email string }{
+		{"alice", "a1@example.com"}, {"bob", "b1@example.com"}, {"alice", "a2@example.com"},
+		{"alice", "shared@example.com"}, {"bob", "shared@example.com"},
+	} {
+		if err := d.CreateMailAccount(ctx, &db.MailAccount{OwnerPubKey: acc.owner, AccountEmail: acc.email}); err != nil {
+			t.Fatalf("CreateMailAccount: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    db.MailAccountQuery
+		want []string // owner/email, in order
+	}{
+		{"everything", db.MailAccountQuery{}, []string{"alice/a1", "bob/b1", "alice/a2", "alice/shared", "bob/shared"}},
+		{"owner", db.MailAccountQuery{Owner: "alice"}, []string{"alice/a1", "alice/a2", "alice/shared"}},
+		{"email", db.MailAccountQuery{Email: "shared@example.com"}, []string{"alice/shared", "bob/shared"}},
+		{"owner and email", db.MailAccountQuery{Owner: "bob", Email: "shared@example.com"}, []string{"bob/shared"}},
+		{"unknown owner", db.MailAccountQuery{Owner: "carol"}, nil},
+		{"email of another owner", db.MailAccountQuery{Owner: "bob", Email: "a1@example.com"}, nil},
+		{"limit", db.MailAccountQuery{Page: db.Page{Limit: 2}}, []string{"alice/a1", "bob/b1"}},
+		{"offset", db.MailAccountQuery{Page: db.Page{Offset: 3}}, []string{"alice/shared", "bob/shared"}},
+		{"offset and limit", db.MailAccountQuery{Owner: "alice", Page: db.Page{Offset: 1, Limit: 1}}, []string{"alice/a2"}},
+		{"offset past the end", db.MailAccountQuery{Page: db.Page{Offset: 9}}, nil},
+		{"negative page", db.MailAccountQuery{Owner: "bob", Page: db.Page{Offset: -1, Limit: -1}}, []string{"bob/b1", "bob/shared"}},
+	}
+	for _, tt := range tests {
+		accs, err := d.FindMailAccounts(ctx, tt.q)
+		if err != nil {
+			t.Fatalf("%s: FindMailAccounts: %v", tt.name, err)
+		}
+		var got []string
+		for _, a := range accs {
+			got = append(got, a.OwnerPubKey+"/"+strings.TrimSuffix(a.AccountEmail, "@example.com"))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func conformSentMessages(t *testing.T, ctx context.Context, d db.DB) {
+	if sent, err := d.GetRecentSentMessages(ctx, "pk-nobody", 10); err != nil || len(sent) != 0 {
+		t.Errorf("GetRecentSentMessages of an unknown owner: want none, got %v, %v", sent, err)
+	}
+	for _, id := range []string{"<1@x>", "<2@x>", "<3@x>"} {
+		if err := d.CreateSentMessage(ctx, &db.SentMessage{OwnerPubKey: "pk-alice", MessageID: id}); err != nil {
+			t.Fatalf("CreateSentMessage: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond) // MongoDB keeps SentAt to the millisecond
+	}
+	sent, err := d.GetRecentSentMessages(ctx, "pk-alice", 2)
+	if err != nil || len(sent) != 2 || sent[0].MessageID != "<3@x>" || sent[1].MessageID != "<2@x>" {
+		t.Errorf("GetRecentSentMessages: want the two newest, newest first, got %+v, %v", sent, err)
+	}
+
+	bounce := &db.SentBounce{Recipient: "bob@example.com", Status: "5.1.1"}
+	if err := d.MarkSentMessageBounced(ctx, "pk-alice", "<unknown@x>", bounce); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("MarkSentMessageBounced of an unknown message: want ErrNotFound, got %v", err)
+	}
+	if err := d.MarkSentMessageBounced(ctx, "pk-mallory", "<1@x>", bounce); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("MarkSentMessageBounced of another owner's message: want ErrNotFound, got %v", err)
+	}
+	if err := d.MarkSentMessageBounced(ctx, "pk-alice", "<1@x>", bounce); err != nil {
+		t.Errorf("MarkSentMessageBounced: %v", err)
+	}
+}
+
+func conformCachedMessages(t *testing.T, ctx context.Context, d db.DB) {
+	msg := &db.CachedMessage{OwnerPubKey: "pk-alice", AccountEmail: "a@example.com", UID: "u1", FromIndex: "ix", SnippetEnc: "snippet"}
+	if inserted, err := d.UpsertCachedMessage(ctx, msg); err != nil || !inserted {
+		t.Errorf("UpsertCachedMessage of a new message: want inserted, got %v, %v", inserted, err)
+	}
+	again := &db.CachedMessage{OwnerPubKey: "pk-alice", AccountEmail: "a@example.com", UID: "u1", FromIndex: "ix", Size: 42}
+	if inserted, err := d.UpsertCachedMessage(ctx, again); err != nil || inserted {
+		t.Errorf("UpsertCachedMessage of a cached message: want replaced, got %v, %v", inserted, err)
+	}
+	cached, err := d.GetCachedMessagesBySender(ctx, "pk-alice", "a@example.com", "ix")
+	if err != nil || len(cached) != 1 || cached[0].Size != 42 || cached[0].SnippetEnc != "snippet" {
+		t.Errorf("a replaced message should keep its snippet, got %+v, %v", cached, err)
+	}
+	if cached, err := d.GetCachedMessagesByOwner(ctx, "pk-nobody"); err != nil || len(cached) != 0 {
+		t.Errorf("GetCachedMessagesByOwner of an unknown owner: want none, got %v, %v", cached, err)
+	}
+
+	for _, m := range []*db.CachedMessage{
+		{OwnerPubKey: "pk-alice", AccountEmail: "a@example.com", UID: "u2"},
+		{OwnerPubKey: "pk-alice", AccountEmail: "b@example.com", UID: "u9"},
+	} {
+		if _, err := d.UpsertCachedMessage(ctx, m); err != nil {
+			t.Fatalf("UpsertCachedMessage: %v", err)
+		}
+	}
+	uids := func(msgs []db.CachedMessage) string {
+		var u []string
+		for _, m := range msgs {
+			u = append(u, m.UID)
+		}
+		return strings.Join(u, ",")
+	}
+	hourAgo, inAnHour := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if stale, err := d.FindStaleCachedMessages(ctx, db.StaleMessageQuery{Owner: "pk-alice", SeenBefore: hourAgo}); err != nil || len(stale) != 0 {
+		t.Errorf("FindStaleCachedMessages of fresh previews: want none, got %v, %v", uids(stale), err)
+	}
+	if err := d.MarkCachedMessagesSeen(ctx, "pk-alice", "a@example.com", []string{"u1"}, time.Now()); err != nil {
+		t.Fatalf("MarkCachedMessagesSeen: %v", err)
+	}
+	stale, err := d.FindStaleCachedMessages(ctx, db.StaleMessageQuery{Owner: "pk-alice", SeenBefore: hourAgo})
+	if err != nil || uids(stale) != "u2" || stale[0].VanishedAt.IsZero() {
+		t.Errorf("FindStaleCachedMessages: want the vanished u2, got %v, %v", uids(stale), err)
+	}
+	all, err := d.FindStaleCachedMessages(ctx, db.StaleMessageQuery{Owner: "pk-alice", SeenBefore: inAnHour})
+	if err != nil || len(all) != 3 {
+		t.Fatalf("FindStaleCachedMessages of everything seen before now: want 3, got %v, %v", uids(all), err)
+	}
+	if page, err := d.FindStaleCachedMessages(ctx, db.StaleMessageQuery{Owner: "pk-alice", SeenBefore: inAnHour, Limit: 2}); err != nil || uids(page) != uids(all[:2]) {
+		t.Errorf("FindStaleCachedMessages with a limit: want %v, got %v, %v", uids(all[:2]), uids(page), err)
+	}
+	if page, err := d.FindStaleCachedMessages(ctx, db.StaleMessageQuery{Owner: "pk-alice", SeenBefore: inAnHour, After: all[1].ID}); err != nil || uids(page) != uids(all[2:]) {
+		t.Errorf("FindStaleCachedMessages after an id: want %v, got %v, %v", uids(all[2:]), uids(page), err)
+	}
+	if page, err := d.FindStaleCachedMessages(ctx, db.StaleMessageQuery{Account: "b@example.com", SeenBefore: inAnHour}); err != nil || uids(page) != "u9" {
+		t.Errorf("FindStaleCachedMessages of one account: want u9, got %v, %v", uids(page), err)
+	}
+
+	if err := d.MarkCachedMessagesSeen(ctx, "pk-alice", "a@example.com", []string{"u1", "u2"}, time.Now()); err != nil {
+		t.Fatalf("MarkCachedMessagesSeen: %v", err)
+	}
+	if stale, err := d.FindStaleCachedMessages(ctx, db.StaleMessageQuery{Owner: "pk-alice", SeenBefore: hourAgo}); err != nil || len(stale) != 0 {
+		t.Errorf("a preview seen again should no longer be vanished, got %v, %v", uids(stale), err)
+	}
+
+	if n, err := d.DeleteCachedMessages(ctx, []primitive.ObjectID{cachedID(all, "u2")}); err != nil || n != 1 {
+		t.Errorf("DeleteCachedMessages: want 1 deleted, got %d, %v", n, err)
+	}
+	if n, err := d.DeleteCachedMessages(ctx, []primitive.ObjectID{cachedID(all, "u2")}); err != nil || n != 0 {
+		t.Errorf("DeleteCachedMessages of a deleted preview: want 0, got %d, %v", n, err)
+	}
+	if left, err := d.GetCachedMessagesByOwner(ctx, "pk-alice"); err != nil || len(left) != 2 {
+		t.Errorf("after deleting u2: want 2 previews left, got %v, %v", uids(left), err)
+	}
+}
+
+// cachedID returns the id of the preview with the given UID among msgs.
+func cachedID(msgs []db.CachedMessage, uid string) primitive.ObjectID {
+	for _, m := range msgs {
+		if m.UID == uid {
+			return m.ID
+		}
+	}
+	return primitive.NilObjectID
+}
+
+func conformScheduledMessages(t *testing.T, ctx context.Context, d db.DB) {
+	now := time.Now()
+	if _, err := d.ClaimDueScheduledMessage(ctx, now, "w1"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("ClaimDueScheduledMessage with nothing due: want ErrNotFound, got %v", err)
+	}
+	later := &db.ScheduledMessage{OwnerPubKey: "pk-alice", SendAt: now.Add(-time.Minute)}
+	sooner := &db.ScheduledMessage{OwnerPubKey: "pk-alice", SendAt: now.Add(-time.Hour)}
+	future := &db.ScheduledMessage{OwnerPubKey: "pk-alice", SendAt: now.Add(time.Hour)}
+	for _, m := range []*db.ScheduledMessage{later, sooner, future} {
+		if err := d.CreateScheduledMessage(ctx, m); err != nil {
+			t.Fatalf("CreateScheduledMessage: %v", err)
+		}
+		if m.ID.IsZero() || m.Status != db.ScheduledPending {
+			t.Errorf("CreateScheduledMessage should set the ID and status, got %+v", m)
+		}
+	}
+
+	if err := d.CancelScheduledMessage(ctx, "pk-mallory", future.ID.Hex()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("CancelScheduledMessage of another owner's message: want ErrNotFound, got %v", err)
+	}
+	if err := d.CancelScheduledMessage(ctx, "pk-alice", "not-an-id"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("CancelScheduledMessage of a malformed id: want ErrNotFound, got %v", err)
+	}
+	if err := d.CancelScheduledMessage(ctx, "pk-alice", future.ID.Hex()); err != nil {
+		t.Errorf("CancelScheduledMessage: %v", err)
+	}
+	if err := d.CancelScheduledMessage(ctx, "pk-alice", future.ID.Hex()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("CancelScheduledMessage of a cancelled message: want ErrNotFound, got %v", err)
+	}
+
+	claimed, err := d.ClaimDueScheduledMessage(ctx, now, "w1")
+	if err != nil || claimed.ID != sooner.ID || claimed.Status != db.ScheduledSending || claimed.ClaimedBy != "w1" {
+		t.Fatalf("ClaimDueScheduledMessage should claim the earliest due message, got %+v, %v", claimed, err)
+	}
+	stolen := *claimed
+	stolen.ClaimedBy, stolen.Status = "w2", db.ScheduledSent
+	if err := d.FinishScheduledAttempt(ctx, &stolen); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("FinishScheduledAttempt by another worker: want ErrNotFound, got %v", err)
+	}
+	if err := d.CancelScheduledMessage(ctx, "pk-alice", claimed.ID.Hex()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("CancelScheduledMessage of a message being sent: want ErrNotFound, got %v", err)
+	}
+	if n, err := d.MarkStuckScheduledMessages(ctx, now.Add(-time.Minute), "lost"); err != nil || n != 0 {
+		t.Errorf("MarkStuckScheduledMessages of a fresh claim: want 0, got %d, %v", n, err)
+	}
+	claimed.Status = db.ScheduledSent
+	if err := d.FinishScheduledAttempt(ctx, claimed); err != nil {
+		t.Errorf("FinishScheduledAttempt: %v", err)
+	}
+	if err := d.FinishScheduledAttempt(ctx, claimed); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("FinishScheduledAttempt of a finished message: want ErrNotFound, got %v", err)
+	}
+
+	// The remaining due message is claimed by a worker that never reports
+	// back; once its claim is stale it is stuck, and can be cancelled.
+	lost, err := d.ClaimDueScheduledMessage(ctx, now, "w1")
+	if err != nil || lost.ID != later.ID {
+		t.Fatalf("ClaimDueScheduledMessage: want the later message, got %+v, %v", lost, err)
+	}
+	if n, err := d.MarkStuckScheduledMessages(ctx, time.Now().Add(time.Minute), "lost"); err != nil || n != 1 {
+		t.Errorf("MarkStuckScheduledMessages: want 1, got %d, %v", n, err)
+	}
+	if err := d.FinishScheduledAttempt(ctx, lost); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("FinishScheduledAttempt of a stuck message: want ErrNotFound, got %v", err)
+	}
+	if err := d.CancelScheduledMessage(ctx, "pk-alice", later.ID.Hex()); err != nil {
+		t.Errorf("CancelScheduledMessage of a stuck message: %v", err)
+	}
+
+	msgs, err := d.GetScheduledMessagesByOwner(ctx, "pk-alice")
+	if err != nil || len(msgs) != 3 {
+		t.Fatalf("GetScheduledMessagesByOwner: want 3 messages, got %v, %v", msgs, err)
+	}
+	if msgs[0].ID != sooner.ID || msgs[0].Status != db.ScheduledSent || msgs[1].Status != db.ScheduledCancelled || msgs[2].Status != db.ScheduledCancelled {
+		t.Errorf("GetScheduledMessagesByOwner: want send time order, got %+v", msgs)
+	}
+}
+
+func conformOutbox(t *testing.T, ctx context.Context, d db.DB) {
+	now := time.Now()
+	msg := &db.OutboxMessage{OwnerPubKey: "pk-alice"}
+	if err := d.CreateOutboxMessage(ctx, msg); err != nil {
+		t.Fatalf("CreateOutboxMessage: %v", err)
+	}
+	if _, err := d.GetOutboxMessage(ctx, "pk-mallory", msg.ID.Hex()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetOutboxMessage of another owner's message: want ErrNotFound, got %v", err)
+	}
+	if err := d.RenewOutboxClaim(ctx, msg.ID, "w1", now); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("RenewOutboxClaim of an unclaimed message: want ErrNotFound, got %v", err)
+	}
+
+	claimed, err := d.ClaimOutboxMessage(ctx, time.Now(), now.Add(-time.Minute), "w1")
+	if err != nil || claimed.ID != msg.ID || claimed.Attempts != 1 || claimed.ClaimedBy != "w1" {
+		t.Fatalf("ClaimOutboxMessage: got %+v, %v", claimed, err)
+	}
+	if _, err := d.ClaimOutboxMessage(ctx, time.Now(), now.Add(-time.Minute), "w2"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("ClaimOutboxMessage of a fresh claim: want ErrNotFound, got %v", err)
+	}
+	if err := d.RenewOutboxClaim(ctx, msg.ID, "w2", time.Now()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("RenewOutboxClaim by another worker: want ErrNotFound, got %v", err)
+	}
+	if err := d.RenewOutboxClaim(ctx, msg.ID, "w1", time.Now()); err != nil {
+		t.Errorf("RenewOutboxClaim: %v", err)
+	}
+
+	// A claim not renewed since staleBefore is taken over.
+	stale, err := d.ClaimOutboxMessage(ctx, time.Now(), time.Now().Add(time.Minute), "w2")
+	if err != nil || stale.ClaimedBy != "w2" || stale.Attempts != 2 {
+		t.Fatalf("ClaimOutboxMessage of a stale claim: got %+v, %v", stale, err)
+	}
+	claimed.Status = db.OutboxSent
+	if err := d.FinishOutboxAttempt(ctx, claimed); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("FinishOutboxAttempt by the worker that lost the claim: want ErrNotFound, got %v", err)
+	}
+	stale.Status = db.OutboxSent
+	if err := d.FinishOutboxAttempt(ctx, stale); err != nil {
+		t.Errorf("FinishOutboxAttempt: %v", err)
+	}
+	if got, err := d.GetOutboxMessage(ctx, "pk-alice", msg.ID.Hex()); err != nil || got.Status != db.OutboxSent {
+		t.Errorf("GetOutboxMessage: got %+v, %v", got, err)
+	}
+
+	// A deferred message waits for its NextAttemptAt, then is claimed.
+	deferred := &db.OutboxMessage{OwnerPubKey: "pk-alice", Status: db.OutboxDeferredGreylist, NextAttemptAt: now.Add(10 * time.Minute), Attempts: 1}
+	if err := d.CreateOutboxMessage(ctx, deferred); err != nil || deferred.Status != db.OutboxDeferredGreylist {
+		t.Fatalf("CreateOutboxMessage of a deferred message: got %+v, %v", deferred, err)
+	}
+	if _, err := d.ClaimOutboxMessage(ctx, now, now.Add(-time.Minute), "w1"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("ClaimOutboxMessage before the deferral ends: want ErrNotFound, got %v", err)
+	}
+	if undelivered, err := d.GetUndeliveredOutboxMessages(ctx); err != nil || len(undelivered) != 1 || undelivered[0].ID != deferred.ID {
+		t.Errorf("GetUndeliveredOutboxMessages: want the deferred message, got %+v, %v", undelivered, err)
+	}
+	claimed, err = d.ClaimOutboxMessage(ctx, now.Add(11*time.Minute), now.Add(-time.Minute), "w1")
+	if err != nil || claimed.ID != deferred.ID || claimed.Attempts != 2 {
+		t.Errorf("ClaimOutboxMessage once the deferral ends: got %+v, %v", claimed, err)
+	}
+}
+
+func conformExportJobs(t *testing.T, ctx context.Context, d db.DB) {
+	first := &db.ExportJob{OwnerPubKey: "pk-alice"}
+	if created, err := d.CreateExportJob(ctx, first); err != nil || !created {
+		t.Fatalf("CreateExportJob: want created, got %v, %v", created, err)
+	}
+	again := &db.ExportJob{OwnerPubKey: "pk-alice"}
+	if created, err := d.CreateExportJob(ctx, again); err != nil || created || again.ID != first.ID {
+		t.Errorf("CreateExportJob with one pending: want the pending job, got %+v, %v, %v", again, created, err)
+	}
+	mbox := &db.ExportJob{OwnerPubKey: "pk-alice", Kind: db.ExportMbox, AccountEmail: "a@example.com"}
+	if created, err := d.CreateExportJob(ctx, mbox); err != nil || !created || mbox.ID == first.ID {
+		t.Errorf("CreateExportJob of another kind: want a new job, got %+v, %v, %v", mbox, created, err)
+	}
+	if _, err := d.GetExportJob(ctx, "pk-mallory", first.ID.Hex()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetExportJob of another owner's job: want ErrNotFound, got %v", err)
+	}
+}
+
+func conformErasure(t *testing.T, ctx context.Context, d db.DB) {
+	now := time.Now()
+	first := &db.ErasureJob{OwnerPubKey: "pk-alice", ChallengeHash: "h1", ChallengeExpiresAt: now.Add(time.Minute)}
+	if err := d.CreateErasureChallenge(ctx, first); err != nil {
+		t.Fatalf("CreateErasureChallenge: %v", err)
+	}
+	second := &db.ErasureJob{OwnerPubKey: "pk-alice", ChallengeHash: "h2", ChallengeExpiresAt: now.Add(time.Minute)}
+	if err := d.CreateErasureChallenge(ctx, second); err != nil {
+		t.Fatalf("CreateErasureChallenge: %v", err)
+	}
+	if second.ID != first.ID || second.Status != db.ErasureChallenged {
+		t.Errorf("a new challenge should replace the open one, got %+v", second)
+	}
+	if _, err := d.ConfirmErasureJob(ctx, "pk-alice", "h1", now); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("ConfirmErasureJob with a replaced challenge: want ErrNotFound, got %v", err)
+	}
+	if _, err := d.ConfirmErasureJob(ctx, "pk-alice", "h2", now.Add(time.Hour)); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("ConfirmErasureJob with an expired challenge: want ErrNotFound, got %v", err)
+	}
+	job, err := d.ConfirmErasureJob(ctx, "pk-alice", "h2", now)
+	if err != nil || job.ID != first.ID || job.Status != db.ErasurePending || job.ChallengeHash != "" {
+		t.Errorf("ConfirmErasureJob: got %+v, %v", job, err)
+	}
+	if _, err := d.ConfirmErasureJob(ctx, "pk-alice", "h2", now); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("ConfirmErasureJob twice: want ErrNotFound, got %v", err)
+	}
+}
+
+func conformUniqueRecords(t *testing.T, ctx context.Context, d db.DB) {
+	if err := d.CreatePayment(ctx, &db.Payment{TxSig: "sig", OwnerPubKey: "pk-alice"}); err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if err := d.CreatePayment(ctx, &db.Payment{TxSig: "sig", OwnerPubKey: "pk-mallory"}); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("CreatePayment of a claimed transaction: want ErrDuplicate, got %v", err)
+	}
+	if _, err := d.GetPaymentByTxSig(ctx, "other"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetPaymentByTxSig of an unknown transaction: want ErrNotFound, got %v", err)
+	}
+
+	if err := d.CreateTip(ctx, &db.Tip{TxSig: "tip", FromPubKey: "pk-alice"}); err != nil {
+		t.Fatalf("CreateTip: %v", err)
+	}
+	if err := d.CreateTip(ctx, &db.Tip{TxSig: "tip", FromPubKey: "pk-alice"}); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("CreateTip of a recorded transaction: want ErrDuplicate, got %v", err)
+	}
+
+	key := &db.APIKey{KeyHash: "hash", OwnerPubKey: "pk-alice"}
+	if err := d.CreateAPIKey(ctx, key); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	if err := d.CreateAPIKey(ctx, &db.APIKey{KeyHash: "hash", OwnerPubKey: "pk-alice"}); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("CreateAPIKey of a known hash: want ErrDuplicate, got %v", err)
+	}
+	if _, err := d.GetAPIKeyByHash(ctx, "other"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetAPIKeyByHash of an unknown hash: want ErrNotFound, got %v", err)
+	}
+	if err := d.TouchAPIKey(ctx, primitive.NewObjectID(), time.Now()); err != nil {
+		t.Errorf("TouchAPIKey of an unknown key: want nil, got %v", err)
+	}
+	if err := d.DeleteAPIKey(ctx, "pk-mallory", key.ID.Hex()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("DeleteAPIKey of another owner's key: want ErrNotFound, got %v", err)
+	}
+	if err := d.DeleteAPIKey(ctx, "pk-alice", key.ID.Hex()); err != nil {
+		t.Errorf("DeleteAPIKey: %v", err)
+	}
+
+	until := time.Now().Add(time.Minute)
+	if err := d.UseSignature(ctx, "sig", until); err != nil {
+		t.Fatalf("UseSignature: %v", err)
+	}
+	if err := d.UseSignature(ctx, "sig", until); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("UseSignature of a used signature: want ErrDuplicate, got %v", err)
+	}
+	if err := d.UseSignature(ctx, "other-sig", until); err != nil {
+		t.Errorf("UseSignature of another signature: %v", err)
+	}
+}
+
+func conformContacts(t *testing.T, ctx context.Context, d db.DB) {
+	seen := time.Now().Truncate(time.Millisecond)
+	auto := &db.Contact{OwnerPubKey: "pk-alice", EmailIndex: "bob", EmailEnc: "enc-bob", LastSeen: seen}
+	if err := d.RecordContactActivity(ctx, auto, true); err != nil {
+		t.Fatalf("RecordContactActivity: %v", err)
+	}
+	contacts, err := d.GetContacts(ctx, "pk-alice", "", 10)
+	if err != nil || len(contacts) != 1 || contacts[0].Source != db.ContactAuto || contacts[0].SentCount != 1 {
+		t.Fatalf("GetContacts: want the recorded contact, got %+v, %v", contacts, err)
+	}
+
+	// Creating an address known from mail activity takes the contact over.
+	user := &db.Contact{OwnerPubKey: "pk-alice", EmailIndex: "bob", EmailEnc: "enc-bob", NameEnc: "enc-name"}
+	if err := d.CreateContact(ctx, user); err != nil || user.ID != contacts[0].ID || user.Source != db.ContactUser {
+		t.Errorf("CreateContact of an auto contact: got %+v, %v", user, err)
+	}
+	if err := d.CreateContact(ctx, &db.Contact{OwnerPubKey: "pk-alice", EmailIndex: "bob"}); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("CreateContact of an existing contact: want ErrDuplicate, got %v", err)
+	}
+
+	if err := d.DeleteContact(ctx, "pk-alice", user.ID.Hex()); err != nil {
+		t.Fatalf("DeleteContact: %v", err)
+	}
+	if err := d.DeleteContact(ctx, "pk-alice", user.ID.Hex()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("DeleteContact of a deleted contact: want ErrNotFound, got %v", err)
+	}
+	// The tombstone keeps later mail from bringing the contact back.
+	if err := d.RecordContactActivity(ctx, auto, false); err != nil {
+		t.Errorf("RecordContactActivity of a deleted contact: want nil, got %v", err)
+	}
+	if contacts, err := d.GetContacts(ctx, "pk-alice", "", 10); err != nil || len(contacts) != 0 {
+		t.Errorf("a deleted contact should stay deleted, got %+v, %v", contacts, err)
+	}
+	if err := d.CreateContact(ctx, &db.Contact{OwnerPubKey: "pk-alice", EmailIndex: "bob"}); err != nil {
+		t.Errorf("CreateContact of a deleted contact: %v", err)
+	}
+}
+
+func conformDailySends(t *testing.T, ctx context.Context, d db.DB) {
+	for i, want := range []bool{true, true, false} {
+		ok, err := d.CountDailySend(ctx, "pk-alice", "a@example.com", "2026-01-02", 2)
+		if err != nil || ok != want {
+			t.Errorf("CountDailySend #%d: want %v, got %v, %v", i+1, want, ok, err)
+		}
+	}
+	if ok, err := d.CountDailySend(ctx, "pk-alice", "a@example.com", "2026-01-03", 2); err != nil || !ok {
+		t.Errorf("CountDailySend on the next day: want true, got %v, %v", ok, err)
+	}
+	if _, err := d.CountDailySend(ctx, "pk-alice", "a@example.com", "yesterday", 2); err == nil {
+		t.Error("CountDailySend of a malformed day: want an error")
+	}
+}
+
+func conformLeases(t *testing.T, ctx context.Context, d db.DB) {
+	acquire := map[string]func(key, holder string, ttl time.Duration) (bool, error){
+		"owner": func(key, holder string, ttl time.Duration) (bool, error) {
+			return d.AcquireOwnerLease(ctx, key, holder, ttl)
+		},
+		"role": func(key, holder string, ttl time.Duration) (bool, error) {
+			return d.AcquireRoleLease(ctx, key, holder, ttl)
+		},
+	}
+	release := map[string]func(key, holder string) error{
+		"owner": func(key, holder string) error { return d.ReleaseOwnerLease(ctx, key, holder) },
+		"role":  func(key, holder string) error { return d.ReleaseRoleLease(ctx, key, holder) },
+	}
+	for kind, acquire := range acquire {
+		if ok, err := acquire("k", "a", time.Minute); err != nil || !ok {
+			t.Errorf("%s lease: first acquire should succeed, got %v, %v", kind, ok, err)
+		}
+		if ok, err := acquire("k", "b", time.Minute); err != nil || ok {
+			t.Errorf("%s lease: a held lease should not be taken, got %v, %v", kind, ok, err)
+		}
+		if ok, err := acquire("k", "a", time.Minute); err != nil || !ok {
+			t.Errorf("%s lease: the holder should renew it, got %v, %v", kind, ok, err)
+		}
+		if err := release[kind]("k", "b"); err != nil {
+			t.Errorf("%s lease: release by another holder: %v", kind, err)
+		}
+		if ok, _ := acquire("k", "b", time.Minute); ok {
+			t.Errorf("%s lease: release by another holder should not free it", kind)
+		}
+		if err := release[kind]("k", "a"); err != nil {
+			t.Errorf("%s lease: release: %v", kind, err)
+		}
+		if ok, err := acquire("k", "b", time.Millisecond); err != nil || !ok {
+			t.Errorf("%s lease: a released lease should be free, got %v, %v", kind, ok, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if ok, err := acquire("k", "a", time.Minute); err != nil || !ok {
+			t.Errorf("%s lease: an expired lease should be free, got %v, %v", kind, ok, err)
+		}
+	}
+	leases, err := d.GetRoleLeases(ctx)
+	if err != nil || len(leases) != 1 || leases[0].Role != "k" || leases[0].Holder != "a" {
+		t.Errorf("GetRoleLeases: got %+v, %v", leases, err)
+	}
+}
+
+func conformOwnerData(t *testing.T, ctx context.Context, d db.DB) {
+	if _, err := d.DeleteOwnerData(ctx, "pk-alice", "identities"); err == nil {
+		t.Error("DeleteOwnerData of a collection that is not owner data: want an error")
+	}
+	if err := d.CreateMailAccount(ctx, &db.MailAccount{OwnerPubKey: "pk-alice", AccountEmail: "a@example.com"}); err != nil {
+		t.Fatalf("CreateMailAccount: %v", err)
+	}
+	if err := d.CreateMailAccount(ctx, &db.MailAccount{OwnerPubKey: "pk-bob", AccountEmail: "b@example.com"}); err != nil {
+		t.Fatalf("CreateMailAccount: %v", err)
+	}
+	counts, err := d.CountOwnerData(ctx, "pk-alice")
+	if err != nil || counts["mail_accounts"] != 1 {
+		t.Errorf("CountOwnerData: got %v, %v", counts, err)
+	}
+	if n, err := d.DeleteOwnerData(ctx, "pk-alice", "mail_accounts"); err != nil || n != 1 {
+		t.Errorf("DeleteOwnerData: want 1 deleted, got %d, %v", n, err)
+	}
+	if n, err := d.DeleteOwnerData(ctx, "pk-alice", "mail_accounts"); err != nil || n != 0 {
+		t.Errorf("DeleteOwnerData again: want 0 deleted, got %d, %v", n, err)
+	}
+	if accounts, err := d.GetMailAccountsByOwner(ctx, "pk-bob"); err != nil || len(accounts) != 1 {
+		t.Errorf("DeleteOwnerData should leave other owners' data, got %v, %v", accounts, err)
+	}
+}
+
+func conformAuditEvents(t *testing.T, ctx context.Context, d db.DB) {
+	if events, err := d.GetAuditEvents(ctx, "pk-nobody", 10); err != nil || events == nil || len(events) != 0 {
+		t.Errorf("GetAuditEvents of an unknown owner: want an empty list, got %v, %v", events, err)
+	}
+	for _, action := range []string{"first", "second", "third"} {
+		if err := d.CreateAuditEvent(ctx, &db.AuditEvent{OwnerPubKey: "pk-alice", Action: action}); err != nil {
+			t.Fatalf("CreateAuditEvent: %v", err)
+		}
+	}
+	events, err := d.GetAuditEvents(ctx, "pk-alice", 2)
+	if err != nil || len(events) != 2 || events[0].Action != "third" || events[1].Action != "second" {
+		t.Errorf("GetAuditEvents: want the two newest, newest first, got %+v, %v", events, err)
+	}
+}
+
+func conformSettings(t *testing.T, ctx context.Context, d db.DB) {
+	if _, err := d.GetSendLimits(ctx, "pk-nobody"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetSendLimits of an unknown owner: want ErrNotFound, got %v", err)
+	}
+	if err := d.SetSendLimits(ctx, &db.SendLimits{OwnerPubKey: "pk-alice", MaxDailySends: 5}); err != nil {
+		t.Fatalf("SetSendLimits: %v", err)
+	}
+	if l, err := d.GetSendLimits(ctx, "pk-alice"); err != nil || l.MaxDailySends != 5 {
+		t.Errorf("GetSendLimits: got %+v, %v", l, err)
+	}
+
+	if _, err := d.GetAccountHealth(ctx, "pk-nobody", "a@example.com"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetAccountHealth of an unknown account: want ErrNotFound, got %v", err)
+	}
+	if err := d.SetAccountHealth(ctx, &db.AccountHealth{OwnerPubKey: "pk-alice", AccountEmail: "a@example.com", ConsecutiveFailures: 2}); err != nil {
+		t.Fatalf("SetAccountHealth: %v", err)
+	}
+	if h, err := d.GetAccountHealth(ctx, "pk-alice", "a@example.com"); err != nil || h.ConsecutiveFailures != 2 {
+		t.Errorf("GetAccountHealth: got %+v, %v", h, err)
+	}
+
+	if m, err := d.GetMaintenance(ctx); err != nil || m.Enabled {
+		t.Errorf("GetMaintenance before any is set: want disabled, got %+v, %v", m, err)
+	}
+	if err := d.SetMaintenance(ctx, &db.Maintenance{Enabled: true, Message: "migrating", RetryAfter: 60}); err != nil {
+		t.Fatalf("SetMaintenance: %v", err)
+	}
+	if m, err := d.GetMaintenance(ctx); err != nil || !m.Enabled || m.Message != "migrating" || m.RetryAfter != 60 || m.UpdatedAt.IsZero() {
+		t.Errorf("GetMaintenance: got %+v, %v", m, err)
+	}
+	if err := d.SetMaintenance(ctx, &db.Maintenance{}); err != nil {
+		t.Fatalf("SetMaintenance off: %v", err)
+	}
+	if m, err := d.GetMaintenance(ctx); err != nil || m.Enabled || m.Message != "" {
+		t.Errorf("GetMaintenance after switching off: got %+v, %v", m, err)
+	}
+}
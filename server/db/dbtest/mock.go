@@ -0,0 +1,1753 @@
+// Package dbtest provides an in-memory db.DB for tests, and a conformance
+// suite that holds it and the MongoDB client to the same behaviour.
+package dbtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"mulamail/db"
+)
+
+// Mock is an in-memory db.DB.  Its fields hold what it stores, for tests to
+// seed and inspect directly; fields guarded by a mutex must only be touched
+// while no call is in flight.  Fail and FailWith make methods fail, so
+// tests can take the error paths of the code calling them.
+type Mock struct {
+	Identities map[string]*db.Identity // keyed by email
+	Accounts   map[string][]*db.MailAccount
+	Sent       []*db.SentMessage
+	SendLimits map[string]*db.SendLimits
+	Payments   map[string]*db.Payment // keyed by tx signature
+	Plans      map[string]*db.Plan
+	Tips       map[string]*db.Tip // keyed by tx signature
+	Scheduled  []*db.ScheduledMessage
+	Contacts   []*db.Contact
+	Exports    []*db.ExportJob
+	Archives   []*db.ArchiveJob
+	Erasures   []*db.ErasureJob
+	Audit      []db.AuditEvent
+
+	IdentityQueries int // batch identity lookups made
+
+	keysMu         sync.Mutex // TouchAPIKey runs in the background
+	APIKeys        []*db.APIKey
+	UsedSignatures map[string]time.Time // expiry by signature hash
+
+	statsMu sync.Mutex // the unified inbox fetches accounts concurrently
+
+	cachedMu sync.Mutex // the unified inbox caches previews concurrently
+	Cached   []*db.CachedMessage
+
+	healthMu sync.Mutex // the unified inbox logs in to accounts concurrently
+	Health   []*db.AccountHealth
+
+	leaseMu       sync.Mutex // leases are taken by concurrent requests
+	Leases        map[string]Lease
+	LeaseAcquires int // successful AcquireOwnerLease calls
+	RoleLeases    map[string]Lease
+
+	maintenanceMu sync.Mutex // every request consults the maintenance switch
+	Maintenance   *db.Maintenance
+
+	outboxMu sync.Mutex // outbox workers claim messages concurrently
+	Outbox   []*db.OutboxMessage
+
+	sendCountsMu sync.Mutex // sends from one account may run concurrently
+	sendCounts   map[sendCountKey]int
+
+	faultsMu sync.Mutex
+	faults   map[string]Fault
+}
+
+var _ db.DB = (*Mock)(nil)
+
+type sendCountKey struct{ owner, account, day string }
+
+// Lease is an owner or role lease held in a Mock.
+type Lease struct {
+	Holder  string
+	Expires time.Time
+}
+
+// New returns an empty Mock.
+func New() *Mock {
+	return &Mock{
+		Identities: make(map[string]*db.Identity),
+		Accounts:   make(map[string][]*db.MailAccount),
+		SendLimits: make(map[string]*db.SendLimits),
+		Payments:   make(map[string]*db.Payment),
+		Plans:      make(map[string]*db.Plan),
+		Tips:       make(map[string]*db.Tip),
+	}
+}
+
+// Fault decides whether a call of a Mock method fails.  It is given the
+// call's context and the method's other arguments, and returns the error
+// the call fails with, or nil to let it run.
+type Fault func(ctx context.Context, args ...any) error
+
+// FailWith makes f decide the calls of the db.DB method named method,
+// replacing any fault set for it before; a nil f removes it.  It panics
+// if db.DB has no such method.
+func (m *Mock) FailWith(method string, f Fault) {
+	if _, ok := reflect.TypeFor[db.DB]().MethodByName(method); !ok {
+		panic("dbtest: db.DB has no method " + method)
+	}
+	m.faultsMu.Lock()
+	defer m.faultsMu.Unlock()
+	if m.faults == nil {
+		m.faults = make(map[string]Fault)
+	}
+	if f == nil {
+		delete(m.faults, method)
+		return
+	}
+	m.faults[method] = f
+}
+
+// Fail makes every call of method fail with err.
+func (m *Mock) Fail(method string, err error) {
+	m.FailWith(method, func(context.Context, ...any) error { return err })
+}
+
+// FailOnce makes the next call of method fail with err, and later calls
+// run.
+func (m *Mock) FailOnce(method string, err error) {
+	var once sync.Once
+	m.FailWith(method, func(context.Context, ...any) error {
+		var failed error
+		once.Do(func() { failed = err })
+		return failed
+	})
+}
+
+// fault returns the error the fault set for method fails this call with.
+func (m *Mock) fault(ctx context.Context, method string, args ...any) error {
+	m.faultsMu.Lock()
+	f := m.faults[method]
+	m.faultsMu.Unlock()
+	if f == nil {
+		return nil
+	}
+	return f(ctx, args...)
+}
+
+func (m *Mock) CreateIdentity(ctx context.Context, id *db.Identity) error {
+	if err := m.fault(ctx, "CreateIdentity", id); err != nil {
+		return err
+	}
+	if id.CanonicalEmail != "" && m.identityByCanonical(id.CanonicalEmail) != nil {
+		return db.ErrDuplicate
+	}
+	if id.TxSig != "" && m.identityByTxSig(id.TxSig) != nil {
+		return db.ErrDuplicate
+	}
+	if id.ID.IsZero() {
+		id.ID = primitive.NewObjectID()
+	}
+	id.CreatedAt = time.Now()
+	m.Identities[id.Email] = id
+	return nil
+}
+
+func (m *Mock) GetIdentityByTxSig(ctx context.Context, sig string) (*db.Identity, error) {
+	if err := m.fault(ctx, "GetIdentityByTxSig", sig); err != nil {
+		return nil, err
+	}
+	if id := m.identityByTxSig(sig); id != nil {
+		return id, nil
+	}
+	return nil, db.ErrNotFound
+}
+
+// identityByTxSig returns the identity registered with the transaction
+// whose signature is sig.
+func (m *Mock) identityByTxSig(sig string) *db.Identity {
+	for _, id := range m.Identities {
+		if id.TxSig == sig {
+			return id
+		}
+	}
+	return nil
+}
+
+func (m *Mock) GetIdentityByEmail(ctx context.Context, email string) (*db.Identity, error) {
+	if err := m.fault(ctx, "GetIdentityByEmail", email); err != nil {
+		return nil, err
+	}
+	if id, ok := m.Identities[email]; ok {
+		return id, nil
+	}
+	return nil, db.ErrNotFound
+}
+
+// identityByCanonical returns the identity with the canonical email.
+func (m *Mock) identityByCanonical(canonical string) *db.Identity {
+	for _, id := range m.Identities {
+		if id.CanonicalEmail == canonical {
+			return id
+		}
+	}
+	return nil
+}
+
+func (m *Mock) GetIdentityByCanonicalEmail(ctx context.Context, canonical, email string) (*db.Identity, error) {
+	if err := m.fault(ctx, "GetIdentityByCanonicalEmail", canonical, email); err != nil {
+		return nil, err
+	}
+	if id := m.identityByCanonical(canonical); id != nil {
+		return id, nil
+	}
+	if id, ok := m.Identities[email]; ok && id.CanonicalEmail == "" {
+		return id, nil
+	}
+	return nil, db.ErrNotFound
+}
+
+// identitiesOf returns the pubkey's identities in the database's order:
+// unrevoked first, then the primary, then oldest first.
+func (m *Mock) identitiesOf(pubkey string) []*db.Identity {
+	var ids []*db.Identity
+	for _, id := range m.Identities {
+		if id.PubKey == pubkey {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		switch {
+		case a.RevokedAt.IsZero() != b.RevokedAt.IsZero():
+			return a.RevokedAt.IsZero()
+		case a.Primary != b.Primary:
+			return a.Primary
+		case !a.CreatedAt.Equal(b.CreatedAt):
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID.Hex() < b.ID.Hex()
+	})
+	return ids
+}
+
+func (m *Mock) GetIdentityByPubKey(ctx context.Context, pubkey string) (*db.Identity, error) {
+	if err := m.fault(ctx, "GetIdentityByPubKey", pubkey); err != nil {
+		return nil, err
+	}
+	if ids := m.identitiesOf(pubkey); len(ids) > 0 {
+		return ids[0], nil
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) GetIdentitiesByEmails(ctx context.Context, emails []string) ([]db.Identity, error) {
+	if err := m.fault(ctx, "GetIdentitiesByEmails", emails); err != nil {
+		return nil, err
+	}
+	m.IdentityQueries++
+	var result []db.Identity
+	for _, e := range emails {
+		if id, ok := m.Identities[e]; ok {
+			result = append(result, *id)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) GetIdentitiesByCanonicalEmails(ctx context.Context, canonicals, emails []string) ([]db.Identity, error) {
+	if err := m.fault(ctx, "GetIdentitiesByCanonicalEmails", canonicals, emails); err != nil {
+		return nil, err
+	}
+	m.IdentityQueries++
+	var result []db.Identity
+	for _, id := range m.Identities {
+		if (id.CanonicalEmail != "" && slices.Contains(canonicals, id.CanonicalEmail)) ||
+			(id.CanonicalEmail == "" && slices.Contains(emails, id.Email)) {
+			result = append(result, *id)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) GetIdentitiesByPubKeys(ctx context.Context, pubkeys []string) ([]db.Identity, error) {
+	if err := m.fault(ctx, "GetIdentitiesByPubKeys", pubkeys); err != nil {
+		return nil, err
+	}
+	m.IdentityQueries++
+	var result []db.Identity
+	for _, pk := range pubkeys {
+		for _, id := range m.identitiesOf(pk) {
+			result = append(result, *id)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) UpsertIdentity(ctx context.Context, id *db.Identity) (bool, error) {
+	if err := m.fault(ctx, "UpsertIdentity", id); err != nil {
+		return false, err
+	}
+	if _, ok := m.Identities[id.Email]; ok {
+		return false, nil
+	}
+	if id.CanonicalEmail != "" && m.identityByCanonical(id.CanonicalEmail) != nil {
+		return false, nil
+	}
+	if id.CreatedAt.IsZero() {
+		id.CreatedAt = time.Now()
+	}
+	id.ID = primitive.NewObjectID()
+	m.Identities[id.Email] = id
+	return true, nil
+}
+
+func (m *Mock) GetAllIdentities(ctx context.Context) ([]db.Identity, error) {
+	if err := m.fault(ctx, "GetAllIdentities"); err != nil {
+		return nil, err
+	}
+	result := make([]db.Identity, 0, len(m.Identities))
+	for _, id := range m.Identities {
+		result = append(result, *id)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+		return result[i].Email < result[j].Email
+	})
+	return result, nil
+}
+
+func (m *Mock) SetIdentityCanonicalEmail(ctx context.Context, oid primitive.ObjectID, canonical string) error {
+	if err := m.fault(ctx, "SetIdentityCanonicalEmail", oid, canonical); err != nil {
+		return err
+	}
+	for _, id := range m.Identities {
+		if id.ID != oid {
+			continue
+		}
+		if other := m.identityByCanonical(canonical); canonical != "" && other != nil && other != id {
+			return db.ErrDuplicate
+		}
+		id.CanonicalEmail = canonical
+		return nil
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) GetIdentitiesToCheck(ctx context.Context, since time.Time, limit int) ([]db.Identity, error) {
+	if err := m.fault(ctx, "GetIdentitiesToCheck", since, limit); err != nil {
+		return nil, err
+	}
+	var result []db.Identity
+	for _, id := range m.Identities {
+		if id.TxHash == "" || id.ChainStatus == db.ChainAnchored || !id.RevokedAt.IsZero() {
+			continue
+		}
+		if id.CreatedAt.Before(since) && id.ChainStatus != "" {
+			continue
+		}
+		result = append(result, *id)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].ChainCheckedAt.Equal(result[j].ChainCheckedAt) {
+			return result[i].ChainCheckedAt.Before(result[j].ChainCheckedAt)
+		}
+		return result[i].ID.Hex() < result[j].ID.Hex()
+	})
+	return result[:min(len(result), limit)], nil
+}
+
+func (m *Mock) SetIdentityChainStatus(ctx context.Context, oid primitive.ObjectID, status string, verified bool, at time.Time) error {
+	if err := m.fault(ctx, "SetIdentityChainStatus", oid, status, verified, at); err != nil {
+		return err
+	}
+	for _, id := range m.Identities {
+		if id.ID == oid {
+			id.ChainStatus, id.Verified, id.ChainCheckedAt = status, verified, at
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) CreateMailAccount(ctx context.Context, acc *db.MailAccount) error {
+	if err := m.fault(ctx, "CreateMailAccount", acc); err != nil {
+		return err
+	}
+	if acc.ID.IsZero() {
+		acc.ID = primitive.NewObjectID()
+	}
+	acc.CreatedAt = time.Now()
+	m.Accounts[acc.OwnerPubKey] = append(m.Accounts[acc.OwnerPubKey], acc)
+	return nil
+}
+
+func (m *Mock) FindMailAccounts(ctx context.Context, q db.MailAccountQuery) ([]db.MailAccount, error) {
+	if err := m.fault(ctx, "FindMailAccounts", q); err != nil {
+		return nil, err
+	}
+	return m.findMailAccounts(q), nil
+}
+
+// findMailAccounts returns the mail accounts q selects, oldest first.
+func (m *Mock) findMailAccounts(q db.MailAccountQuery) []db.MailAccount {
+	result := make([]db.MailAccount, 0)
+	for owner, accs := range m.Accounts {
+		if q.Owner != "" && owner != q.Owner {
+			continue
+		}
+		for _, a := range accs {
+			if q.Email == "" || a.AccountEmail == q.Email {
+				result = append(result, *a)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID.Hex() < b.ID.Hex()
+	})
+	result = result[min(max(q.Page.Offset, 0), len(result)):]
+	if q.Page.Limit > 0 {
+		result = result[:min(q.Page.Limit, len(result))]
+	}
+	return result
+}
+
+func (m *Mock) GetMailAccountsByOwner(ctx context.Context, owner string) ([]db.MailAccount, error) {
+	if err := m.fault(ctx, "GetMailAccountsByOwner", owner); err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		return []db.MailAccount{}, nil
+	}
+	return m.findMailAccounts(db.MailAccountQuery{Owner: owner}), nil
+}
+
+func (m *Mock) CountMailAccountsByOwner(ctx context.Context, owner string) (int64, error) {
+	if err := m.fault(ctx, "CountMailAccountsByOwner", owner); err != nil {
+		return 0, err
+	}
+	if owner == "" {
+		return 0, nil
+	}
+	return int64(len(m.findMailAccounts(db.MailAccountQuery{Owner: owner}))), nil
+}
+
+func (m *Mock) GetMailAccount(ctx context.Context, owner, email string) (*db.MailAccount, error) {
+	if err := m.fault(ctx, "GetMailAccount", owner, email); err != nil {
+		return nil, err
+	}
+	acc := m.mailAccount(owner, email)
+	if acc == nil {
+		return nil, db.ErrNotFound
+	}
+	found := *acc
+	return &found, nil
+}
+
+// mailAccount returns the owner's stored account for email.
+func (m *Mock) mailAccount(owner, email string) *db.MailAccount {
+	if owner == "" || email == "" {
+		return nil
+	}
+	for _, acc := range m.Accounts[owner] {
+		if acc.AccountEmail == email {
+			return acc
+		}
+	}
+	return nil
+}
+
+func (m *Mock) GetAllMailAccounts(ctx context.Context) ([]db.MailAccount, error) {
+	if err := m.fault(ctx, "GetAllMailAccounts"); err != nil {
+		return nil, err
+	}
+	return m.findMailAccounts(db.MailAccountQuery{}), nil
+}
+
+func (m *Mock) SetMailAccountPasswords(ctx context.Context, owner, email, pop3Enc, smtpEnc string) error {
+	if err := m.fault(ctx, "SetMailAccountPasswords", owner, email, pop3Enc, smtpEnc); err != nil {
+		return err
+	}
+	acc := m.mailAccount(owner, email)
+	if acc == nil {
+		return db.ErrNotFound
+	}
+	acc.POP3.PassEnc, acc.SMTP.PassEnc = pop3Enc, smtpEnc
+	return nil
+}
+
+func (m *Mock) UpdateMailAccountProfile(ctx context.Context, owner, email string, p db.MailAccountProfile) error {
+	if err := m.fault(ctx, "UpdateMailAccountProfile", owner, email, p); err != nil {
+		return err
+	}
+	if p == (db.MailAccountProfile{}) {
+		return nil
+	}
+	acc := m.mailAccount(owner, email)
+	if acc == nil {
+		return db.ErrNotFound
+	}
+	if p.DisplayName != nil {
+		acc.DisplayName = *p.DisplayName
+	}
+	if p.Signature != nil {
+		acc.Signature = *p.Signature
+	}
+	if p.DefaultEnvelopeFrom != nil {
+		acc.DefaultEnvelopeFrom = *p.DefaultEnvelopeFrom
+	}
+	if p.FetchPolicy != nil {
+		acc.FetchPolicy = *p.FetchPolicy
+	}
+	if p.SMTPMaxSessions != nil {
+		acc.SMTP.MaxSessions = *p.SMTPMaxSessions
+	}
+	if p.SMTPHELOHostname != nil {
+		acc.SMTP.HELOHostname = *p.SMTPHELOHostname
+	}
+	return nil
+}
+
+func (m *Mock) UpdateMailAccountStats(ctx context.Context, owner, email string, at time.Time, status string, count int) error {
+	if err := m.fault(ctx, "UpdateMailAccountStats", owner, email, at, status, count); err != nil {
+		return err
+	}
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	acc := m.mailAccount(owner, email)
+	if acc == nil || acc.LastFetchAt.After(at) {
+		return nil
+	}
+	acc.LastFetchAt, acc.LastFetchStatus = at, status
+	if status == db.FetchOK {
+		acc.MessageCount = count
+	}
+	return nil
+}
+
+func (m *Mock) CreateSentMessage(ctx context.Context, msg *db.SentMessage) error {
+	if err := m.fault(ctx, "CreateSentMessage", msg); err != nil {
+		return err
+	}
+	if msg.ID.IsZero() {
+		msg.ID = primitive.NewObjectID()
+	}
+	msg.SentAt = time.Now()
+	stored := *msg
+	m.Sent = append(m.Sent, &stored)
+	return nil
+}
+
+func (m *Mock) GetSentMessagesByOwner(ctx context.Context, owner string) ([]db.SentMessage, error) {
+	if err := m.fault(ctx, "GetSentMessagesByOwner", owner); err != nil {
+		return nil, err
+	}
+	return m.sentBy(owner), nil
+}
+
+// sentBy returns the owner's sent messages, oldest first.
+func (m *Mock) sentBy(owner string) []db.SentMessage {
+	var result []db.SentMessage
+	for _, msg := range m.Sent {
+		if msg.OwnerPubKey == owner {
+			result = append(result, *msg)
+		}
+	}
+	slices.SortStableFunc(result, func(a, b db.SentMessage) int { return a.SentAt.Compare(b.SentAt) })
+	return result
+}
+
+func (m *Mock) GetRecentSentMessages(ctx context.Context, owner string, limit int) ([]db.SentMessage, error) {
+	if err := m.fault(ctx, "GetRecentSentMessages", owner, limit); err != nil {
+		return nil, err
+	}
+	result := m.sentBy(owner)
+	slices.SortStableFunc(result, func(a, b db.SentMessage) int { return b.SentAt.Compare(a.SentAt) })
+	return result[:min(limit, len(result))], nil
+}
+
+func (m *Mock) MarkSentMessageBounced(ctx context.Context, owner, messageID string, b *db.SentBounce) error {
+	if err := m.fault(ctx, "MarkSentMessageBounced", owner, messageID, b); err != nil {
+		return err
+	}
+	for _, sent := range m.Sent {
+		if sent.OwnerPubKey == owner && sent.MessageID == messageID {
+			sent.Bounce = b
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) UpsertCachedMessage(ctx context.Context, msg *db.CachedMessage) (bool, error) {
+	if err := m.fault(ctx, "UpsertCachedMessage", msg); err != nil {
+		return false, err
+	}
+	m.cachedMu.Lock()
+	defer m.cachedMu.Unlock()
+	msg.CachedAt = time.Now()
+	msg.LastSeenAt, msg.VanishedAt = msg.CachedAt, time.Time{}
+	for i, c := range m.Cached {
+		if c.OwnerPubKey == msg.OwnerPubKey && c.AccountEmail == msg.AccountEmail && c.UID == msg.UID {
+			if msg.SnippetEnc == "" {
+				msg.SnippetEnc = c.SnippetEnc
+			}
+			msg.ID = c.ID
+			stored := *msg
+			m.Cached[i] = &stored
+			return false, nil
+		}
+	}
+	msg.ID = primitive.NewObjectID()
+	stored := *msg
+	m.Cached = append(m.Cached, &stored)
+	return true, nil
+}
+
+func (m *Mock) GetCachedMessagesBySender(ctx context.Context, owner, account, fromIndex string) ([]db.CachedMessage, error) {
+	if err := m.fault(ctx, "GetCachedMessagesBySender", owner, account, fromIndex); err != nil {
+		return nil, err
+	}
+	var result []db.CachedMessage
+	for _, c := range m.Cached {
+		if c.OwnerPubKey == owner && c.FromIndex == fromIndex && (account == "" || c.AccountEmail == account) {
+			result = append(result, *c)
+		}
+	}
+	slices.SortStableFunc(result, func(a, b db.CachedMessage) int { return b.Date.Compare(a.Date) })
+	return result, nil
+}
+
+func (m *Mock) GetCachedMessagesByOwner(ctx context.Context, owner string) ([]db.CachedMessage, error) {
+	if err := m.fault(ctx, "GetCachedMessagesByOwner", owner); err != nil {
+		return nil, err
+	}
+	var result []db.CachedMessage
+	for _, c := range m.Cached {
+		if c.OwnerPubKey == owner {
+			result = append(result, *c)
+		}
+	}
+	slices.SortStableFunc(result, func(a, b db.CachedMessage) int {
+		if c := strings.Compare(a.AccountEmail, b.AccountEmail); c != 0 {
+			return c
+		}
+		return a.Date.Compare(b.Date)
+	})
+	return result, nil
+}
+
+func (m *Mock) GetBouncedCachedMessages(ctx context.Context, owner, account string, limit int) ([]db.CachedMessage, error) {
+	if err := m.fault(ctx, "GetBouncedCachedMessages", owner, account, limit); err != nil {
+		return nil, err
+	}
+	var result []db.CachedMessage
+	for _, c := range m.Cached {
+		if c.OwnerPubKey == owner && c.Bounced && (account == "" || c.AccountEmail == account) {
+			result = append(result, *c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date.After(result[j].Date) })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (m *Mock) GetPlaintextCachedMessages(ctx context.Context, limit int) ([]db.CachedMessage, error) {
+	if err := m.fault(ctx, "GetPlaintextCachedMessages", limit); err != nil {
+		return nil, err
+	}
+	var result []db.CachedMessage
+	for _, c := range m.Cached {
+		if (c.From != "" || c.Subject != "") && len(result) < limit {
+			result = append(result, *c)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) MarkCachedMessagesSeen(ctx context.Context, owner, account string, uids []string, at time.Time) error {
+	if err := m.fault(ctx, "MarkCachedMessagesSeen", owner, account, uids, at); err != nil {
+		return err
+	}
+	m.cachedMu.Lock()
+	defer m.cachedMu.Unlock()
+	for _, c := range m.Cached {
+		if c.OwnerPubKey != owner || c.AccountEmail != account {
+			continue
+		}
+		if slices.Contains(uids, c.UID) {
+			c.LastSeenAt, c.VanishedAt = at, time.Time{}
+		} else if c.VanishedAt.IsZero() {
+			c.VanishedAt = at
+		}
+	}
+	return nil
+}
+
+func (m *Mock) FindStaleCachedMessages(ctx context.Context, q db.StaleMessageQuery) ([]db.CachedMessage, error) {
+	if err := m.fault(ctx, "FindStaleCachedMessages", q); err != nil {
+		return nil, err
+	}
+	m.cachedMu.Lock()
+	defer m.cachedMu.Unlock()
+	var result []db.CachedMessage
+	for _, c := range m.Cached {
+		if q.Owner != "" && c.OwnerPubKey != q.Owner || q.Account != "" && c.AccountEmail != q.Account {
+			continue
+		}
+		if !q.After.IsZero() && bytes.Compare(c.ID[:], q.After[:]) <= 0 {
+			continue
+		}
+		seen := c.LastSeenAt
+		if seen.IsZero() {
+			seen = c.CachedAt
+		}
+		if c.VanishedAt.IsZero() && !seen.Before(q.SeenBefore) {
+			continue
+		}
+		result = append(result, *c)
+	}
+	slices.SortFunc(result, func(a, b db.CachedMessage) int { return bytes.Compare(a.ID[:], b.ID[:]) })
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result, nil
+}
+
+func (m *Mock) DeleteCachedMessages(ctx context.Context, ids []primitive.ObjectID) (int64, error) {
+	if err := m.fault(ctx, "DeleteCachedMessages", ids); err != nil {
+		return 0, err
+	}
+	m.cachedMu.Lock()
+	defer m.cachedMu.Unlock()
+	before := len(m.Cached)
+	m.Cached = slices.DeleteFunc(m.Cached, func(c *db.CachedMessage) bool { return slices.Contains(ids, c.ID) })
+	return int64(before - len(m.Cached)), nil
+}
+
+func (m *Mock) CreateScheduledMessage(ctx context.Context, msg *db.ScheduledMessage) error {
+	if err := m.fault(ctx, "CreateScheduledMessage", msg); err != nil {
+		return err
+	}
+	msg.ID = primitive.NewObjectID()
+	msg.Status = db.ScheduledPending
+	msg.NextAttemptAt = msg.SendAt
+	msg.CreatedAt, msg.UpdatedAt = time.Now(), time.Now()
+	m.Scheduled = append(m.Scheduled, msg)
+	return nil
+}
+
+func (m *Mock) GetScheduledMessagesByOwner(ctx context.Context, owner string) ([]db.ScheduledMessage, error) {
+	if err := m.fault(ctx, "GetScheduledMessagesByOwner", owner); err != nil {
+		return nil, err
+	}
+	var result []db.ScheduledMessage
+	for _, msg := range m.Scheduled {
+		if msg.OwnerPubKey == owner {
+			result = append(result, *msg)
+		}
+	}
+	slices.SortStableFunc(result, func(a, b db.ScheduledMessage) int { return a.SendAt.Compare(b.SendAt) })
+	return result, nil
+}
+
+func (m *Mock) GetUndeliveredScheduledMessages(ctx context.Context) ([]db.ScheduledMessage, error) {
+	if err := m.fault(ctx, "GetUndeliveredScheduledMessages"); err != nil {
+		return nil, err
+	}
+	var result []db.ScheduledMessage
+	for _, msg := range m.Scheduled {
+		if msg.Status == db.ScheduledPending || msg.Status == db.ScheduledSending {
+			result = append(result, *msg)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) SetScheduledPayload(ctx context.Context, id primitive.ObjectID, payloadEnc string) error {
+	if err := m.fault(ctx, "SetScheduledPayload", id, payloadEnc); err != nil {
+		return err
+	}
+	for _, msg := range m.Scheduled {
+		if msg.ID == id {
+			msg.PayloadEnc = payloadEnc
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) CancelScheduledMessage(ctx context.Context, owner, id string) error {
+	if err := m.fault(ctx, "CancelScheduledMessage", owner, id); err != nil {
+		return err
+	}
+	for _, msg := range m.Scheduled {
+		if msg.ID.Hex() == id && msg.OwnerPubKey == owner && (msg.Status == db.ScheduledPending || msg.Status == db.ScheduledStuck) {
+			msg.Status = db.ScheduledCancelled
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) ClaimDueScheduledMessage(ctx context.Context, now time.Time, worker string) (*db.ScheduledMessage, error) {
+	if err := m.fault(ctx, "ClaimDueScheduledMessage", now, worker); err != nil {
+		return nil, err
+	}
+	var due *db.ScheduledMessage
+	for _, msg := range m.Scheduled {
+		if msg.Status == db.ScheduledPending && !msg.NextAttemptAt.After(now) &&
+			(due == nil || msg.NextAttemptAt.Before(due.NextAttemptAt)) {
+			due = msg
+		}
+	}
+	if due == nil {
+		return nil, db.ErrNotFound
+	}
+	due.Status, due.ClaimedBy, due.UpdatedAt = db.ScheduledSending, worker, now
+	claimed := *due
+	return &claimed, nil
+}
+
+func (m *Mock) MarkStuckScheduledMessages(ctx context.Context, claimedBefore time.Time, lastError string) (int64, error) {
+	if err := m.fault(ctx, "MarkStuckScheduledMessages", claimedBefore, lastError); err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, msg := range m.Scheduled {
+		if msg.Status == db.ScheduledSending && msg.UpdatedAt.Before(claimedBefore) {
+			msg.Status, msg.LastError, msg.UpdatedAt = db.ScheduledStuck, lastError, time.Now()
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Mock) FinishScheduledAttempt(ctx context.Context, upd *db.ScheduledMessage) error {
+	if err := m.fault(ctx, "FinishScheduledAttempt", upd); err != nil {
+		return err
+	}
+	for _, msg := range m.Scheduled {
+		if msg.ID == upd.ID && msg.Status == db.ScheduledSending && msg.ClaimedBy == upd.ClaimedBy {
+			*msg = *upd
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) CreateOutboxMessage(ctx context.Context, msg *db.OutboxMessage) error {
+	if err := m.fault(ctx, "CreateOutboxMessage", msg); err != nil {
+		return err
+	}
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	msg.ID = primitive.NewObjectID()
+	if msg.Status != db.OutboxDeferredGreylist || msg.NextAttemptAt.IsZero() {
+		msg.Status, msg.NextAttemptAt = db.OutboxQueued, time.Now()
+	}
+	msg.CreatedAt, msg.UpdatedAt = time.Now(), time.Now()
+	stored := *msg
+	m.Outbox = append(m.Outbox, &stored)
+	return nil
+}
+
+func (m *Mock) GetOutboxMessage(ctx context.Context, owner, id string) (*db.OutboxMessage, error) {
+	if err := m.fault(ctx, "GetOutboxMessage", owner, id); err != nil {
+		return nil, err
+	}
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	for _, msg := range m.Outbox {
+		if msg.ID.Hex() == id && msg.OwnerPubKey == owner {
+			found := *msg
+			return &found, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) GetUndeliveredOutboxMessages(ctx context.Context) ([]db.OutboxMessage, error) {
+	if err := m.fault(ctx, "GetUndeliveredOutboxMessages"); err != nil {
+		return nil, err
+	}
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	var result []db.OutboxMessage
+	for _, msg := range m.Outbox {
+		if msg.Status == db.OutboxQueued || msg.Status == db.OutboxDeferredGreylist || msg.Status == db.OutboxSending {
+			result = append(result, *msg)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) SetOutboxPayload(ctx context.Context, id primitive.ObjectID, payloadEnc string) error {
+	if err := m.fault(ctx, "SetOutboxPayload", id, payloadEnc); err != nil {
+		return err
+	}
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	for _, msg := range m.Outbox {
+		if msg.ID == id {
+			msg.PayloadEnc = payloadEnc
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) ClaimOutboxMessage(ctx context.Context, now, staleBefore time.Time, worker string) (*db.OutboxMessage, error) {
+	if err := m.fault(ctx, "ClaimOutboxMessage", now, staleBefore, worker); err != nil {
+		return nil, err
+	}
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	var next *db.OutboxMessage
+	for _, msg := range m.Outbox {
+		if (((msg.Status == db.OutboxQueued || msg.Status == db.OutboxDeferredGreylist) && !msg.NextAttemptAt.After(now)) ||
+			(msg.Status == db.OutboxSending && msg.ClaimedAt.Before(staleBefore))) &&
+			(next == nil || msg.NextAttemptAt.Before(next.NextAttemptAt)) {
+			next = msg
+		}
+	}
+	if next == nil {
+		return nil, db.ErrNotFound
+	}
+	next.Status, next.ClaimedBy, next.ClaimedAt, next.UpdatedAt = db.OutboxSending, worker, now, now
+	next.Attempts++
+	claimed := *next
+	return &claimed, nil
+}
+
+func (m *Mock) RenewOutboxClaim(ctx context.Context, id primitive.ObjectID, worker string, now time.Time) error {
+	if err := m.fault(ctx, "RenewOutboxClaim", id, worker, now); err != nil {
+		return err
+	}
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	for _, msg := range m.Outbox {
+		if msg.ID == id && msg.Status == db.OutboxSending && msg.ClaimedBy == worker {
+			msg.ClaimedAt = now
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) FinishOutboxAttempt(ctx context.Context, upd *db.OutboxMessage) error {
+	if err := m.fault(ctx, "FinishOutboxAttempt", upd); err != nil {
+		return err
+	}
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	for _, msg := range m.Outbox {
+		if msg.ID == upd.ID && msg.Status == db.OutboxSending && msg.ClaimedBy == upd.ClaimedBy {
+			*msg = *upd
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) CreateExportJob(ctx context.Context, j *db.ExportJob) (bool, error) {
+	if err := m.fault(ctx, "CreateExportJob", j); err != nil {
+		return false, err
+	}
+	for _, e := range m.Exports {
+		if e.OwnerPubKey == j.OwnerPubKey && e.Kind == j.Kind && e.AccountEmail == j.AccountEmail && (e.Status == db.ExportPending || e.Status == db.ExportRunning) {
+			*j = *e
+			return false, nil
+		}
+	}
+	j.ID = primitive.NewObjectID()
+	j.Status = db.ExportPending
+	j.CreatedAt, j.UpdatedAt = time.Now(), time.Now()
+	stored := *j
+	m.Exports = append(m.Exports, &stored)
+	return true, nil
+}
+
+func (m *Mock) GetExportJob(ctx context.Context, owner, id string) (*db.ExportJob, error) {
+	if err := m.fault(ctx, "GetExportJob", owner, id); err != nil {
+		return nil, err
+	}
+	for _, e := range m.Exports {
+		if e.ID.Hex() == id && e.OwnerPubKey == owner {
+			found := *e
+			return &found, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) ClaimExportJob(ctx context.Context, now, staleBefore time.Time, worker string) (*db.ExportJob, error) {
+	if err := m.fault(ctx, "ClaimExportJob", now, staleBefore, worker); err != nil {
+		return nil, err
+	}
+	for _, e := range m.Exports {
+		if e.Status == db.ExportPending || (e.Status == db.ExportRunning && e.ClaimedAt.Before(staleBefore)) {
+			e.Status, e.ClaimedBy, e.ClaimedAt = db.ExportRunning, worker, now
+			e.Attempts++
+			claimed := *e
+			return &claimed, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) FinishExportJob(ctx context.Context, j *db.ExportJob) error {
+	if err := m.fault(ctx, "FinishExportJob", j); err != nil {
+		return err
+	}
+	for _, e := range m.Exports {
+		if e.ID == j.ID && e.Status == db.ExportRunning && e.ClaimedBy == j.ClaimedBy {
+			*e = *j
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) GetExpiredExportJobs(ctx context.Context, now time.Time) ([]db.ExportJob, error) {
+	if err := m.fault(ctx, "GetExpiredExportJobs", now); err != nil {
+		return nil, err
+	}
+	var result []db.ExportJob
+	for _, e := range m.Exports {
+		if e.Status == db.ExportDone && !e.ExpiresAt.After(now) {
+			result = append(result, *e)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) GetUnexpiredExportJobs(ctx context.Context) ([]db.ExportJob, error) {
+	if err := m.fault(ctx, "GetUnexpiredExportJobs"); err != nil {
+		return nil, err
+	}
+	var result []db.ExportJob
+	for _, e := range m.Exports {
+		if e.Status == db.ExportPending || e.Status == db.ExportRunning || e.Status == db.ExportDone {
+			result = append(result, *e)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) ExpireExportJob(ctx context.Context, id primitive.ObjectID) error {
+	if err := m.fault(ctx, "ExpireExportJob", id); err != nil {
+		return err
+	}
+	for _, e := range m.Exports {
+		if e.ID == id && e.Status == db.ExportDone {
+			e.Status, e.StorageKey = db.ExportExpired, ""
+		}
+	}
+	return nil
+}
+
+func (m *Mock) CreateArchiveJob(ctx context.Context, j *db.ArchiveJob) (bool, error) {
+	if err := m.fault(ctx, "CreateArchiveJob", j); err != nil {
+		return false, err
+	}
+	for _, a := range m.Archives {
+		if a.OwnerPubKey == j.OwnerPubKey && a.AccountEmail == j.AccountEmail && (a.Status == db.ArchivePending || a.Status == db.ArchiveRunning) {
+			*j = *a
+			return false, nil
+		}
+	}
+	j.ID = primitive.NewObjectID()
+	j.Status = db.ArchivePending
+	j.CreatedAt, j.UpdatedAt = time.Now(), time.Now()
+	stored := *j
+	m.Archives = append(m.Archives, &stored)
+	return true, nil
+}
+
+func (m *Mock) GetArchiveJob(ctx context.Context, owner, id string) (*db.ArchiveJob, error) {
+	if err := m.fault(ctx, "GetArchiveJob", owner, id); err != nil {
+		return nil, err
+	}
+	for _, a := range m.Archives {
+		if a.ID.Hex() == id && a.OwnerPubKey == owner {
+			found := *a
+			return &found, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) ClaimArchiveJob(ctx context.Context, now, staleBefore time.Time, worker string) (*db.ArchiveJob, error) {
+	if err := m.fault(ctx, "ClaimArchiveJob", now, staleBefore, worker); err != nil {
+		return nil, err
+	}
+	var oldest *db.ArchiveJob
+	for _, a := range m.Archives {
+		if (a.Status == db.ArchivePending || (a.Status == db.ArchiveRunning && a.ClaimedAt.Before(staleBefore))) &&
+			(oldest == nil || a.UpdatedAt.Before(oldest.UpdatedAt)) {
+			oldest = a
+		}
+	}
+	if oldest == nil {
+		return nil, db.ErrNotFound
+	}
+	oldest.Status, oldest.ClaimedBy, oldest.ClaimedAt, oldest.UpdatedAt = db.ArchiveRunning, worker, now, now
+	oldest.Attempts++
+	claimed := *oldest
+	return &claimed, nil
+}
+
+func (m *Mock) SaveArchiveJob(ctx context.Context, j *db.ArchiveJob) error {
+	if err := m.fault(ctx, "SaveArchiveJob", j); err != nil {
+		return err
+	}
+	for _, a := range m.Archives {
+		if a.ID == j.ID && a.Status == db.ArchiveRunning && a.ClaimedBy == j.ClaimedBy {
+			j.UpdatedAt = time.Now()
+			*a = *j
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) CreateErasureChallenge(ctx context.Context, j *db.ErasureJob) error {
+	if err := m.fault(ctx, "CreateErasureChallenge", j); err != nil {
+		return err
+	}
+	for _, e := range m.Erasures {
+		if e.OwnerPubKey == j.OwnerPubKey && e.Status == db.ErasureChallenged {
+			e.ChallengeHash, e.ChallengeExpiresAt = j.ChallengeHash, j.ChallengeExpiresAt
+			*j = *e
+			return nil
+		}
+	}
+	j.ID = primitive.NewObjectID()
+	j.Status = db.ErasureChallenged
+	j.CreatedAt, j.UpdatedAt = time.Now(), time.Now()
+	stored := *j
+	m.Erasures = append(m.Erasures, &stored)
+	return nil
+}
+
+func (m *Mock) ConfirmErasureJob(ctx context.Context, owner, challengeHash string, now time.Time) (*db.ErasureJob, error) {
+	if err := m.fault(ctx, "ConfirmErasureJob", owner, challengeHash, now); err != nil {
+		return nil, err
+	}
+	for _, e := range m.Erasures {
+		if e.OwnerPubKey == owner && e.Status == db.ErasureChallenged && e.ChallengeHash == challengeHash && e.ChallengeExpiresAt.After(now) {
+			e.Status, e.ChallengeHash, e.ChallengeExpiresAt = db.ErasurePending, "", time.Time{}
+			confirmed := *e
+			return &confirmed, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) GetErasureJob(ctx context.Context, owner, id string) (*db.ErasureJob, error) {
+	if err := m.fault(ctx, "GetErasureJob", owner, id); err != nil {
+		return nil, err
+	}
+	for _, e := range m.Erasures {
+		if e.ID.Hex() == id && e.OwnerPubKey == owner {
+			found := *e
+			found.Steps = slices.Clone(e.Steps)
+			return &found, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) ClaimErasureJob(ctx context.Context, now, staleBefore time.Time, worker string) (*db.ErasureJob, error) {
+	if err := m.fault(ctx, "ClaimErasureJob", now, staleBefore, worker); err != nil {
+		return nil, err
+	}
+	for _, e := range m.Erasures {
+		if e.Status == db.ErasurePending || (e.Status == db.ErasureRunning && e.ClaimedAt.Before(staleBefore)) {
+			e.Status, e.ClaimedBy, e.ClaimedAt = db.ErasureRunning, worker, now
+			e.Attempts++
+			claimed := *e
+			claimed.Steps = slices.Clone(e.Steps)
+			return &claimed, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) UpdateErasureJob(ctx context.Context, j *db.ErasureJob) error {
+	if err := m.fault(ctx, "UpdateErasureJob", j); err != nil {
+		return err
+	}
+	for _, e := range m.Erasures {
+		if e.ID == j.ID && e.Status == db.ErasureRunning && e.ClaimedBy == j.ClaimedBy {
+			*e = *j
+			e.Steps = slices.Clone(j.Steps)
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) CountOwnerData(ctx context.Context, owner string) (map[string]int64, error) {
+	if err := m.fault(ctx, "CountOwnerData", owner); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(db.OwnerCollections))
+	for _, coll := range db.OwnerCollections {
+		counts[coll] = m.ownerData(coll, owner, false)
+	}
+	return counts, nil
+}
+
+func (m *Mock) DeleteOwnerData(ctx context.Context, owner, coll string) (int64, error) {
+	if err := m.fault(ctx, "DeleteOwnerData", owner, coll); err != nil {
+		return 0, err
+	}
+	if !slices.Contains(db.OwnerCollections, coll) {
+		return 0, fmt.Errorf("not an owner data collection: %q", coll)
+	}
+	return m.ownerData(coll, owner, true), nil
+}
+
+// ownerData counts the owner's records in the mock's version of coll,
+// deleting them if del is set.
+func (m *Mock) ownerData(coll, owner string, del bool) int64 {
+	var n int64
+	count := func(owned bool) bool {
+		if owned {
+			n++
+		}
+		return owned && del
+	}
+	switch coll {
+	case "api_keys":
+		m.keysMu.Lock()
+		m.APIKeys = slices.DeleteFunc(m.APIKeys, func(k *db.APIKey) bool { return count(k.OwnerPubKey == owner) })
+		m.keysMu.Unlock()
+	case "scheduled_messages":
+		m.Scheduled = slices.DeleteFunc(m.Scheduled, func(s *db.ScheduledMessage) bool { return count(s.OwnerPubKey == owner) })
+	case "outbox":
+		m.outboxMu.Lock()
+		m.Outbox = slices.DeleteFunc(m.Outbox, func(o *db.OutboxMessage) bool { return count(o.OwnerPubKey == owner) })
+		m.outboxMu.Unlock()
+	case "archive_jobs":
+		m.Archives = slices.DeleteFunc(m.Archives, func(a *db.ArchiveJob) bool { return count(a.OwnerPubKey == owner) })
+	case "mail_accounts":
+		m.Accounts[owner] = slices.DeleteFunc(m.Accounts[owner], func(*db.MailAccount) bool { return count(true) })
+	case "account_health":
+		m.healthMu.Lock()
+		m.Health = slices.DeleteFunc(m.Health, func(h *db.AccountHealth) bool { return count(h.OwnerPubKey == owner) })
+		m.healthMu.Unlock()
+	case "send_counts":
+		m.sendCountsMu.Lock()
+		maps.DeleteFunc(m.sendCounts, func(k sendCountKey, _ int) bool { return count(k.owner == owner) })
+		m.sendCountsMu.Unlock()
+	case "messages":
+		m.Cached = slices.DeleteFunc(m.Cached, func(c *db.CachedMessage) bool { return count(c.OwnerPubKey == owner) })
+	case "sent_messages":
+		m.Sent = slices.DeleteFunc(m.Sent, func(s *db.SentMessage) bool { return count(s.OwnerPubKey == owner) })
+	case "contacts":
+		m.Contacts = slices.DeleteFunc(m.Contacts, func(c *db.Contact) bool { return count(c.OwnerPubKey == owner) })
+	case "export_jobs":
+		m.Exports = slices.DeleteFunc(m.Exports, func(e *db.ExportJob) bool { return count(e.OwnerPubKey == owner) })
+	}
+	return n
+}
+
+func (m *Mock) RevokeIdentities(ctx context.Context, pubkey string, at time.Time) (int64, error) {
+	if err := m.fault(ctx, "RevokeIdentities", pubkey, at); err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, id := range m.Identities {
+		if id.PubKey == pubkey && id.RevokedAt.IsZero() {
+			id.RevokedAt = at
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Mock) CreateAuditEvent(ctx context.Context, e *db.AuditEvent) error {
+	if err := m.fault(ctx, "CreateAuditEvent", e); err != nil {
+		return err
+	}
+	e.ID = primitive.NewObjectID()
+	e.CreatedAt = time.Now()
+	m.Audit = append(m.Audit, *e)
+	return nil
+}
+
+func (m *Mock) GetAuditEvents(ctx context.Context, owner string, limit int) ([]db.AuditEvent, error) {
+	if err := m.fault(ctx, "GetAuditEvents", owner, limit); err != nil {
+		return nil, err
+	}
+	result := make([]db.AuditEvent, 0)
+	for i := len(m.Audit) - 1; i >= 0 && len(result) < limit; i-- {
+		if m.Audit[i].OwnerPubKey == owner {
+			result = append(result, m.Audit[i])
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) CreatePayment(ctx context.Context, p *db.Payment) error {
+	if err := m.fault(ctx, "CreatePayment", p); err != nil {
+		return err
+	}
+	if _, ok := m.Payments[p.TxSig]; ok {
+		return db.ErrDuplicate
+	}
+	p.ID = primitive.NewObjectID()
+	p.CreatedAt = time.Now()
+	m.Payments[p.TxSig] = p
+	return nil
+}
+
+func (m *Mock) GetPaymentByTxSig(ctx context.Context, txSig string) (*db.Payment, error) {
+	if err := m.fault(ctx, "GetPaymentByTxSig", txSig); err != nil {
+		return nil, err
+	}
+	if p, ok := m.Payments[txSig]; ok {
+		return p, nil
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) SetPlan(ctx context.Context, p *db.Plan) error {
+	if err := m.fault(ctx, "SetPlan", p); err != nil {
+		return err
+	}
+	p.UpdatedAt = time.Now()
+	m.Plans[p.OwnerPubKey] = p
+	return nil
+}
+
+func (m *Mock) CreateTip(ctx context.Context, t *db.Tip) error {
+	if err := m.fault(ctx, "CreateTip", t); err != nil {
+		return err
+	}
+	if _, ok := m.Tips[t.TxSig]; ok {
+		return db.ErrDuplicate
+	}
+	t.ID = primitive.NewObjectID()
+	t.CreatedAt = time.Now()
+	m.Tips[t.TxSig] = t
+	return nil
+}
+
+func (m *Mock) CreateAPIKey(ctx context.Context, k *db.APIKey) error {
+	if err := m.fault(ctx, "CreateAPIKey", k); err != nil {
+		return err
+	}
+	m.keysMu.Lock()
+	defer m.keysMu.Unlock()
+	for _, existing := range m.APIKeys {
+		if existing.KeyHash == k.KeyHash {
+			return db.ErrDuplicate
+		}
+	}
+	k.ID = primitive.NewObjectID()
+	k.CreatedAt = time.Now()
+	stored := *k
+	m.APIKeys = append(m.APIKeys, &stored)
+	return nil
+}
+
+func (m *Mock) GetAPIKeyByHash(ctx context.Context, keyHash string) (*db.APIKey, error) {
+	if err := m.fault(ctx, "GetAPIKeyByHash", keyHash); err != nil {
+		return nil, err
+	}
+	m.keysMu.Lock()
+	defer m.keysMu.Unlock()
+	for _, k := range m.APIKeys {
+		if k.KeyHash == keyHash {
+			found := *k
+			return &found, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) DeleteAPIKey(ctx context.Context, owner, id string) error {
+	if err := m.fault(ctx, "DeleteAPIKey", owner, id); err != nil {
+		return err
+	}
+	m.keysMu.Lock()
+	defer m.keysMu.Unlock()
+	for i, k := range m.APIKeys {
+		if k.ID.Hex() == id && k.OwnerPubKey == owner {
+			m.APIKeys = append(m.APIKeys[:i], m.APIKeys[i+1:]...)
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) TouchAPIKey(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	if err := m.fault(ctx, "TouchAPIKey", id, at); err != nil {
+		return err
+	}
+	m.keysMu.Lock()
+	defer m.keysMu.Unlock()
+	for _, k := range m.APIKeys {
+		if k.ID == id {
+			k.LastUsedAt = at
+		}
+	}
+	return nil
+}
+
+func (m *Mock) UseSignature(ctx context.Context, sigHash string, expiresAt time.Time) error {
+	if err := m.fault(ctx, "UseSignature", sigHash, expiresAt); err != nil {
+		return err
+	}
+	m.keysMu.Lock()
+	defer m.keysMu.Unlock()
+	if until, ok := m.UsedSignatures[sigHash]; ok && until.After(time.Now()) {
+		return db.ErrDuplicate
+	}
+	if m.UsedSignatures == nil {
+		m.UsedSignatures = make(map[string]time.Time)
+	}
+	m.UsedSignatures[sigHash] = expiresAt
+	return nil
+}
+
+func (m *Mock) contact(owner, emailIndex string) *db.Contact {
+	for _, c := range m.Contacts {
+		if c.OwnerPubKey == owner && c.EmailIndex == emailIndex {
+			return c
+		}
+	}
+	return nil
+}
+
+func (m *Mock) RecordContactActivity(ctx context.Context, ct *db.Contact, sent bool) error {
+	if err := m.fault(ctx, "RecordContactActivity", ct, sent); err != nil {
+		return err
+	}
+	c := m.contact(ct.OwnerPubKey, ct.EmailIndex)
+	if c == nil {
+		stored := *ct
+		stored.ID = primitive.NewObjectID()
+		stored.Source = db.ContactAuto
+		stored.CreatedAt, stored.UpdatedAt = time.Now(), time.Now()
+		c = &stored
+		m.Contacts = append(m.Contacts, c)
+	} else if c.Deleted {
+		return nil
+	}
+	if sent {
+		c.SentCount++
+	} else {
+		c.ReceivedCount++
+	}
+	if ct.LastSeen.After(c.LastSeen) {
+		c.LastSeen = ct.LastSeen
+	}
+	return nil
+}
+
+func (m *Mock) CreateContact(ctx context.Context, ct *db.Contact) error {
+	if err := m.fault(ctx, "CreateContact", ct); err != nil {
+		return err
+	}
+	c := m.contact(ct.OwnerPubKey, ct.EmailIndex)
+	if c == nil {
+		ct.ID = primitive.NewObjectID()
+		ct.Source = db.ContactUser
+		ct.CreatedAt, ct.UpdatedAt = time.Now(), time.Now()
+		stored := *ct
+		m.Contacts = append(m.Contacts, &stored)
+		return nil
+	}
+	if c.Source == db.ContactUser && !c.Deleted {
+		return db.ErrDuplicate
+	}
+	c.EmailEnc, c.NameEnc, c.Prefixes = ct.EmailEnc, ct.NameEnc, ct.Prefixes
+	c.Source, c.Deleted, c.UpdatedAt = db.ContactUser, false, time.Now()
+	*ct = *c
+	return nil
+}
+
+func (m *Mock) GetContacts(ctx context.Context, owner, prefix string, limit int) ([]db.Contact, error) {
+	if err := m.fault(ctx, "GetContacts", owner, prefix, limit); err != nil {
+		return nil, err
+	}
+	var result []db.Contact
+	for _, c := range m.Contacts {
+		if c.OwnerPubKey == owner && !c.Deleted && (prefix == "" || slices.Contains(c.Prefixes, prefix)) {
+			result = append(result, *c)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].LastSeen.After(result[j].LastSeen) })
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (m *Mock) GetContactsByIndexes(ctx context.Context, owner string, indexes []string) ([]db.Contact, error) {
+	if err := m.fault(ctx, "GetContactsByIndexes", owner, indexes); err != nil {
+		return nil, err
+	}
+	var result []db.Contact
+	for _, c := range m.Contacts {
+		if c.OwnerPubKey == owner && !c.Deleted && slices.Contains(indexes, c.EmailIndex) {
+			result = append(result, *c)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) UpdateContact(ctx context.Context, owner, id string, ct *db.Contact) error {
+	if err := m.fault(ctx, "UpdateContact", owner, id, ct); err != nil {
+		return err
+	}
+	for _, c := range m.Contacts {
+		if c.ID.Hex() != id || c.OwnerPubKey != owner || c.Deleted {
+			continue
+		}
+		if other := m.contact(owner, ct.EmailIndex); other != nil && other != c {
+			return db.ErrDuplicate
+		}
+		c.EmailEnc, c.NameEnc, c.EmailIndex, c.Prefixes = ct.EmailEnc, ct.NameEnc, ct.EmailIndex, ct.Prefixes
+		c.Source, c.UpdatedAt = db.ContactUser, time.Now()
+		*ct = *c
+		return nil
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) DeleteContact(ctx context.Context, owner, id string) error {
+	if err := m.fault(ctx, "DeleteContact", owner, id); err != nil {
+		return err
+	}
+	for _, c := range m.Contacts {
+		if c.ID.Hex() == id && c.OwnerPubKey == owner && !c.Deleted {
+			c.Deleted = true
+			c.EmailEnc, c.NameEnc, c.Prefixes = "", "", nil
+			return nil
+		}
+	}
+	return db.ErrNotFound
+}
+
+func (m *Mock) GetSendLimits(ctx context.Context, owner string) (*db.SendLimits, error) {
+	if err := m.fault(ctx, "GetSendLimits", owner); err != nil {
+		return nil, err
+	}
+	if l, ok := m.SendLimits[owner]; ok {
+		return l, nil
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) SetSendLimits(ctx context.Context, l *db.SendLimits) error {
+	if err := m.fault(ctx, "SetSendLimits", l); err != nil {
+		return err
+	}
+	m.SendLimits[l.OwnerPubKey] = l
+	return nil
+}
+
+func (m *Mock) CountDailySend(ctx context.Context, owner, account, day string, limit int) (bool, error) {
+	if err := m.fault(ctx, "CountDailySend", owner, account, day, limit); err != nil {
+		return false, err
+	}
+	if _, err := time.Parse(time.DateOnly, day); err != nil {
+		return false, err
+	}
+	m.sendCountsMu.Lock()
+	defer m.sendCountsMu.Unlock()
+	if m.sendCounts == nil {
+		m.sendCounts = make(map[sendCountKey]int)
+	}
+	key := sendCountKey{owner, account, day}
+	if m.sendCounts[key] >= limit {
+		return false, nil
+	}
+	m.sendCounts[key]++
+	return true, nil
+}
+
+func (m *Mock) GetAccountHealth(ctx context.Context, owner, email string) (*db.AccountHealth, error) {
+	if err := m.fault(ctx, "GetAccountHealth", owner, email); err != nil {
+		return nil, err
+	}
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	for _, h := range m.Health {
+		if h.OwnerPubKey == owner && h.AccountEmail == email {
+			cp := *h
+			return &cp, nil
+		}
+	}
+	return nil, db.ErrNotFound
+}
+
+func (m *Mock) GetAccountHealthByOwner(ctx context.Context, owner string) ([]db.AccountHealth, error) {
+	if err := m.fault(ctx, "GetAccountHealthByOwner", owner); err != nil {
+		return nil, err
+	}
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	var result []db.AccountHealth
+	for _, h := range m.Health {
+		if h.OwnerPubKey == owner {
+			result = append(result, *h)
+		}
+	}
+	return result, nil
+}
+
+func (m *Mock) SetAccountHealth(ctx context.Context, h *db.AccountHealth) error {
+	if err := m.fault(ctx, "SetAccountHealth", h); err != nil {
+		return err
+	}
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+	h.UpdatedAt = time.Now()
+	cp := *h
+	for i, existing := range m.Health {
+		if existing.OwnerPubKey == h.OwnerPubKey && existing.AccountEmail == h.AccountEmail {
+			m.Health[i] = &cp
+			return nil
+		}
+	}
+	m.Health = append(m.Health, &cp)
+	return nil
+}
+
+func (m *Mock) AcquireOwnerLease(ctx context.Context, owner, holder string, ttl time.Duration) (bool, error) {
+	if err := m.fault(ctx, "AcquireOwnerLease", owner, holder, ttl); err != nil {
+		return false, err
+	}
+	m.leaseMu.Lock()
+	defer m.leaseMu.Unlock()
+	if m.Leases == nil {
+		m.Leases = make(map[string]Lease)
+	}
+	now := time.Now()
+	if l, ok := m.Leases[owner]; ok && l.Holder != holder && l.Expires.After(now) {
+		return false, nil
+	}
+	m.Leases[owner] = Lease{Holder: holder, Expires: now.Add(ttl)}
+	m.LeaseAcquires++
+	return true, nil
+}
+
+func (m *Mock) ReleaseOwnerLease(ctx context.Context, owner, holder string) error {
+	if err := m.fault(ctx, "ReleaseOwnerLease", owner, holder); err != nil {
+		return err
+	}
+	m.leaseMu.Lock()
+	defer m.leaseMu.Unlock()
+	if l, ok := m.Leases[owner]; ok && l.Holder == holder {
+		delete(m.Leases, owner)
+	}
+	return nil
+}
+
+func (m *Mock) AcquireRoleLease(ctx context.Context, role, holder string, ttl time.Duration) (bool, error) {
+	if err := m.fault(ctx, "AcquireRoleLease", role, holder, ttl); err != nil {
+		return false, err
+	}
+	m.leaseMu.Lock()
+	defer m.leaseMu.Unlock()
+	if m.RoleLeases == nil {
+		m.RoleLeases = make(map[string]Lease)
+	}
+	now := time.Now()
+	if l, ok := m.RoleLeases[role]; ok && l.Holder != holder && l.Expires.After(now) {
+		return false, nil
+	}
+	m.RoleLeases[role] = Lease{Holder: holder, Expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *Mock) ReleaseRoleLease(ctx context.Context, role, holder string) error {
+	if err := m.fault(ctx, "ReleaseRoleLease", role, holder); err != nil {
+		return err
+	}
+	m.leaseMu.Lock()
+	defer m.leaseMu.Unlock()
+	if l, ok := m.RoleLeases[role]; ok && l.Holder == holder {
+		delete(m.RoleLeases, role)
+	}
+	return nil
+}
+
+func (m *Mock) GetRoleLeases(ctx context.Context) ([]db.RoleLease, error) {
+	if err := m.fault(ctx, "GetRoleLeases"); err != nil {
+		return nil, err
+	}
+	m.leaseMu.Lock()
+	defer m.leaseMu.Unlock()
+	var leases []db.RoleLease
+	for role, l := range m.RoleLeases {
+		if l.Expires.After(time.Now()) {
+			leases = append(leases, db.RoleLease{Role: role, Holder: l.Holder, ExpiresAt: l.Expires})
+		}
+	}
+	slices.SortFunc(leases, func(a, b db.RoleLease) int { return strings.Compare(a.Role, b.Role) })
+	return leases, nil
+}
+
+func (m *Mock) Reset(ctx context.Context) error {
+	if err := m.fault(ctx, "Reset"); err != nil {
+		return err
+	}
+	fresh := New()
+	m.Identities, m.Accounts = fresh.Identities, fresh.Accounts
+	m.SendLimits, m.Payments, m.Plans, m.Tips = fresh.SendLimits, fresh.Payments, fresh.Plans, fresh.Tips
+	m.Sent, m.Scheduled, m.Cached, m.Contacts = nil, nil, nil, nil
+	m.Exports, m.Archives, m.Erasures, m.Audit = nil, nil, nil, nil
+	m.APIKeys, m.UsedSignatures, m.Health, m.Outbox = nil, nil, nil, nil
+	m.Leases, m.RoleLeases, m.sendCounts = nil, nil, nil
+	m.Maintenance = nil
+	return nil
+}
+
+func (m *Mock) GetMaintenance(ctx context.Context) (*db.Maintenance, error) {
+	if err := m.fault(ctx, "GetMaintenance"); err != nil {
+		return nil, err
+	}
+	m.maintenanceMu.Lock()
+	defer m.maintenanceMu.Unlock()
+	if m.Maintenance == nil {
+		return &db.Maintenance{}, nil
+	}
+	found := *m.Maintenance
+	return &found, nil
+}
+
+func (m *Mock) SetMaintenance(ctx context.Context, flag *db.Maintenance) error {
+	if err := m.fault(ctx, "SetMaintenance", flag); err != nil {
+		return err
+	}
+	m.maintenanceMu.Lock()
+	defer m.maintenanceMu.Unlock()
+	flag.UpdatedAt = time.Now()
+	stored := *flag
+	m.Maintenance = &stored
+	return nil
+}
@@ -0,0 +1,51 @@
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"mulamail/db"
+)
+
+func TestMockConformance(t *testing.T) {
+	RunConformance(t, func(*testing.T) db.DB { return New() })
+}
+
+func TestMockFaults(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+	boom := errors.New("boom")
+
+	m.FailOnce("GetSendLimits", boom)
+	if _, err := m.GetSendLimits(ctx, "pk"); !errors.Is(err, boom) {
+		t.Errorf("first call: want the injected error, got %v", err)
+	}
+	if _, err := m.GetSendLimits(ctx, "pk"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("second call: want ErrNotFound, got %v", err)
+	}
+
+	m.FailWith("DeleteOwnerData", func(_ context.Context, args ...any) error {
+		if args[1] == "contacts" {
+			return boom
+		}
+		return nil
+	})
+	if _, err := m.DeleteOwnerData(ctx, "pk", "contacts"); !errors.Is(err, boom) {
+		t.Errorf("faulted collection: want the injected error, got %v", err)
+	}
+	if _, err := m.DeleteOwnerData(ctx, "pk", "messages"); err != nil {
+		t.Errorf("other collection: %v", err)
+	}
+	m.FailWith("DeleteOwnerData", nil)
+	if _, err := m.DeleteOwnerData(ctx, "pk", "contacts"); err != nil {
+		t.Errorf("cleared fault: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("a fault for a method db.DB lacks should panic")
+		}
+	}()
+	m.Fail("GetSendLimit", boom)
+}
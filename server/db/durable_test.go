@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+func TestParseWriteConcern(t *testing.T) {
+	wc, err := ParseWriteConcern("majority", 10*time.Second)
+	if err != nil || wc.GetW() != "majority" || wc.GetWTimeout() != 10*time.Second {
+		t.Errorf("majority: got %+v, %v", wc, err)
+	}
+	wc, err = ParseWriteConcern("2", 0)
+	if err != nil || wc.GetW() != 2 || wc.GetWTimeout() != 0 {
+		t.Errorf("2: got %+v, %v", wc, err)
+	}
+	for _, w := range []string{"", "0", "-1", "all", "Majority"} {
+		if _, err := ParseWriteConcern(w, time.Second); err == nil {
+			t.Errorf("%q: want an error", w)
+		}
+	}
+	if _, err := ParseWriteConcern("majority", -time.Second); err == nil {
+		t.Error("negative timeout: want an error")
+	}
+}
+
+func TestCollection_DurableWriteConcern(t *testing.T) {
+	// Connect does not reach the server; no operation is run.
+	mc, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Disconnect(context.Background())
+	wc := writeconcern.New(writeconcern.WMajority())
+	c := newClient(mc, "test", Options{DurableWriteConcern: wc})
+
+	for _, name := range durableCollections {
+		if got := c.collection(name).Database().WriteConcern(); got != wc {
+			t.Errorf("%s: want the durable write concern, got %+v", name, got)
+		}
+	}
+	for _, name := range []string{"messages", "outbox", "send_counts"} {
+		if got := c.collection(name).Database().WriteConcern(); got != nil {
+			t.Errorf("%s: want the default write concern, got %+v", name, got)
+		}
+	}
+	if got := newClient(mc, "test", Options{}).collection("identities").Database().WriteConcern(); got != nil {
+		t.Errorf("without a durable write concern: want the default, got %+v", got)
+	}
+}
+
+// TestDurableWrites_PrimaryStepDown steps the primary down while mail
+// accounts are being created and checks that every creation reported as
+// done survives on the new primary.  It needs a replica set of at least
+// three members, for example:
+//
+//	docker run -d -p 27017:27017 mongo:7 --replSet rs0   (and two more members)
+//	MONGO_TEST_REPLSET_URI='mongodb://localhost:27017/?replicaSet=rs0' go test ./db/ -run StepDown
+func TestDurableWrites_PrimaryStepDown(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_REPLSET_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_REPLSET_URI not set")
+	}
+	wc, _ := ParseWriteConcern("majority", 30*time.Second)
+	client, err := Connect(uri, "mulamail_test_"+primitive.NewObjectID().Hex(), Options{DurableWriteConcern: wc, RetryWrites: true})
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		client.db.Drop(ctx)
+		client.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	const n = 200
+	created := make(chan string, n)
+	failed := make(chan error, n)
+	go func() {
+		defer close(created)
+		for i := range n {
+			acc := &MailAccount{OwnerPubKey: "owner", AccountEmail: fmt.Sprintf("user%d@example.com", i)}
+			if err := client.CreateMailAccount(ctx, acc); err != nil {
+				failed <- err
+				continue
+			}
+			created <- acc.AccountEmail
+		}
+	}()
+
+	// Step down once writes are under way.
+	var done []string
+	for len(done) < n/4 {
+		done = append(done, <-created)
+	}
+	err = client.client.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "replSetStepDown", Value: 30},
+		{Key: "secondaryCatchUpPeriodSecs", Value: 0},
+		{Key: "force", Value: true},
+	}).Err()
+	var cmdErr mongo.CommandError
+	if err != nil && !mongo.IsNetworkError(err) && !(errors.As(err, &cmdErr) && cmdErr.HasErrorLabel("RetryableWriteError")) {
+		t.Fatalf("replSetStepDown: %v", err)
+	}
+	for email := range created {
+		done = append(done, email)
+	}
+	close(failed)
+	for err := range failed {
+		// A write may fail outright if no new primary is elected in time;
+		// it must never be reported done and then lost.
+		t.Logf("write failed during the election: %v", err)
+	}
+
+	majority := client.db.Collection("mail_accounts", options.Collection().SetReadConcern(readconcern.Majority()))
+	for _, email := range done {
+		if err := majority.FindOne(ctx, bson.M{"account_email": email}).Err(); err != nil {
+			t.Errorf("%s was reported created but is not majority-committed: %v", email, err)
+		}
+	}
+	if len(done) < n/2 {
+		t.Errorf("want retryable writes to carry most creations over the election, got %d of %d", len(done), n)
+	}
+}
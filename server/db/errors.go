@@ -4,3 +4,6 @@ import "errors"
 
 // ErrNotFound is returned when a document is not found in the database
 var ErrNotFound = errors.New("document not found")
+
+// ErrDuplicate is returned when an insert violates a unique index
+var ErrDuplicate = errors.New("duplicate document")
@@ -0,0 +1,5 @@
+package db
+
+// SetupTestDB lets the external tests in package db_test open a throwaway
+// database as setupTestDB does.
+var SetupTestDB = setupTestDB
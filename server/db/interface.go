@@ -1,15 +1,113 @@
 package db
 
-import "context"
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 // DB defines the interface for database operations
 type DB interface {
 	CreateIdentity(ctx context.Context, id *Identity) error
 	GetIdentityByEmail(ctx context.Context, email string) (*Identity, error)
+	GetIdentityByCanonicalEmail(ctx context.Context, canonical, email string) (*Identity, error)
 	GetIdentityByPubKey(ctx context.Context, pubkey string) (*Identity, error)
+	GetIdentityByTxSig(ctx context.Context, sig string) (*Identity, error)
+	GetIdentitiesByEmails(ctx context.Context, emails []string) ([]Identity, error)
+	GetIdentitiesByCanonicalEmails(ctx context.Context, canonicals, emails []string) ([]Identity, error)
+	GetIdentitiesByPubKeys(ctx context.Context, pubkeys []string) ([]Identity, error)
+	UpsertIdentity(ctx context.Context, id *Identity) (bool, error)
+	GetAllIdentities(ctx context.Context) ([]Identity, error)
+	SetIdentityCanonicalEmail(ctx context.Context, id primitive.ObjectID, canonical string) error
+	GetIdentitiesToCheck(ctx context.Context, since time.Time, limit int) ([]Identity, error)
+	SetIdentityChainStatus(ctx context.Context, id primitive.ObjectID, status string, verified bool, at time.Time) error
 	CreateMailAccount(ctx context.Context, acc *MailAccount) error
+	FindMailAccounts(ctx context.Context, q MailAccountQuery) ([]MailAccount, error)
 	GetMailAccountsByOwner(ctx context.Context, ownerPubKey string) ([]MailAccount, error)
+	CountMailAccountsByOwner(ctx context.Context, ownerPubKey string) (int64, error)
 	GetMailAccount(ctx context.Context, ownerPubKey, accountEmail string) (*MailAccount, error)
+	GetAllMailAccounts(ctx context.Context) ([]MailAccount, error)
+	SetMailAccountPasswords(ctx context.Context, ownerPubKey, accountEmail, pop3PassEnc, smtpPassEnc string) error
+	UpdateMailAccountProfile(ctx context.Context, ownerPubKey, accountEmail string, p MailAccountProfile) error
+	UpdateMailAccountStats(ctx context.Context, ownerPubKey, accountEmail string, at time.Time, status string, messageCount int) error
+	CreateSentMessage(ctx context.Context, m *SentMessage) error
+	GetSentMessagesByOwner(ctx context.Context, ownerPubKey string) ([]SentMessage, error)
+	GetRecentSentMessages(ctx context.Context, ownerPubKey string, limit int) ([]SentMessage, error)
+	MarkSentMessageBounced(ctx context.Context, ownerPubKey, messageID string, b *SentBounce) error
+	UpsertCachedMessage(ctx context.Context, m *CachedMessage) (bool, error)
+	GetCachedMessagesBySender(ctx context.Context, ownerPubKey, accountEmail, fromIndex string) ([]CachedMessage, error)
+	GetCachedMessagesByOwner(ctx context.Context, ownerPubKey string) ([]CachedMessage, error)
+	GetBouncedCachedMessages(ctx context.Context, ownerPubKey, accountEmail string, limit int) ([]CachedMessage, error)
+	GetPlaintextCachedMessages(ctx context.Context, limit int) ([]CachedMessage, error)
+	MarkCachedMessagesSeen(ctx context.Context, ownerPubKey, accountEmail string, uids []string, at time.Time) error
+	FindStaleCachedMessages(ctx context.Context, q StaleMessageQuery) ([]CachedMessage, error)
+	DeleteCachedMessages(ctx context.Context, ids []primitive.ObjectID) (int64, error)
+	CreateScheduledMessage(ctx context.Context, m *ScheduledMessage) error
+	GetScheduledMessagesByOwner(ctx context.Context, ownerPubKey string) ([]ScheduledMessage, error)
+	GetUndeliveredScheduledMessages(ctx context.Context) ([]ScheduledMessage, error)
+	SetScheduledPayload(ctx context.Context, id primitive.ObjectID, payloadEnc string) error
+	CancelScheduledMessage(ctx context.Context, ownerPubKey, id string) error
+	ClaimDueScheduledMessage(ctx context.Context, now time.Time, worker string) (*ScheduledMessage, error)
+	FinishScheduledAttempt(ctx context.Context, m *ScheduledMessage) error
+	MarkStuckScheduledMessages(ctx context.Context, claimedBefore time.Time, lastError string) (int64, error)
+	CreateOutboxMessage(ctx context.Context, m *OutboxMessage) error
+	GetOutboxMessage(ctx context.Context, ownerPubKey, id string) (*OutboxMessage, error)
+	GetUndeliveredOutboxMessages(ctx context.Context) ([]OutboxMessage, error)
+	SetOutboxPayload(ctx context.Context, id primitive.ObjectID, payloadEnc string) error
+	ClaimOutboxMessage(ctx context.Context, now, staleBefore time.Time, worker string) (*OutboxMessage, error)
+	RenewOutboxClaim(ctx context.Context, id primitive.ObjectID, worker string, now time.Time) error
+	FinishOutboxAttempt(ctx context.Context, m *OutboxMessage) error
+	CreateExportJob(ctx context.Context, j *ExportJob) (bool, error)
+	GetExportJob(ctx context.Context, ownerPubKey, id string) (*ExportJob, error)
+	ClaimExportJob(ctx context.Context, now, staleBefore time.Time, worker string) (*ExportJob, error)
+	FinishExportJob(ctx context.Context, j *ExportJob) error
+	GetExpiredExportJobs(ctx context.Context, now time.Time) ([]ExportJob, error)
+	ExpireExportJob(ctx context.Context, id primitive.ObjectID) error
+	GetUnexpiredExportJobs(ctx context.Context) ([]ExportJob, error)
+	CreateArchiveJob(ctx context.Context, j *ArchiveJob) (bool, error)
+	GetArchiveJob(ctx context.Context, ownerPubKey, id string) (*ArchiveJob, error)
+	ClaimArchiveJob(ctx context.Context, now, staleBefore time.Time, worker string) (*ArchiveJob, error)
+	SaveArchiveJob(ctx context.Context, j *ArchiveJob) error
+	CreateErasureChallenge(ctx context.Context, j *ErasureJob) error
+	ConfirmErasureJob(ctx context.Context, ownerPubKey, challengeHash string, now time.Time) (*ErasureJob, error)
+	GetErasureJob(ctx context.Context, ownerPubKey, id string) (*ErasureJob, error)
+	ClaimErasureJob(ctx context.Context, now, staleBefore time.Time, worker string) (*ErasureJob, error)
+	UpdateErasureJob(ctx context.Context, j *ErasureJob) error
+	CountOwnerData(ctx context.Context, ownerPubKey string) (map[string]int64, error)
+	DeleteOwnerData(ctx context.Context, ownerPubKey, collection string) (int64, error)
+	RevokeIdentities(ctx context.Context, pubkey string, at time.Time) (int64, error)
+	CreateAuditEvent(ctx context.Context, e *AuditEvent) error
+	GetAuditEvents(ctx context.Context, ownerPubKey string, limit int) ([]AuditEvent, error)
+	CreatePayment(ctx context.Context, p *Payment) error
+	GetPaymentByTxSig(ctx context.Context, txSig string) (*Payment, error)
+	SetPlan(ctx context.Context, p *Plan) error
+	CreateTip(ctx context.Context, t *Tip) error
+	CreateAPIKey(ctx context.Context, k *APIKey) error
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	DeleteAPIKey(ctx context.Context, ownerPubKey, id string) error
+	TouchAPIKey(ctx context.Context, id primitive.ObjectID, at time.Time) error
+	UseSignature(ctx context.Context, sigHash string, expiresAt time.Time) error
+	RecordContactActivity(ctx context.Context, c *Contact, sent bool) error
+	CreateContact(ctx context.Context, c *Contact) error
+	GetContacts(ctx context.Context, ownerPubKey, prefix string, limit int) ([]Contact, error)
+	GetContactsByIndexes(ctx context.Context, ownerPubKey string, emailIndexes []string) ([]Contact, error)
+	UpdateContact(ctx context.Context, ownerPubKey, id string, c *Contact) error
+	DeleteContact(ctx context.Context, ownerPubKey, id string) error
+	GetSendLimits(ctx context.Context, ownerPubKey string) (*SendLimits, error)
+	SetSendLimits(ctx context.Context, l *SendLimits) error
+	CountDailySend(ctx context.Context, ownerPubKey, accountEmail, day string, limit int) (bool, error)
+	GetAccountHealth(ctx context.Context, ownerPubKey, accountEmail string) (*AccountHealth, error)
+	GetAccountHealthByOwner(ctx context.Context, ownerPubKey string) ([]AccountHealth, error)
+	SetAccountHealth(ctx context.Context, h *AccountHealth) error
+	AcquireOwnerLease(ctx context.Context, ownerPubKey, holder string, ttl time.Duration) (bool, error)
+	ReleaseOwnerLease(ctx context.Context, ownerPubKey, holder string) error
+	AcquireRoleLease(ctx context.Context, role, holder string, ttl time.Duration) (bool, error)
+	ReleaseRoleLease(ctx context.Context, role, holder string) error
+	GetRoleLeases(ctx context.Context) ([]RoleLease, error)
+	GetMaintenance(ctx context.Context) (*Maintenance, error)
+	SetMaintenance(ctx context.Context, m *Maintenance) error
+	Reset(ctx context.Context) error
 }
 
 // Ensure Client implements DB interface
@@ -2,33 +2,157 @@ package db
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"strconv"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 // ---------- client ----------
 
 type Client struct {
-	client *mongo.Client
-	db     *mongo.Database
+	client  *mongo.Client
+	db      *mongo.Database
+	durable *mongo.Database // db with the durable write concern, for durableCollections
 }
 
-func Connect(uri, dbName string) (*Client, error) {
+// durableCollections hold credentials and payments: data the API reports
+// as saved and that a client cannot recreate if a failover loses it.  They
+// are written with Options.DurableWriteConcern; the others, mostly caches
+// and job state written far more often, keep the deployment's default.
+var durableCollections = []string{"identities", "mail_accounts", "api_keys", "payments", "tips", "plans"}
+
+// Options tunes how the client writes.
+type Options struct {
+	DurableWriteConcern *writeconcern.WriteConcern // for durableCollections; nil keeps the deployment's default
+	RetryWrites         bool                       // retry a write once after a failover or network error
+}
+
+// ParseWriteConcern reads MONGO_DURABLE_WRITE_CONCERN: "majority" or a
+// number of members, acknowledged within wtimeout unless it is 0.
+func ParseWriteConcern(w string, wtimeout time.Duration) (*writeconcern.WriteConcern, error) {
+	opts := []writeconcern.Option{writeconcern.WTimeout(wtimeout)}
+	if w == "majority" {
+		opts = append(opts, writeconcern.WMajority())
+	} else if n, err := strconv.Atoi(w); err == nil && n >= 1 {
+		opts = append(opts, writeconcern.W(n))
+	} else {
+		return nil, fmt.Errorf("%q is neither \"majority\" nor a number of members", w)
+	}
+	if wtimeout < 0 {
+		return nil, fmt.Errorf("negative timeout %v", wtimeout)
+	}
+	return writeconcern.New(opts...), nil
+}
+
+func Connect(uri, dbName string, opts Options) (*Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetRetryWrites(opts.RetryWrites))
 	if err != nil {
 		return nil, err
 	}
 	if err := client.Ping(ctx, nil); err != nil {
 		return nil, err
 	}
-	return &Client{client: client, db: client.Database(dbName)}, nil
+	c := newClient(client, dbName, opts)
+	if err := c.ensureIndexes(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(client *mongo.Client, dbName string, opts Options) *Client {
+	c := &Client{client: client, db: client.Database(dbName), durable: client.Database(dbName)}
+	if opts.DurableWriteConcern != nil {
+		c.durable = client.Database(dbName, options.Database().SetWriteConcern(opts.DurableWriteConcern))
+	}
+	return c
+}
+
+// collection returns the named collection, configured for durable writes
+// if it is one of durableCollections.
+func (c *Client) collection(name string) *mongo.Collection {
+	if slices.Contains(durableCollections, name) {
+		return c.durable.Collection(name)
+	}
+	return c.db.Collection(name)
+}
+
+// ensureIndexes creates the indexes that enforce uniqueness and expiry.
+// Creating an index that already exists is a no-op.
+func (c *Client) ensureIndexes(ctx context.Context) error {
+	indexes := []struct {
+		collection string
+		keys       bson.D
+		unique     bool
+		expires    bool   // documents are removed once the indexed time has passed
+		partial    bson.M // when set, only documents matching it are indexed
+	}{
+		{"payments", bson.D{{Key: "tx_sig", Value: 1}}, true, false, nil},
+		{"tips", bson.D{{Key: "tx_sig", Value: 1}}, true, false, nil},
+		{"api_keys", bson.D{{Key: "key_hash", Value: 1}}, true, false, nil},
+		{"contacts", bson.D{{Key: "owner_pubkey", Value: 1}, {Key: "email_index", Value: 1}}, true, false, nil},
+		{"contacts", bson.D{{Key: "owner_pubkey", Value: 1}, {Key: "prefixes", Value: 1}}, false, false, nil},
+		{"audit_events", bson.D{{Key: "owner_pubkey", Value: 1}, {Key: "created_at", Value: -1}}, false, false, nil},
+		{"account_health", bson.D{{Key: "owner_pubkey", Value: 1}, {Key: "account_email", Value: 1}}, true, false, nil},
+		{"send_counts", bson.D{{Key: "owner_pubkey", Value: 1}, {Key: "account_email", Value: 1}, {Key: "day", Value: 1}}, true, false, nil},
+		{"send_counts", bson.D{{Key: "expires_at", Value: 1}}, false, true, nil},
+		{"identities", bson.D{{Key: "canonical_email", Value: 1}}, true, false, bson.M{"canonical_email": bson.M{"$exists": true}}},
+		{"identities", bson.D{{Key: "pubkey", Value: 1}, {Key: "revoked_at", Value: 1}, {Key: "primary", Value: -1}, {Key: "created_at", Value: 1}}, false, false, nil},
+		{"identities", bson.D{{Key: "chain_status", Value: 1}, {Key: "chain_checked_at", Value: 1}}, false, false, nil},
+		{"identities", bson.D{{Key: "tx_sig", Value: 1}}, true, false, bson.M{"tx_sig": bson.M{"$exists": true}}},
+		{"leases", bson.D{{Key: "expires_at", Value: 1}}, false, true, nil},
+		{"used_signatures", bson.D{{Key: "expires_at", Value: 1}}, false, true, nil},
+		{"sent_messages", bson.D{{Key: "owner_pubkey", Value: 1}, {Key: "sent_at", Value: -1}}, false, false, nil},
+		{"messages", bson.D{{Key: "last_seen_at", Value: 1}}, false, false, nil},
+		{"messages", bson.D{{Key: "vanished_at", Value: 1}}, false, false, bson.M{"vanished_at": bson.M{"$exists": true}}},
+	}
+	for _, ix := range indexes {
+		opts := options.Index().SetUnique(ix.unique)
+		if ix.expires {
+			opts.SetExpireAfterSeconds(0)
+		}
+		if ix.partial != nil {
+			opts.SetPartialFilterExpression(ix.partial)
+		}
+		_, err := c.collection(ix.collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    ix.keys,
+			Options: opts,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping checks that the MongoDB deployment is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx, nil)
+}
+
+// Reset deletes every document from every collection of the database,
+// keeping the collections and their indexes.  It backs the fixture
+// endpoints of test builds and must never be reachable otherwise.
+func (c *Client) Reset(ctx context.Context) error {
+	names, err := c.db.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := c.collection(name).DeleteMany(ctx, bson.M{}); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
 }
 
 func (c *Client) Close() {
@@ -41,15 +165,49 @@ func (c *Client) Close() {
 
 // Identity maps an email address to a Solana public key, optionally anchored
 // by a on-chain memo transaction.
+//
+// CanonicalEmail is Email with the deployment's canonicalisation rules
+// applied, and is unique across identities.  It is missing on identities
+// stored before canonicalisation and on those whose canonical form another
+// identity claimed first; both resolve by their exact Email only.
+//
+// A public key may register several emails.  Primary marks the first one it
+// registered, which a lookup by public key returns; identities stored
+// before the flag existed have none, and the oldest stands in for it.
 type Identity struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Email     string             `bson:"email"        json:"email"`
-	PubKey    string             `bson:"pubkey"       json:"pubkey"`
-	TxHash    string             `bson:"tx_hash"      json:"tx_hash,omitempty"`
-	Verified  bool               `bson:"verified"     json:"verified"`
-	CreatedAt time.Time          `bson:"created_at"   json:"created_at"`
+	ID             primitive.ObjectID `bson:"_id,omitempty"             json:"id"`
+	Email          string             `bson:"email"                     json:"email"`
+	CanonicalEmail string             `bson:"canonical_email,omitempty" json:"canonical_email,omitempty"`
+	PubKey         string             `bson:"pubkey"                    json:"pubkey"`
+	TxHash         string             `bson:"tx_hash"                   json:"tx_hash,omitempty"`
+	Verified       bool               `bson:"verified"                  json:"verified"`
+	Primary        bool               `bson:"primary,omitempty"         json:"primary"`
+	CreatedAt      time.Time          `bson:"created_at"                json:"created_at"`
+
+	// TxSig is the signature of the transaction the identity was
+	// registered with, and is unique, so that a signed transaction cannot be
+	// replayed to register it again.  It is missing on identities stored
+	// before it was recorded and on those restored from the chain.
+	TxSig string `bson:"tx_sig,omitempty" json:"-"`
+
+	// RevokedAt is set when the owner erased their data.  The on-chain
+	// memo cannot be erased, so the mapping stays, marked revoked.
+	RevokedAt time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitzero"`
+
+	// ChainStatus says whether TxHash has landed, as last checked: an
+	// identity is Verified when it is broadcast, and loses that if its
+	// transaction never lands.  Empty until the identity is first checked.
+	ChainStatus    string    `bson:"chain_status,omitempty"     json:"chain_status,omitempty"`
+	ChainCheckedAt time.Time `bson:"chain_checked_at,omitempty" json:"-"`
 }
 
+// Values of Identity.ChainStatus.
+const (
+	ChainAnchored = "anchored" // the memo transaction is finalized
+	ChainPending  = "pending"  // broadcast, not yet finalized
+	ChainMissing  = "missing"  // never landed, or failed, so the identity is not verified
+)
+
 // MailAccount stores connection details for one legacy mail server.
 // Passwords are encrypted at rest; the PassEnc fields are never serialised
 // back to the client (json:"-").
@@ -57,17 +215,42 @@ type MailAccount struct {
 	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	OwnerPubKey  string             `bson:"owner_pubkey"  json:"owner_pubkey"`
 	AccountEmail string             `bson:"account_email" json:"account_email"`
+	DisplayName  string             `bson:"display_name,omitempty" json:"display_name,omitempty"`
+	Signature    string             `bson:"signature,omitempty"    json:"signature,omitempty"`
 	POP3         POP3Settings       `bson:"pop3"          json:"pop3"`
 	SMTP         SMTPSettings       `bson:"smtp"          json:"smtp"`
 	CreatedAt    time.Time          `bson:"created_at"    json:"created_at"`
+
+	// DefaultEnvelopeFrom is the MAIL FROM (bounce) address for messages
+	// that do not set their own; empty means the account email.
+	DefaultEnvelopeFrom string `bson:"default_envelope_from,omitempty" json:"default_envelope_from,omitempty"`
+
+	// FetchPolicy decides whether fetched mail is deleted from the POP3
+	// server once it is archived in the vault; empty means "leave".
+	FetchPolicy string `bson:"fetch_policy,omitempty" json:"fetch_policy,omitempty"`
+
+	// Outcome of the latest inbox fetch, kept by UpdateMailAccountStats.
+	// MessageCount is the number of messages on the POP3 server when it was
+	// last listed; a failed fetch leaves it as it was.
+	LastFetchAt     time.Time `bson:"last_fetch_at,omitempty"     json:"last_fetch_at,omitzero"`
+	LastFetchStatus string    `bson:"last_fetch_status,omitempty" json:"last_fetch_status,omitempty"`
+	MessageCount    int       `bson:"message_count,omitempty"     json:"message_count"`
 }
 
+// Values of MailAccount.LastFetchStatus.
+const (
+	FetchOK     = "ok"     // the mailbox was listed
+	FetchFailed = "failed" // the login or the LIST failed
+)
+
 type POP3Settings struct {
 	Host    string `bson:"host"     json:"host"`
 	Port    int    `bson:"port"     json:"port"`
 	User    string `bson:"user"     json:"user"`
 	PassEnc string `bson:"pass_enc" json:"-"`
 	UseSSL  bool   `bson:"use_ssl"  json:"use_ssl"`
+
+	AuthMechanism string `bson:"auth_mechanism,omitempty" json:"auth_mechanism,omitempty"` // mail.POP3Auth*; empty = USER/PASS
 }
 
 type SMTPSettings struct {
@@ -76,44 +259,653 @@ type SMTPSettings struct {
 	User    string `bson:"user"     json:"user"`
 	PassEnc string `bson:"pass_enc" json:"-"`
 	UseSSL  bool   `bson:"use_ssl"  json:"use_ssl"`
+
+	MaxSessions  int    `bson:"max_sessions,omitempty"  json:"max_sessions,omitempty"`  // concurrent sessions allowed; 0 = 1
+	HELOHostname string `bson:"helo_hostname,omitempty" json:"helo_hostname,omitempty"` // name announced in EHLO/HELO; empty = SMTP_HELO_HOSTNAME
+}
+
+// SentMessage records a message accepted by an account's SMTP server, so
+// later bounces can be correlated via the Message-ID or the server's queue id.
+type SentMessage struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"    json:"id"`
+	OwnerPubKey  string             `bson:"owner_pubkey"     json:"owner_pubkey"`
+	AccountEmail string             `bson:"account_email"    json:"account_email"` // From header address
+	EnvelopeFrom string             `bson:"envelope_from"    json:"envelope_from"` // MAIL FROM address
+	To           []string           `bson:"to"               json:"to"`
+	Cc           []string           `bson:"cc,omitempty"     json:"cc,omitempty"`
+	Bcc          []string           `bson:"bcc,omitempty"    json:"bcc,omitempty"`
+	Subject      string             `bson:"subject"          json:"subject"`
+	MessageID    string             `bson:"message_id"       json:"message_id"`
+	SMTPResponse string             `bson:"smtp_response"    json:"smtp_response"`
+	QueueID      string             `bson:"queue_id"         json:"queue_id,omitempty"`
+	SentAt       time.Time          `bson:"sent_at"          json:"sent_at"`
+	Bounce       *SentBounce        `bson:"bounce,omitempty" json:"bounce,omitempty"`
+}
+
+// SentBounce records a delivery failure reported for a sent message.
+type SentBounce struct {
+	Recipient  string    `bson:"recipient"  json:"recipient"`
+	Status     string    `bson:"status"     json:"status"` // enhanced status code, e.g. "5.1.1"
+	Diagnostic string    `bson:"diagnostic" json:"diagnostic,omitempty"`
+	BouncedAt  time.Time `bson:"bounced_at" json:"bounced_at"`
+}
+
+// AccountHealth tracks the POP3 logins of one mail account, so that
+// callers can back off from an account whose provider keeps refusing it
+// instead of retrying it on every poll.  A successful login resets it.
+type AccountHealth struct {
+	OwnerPubKey         string    `bson:"owner_pubkey"              json:"owner_pubkey"`
+	AccountEmail        string    `bson:"account_email"             json:"account_email"`
+	ConsecutiveFailures int       `bson:"consecutive_failures"      json:"consecutive_failures"`
+	LastError           string    `bson:"last_error,omitempty"      json:"last_error,omitempty"`
+	LastFailureAt       time.Time `bson:"last_failure_at,omitempty" json:"last_failure_at,omitzero"`
+	NextRetryAt         time.Time `bson:"next_retry_at,omitempty"   json:"next_retry_at,omitzero"`
+	UpdatedAt           time.Time `bson:"updated_at"                json:"updated_at"`
+}
+
+// SendLimits overrides the deployment-wide send limits for one owner.  A
+// zero field means "use the default"; non-empty domain lists replace
+// SEND_ALLOWED_DOMAINS and SEND_BLOCKED_DOMAINS rather than extend them.
+type SendLimits struct {
+	OwnerPubKey     string    `bson:"owner_pubkey"      json:"owner_pubkey"`
+	MaxRecipients   int       `bson:"max_recipients"    json:"max_recipients"`
+	MaxMessageBytes int       `bson:"max_message_bytes" json:"max_message_bytes"`
+	MaxDailySends   int       `bson:"max_daily_sends"   json:"max_daily_sends"`
+	MaxAccounts     int       `bson:"max_accounts"      json:"max_accounts"`  // mail accounts the owner may register
+	WarnAccounts    int       `bson:"warn_accounts"     json:"warn_accounts"` // accounts from which adding another warns
+	Trusted         bool      `bson:"trusted"           json:"trusted"`       // may address any number of recipients without contact history
+	AllowedDomains  []string  `bson:"allowed_domains"   json:"allowed_domains"`
+	BlockedDomains  []string  `bson:"blocked_domains"   json:"blocked_domains"`
+	UpdatedAt       time.Time `bson:"updated_at"        json:"updated_at"`
+}
+
+// Payment is a verified on-chain payment.  Each transaction signature can
+// be claimed only once.
+type Payment struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TxSig       string             `bson:"tx_sig"        json:"tx_sig"`
+	OwnerPubKey string             `bson:"owner_pubkey"  json:"owner_pubkey"`
+	Plan        string             `bson:"plan"          json:"plan"`
+	CreatedAt   time.Time          `bson:"created_at"    json:"created_at"`
+}
+
+// Tip is a SOL transfer one wallet sent the sender of an email, recorded
+// from the broadcast transaction.
+type Tip struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"   json:"id"`
+	TxSig          string             `bson:"tx_sig"          json:"tx_sig"`
+	FromPubKey     string             `bson:"from_pubkey"     json:"from_pubkey"`
+	ToPubKey       string             `bson:"to_pubkey"       json:"to_pubkey"`
+	RecipientEmail string             `bson:"recipient_email" json:"recipient_email"`
+	Lamports       uint64             `bson:"lamports"        json:"lamports"`
+	MessageID      string             `bson:"message_id"      json:"message_id"`
+	CreatedAt      time.Time          `bson:"created_at"      json:"created_at"`
+}
+
+// Plan is an owner's subscription tier.  Owners without a plan document are
+// on the free tier.
+type Plan struct {
+	OwnerPubKey string    `bson:"owner_pubkey" json:"owner_pubkey"`
+	Tier        string    `bson:"tier"         json:"tier"`
+	PaymentTx   string    `bson:"payment_tx"   json:"payment_tx"`
+	UpdatedAt   time.Time `bson:"updated_at"   json:"updated_at"`
+}
+
+// APIKey is a long-lived credential for partner services acting on behalf
+// of OwnerPubKey.  Only the SHA-256 hash of the key is stored; Prefix is
+// kept so owners can tell their keys apart.  A zero ExpiresAt never expires.
+type APIKey struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"          json:"id"`
+	KeyHash     string             `bson:"key_hash"               json:"-"`
+	Prefix      string             `bson:"prefix"                 json:"prefix"`
+	OwnerPubKey string             `bson:"owner_pubkey"           json:"owner_pubkey"`
+	Name        string             `bson:"name,omitempty"         json:"name,omitempty"`
+	Scopes      []string           `bson:"scopes"                 json:"scopes"`
+	CreatedAt   time.Time          `bson:"created_at"             json:"created_at"`
+	ExpiresAt   time.Time          `bson:"expires_at,omitempty"   json:"expires_at,omitzero"`
+	LastUsedAt  time.Time          `bson:"last_used_at,omitempty" json:"last_used_at,omitzero"`
+}
+
+// Scheduled message states.
+const (
+	ScheduledPending   = "pending"   // waiting for SendAt / NextAttemptAt
+	ScheduledSending   = "sending"   // claimed by a worker
+	ScheduledSent      = "sent"      // accepted by the SMTP server
+	ScheduledFailed    = "failed"    // permanent failure or out of attempts
+	ScheduledCancelled = "cancelled" // cancelled by the owner before delivery
+	ScheduledStuck     = "stuck"     // claimed by a worker that never recorded the outcome; may have been sent
+)
+
+// ScheduledMessage is a message queued for delivery at SendAt.  The send
+// request itself is stored encrypted in PayloadEnc and never serialised back
+// to the client.
+type ScheduledMessage struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"           json:"id"`
+	OwnerPubKey   string             `bson:"owner_pubkey"            json:"owner_pubkey"`
+	AccountEmail  string             `bson:"account_email"           json:"account_email"`
+	PayloadEnc    string             `bson:"payload_enc"             json:"-"`
+	SendAt        time.Time          `bson:"send_at"                 json:"send_at"`
+	Status        string             `bson:"status"                  json:"status"`
+	Attempts      int                `bson:"attempts"                json:"attempts"`
+	NextAttemptAt time.Time          `bson:"next_attempt_at"         json:"next_attempt_at"`
+	ClaimedBy     string             `bson:"claimed_by,omitempty"    json:"-"`
+	LastError     string             `bson:"last_error,omitempty"    json:"last_error,omitempty"`
+	MessageID     string             `bson:"message_id,omitempty"    json:"message_id,omitempty"`
+	SMTPResponse  string             `bson:"smtp_response,omitempty" json:"smtp_response,omitempty"`
+	QueueID       string             `bson:"queue_id,omitempty"      json:"queue_id,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at"              json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at"              json:"updated_at"`
+}
+
+// Outbox message states.
+const (
+	OutboxQueued  = "queued"  // waiting for a worker, or for a retry
+	OutboxSending = "sending" // claimed by a worker
+	OutboxSent    = "sent"    // accepted by the SMTP server
+	OutboxFailed  = "failed"  // permanent failure or out of attempts
+
+	// OutboxDeferredGreylist is a message a greylisting server turned away,
+	// waiting out the delay before it is accepted.  It is claimed like a
+	// queued one.
+	OutboxDeferredGreylist = "deferred_greylist"
+)
+
+// OutboxMessage is a message accepted for asynchronous delivery.  Like a
+// scheduled message its send request is stored encrypted in PayloadEnc.  A
+// worker holds its claim by renewing ClaimedAt; a sending message whose
+// claim has not been renewed within the lease is claimed again, so delivery
+// survives a worker dying.
+type OutboxMessage struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"           json:"id"`
+	OwnerPubKey   string             `bson:"owner_pubkey"            json:"owner_pubkey"`
+	AccountEmail  string             `bson:"account_email"           json:"account_email"`
+	PayloadEnc    string             `bson:"payload_enc"             json:"-"`
+	Status        string             `bson:"status"                  json:"status"`
+	Attempts      int                `bson:"attempts"                json:"attempts"`
+	NextAttemptAt time.Time          `bson:"next_attempt_at"         json:"next_attempt_at"`
+	ClaimedBy     string             `bson:"claimed_by,omitempty"    json:"-"`
+	ClaimedAt     time.Time          `bson:"claimed_at,omitempty"    json:"-"`
+	LastError     string             `bson:"last_error,omitempty"    json:"last_error,omitempty"`
+	MessageID     string             `bson:"message_id,omitempty"    json:"message_id,omitempty"`
+	SMTPResponse  string             `bson:"smtp_response,omitempty" json:"smtp_response,omitempty"`
+	QueueID       string             `bson:"queue_id,omitempty"      json:"queue_id,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at"              json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at"              json:"updated_at"`
+	SentAt        time.Time          `bson:"sent_at,omitempty"       json:"sent_at,omitzero"`
+}
+
+// Export job states.
+const (
+	ExportPending = "pending" // waiting for a worker, or for a retry
+	ExportRunning = "running" // claimed by a worker
+	ExportDone    = "done"    // archive stored and ready to download
+	ExportFailed  = "failed"  // out of attempts
+	ExportExpired = "expired" // archive deleted after ExpiresAt
+)
+
+// Export kinds.
+const (
+	ExportArchive = ""     // everything stored for the owner, as a passphrase-encrypted zip archive
+	ExportMbox    = "mbox" // one account's archived messages, as an mbox file
+)
+
+// ExportJob builds an encrypted archive of everything stored for an owner,
+// or an mbox file of one account's archived messages.  The passphrase an
+// archive is encrypted with is kept, encrypted with the server key, only
+// until the job finishes.  A running job whose claim is older than the
+// worker lease may be claimed again, so an export survives a worker dying
+// mid-run.
+type ExportJob struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"            json:"id"`
+	OwnerPubKey   string             `bson:"owner_pubkey"             json:"owner_pubkey"`
+	Kind          string             `bson:"kind,omitempty"           json:"kind,omitempty"`
+	AccountEmail  string             `bson:"account_email,omitempty"  json:"account_email,omitempty"` // mbox exports
+	Since         time.Time          `bson:"since,omitempty"          json:"since,omitzero"`          // mbox exports: messages dated from
+	Until         time.Time          `bson:"until,omitempty"          json:"until,omitzero"`          // mbox exports: messages dated before
+	Status        string             `bson:"status"                   json:"status"`
+	PassphraseEnc string             `bson:"passphrase_enc,omitempty" json:"-"`
+	StorageKey    string             `bson:"storage_key,omitempty"    json:"-"`
+	Parts         int                `bson:"parts,omitempty"          json:"-"` // mbox exports are stored in this many chunks
+	Size          int                `bson:"size,omitempty"           json:"size,omitempty"`
+	Counts        map[string]int     `bson:"counts,omitempty"         json:"counts,omitempty"`
+	Attempts      int                `bson:"attempts"                 json:"attempts"`
+	ClaimedBy     string             `bson:"claimed_by,omitempty"     json:"-"`
+	ClaimedAt     time.Time          `bson:"claimed_at,omitempty"     json:"-"`
+	LastError     string             `bson:"last_error,omitempty"     json:"last_error,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at"               json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at"               json:"updated_at"`
+	CompletedAt   time.Time          `bson:"completed_at,omitempty"   json:"completed_at,omitzero"`
+	ExpiresAt     time.Time          `bson:"expires_at,omitempty"     json:"expires_at,omitzero"`
+}
+
+// Archive job states.
+const (
+	ArchivePending = "pending" // waiting for a worker: queued, between batches or awaiting a retry
+	ArchiveRunning = "running" // a worker is archiving a batch
+	ArchiveDone    = "done"    // every message in the mailbox is archived
+	ArchiveFailed  = "failed"  // out of attempts, or the account is gone
+)
+
+// ArchiveJob imports a whole mailbox into the vault, a batch of messages
+// per claim.  LastUID is the checkpoint: the UIDL of the last message
+// handled, in mailbox order, so a job resumes after it whether it was
+// interrupted or only waiting for its next batch.  The claim is renewed
+// with every checkpoint, so a job whose worker died is claimed again
+// once the claim goes stale.
+type ArchiveJob struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"          json:"id"`
+	OwnerPubKey  string             `bson:"owner_pubkey"           json:"owner_pubkey"`
+	AccountEmail string             `bson:"account_email"          json:"account_email"`
+	Status       string             `bson:"status"                 json:"status"`
+	Total        int                `bson:"total"                  json:"total"`    // messages in the mailbox at the latest batch
+	Archived     int                `bson:"archived"               json:"archived"` // messages this job stored
+	Skipped      int                `bson:"skipped"                json:"skipped"`  // messages already archived when the job reached them
+	LastUID      string             `bson:"last_uid,omitempty"     json:"-"`
+	Attempts     int                `bson:"attempts"               json:"attempts"` // consecutive batches that failed
+	ClaimedBy    string             `bson:"claimed_by,omitempty"   json:"-"`
+	ClaimedAt    time.Time          `bson:"claimed_at,omitempty"   json:"-"`
+	LastError    string             `bson:"last_error,omitempty"   json:"last_error,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at"             json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at"             json:"updated_at"`
+	CompletedAt  time.Time          `bson:"completed_at,omitempty" json:"completed_at,omitzero"`
+}
+
+// Erasure job states.
+const (
+	ErasureChallenged = "challenged" // challenge issued, waiting for the signed confirmation
+	ErasurePending    = "pending"    // confirmed, waiting for a worker or for a retry
+	ErasureRunning    = "running"    // claimed by a worker
+	ErasureDone       = "done"       // every step finished
+	ErasureFailed     = "failed"     // out of attempts
+)
+
+// ErasureStep is the progress of one part of an erasure: a collection, the
+// identity or the owner's vault blobs.  Steps already done are skipped when
+// a failed attempt is retried.
+type ErasureStep struct {
+	Name    string `bson:"name"              json:"name"`
+	Done    bool   `bson:"done"              json:"done"`
+	Deleted int64  `bson:"deleted"           json:"deleted"`
+	Error   string `bson:"error,omitempty"   json:"error,omitempty"`
+}
+
+// ErasureJob deletes everything stored for an owner.  It starts as a
+// challenge whose token only the hash of is stored; confirming it queues the
+// job for a worker, claimed the same way as export jobs.
+type ErasureJob struct {
+	ID                 primitive.ObjectID `bson:"_id,omitempty"                  json:"id"`
+	OwnerPubKey        string             `bson:"owner_pubkey"                   json:"owner_pubkey"`
+	Status             string             `bson:"status"                         json:"status"`
+	ChallengeHash      string             `bson:"challenge_hash,omitempty"       json:"-"`
+	ChallengeExpiresAt time.Time          `bson:"challenge_expires_at,omitempty" json:"-"`
+	Steps              []ErasureStep      `bson:"steps,omitempty"                json:"steps,omitempty"`
+	Attempts           int                `bson:"attempts"                       json:"attempts"`
+	ClaimedBy          string             `bson:"claimed_by,omitempty"           json:"-"`
+	ClaimedAt          time.Time          `bson:"claimed_at,omitempty"           json:"-"`
+	LastError          string             `bson:"last_error,omitempty"           json:"last_error,omitempty"`
+	CreatedAt          time.Time          `bson:"created_at"                     json:"created_at"`
+	UpdatedAt          time.Time          `bson:"updated_at"                     json:"updated_at"`
+	CompletedAt        time.Time          `bson:"completed_at,omitempty"         json:"completed_at,omitzero"`
+}
+
+// Owner data collections, in the order an erasure deletes them: API keys
+// and scheduled and queued mail first so nothing acts for the owner while
+// the rest goes.  Payments and plans are billing records and are kept.
+var OwnerCollections = []string{
+	"api_keys",
+	"scheduled_messages",
+	"outbox",
+	"archive_jobs",
+	"mail_accounts",
+	"account_health",
+	"send_counts",
+	"messages",
+	"sent_messages",
+	"contacts",
+	"export_jobs",
+}
+
+// AuditEvent records a security-relevant action.  Audit events are not
+// owner data: they outlive an erasure, which is itself audited.
+type AuditEvent struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"      json:"id"`
+	OwnerPubKey string             `bson:"owner_pubkey"       json:"owner_pubkey"`
+	Action      string             `bson:"action"             json:"action"`
+	Target      string             `bson:"target,omitempty"   json:"target,omitempty"`
+	Detail      map[string]any     `bson:"detail,omitempty"   json:"detail,omitempty"`
+	ClientIP    string             `bson:"client_ip,omitempty" json:"client_ip,omitempty"` // of the request that caused the event, if any
+	CreatedAt   time.Time          `bson:"created_at"         json:"created_at"`
+}
+
+// CachedMessage is an inbox preview cached per POP3 UIDL.  Sender and
+// subject are stored encrypted; FromIndex is a blind index of the sender
+// address for exact-match search.  From and Subject are only present on
+// documents written before encryption was introduced and are removed by the
+// cache migration.
+type CachedMessage struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"     json:"id"`
+	OwnerPubKey  string             `bson:"owner_pubkey"      json:"owner_pubkey"`
+	AccountEmail string             `bson:"account_email"     json:"account_email"`
+	UID          string             `bson:"uid"               json:"uid"`
+	FromEnc      string             `bson:"from_enc"          json:"-"`
+	SubjectEnc   string             `bson:"subject_enc"       json:"-"`
+	FromIndex    string             `bson:"from_index"        json:"-"`
+	From         string             `bson:"from,omitempty"    json:"-"`
+	Subject      string             `bson:"subject,omitempty" json:"-"`
+	Date         time.Time          `bson:"date"              json:"date"`
+	Size         int                `bson:"size"              json:"size"`
+	CachedAt     time.Time          `bson:"cached_at"         json:"cached_at"`
+
+	// DedupIndex is a blind index of the message's mail.DedupKey, shared by
+	// the copies of a message its server lists more than once; empty when
+	// it has none.
+	DedupIndex string `bson:"dedup_index,omitempty" json:"-"`
+
+	// SnippetEnc holds the encrypted mail.Snippet of the message body, when
+	// one was fetched.
+	SnippetEnc string `bson:"snippet_enc,omitempty" json:"-"`
+
+	// Bounced marks delivery status notifications; BounceEnc holds their
+	// parsed details, encrypted like the sender.
+	Bounced   bool   `bson:"bounced,omitempty"    json:"bounced,omitempty"`
+	BounceEnc string `bson:"bounce_enc,omitempty" json:"-"`
+
+	// MailingList marks messages sent through a mailing list; ListEnc
+	// holds the list's mail.MailingList, encrypted like the sender.
+	MailingList bool   `bson:"mailing_list,omitempty" json:"mailing_list,omitempty"`
+	ListEnc     string `bson:"list_enc,omitempty"     json:"-"`
+
+	// LastSeenAt is when an inbox fetch last found the message on the
+	// server, and VanishedAt when one first found its UIDL gone; the cache
+	// sweep removes previews by them.  Previews cached before they were
+	// recorded have neither, and count as last seen at CachedAt.
+	LastSeenAt time.Time `bson:"last_seen_at,omitempty" json:"last_seen_at,omitzero"`
+	VanishedAt time.Time `bson:"vanished_at,omitempty"  json:"vanished_at,omitzero"`
+}
+
+// Contact sources.
+const (
+	ContactAuto = "auto" // derived from sent and received mail
+	ContactUser = "user" // created or edited by the owner
+)
+
+// Contact is an address-book entry.  Address and name are stored encrypted;
+// EmailIndex is a blind index of the address, unique per owner, and Prefixes
+// holds blind indexes of the address and name prefixes for typeahead search.
+// Deleted contacts are kept as tombstones, without address, name or
+// prefixes, so that later mail activity does not recreate them.
+type Contact struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"       json:"id"`
+	OwnerPubKey   string             `bson:"owner_pubkey"        json:"owner_pubkey"`
+	EmailEnc      string             `bson:"email_enc,omitempty" json:"-"`
+	NameEnc       string             `bson:"name_enc,omitempty"  json:"-"`
+	EmailIndex    string             `bson:"email_index"         json:"-"`
+	Prefixes      []string           `bson:"prefixes,omitempty"  json:"-"`
+	Source        string             `bson:"source"              json:"source"`
+	SentCount     int                `bson:"sent_count"          json:"sent_count"`
+	ReceivedCount int                `bson:"received_count"      json:"received_count"`
+	LastSeen      time.Time          `bson:"last_seen,omitempty" json:"last_seen,omitzero"`
+	Deleted       bool               `bson:"deleted,omitempty"   json:"-"`
+	CreatedAt     time.Time          `bson:"created_at"          json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at"          json:"updated_at"`
+}
+
+// RoleLease records which instance leads a background worker role, and
+// until when.  The leader renews it well before it expires; once it has
+// expired any instance may take the role.
+type RoleLease struct {
+	Role      string    `bson:"_id"        json:"role"`
+	Holder    string    `bson:"holder"     json:"holder"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// Maintenance is the deployment-wide maintenance switch.  While it is
+// enabled every instance refuses writes, with Message and RetryAfter, and
+// pauses its background workers.
+type Maintenance struct {
+	Enabled    bool      `bson:"enabled"     json:"enabled"`
+	Message    string    `bson:"message"     json:"message,omitempty"`
+	RetryAfter int       `bson:"retry_after" json:"retry_after_seconds,omitempty"` // seconds
+	UpdatedAt  time.Time `bson:"updated_at"  json:"updated_at,omitzero"`
 }
 
 // ---------- identity operations ----------
 
+// CreateIdentity stores id, returning ErrDuplicate if another identity
+// already has its canonical email.
 func (c *Client) CreateIdentity(ctx context.Context, id *Identity) error {
 	id.CreatedAt = time.Now()
-	_, err := c.db.Collection("identities").InsertOne(ctx, id)
+	_, err := c.collection("identities").InsertOne(ctx, id)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
 	return err
 }
 
 func (c *Client) GetIdentityByEmail(ctx context.Context, email string) (*Identity, error) {
 	var id Identity
-	err := c.db.Collection("identities").FindOne(ctx, bson.M{"email": email}).Decode(&id)
+	err := c.collection("identities").FindOne(ctx, bson.M{"email": email}).Decode(&id)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// GetIdentityByCanonicalEmail returns the identity whose canonical email
+// is canonical or, failing that, one without a canonical email whose email
+// is exactly email.
+func (c *Client) GetIdentityByCanonicalEmail(ctx context.Context, canonical, email string) (*Identity, error) {
+	var id Identity
+	err := c.collection("identities").FindOne(ctx,
+		canonicalFilter([]string{canonical}, []string{email}),
+		options.FindOne().SetSort(bson.D{{Key: "canonical_email", Value: -1}})).Decode(&id)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &id, nil
 }
 
+// identityOrder sorts a public key's identities: unrevoked ones first (a
+// missing revoked_at sorts low), then the primary, then oldest first.
+var identityOrder = bson.D{{Key: "revoked_at", Value: 1}, {Key: "primary", Value: -1}, {Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}
+
+// GetIdentityByPubKey returns the public key's primary identity, or its
+// oldest when none is marked primary.  Revoked identities are only returned
+// when the key has no other.
 func (c *Client) GetIdentityByPubKey(ctx context.Context, pubkey string) (*Identity, error) {
 	var id Identity
-	err := c.db.Collection("identities").FindOne(ctx, bson.M{"pubkey": pubkey}).Decode(&id)
+	err := c.collection("identities").FindOne(ctx, bson.M{"pubkey": pubkey},
+		options.FindOne().SetSort(identityOrder)).Decode(&id)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// GetIdentityByTxSig returns the identity registered with the transaction
+// whose signature is sig.
+func (c *Client) GetIdentityByTxSig(ctx context.Context, sig string) (*Identity, error) {
+	var id Identity
+	err := c.collection("identities").FindOne(ctx, bson.M{"tx_sig": sig}).Decode(&id)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &id, nil
 }
 
+// GetIdentitiesByEmails returns the identities registered for any of
+// emails, in no particular order, using a single query.
+func (c *Client) GetIdentitiesByEmails(ctx context.Context, emails []string) ([]Identity, error) {
+	return c.findIdentities(ctx, bson.M{"email": bson.M{"$in": emails}})
+}
+
+// GetIdentitiesByCanonicalEmails returns the identities whose canonical
+// email is one of canonicals and those without a canonical email whose email
+// is one of emails, in no particular order, using a single query.
+func (c *Client) GetIdentitiesByCanonicalEmails(ctx context.Context, canonicals, emails []string) ([]Identity, error) {
+	return c.findIdentities(ctx, canonicalFilter(canonicals, emails))
+}
+
+// canonicalFilter matches identities by canonical email, falling back to
+// the exact email for identities without one.
+func canonicalFilter(canonicals, emails []string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"canonical_email": bson.M{"$in": canonicals}},
+		bson.M{"canonical_email": bson.M{"$exists": false}, "email": bson.M{"$in": emails}},
+	}}
+}
+
+// GetAllIdentities returns every identity, oldest first.
+func (c *Client) GetAllIdentities(ctx context.Context) ([]Identity, error) {
+	cursor, err := c.collection("identities").Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	ids := make([]Identity, 0)
+	if err := cursor.All(ctx, &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// SetIdentityCanonicalEmail sets the identity's canonical email, or removes
+// it when canonical is empty.  It returns ErrDuplicate if another identity
+// has that canonical email.
+func (c *Client) SetIdentityCanonicalEmail(ctx context.Context, id primitive.ObjectID, canonical string) error {
+	update := bson.M{"$set": bson.M{"canonical_email": canonical}}
+	if canonical == "" {
+		update = bson.M{"$unset": bson.M{"canonical_email": ""}}
+	}
+	res, err := c.collection("identities").UpdateOne(ctx, bson.M{"_id": id}, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetIdentitiesByPubKeys returns the identities registered to any of
+// pubkeys using a single query.  Each key's identities are in
+// GetIdentityByPubKey's order, primary first, though the keys are not
+// grouped.
+func (c *Client) GetIdentitiesByPubKeys(ctx context.Context, pubkeys []string) ([]Identity, error) {
+	return c.findIdentities(ctx, bson.M{"pubkey": bson.M{"$in": pubkeys}}, options.Find().SetSort(identityOrder))
+}
+
+func (c *Client) findIdentities(ctx context.Context, filter bson.M, opts ...*options.FindOptions) ([]Identity, error) {
+	cursor, err := c.collection("identities").Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	ids := make([]Identity, 0)
+	if err := cursor.All(ctx, &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// UpsertIdentity inserts id unless an identity for its email already exists,
+// matched as GetIdentityByCanonicalEmail does, in which case the stored
+// mapping is left untouched.  It reports whether id was inserted, so
+// replaying the same identity is harmless.  A zero CreatedAt defaults to
+// now.
+func (c *Client) UpsertIdentity(ctx context.Context, id *Identity) (bool, error) {
+	if id.CreatedAt.IsZero() {
+		id.CreatedAt = time.Now()
+	}
+	insert := bson.M{
+		"email":      id.Email,
+		"pubkey":     id.PubKey,
+		"tx_hash":    id.TxHash,
+		"verified":   id.Verified,
+		"created_at": id.CreatedAt,
+	}
+	if id.ChainStatus != "" {
+		insert["chain_status"] = id.ChainStatus
+	}
+	filter := bson.M{"email": id.Email}
+	if id.CanonicalEmail != "" {
+		insert["canonical_email"] = id.CanonicalEmail
+		filter = canonicalFilter([]string{id.CanonicalEmail}, []string{id.Email})
+	}
+	res, err := c.collection("identities").UpdateOne(ctx, filter,
+		bson.M{"$setOnInsert": insert},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent upsert claimed the canonical email first.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if oid, ok := res.UpsertedID.(primitive.ObjectID); ok {
+		id.ID = oid
+	}
+	return res.UpsertedCount == 1, nil
+}
+
+// GetIdentitiesToCheck returns up to limit unrevoked identities whose
+// transaction is not yet anchored and that were registered since the given
+// time or were never checked, least recently checked first.
+func (c *Client) GetIdentitiesToCheck(ctx context.Context, since time.Time, limit int) ([]Identity, error) {
+	return c.findIdentities(ctx, bson.M{
+		"tx_hash":      bson.M{"$ne": ""},
+		"chain_status": bson.M{"$ne": ChainAnchored},
+		"revoked_at":   bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"created_at": bson.M{"$gte": since}},
+			bson.M{"chain_status": bson.M{"$exists": false}},
+		},
+	}, options.Find().SetSort(bson.D{{Key: "chain_checked_at", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(int64(limit)))
+}
+
+// SetIdentityChainStatus records the outcome of checking an identity's
+// transaction at the given time, and whether it is verified.
+func (c *Client) SetIdentityChainStatus(ctx context.Context, id primitive.ObjectID, status string, verified bool, at time.Time) error {
+	res, err := c.collection("identities").UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"chain_status": status, "verified": verified, "chain_checked_at": at}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 // ---------- mail-account operations ----------
 
 func (c *Client) CreateMailAccount(ctx context.Context, acc *MailAccount) error {
 	acc.CreatedAt = time.Now()
-	_, err := c.db.Collection("mail_accounts").InsertOne(ctx, acc)
+	_, err := c.collection("mail_accounts").InsertOne(ctx, acc)
 	return err
 }
 
-func (c *Client) GetMailAccountsByOwner(ctx context.Context, ownerPubKey string) ([]MailAccount, error) {
-	cursor, err := c.db.Collection("mail_accounts").Find(ctx, bson.M{"owner_pubkey": ownerPubKey})
+// FindMailAccounts returns the mail accounts q selects, oldest first.
+func (c *Client) FindMailAccounts(ctx context.Context, q MailAccountQuery) ([]MailAccount, error) {
+	cursor, err := c.collection("mail_accounts").Find(ctx, q.filter(), q.Page.findOptions(mailAccountOrder))
 	if err != nil {
 		return nil, err
 	}
@@ -126,14 +918,1567 @@ func (c *Client) GetMailAccountsByOwner(ctx context.Context, ownerPubKey string)
 	return accounts, nil
 }
 
+// GetMailAccountsByOwner returns the owner's accounts, oldest first.  An
+// empty ownerPubKey owns nothing, rather than leaving the query unscoped.
+func (c *Client) GetMailAccountsByOwner(ctx context.Context, ownerPubKey string) ([]MailAccount, error) {
+	if ownerPubKey == "" {
+		return []MailAccount{}, nil
+	}
+	return c.FindMailAccounts(ctx, MailAccountQuery{Owner: ownerPubKey})
+}
+
+// CountMailAccountsByOwner returns how many accounts the owner has,
+// without loading them.
+func (c *Client) CountMailAccountsByOwner(ctx context.Context, ownerPubKey string) (int64, error) {
+	if ownerPubKey == "" {
+		return 0, nil
+	}
+	return c.collection("mail_accounts").CountDocuments(ctx, MailAccountQuery{Owner: ownerPubKey}.filter())
+}
+
+// GetMailAccount returns the owner's account for accountEmail, or
+// ErrNotFound.
 func (c *Client) GetMailAccount(ctx context.Context, ownerPubKey, accountEmail string) (*MailAccount, error) {
-	var acc MailAccount
-	err := c.db.Collection("mail_accounts").FindOne(ctx, bson.M{
+	if ownerPubKey == "" || accountEmail == "" {
+		return nil, ErrNotFound
+	}
+	accounts, err := c.FindMailAccounts(ctx, MailAccountQuery{Owner: ownerPubKey, Email: accountEmail, Page: Page{Limit: 1}})
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, ErrNotFound
+	}
+	return &accounts[0], nil
+}
+
+// GetAllMailAccounts returns every mail account, for maintenance tasks such
+// as re-encrypting credentials under a new key.
+func (c *Client) GetAllMailAccounts(ctx context.Context) ([]MailAccount, error) {
+	return c.FindMailAccounts(ctx, MailAccountQuery{})
+}
+
+// SetMailAccountPasswords replaces both encrypted passwords of an account.
+func (c *Client) SetMailAccountPasswords(ctx context.Context, ownerPubKey, accountEmail, pop3PassEnc, smtpPassEnc string) error {
+	res, err := c.collection("mail_accounts").UpdateOne(ctx, bson.M{
+		"owner_pubkey":  ownerPubKey,
+		"account_email": accountEmail,
+	}, bson.M{"$set": bson.M{"pop3.pass_enc": pop3PassEnc, "smtp.pass_enc": smtpPassEnc}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MailAccountProfile holds the user-facing account settings that may be
+// changed after registration.  Nil fields are left untouched.
+type MailAccountProfile struct {
+	DisplayName         *string
+	Signature           *string
+	DefaultEnvelopeFrom *string
+	FetchPolicy         *string
+	SMTPMaxSessions     *int
+	SMTPHELOHostname    *string
+}
+
+func (c *Client) UpdateMailAccountProfile(ctx context.Context, ownerPubKey, accountEmail string, p MailAccountProfile) error {
+	set := bson.M{}
+	if p.DisplayName != nil {
+		set["display_name"] = *p.DisplayName
+	}
+	if p.Signature != nil {
+		set["signature"] = *p.Signature
+	}
+	if p.DefaultEnvelopeFrom != nil {
+		set["default_envelope_from"] = *p.DefaultEnvelopeFrom
+	}
+	if p.FetchPolicy != nil {
+		set["fetch_policy"] = *p.FetchPolicy
+	}
+	if p.SMTPMaxSessions != nil {
+		set["smtp.max_sessions"] = *p.SMTPMaxSessions
+	}
+	if p.SMTPHELOHostname != nil {
+		set["smtp.helo_hostname"] = *p.SMTPHELOHostname
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	res, err := c.collection("mail_accounts").UpdateOne(ctx, bson.M{
+		"owner_pubkey":  ownerPubKey,
+		"account_email": accountEmail,
+	}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateMailAccountStats records the outcome of an inbox fetch made at at,
+// and for a successful one the message count it listed.  Only the stats
+// fields are written, so the update cannot undo a concurrent credential or
+// profile change, and only while no later fetch is recorded: fetches of one
+// account racing each other keep the latest outcome whichever finishes
+// first.  Nothing is written for an unknown account.
+func (c *Client) UpdateMailAccountStats(ctx context.Context, ownerPubKey, accountEmail string, at time.Time, status string, messageCount int) error {
+	set := bson.M{"last_fetch_at": at, "last_fetch_status": status}
+	if status == FetchOK {
+		set["message_count"] = messageCount
+	}
+	_, err := c.collection("mail_accounts").UpdateOne(ctx, bson.M{
 		"owner_pubkey":  ownerPubKey,
 		"account_email": accountEmail,
-	}).Decode(&acc)
+		"last_fetch_at": bson.M{"$not": bson.M{"$gt": at}},
+	}, bson.M{"$set": set})
+	return err
+}
+
+// ---------- sent-mail history ----------
+
+func (c *Client) CreateSentMessage(ctx context.Context, m *SentMessage) error {
+	m.SentAt = time.Now()
+	_, err := c.collection("sent_messages").InsertOne(ctx, m)
+	return err
+}
+
+// GetSentMessagesByOwner returns the owner's sent-mail history, oldest
+// first.
+func (c *Client) GetSentMessagesByOwner(ctx context.Context, ownerPubKey string) ([]SentMessage, error) {
+	cur, err := c.collection("sent_messages").Find(ctx, bson.M{"owner_pubkey": ownerPubKey},
+		options.Find().SetSort(bson.D{{Key: "sent_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var msgs []SentMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// GetRecentSentMessages returns the owner's limit most recently sent
+// messages, newest first.
+func (c *Client) GetRecentSentMessages(ctx context.Context, ownerPubKey string, limit int) ([]SentMessage, error) {
+	cur, err := c.collection("sent_messages").Find(ctx, bson.M{"owner_pubkey": ownerPubKey},
+		options.Find().SetSort(bson.D{{Key: "sent_at", Value: -1}}).SetLimit(int64(limit)))
 	if err != nil {
 		return nil, err
 	}
-	return &acc, nil
+	defer cur.Close(ctx)
+
+	var msgs []SentMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// MarkSentMessageBounced attaches b to the owner's sent message with the
+// given Message-ID.  It returns ErrNotFound when no such message was sent.
+func (c *Client) MarkSentMessageBounced(ctx context.Context, ownerPubKey, messageID string, b *SentBounce) error {
+	res, err := c.collection("sent_messages").UpdateOne(ctx,
+		bson.M{"owner_pubkey": ownerPubKey, "message_id": messageID},
+		bson.M{"$set": bson.M{"bounce": b}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ---------- message preview cache ----------
+
+// UpsertCachedMessage stores m, replacing any cached preview with the same
+// owner, account and UID.  When m has no snippet, the one cached is kept:
+// snippets are only fetched on request.  It reports whether m was not
+// cached before.  A stored preview counts as seen on the server now.
+func (c *Client) UpsertCachedMessage(ctx context.Context, m *CachedMessage) (bool, error) {
+	m.CachedAt = time.Now()
+	m.LastSeenAt, m.VanishedAt = m.CachedAt, time.Time{}
+	filter := bson.M{
+		"owner_pubkey":  m.OwnerPubKey,
+		"account_email": m.AccountEmail,
+		"uid":           m.UID,
+	}
+	if m.SnippetEnc == "" {
+		var cached CachedMessage
+		err := c.collection("messages").FindOne(ctx, filter,
+			options.FindOne().SetProjection(bson.M{"snippet_enc": 1})).Decode(&cached)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return false, err
+		}
+		m.SnippetEnc = cached.SnippetEnc
+	}
+	res, err := c.collection("messages").ReplaceOne(ctx, filter, m, options.Replace().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount == 1, nil
+}
+
+// GetCachedMessagesBySender returns the owner's cached previews whose sender
+// blind index equals fromIndex, newest first.  An empty accountEmail searches
+// all of the owner's accounts.
+func (c *Client) GetCachedMessagesBySender(ctx context.Context, ownerPubKey, accountEmail, fromIndex string) ([]CachedMessage, error) {
+	filter := bson.M{"owner_pubkey": ownerPubKey, "from_index": fromIndex}
+	if accountEmail != "" {
+		filter["account_email"] = accountEmail
+	}
+	cur, err := c.collection("messages").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "date", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var msgs []CachedMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// GetCachedMessagesByOwner returns all of the owner's cached previews,
+// ordered by account and then date.
+func (c *Client) GetCachedMessagesByOwner(ctx context.Context, ownerPubKey string) ([]CachedMessage, error) {
+	cur, err := c.collection("messages").Find(ctx, bson.M{"owner_pubkey": ownerPubKey},
+		options.Find().SetSort(bson.D{{Key: "account_email", Value: 1}, {Key: "date", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var msgs []CachedMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// GetBouncedCachedMessages returns up to limit of the owner's cached
+// delivery status notifications, newest first.  An empty accountEmail
+// searches all of the owner's accounts.
+func (c *Client) GetBouncedCachedMessages(ctx context.Context, ownerPubKey, accountEmail string, limit int) ([]CachedMessage, error) {
+	filter := bson.M{"owner_pubkey": ownerPubKey, "bounced": true}
+	if accountEmail != "" {
+		filter["account_email"] = accountEmail
+	}
+	cur, err := c.collection("messages").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "date", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var msgs []CachedMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// GetPlaintextCachedMessages returns up to limit cached previews that still
+// carry plaintext sender or subject fields.
+func (c *Client) GetPlaintextCachedMessages(ctx context.Context, limit int) ([]CachedMessage, error) {
+	cur, err := c.collection("messages").Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"from": bson.M{"$exists": true}},
+		bson.M{"subject": bson.M{"$exists": true}},
+	}}, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var msgs []CachedMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// MarkCachedMessagesSeen records the UIDLs an inbox fetch found on the
+// account's server at time at: the previews cached under them are seen at
+// at, and any other preview of the account has vanished from the server,
+// as of at unless it had already.
+func (c *Client) MarkCachedMessagesSeen(ctx context.Context, ownerPubKey, accountEmail string, uids []string, at time.Time) error {
+	if uids == nil {
+		uids = []string{}
+	}
+	account := bson.M{"owner_pubkey": ownerPubKey, "account_email": accountEmail}
+	_, err := c.collection("messages").UpdateMany(ctx,
+		bson.M{"owner_pubkey": ownerPubKey, "account_email": accountEmail, "uid": bson.M{"$in": uids}},
+		bson.M{"$set": bson.M{"last_seen_at": at}, "$unset": bson.M{"vanished_at": ""}})
+	if err != nil {
+		return err
+	}
+	account["uid"] = bson.M{"$nin": uids}
+	account["vanished_at"] = bson.M{"$exists": false}
+	_, err = c.collection("messages").UpdateMany(ctx, account, bson.M{"$set": bson.M{"vanished_at": at}})
+	return err
+}
+
+// FindStaleCachedMessages returns the cached previews q selects, by
+// ascending id.
+func (c *Client) FindStaleCachedMessages(ctx context.Context, q StaleMessageQuery) ([]CachedMessage, error) {
+	cur, err := c.collection("messages").Find(ctx, q.filter(),
+		Page{Limit: q.Limit}.findOptions(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var msgs []CachedMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// DeleteCachedMessages deletes the cached previews with the given ids and
+// returns how many there were.
+func (c *Client) DeleteCachedMessages(ctx context.Context, ids []primitive.ObjectID) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := c.collection("messages").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// ---------- scheduled messages ----------
+
+func (c *Client) CreateScheduledMessage(ctx context.Context, m *ScheduledMessage) error {
+	now := time.Now()
+	m.Status = ScheduledPending
+	m.NextAttemptAt = m.SendAt
+	m.CreatedAt, m.UpdatedAt = now, now
+	res, err := c.collection("scheduled_messages").InsertOne(ctx, m)
+	if err != nil {
+		return err
+	}
+	if id, ok := res.InsertedID.(primitive.ObjectID); ok {
+		m.ID = id
+	}
+	return nil
+}
+
+func (c *Client) GetScheduledMessagesByOwner(ctx context.Context, ownerPubKey string) ([]ScheduledMessage, error) {
+	cur, err := c.collection("scheduled_messages").Find(ctx,
+		bson.M{"owner_pubkey": ownerPubKey},
+		options.Find().SetSort(bson.D{{Key: "send_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var msgs []ScheduledMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// GetUndeliveredScheduledMessages returns every scheduled message that may
+// still be delivered: pending, or claimed by a worker.
+func (c *Client) GetUndeliveredScheduledMessages(ctx context.Context) ([]ScheduledMessage, error) {
+	cur, err := c.collection("scheduled_messages").Find(ctx,
+		bson.M{"status": bson.M{"$in": bson.A{ScheduledPending, ScheduledSending}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var msgs []ScheduledMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// SetScheduledPayload replaces the encrypted payload of a scheduled message.
+func (c *Client) SetScheduledPayload(ctx context.Context, id primitive.ObjectID, payloadEnc string) error {
+	res, err := c.collection("scheduled_messages").UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"payload_enc": payloadEnc, "updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CancelScheduledMessage cancels a message that is still pending, or stuck.
+// Messages being delivered, delivered or unknown yield ErrNotFound.
+func (c *Client) CancelScheduledMessage(ctx context.Context, ownerPubKey, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	res, err := c.collection("scheduled_messages").UpdateOne(ctx,
+		bson.M{"_id": oid, "owner_pubkey": ownerPubKey, "status": bson.M{"$in": bson.A{ScheduledPending, ScheduledStuck}}},
+		bson.M{"$set": bson.M{"status": ScheduledCancelled, "updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ClaimDueScheduledMessage atomically moves the oldest due pending message to
+// the sending state on behalf of worker, so concurrent workers on other
+// instances can never pick up the same message.  ErrNotFound means nothing is
+// due.
+func (c *Client) ClaimDueScheduledMessage(ctx context.Context, now time.Time, worker string) (*ScheduledMessage, error) {
+	var m ScheduledMessage
+	err := c.collection("scheduled_messages").FindOneAndUpdate(ctx,
+		bson.M{"status": ScheduledPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"status": ScheduledSending, "claimed_by": worker, "updated_at": now}},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// MarkStuckScheduledMessages moves messages claimed before claimedBefore
+// and never finished to ScheduledStuck, with lastError, and reports how
+// many it moved.  Their worker died or lost the database mid-attempt, so
+// whether they were sent is unknown: they are left for the owner to check
+// and cancel rather than delivered again.
+func (c *Client) MarkStuckScheduledMessages(ctx context.Context, claimedBefore time.Time, lastError string) (int64, error) {
+	res, err := c.collection("scheduled_messages").UpdateMany(ctx,
+		bson.M{"status": ScheduledSending, "updated_at": bson.M{"$lt": claimedBefore}},
+		bson.M{"$set": bson.M{"status": ScheduledStuck, "last_error": lastError, "updated_at": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// FinishScheduledAttempt records the outcome of a delivery attempt.  Only
+// the worker holding the claim may do so; otherwise ErrNotFound is returned.
+func (c *Client) FinishScheduledAttempt(ctx context.Context, m *ScheduledMessage) error {
+	m.UpdatedAt = time.Now()
+	res, err := c.collection("scheduled_messages").UpdateOne(ctx,
+		bson.M{"_id": m.ID, "status": ScheduledSending, "claimed_by": m.ClaimedBy},
+		bson.M{"$set": bson.M{
+			"status":          m.Status,
+			"attempts":        m.Attempts,
+			"next_attempt_at": m.NextAttemptAt,
+			"last_error":      m.LastError,
+			"message_id":      m.MessageID,
+			"smtp_response":   m.SMTPResponse,
+			"queue_id":        m.QueueID,
+			"updated_at":      m.UpdatedAt,
+		}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ---------- outbox ----------
+
+// CreateOutboxMessage queues m for delivery now, or stores it deferred
+// until its NextAttemptAt when its status is OutboxDeferredGreylist.
+func (c *Client) CreateOutboxMessage(ctx context.Context, m *OutboxMessage) error {
+	now := time.Now()
+	if m.Status != OutboxDeferredGreylist || m.NextAttemptAt.IsZero() {
+		m.Status, m.NextAttemptAt = OutboxQueued, now
+	}
+	m.CreatedAt, m.UpdatedAt = now, now
+	res, err := c.collection("outbox").InsertOne(ctx, m)
+	if err != nil {
+		return err
+	}
+	if id, ok := res.InsertedID.(primitive.ObjectID); ok {
+		m.ID = id
+	}
+	return nil
+}
+
+// GetOutboxMessage returns one of the owner's outbox messages.
+func (c *Client) GetOutboxMessage(ctx context.Context, ownerPubKey, id string) (*OutboxMessage, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	var m OutboxMessage
+	err = c.collection("outbox").FindOne(ctx, bson.M{"_id": oid, "owner_pubkey": ownerPubKey}).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetUndeliveredOutboxMessages returns every outbox message that may still
+// be delivered: queued, deferred, or claimed by a worker.
+func (c *Client) GetUndeliveredOutboxMessages(ctx context.Context) ([]OutboxMessage, error) {
+	cur, err := c.collection("outbox").Find(ctx,
+		bson.M{"status": bson.M{"$in": bson.A{OutboxQueued, OutboxDeferredGreylist, OutboxSending}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var msgs []OutboxMessage
+	if err := cur.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// SetOutboxPayload replaces the encrypted payload of an outbox message.
+func (c *Client) SetOutboxPayload(ctx context.Context, id primitive.ObjectID, payloadEnc string) error {
+	res, err := c.collection("outbox").UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"payload_enc": payloadEnc, "updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ClaimOutboxMessage atomically moves the oldest due queued or deferred
+// message, or a sending one whose claim was last renewed before
+// staleBefore, to the sending state on behalf of worker, and counts the
+// attempt.  ErrNotFound means nothing is waiting.
+func (c *Client) ClaimOutboxMessage(ctx context.Context, now, staleBefore time.Time, worker string) (*OutboxMessage, error) {
+	var m OutboxMessage
+	err := c.collection("outbox").FindOneAndUpdate(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": bson.M{"$in": bson.A{OutboxQueued, OutboxDeferredGreylist}}, "next_attempt_at": bson.M{"$lte": now}},
+			bson.M{"status": OutboxSending, "claimed_at": bson.M{"$lt": staleBefore}},
+		}},
+		bson.M{
+			"$set": bson.M{"status": OutboxSending, "claimed_by": worker, "claimed_at": now, "updated_at": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// RenewOutboxClaim extends worker's claim on a sending message to now.
+// ErrNotFound means the claim was lost to another worker.
+func (c *Client) RenewOutboxClaim(ctx context.Context, id primitive.ObjectID, worker string, now time.Time) error {
+	res, err := c.collection("outbox").UpdateOne(ctx,
+		bson.M{"_id": id, "status": OutboxSending, "claimed_by": worker},
+		bson.M{"$set": bson.M{"claimed_at": now, "updated_at": now}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// FinishOutboxAttempt records the outcome of a delivery attempt.  Only the
+// worker holding the claim may do so; otherwise ErrNotFound is returned.
+func (c *Client) FinishOutboxAttempt(ctx context.Context, m *OutboxMessage) error {
+	m.UpdatedAt = time.Now()
+	res, err := c.collection("outbox").UpdateOne(ctx,
+		bson.M{"_id": m.ID, "status": OutboxSending, "claimed_by": m.ClaimedBy},
+		bson.M{"$set": bson.M{
+			"status":          m.Status,
+			"next_attempt_at": m.NextAttemptAt,
+			"last_error":      m.LastError,
+			"message_id":      m.MessageID,
+			"smtp_response":   m.SMTPResponse,
+			"queue_id":        m.QueueID,
+			"updated_at":      m.UpdatedAt,
+			"sent_at":         m.SentAt,
+		}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ---------- export jobs ----------
+
+// CreateExportJob queues j unless the owner already has an export of the
+// same kind, and for the same account, pending or running, in which case
+// that job is loaded into j instead.  It reports whether j was queued, so
+// repeated requests do not pile up exports.
+func (c *Client) CreateExportJob(ctx context.Context, j *ExportJob) (bool, error) {
+	now := time.Now()
+	// $in rather than plain equality, which an upsert would copy into the
+	// new document: archive exports have neither field.
+	active := bson.M{
+		"owner_pubkey":  j.OwnerPubKey,
+		"kind":          bson.M{"$in": bson.A{optional(j.Kind)}},
+		"account_email": bson.M{"$in": bson.A{optional(j.AccountEmail)}},
+		"status":        bson.M{"$in": bson.A{ExportPending, ExportRunning}},
+	}
+	insert := bson.M{
+		"status":     ExportPending,
+		"attempts":   0,
+		"created_at": now,
+		"updated_at": now,
+	}
+	if j.PassphraseEnc != "" {
+		insert["passphrase_enc"] = j.PassphraseEnc
+	}
+	if j.Kind == ExportMbox {
+		insert["kind"], insert["account_email"] = j.Kind, j.AccountEmail
+		if !j.Since.IsZero() {
+			insert["since"] = j.Since
+		}
+		if !j.Until.IsZero() {
+			insert["until"] = j.Until
+		}
+	}
+	res, err := c.collection("export_jobs").UpdateOne(ctx, active,
+		bson.M{"$setOnInsert": insert},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	if oid, ok := res.UpsertedID.(primitive.ObjectID); ok {
+		j.ID, j.Status, j.CreatedAt, j.UpdatedAt = oid, ExportPending, now, now
+		return true, nil
+	}
+	err = c.collection("export_jobs").FindOne(ctx, active).Decode(j)
+	if err == mongo.ErrNoDocuments {
+		// Finished between the two calls; the caller may simply retry.
+		return false, ErrNotFound
+	}
+	return false, err
+}
+
+// GetExportJob returns one of the owner's export jobs.
+func (c *Client) GetExportJob(ctx context.Context, ownerPubKey, id string) (*ExportJob, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	var j ExportJob
+	err = c.collection("export_jobs").FindOne(ctx, bson.M{"_id": oid, "owner_pubkey": ownerPubKey}).Decode(&j)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// optional matches s in a filter, or a missing field when s is empty.
+func optional(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// ClaimExportJob atomically claims the oldest pending export, or a running
+// one whose claim is older than staleBefore, for worker and counts the
+// attempt.  ErrNotFound means there is nothing to do.
+func (c *Client) ClaimExportJob(ctx context.Context, now, staleBefore time.Time, worker string) (*ExportJob, error) {
+	var j ExportJob
+	err := c.collection("export_jobs").FindOneAndUpdate(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": ExportPending},
+			bson.M{"status": ExportRunning, "claimed_at": bson.M{"$lt": staleBefore}},
+		}},
+		bson.M{
+			"$set": bson.M{"status": ExportRunning, "claimed_by": worker, "claimed_at": now, "updated_at": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "created_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&j)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// FinishExportJob records the outcome of an export attempt.  Only the
+// worker holding the claim may do so; otherwise ErrNotFound is returned.
+func (c *Client) FinishExportJob(ctx context.Context, j *ExportJob) error {
+	j.UpdatedAt = time.Now()
+	update := bson.M{"$set": bson.M{
+		"status":       j.Status,
+		"storage_key":  j.StorageKey,
+		"parts":        j.Parts,
+		"size":         j.Size,
+		"counts":       j.Counts,
+		"last_error":   j.LastError,
+		"updated_at":   j.UpdatedAt,
+		"completed_at": j.CompletedAt,
+		"expires_at":   j.ExpiresAt,
+	}}
+	if j.PassphraseEnc == "" {
+		update["$unset"] = bson.M{"passphrase_enc": ""}
+	}
+	res, err := c.collection("export_jobs").UpdateOne(ctx,
+		bson.M{"_id": j.ID, "status": ExportRunning, "claimed_by": j.ClaimedBy}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetExpiredExportJobs returns finished exports whose ExpiresAt has passed.
+func (c *Client) GetExpiredExportJobs(ctx context.Context, now time.Time) ([]ExportJob, error) {
+	cur, err := c.collection("export_jobs").Find(ctx,
+		bson.M{"status": ExportDone, "expires_at": bson.M{"$lte": now}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var jobs []ExportJob
+	if err := cur.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// GetUnexpiredExportJobs returns the exports whose archive is stored or
+// about to be: pending, running and done jobs.
+func (c *Client) GetUnexpiredExportJobs(ctx context.Context) ([]ExportJob, error) {
+	cur, err := c.collection("export_jobs").Find(ctx,
+		bson.M{"status": bson.M{"$in": bson.A{ExportPending, ExportRunning, ExportDone}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var jobs []ExportJob
+	if err := cur.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// ExpireExportJob marks a finished export expired once its archive has been
+// deleted.
+func (c *Client) ExpireExportJob(ctx context.Context, id primitive.ObjectID) error {
+	_, err := c.collection("export_jobs").UpdateOne(ctx,
+		bson.M{"_id": id, "status": ExportDone},
+		bson.M{
+			"$set":   bson.M{"status": ExportExpired, "updated_at": time.Now()},
+			"$unset": bson.M{"storage_key": ""},
+		})
+	return err
+}
+
+// ---------- archive jobs ----------
+
+// CreateArchiveJob queues j unless its account already has an archive job
+// pending or running, in which case that job is loaded into j instead.  It
+// reports whether j was queued.
+func (c *Client) CreateArchiveJob(ctx context.Context, j *ArchiveJob) (bool, error) {
+	now := time.Now()
+	active := bson.M{
+		"owner_pubkey":  j.OwnerPubKey,
+		"account_email": j.AccountEmail,
+		"status":        bson.M{"$in": bson.A{ArchivePending, ArchiveRunning}},
+	}
+	res, err := c.collection("archive_jobs").UpdateOne(ctx, active,
+		bson.M{"$setOnInsert": bson.M{
+			"status":     ArchivePending,
+			"total":      0,
+			"archived":   0,
+			"skipped":    0,
+			"attempts":   0,
+			"created_at": now,
+			"updated_at": now,
+		}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	if oid, ok := res.UpsertedID.(primitive.ObjectID); ok {
+		j.ID, j.Status, j.CreatedAt, j.UpdatedAt = oid, ArchivePending, now, now
+		return true, nil
+	}
+	err = c.collection("archive_jobs").FindOne(ctx, active).Decode(j)
+	if err == mongo.ErrNoDocuments {
+		// Finished between the two calls; the caller may simply retry.
+		return false, ErrNotFound
+	}
+	return false, err
+}
+
+// GetArchiveJob returns one of the owner's archive jobs.
+func (c *Client) GetArchiveJob(ctx context.Context, ownerPubKey, id string) (*ArchiveJob, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	var j ArchiveJob
+	err = c.collection("archive_jobs").FindOne(ctx, bson.M{"_id": oid, "owner_pubkey": ownerPubKey}).Decode(&j)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// ClaimArchiveJob atomically claims the pending archive job that has waited
+// longest, or a running one whose claim is older than staleBefore.  Jobs
+// go back to pending between batches, so mailboxes take turns.
+func (c *Client) ClaimArchiveJob(ctx context.Context, now, staleBefore time.Time, worker string) (*ArchiveJob, error) {
+	var j ArchiveJob
+	err := c.collection("archive_jobs").FindOneAndUpdate(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": ArchivePending},
+			bson.M{"status": ArchiveRunning, "claimed_at": bson.M{"$lt": staleBefore}},
+		}},
+		bson.M{
+			"$set": bson.M{"status": ArchiveRunning, "claimed_by": worker, "claimed_at": now, "updated_at": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "updated_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&j)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// SaveArchiveJob records a checkpoint or the outcome of a batch, renewing
+// the claim to j.ClaimedAt.  Only the worker holding the claim may do so;
+// otherwise ErrNotFound is returned.
+func (c *Client) SaveArchiveJob(ctx context.Context, j *ArchiveJob) error {
+	j.UpdatedAt = time.Now()
+	res, err := c.collection("archive_jobs").UpdateOne(ctx,
+		bson.M{"_id": j.ID, "status": ArchiveRunning, "claimed_by": j.ClaimedBy},
+		bson.M{"$set": bson.M{
+			"status":       j.Status,
+			"total":        j.Total,
+			"archived":     j.Archived,
+			"skipped":      j.Skipped,
+			"last_uid":     j.LastUID,
+			"attempts":     j.Attempts,
+			"claimed_at":   j.ClaimedAt,
+			"last_error":   j.LastError,
+			"updated_at":   j.UpdatedAt,
+			"completed_at": j.CompletedAt,
+		}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ---------- erasure jobs ----------
+
+// CreateErasureChallenge stores a challenge for j.OwnerPubKey, replacing
+// any earlier unconfirmed one, so only the latest token can be confirmed.
+func (c *Client) CreateErasureChallenge(ctx context.Context, j *ErasureJob) error {
+	now := time.Now()
+	var stored ErasureJob
+	err := c.collection("erasure_jobs").FindOneAndUpdate(ctx,
+		bson.M{"owner_pubkey": j.OwnerPubKey, "status": ErasureChallenged},
+		bson.M{
+			"$set": bson.M{
+				"challenge_hash":       j.ChallengeHash,
+				"challenge_expires_at": j.ChallengeExpiresAt,
+				"updated_at":           now,
+			},
+			"$setOnInsert": bson.M{"attempts": 0, "created_at": now},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&stored)
+	if err != nil {
+		return err
+	}
+	*j = stored
+	return nil
+}
+
+// ConfirmErasureJob queues the owner's challenged erasure whose token hashes
+// to challengeHash, if it has not expired by now.  The challenge is used up.
+// ErrNotFound means no such challenge.
+func (c *Client) ConfirmErasureJob(ctx context.Context, ownerPubKey, challengeHash string, now time.Time) (*ErasureJob, error) {
+	var j ErasureJob
+	err := c.collection("erasure_jobs").FindOneAndUpdate(ctx,
+		bson.M{
+			"owner_pubkey":         ownerPubKey,
+			"status":               ErasureChallenged,
+			"challenge_hash":       challengeHash,
+			"challenge_expires_at": bson.M{"$gt": now},
+		},
+		bson.M{
+			"$set":   bson.M{"status": ErasurePending, "updated_at": now},
+			"$unset": bson.M{"challenge_hash": "", "challenge_expires_at": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&j)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// GetErasureJob returns one of the owner's erasure jobs.
+func (c *Client) GetErasureJob(ctx context.Context, ownerPubKey, id string) (*ErasureJob, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	var j ErasureJob
+	err = c.collection("erasure_jobs").FindOne(ctx, bson.M{"_id": oid, "owner_pubkey": ownerPubKey}).Decode(&j)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// ClaimErasureJob is ClaimExportJob for erasure jobs.
+func (c *Client) ClaimErasureJob(ctx context.Context, now, staleBefore time.Time, worker string) (*ErasureJob, error) {
+	var j ErasureJob
+	err := c.collection("erasure_jobs").FindOneAndUpdate(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": ErasurePending},
+			bson.M{"status": ErasureRunning, "claimed_at": bson.M{"$lt": staleBefore}},
+		}},
+		bson.M{
+			"$set": bson.M{"status": ErasureRunning, "claimed_by": worker, "claimed_at": now, "updated_at": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "created_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&j)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// UpdateErasureJob records the progress or outcome of an erasure attempt.
+// Only the worker holding the claim may do so; otherwise ErrNotFound is
+// returned.
+func (c *Client) UpdateErasureJob(ctx context.Context, j *ErasureJob) error {
+	j.UpdatedAt = time.Now()
+	res, err := c.collection("erasure_jobs").UpdateOne(ctx,
+		bson.M{"_id": j.ID, "status": ErasureRunning, "claimed_by": j.ClaimedBy},
+		bson.M{"$set": bson.M{
+			"status":       j.Status,
+			"steps":        j.Steps,
+			"last_error":   j.LastError,
+			"updated_at":   j.UpdatedAt,
+			"completed_at": j.CompletedAt,
+		}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CountOwnerData returns the number of documents the owner has in each of
+// OwnerCollections.
+func (c *Client) CountOwnerData(ctx context.Context, ownerPubKey string) (map[string]int64, error) {
+	counts := make(map[string]int64, len(OwnerCollections))
+	for _, coll := range OwnerCollections {
+		n, err := c.collection(coll).CountDocuments(ctx, bson.M{"owner_pubkey": ownerPubKey})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", coll, err)
+		}
+		counts[coll] = n
+	}
+	return counts, nil
+}
+
+// DeleteOwnerData deletes the owner's documents from coll, one of
+// OwnerCollections, and returns how many there were.
+func (c *Client) DeleteOwnerData(ctx context.Context, ownerPubKey, coll string) (int64, error) {
+	if !slices.Contains(OwnerCollections, coll) {
+		return 0, fmt.Errorf("not an owner data collection: %q", coll)
+	}
+	res, err := c.collection(coll).DeleteMany(ctx, bson.M{"owner_pubkey": ownerPubKey})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// RevokeIdentities marks the identities registered to pubkey revoked at the
+// given time and returns how many were newly revoked.
+func (c *Client) RevokeIdentities(ctx context.Context, pubkey string, at time.Time) (int64, error) {
+	res, err := c.collection("identities").UpdateMany(ctx,
+		bson.M{"pubkey": pubkey, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": at}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// ---------- audit events ----------
+
+func (c *Client) CreateAuditEvent(ctx context.Context, e *AuditEvent) error {
+	e.CreatedAt = time.Now()
+	res, err := c.collection("audit_events").InsertOne(ctx, e)
+	if err != nil {
+		return err
+	}
+	if oid, ok := res.InsertedID.(primitive.ObjectID); ok {
+		e.ID = oid
+	}
+	return nil
+}
+
+// GetAuditEvents returns the owner's most recent audit events, newest
+// first.
+func (c *Client) GetAuditEvents(ctx context.Context, ownerPubKey string, limit int) ([]AuditEvent, error) {
+	cur, err := c.collection("audit_events").Find(ctx,
+		bson.M{"owner_pubkey": ownerPubKey},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	events := make([]AuditEvent, 0)
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ---------- billing ----------
+
+// CreatePayment records a claimed payment, returning ErrDuplicate if its
+// transaction signature has already been claimed.
+func (c *Client) CreatePayment(ctx context.Context, p *Payment) error {
+	p.CreatedAt = time.Now()
+	res, err := c.collection("payments").InsertOne(ctx, p)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	p.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (c *Client) GetPaymentByTxSig(ctx context.Context, txSig string) (*Payment, error) {
+	var p Payment
+	err := c.collection("payments").FindOne(ctx, bson.M{"tx_sig": txSig}).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// CreateTip records a broadcast tip, returning ErrDuplicate if its
+// transaction has already been recorded.
+func (c *Client) CreateTip(ctx context.Context, t *Tip) error {
+	t.CreatedAt = time.Now()
+	res, err := c.collection("tips").InsertOne(ctx, t)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	t.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// SetPlan creates or replaces the owner's plan.
+func (c *Client) SetPlan(ctx context.Context, p *Plan) error {
+	p.UpdatedAt = time.Now()
+	_, err := c.collection("plans").ReplaceOne(ctx,
+		bson.M{"owner_pubkey": p.OwnerPubKey}, p,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// ---------- API keys ----------
+
+// CreateAPIKey stores a new key, returning ErrDuplicate if its hash is
+// already taken.
+func (c *Client) CreateAPIKey(ctx context.Context, k *APIKey) error {
+	k.CreatedAt = time.Now()
+	res, err := c.collection("api_keys").InsertOne(ctx, k)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	k.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+func (c *Client) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	var k APIKey
+	err := c.collection("api_keys").FindOne(ctx, bson.M{"key_hash": keyHash}).Decode(&k)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// DeleteAPIKey revokes one of the owner's keys.  Unknown ids and keys of
+// other owners yield ErrNotFound.
+func (c *Client) DeleteAPIKey(ctx context.Context, ownerPubKey, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	res, err := c.collection("api_keys").DeleteOne(ctx, bson.M{"_id": oid, "owner_pubkey": ownerPubKey})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TouchAPIKey records that a key was used at the given time.
+func (c *Client) TouchAPIKey(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	_, err := c.collection("api_keys").UpdateOne(ctx,
+		bson.M{"_id": id}, bson.M{"$set": bson.M{"last_used_at": at}})
+	return err
+}
+
+// UseSignature records a wallet signature, by its hash, as used until
+// expiresAt, returning ErrDuplicate if it already is.  Signed requests that
+// must not be replayed call it once the signature checks out.
+func (c *Client) UseSignature(ctx context.Context, sigHash string, expiresAt time.Time) error {
+	_, err := c.collection("used_signatures").InsertOne(ctx, bson.M{"_id": sigHash, "expires_at": expiresAt})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// ---------- contacts ----------
+
+// RecordContactActivity counts one message sent to (sent) or received from
+// the contact with c's EmailIndex and advances its LastSeen to c.LastSeen.
+// Unknown addresses are added as ContactAuto with c's address, name and
+// prefixes; names of existing contacts are left alone.  Activity for a
+// deleted contact is ignored.
+func (c *Client) RecordContactActivity(ctx context.Context, ct *Contact, sent bool) error {
+	counter := "received_count"
+	if sent {
+		counter = "sent_count"
+	}
+	now := time.Now()
+	_, err := c.collection("contacts").UpdateOne(ctx,
+		bson.M{"owner_pubkey": ct.OwnerPubKey, "email_index": ct.EmailIndex, "deleted": bson.M{"$ne": true}},
+		bson.M{
+			"$setOnInsert": bson.M{
+				"email_enc":  ct.EmailEnc,
+				"name_enc":   ct.NameEnc,
+				"prefixes":   ct.Prefixes,
+				"source":     ContactAuto,
+				"created_at": now,
+				"updated_at": now,
+			},
+			"$inc": bson.M{counter: 1},
+			"$max": bson.M{"last_seen": ct.LastSeen},
+		},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// A tombstone holds the address: the owner deleted this contact.
+		return nil
+	}
+	return err
+}
+
+// CreateContact stores ct as a ContactUser contact.  An automatic or deleted
+// contact with the same address is taken over, keeping its activity counts;
+// an existing user contact yields ErrDuplicate.
+func (c *Client) CreateContact(ctx context.Context, ct *Contact) error {
+	now := time.Now()
+	ct.ID = primitive.NilObjectID
+	ct.Source, ct.Deleted = ContactUser, false
+	ct.CreatedAt, ct.UpdatedAt = now, now
+	res, err := c.collection("contacts").InsertOne(ctx, ct)
+	if err == nil {
+		ct.ID = res.InsertedID.(primitive.ObjectID)
+		return nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	err = c.collection("contacts").FindOneAndUpdate(ctx,
+		bson.M{
+			"owner_pubkey": ct.OwnerPubKey,
+			"email_index":  ct.EmailIndex,
+			"$or":          bson.A{bson.M{"source": ContactAuto}, bson.M{"deleted": true}},
+		},
+		bson.M{
+			"$set": bson.M{
+				"email_enc":  ct.EmailEnc,
+				"name_enc":   ct.NameEnc,
+				"prefixes":   ct.Prefixes,
+				"source":     ContactUser,
+				"updated_at": now,
+			},
+			"$unset": bson.M{"deleted": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(ct)
+	if err == mongo.ErrNoDocuments {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// GetContacts returns up to limit of the owner's contacts, most recently
+// seen first; a limit of 0 returns them all.  A non-empty prefix restricts
+// them to contacts whose Prefixes contain it.
+func (c *Client) GetContacts(ctx context.Context, ownerPubKey, prefix string, limit int) ([]Contact, error) {
+	filter := bson.M{"owner_pubkey": ownerPubKey, "deleted": bson.M{"$ne": true}}
+	if prefix != "" {
+		filter["prefixes"] = prefix
+	}
+	cur, err := c.collection("contacts").Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "last_seen", Value: -1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var contacts []Contact
+	if err := cur.All(ctx, &contacts); err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// GetContactsByIndexes returns the owner's contacts, deleted ones aside,
+// whose email blind index is one of emailIndexes.
+func (c *Client) GetContactsByIndexes(ctx context.Context, ownerPubKey string, emailIndexes []string) ([]Contact, error) {
+	cur, err := c.collection("contacts").Find(ctx, bson.M{
+		"owner_pubkey": ownerPubKey,
+		"email_index":  bson.M{"$in": emailIndexes},
+		"deleted":      bson.M{"$ne": true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var contacts []Contact
+	if err := cur.All(ctx, &contacts); err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// UpdateContact replaces the address, name and prefixes of one of the
+// owner's contacts with those of ct, makes it a ContactUser contact and
+// loads the result into ct.  Unknown and deleted contacts yield
+// ErrNotFound; an address another contact already has yields ErrDuplicate.
+func (c *Client) UpdateContact(ctx context.Context, ownerPubKey, id string, ct *Contact) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	err = c.collection("contacts").FindOneAndUpdate(ctx,
+		bson.M{"_id": oid, "owner_pubkey": ownerPubKey, "deleted": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{
+			"email_enc":   ct.EmailEnc,
+			"name_enc":    ct.NameEnc,
+			"email_index": ct.EmailIndex,
+			"prefixes":    ct.Prefixes,
+			"source":      ContactUser,
+			"updated_at":  time.Now(),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(ct)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return ErrDuplicate
+	}
+	return err
+}
+
+// DeleteContact turns one of the owner's contacts into a tombstone.  Unknown
+// and already deleted contacts yield ErrNotFound.
+func (c *Client) DeleteContact(ctx context.Context, ownerPubKey, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	res, err := c.collection("contacts").UpdateOne(ctx,
+		bson.M{"_id": oid, "owner_pubkey": ownerPubKey, "deleted": bson.M{"$ne": true}},
+		bson.M{
+			"$set":   bson.M{"deleted": true, "updated_at": time.Now()},
+			"$unset": bson.M{"email_enc": "", "name_enc": "", "prefixes": ""},
+		})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ---------- per-owner send limits ----------
+
+func (c *Client) GetSendLimits(ctx context.Context, ownerPubKey string) (*SendLimits, error) {
+	var l SendLimits
+	err := c.collection("send_limits").FindOne(ctx, bson.M{"owner_pubkey": ownerPubKey}).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (c *Client) SetSendLimits(ctx context.Context, l *SendLimits) error {
+	l.UpdatedAt = time.Now()
+	_, err := c.collection("send_limits").ReplaceOne(ctx,
+		bson.M{"owner_pubkey": l.OwnerPubKey}, l,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// CountDailySend counts a message sent from the account on day, a UTC
+// date as "2006-01-02", unless the day's count has already reached limit.
+// It reports whether the message was counted.  Counts expire two days
+// after their day.
+func (c *Client) CountDailySend(ctx context.Context, ownerPubKey, accountEmail, day string, limit int) (bool, error) {
+	date, err := time.Parse(time.DateOnly, day)
+	if err != nil {
+		return false, err
+	}
+	_, err = c.collection("send_counts").UpdateOne(ctx, bson.M{
+		"owner_pubkey":  ownerPubKey,
+		"account_email": accountEmail,
+		"day":           day,
+		"count":         bson.M{"$lt": limit},
+	}, bson.M{
+		"$inc":         bson.M{"count": 1},
+		"$setOnInsert": bson.M{"expires_at": date.AddDate(0, 0, 2)},
+	}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The day's count exists and has reached the limit.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ---------- mail-account health ----------
+
+func (c *Client) GetAccountHealth(ctx context.Context, ownerPubKey, accountEmail string) (*AccountHealth, error) {
+	var h AccountHealth
+	err := c.collection("account_health").FindOne(ctx, bson.M{
+		"owner_pubkey":  ownerPubKey,
+		"account_email": accountEmail,
+	}).Decode(&h)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (c *Client) GetAccountHealthByOwner(ctx context.Context, ownerPubKey string) ([]AccountHealth, error) {
+	cursor, err := c.collection("account_health").Find(ctx, bson.M{"owner_pubkey": ownerPubKey})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var result []AccountHealth
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Client) SetAccountHealth(ctx context.Context, h *AccountHealth) error {
+	h.UpdatedAt = time.Now()
+	_, err := c.collection("account_health").ReplaceOne(ctx, bson.M{
+		"owner_pubkey":  h.OwnerPubKey,
+		"account_email": h.AccountEmail,
+	}, h, options.Replace().SetUpsert(true))
+	return err
+}
+
+// ---------- owner leases ----------
+
+// AcquireOwnerLease takes the lease on the owner for holder until ttl from
+// now, and reports whether it did.  A lease still held by another holder is
+// not taken; an expired one is.  Re-acquiring a lease one already holds
+// extends it.
+func (c *Client) AcquireOwnerLease(ctx context.Context, ownerPubKey, holder string, ttl time.Duration) (bool, error) {
+	return c.acquireLease(ctx, "owner_leases", ownerPubKey, holder, ttl)
+}
+
+// ReleaseOwnerLease gives up holder's lease on the owner, if it still has it.
+func (c *Client) ReleaseOwnerLease(ctx context.Context, ownerPubKey, holder string) error {
+	_, err := c.collection("owner_leases").DeleteOne(ctx, bson.M{"_id": ownerPubKey, "holder": holder})
+	return err
+}
+
+// acquireLease takes or extends the lease with the given id in collection
+// for holder, as AcquireOwnerLease describes.
+func (c *Client) acquireLease(ctx context.Context, collection, id, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := c.collection(collection).UpdateOne(ctx, bson.M{
+		"_id": id,
+		"$or": bson.A{
+			bson.M{"holder": holder},
+			bson.M{"expires_at": bson.M{"$lte": now}},
+		},
+	}, bson.M{"$set": bson.M{"holder": holder, "expires_at": now.Add(ttl)}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The lease exists and belongs to someone else.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ---------- worker role leases ----------
+
+// AcquireRoleLease takes the lease on a background worker role for holder
+// until ttl from now, and reports whether it did, on the same terms as
+// AcquireOwnerLease.  The holder of a role's lease is its leader.
+func (c *Client) AcquireRoleLease(ctx context.Context, role, holder string, ttl time.Duration) (bool, error) {
+	return c.acquireLease(ctx, "leases", role, holder, ttl)
+}
+
+// ReleaseRoleLease gives up holder's lease on the role, if it still has it,
+// so that another instance can take the role over at once.
+func (c *Client) ReleaseRoleLease(ctx context.Context, role, holder string) error {
+	_, err := c.collection("leases").DeleteOne(ctx, bson.M{"_id": role, "holder": holder})
+	return err
+}
+
+// GetRoleLeases returns the role leases that have not expired, by role.
+func (c *Client) GetRoleLeases(ctx context.Context) ([]RoleLease, error) {
+	cursor, err := c.collection("leases").Find(ctx, bson.M{"expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var leases []RoleLease
+	err = cursor.All(ctx, &leases)
+	return leases, err
+}
+
+// ---------- settings ----------
+
+// maintenanceID is the _id of the maintenance switch in the settings
+// collection.
+const maintenanceID = "maintenance"
+
+// GetMaintenance returns the maintenance switch, disabled if it has never
+// been set.
+func (c *Client) GetMaintenance(ctx context.Context) (*Maintenance, error) {
+	var m Maintenance
+	err := c.collection("settings").FindOne(ctx, bson.M{"_id": maintenanceID}).Decode(&m)
+	if err == mongo.ErrNoDocuments {
+		return &Maintenance{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetMaintenance replaces the maintenance switch.
+func (c *Client) SetMaintenance(ctx context.Context, m *Maintenance) error {
+	m.UpdatedAt = time.Now()
+	_, err := c.collection("settings").UpdateOne(ctx, bson.M{"_id": maintenanceID},
+		bson.M{"$set": m}, options.Update().SetUpsert(true))
+	return err
 }
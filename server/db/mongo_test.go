@@ -2,12 +2,15 @@ package db
 
 import (
 	"context"
+	"errors"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 // getTestMongoURI returns the MongoDB URI for testing.
@@ -27,7 +30,7 @@ func setupTestDB(t *testing.T) (*Client, func()) {
 	uri := getTestMongoURI()
 	dbName := "mulamail_test_" + primitive.NewObjectID().Hex()
 
-	client, err := Connect(uri, dbName)
+	client, err := Connect(uri, dbName, Options{DurableWriteConcern: writeconcern.New(writeconcern.WMajority()), RetryWrites: true})
 	if err != nil {
 		t.Skipf("MongoDB not available at %s: %v (use MONGO_TEST_URI to specify test instance)", uri, err)
 		return nil, nil
@@ -60,7 +63,7 @@ func TestConnect_Success(t *testing.T) {
 }
 
 func TestConnect_InvalidURI(t *testing.T) {
-	_, err := Connect("invalid://uri", "testdb")
+	_, err := Connect("invalid://uri", "testdb", Options{})
 	if err == nil {
 		t.Error("expected error with invalid URI, got nil")
 	}
@@ -151,8 +154,8 @@ func TestGetIdentityByEmail_NotFound(t *testing.T) {
 	if err == nil {
 		t.Error("expected error for non-existent email, got nil")
 	}
-	if err != mongo.ErrNoDocuments {
-		t.Errorf("expected mongo.ErrNoDocuments, got %v", err)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
 	}
 }
 
@@ -188,6 +191,40 @@ func TestGetIdentityByPubKey_Success(t *testing.T) {
 	}
 }
 
+func TestUpsertIdentity_KeepsExisting(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	first := &Identity{Email: "carol@example.com", PubKey: "CarolKey1", TxHash: "tx1", Verified: true}
+	inserted, err := client.UpsertIdentity(ctx, first)
+	if err != nil {
+		t.Fatalf("UpsertIdentity failed: %v", err)
+	}
+	if !inserted || first.ID.IsZero() {
+		t.Errorf("expected first upsert to insert, got inserted=%v id=%v", inserted, first.ID)
+	}
+
+	inserted, err = client.UpsertIdentity(ctx, &Identity{Email: "carol@example.com", PubKey: "CarolKey2", TxHash: "tx2"})
+	if err != nil {
+		t.Fatalf("second UpsertIdentity failed: %v", err)
+	}
+	if inserted {
+		t.Error("expected second upsert for the same email not to insert")
+	}
+
+	got, err := client.GetIdentityByEmail(ctx, "carol@example.com")
+	if err != nil {
+		t.Fatalf("GetIdentityByEmail failed: %v", err)
+	}
+	if got.PubKey != "CarolKey1" || got.TxHash != "tx1" {
+		t.Errorf("existing mapping overwritten: %+v", got)
+	}
+}
+
 func TestGetIdentityByPubKey_NotFound(t *testing.T) {
 	client, cleanup := setupTestDB(t)
 	if client == nil {
@@ -381,8 +418,67 @@ func TestGetMailAccount_NotFound(t *testing.T) {
 
 	ctx := context.Background()
 	_, err := client.GetMailAccount(ctx, "owner", "nonexistent@example.com")
-	if err == nil {
-		t.Error("expected error for non-existent account, got nil")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound for non-existent account, got %v", err)
+	}
+}
+
+func TestFindMailAccounts(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, acc := range []struct{ owner, email string }{
+		{"alice", "a1@example.com"}, {"bob", "b1@example.com"}, {"alice", "a2@example.com"},
+		{"alice", "shared@example.com"}, {"bob", "shared@example.com"},
+	} {
+		if err := client.CreateMailAccount(ctx, &MailAccount{OwnerPubKey: acc.owner, AccountEmail: acc.email}); err != nil {
+			t.Fatalf("CreateMailAccount failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    MailAccountQuery
+		want []string // owner/email, in order
+	}{
+		{"everything", MailAccountQuery{}, []string{"alice/a1", "bob/b1", "alice/a2", "alice/shared", "bob/shared"}},
+		{"owner", MailAccountQuery{Owner: "alice"}, []string{"alice/a1", "alice/a2", "alice/shared"}},
+		{"email", MailAccountQuery{Email: "shared@example.com"}, []string{"alice/shared", "bob/shared"}},
+		{"owner and email", MailAccountQuery{Owner: "bob", Email: "shared@example.com"}, []string{"bob/shared"}},
+		{"unknown owner", MailAccountQuery{Owner: "carol"}, nil},
+		{"email of another owner", MailAccountQuery{Owner: "bob", Email: "a1@example.com"}, nil},
+		{"limit", MailAccountQuery{Page: Page{Limit: 2}}, []string{"alice/a1", "bob/b1"}},
+		{"offset", MailAccountQuery{Page: Page{Offset: 3}}, []string{"alice/shared", "bob/shared"}},
+		{"offset and limit", MailAccountQuery{Owner: "alice", Page: Page{Offset: 1, Limit: 1}}, []string{"alice/a2"}},
+		{"offset past the end", MailAccountQuery{Page: Page{Offset: 9}}, nil},
+		{"negative page", MailAccountQuery{Owner: "bob", Page: Page{Offset: -1, Limit: -1}}, []string{"bob/b1", "bob/shared"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accs, err := client.FindMailAccounts(ctx, tt.q)
+			if err != nil {
+				t.Fatalf("FindMailAccounts failed: %v", err)
+			}
+			var got []string
+			for _, a := range accs {
+				got = append(got, a.OwnerPubKey+"/"+strings.TrimSuffix(a.AccountEmail, "@example.com"))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	// The wrappers never leave an empty owner unscoped.
+	if accs, err := client.GetMailAccountsByOwner(ctx, ""); err != nil || len(accs) != 0 {
+		t.Errorf("empty owner: want no accounts, got %d, %v", len(accs), err)
+	}
+	if _, err := client.GetMailAccount(ctx, "", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("empty owner and email: want ErrNotFound, got %v", err)
 	}
 }
 
@@ -506,3 +602,677 @@ func TestClose_Success(t *testing.T) {
 	// Still call cleanup to drop the test database
 	cleanup()
 }
+
+func TestCreateSentMessage_Success(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	msg := &SentMessage{
+		OwnerPubKey:  "owner_pub_key_123",
+		AccountEmail: "mail@example.com",
+		To:           []string{"you@example.org"},
+		Subject:      "hello",
+		MessageID:    "<1.abc@example.com>",
+		SMTPResponse: "250 2.0.0 Ok: queued as ABC123",
+		QueueID:      "ABC123",
+	}
+
+	if err := client.CreateSentMessage(ctx, msg); err != nil {
+		t.Fatalf("CreateSentMessage failed: %v", err)
+	}
+	if msg.SentAt.IsZero() {
+		t.Error("expected SentAt to be set after creation")
+	}
+
+	var stored SentMessage
+	if err := client.db.Collection("sent_messages").FindOne(ctx, map[string]string{"message_id": msg.MessageID}).Decode(&stored); err != nil {
+		t.Fatalf("stored record not found: %v", err)
+	}
+	if stored.QueueID != "ABC123" {
+		t.Errorf("QueueID: want %q, got %q", "ABC123", stored.QueueID)
+	}
+}
+
+func TestSendLimits_SetAndGet(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := client.GetSendLimits(ctx, "owner"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound before any override, got %v", err)
+	}
+
+	if err := client.SetSendLimits(ctx, &SendLimits{OwnerPubKey: "owner", MaxRecipients: 10}); err != nil {
+		t.Fatalf("SetSendLimits failed: %v", err)
+	}
+	// Upsert replaces the previous override.
+	if err := client.SetSendLimits(ctx, &SendLimits{OwnerPubKey: "owner", MaxRecipients: 20}); err != nil {
+		t.Fatalf("SetSendLimits (update) failed: %v", err)
+	}
+
+	l, err := client.GetSendLimits(ctx, "owner")
+	if err != nil {
+		t.Fatalf("GetSendLimits failed: %v", err)
+	}
+	if l.MaxRecipients != 20 {
+		t.Errorf("MaxRecipients: want 20, got %d", l.MaxRecipients)
+	}
+}
+
+func TestUpdateMailAccountProfile(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := client.CreateMailAccount(ctx, &MailAccount{OwnerPubKey: "owner", AccountEmail: "me@example.com", DisplayName: "Old"}); err != nil {
+		t.Fatalf("CreateMailAccount failed: %v", err)
+	}
+
+	sig := "Regards,\r\nMe"
+	if err := client.UpdateMailAccountProfile(ctx, "owner", "me@example.com", MailAccountProfile{Signature: &sig}); err != nil {
+		t.Fatalf("UpdateMailAccountProfile failed: %v", err)
+	}
+
+	acc, err := client.GetMailAccount(ctx, "owner", "me@example.com")
+	if err != nil {
+		t.Fatalf("GetMailAccount failed: %v", err)
+	}
+	if acc.Signature != sig {
+		t.Errorf("Signature: want %q, got %q", sig, acc.Signature)
+	}
+	if acc.DisplayName != "Old" {
+		t.Errorf("DisplayName must be left untouched, got %q", acc.DisplayName)
+	}
+
+	err = client.UpdateMailAccountProfile(ctx, "owner", "missing@example.com", MailAccountProfile{Signature: &sig})
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for unknown account, got %v", err)
+	}
+}
+
+func TestSetMailAccountPasswords(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, owner := range []string{"owner-a", "owner-b"} {
+		acc := &MailAccount{OwnerPubKey: owner, AccountEmail: "me@example.com",
+			POP3: POP3Settings{Host: "pop.example.com", PassEnc: "old-pop3"},
+			SMTP: SMTPSettings{Host: "smtp.example.com", PassEnc: "old-smtp"}}
+		if err := client.CreateMailAccount(ctx, acc); err != nil {
+			t.Fatalf("CreateMailAccount failed: %v", err)
+		}
+	}
+
+	all, err := client.GetAllMailAccounts(ctx)
+	if err != nil {
+		t.Fatalf("GetAllMailAccounts failed: %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("expected 2 accounts across owners, got %d", len(all))
+	}
+
+	if err := client.SetMailAccountPasswords(ctx, "owner-a", "me@example.com", "new-pop3", "new-smtp"); err != nil {
+		t.Fatalf("SetMailAccountPasswords failed: %v", err)
+	}
+	acc, err := client.GetMailAccount(ctx, "owner-a", "me@example.com")
+	if err != nil {
+		t.Fatalf("GetMailAccount failed: %v", err)
+	}
+	if acc.POP3.PassEnc != "new-pop3" || acc.SMTP.PassEnc != "new-smtp" {
+		t.Errorf("passwords not replaced: %+v %+v", acc.POP3, acc.SMTP)
+	}
+	if acc.POP3.Host != "pop.example.com" {
+		t.Errorf("other POP3 settings must be left untouched, got %+v", acc.POP3)
+	}
+
+	if err := client.SetMailAccountPasswords(ctx, "owner-a", "missing@example.com", "x", "y"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for unknown account, got %v", err)
+	}
+}
+
+func TestScheduledMessage_UndeliveredAndPayload(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	pending := &ScheduledMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", PayloadEnc: "old", SendAt: time.Now().Add(time.Hour)}
+	cancelled := &ScheduledMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", PayloadEnc: "old", SendAt: time.Now().Add(time.Hour)}
+	for _, m := range []*ScheduledMessage{pending, cancelled} {
+		if err := client.CreateScheduledMessage(ctx, m); err != nil {
+			t.Fatalf("CreateScheduledMessage failed: %v", err)
+		}
+	}
+	if err := client.CancelScheduledMessage(ctx, "owner", cancelled.ID.Hex()); err != nil {
+		t.Fatalf("CancelScheduledMessage failed: %v", err)
+	}
+
+	msgs, err := client.GetUndeliveredScheduledMessages(ctx)
+	if err != nil {
+		t.Fatalf("GetUndeliveredScheduledMessages failed: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].ID != pending.ID {
+		t.Fatalf("expected only the pending message, got %+v", msgs)
+	}
+
+	if err := client.SetScheduledPayload(ctx, pending.ID, "new"); err != nil {
+		t.Fatalf("SetScheduledPayload failed: %v", err)
+	}
+	msgs, _ = client.GetScheduledMessagesByOwner(ctx, "owner")
+	for _, m := range msgs {
+		if m.ID == pending.ID && m.PayloadEnc != "new" {
+			t.Errorf("payload not replaced: %q", m.PayloadEnc)
+		}
+	}
+
+	if err := client.SetScheduledPayload(ctx, primitive.NewObjectID(), "x"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for unknown message, got %v", err)
+	}
+}
+
+func TestScheduledMessage_Lifecycle(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	due := &ScheduledMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", PayloadEnc: "enc", SendAt: now.Add(-time.Minute)}
+	later := &ScheduledMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", PayloadEnc: "enc", SendAt: now.Add(time.Hour)}
+	for _, m := range []*ScheduledMessage{due, later} {
+		if err := client.CreateScheduledMessage(ctx, m); err != nil {
+			t.Fatalf("CreateScheduledMessage failed: %v", err)
+		}
+	}
+
+	// Only one worker may claim the due message.
+	m, err := client.ClaimDueScheduledMessage(ctx, now, "worker-a")
+	if err != nil {
+		t.Fatalf("ClaimDueScheduledMessage failed: %v", err)
+	}
+	if m.ID != due.ID || m.Status != ScheduledSending {
+		t.Errorf("claimed unexpected message %+v", m)
+	}
+	if _, err := client.ClaimDueScheduledMessage(ctx, now, "worker-b"); err != ErrNotFound {
+		t.Errorf("second claim: expected ErrNotFound, got %v", err)
+	}
+
+	// A worker without the claim cannot record an outcome.
+	stolen := *m
+	stolen.ClaimedBy = "worker-b"
+	stolen.Status = ScheduledSent
+	if err := client.FinishScheduledAttempt(ctx, &stolen); err != ErrNotFound {
+		t.Errorf("finish without claim: expected ErrNotFound, got %v", err)
+	}
+
+	m.Status, m.Attempts, m.MessageID = ScheduledSent, 1, "<id@example.com>"
+	if err := client.FinishScheduledAttempt(ctx, m); err != nil {
+		t.Fatalf("FinishScheduledAttempt failed: %v", err)
+	}
+
+	if err := client.CancelScheduledMessage(ctx, "owner", due.ID.Hex()); err != ErrNotFound {
+		t.Errorf("cancel after delivery: expected ErrNotFound, got %v", err)
+	}
+	if err := client.CancelScheduledMessage(ctx, "owner", later.ID.Hex()); err != nil {
+		t.Errorf("CancelScheduledMessage failed: %v", err)
+	}
+
+	msgs, err := client.GetScheduledMessagesByOwner(ctx, "owner")
+	if err != nil {
+		t.Fatalf("GetScheduledMessagesByOwner failed: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].Status != ScheduledSent || msgs[1].Status != ScheduledCancelled {
+		t.Errorf("unexpected scheduled messages %+v", msgs)
+	}
+}
+
+func TestOutbox_ClaimRenewAndReclaim(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	m := &OutboxMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", PayloadEnc: "enc"}
+	if err := client.CreateOutboxMessage(ctx, m); err != nil {
+		t.Fatalf("CreateOutboxMessage failed: %v", err)
+	}
+	now := time.Now().Truncate(time.Millisecond)
+	lease := 5 * time.Minute
+
+	claimed, err := client.ClaimOutboxMessage(ctx, now, now.Add(-lease), "worker-a")
+	if err != nil {
+		t.Fatalf("ClaimOutboxMessage failed: %v", err)
+	}
+	if claimed.ID != m.ID || claimed.Status != OutboxSending || claimed.Attempts != 1 {
+		t.Errorf("claimed unexpected message %+v", claimed)
+	}
+	if _, err := client.ClaimOutboxMessage(ctx, now, now.Add(-lease), "worker-b"); err != ErrNotFound {
+		t.Errorf("second claim: expected ErrNotFound, got %v", err)
+	}
+
+	// A renewed claim stays with its worker; once the lease runs out
+	// without renewal the message is claimed again.
+	later := now.Add(lease)
+	if err := client.RenewOutboxClaim(ctx, m.ID, "worker-a", later); err != nil {
+		t.Fatalf("RenewOutboxClaim failed: %v", err)
+	}
+	if _, err := client.ClaimOutboxMessage(ctx, later, later.Add(-lease), "worker-b"); err != ErrNotFound {
+		t.Errorf("claim of a renewed message: expected ErrNotFound, got %v", err)
+	}
+	stale := later.Add(lease + time.Second)
+	reclaimed, err := client.ClaimOutboxMessage(ctx, stale, stale.Add(-lease), "worker-b")
+	if err != nil || reclaimed.Attempts != 2 {
+		t.Fatalf("reclaim: %+v, %v", reclaimed, err)
+	}
+
+	// The worker that lost the claim can neither renew nor finish.
+	if err := client.RenewOutboxClaim(ctx, m.ID, "worker-a", stale); err != ErrNotFound {
+		t.Errorf("renew without claim: expected ErrNotFound, got %v", err)
+	}
+	claimed.Status = OutboxSent
+	if err := client.FinishOutboxAttempt(ctx, claimed); err != ErrNotFound {
+		t.Errorf("finish without claim: expected ErrNotFound, got %v", err)
+	}
+
+	reclaimed.Status, reclaimed.SMTPResponse, reclaimed.SentAt = OutboxSent, "250 OK", stale
+	if err := client.FinishOutboxAttempt(ctx, reclaimed); err != nil {
+		t.Fatalf("FinishOutboxAttempt failed: %v", err)
+	}
+	got, err := client.GetOutboxMessage(ctx, "owner", m.ID.Hex())
+	if err != nil || got.Status != OutboxSent || got.SMTPResponse != "250 OK" {
+		t.Errorf("GetOutboxMessage: %+v, %v", got, err)
+	}
+	if _, err := client.GetOutboxMessage(ctx, "someone-else", m.ID.Hex()); err != ErrNotFound {
+		t.Errorf("other owner: expected ErrNotFound, got %v", err)
+	}
+	if msgs, _ := client.GetUndeliveredOutboxMessages(ctx); len(msgs) != 0 {
+		t.Errorf("a sent message is not undelivered: %+v", msgs)
+	}
+}
+
+func TestCachedMessages_UpsertSearchAndMigrate(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	legacy := &CachedMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: "u1", From: "a@example.com", Subject: "hi"}
+	if inserted, err := client.UpsertCachedMessage(ctx, legacy); err != nil || !inserted {
+		t.Fatalf("UpsertCachedMessage: inserted=%v err=%v", inserted, err)
+	}
+
+	plain, err := client.GetPlaintextCachedMessages(ctx, 10)
+	if err != nil {
+		t.Fatalf("GetPlaintextCachedMessages failed: %v", err)
+	}
+	if len(plain) != 1 {
+		t.Fatalf("expected 1 plaintext document, got %d", len(plain))
+	}
+
+	// Replacing by owner/account/uid drops the plaintext fields.
+	migrated := plain[0]
+	migrated.From, migrated.Subject = "", ""
+	migrated.FromEnc, migrated.SubjectEnc, migrated.FromIndex = "enc-from", "enc-subject", "idx"
+	if inserted, err := client.UpsertCachedMessage(ctx, &migrated); err != nil || inserted {
+		t.Fatalf("UpsertCachedMessage (replace): inserted=%v err=%v", inserted, err)
+	}
+
+	if plain, _ := client.GetPlaintextCachedMessages(ctx, 10); len(plain) != 0 {
+		t.Errorf("expected no plaintext documents after replace, got %d", len(plain))
+	}
+	found, err := client.GetCachedMessagesBySender(ctx, "owner", "", "idx")
+	if err != nil {
+		t.Fatalf("GetCachedMessagesBySender failed: %v", err)
+	}
+	if len(found) != 1 || found[0].UID != "u1" {
+		t.Errorf("unexpected search result %+v", found)
+	}
+}
+
+func TestBounces_MarkSentAndListCached(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	sent := &SentMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", To: []string{"nobody@example.org"}, MessageID: "<m1@example.com>"}
+	if err := client.CreateSentMessage(ctx, sent); err != nil {
+		t.Fatalf("CreateSentMessage failed: %v", err)
+	}
+	b := &SentBounce{Recipient: "nobody@example.org", Status: "5.1.1", BouncedAt: time.Now()}
+	if err := client.MarkSentMessageBounced(ctx, "owner", "<m1@example.com>", b); err != nil {
+		t.Fatalf("MarkSentMessageBounced failed: %v", err)
+	}
+	if err := client.MarkSentMessageBounced(ctx, "someone-else", "<m1@example.com>", b); err != ErrNotFound {
+		t.Errorf("other owner: want ErrNotFound, got %v", err)
+	}
+
+	for i, uid := range []string{"dsn-old", "plain", "dsn-new"} {
+		m := &CachedMessage{OwnerPubKey: "owner", AccountEmail: "me@example.com", UID: uid,
+			Date: time.Now().Add(time.Duration(i) * time.Hour), Bounced: uid != "plain", BounceEnc: "enc"}
+		if _, err := client.UpsertCachedMessage(ctx, m); err != nil {
+			t.Fatalf("UpsertCachedMessage failed: %v", err)
+		}
+	}
+	found, err := client.GetBouncedCachedMessages(ctx, "owner", "", 10)
+	if err != nil {
+		t.Fatalf("GetBouncedCachedMessages failed: %v", err)
+	}
+	if len(found) != 2 || found[0].UID != "dsn-new" || found[1].UID != "dsn-old" {
+		t.Errorf("want the two bounces newest first, got %+v", found)
+	}
+}
+
+func TestCreatePayment_RejectsReuse(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := client.CreatePayment(ctx, &Payment{TxSig: "sig1", OwnerPubKey: "owner1", Plan: "premium"}); err != nil {
+		t.Fatalf("CreatePayment failed: %v", err)
+	}
+	err := client.CreatePayment(ctx, &Payment{TxSig: "sig1", OwnerPubKey: "owner2", Plan: "premium"})
+	if err != ErrDuplicate {
+		t.Errorf("expected ErrDuplicate for reused signature, got %v", err)
+	}
+
+	p, err := client.GetPaymentByTxSig(ctx, "sig1")
+	if err != nil {
+		t.Fatalf("GetPaymentByTxSig failed: %v", err)
+	}
+	if p.OwnerPubKey != "owner1" {
+		t.Errorf("OwnerPubKey: want %q, got %q", "owner1", p.OwnerPubKey)
+	}
+	if _, err := client.GetPaymentByTxSig(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSetPlan_Upserts(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, tx := range []string{"sig1", "sig2"} {
+		if err := client.SetPlan(ctx, &Plan{OwnerPubKey: "owner1", Tier: "premium", PaymentTx: tx}); err != nil {
+			t.Fatalf("SetPlan failed: %v", err)
+		}
+	}
+	n, err := client.db.Collection("plans").CountDocuments(ctx, map[string]string{"owner_pubkey": "owner1"})
+	if err != nil {
+		t.Fatalf("CountDocuments failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 plan document, got %d", n)
+	}
+}
+
+func TestAPIKey_Lifecycle(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	k := &APIKey{KeyHash: "hash1", Prefix: "mk_abcd", OwnerPubKey: "owner1", Scopes: []string{"mail:read"}}
+	if err := client.CreateAPIKey(ctx, k); err != nil {
+		t.Fatalf("CreateAPIKey failed: %v", err)
+	}
+	if k.ID.IsZero() {
+		t.Error("expected ID to be set")
+	}
+	if err := client.CreateAPIKey(ctx, &APIKey{KeyHash: "hash1", OwnerPubKey: "owner2"}); err != ErrDuplicate {
+		t.Errorf("expected ErrDuplicate for reused hash, got %v", err)
+	}
+
+	got, err := client.GetAPIKeyByHash(ctx, "hash1")
+	if err != nil {
+		t.Fatalf("GetAPIKeyByHash failed: %v", err)
+	}
+	if got.OwnerPubKey != "owner1" || len(got.Scopes) != 1 || !got.LastUsedAt.IsZero() {
+		t.Errorf("unexpected key: %+v", got)
+	}
+
+	used := time.Now().Truncate(time.Millisecond)
+	if err := client.TouchAPIKey(ctx, k.ID, used); err != nil {
+		t.Fatalf("TouchAPIKey failed: %v", err)
+	}
+	got, _ = client.GetAPIKeyByHash(ctx, "hash1")
+	if !got.LastUsedAt.Equal(used) {
+		t.Errorf("LastUsedAt: want %v, got %v", used, got.LastUsedAt)
+	}
+
+	if err := client.DeleteAPIKey(ctx, "owner2", k.ID.Hex()); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound when deleting another owner's key, got %v", err)
+	}
+	if err := client.DeleteAPIKey(ctx, "owner1", k.ID.Hex()); err != nil {
+		t.Fatalf("DeleteAPIKey failed: %v", err)
+	}
+	if _, err := client.GetAPIKeyByHash(ctx, "hash1"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := client.DeleteAPIKey(ctx, "owner1", "not-an-id"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for malformed id, got %v", err)
+	}
+}
+
+func TestGetIdentitiesByEmailsAndPubKeys(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, id := range []*Identity{
+		{Email: "alice@example.com", PubKey: "pk-alice"},
+		{Email: "bob@example.com", PubKey: "pk-bob"},
+		{Email: "carol@example.com", PubKey: "pk-carol"},
+	} {
+		if err := client.CreateIdentity(ctx, id); err != nil {
+			t.Fatalf("CreateIdentity failed: %v", err)
+		}
+	}
+
+	ids, err := client.GetIdentitiesByEmails(ctx, []string{"alice@example.com", "carol@example.com", "nobody@example.com"})
+	if err != nil {
+		t.Fatalf("GetIdentitiesByEmails failed: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected 2 identities, got %+v", ids)
+	}
+
+	ids, err = client.GetIdentitiesByPubKeys(ctx, []string{"pk-bob"})
+	if err != nil {
+		t.Fatalf("GetIdentitiesByPubKeys failed: %v", err)
+	}
+	if len(ids) != 1 || ids[0].Email != "bob@example.com" {
+		t.Errorf("expected bob's identity, got %+v", ids)
+	}
+
+	ids, err = client.GetIdentitiesByEmails(ctx, []string{"nobody@example.com"})
+	if err != nil || ids == nil || len(ids) != 0 {
+		t.Errorf("expected an empty, non-nil result, got %v, %v", ids, err)
+	}
+}
+
+func TestContacts_ActivityCreateAndTombstone(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := client.ensureIndexes(ctx); err != nil {
+		t.Fatalf("ensureIndexes failed: %v", err)
+	}
+	seen := func(index string, at time.Time, sent bool) {
+		t.Helper()
+		ct := &Contact{OwnerPubKey: "owner", EmailIndex: index, EmailEnc: "enc-" + index, Prefixes: []string{"p-" + index}, LastSeen: at}
+		if err := client.RecordContactActivity(ctx, ct, sent); err != nil {
+			t.Fatalf("RecordContactActivity failed: %v", err)
+		}
+	}
+	now := time.Now().Truncate(time.Millisecond)
+	seen("alice", now.Add(-time.Hour), true)
+	seen("alice", now, false)
+	seen("alice", now.Add(-2*time.Hour), true)
+	seen("bob", now.Add(-time.Minute), false)
+
+	contacts, err := client.GetContacts(ctx, "owner", "", 10)
+	if err != nil {
+		t.Fatalf("GetContacts failed: %v", err)
+	}
+	if len(contacts) != 2 || contacts[0].EmailIndex != "alice" || contacts[1].EmailIndex != "bob" {
+		t.Fatalf("want alice then bob, got %+v", contacts)
+	}
+	alice := contacts[0]
+	if alice.Source != ContactAuto || alice.SentCount != 2 || alice.ReceivedCount != 1 || !alice.LastSeen.Equal(now) {
+		t.Errorf("unexpected auto contact %+v", alice)
+	}
+	if found, _ := client.GetContacts(ctx, "owner", "p-bob", 10); len(found) != 1 || found[0].EmailIndex != "bob" {
+		t.Errorf("prefix search: want bob, got %+v", found)
+	}
+
+	// Creating a known address takes the automatic contact over.
+	created := &Contact{OwnerPubKey: "owner", EmailIndex: "alice", EmailEnc: "enc-alice", NameEnc: "enc-name"}
+	if err := client.CreateContact(ctx, created); err != nil {
+		t.Fatalf("CreateContact failed: %v", err)
+	}
+	if created.ID != alice.ID || created.Source != ContactUser || created.SentCount != 2 {
+		t.Errorf("want the automatic contact taken over, got %+v", created)
+	}
+	if err := client.CreateContact(ctx, &Contact{OwnerPubKey: "owner", EmailIndex: "alice"}); err != ErrDuplicate {
+		t.Errorf("second create: want ErrDuplicate, got %v", err)
+	}
+	if err := client.UpdateContact(ctx, "owner", alice.ID.Hex(), &Contact{EmailIndex: "bob"}); err != ErrDuplicate {
+		t.Errorf("update to a taken address: want ErrDuplicate, got %v", err)
+	}
+
+	// Deleted contacts stay deleted when mail activity sees them again.
+	if err := client.DeleteContact(ctx, "owner", contacts[1].ID.Hex()); err != nil {
+		t.Fatalf("DeleteContact failed: %v", err)
+	}
+	if err := client.DeleteContact(ctx, "owner", contacts[1].ID.Hex()); err != ErrNotFound {
+		t.Errorf("second delete: want ErrNotFound, got %v", err)
+	}
+	seen("bob", now, false)
+	if found, _ := client.GetContacts(ctx, "owner", "", 10); len(found) != 1 || found[0].EmailIndex != "alice" {
+		t.Errorf("deleted contact came back: %+v", found)
+	}
+
+	// ... until the owner adds them again.
+	bob := &Contact{OwnerPubKey: "owner", EmailIndex: "bob", EmailEnc: "enc-bob"}
+	if err := client.CreateContact(ctx, bob); err != nil || bob.ID != contacts[1].ID || bob.Source != ContactUser {
+		t.Errorf("re-create deleted contact: err=%v contact=%+v", err, bob)
+	}
+}
+
+func TestErasure_ChallengeConfirmAndDelete(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	if client == nil {
+		return
+	}
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now()
+	client.CreateIdentity(ctx, &Identity{Email: "me@example.com", PubKey: "owner", Verified: true})
+	client.CreateMailAccount(ctx, &MailAccount{OwnerPubKey: "owner", AccountEmail: "me@example.com"})
+	client.CreateSentMessage(ctx, &SentMessage{OwnerPubKey: "owner", MessageID: "<1@x>"})
+	client.CreateSentMessage(ctx, &SentMessage{OwnerPubKey: "other", MessageID: "<2@x>"})
+
+	stale := &ErasureJob{OwnerPubKey: "owner", ChallengeHash: "old", ChallengeExpiresAt: now.Add(time.Minute)}
+	if err := client.CreateErasureChallenge(ctx, stale); err != nil {
+		t.Fatalf("CreateErasureChallenge failed: %v", err)
+	}
+	fresh := &ErasureJob{OwnerPubKey: "owner", ChallengeHash: "new", ChallengeExpiresAt: now.Add(time.Minute)}
+	if err := client.CreateErasureChallenge(ctx, fresh); err != nil {
+		t.Fatalf("CreateErasureChallenge failed: %v", err)
+	}
+	if fresh.ID != stale.ID || fresh.Status != ErasureChallenged {
+		t.Errorf("a new challenge should replace the unconfirmed one: %+v, %+v", stale, fresh)
+	}
+	if _, err := client.ConfirmErasureJob(ctx, "owner", "old", now); err != ErrNotFound {
+		t.Errorf("superseded challenge: want ErrNotFound, got %v", err)
+	}
+	if _, err := client.ConfirmErasureJob(ctx, "owner", "new", now.Add(2*time.Minute)); err != ErrNotFound {
+		t.Errorf("expired challenge: want ErrNotFound, got %v", err)
+	}
+	job, err := client.ConfirmErasureJob(ctx, "owner", "new", now)
+	if err != nil || job.Status != ErasurePending || job.ChallengeHash != "" {
+		t.Fatalf("ConfirmErasureJob: %+v, %v", job, err)
+	}
+
+	claimed, err := client.ClaimErasureJob(ctx, now, now.Add(-time.Minute), "w1")
+	if err != nil || claimed.ID != job.ID || claimed.Attempts != 1 {
+		t.Fatalf("ClaimErasureJob: %+v, %v", claimed, err)
+	}
+	counts, err := client.CountOwnerData(ctx, "owner")
+	if err != nil || counts["mail_accounts"] != 1 || counts["sent_messages"] != 1 {
+		t.Errorf("CountOwnerData: %v, %v", counts, err)
+	}
+	if n, err := client.DeleteOwnerData(ctx, "owner", "sent_messages"); err != nil || n != 1 {
+		t.Errorf("DeleteOwnerData: deleted %d, %v", n, err)
+	}
+	if _, err := client.DeleteOwnerData(ctx, "owner", "payments"); err == nil {
+		t.Error("DeleteOwnerData should refuse collections outside OwnerCollections")
+	}
+	if n, err := client.RevokeIdentities(ctx, "owner", now); err != nil || n != 1 {
+		t.Errorf("RevokeIdentities: revoked %d, %v", n, err)
+	}
+	if n, _ := client.RevokeIdentities(ctx, "owner", now); n != 0 {
+		t.Errorf("RevokeIdentities again: want 0, got %d", n)
+	}
+
+	claimed.Status, claimed.Steps = ErasureDone, []ErasureStep{{Name: "sent_messages", Done: true, Deleted: 1}}
+	if err := client.UpdateErasureJob(ctx, claimed); err != nil {
+		t.Fatalf("UpdateErasureJob failed: %v", err)
+	}
+	if err := client.UpdateErasureJob(ctx, claimed); err != ErrNotFound {
+		t.Errorf("update after finishing: want ErrNotFound, got %v", err)
+	}
+	got, err := client.GetErasureJob(ctx, "owner", job.ID.Hex())
+	if err != nil || got.Status != ErasureDone || len(got.Steps) != 1 {
+		t.Errorf("GetErasureJob: %+v, %v", got, err)
+	}
+
+	client.CreateAuditEvent(ctx, &AuditEvent{OwnerPubKey: "owner", Action: "first"})
+	client.CreateAuditEvent(ctx, &AuditEvent{OwnerPubKey: "owner", Action: "second"})
+	events, err := client.GetAuditEvents(ctx, "owner", 1)
+	if err != nil || len(events) != 1 || events[0].Action != "second" {
+		t.Errorf("GetAuditEvents: %+v, %v", events, err)
+	}
+}
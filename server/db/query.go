@@ -0,0 +1,84 @@
+package db
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Page selects a window of a sorted result: up to Limit documents after
+// skipping Offset.  A zero Limit means no limit; negative values count as
+// zero.
+type Page struct {
+	Offset int
+	Limit  int
+}
+
+// findOptions returns options applying p to a query sorted by sort.
+func (p Page) findOptions(sort bson.D) *options.FindOptions {
+	opts := options.Find().SetSort(sort)
+	if p.Offset > 0 {
+		opts.SetSkip(int64(p.Offset))
+	}
+	if p.Limit > 0 {
+		opts.SetLimit(int64(p.Limit))
+	}
+	return opts
+}
+
+// MailAccountQuery selects mail accounts for FindMailAccounts.  Each set
+// field narrows the result, so the zero query matches every account.
+type MailAccountQuery struct {
+	Owner string // owner pubkey
+	Email string // account email, exactly as stored
+	Page  Page   // applied to the accounts oldest first
+}
+
+// filter returns the MongoDB filter matching q.
+func (q MailAccountQuery) filter() bson.M {
+	filter := bson.M{}
+	if q.Owner != "" {
+		filter["owner_pubkey"] = q.Owner
+	}
+	if q.Email != "" {
+		filter["account_email"] = q.Email
+	}
+	return filter
+}
+
+// mailAccountOrder sorts mail accounts oldest first, so that pages are
+// stable while accounts are added.
+var mailAccountOrder = bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}
+
+// StaleMessageQuery selects cached previews for FindStaleCachedMessages:
+// those an inbox fetch found vanished from the server, and those no fetch
+// has seen since SeenBefore.  Owner and Account narrow the result when set,
+// and After resumes a scan past the preview with that id.
+type StaleMessageQuery struct {
+	Owner      string
+	Account    string
+	SeenBefore time.Time
+	After      primitive.ObjectID
+	Limit      int // 0 means no limit
+}
+
+// filter returns the MongoDB filter matching q.
+func (q StaleMessageQuery) filter() bson.M {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"vanished_at": bson.M{"$exists": true}},
+		bson.M{"last_seen_at": bson.M{"$lt": q.SeenBefore}},
+		bson.M{"last_seen_at": bson.M{"$exists": false}, "cached_at": bson.M{"$lt": q.SeenBefore}},
+	}}
+	if q.Owner != "" {
+		filter["owner_pubkey"] = q.Owner
+	}
+	if q.Account != "" {
+		filter["account_email"] = q.Account
+	}
+	if !q.After.IsZero() {
+		filter["_id"] = bson.M{"$gt": q.After}
+	}
+	return filter
+}
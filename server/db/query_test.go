@@ -0,0 +1,50 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMailAccountQuery_Filter(t *testing.T) {
+	tests := []struct {
+		name string
+		q    MailAccountQuery
+		want bson.M
+	}{
+		{"zero", MailAccountQuery{}, bson.M{}},
+		{"owner", MailAccountQuery{Owner: "pk"}, bson.M{"owner_pubkey": "pk"}},
+		{"email", MailAccountQuery{Email: "a@example.com"}, bson.M{"account_email": "a@example.com"}},
+		{"owner and email", MailAccountQuery{Owner: "pk", Email: "a@example.com"}, bson.M{"owner_pubkey": "pk", "account_email": "a@example.com"}},
+		{"page only", MailAccountQuery{Page: Page{Offset: 5, Limit: 10}}, bson.M{}},
+	}
+	for _, tt := range tests {
+		if got := tt.q.filter(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestPage_FindOptions(t *testing.T) {
+	int64p := func(n int64) *int64 { return &n }
+	tests := []struct {
+		page        Page
+		skip, limit *int64
+	}{
+		{Page{}, nil, nil},
+		{Page{Limit: 10}, nil, int64p(10)},
+		{Page{Offset: 20}, int64p(20), nil},
+		{Page{Offset: 20, Limit: 10}, int64p(20), int64p(10)},
+		{Page{Offset: -1, Limit: -1}, nil, nil},
+	}
+	for _, tt := range tests {
+		opts := tt.page.findOptions(mailAccountOrder)
+		if !reflect.DeepEqual(opts.Skip, tt.skip) || !reflect.DeepEqual(opts.Limit, tt.limit) {
+			t.Errorf("%+v: want skip %v limit %v, got %v, %v", tt.page, tt.skip, tt.limit, opts.Skip, opts.Limit)
+		}
+		if !reflect.DeepEqual(opts.Sort, mailAccountOrder) {
+			t.Errorf("%+v: want sorted by %v, got %v", tt.page, mailAccountOrder, opts.Sort)
+		}
+	}
+}
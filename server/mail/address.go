@@ -0,0 +1,174 @@
+package mail
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Address is a mailbox with an optional display name.
+type Address struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+// header renders a as an address header value: the bare address when there is no
+// display name, otherwise `Name <addr>` with the name quoted or RFC 2047
+// encoded as needed.  CR/LF in the name are flattened first.
+func (a Address) header() string {
+	name := strings.TrimSpace(headerValue(a.Name))
+	if name == "" {
+		return headerValue(a.Email)
+	}
+	return (&netmail.Address{Name: name, Address: headerValue(a.Email)}).String()
+}
+
+// addressList renders addrs as a comma-separated header value.
+func addressList(addrs []Address) string {
+	parts := make([]string, len(addrs))
+	for i, a := range addrs {
+		parts[i] = a.header()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Emails returns the bare addresses of addrs.
+func Emails(addrs []Address) []string {
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.Email
+	}
+	return out
+}
+
+// AddressError is returned when an address is unsafe to place in an SMTP
+// envelope or a message header.
+type AddressError struct {
+	Address string
+	Reason  string
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("invalid address %q: %s", e.Address, e.Reason)
+}
+
+// ValidateAddress reports whether addr is a bare RFC 5322 addr-spec
+// (local@domain) with nothing that could terminate an SMTP command or start
+// a new header.  Display-name forms are rejected; callers wanting one must
+// format it separately.  Internationalised addresses (RFC 6531) are
+// accepted: a UTF-8 local part, and a domain in Unicode or ASCII (xn--)
+// form that is a valid IDN.
+func ValidateAddress(addr string) error {
+	if addr == "" {
+		return &AddressError{Address: addr, Reason: "empty"}
+	}
+	if !utf8.ValidString(addr) {
+		return &AddressError{Address: addr, Reason: "not valid UTF-8"}
+	}
+	for _, r := range addr {
+		if r < 0x20 || r == 0x7f {
+			return &AddressError{Address: addr, Reason: "contains control characters"}
+		}
+	}
+	if strings.ContainsAny(addr, "<> ") {
+		return &AddressError{Address: addr, Reason: "contains forbidden characters"}
+	}
+	parsed, err := netmail.ParseAddress(addr)
+	if err != nil {
+		return &AddressError{Address: addr, Reason: err.Error()}
+	}
+	if parsed.Name != "" || parsed.Address != addr {
+		return &AddressError{Address: addr, Reason: "not a bare address"}
+	}
+	if _, domain := splitAddress(addr); isIDN(domain) {
+		if _, err := idna.Lookup.ToASCII(domain); err != nil {
+			return &AddressError{Address: addr, Reason: "invalid internationalised domain: " + err.Error()}
+		}
+	}
+	return nil
+}
+
+// NormalizeAddress validates addr and returns it with an internationalised
+// domain in the Unicode form IDNA lookup maps it to, lower-cased and NFC
+// normalised, so the Unicode and ASCII (xn--) spellings of an address are
+// stored alike.  The local part, and an ASCII domain, are kept as given.
+func NormalizeAddress(addr string) (string, error) {
+	if err := ValidateAddress(addr); err != nil {
+		return "", err
+	}
+	local, domain := splitAddress(addr)
+	return local + "@" + unicodeDomain(domain), nil
+}
+
+// ToASCII returns addr with its domain in ASCII (A-label) form, as it must
+// travel to a server without SMTPUTF8: 用户@例え.jp has none, but
+// user@例え.jp becomes user@xn--r8jz45g.jp.  A non-ASCII local part has no
+// ASCII form, so it is an *AddressError.
+func ToASCII(addr string) (string, error) {
+	local, domain := splitAddress(addr)
+	if !isASCII(local) {
+		return "", &AddressError{Address: addr, Reason: "non-ASCII local part needs a server with SMTPUTF8"}
+	}
+	ascii, err := asciiDomain(domain)
+	if err != nil {
+		return "", &AddressError{Address: addr, Reason: "invalid internationalised domain: " + err.Error()}
+	}
+	return local + "@" + ascii, nil
+}
+
+// splitAddress splits addr at its last "@"; domain is empty when there is
+// none.
+func splitAddress(addr string) (local, domain string) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, ""
+	}
+	return addr[:at], addr[at+1:]
+}
+
+// isIDN reports whether domain is internationalised: it has non-ASCII
+// characters or an xn-- label.
+func isIDN(domain string) bool {
+	if !isASCII(domain) {
+		return true
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) >= 4 && strings.EqualFold(label[:4], "xn--") {
+			return true
+		}
+	}
+	return false
+}
+
+// asciiDomain returns domain in ASCII (A-label) form.  Domains that are
+// not internationalised are returned as they are.
+func asciiDomain(domain string) (string, error) {
+	if !isIDN(domain) {
+		return domain, nil
+	}
+	return idna.Lookup.ToASCII(domain)
+}
+
+// unicodeDomain returns an internationalised domain in Unicode (U-label)
+// form, and any other domain, or one that is not a valid IDN, as it is.
+func unicodeDomain(domain string) string {
+	if !isIDN(domain) {
+		return domain
+	}
+	if u, err := idna.Lookup.ToUnicode(domain); err == nil {
+		return u
+	}
+	return domain
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
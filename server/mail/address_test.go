@@ -0,0 +1,132 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateAddress(t *testing.T) {
+	valid := []string{
+		"alice@example.com", "first.last+tag@sub.example.org",
+		"用户@例え.jp", "user@例え.jp", "用户@xn--r8jz45g.jp", "josé@bücher.de",
+	}
+	for _, a := range valid {
+		if err := ValidateAddress(a); err != nil {
+			t.Errorf("ValidateAddress(%q): unexpected error %v", a, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"alice@example.com>\r\nRCPT TO:<evil@example.net",
+		"alice@example.com\nBcc: evil@example.net",
+		"alice@example.com> SIZE=1",
+		"<alice@example.com>",
+		"Alice <alice@example.com>",
+		"alice@example.com\x00",
+		"not an address",
+		"alice@xn--zz.com",   // not punycode
+		"alice@bü-.de",       // hyphen ending a label
+		"alice@\xff.example", // not UTF-8
+		"用户@例え.jp\u2028",     // Unicode line separator
+	}
+	for _, a := range invalid {
+		err := ValidateAddress(a)
+		var addrErr *AddressError
+		if !errors.As(err, &addrErr) {
+			t.Errorf("ValidateAddress(%q): want *AddressError, got %v", a, err)
+		}
+	}
+}
+
+func TestIDNA(t *testing.T) {
+	tests := []struct {
+		addr    string
+		ascii   string // ToASCII, or "" when there is no ASCII form
+		unicode string // NormalizeAddress
+	}{
+		{"alice@example.com", "alice@example.com", "alice@example.com"},
+		{"Alice@EXAMPLE.com", "Alice@EXAMPLE.com", "Alice@EXAMPLE.com"},
+		{"user@例え.jp", "user@xn--r8jz45g.jp", "user@例え.jp"},
+		{"user@xn--r8jz45g.jp", "user@xn--r8jz45g.jp", "user@例え.jp"},
+		{"user@XN--R8JZ45G.JP", "user@xn--r8jz45g.jp", "user@例え.jp"},
+		{"josé@Bücher.DE", "", "josé@bücher.de"},
+		{"jose@Bücher.DE", "jose@xn--bcher-kva.de", "jose@bücher.de"},
+		{"mail@faß.de", "mail@xn--fa-hia.de", "mail@faß.de"},
+		{"用户@例え.jp", "", "用户@例え.jp"},
+	}
+	for _, tt := range tests {
+		ascii, err := ToASCII(tt.addr)
+		if tt.ascii == "" {
+			var addrErr *AddressError
+			if !errors.As(err, &addrErr) {
+				t.Errorf("ToASCII(%q): want *AddressError, got %q, %v", tt.addr, ascii, err)
+			}
+		} else if err != nil || ascii != tt.ascii {
+			t.Errorf("ToASCII(%q): want %q, got %q, %v", tt.addr, tt.ascii, ascii, err)
+		}
+		unicode, err := NormalizeAddress(tt.addr)
+		if err != nil || unicode != tt.unicode {
+			t.Errorf("NormalizeAddress(%q): want %q, got %q, %v", tt.addr, tt.unicode, unicode, err)
+		}
+		// Either form normalises to the same address.
+		if ascii != "" {
+			if back, err := NormalizeAddress(ascii); err != nil || !strings.EqualFold(back, tt.unicode) {
+				t.Errorf("round trip of %q through %q: want %q, got %q, %v", tt.addr, ascii, tt.unicode, back, err)
+			}
+		}
+	}
+	if _, err := NormalizeAddress("alice@xn--zz.com"); err == nil {
+		t.Error("NormalizeAddress must reject an invalid IDN")
+	}
+}
+
+func TestSMTPSend_RejectsUnsafeFrom(t *testing.T) {
+	c := &SMTPClient{} // no connection: any write would panic
+	_, err := c.Send(context.Background(), SendRequest{
+		From: "me@example.com>\r\nRCPT TO:<evil@example.net",
+		To:   []Address{{Email: "you@example.org"}},
+	})
+	var addrErr *AddressError
+	if !errors.As(err, &addrErr) {
+		t.Fatalf("want *AddressError, got %v", err)
+	}
+}
+
+func TestBuildMessage_DisplayNames(t *testing.T) {
+	msg := buildMessage(SendRequest{
+		From:     "alice@example.com",
+		FromName: "Alice Johnson",
+		To:       []Address{{Email: "bob@example.org", Name: "Smith, Bob"}, {Email: "carol@example.org"}},
+		Cc:       []Address{{Email: "zoe@example.org", Name: "Zoë"}},
+		Bcc:      []Address{{Email: "hidden@example.org", Name: "Hidden"}},
+	}, "<id@example.com>", time.Unix(0, 0))
+
+	for _, want := range []string{
+		"From: \"Alice Johnson\" <alice@example.com>\r\n",
+		"To: \"Smith, Bob\" <bob@example.org>, carol@example.org\r\n",
+		"Cc: =?utf-8?q?Zo=C3=AB?= <zoe@example.org>\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("missing header %q in:\n%s", want, msg)
+		}
+	}
+	if strings.Contains(msg, "Hidden") {
+		t.Error("Bcc display name must not appear in the message")
+	}
+}
+
+func TestSendRequestRecipients_BareAddresses(t *testing.T) {
+	req := SendRequest{
+		To:  []Address{{Email: "a@example.org", Name: "A"}},
+		Cc:  []Address{{Email: "b@example.org", Name: "B"}},
+		Bcc: []Address{{Email: "c@example.org", Name: "C"}},
+	}
+	got := strings.Join(req.Recipients(), ",")
+	if got != "a@example.org,b@example.org,c@example.org" {
+		t.Errorf("unexpected recipients %q", got)
+	}
+}
@@ -0,0 +1,77 @@
+package mail
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CanonicalRule says how the local part of a domain's addresses is
+// canonicalised.
+type CanonicalRule struct {
+	StripPlus bool // drop a "+tag" sub-address: alice+invoices -> alice
+	StripDots bool // drop dots, which the provider ignores: a.lice -> alice
+}
+
+// CanonicalRules maps lower-case domains to their rules.  A nil
+// CanonicalRules only lower-cases addresses.
+type CanonicalRules map[string]CanonicalRule
+
+// ParseCanonicalRules reads spec, a comma-separated list of
+// domain:rule[:rule] entries where each rule is "plus" or "dots", as in
+// "gmail.com:plus:dots,example.com:plus".  An empty spec yields no rules.
+func ParseCanonicalRules(spec string) (CanonicalRules, error) {
+	rules := CanonicalRules{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		domain := unicodeDomain(strings.ToLower(parts[0]))
+		if domain == "" || len(parts) < 2 {
+			return nil, fmt.Errorf("canonical rules: %q is not domain:rule[:rule]", entry)
+		}
+		if _, dup := rules[domain]; dup {
+			return nil, fmt.Errorf("canonical rules: domain %s is listed more than once", domain)
+		}
+		var rule CanonicalRule
+		for _, name := range parts[1:] {
+			switch name {
+			case "plus":
+				rule.StripPlus = true
+			case "dots":
+				rule.StripDots = true
+			default:
+				return nil, fmt.Errorf("canonical rules: %s: unknown rule %q (want plus or dots)", domain, name)
+			}
+		}
+		rules[domain] = rule
+	}
+	return rules, nil
+}
+
+// Canonical returns the form of addr that every address delivering to the
+// same mailbox shares: trimmed and lower-cased, an internationalised domain
+// in Unicode form whichever way it was spelled, with the rules of its
+// domain applied to the local part.  A rule that would leave the local
+// part empty is not applied.
+func (r CanonicalRules) Canonical(addr string) string {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	local, domain := addr[:at], unicodeDomain(addr[at+1:])
+	rule := r[domain]
+	if rule.StripPlus {
+		if tagless, _, _ := strings.Cut(local, "+"); tagless != "" {
+			local = tagless
+		}
+	}
+	if rule.StripDots {
+		if dotless := strings.ReplaceAll(local, ".", ""); dotless != "" {
+			local = dotless
+		}
+	}
+	return local + "@" + domain
+}
@@ -0,0 +1,44 @@
+package mail
+
+import "testing"
+
+func TestCanonicalRules_Canonical(t *testing.T) {
+	rules, err := ParseCanonicalRules("gmail.com:plus:dots, Example.com:plus")
+	if err != nil {
+		t.Fatalf("ParseCanonicalRules failed: %v", err)
+	}
+	tests := []struct{ addr, want string }{
+		{"alice@example.com", "alice@example.com"},
+		{" Alice+Invoices@EXAMPLE.com ", "alice@example.com"},
+		{"a.lice+invoices@example.com", "a.lice@example.com"},
+		{"A.Lice+news@gmail.com", "alice@gmail.com"},
+		{"alice+tag@example.org", "alice+tag@example.org"}, // no rules for the domain
+		{"+tag@example.com", "+tag@example.com"},           // nothing left to keep
+		{"...@gmail.com", "...@gmail.com"},
+		{"not-an-address", "not-an-address"},
+		{"Alice@Bücher.de", "alice@bücher.de"},
+		{"alice@XN--BCHER-KVA.de", "alice@bücher.de"}, // either form of the domain
+	}
+	for _, tt := range tests {
+		if got := rules.Canonical(tt.addr); got != tt.want {
+			t.Errorf("Canonical(%q): want %q, got %q", tt.addr, tt.want, got)
+		}
+	}
+	if got := CanonicalRules(nil).Canonical("Alice+x@Gmail.com"); got != "alice+x@gmail.com" {
+		t.Errorf("no rules: want only lower-casing, got %q", got)
+	}
+}
+
+func TestParseCanonicalRules_Invalid(t *testing.T) {
+	for _, spec := range []string{"gmail.com", ":plus", "gmail.com:case", "gmail.com:plus,GMAIL.com:dots"} {
+		if _, err := ParseCanonicalRules(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+	if rules, err := ParseCanonicalRules("xn--bcher-kva.de:plus"); err != nil || rules.Canonical("a+x@bücher.de") != "a@bücher.de" {
+		t.Errorf("A-label rule: want it applied to the U-label domain, got %v, %v", rules, err)
+	}
+	if rules, err := ParseCanonicalRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("empty spec: want no rules, got %v, %v", rules, err)
+	}
+}
@@ -0,0 +1,221 @@
+package mail
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Attachment is a file sent with a message.  An inline attachment is an
+// image the HTML body shows where it refers to cid:ContentID; it travels
+// with the body in a multipart/related part (RFC 2387) instead of being
+// offered for download.
+type Attachment struct {
+	Filename    string
+	ContentType string // defaults to application/octet-stream
+	Data        []byte
+	Inline      bool
+	ContentID   string // without angle brackets; required when Inline
+}
+
+// ValidateAttachments checks the attachments of a message whose HTML body
+// is htmlBody: content types must parse, names must be single-line, and
+// every inline attachment needs an HTML body and a Content-ID of its own.
+// Whether the HTML refers to images it does not carry is MissingContentIDs'
+// business.
+func ValidateAttachments(htmlBody string, atts []Attachment) error {
+	seen := make(map[string]bool)
+	for i, a := range atts {
+		if a.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(a.ContentType); err != nil {
+				return fmt.Errorf("attachment %d: content type %q: %w", i, a.ContentType, err)
+			}
+			if strings.HasPrefix(strings.ToLower(a.ContentType), "multipart/") {
+				return fmt.Errorf("attachment %d: content type must not be multipart", i)
+			}
+		}
+		if strings.ContainsAny(a.Filename, "\r\n") {
+			return fmt.Errorf("attachment %d: filename must not contain line breaks", i)
+		}
+		if a.ContentID == "" {
+			if a.Inline {
+				return fmt.Errorf("attachment %d: an inline attachment needs a content_id", i)
+			}
+			continue
+		}
+		if strings.ContainsFunc(a.ContentID, func(r rune) bool { return r <= ' ' || r == '<' || r == '>' || r >= 0x7f }) {
+			return fmt.Errorf("attachment %d: content_id %q must be printable ASCII without spaces or angle brackets", i, a.ContentID)
+		}
+		if seen[a.ContentID] {
+			return fmt.Errorf("attachment %d: duplicate content_id %q", i, a.ContentID)
+		}
+		seen[a.ContentID] = true
+		if a.Inline && htmlBody == "" {
+			return errors.New("inline attachments need an HTML body")
+		}
+	}
+	return nil
+}
+
+// ContentIDs returns the Content-IDs htmlBody's images refer to with cid:
+// URLs, each once, in order of appearance.
+func ContentIDs(htmlBody string) []string {
+	var cids []string
+	z := html.NewTokenizer(strings.NewReader(htmlBody))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return cids
+		case html.StartTagToken, html.SelfClosingTagToken:
+			for _, a := range z.Token().Attr {
+				if a.Key != "src" && a.Key != "background" {
+					continue
+				}
+				scheme, rest, ok := strings.Cut(strings.TrimSpace(a.Val), ":")
+				if !ok || !strings.EqualFold(scheme, "cid") {
+					continue
+				}
+				if cid, err := url.PathUnescape(rest); err == nil {
+					rest = cid
+				}
+				if rest != "" && !slices.Contains(cids, rest) {
+					cids = append(cids, rest)
+				}
+			}
+		}
+	}
+}
+
+// MissingContentIDs returns the Content-IDs htmlBody refers to for which
+// atts has no inline attachment.  A recipient's client would show those
+// images as broken.
+func MissingContentIDs(htmlBody string, atts []Attachment) []string {
+	var missing []string
+	for _, cid := range ContentIDs(htmlBody) {
+		if !slices.ContainsFunc(atts, func(a Attachment) bool { return a.Inline && a.ContentID == cid }) {
+			missing = append(missing, cid)
+		}
+	}
+	return missing
+}
+
+// entity is a MIME entity as buildMessage writes it: its Content-* header
+// lines, each ending in CRLF, and its body, without a final line break.
+type entity struct {
+	header string
+	body   string
+}
+
+// bodyEntity returns the MIME body of req.  A plain-text message stays a
+// single text/plain entity.  An HTML body makes it multipart/alternative,
+// inline attachments wrap that in multipart/related, and other attachments
+// wrap the lot in multipart/mixed.
+func bodyEntity(req SendRequest) entity {
+	e := entity{header: "Content-Type: text/plain; charset=UTF-8\r\n", body: req.Body}
+	if req.HTML != "" {
+		e = multipartEntity("alternative", "", e, entity{
+			header: "Content-Type: text/html; charset=UTF-8\r\nContent-Transfer-Encoding: quoted-printable\r\n",
+			body:   quotedPrintable(req.HTML),
+		})
+	}
+	var inline, attached []entity
+	for _, a := range req.Attachments {
+		if a.Inline {
+			inline = append(inline, attachmentEntity(a))
+		} else {
+			attached = append(attached, attachmentEntity(a))
+		}
+	}
+	if len(inline) > 0 {
+		// RFC 2387: type names the root part, the first one.
+		e = multipartEntity("related", "multipart/alternative", append([]entity{e}, inline...)...)
+	}
+	if len(attached) > 0 {
+		e = multipartEntity("mixed", "", append([]entity{e}, attached...)...)
+	}
+	return e
+}
+
+// multipartEntity returns a multipart/subtype entity holding parts, under
+// a boundary no part can contain.  rootType, when set, is the related
+// entity's type parameter.
+func multipartEntity(subtype, rootType string, parts ...entity) entity {
+	var rnd [12]byte
+	rand.Read(rnd[:]) //nolint:errcheck
+	boundary := "=_mulamail_" + hex.EncodeToString(rnd[:])
+	params := map[string]string{"boundary": boundary}
+	if rootType != "" {
+		params["type"] = rootType
+	}
+	var b strings.Builder
+	for _, p := range parts {
+		fmt.Fprintf(&b, "--%s\r\n%s\r\n%s\r\n", boundary, p.header, p.body)
+	}
+	fmt.Fprintf(&b, "--%s--", boundary)
+	return entity{
+		header: "Content-Type: " + mime.FormatMediaType("multipart/"+subtype, params) + "\r\n",
+		body:   b.String(),
+	}
+}
+
+// attachmentEntity returns a as a base64 entity, disposed inline or as an
+// attachment.
+func attachmentEntity(a Attachment) entity {
+	ctype := a.ContentType
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	disposition := "attachment"
+	if a.Inline {
+		disposition = "inline"
+	}
+	dispParams := map[string]string{}
+	if a.Filename != "" {
+		params["name"] = a.Filename
+		dispParams["filename"] = a.Filename
+	}
+	var h strings.Builder
+	fmt.Fprintf(&h, "Content-Type: %s\r\n", mime.FormatMediaType(mediaType, params))
+	fmt.Fprintf(&h, "Content-Disposition: %s\r\n", mime.FormatMediaType(disposition, dispParams))
+	h.WriteString("Content-Transfer-Encoding: base64\r\n")
+	if a.ContentID != "" {
+		fmt.Fprintf(&h, "Content-ID: <%s>\r\n", a.ContentID)
+	}
+	return entity{header: h.String(), body: base64Lines(a.Data)}
+}
+
+// base64Lines encodes data in base64 lines of 76 characters (RFC 2045).
+func base64Lines(data []byte) string {
+	enc := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for len(enc) > 76 {
+		b.WriteString(enc[:76])
+		b.WriteString("\r\n")
+		enc = enc[76:]
+	}
+	b.WriteString(enc)
+	return b.String()
+}
+
+// quotedPrintable encodes s so that no line exceeds the 998 characters
+// SMTP allows, as minified HTML easily would.
+func quotedPrintable(s string) string {
+	var b strings.Builder
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(s)) //nolint:errcheck
+	w.Close()          //nolint:errcheck
+	return b.String()
+}
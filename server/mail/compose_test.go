@@ -0,0 +1,190 @@
+package mail
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readMultipart parses a multipart body of Content-Type ctype, checking its
+// subtype, and returns its parts' headers and decoded bodies.
+func readMultipart(t *testing.T, ctype string, body io.Reader, subtype string) ([]multipart.Part, [][]byte) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		t.Fatalf("parse content type %q: %v", ctype, err)
+	}
+	if mediaType != "multipart/"+subtype {
+		t.Fatalf("want multipart/%s, got %s", subtype, mediaType)
+	}
+	var parts []multipart.Part
+	var bodies [][]byte
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts, bodies
+		}
+		if err != nil {
+			t.Fatalf("next part of multipart/%s: %v", subtype, err)
+		}
+		var r io.Reader = p
+		switch p.Header.Get("Content-Transfer-Encoding") {
+		case "base64":
+			r = base64.NewDecoder(base64.StdEncoding, p)
+		case "quoted-printable":
+			r = quotedprintable.NewReader(p)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		parts = append(parts, *p)
+		bodies = append(bodies, data)
+	}
+}
+
+func TestBuildMessage_InlineImages(t *testing.T) {
+	logo := []byte("\x89PNG\r\n\x1a\nlogo")
+	html := `<p>Hi</p><img src="cid:logo@example.com"><table background="CID:bg"></table>` + strings.Repeat("x", 2000)
+	req := SendRequest{
+		From: "a@example.com", To: []Address{{Email: "b@example.com"}}, Subject: "s",
+		Body: "Hi", HTML: html,
+		Attachments: []Attachment{
+			{Filename: "logo.png", ContentType: "image/png", Data: logo, Inline: true, ContentID: "logo@example.com"},
+			{Filename: "bg.gif", ContentType: "image/gif", Data: []byte("GIF89a"), Inline: true, ContentID: "bg"},
+			{Filename: "résumé.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4\n")},
+		},
+	}
+	raw := buildMessage(req, "<id@example.com>", time.Now())
+	for _, line := range strings.Split(raw, "\r\n") {
+		if len(line) > 998 {
+			t.Fatalf("line of %d characters", len(line))
+		}
+	}
+
+	msg, err := netmail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	mixed, mixedBodies := readMultipart(t, msg.Header.Get("Content-Type"), msg.Body, "mixed")
+	if len(mixed) != 2 {
+		t.Fatalf("multipart/mixed: want 2 parts, got %d", len(mixed))
+	}
+	if d, params, _ := mime.ParseMediaType(mixed[1].Header.Get("Content-Disposition")); d != "attachment" || params["filename"] != "résumé.pdf" {
+		t.Errorf("attachment disposition %q: %v", d, params)
+	}
+	if string(mixedBodies[1]) != "%PDF-1.4\n" {
+		t.Errorf("attachment body %q", mixedBodies[1])
+	}
+
+	relatedType := mixed[0].Header.Get("Content-Type")
+	if _, params, _ := mime.ParseMediaType(relatedType); params["type"] != "multipart/alternative" {
+		t.Errorf("multipart/related type parameter: %q", relatedType)
+	}
+	related, relatedBodies := readMultipart(t, relatedType, strings.NewReader(string(mixedBodies[0])), "related")
+	if len(related) != 3 {
+		t.Fatalf("multipart/related: want 3 parts, got %d", len(related))
+	}
+	for i, want := range []struct {
+		cid  string
+		data []byte
+	}{{"<logo@example.com>", logo}, {"<bg>", []byte("GIF89a")}} {
+		p := related[i+1]
+		if got := p.Header.Get("Content-ID"); got != want.cid {
+			t.Errorf("inline part %d: Content-ID %q, want %q", i, got, want.cid)
+		}
+		if d, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition")); d != "inline" {
+			t.Errorf("inline part %d: disposition %q", i, d)
+		}
+		if string(relatedBodies[i+1]) != string(want.data) {
+			t.Errorf("inline part %d: body %q", i, relatedBodies[i+1])
+		}
+	}
+
+	alternative, altBodies := readMultipart(t, related[0].Header.Get("Content-Type"), strings.NewReader(string(relatedBodies[0])), "alternative")
+	if len(alternative) != 2 {
+		t.Fatalf("multipart/alternative: want 2 parts, got %d", len(alternative))
+	}
+	if ct := alternative[0].Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") || string(altBodies[0]) != "Hi" {
+		t.Errorf("plain part %q: %q", ct, altBodies[0])
+	}
+	if ct := alternative[1].Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") || string(altBodies[1]) != html {
+		t.Errorf("html part %q does not round-trip", ct)
+	}
+}
+
+func TestBuildMessage_Shapes(t *testing.T) {
+	base := SendRequest{From: "a@example.com", To: []Address{{Email: "b@example.com"}}, Body: "Hi"}
+
+	plain := buildMessage(base, "<id@example.com>", time.Now())
+	if !strings.Contains(plain, "Content-Type: text/plain; charset=UTF-8\r\n\r\nHi\r\n") {
+		t.Errorf("a plain message must stay a single text/plain part:\n%s", plain)
+	}
+
+	htmlOnly := base
+	htmlOnly.HTML = "<p>Hi</p>"
+	msg, err := netmail.ReadMessage(strings.NewReader(buildMessage(htmlOnly, "<id@example.com>", time.Now())))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	readMultipart(t, msg.Header.Get("Content-Type"), msg.Body, "alternative")
+
+	attached := base
+	attached.Attachments = []Attachment{{Filename: "a.txt", Data: []byte("data")}}
+	msg, err = netmail.ReadMessage(strings.NewReader(buildMessage(attached, "<id@example.com>", time.Now())))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	parts, _ := readMultipart(t, msg.Header.Get("Content-Type"), msg.Body, "mixed")
+	if ct := parts[1].Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/octet-stream") {
+		t.Errorf("default attachment type: %q", ct)
+	}
+}
+
+func TestMissingContentIDs(t *testing.T) {
+	html := `<img src="cid:a"><img src=" cid:b%40x "><img src="cid:a"><img src="https://example.com/c.png"><div background="cid:d"></div>`
+	if got := ContentIDs(html); !slices.Equal(got, []string{"a", "b@x", "d"}) {
+		t.Errorf("ContentIDs: %q", got)
+	}
+	atts := []Attachment{
+		{Inline: true, ContentID: "a"},
+		{ContentID: "d"}, // not inline: does not count
+	}
+	if got := MissingContentIDs(html, atts); !slices.Equal(got, []string{"b@x", "d"}) {
+		t.Errorf("MissingContentIDs: %q", got)
+	}
+}
+
+func TestValidateAttachments(t *testing.T) {
+	testCases := []struct {
+		name string
+		html string
+		atts []Attachment
+		ok   bool
+	}{
+		{"plain attachment", "", []Attachment{{Filename: "a.pdf", ContentType: "application/pdf"}}, true},
+		{"inline image", "<img src=cid:x>", []Attachment{{Inline: true, ContentID: "x", ContentType: "image/png"}}, true},
+		{"inline without html", "", []Attachment{{Inline: true, ContentID: "x"}}, false},
+		{"inline without content id", "<p>", []Attachment{{Inline: true}}, false},
+		{"duplicate content id", "<p>", []Attachment{{Inline: true, ContentID: "x"}, {Inline: true, ContentID: "x"}}, false},
+		{"bracketed content id", "<p>", []Attachment{{Inline: true, ContentID: "<x>"}}, false},
+		{"bad content type", "", []Attachment{{ContentType: "image/"}}, false},
+		{"multipart content type", "", []Attachment{{ContentType: "multipart/mixed; boundary=x"}}, false},
+		{"filename injection", "", []Attachment{{Filename: "a\r\nBcc: x@example.com"}}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateAttachments(tc.html, tc.atts); (err == nil) != tc.ok {
+				t.Errorf("want ok=%t, got %v", tc.ok, err)
+			}
+		})
+	}
+}
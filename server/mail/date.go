@@ -0,0 +1,68 @@
+package mail
+
+import (
+	netmail "net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fallbackDateLayouts covers Date headers that net/mail rejects but which
+// real-world clients still emit: asctime output, RFC 850, ISO 8601, and
+// zone-less timestamps.
+var fallbackDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.ANSIC,
+	time.UnixDate,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+}
+
+// ParseDate normalises a raw Date header into a time.Time.  It tries the
+// RFC 5322 grammar first (which also accepts the obsolete forms and trailing
+// zone comments such as "(IST)"), then a list of common malformed layouts.
+// ok is false when no layout matches.
+func ParseDate(raw string) (t time.Time, ok bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, false
+	}
+	if t, err := netmail.ParseDate(raw); err == nil {
+		return t, true
+	}
+
+	// Drop a trailing comment and collapse runs of whitespace before
+	// trying the fallback layouts.
+	if i := strings.LastIndex(raw, "("); i > 0 && strings.HasSuffix(raw, ")") {
+		raw = strings.TrimSpace(raw[:i])
+	}
+	raw = strings.Join(strings.Fields(raw), " ")
+	for _, layout := range fallbackDateLayouts {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// SortNewestFirst orders previews by their parsed Date, newest first.
+// Messages with equal or unparseable dates fall back to POP3 index order
+// (highest index first); unparseable dates sort after every parsed one.
+func SortNewestFirst(msgs []*Message) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		a, b := msgs[i], msgs[j]
+		aok, bok := !a.DateParsed.IsZero(), !b.DateParsed.IsZero()
+		if aok != bok {
+			return aok
+		}
+		if aok && !a.DateParsed.Equal(b.DateParsed) {
+			return a.DateParsed.After(b.DateParsed)
+		}
+		return a.ID > b.ID
+	})
+}
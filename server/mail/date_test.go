@@ -0,0 +1,64 @@
+package mail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	want := time.Date(2023, 10, 3, 8, 52, 1, 0, time.UTC)
+
+	testCases := []struct {
+		name string
+		raw  string
+	}{
+		{"RFC 1123Z", "Tue, 03 Oct 2023 14:22:01 +0530"},
+		{"single-digit day", "Tue, 3 Oct 2023 14:22:01 +0530"},
+		{"zone comment", "Tue, 3 Oct 2023 14:22:01 +0530 (IST)"},
+		{"no weekday", "3 Oct 2023 14:22:01 +0530"},
+		{"extra whitespace", "Tue,  3 Oct 2023   14:22:01 +0530"},
+		{"ISO 8601", "2023-10-03T14:22:01+05:30"},
+		{"RFC 850", "Tuesday, 03-Oct-23 08:52:01 UTC"},
+		{"asctime", "Tue Oct  3 08:52:01 2023"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := ParseDate(tc.raw)
+			if !ok {
+				t.Fatalf("ParseDate(%q) failed", tc.raw)
+			}
+			if !got.Equal(want) {
+				t.Errorf("ParseDate(%q): want %s, got %s", tc.raw, want, got.UTC())
+			}
+		})
+	}
+}
+
+func TestParseDate_Invalid(t *testing.T) {
+	for _, raw := range []string{"", "   ", "not a date", "32 Foo 2023"} {
+		if _, ok := ParseDate(raw); ok {
+			t.Errorf("ParseDate(%q): expected failure", raw)
+		}
+	}
+}
+
+func TestSortNewestFirst(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2023, 10, d, 0, 0, 0, 0, time.UTC) }
+	msgs := []*Message{
+		{ID: 1, DateParsed: day(2)},
+		{ID: 2},
+		{ID: 3, DateParsed: day(1)},
+		{ID: 4, DateParsed: day(2)},
+		{ID: 5},
+	}
+
+	SortNewestFirst(msgs)
+
+	want := []int{4, 1, 3, 5, 2}
+	for i, id := range want {
+		if msgs[i].ID != id {
+			t.Errorf("position %d: want id %d, got %d", i, id, msgs[i].ID)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package mail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// dedupKey derives the key DedupKey returns from a message's headers: its
+// Message-ID or, lacking one, a hash of the From, To, Cc, Date and Subject
+// headers as sent.  Two distinct messages without a Message-ID would need
+// the same sender, recipients, subject and Date to the second to collide;
+// without a Date as well there is too little to go on, and there is no key.
+func dedupKey(h map[string]string) string {
+	if id := strings.TrimSpace(h["message-id"]); id != "" {
+		return "id:" + id
+	}
+	if strings.TrimSpace(h["date"]) == "" {
+		return ""
+	}
+	sum := sha256.New()
+	for _, name := range []string{"from", "to", "cc", "date", "subject"} {
+		sum.Write([]byte(name + "\x00" + h[name] + "\x00")) //nolint:errcheck
+	}
+	return "hash:" + hex.EncodeToString(sum.Sum(nil))
+}
+
+// DedupKey identifies a message across the sequence numbers a server may
+// list it under, as some do (Gmail's "all mail" POP3 mode, for one).  It is
+// empty for a message listed without its headers or lacking both a
+// Message-ID and a Date: such a message is never taken for a duplicate.
+func (m *Message) DedupKey() string {
+	return m.dedupKey
+}
+
+// Dedup returns msgs with the duplicates of each message left out: of the
+// copies sharing a DedupKey the smallest is kept, the one listed first
+// among equals, where the first copy stood, and its Duplicates counts the
+// others.  Of msgs, only Duplicates fields are written.
+func Dedup(msgs []*Message) []*Message {
+	kept := make(map[string]int) // key -> index in out
+	out := make([]*Message, 0, len(msgs))
+	for _, m := range msgs {
+		key := m.DedupKey()
+		i, seen := kept[key]
+		if key == "" || !seen {
+			if key != "" {
+				kept[key] = len(out)
+			}
+			m.Duplicates = 0
+			out = append(out, m)
+			continue
+		}
+		survivor := out[i]
+		if m.Size < survivor.Size {
+			m.Duplicates, survivor.Duplicates = survivor.Duplicates, 0
+			out[i], survivor = m, m
+		}
+		survivor.Duplicates++
+	}
+	return out
+}
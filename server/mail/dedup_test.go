@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDedupKey(t *testing.T) {
+	const date = "Date: Mon, 2 Jan 2006 15:04:05 -0700\r\n"
+	key := func(headers string) string { return ParsePreview(1, headers+"\r\nbody").DedupKey() }
+
+	withID := key("From: a@example.com\r\nMessage-ID: <1@example.com>\r\n" + date)
+	if withID != key("Message-ID:  <1@example.com> \r\nSubject: other\r\n") {
+		t.Error("a Message-ID must identify the message whatever its other headers")
+	}
+	alert := "From: alerts@example.net\r\nTo: me@example.com\r\nSubject: Disk full\r\n"
+	if key(alert+date) != key("Subject: Disk full\r\n"+date+"From: alerts@example.net\r\nTo: me@example.com\r\n") {
+		t.Error("copies without a Message-ID must share a key")
+	}
+	for _, other := range []string{
+		"From: alerts@example.net\r\nTo: you@example.com\r\nSubject: Disk full\r\n" + date,
+		"From: alerts@example.net\r\nTo: me@example.com\r\nCc: ops@example.com\r\nSubject: Disk full\r\n" + date,
+		"From: alerts@example.net\r\nTo: me@example.com\r\nSubject: Disk almost full\r\n" + date,
+		alert + "Date: Mon, 2 Jan 2006 15:04:06 -0700\r\n",
+	} {
+		if key(other) == key(alert+date) {
+			t.Errorf("distinct messages share a key: %q", other)
+		}
+	}
+	if k := key(alert); k != "" {
+		t.Errorf("without a Message-ID or Date: want no key, got %q", k)
+	}
+	if (&Message{ID: 1, PreviewSkipped: true}).DedupKey() != "" {
+		t.Error("a message listed without its headers must have no key")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	copyOf := func(id, size int, key string) *Message { return &Message{ID: id, Size: size, dedupKey: key} }
+	msgs := []*Message{
+		copyOf(5, 300, "id:a"),
+		copyOf(4, 50, ""),
+		copyOf(3, 100, "id:a"),
+		copyOf(2, 50, ""),
+		copyOf(1, 200, "id:a"),
+		copyOf(0, 10, "id:b"),
+	}
+	var got []int
+	for _, m := range Dedup(msgs) {
+		got = append(got, m.ID, m.Duplicates)
+	}
+	// The smallest copy of "a" takes the first copy's place; messages
+	// without a key are never merged.
+	if want := []int{3, 2, 4, 0, 2, 0, 0, 0}; !slices.Equal(got, want) {
+		t.Errorf("want (id, duplicates) %v, got %v", want, got)
+	}
+	if len(msgs) != 6 || msgs[0].ID != 5 {
+		t.Error("Dedup must not reorder its argument")
+	}
+}
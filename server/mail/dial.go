@@ -0,0 +1,116 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialTimeout bounds establishing the TCP connection to a mail server.
+const dialTimeout = 30 * time.Second
+
+// quitTimeout bounds the QUIT exchange in Close, so a server that never
+// answers it cannot hold the connection, and the client's lock, open.
+const quitTimeout = 5 * time.Second
+
+// Dialer opens the raw TCP connections used by the POP3 and SMTP clients.
+// TLS (implicit or via STARTTLS) is always layered on top of the returned
+// connection, so a proxying Dialer carries the encrypted session too.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewDialer builds the outbound Dialer for mail connections.  proxyURL is an
+// optional socks5://[user:pass@]host:port; bindIP optionally pins the local
+// source address.  With both empty it returns a plain direct dialer.
+//
+// When a proxy is configured, hostnames are handed to the proxy unresolved
+// so DNS resolution happens on the proxy side.
+func NewDialer(proxyURL, bindIP string) (Dialer, error) {
+	direct := &net.Dialer{Timeout: dialTimeout}
+	if bindIP != "" {
+		ip := net.ParseIP(bindIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid outbound bind IP %q", bindIP)
+		}
+		direct.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if proxyURL == "" {
+		return direct, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse outbound proxy: %w", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported outbound proxy scheme %q (want socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("outbound proxy %q has no host", proxyURL)
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+	}
+	d, err := proxy.SOCKS5("tcp", u.Host, auth, direct)
+	if err != nil {
+		return nil, fmt.Errorf("outbound proxy: %w", err)
+	}
+	return d.(Dialer), nil
+}
+
+// dial connects to addr through d, wrapping the connection in TLS for
+// serverName when useTLS is set.  A nil Dialer dials directly.  Dialing is
+// bounded by both ctx and dialTimeout.
+func dial(ctx context.Context, d Dialer, addr, serverName string, useTLS bool) (net.Conn, error) {
+	if d == nil {
+		d = &net.Dialer{Timeout: dialTimeout}
+	}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !useTLS {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// withConn runs op, one exchange on conn, under ctx.  When ctx is cancelled
+// or its deadline passes, the connection deadline is moved into the past so
+// blocked reads and writes return at once.  The connection is then closed,
+// since the protocol state is unknown, and the returned error wraps
+// ctx.Err() alongside the I/O error it caused.
+func withConn(ctx context.Context, conn net.Conn, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		conn.Close()
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0)) //nolint:errcheck
+	})
+	err := op()
+	if stop() {
+		return err
+	}
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	return nil
+}
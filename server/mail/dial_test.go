@@ -0,0 +1,315 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// socks5Proxy is a minimal no-auth / user-pass SOCKS5 CONNECT server.  Every
+// CONNECT is routed to target regardless of the requested address, and the
+// requested address is recorded so tests can see what the client asked for.
+type socks5Proxy struct {
+	target   string
+	user     string
+	pass     string
+	mu       sync.Mutex
+	requests []string
+}
+
+func (p *socks5Proxy) start(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (p *socks5Proxy) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// Greeting: VER NMETHODS METHODS...
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	io.ReadFull(r, methods) //nolint:errcheck
+	if p.user != "" {
+		conn.Write([]byte{5, 2}) //nolint:errcheck
+		// RFC 1929: VER ULEN UNAME PLEN PASSWD
+		ver := make([]byte, 2)
+		io.ReadFull(r, ver) //nolint:errcheck
+		uname := make([]byte, ver[1])
+		io.ReadFull(r, uname) //nolint:errcheck
+		plen, _ := r.ReadByte()
+		passwd := make([]byte, plen)
+		io.ReadFull(r, passwd) //nolint:errcheck
+		if string(uname) != p.user || string(passwd) != p.pass {
+			conn.Write([]byte{1, 1}) //nolint:errcheck
+			return
+		}
+		conn.Write([]byte{1, 0}) //nolint:errcheck
+	} else {
+		conn.Write([]byte{5, 0}) //nolint:errcheck
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip) //nolint:errcheck
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(r, name) //nolint:errcheck
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(r, ip) //nolint:errcheck
+		host = net.IP(ip).String()
+	}
+	portBytes := make([]byte, 2)
+	io.ReadFull(r, portBytes) //nolint:errcheck
+	p.mu.Lock()
+	p.requests = append(p.requests, fmt.Sprintf("%s:%d", host, binary.BigEndian.Uint16(portBytes)))
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0}) //nolint:errcheck
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}) //nolint:errcheck
+
+	go io.Copy(upstream, r) //nolint:errcheck
+	io.Copy(conn, upstream) //nolint:errcheck
+}
+
+// startGreeter runs a server that writes a POP3 greeting and closes.
+func startGreeter(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "+OK hello\r\n")
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestNewDialer_Direct(t *testing.T) {
+	d, err := NewDialer("", "")
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	if _, ok := d.(*net.Dialer); !ok {
+		t.Errorf("expected *net.Dialer, got %T", d)
+	}
+
+	d, err = NewDialer("", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewDialer with bind IP failed: %v", err)
+	}
+	if nd := d.(*net.Dialer); nd.LocalAddr.String() != "127.0.0.1:0" {
+		t.Errorf("LocalAddr: want 127.0.0.1:0, got %s", nd.LocalAddr)
+	}
+}
+
+func TestNewDialer_Invalid(t *testing.T) {
+	testCases := []struct {
+		name   string
+		proxy  string
+		bindIP string
+	}{
+		{"bad bind IP", "", "not-an-ip"},
+		{"unsupported scheme", "http://proxy:8080", ""},
+		{"missing host", "socks5://", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewDialer(tc.proxy, tc.bindIP); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestPOP3Connect_ThroughSOCKS5(t *testing.T) {
+	testCases := []struct {
+		name string
+		user string
+		pass string
+	}{
+		{"no auth", "", ""},
+		{"user/pass auth", "alice", "s3cret"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &socks5Proxy{target: startGreeter(t), user: tc.user, pass: tc.pass}
+			proxyAddr := p.start(t)
+
+			proxyURL := "socks5://" + proxyAddr
+			if tc.user != "" {
+				proxyURL = fmt.Sprintf("socks5://%s:%s@%s", tc.user, tc.pass, proxyAddr)
+			}
+			d, err := NewDialer(proxyURL, "")
+			if err != nil {
+				t.Fatalf("NewDialer failed: %v", err)
+			}
+
+			// The hostname does not resolve locally, so the connection can
+			// only succeed if resolution is left to the proxy.
+			client := NewPOP3Client(POP3Config{Host: "pop.mail.invalid", Port: 110, Dialer: d})
+			if err := client.Connect(context.Background()); err != nil {
+				t.Fatalf("Connect through proxy failed: %v", err)
+			}
+			client.conn.Close()
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if len(p.requests) != 1 || p.requests[0] != "pop.mail.invalid:110" {
+				t.Errorf("proxy requests: want [pop.mail.invalid:110], got %v", p.requests)
+			}
+		})
+	}
+}
+
+func TestDial_ProxyRejectsBadCredentials(t *testing.T) {
+	p := &socks5Proxy{target: startGreeter(t), user: "alice", pass: "right"}
+	proxyAddr := p.start(t)
+
+	d, err := NewDialer("socks5://alice:wrong@"+proxyAddr, "")
+	if err != nil {
+		t.Fatalf("NewDialer failed: %v", err)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "pop.mail.invalid:110"); err == nil {
+		t.Error("expected authentication failure, got nil")
+	}
+}
+
+// startStalling runs a single-connection server that plays script and then
+// waits for the client to hang up.  The returned channel is closed once the
+// client has closed its end.
+func startStalling(t *testing.T, script func(conn net.Conn, r *bufio.Reader)) (string, <-chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	hungUp := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		script(conn, r)
+		io.Copy(io.Discard, r) //nolint:errcheck
+		close(hungUp)
+	}()
+	return ln.Addr().String(), hungUp
+}
+
+// cancelAfter returns a context cancelled after d.
+func cancelAfter(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	time.AfterFunc(d, cancel)
+	return ctx
+}
+
+// waitHungUp fails the test unless the client closes its connection soon.
+func waitHungUp(t *testing.T, hungUp <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-hungUp:
+	case <-time.After(2 * time.Second):
+		t.Error("client did not close the connection")
+	}
+}
+
+func TestPOP3Retrieve_CancelMidTransfer(t *testing.T) {
+	addr, hungUp := startStalling(t, func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprintf(conn, "+OK ready\r\n")
+		r.ReadString('\n') //nolint:errcheck // RETR
+		// Start a large message and never finish it.
+		fmt.Fprintf(conn, "+OK 5000000 octets\r\nSubject: big\r\n\r\n")
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+
+	client := NewPOP3Client(POP3Config{Host: host, Port: portNum})
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	_, err := client.Retrieve(cancelAfter(t, 50*time.Millisecond), 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Retrieve took %v to return after cancel", elapsed)
+	}
+	waitHungUp(t, hungUp)
+}
+
+func TestPOP3_CancelledContext(t *testing.T) {
+	addr, hungUp := startStalling(t, func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprintf(conn, "+OK ready\r\n")
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+
+	client := NewPOP3Client(POP3Config{Host: host, Port: portNum})
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.List(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+	waitHungUp(t, hungUp)
+}
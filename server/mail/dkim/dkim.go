@@ -0,0 +1,291 @@
+// Package dkim signs outgoing messages with DKIM (RFC 6376), using
+// relaxed/relaxed canonicalization and either RSA-SHA256 or Ed25519-SHA256
+// (RFC 8463) keys.
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// DefaultHeaders are the header fields signed when a Signer lists none.
+// Fields missing from a message are left out of its signature.  The
+// List-Unsubscribe fields are among them because RFC 8058 one-click
+// unsubscribe is only honoured when they are signed.
+var DefaultHeaders = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// minRSABits is the smallest RSA key verifiers must accept (RFC 8301).
+const minRSABits = 1024
+
+// Signer signs messages for one domain.
+type Signer struct {
+	Domain   string        // d= tag, the signing domain
+	Selector string        // s= tag; the public key is published at <selector>._domainkey.<domain>
+	Key      crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+	Headers  []string      // header fields to sign; nil means DefaultHeaders
+}
+
+// Sign returns the DKIM-Signature header field for msg, CRLF-terminated,
+// to be prepended to it.  msg must use CRLF line endings exactly as it will
+// be transmitted, without dot-stuffing.
+func (s *Signer) Sign(msg string, now time.Time) (string, error) {
+	algo, opts, err := algorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+	header, body := msg, ""
+	if i := strings.Index(msg, "\r\n\r\n"); i >= 0 {
+		header, body = msg[:i+2], msg[i+4:]
+	}
+	bodyHash := sha256.Sum256([]byte(relaxedBody(body)))
+
+	fields, names := s.selectFields(splitFields(header))
+	field := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n"+
+		"\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algo, s.Domain, s.Selector, now.Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(relaxedHeader(f) + "\r\n"))
+	}
+	h.Write([]byte(relaxedHeader(field))) // the signature field itself, b= empty and no CRLF
+	sig, err := s.Key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return "", fmt.Errorf("dkim sign: %w", err)
+	}
+	return field + fold(base64.StdEncoding.EncodeToString(sig)) + "\r\n", nil
+}
+
+// DNSRecord returns the TXT record to publish at
+// <selector>._domainkey.<domain> so receivers can verify the signatures.
+func (s *Signer) DNSRecord() (string, error) {
+	switch pub := s.Key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		// RFC 8463 publishes the raw key rather than SubjectPublicKeyInfo.
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	}
+	return "", errors.New("dkim: unsupported key type")
+}
+
+// algorithm returns the a= tag for key and the options its Sign expects:
+// RSA signs the SHA-256 digest with PKCS #1 v1.5, Ed25519 signs the digest
+// itself.
+func algorithm(key crypto.Signer) (string, crypto.SignerOpts, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < minRSABits {
+			return "", nil, fmt.Errorf("dkim: RSA key of %d bits is too short", pub.N.BitLen())
+		}
+		return "rsa-sha256", crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", crypto.Hash(0), nil
+	}
+	return "", nil, errors.New("dkim: unsupported key type")
+}
+
+// selectFields picks the header fields to sign, in the order of s.Headers.
+// A name listed twice signs the next occurrence up, as RFC 6376 §5.4.2
+// requires.  It returns the fields and the names for the h= tag.
+func (s *Signer) selectFields(fields []string) ([]string, []string) {
+	want := s.Headers
+	if want == nil {
+		want = DefaultHeaders
+	}
+	used := make([]bool, len(fields))
+	var signed, names []string
+	for _, name := range want {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				signed = append(signed, fields[i])
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return signed, names
+}
+
+// splitFields splits a header section into fields, keeping folded
+// continuation lines with the field they continue.
+func splitFields(header string) []string {
+	var fields []string
+	for _, line := range strings.Split(strings.TrimSuffix(header, "\r\n"), "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimRight(name, " \t")
+}
+
+func isWSP(r rune) bool { return r == ' ' || r == '\t' }
+
+// relaxedHeader applies the "relaxed" header canonicalization (RFC 6376
+// §3.4.2): the name is lower-cased, the value unfolded, runs of whitespace
+// collapsed and whitespace around the value removed.
+func relaxedHeader(field string) string {
+	_, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(fieldName(field)) + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ")
+}
+
+// relaxedBody applies the "relaxed" body canonicalization (RFC 6376
+// §3.4.4): whitespace runs become one space, trailing whitespace and
+// trailing empty lines are removed, and a non-empty body ends in CRLF.
+func relaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		var b strings.Builder
+		space := false
+		for _, r := range line {
+			if isWSP(r) {
+				space = true
+				continue
+			}
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteRune(r)
+		}
+		lines[i] = b.String()
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// fold breaks a long base64 value into continuation lines.
+func fold(v string) string {
+	const width = 72
+	var b strings.Builder
+	for len(v) > width {
+		b.WriteString(v[:width] + "\r\n\t")
+		v = v[width:]
+	}
+	b.WriteString(v)
+	return b.String()
+}
+
+// ParsePrivateKey decodes a PEM private key: PKCS #1 RSA, or PKCS #8 RSA or
+// Ed25519.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM private key found")
+	}
+	var (
+		key any
+		err error
+	)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("dkim: unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim: parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("dkim: unsupported key type")
+	}
+	if _, _, err := algorithm(signer); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// Keys holds the signers for each sending domain, keyed by lower-case
+// domain, internationalised domains in their ASCII (xn--) form as d= needs
+// them (RFC 8616).  A nil Keys signs nothing.
+type Keys map[string]*Signer
+
+// For returns the signer for the domain of the address from, or nil when
+// that domain has no key.  An internationalised domain finds its key in
+// either form.
+func (k Keys) For(from string) *Signer {
+	i := strings.LastIndex(from, "@")
+	if i < 0 {
+		return nil
+	}
+	return k[keyDomain(from[i+1:])]
+}
+
+// keyDomain returns the Keys index of domain: lower-cased, and in ASCII
+// form when it is a valid internationalised domain.
+func keyDomain(domain string) string {
+	domain = strings.ToLower(domain)
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		return ascii
+	}
+	return domain
+}
+
+// LoadKeys reads the signing keys described by spec, a comma-separated list
+// of domain:selector:path entries where path names a PEM private key file.
+// An empty spec yields no keys.
+func LoadKeys(spec string) (Keys, error) {
+	keys := Keys{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("dkim: key %q is not domain:selector:path", entry)
+		}
+		domain := keyDomain(parts[0])
+		if _, dup := keys[domain]; dup {
+			return nil, fmt.Errorf("dkim: domain %s has more than one key", domain)
+		}
+		data, err := os.ReadFile(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("dkim: %s: %w", domain, err)
+		}
+		key, err := ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w (%s)", err, domain)
+		}
+		keys[domain] = &Signer{Domain: domain, Selector: parts[1], Key: key}
+	}
+	return keys, nil
+}
@@ -0,0 +1,294 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	foldedWSP  = regexp.MustCompile(`\r\n([ \t])`)
+	wspRun     = regexp.MustCompile(`[ \t]+`)
+	lineEndWSP = regexp.MustCompile(` \r\n`)
+	endCRLFs   = regexp.MustCompile(`(\r\n)+$`)
+	bTagValue  = regexp.MustCompile(`([;\s]b=)[^;]*`)
+)
+
+// verify is a reference verifier for relaxed/relaxed DKIM signatures,
+// written from RFC 6376 §3.4 and §6.1 independently of the signer.  record
+// stands in for the selector's DNS TXT record.
+func verify(msg, record string) error {
+	header, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		header, body = strings.TrimSuffix(msg, "\r\n"), ""
+	}
+	lines := strings.Split(foldedWSP.ReplaceAllString(header, "$1"), "\r\n")
+	if !strings.HasPrefix(strings.ToLower(lines[0]), "dkim-signature:") {
+		return errors.New("first header is not DKIM-Signature")
+	}
+	sigField, fields := lines[0], lines[1:]
+
+	tags := parseTags(sigField[strings.Index(sigField, ":")+1:])
+	if tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("unexpected canonicalization %q", tags["c"])
+	}
+
+	// Body hash.
+	body = lineEndWSP.ReplaceAllString(wspRun.ReplaceAllString(body, " "), "\r\n")
+	body = strings.TrimRight(body, " ")
+	if body != "" {
+		body = endCRLFs.ReplaceAllString(body+"\r\n", "\r\n")
+	}
+	if body == "\r\n" {
+		body = ""
+	}
+	bh := sha256.Sum256([]byte(body))
+	if got := base64.StdEncoding.EncodeToString(bh[:]); got != tags["bh"] {
+		return fmt.Errorf("body hash mismatch: computed %s, signed %s", got, tags["bh"])
+	}
+
+	// Header hash.
+	canon := func(f string) string {
+		name, value, _ := strings.Cut(f, ":")
+		return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(wspRun.ReplaceAllString(value, " "))
+	}
+	used := map[int]bool{}
+	var signed strings.Builder
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			n, _, _ := strings.Cut(fields[i], ":")
+			if !used[i] && strings.EqualFold(strings.TrimSpace(n), name) {
+				used[i] = true
+				signed.WriteString(canon(fields[i]) + "\r\n")
+				break
+			}
+		}
+	}
+	signed.WriteString(canon(bTagValue.ReplaceAllString(sigField, "$1")))
+	digest := sha256.Sum256([]byte(signed.String()))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("decode b=: %w", err)
+	}
+	keyTags := parseTags(record)
+	key, err := base64.StdEncoding.DecodeString(keyTags["p"])
+	if err != nil {
+		return fmt.Errorf("decode p=: %w", err)
+	}
+	switch keyTags["k"] {
+	case "ed25519":
+		if tags["a"] != "ed25519-sha256" || !ed25519.Verify(ed25519.PublicKey(key), digest[:], sig) {
+			return errors.New("ed25519 signature does not verify")
+		}
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(key)
+		if err != nil {
+			return err
+		}
+		if tags["a"] != "rsa-sha256" {
+			return fmt.Errorf("unexpected algorithm %q", tags["a"])
+		}
+		if err := rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unexpected key type %q", keyTags["k"])
+	}
+	return nil
+}
+
+// parseTags parses a tag=value list, dropping all whitespace from values.
+func parseTags(list string) map[string]string {
+	tags := map[string]string{}
+	for _, tv := range strings.Split(list, ";") {
+		tag, value, ok := strings.Cut(tv, "=")
+		if ok {
+			tags[strings.TrimSpace(tag)] = strings.Join(strings.Fields(value), "")
+		}
+	}
+	return tags
+}
+
+// The Ed25519 example from RFC 8463 Appendix A.3 checks the reference
+// verifier itself.
+func TestVerify_RFC8463Example(t *testing.T) {
+	msg := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+	record := "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	if err := verify(msg, record); err != nil {
+		t.Fatalf("RFC 8463 example: %v", err)
+	}
+	if err := verify(strings.Replace(msg, "Joe.", "Jim.", 1), record); err == nil {
+		t.Error("altered body must not verify")
+	}
+}
+
+func testSigners(t *testing.T) map[string]*Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate Ed25519 key: %v", err)
+	}
+	return map[string]*Signer{
+		"rsa":     {Domain: "example.com", Selector: "mail", Key: rsaKey},
+		"ed25519": {Domain: "example.com", Selector: "ed", Key: edKey},
+	}
+}
+
+func TestSign(t *testing.T) {
+	header := "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.org\r\n" +
+		"Subject:  Lunch\t plans \r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n"
+	bodies := map[string]string{
+		"plain":               "Hello Bob,\r\nSee you at noon.\r\n",
+		"trailing whitespace": "Hello  \t Bob, \r\n\t indented\t\r\n \r\n\r\n\r\n",
+		"no final newline":    "Hello Bob",
+		"empty":               "",
+		"only blank lines":    "\r\n\r\n",
+	}
+	for algo, signer := range testSigners(t) {
+		record, err := signer.DNSRecord()
+		if err != nil {
+			t.Fatalf("%s: DNSRecord: %v", algo, err)
+		}
+		for name, body := range bodies {
+			t.Run(algo+"/"+name, func(t *testing.T) {
+				msg := header + body
+				sig, err := signer.Sign(msg, time.Now())
+				if err != nil {
+					t.Fatalf("Sign: %v", err)
+				}
+				if !strings.HasSuffix(sig, "\r\n") {
+					t.Errorf("signature field must end in CRLF: %q", sig)
+				}
+				if err := verify(sig+msg, record); err != nil {
+					t.Fatalf("verify: %v\n%s", err, sig)
+				}
+				if err := verify(sig+strings.Replace(msg, "Lunch", "Dinner", 1), record); err == nil {
+					t.Error("altered Subject must not verify")
+				}
+				if err := verify(sig+msg+"P.S.\r\n", record); err == nil {
+					t.Error("altered body must not verify")
+				}
+			})
+		}
+	}
+}
+
+func TestSign_FoldedAndRepeatedHeaders(t *testing.T) {
+	signer := testSigners(t)["ed25519"]
+	signer.Headers = []string{"From", "Subject", "Subject", "Subject"}
+	record, _ := signer.DNSRecord()
+
+	msg := "Subject: first\r\nFrom: alice@example.com\r\nSubject: second,\r\n\tfolded\r\n\r\nbody\r\n"
+	sig, err := signer.Sign(msg, time.Now())
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !strings.Contains(sig, "h=From:Subject:Subject;") {
+		t.Errorf("h= should name each present field once, got %q", sig)
+	}
+	if err := verify(sig+msg, record); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	// Relaxed canonicalization tolerates refolding.
+	refolded := strings.Replace(msg, "second,\r\n\tfolded", "second,  folded", 1)
+	if err := verify(sig+refolded, record); err != nil {
+		t.Errorf("refolded header: %v", err)
+	}
+}
+
+func TestSign_RejectsShortRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	s := &Signer{Domain: "example.com", Selector: "s", Key: key}
+	if _, err := s.Sign("From: a@example.com\r\n\r\n", time.Now()); err == nil {
+		t.Error("a 512-bit RSA key must be rejected")
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	write := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	rsaPath := write("rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	edPath := write("ed.pem", "PRIVATE KEY", pkcs8)
+	certPath := write("cert.pem", "CERTIFICATE", []byte("x"))
+
+	keys, err := LoadKeys(fmt.Sprintf("Example.com:mail:%s, example.org:ed:%s", rsaPath, edPath))
+	if err != nil {
+		t.Fatalf("LoadKeys: %v", err)
+	}
+	if s := keys.For("alice@EXAMPLE.com"); s == nil || s.Selector != "mail" || s.Domain != "example.com" {
+		t.Errorf("example.com signer: got %+v", s)
+	}
+	if s := keys.For("bob@example.org"); s == nil || s.Selector != "ed" {
+		t.Errorf("example.org signer: got %+v", s)
+	}
+	if keys.For("carol@example.net") != nil || keys.For("no-at-sign") != nil {
+		t.Error("unconfigured domains must have no signer")
+	}
+	if keys, err := LoadKeys(""); err != nil || len(keys) != 0 {
+		t.Errorf("empty spec: got %v, %v", keys, err)
+	}
+
+	for _, spec := range []string{
+		"example.com:mail",
+		"example.com::" + rsaPath,
+		"example.com:mail:" + filepath.Join(dir, "missing.pem"),
+		"example.com:mail:" + certPath,
+		"example.com:a:" + rsaPath + ",EXAMPLE.COM:b:" + edPath,
+	} {
+		if _, err := LoadKeys(spec); err == nil {
+			t.Errorf("LoadKeys(%q) should fail", spec)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package mail
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DomainList is a list of lower-case ASCII domains, each matching itself
+// and its subdomains.
+type DomainList []string
+
+// NewDomainList validates and lower-cases domains, and converts
+// internationalised ones to their ASCII (xn--) form.  A trailing dot is
+// dropped; empty entries, addresses and wildcards are errors.
+func NewDomainList(domains []string) (DomainList, error) {
+	list := make(DomainList, 0, len(domains))
+	for _, d := range domains {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		if d == "" || strings.ContainsAny(d, "@*,: ") || strings.HasPrefix(d, ".") || strings.Contains(d, "..") {
+			return nil, fmt.Errorf("domain list: %q is not a domain", d)
+		}
+		ascii, err := asciiDomain(d)
+		if err != nil {
+			return nil, fmt.Errorf("domain list: %q is not a valid internationalised domain", d)
+		}
+		list = append(list, ascii)
+	}
+	return list, nil
+}
+
+// ParseDomainList reads a comma-separated list of domains, as in
+// "example.com,corp.example.org".  An empty spec yields an empty list.
+func ParseDomainList(spec string) (DomainList, error) {
+	var domains []string
+	for _, d := range strings.Split(spec, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return NewDomainList(domains)
+}
+
+// Match reports whether domain is one of l's domains or a subdomain of
+// one, ignoring case: "example.com" matches "Mail.Example.com" but not
+// "badexample.com".  An internationalised domain matches in either form.
+func (l DomainList) Match(domain string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if ascii, err := asciiDomain(domain); err == nil {
+		domain = ascii
+	}
+	for _, d := range l {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecipientPolicy restricts the domains mail may be sent to.
+type RecipientPolicy struct {
+	Allowed DomainList // when not empty, the only domains mail may go to
+	Blocked DomainList // domains mail may never go to, even when allowed
+}
+
+// Rejected returns the recipients p refuses, in order: those in a blocked
+// domain and, when Allowed is not empty, those outside the allowed ones.
+func (p RecipientPolicy) Rejected(recipients []string) []string {
+	var rejected []string
+	for _, addr := range recipients {
+		domain := addr[strings.LastIndex(addr, "@")+1:]
+		if p.Blocked.Match(domain) || len(p.Allowed) > 0 && !p.Allowed.Match(domain) {
+			rejected = append(rejected, addr)
+		}
+	}
+	return rejected
+}
@@ -0,0 +1,78 @@
+package mail
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDomainList_Match(t *testing.T) {
+	list, err := ParseDomainList("Example.com, corp.example.org., Bücher.de, xn--r8jz45g.jp")
+	if err != nil {
+		t.Fatalf("ParseDomainList failed: %v", err)
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.COM", true},
+		{"mail.example.com", true},
+		{"a.b.Example.Com", true},
+		{"example.com.", true},
+		{"badexample.com", false},
+		{"example.com.evil.net", false},
+		{"com", false},
+		{"corp.example.org", true},
+		{"eu.corp.example.org", true},
+		{"example.org", false},
+		{"", false},
+		{"xn--bcher-kva.de", true},
+		{"shop.BÜCHER.de", true},
+		{"例え.jp", true},
+		{"buecher.de", false},
+	}
+	for _, tt := range tests {
+		if got := list.Match(tt.domain); got != tt.want {
+			t.Errorf("Match(%q): want %v, got %v", tt.domain, tt.want, got)
+		}
+	}
+	if DomainList(nil).Match("example.com") {
+		t.Error("an empty list must match nothing")
+	}
+}
+
+func TestParseDomainList_Invalid(t *testing.T) {
+	for _, spec := range []string{"user@example.com", "*.example.com", ".example.com", "example..com", "example.com:25", "exa mple.com", "xn--zz.com"} {
+		if _, err := ParseDomainList(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+	if list, err := ParseDomainList(" , "); err != nil || len(list) != 0 {
+		t.Errorf("blank spec: want an empty list, got %v, %v", list, err)
+	}
+}
+
+func TestRecipientPolicy_Rejected(t *testing.T) {
+	recipients := []string{"a@example.com", "b@sales.example.com", "c@partner.net", "d@spam.example.com", "e@other.org"}
+	tests := []struct {
+		name             string
+		allowed, blocked string
+		want             []string
+	}{
+		{"no lists", "", "", nil},
+		{"allowed only", "example.com,partner.net", "", []string{"e@other.org"}},
+		{"blocked only", "", "partner.net, SPAM.example.com", []string{"c@partner.net", "d@spam.example.com"}},
+		{"blocked within allowed", "example.com", "spam.example.com", []string{"c@partner.net", "d@spam.example.com", "e@other.org"}},
+		{"everything blocked", "", "com,net,org", recipients},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, _ := ParseDomainList(tt.allowed)
+			blocked, _ := ParseDomainList(tt.blocked)
+			got := RecipientPolicy{Allowed: allowed, Blocked: blocked}.Rejected(recipients)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
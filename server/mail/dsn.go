@@ -0,0 +1,139 @@
+package mail
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ErrNotBounce is returned by ParseBounce for messages that are not
+// delivery status notifications.
+var ErrNotBounce = errors.New("not a delivery status notification")
+
+// Bounce summarises a delivery status notification (RFC 3464): the
+// multipart/report a mail server sends back when it could not deliver a
+// message.
+type Bounce struct {
+	Recipient         string `json:"recipient"`                     // address the message could not be delivered to
+	Action            string `json:"action"`                        // "failed", "delayed", "delivered", ...
+	Status            string `json:"status"`                        // enhanced status code, e.g. "5.1.1"
+	Diagnostic        string `json:"diagnostic,omitempty"`          // remote server's reply, e.g. "550 5.1.1 User unknown"
+	OriginalMessageID string `json:"original_message_id,omitempty"` // Message-ID of the bounced message, with angle brackets
+}
+
+// isDeliveryReport reports whether a header block declares a delivery
+// status notification: multipart/report with report-type=delivery-status.
+func isDeliveryReport(header string) bool {
+	msg, err := netmail.ReadMessage(strings.NewReader(header + "\r\n\r\n"))
+	if err != nil {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/report" &&
+		strings.EqualFold(params["report-type"], "delivery-status")
+}
+
+// ParseBounce extracts the bounce details from a raw delivery status
+// notification.  When the report lists several recipients, the first whose
+// delivery failed is returned.  Messages that are not DSNs yield
+// ErrNotBounce.
+func ParseBounce(raw string) (*Bounce, error) {
+	msg, err := netmail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parse message: %w", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" ||
+		!strings.EqualFold(params["report-type"], "delivery-status") || params["boundary"] == "" {
+		return nil, ErrNotBounce
+	}
+
+	var b *Bounce
+	originalID := ""
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read report: %w", err)
+		}
+		content, err := io.ReadAll(decodeTransfer(p.Header.Get("Content-Transfer-Encoding"), p))
+		if err != nil {
+			return nil, fmt.Errorf("read report part: %w", err)
+		}
+		partType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			b = parseDeliveryStatus(string(content))
+		case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+			// The returned message, or only its headers, which may lack
+			// the blank line that ends them.
+			if orig, err := netmail.ReadMessage(strings.NewReader(string(content) + "\r\n\r\n")); err == nil {
+				originalID = strings.TrimSpace(orig.Header.Get("Message-Id"))
+			}
+		}
+	}
+	if b == nil {
+		return nil, errors.New("delivery report has no delivery-status part")
+	}
+	b.OriginalMessageID = originalID
+	return b, nil
+}
+
+// parseDeliveryStatus reads the fields of a message/delivery-status body: a
+// per-message block followed by one block per recipient, separated by
+// blank lines.
+func parseDeliveryStatus(content string) *Bounce {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	blocks := strings.Split(strings.TrimSpace(content), "\n\n")
+
+	var first *Bounce
+	for _, block := range blocks {
+		h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(block + "\n\n"))).ReadMIMEHeader()
+		if err != nil && len(h) == 0 {
+			continue
+		}
+		recipient := typedValue(h.Get("Final-Recipient"))
+		if recipient == "" {
+			recipient = typedValue(h.Get("Original-Recipient"))
+		}
+		b := &Bounce{
+			Recipient:  recipient,
+			Action:     strings.ToLower(strings.TrimSpace(h.Get("Action"))),
+			Diagnostic: typedValue(h.Get("Diagnostic-Code")),
+		}
+		if fields := strings.Fields(h.Get("Status")); len(fields) > 0 {
+			b.Status = fields[0]
+		}
+		if b.Recipient == "" && b.Status == "" {
+			continue // the per-message block
+		}
+		if b.Action == "failed" {
+			return b
+		}
+		if first == nil {
+			first = b
+		}
+	}
+	if first == nil {
+		return &Bounce{}
+	}
+	return first
+}
+
+// typedValue strips the type prefix of a DSN field such as
+// "rfc822; alice@example.com" or "smtp; 550 User unknown".
+func typedValue(v string) string {
+	if _, rest, ok := strings.Cut(v, ";"); ok {
+		v = rest
+	}
+	return strings.TrimSpace(v)
+}
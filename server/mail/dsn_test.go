@@ -0,0 +1,115 @@
+package mail
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// dsnHeader is a Postfix-style bounce header with a folded Content-Type.
+const dsnHeader = "From: MAILER-DAEMON@mx.example.org (Mail Delivery System)\r\n" +
+	"To: me@example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status;\r\n" +
+	"\tboundary=\"B1\"\r\n"
+
+const dsnMessage = dsnHeader +
+	"\r\n" +
+	"--B1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"I'm sorry to have to inform you that your message could not be delivered.\r\n" +
+	"--B1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"Arrival-Date: Mon,  2 Jan 2006 15:04:05 -0700\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; ok@example.org\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; nobody@example.org\r\n" +
+	"Original-Recipient: rfc822;Nobody@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1 (bad destination mailbox)\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <nobody@example.org>:\r\n" +
+	"    Recipient address rejected: User unknown\r\n" +
+	"\r\n" +
+	"--B1\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: me@example.com\r\n" +
+	"To: nobody@example.org\r\n" +
+	"Message-ID: <1700000000.abc@example.com>\r\n" +
+	"Subject: hello\r\n" +
+	"--B1--\r\n"
+
+func TestParseBounce(t *testing.T) {
+	b, err := ParseBounce(dsnMessage)
+	if err != nil {
+		t.Fatalf("ParseBounce: %v", err)
+	}
+	want := Bounce{
+		Recipient:         "nobody@example.org",
+		Action:            "failed",
+		Status:            "5.1.1",
+		Diagnostic:        "550 5.1.1 <nobody@example.org>: Recipient address rejected: User unknown",
+		OriginalMessageID: "<1700000000.abc@example.com>",
+	}
+	if *b != want {
+		t.Errorf("ParseBounce:\nwant %+v\n got %+v", want, *b)
+	}
+}
+
+func TestParseBounce_EncodedStatusAndFullMessage(t *testing.T) {
+	raw := "From: postmaster@example.org\r\n" +
+		"Content-Type: multipart/report; report-type=\"Delivery-Status\"; boundary=\"x\"\r\n" +
+		"\r\n" +
+		"--x\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		// "Reporting-MTA: dns; mx\n\nFinal-Recipient: rfc822; a@b.c\nAction: delayed\nStatus: 4.2.2\n"
+		"UmVwb3J0aW5nLU1UQTogZG5zOyBteAoKRmluYWwtUmVjaXBpZW50OiByZmM4MjI7IGFAYi5jCkFjdGlvbjogZGVsYXllZApTdGF0dXM6IDQuMi4yCg==\r\n" +
+		"--x\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Message-ID: <orig@example.com>\r\n" +
+		"Subject: hi\r\n" +
+		"\r\n" +
+		"body\r\n" +
+		"--x--\r\n"
+	b, err := ParseBounce(raw)
+	if err != nil {
+		t.Fatalf("ParseBounce: %v", err)
+	}
+	if b.Recipient != "a@b.c" || b.Action != "delayed" || b.Status != "4.2.2" || b.OriginalMessageID != "<orig@example.com>" {
+		t.Errorf("unexpected bounce %+v", *b)
+	}
+}
+
+func TestParseBounce_NotBounce(t *testing.T) {
+	for name, raw := range map[string]string{
+		"plain":        "From: a@example.com\r\nSubject: hi\r\n\r\nhello\r\n",
+		"other report": strings.Replace(dsnMessage, "report-type=delivery-status", "report-type=disposition-notification", 1),
+		"multipart":    multipartMessage,
+	} {
+		if _, err := ParseBounce(raw); !errors.Is(err, ErrNotBounce) {
+			t.Errorf("%s: want ErrNotBounce, got %v", name, err)
+		}
+	}
+}
+
+func TestIsDeliveryReport(t *testing.T) {
+	if !isDeliveryReport(dsnHeader) {
+		t.Error("folded multipart/report header not recognised")
+	}
+	if isDeliveryReport("From: a@example.com\r\nContent-Type: multipart/mixed; boundary=x\r\n") {
+		t.Error("multipart/mixed is not a delivery report")
+	}
+	if isDeliveryReport("Subject: no content type\r\n") {
+		t.Error("a message without Content-Type is not a delivery report")
+	}
+}
@@ -0,0 +1,76 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDSNNotSupported is returned by Send for a request that requires
+// delivery status notifications when the server does not advertise the DSN
+// extension.
+var ErrDSNNotSupported = errors.New("smtp: server does not support delivery status notifications")
+
+// DSN asks the receiving servers for delivery status notifications (RFC
+// 3461) about a message, which come back to its envelope sender as the
+// reports ParseBounce reads.
+type DSN struct {
+	Notify []string // "NEVER", or any of "SUCCESS", "FAILURE" and "DELAY"; empty = the server's default
+	Ret    string   // "FULL" or "HDRS": what of the message a report returns; empty = the server's default
+
+	// Require fails the send with ErrDSNNotSupported when the server does
+	// not advertise DSN; otherwise the parameters are left out.
+	Require bool
+}
+
+// ValidateDSN checks the parameters of d, if any, ignoring case: the
+// NOTIFY keywords, of which NEVER excludes the others, and the RET value.
+func ValidateDSN(d *DSN) error {
+	if d == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, n := range d.Notify {
+		n = strings.ToUpper(n)
+		switch n {
+		case "NEVER", "SUCCESS", "FAILURE", "DELAY":
+		default:
+			return fmt.Errorf("DSN notify: %q is not NEVER, SUCCESS, FAILURE or DELAY", n)
+		}
+		if seen[n] {
+			return fmt.Errorf("DSN notify: %s given twice", n)
+		}
+		seen[n] = true
+	}
+	if seen["NEVER"] && len(seen) > 1 {
+		return errors.New("DSN notify: NEVER cannot be combined with other values")
+	}
+	switch strings.ToUpper(d.Ret) {
+	case "", "FULL", "HDRS":
+	default:
+		return fmt.Errorf("DSN ret: %q is not FULL or HDRS", d.Ret)
+	}
+	return nil
+}
+
+// mailParams returns the MAIL FROM parameters of d, with a leading space,
+// or "" for none.
+func (d *DSN) mailParams() string {
+	if d == nil || d.Ret == "" {
+		return ""
+	}
+	return " RET=" + strings.ToUpper(d.Ret)
+}
+
+// rcptParams returns the RCPT TO parameters of d, with a leading space,
+// or "" for none.
+func (d *DSN) rcptParams() string {
+	if d == nil || len(d.Notify) == 0 {
+		return ""
+	}
+	notify := make([]string, len(d.Notify))
+	for i, n := range d.Notify {
+		notify[i] = strings.ToUpper(n)
+	}
+	return " NOTIFY=" + strings.Join(notify, ",")
+}
@@ -0,0 +1,40 @@
+package mail
+
+import "testing"
+
+func TestValidateDSN(t *testing.T) {
+	tests := []struct {
+		name string
+		dsn  *DSN
+		ok   bool
+	}{
+		{"none", nil, true},
+		{"server defaults", &DSN{Require: true}, true},
+		{"failure and delay", &DSN{Notify: []string{"FAILURE", "delay"}, Ret: "hdrs"}, true},
+		{"never", &DSN{Notify: []string{"NEVER"}, Ret: "FULL"}, true},
+		{"never with others", &DSN{Notify: []string{"NEVER", "FAILURE"}}, false},
+		{"twice", &DSN{Notify: []string{"FAILURE", "failure"}}, false},
+		{"unknown notify", &DSN{Notify: []string{"ALWAYS"}}, false},
+		{"injection", &DSN{Notify: []string{"FAILURE\r\nRCPT TO:<evil@example.net>"}}, false},
+		{"unknown ret", &DSN{Ret: "BODY"}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateDSN(tt.dsn); (err == nil) != tt.ok {
+			t.Errorf("%s: want ok=%v, got %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestDSNParams(t *testing.T) {
+	d := &DSN{Notify: []string{"failure", "DELAY"}, Ret: "hdrs"}
+	if got := d.mailParams(); got != " RET=HDRS" {
+		t.Errorf("MAIL FROM parameters: got %q", got)
+	}
+	if got := d.rcptParams(); got != " NOTIFY=FAILURE,DELAY" {
+		t.Errorf("RCPT TO parameters: got %q", got)
+	}
+	var none *DSN
+	if none.mailParams() != "" || none.rcptParams() != "" || (&DSN{Require: true}).rcptParams() != "" {
+		t.Error("want no parameters without values")
+	}
+}
@@ -0,0 +1,48 @@
+package mail
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// greylistWords are the words by which greylisting servers (postgrey,
+// Exim, rspamd, most hosted filters) tell their temporary rejections apart.
+var greylistWords = []string{"greylist", "graylist", "grey-list", "gray-list", "grey list", "gray list"}
+
+// greylistDelayRe finds the wait a greylisting reply suggests, as in
+// "please retry in 300 seconds" or "try again after 5 minutes".
+var greylistDelayRe = regexp.MustCompile(`(?i)\b(?:in|after|for|wait)\s+(\d{1,5})\s*(s|secs?|seconds?|m|mins?|minutes?)\b`)
+
+// Greylisted reports whether err is a greylisting server's temporary
+// rejection: a 450 or 451 reply that says so.  Such a server accepts the
+// same message once a few minutes have passed, and not before; delay is
+// the wait its reply suggests, or 0 when it names none.
+func Greylisted(err error) (delay time.Duration, ok bool) {
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || (smtpErr.Code != 450 && smtpErr.Code != 451) {
+		return 0, false
+	}
+	reply := strings.ToLower(smtpErr.Reply)
+	greylisted := false
+	for _, w := range greylistWords {
+		if strings.Contains(reply, w) {
+			greylisted = true
+			break
+		}
+	}
+	if !greylisted {
+		return 0, false
+	}
+	m := greylistDelayRe.FindStringSubmatch(reply)
+	if m == nil {
+		return 0, true
+	}
+	n, _ := strconv.Atoi(m[1])
+	if strings.HasPrefix(m[2], "m") {
+		return time.Duration(n) * time.Minute, true
+	}
+	return time.Duration(n) * time.Second, true
+}
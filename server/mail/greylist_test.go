@@ -0,0 +1,32 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGreylisted(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		ok    bool
+		delay time.Duration
+	}{
+		{"postgrey", fmt.Errorf("smtp RCPT TO: %w", &SMTPError{Code: 450, Reply: "450 4.2.0 <bob@example.com>: Recipient address rejected: Greylisted, see http://postgrey.schweikert.ch/help/example.com.html"}), true, 0},
+		{"seconds", &SMTPError{Code: 451, Reply: "451 4.7.1 Greylisting in action, please come back in 300 seconds"}, true, 300 * time.Second},
+		{"minutes", &SMTPError{Code: 451, Reply: "451-4.7.1 You have been graylisted.\n451 4.7.1 Try again after 5 minutes"}, true, 5 * time.Minute},
+		{"short unit", &SMTPError{Code: 450, Reply: "450 grey-listed, wait 90s"}, true, 90 * time.Second},
+		{"other 451", &SMTPError{Code: 451, Reply: "451 4.3.0 try again later"}, false, 0},
+		{"421", &SMTPError{Code: 421, Reply: "421 greylisted, closing"}, false, 0},
+		{"5xx", &SMTPError{Code: 550, Reply: "550 greylist database broken"}, false, 0},
+		{"not smtp", errors.New("greylisted"), false, 0},
+	}
+	for _, tt := range tests {
+		delay, ok := Greylisted(tt.err)
+		if ok != tt.ok || delay != tt.delay {
+			t.Errorf("%s: want %v, %v, got %v, %v", tt.name, tt.delay, tt.ok, delay, ok)
+		}
+	}
+}
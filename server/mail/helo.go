@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// defaultHELOHostname is announced in EHLO/HELO when neither the
+// configuration nor the host provides a usable name.
+const defaultHELOHostname = "mulamail"
+
+// ValidateHostname checks that name is a syntactically legal hostname
+// (RFC 1123): at most 253 characters of dot-separated labels, each 1 to 63
+// letters, digits and hyphens that neither starts nor ends with a hyphen.
+// A single trailing dot is allowed.  Address literals and internationalised
+// names are rejected; use the ASCII (xn--) form of the latter.
+func ValidateHostname(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return fmt.Errorf("hostname is empty")
+	}
+	if len(name) > 253 {
+		return fmt.Errorf("hostname is longer than 253 characters")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("hostname %q: labels must be 1 to 63 characters", name)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("hostname %q: labels must not start or end with a hyphen", name)
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return fmt.Errorf("hostname %q: %q is not allowed, only letters, digits and hyphens", name, c)
+			}
+		}
+	}
+	return nil
+}
+
+// LocalHostname returns the fully qualified name of this host, as the
+// name to announce in EHLO/HELO: the OS hostname when it is qualified,
+// otherwise the first qualified name its addresses resolve back to.  When
+// neither yields a legal hostname, it returns the bare OS hostname, or
+// "mulamail".  The lookup runs once per process.
+var LocalHostname = sync.OnceValue(func() string {
+	host, err := os.Hostname()
+	if err != nil || ValidateHostname(host) != nil {
+		return defaultHELOHostname
+	}
+	if strings.Contains(host, ".") {
+		return host
+	}
+	addrs, _ := net.LookupHost(host)
+	for _, addr := range addrs {
+		names, _ := net.LookupAddr(addr)
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if strings.Contains(name, ".") && ValidateHostname(name) == nil {
+				return name
+			}
+		}
+	}
+	return host
+})
@@ -0,0 +1,118 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"mx1.example.com", true},
+		{"mx1.example.com.", true},
+		{"localhost", true},
+		{"xn--bcher-kva.de", true},
+		{"a-b.c0", true},
+		{"", false},
+		{".", false},
+		{"mx1..example.com", false},
+		{".example.com", false},
+		{"-mx.example.com", false},
+		{"mx-.example.com", false},
+		{"mx_1.example.com", false},
+		{"mx1 example.com", false},
+		{"mx1.example.com\r\nRSET", false},
+		{"[192.0.2.1]", false},
+		{"bücher.de", false},
+		{strings.Repeat("a", 64) + ".example.com", false},
+		{strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateHostname(tt.name); (err == nil) != tt.ok {
+			t.Errorf("ValidateHostname(%q): want ok=%v, got %v", tt.name, tt.ok, err)
+		}
+	}
+}
+
+func TestLocalHostname(t *testing.T) {
+	if err := ValidateHostname(LocalHostname()); err != nil {
+		t.Errorf("LocalHostname() = %q: %v", LocalHostname(), err)
+	}
+}
+
+func TestSMTPHandshake_HELOHostname(t *testing.T) {
+	// handshake runs Handshake against a server that accepts EHLO, or only
+	// HELO, and returns the greetings it received.
+	handshake := func(t *testing.T, cfg SMTPConfig, ehlo bool) []string {
+		t.Helper()
+		seen := make(chan []string, 1)
+		addr, _ := startStalling(t, func(conn net.Conn, r *bufio.Reader) {
+			fmt.Fprintf(conn, "220 ready\r\n")
+			var greetings []string
+			defer func() { seen <- greetings }()
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\r\n")
+				switch {
+				case strings.HasPrefix(line, "EHLO "):
+					greetings = append(greetings, line)
+					if ehlo {
+						fmt.Fprintf(conn, "250 hello\r\n")
+					} else {
+						fmt.Fprintf(conn, "502 command not implemented\r\n")
+					}
+				case strings.HasPrefix(line, "HELO "):
+					greetings = append(greetings, line)
+					fmt.Fprintf(conn, "250 hello\r\n")
+				case line == "STARTTLS":
+					fmt.Fprintf(conn, "454 TLS not available\r\n")
+				case line == "QUIT":
+					fmt.Fprintf(conn, "221 bye\r\n")
+					return
+				default:
+					fmt.Fprintf(conn, "500 unexpected\r\n")
+				}
+			}
+		})
+		host, port, _ := net.SplitHostPort(addr)
+		cfg.Host = host
+		cfg.Port, _ = strconv.Atoi(port)
+		client := NewSMTPClient(cfg)
+		if err := client.Connect(context.Background()); err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		if err := client.Handshake(context.Background()); err != nil {
+			t.Fatalf("Handshake: %v", err)
+		}
+		client.Close()
+		return <-seen
+	}
+
+	tests := []struct {
+		name string
+		cfg  SMTPConfig
+		ehlo bool
+		want []string
+	}{
+		{"configured", SMTPConfig{HELOHostname: "mx1.example.com"}, true, []string{"EHLO mx1.example.com"}},
+		{"helo fallback", SMTPConfig{HELOHostname: "mx1.example.com"}, false, []string{"EHLO mx1.example.com", "HELO mx1.example.com"}},
+		{"default", SMTPConfig{}, true, []string{"EHLO mulamail"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := handshake(t, tt.cfg, tt.ehlo); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package mail
+
+import (
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// MailingList identifies the list a message was distributed by, from its
+// List-Id (RFC 2919) and List-Post and List-Archive (RFC 2369) headers.
+// Messages with none of them but a Precedence of "list" or "bulk" are
+// list traffic too, with every field empty.
+type MailingList struct {
+	ID      string `json:"id,omitempty"`      // list identifier, lower-cased, e.g. "users.example.org"
+	Post    string `json:"post,omitempty"`    // address to post to; empty when posting is not allowed
+	Archive string `json:"archive,omitempty"` // URL of the list archive
+}
+
+// parseMailingList reads the list headers of a message's header block, and
+// returns nil for mail that was not sent through a list.
+func parseMailingList(header string) *MailingList {
+	msg, err := netmail.ReadMessage(strings.NewReader(header + "\r\n\r\n"))
+	if err != nil {
+		return nil
+	}
+	h := msg.Header
+	id, post, archive := h.Get("List-Id"), h.Get("List-Post"), h.Get("List-Archive")
+	if id == "" && post == "" && archive == "" {
+		switch strings.ToLower(strings.TrimSpace(stripComments(h.Get("Precedence")))) {
+		case "list", "bulk":
+			return &MailingList{}
+		}
+		return nil
+	}
+	l := &MailingList{ID: listID(id), Archive: firstOf(bracketed(archive))}
+	for _, raw := range bracketed(post) {
+		u, err := url.Parse(raw)
+		if err != nil || !strings.EqualFold(u.Scheme, "mailto") {
+			continue
+		}
+		if addr, err := url.PathUnescape(u.Opaque); err == nil && ValidateAddress(addr) == nil {
+			l.Post = addr
+			break
+		}
+	}
+	return l
+}
+
+// listID extracts the identifier of a List-Id header, "<users.example.org>"
+// after an optional phrase.  A bare identifier, as some list managers sent
+// before RFC 2919, is accepted too.
+func listID(v string) string {
+	if ids := bracketed(v); len(ids) > 0 {
+		return strings.ToLower(ids[0])
+	}
+	if v = strings.TrimSpace(stripComments(v)); v != "" && !strings.ContainsFunc(v, unicode.IsSpace) && !strings.ContainsAny(v, `"<>`) {
+		return strings.ToLower(v)
+	}
+	return ""
+}
+
+// bracketed returns the contents of the angle brackets of a header value,
+// in order, skipping those inside comments and quoted strings.  Whitespace
+// within brackets, left by folding, is dropped (RFC 2369).
+func bracketed(v string) []string {
+	var out []string
+	var cur strings.Builder
+	depth, quoted, inAngle := 0, false, false
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case inAngle:
+			switch {
+			case c == '>':
+				if s := cur.String(); s != "" {
+					out = append(out, s)
+				}
+				cur.Reset()
+				inAngle = false
+			case c != ' ' && c != '\t' && c != '\r' && c != '\n':
+				cur.WriteByte(c)
+			}
+		case c == '\\' && (quoted || depth > 0):
+			i++ // quoted pair
+		case quoted:
+			quoted = c != '"'
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == '"':
+			quoted = true
+		case c == '<':
+			inAngle = true
+		}
+	}
+	return out
+}
+
+// stripComments removes the comments of a header value, nested ones
+// included, leaving quoted strings as they are.
+func stripComments(v string) string {
+	var b strings.Builder
+	depth, quoted := 0, false
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '\\' && (quoted || depth > 0):
+			if quoted {
+				b.WriteString(v[i:min(i+2, len(v))])
+			}
+			i++
+		case quoted:
+			b.WriteByte(c)
+			quoted = c != '"'
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		default:
+			b.WriteByte(c)
+			quoted = c == '"'
+		}
+	}
+	return b.String()
+}
+
+func firstOf(s []string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
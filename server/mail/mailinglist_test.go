@@ -0,0 +1,50 @@
+package mail
+
+import "testing"
+
+func TestParseMailingList(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   *MailingList
+	}{
+		{"personal", "From: alice@example.com\r\nSubject: hi", nil},
+		{"list-id", "List-Id: <users.example.org>", &MailingList{ID: "users.example.org"}},
+		{"phrase", "List-Id: Example Users <Users.Example.ORG>", &MailingList{ID: "users.example.org"}},
+		{"quoted phrase with brackets", `List-Id: "Users <not this>" <users.example.org>`, &MailingList{ID: "users.example.org"}},
+		{"comments", "List-Id: (archived <nope>) Users (the (main) one) <users.example.org> (trailing)", &MailingList{ID: "users.example.org"}},
+		{"escaped comment", `List-Id: (a \) <nope>) <users.example.org>`, &MailingList{ID: "users.example.org"}},
+		{"bare", "List-Id: users.example.org (legacy)", &MailingList{ID: "users.example.org"}},
+		{"folded", "List-Id: Example Users\r\n <users.example.org>", &MailingList{ID: "users.example.org"}},
+		{"post", "List-Id: <users.example.org>\r\nList-Post: <mailto:users@example.org>", &MailingList{ID: "users.example.org", Post: "users@example.org"}},
+		{"post with query and comment", "List-Post: <mailto:users@example.org?subject=post> (Posting)", &MailingList{Post: "users@example.org"}},
+		{"post after a web url", "List-Post: <https://example.org/post>, <mailto:users%2Bpost@example.org>", &MailingList{Post: "users+post@example.org"}},
+		{"post folded inside brackets", "List-Post: <mailto:users@\r\n example.org>", &MailingList{Post: "users@example.org"}},
+		{"posting not allowed", "List-Id: <news.example.org>\r\nList-Post: NO (posting not allowed on this list)", &MailingList{ID: "news.example.org"}},
+		{"archive", "List-Archive: <https://lists.example.org/archive/users/> (Web Archive)", &MailingList{Archive: "https://lists.example.org/archive/users/"}},
+		{"precedence list", "Precedence: list", &MailingList{}},
+		{"precedence bulk", "Precedence: Bulk (newsletter)", &MailingList{}},
+		{"precedence junk", "Precedence: junk", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseMailingList(tt.header)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil || *got != *tt.want:
+				t.Errorf("want %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParsePreview_MailingList(t *testing.T) {
+	raw := "From: list-bounces@example.org\r\nList-Id: Users <users.example.org>\r\nList-Post: <mailto:users@example.org>\r\n\r\nbody"
+	msg := ParsePreview(1, raw)
+	if msg.List == nil || msg.List.ID != "users.example.org" || msg.List.Post != "users@example.org" {
+		t.Errorf("List: got %+v", msg.List)
+	}
+	if msg := ParsePreview(2, "From: alice@example.com\r\n\r\nList-Id: <not.a.header>"); msg.List != nil {
+		t.Errorf("a List-Id in the body must not count, got %+v", msg.List)
+	}
+}
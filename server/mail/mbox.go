@@ -0,0 +1,31 @@
+package mail
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+)
+
+// WriteMbox appends raw to w as one mboxrd message: a "From " separator
+// line naming sender and date, the message with LF line endings and every
+// line matching ">*From " quoted with one more '>', and a blank line.  An
+// empty sender is written as MAILER-DAEMON.
+func WriteMbox(w io.Writer, sender string, date time.Time, raw string) error {
+	if sender == "" || strings.ContainsAny(sender, " \t\r\n") {
+		sender = "MAILER-DAEMON"
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString("From " + sender + " " + date.UTC().Format(time.ANSIC) + "\n")
+
+	raw = strings.TrimRight(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	for _, line := range strings.Split(raw, "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			bw.WriteByte('>')
+		}
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
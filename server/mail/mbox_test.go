@@ -0,0 +1,36 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMbox(t *testing.T) {
+	var b strings.Builder
+	date := time.Date(2006, 1, 2, 15, 4, 5, 0, time.FixedZone("", -7*3600))
+	raw := "From: a@example.com\r\nSubject: hi\r\n\r\nFrom here on\r\n>From quoted\r\nfine\r\n"
+	if err := WriteMbox(&b, "a@example.com", date, raw); err != nil {
+		t.Fatalf("WriteMbox: %v", err)
+	}
+	if err := WriteMbox(&b, "", date, "Subject: second\n\nbody"); err != nil {
+		t.Fatalf("WriteMbox: %v", err)
+	}
+
+	want := "From a@example.com Mon Jan  2 22:04:05 2006\n" +
+		"From: a@example.com\n" +
+		"Subject: hi\n" +
+		"\n" +
+		">From here on\n" +
+		">>From quoted\n" +
+		"fine\n" +
+		"\n" +
+		"From MAILER-DAEMON Mon Jan  2 22:04:05 2006\n" +
+		"Subject: second\n" +
+		"\n" +
+		"body\n" +
+		"\n"
+	if b.String() != want {
+		t.Errorf("mbox:\nwant %q\n got %q", want, b.String())
+	}
+}
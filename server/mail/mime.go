@@ -0,0 +1,153 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ErrPartNotFound is returned by FindPart when no MIME part matches.
+var ErrPartNotFound = errors.New("mime part not found")
+
+// Part is a single leaf MIME part of a message.
+type Part struct {
+	Index       int    // 0-based position among the message's leaf parts
+	ContentType string // media type, e.g. "application/pdf"
+	Filename    string // from Content-Disposition or Content-Type name=
+	ContentID   string // without angle brackets
+	Attachment  bool   // Content-Disposition is attachment
+	Size        int    // size of the encoded body in bytes
+	Body        io.Reader
+}
+
+// FindPart locates a leaf MIME part in a raw RFC 5322 message.  selector is
+// either a decimal leaf index (depth-first, starting at 0) or a Content-ID,
+// with or without angle brackets.  The returned Body yields the part with
+// its Content-Transfer-Encoding removed.
+func FindPart(raw, selector string) (*Part, error) {
+	want := -1
+	if n, err := strconv.Atoi(selector); err == nil && n >= 0 {
+		want = n
+	}
+	cid := strings.Trim(selector, "<>")
+	return findLeaf(raw, func(p *Part) bool {
+		if want >= 0 {
+			return p.Index == want
+		}
+		return p.ContentID != "" && p.ContentID == cid
+	})
+}
+
+// FindBody returns the first leaf part of a raw message with the given
+// media type, such as "text/html", that is not an attachment.
+func FindBody(raw, mediaType string) (*Part, error) {
+	return findLeaf(raw, func(p *Part) bool {
+		return p.ContentType == mediaType && !p.Attachment
+	})
+}
+
+// findLeaf returns the first leaf part of raw that match accepts.
+func findLeaf(raw string, match func(*Part) bool) (*Part, error) {
+	msg, err := netmail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("parse message: %w", err)
+	}
+	w := &partWalker{}
+	found, err := w.walk(textproto.MIMEHeader(msg.Header), msg.Body, match)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrPartNotFound
+	}
+	return found, nil
+}
+
+// partWalker numbers leaf parts as it descends a multipart tree.
+type partWalker struct {
+	next int
+}
+
+func (w *partWalker) walk(h textproto.MIMEHeader, body io.Reader, match func(*Part) bool) (*Part, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("read multipart: %w", err)
+			}
+			found, err := w.walk(p.Header, p, match)
+			if err != nil || found != nil {
+				return found, err
+			}
+		}
+	}
+
+	disposition, _, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	part := &Part{
+		Index:       w.next,
+		ContentType: mediaType,
+		Filename:    partFilename(h, params),
+		ContentID:   strings.Trim(h.Get("Content-Id"), "<> "),
+		Attachment:  disposition == "attachment",
+	}
+	w.next++
+	if !match(part) {
+		_, err := io.Copy(io.Discard, body)
+		return nil, err
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("read part: %w", err)
+	}
+	part.Size = len(content)
+	part.Body = decodeTransfer(h.Get("Content-Transfer-Encoding"), bytes.NewReader(content))
+	return part, nil
+}
+
+// partFilename prefers the Content-Disposition filename and falls back to
+// the legacy Content-Type name parameter, decoding RFC 2047 encoded-words.
+func partFilename(h textproto.MIMEHeader, ctParams map[string]string) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = ctParams["name"]
+	}
+	dec := new(mime.WordDecoder)
+	if decoded, err := dec.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return name
+}
+
+// decodeTransfer wraps r to undo the given Content-Transfer-Encoding.
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r) // skips CR/LF itself
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r // 7bit, 8bit, binary
+	}
+}
@@ -0,0 +1,122 @@
+package mail
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const multipartMessage = "From: a@example.com\r\n" +
+	"Subject: report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=C3=A9\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>cafe</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"legacy.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"=?UTF-8?Q?r=C3=A9sum=C3=A9.pdf?=\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-ID: <doc@example.com>\r\n" +
+	"\r\n" +
+	"JVBERi0x\r\n" +
+	"LjQK\r\n" +
+	"--outer--\r\n"
+
+func TestFindPart_ByIndex(t *testing.T) {
+	testCases := []struct {
+		selector    string
+		contentType string
+		body        string
+	}{
+		{"0", "text/plain", "café"},
+		{"1", "text/html", "<p>cafe</p>"},
+		{"2", "application/pdf", "%PDF-1.4\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.selector, func(t *testing.T) {
+			part, err := FindPart(multipartMessage, tc.selector)
+			if err != nil {
+				t.Fatalf("FindPart failed: %v", err)
+			}
+			if part.ContentType != tc.contentType {
+				t.Errorf("ContentType: want %q, got %q", tc.contentType, part.ContentType)
+			}
+			body, err := io.ReadAll(part.Body)
+			if err != nil {
+				t.Fatalf("read body: %v", err)
+			}
+			if string(body) != tc.body {
+				t.Errorf("body: want %q, got %q", tc.body, string(body))
+			}
+		})
+	}
+}
+
+func TestFindPart_ByContentID(t *testing.T) {
+	for _, selector := range []string{"doc@example.com", "<doc@example.com>"} {
+		part, err := FindPart(multipartMessage, selector)
+		if err != nil {
+			t.Fatalf("FindPart(%q) failed: %v", selector, err)
+		}
+		if part.Index != 2 {
+			t.Errorf("Index: want 2, got %d", part.Index)
+		}
+		if part.Filename != "résumé.pdf" {
+			t.Errorf("Filename: want %q, got %q", "résumé.pdf", part.Filename)
+		}
+	}
+}
+
+func TestFindPart_NotFound(t *testing.T) {
+	for _, selector := range []string{"3", "missing@example.com"} {
+		if _, err := FindPart(multipartMessage, selector); !errors.Is(err, ErrPartNotFound) {
+			t.Errorf("FindPart(%q): want ErrPartNotFound, got %v", selector, err)
+		}
+	}
+}
+
+func TestFindPart_SinglePart(t *testing.T) {
+	raw := "Subject: hi\r\n\r\nplain body"
+	part, err := FindPart(raw, "0")
+	if err != nil {
+		t.Fatalf("FindPart failed: %v", err)
+	}
+	body, _ := io.ReadAll(part.Body)
+	if part.ContentType != "text/plain" || !strings.HasPrefix(string(body), "plain body") {
+		t.Errorf("unexpected part %q: %q", part.ContentType, body)
+	}
+}
+
+func TestFindBody(t *testing.T) {
+	for _, tc := range []struct{ mediaType, want string }{
+		{"text/html", "<p>cafe</p>"},
+		{"text/plain", "café"},
+	} {
+		part, err := FindBody(multipartMessage, tc.mediaType)
+		if err != nil {
+			t.Fatalf("FindBody(%q) failed: %v", tc.mediaType, err)
+		}
+		body, _ := io.ReadAll(part.Body)
+		if got := strings.TrimSpace(string(body)); got != tc.want {
+			t.Errorf("FindBody(%q): want %q, got %q", tc.mediaType, tc.want, got)
+		}
+	}
+	// The PDF is an attachment, not a body.
+	if _, err := FindBody(multipartMessage, "application/pdf"); !errors.Is(err, ErrPartNotFound) {
+		t.Errorf("attachment: want ErrPartNotFound, got %v", err)
+	}
+}
@@ -2,9 +2,15 @@ package mail
 
 import (
 	"bufio"
+	"context"
+	"crypto/md5"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -15,26 +21,127 @@ type POP3Config struct {
 	Host   string
 	Port   int
 	User   string
-	Pass   string
+	Pass   []byte // zeroed by the client once Auth returns or on Close
 	UseSSL bool
+	Dialer Dialer // nil = direct connection
+
+	AuthMechanism string // POP3AuthUser (default), POP3AuthAPOP or POP3AuthAuto
+	APOPFallback  bool   // try USER/PASS when APOP is rejected or not offered
+
+	Trace *Trace // records the session; nil = no trace
+}
+
+// POP3 authentication mechanisms for POP3Config.AuthMechanism.
+const (
+	POP3AuthUser = "user" // USER/PASS
+	POP3AuthAPOP = "apop" // APOP only; the password never crosses the wire
+	POP3AuthAuto = "auto" // APOP when the greeting offers it, USER/PASS otherwise
+)
+
+// ValidatePOP3AuthMechanism reports whether m names a POP3 authentication
+// mechanism.  The empty string selects the default.
+func ValidatePOP3AuthMechanism(m string) error {
+	switch m {
+	case "", POP3AuthUser, POP3AuthAPOP, POP3AuthAuto:
+		return nil
+	}
+	return fmt.Errorf("unknown POP3 auth mechanism %q (want %s, %s or %s)", m, POP3AuthUser, POP3AuthAPOP, POP3AuthAuto)
+}
+
+// POP3Error is a -ERR reply from the server.
+type POP3Error struct {
+	Reply string // the reply line, "-ERR" included
+}
+
+func (e *POP3Error) Error() string {
+	return "pop3: " + e.Reply
+}
+
+// ErrNotSupported is returned, without a round trip, for a command whose
+// capability is missing from the server's CAPA reply.
+var ErrNotSupported = errors.New("pop3: not supported by the server")
+
+// POP3Capabilities is a server's CAPA reply (RFC 2449): upper-cased
+// capability names mapped to their arguments, such as "SASL" to
+// ["PLAIN", "LOGIN"].
+type POP3Capabilities map[string][]string
+
+// Has reports whether the server advertised capability name.
+func (c POP3Capabilities) Has(name string) bool {
+	_, ok := c[strings.ToUpper(name)]
+	return ok
+}
+
+// List returns the capabilities as sorted CAPA lines, arguments included.
+func (c POP3Capabilities) List() []string {
+	lines := make([]string, 0, len(c))
+	for name, args := range c {
+		lines = append(lines, strings.Join(append([]string{name}, args...), " "))
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// parseCAPA parses the lines of a CAPA reply.
+func parseCAPA(lines []string) POP3Capabilities {
+	caps := make(POP3Capabilities, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		caps[strings.ToUpper(fields[0])] = fields[1:]
+	}
+	return caps
 }
 
 // Message is a lightweight representation of an email, used both for inbox
 // previews (From/Subject/Date only) and full retrieval (Body populated).
+// Date keeps the raw header; DateParsed holds its normalised form and is
+// zero when the header could not be parsed.
 type Message struct {
-	ID      int    `json:"id"`
-	Size    int    `json:"size"`
-	From    string `json:"from,omitempty"`
-	Subject string `json:"subject,omitempty"`
-	Date    string `json:"date,omitempty"`
-	Body    string `json:"body,omitempty"`
+	ID         int       `json:"id"`
+	Size       int       `json:"size"`
+	From       string    `json:"from,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	Date       string    `json:"date,omitempty"`
+	DateParsed time.Time `json:"date_parsed,omitzero"`
+	Body       string    `json:"body,omitempty"`
+	Snippet    string    `json:"snippet,omitempty"` // see Snippet; set when the body was fetched
+	Bounce     *Bounce   `json:"bounce,omitempty"`  // set by the caller from ParseBounce
+
+	// List is set when the headers show the message was sent through a
+	// mailing list; see MailingList.
+	List *MailingList `json:"list,omitempty"`
+
+	// DeliveryReport is set by Top when the headers announce a delivery
+	// status notification; ParseBounce on the full message yields Bounce.
+	DeliveryReport bool `json:"-"`
+
+	// PreviewSkipped is set by the caller when the message is listed by its
+	// size alone, without fetching its headers.
+	PreviewSkipped bool `json:"preview_skipped,omitempty"`
+
+	// Duplicates counts the other copies of the message Dedup left out.
+	Duplicates int `json:"duplicates,omitempty"`
+
+	dedupKey string // see DedupKey
 }
 
-// POP3Client speaks the POP3 protocol over a single TCP connection.
+// POP3Client speaks the POP3 protocol over a single TCP connection.  Methods
+// that talk to the server take a context; cancelling it aborts the exchange
+// in progress and closes the connection.  A client is safe for use by
+// several goroutines: each exchange holds the session lock, so concurrent
+// calls run one after another.
 type POP3Client struct {
-	cfg    POP3Config
-	conn   net.Conn
-	reader *bufio.Reader
+	session
+	cfg       POP3Config
+	conn      net.Conn
+	reader    *bufio.Reader
+	timestamp string // APOP timestamp from the greeting, "" if none
+
+	caps      POP3Capabilities // CAPA reply in the current session state; nil if CAPA is unsupported
+	capaAsked bool             // CAPA has been sent in the current session state
 }
 
 func NewPOP3Client(cfg POP3Config) *POP3Client {
@@ -42,45 +149,211 @@ func NewPOP3Client(cfg POP3Config) *POP3Client {
 }
 
 // Connect opens the TCP (or TLS) connection and reads the server greeting.
-func (c *POP3Client) Connect() error {
-	addr := fmt.Sprintf("%s:%d", c.cfg.Host, c.cfg.Port)
-	var err error
+func (c *POP3Client) Connect(ctx context.Context) error {
+	c.lock()
+	defer c.unlock()
 
-	if c.cfg.UseSSL {
-		c.conn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: c.cfg.Host})
-	} else {
-		c.conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
-	}
+	addr := net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port))
+	conn, err := dial(ctx, c.cfg.Dialer, addr, c.cfg.Host, c.cfg.UseSSL)
 	if err != nil {
 		return fmt.Errorf("pop3 connect %s: %w", addr, err)
 	}
+	c.conn = conn
 	c.reader = bufio.NewReader(c.conn)
 
-	// Consume server greeting line.
-	if _, err := c.readResponse(); err != nil {
+	// Read the server greeting, which carries the APOP timestamp.
+	err = withConn(ctx, c.conn, func() error {
+		greeting, err := c.readResponse()
+		c.timestamp = apopTimestamp(greeting)
+		return err
+	})
+	if err != nil {
 		c.conn.Close()
 		return fmt.Errorf("pop3 greeting: %w", err)
 	}
 	return nil
 }
 
-// Auth performs USER/PASS authentication.
-func (c *POP3Client) Auth() error {
+// Auth authenticates with the configured mechanism: USER/PASS, or APOP
+// (RFC 1939), which sends a digest of the greeting's timestamp and the
+// password instead of the password itself.  USER/PASS is only tried after
+// APOP when APOPFallback is set.  On a plaintext connection Auth first
+// upgrades to TLS when the server offers STLS.  The password is zeroed when
+// Auth returns, so a client authenticates at most once.
+func (c *POP3Client) Auth(ctx context.Context) error {
+	c.lock()
+	defer c.unlock()
+	defer clear(c.cfg.Pass)
+	// The STLS upgrade layers the TLS session on the raw connection, so
+	// binding ctx to it covers both phases.
+	return withConn(ctx, c.conn, func() error {
+		if !c.cfg.UseSSL {
+			if err := c.startTLS(ctx); err != nil {
+				return err
+			}
+		}
+		if err := c.authenticate(); err != nil {
+			return err
+		}
+		// Servers may advertise different capabilities once a user is
+		// logged in (RFC 2449), so ask again when they are next needed.
+		c.caps, c.capaAsked = nil, false
+		return nil
+	})
+}
+
+// authenticate runs the configured authentication mechanism.
+func (c *POP3Client) authenticate() error {
+	switch c.cfg.AuthMechanism {
+	case POP3AuthAPOP, POP3AuthAuto:
+		if c.timestamp == "" && c.cfg.AuthMechanism == POP3AuthAuto {
+			break // APOP not offered
+		}
+		err := c.apop()
+		var rejected *POP3Error
+		switch {
+		case err == nil:
+			return nil
+		case !c.cfg.APOPFallback:
+			return err
+		case c.timestamp != "" && !errors.As(err, &rejected):
+			return err // the connection failed; the server did not refuse APOP
+		}
+	}
+	return c.userPass()
+}
+
+// startTLS upgrades a plaintext session with STLS (RFC 2595) when the
+// server's capabilities include it.  A server that refuses STLS is used
+// unencrypted, like one that does not offer it; a failed TLS handshake
+// fails the session.
+func (c *POP3Client) startTLS(ctx context.Context) error {
+	caps, err := c.capabilities()
+	if err != nil {
+		return fmt.Errorf("pop3 CAPA: %w", err)
+	}
+	if !caps.Has("STLS") {
+		return nil
+	}
+	if _, err := c.cmd("STLS"); err != nil {
+		var refused *POP3Error
+		if errors.As(err, &refused) {
+			return nil
+		}
+		return fmt.Errorf("pop3 STLS: %w", err)
+	}
+	tlsConn := tls.Client(c.conn, &tls.Config{ServerName: c.cfg.Host})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("pop3 TLS handshake: %w", err)
+	}
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	c.cfg.Trace.notef("TLS established: %s", tls.VersionName(tlsConn.ConnectionState().Version))
+	// Capabilities learnt before the upgrade must be discarded (RFC 2595).
+	c.caps, c.capaAsked = nil, false
+	return nil
+}
+
+// apop authenticates with APOP.
+func (c *POP3Client) apop() error {
+	if c.timestamp == "" {
+		return errors.New("pop3 APOP: server greeting has no timestamp")
+	}
+	digest := apopDigest(c.timestamp, c.cfg.Pass)
+	if _, err := c.cmdSecret("APOP "+c.cfg.User+" ", []byte(digest)); err != nil {
+		return fmt.Errorf("pop3 APOP: %w", err)
+	}
+	return nil
+}
+
+// userPass authenticates with USER and PASS.
+func (c *POP3Client) userPass() error {
 	if _, err := c.cmd("USER " + c.cfg.User); err != nil {
 		return fmt.Errorf("pop3 USER: %w", err)
 	}
-	if _, err := c.cmd("PASS " + c.cfg.Pass); err != nil {
+	if _, err := c.cmdSecret("PASS ", c.cfg.Pass); err != nil {
 		return fmt.Errorf("pop3 PASS: %w", err)
 	}
 	return nil
 }
 
-// List returns every message in the mailbox with its index and size.
-func (c *POP3Client) List() ([]Message, error) {
-	if _, err := c.cmd("LIST"); err != nil {
+// apopTimestamp extracts the <process-id.clock@hostname> timestamp a server
+// offering APOP puts in its greeting.
+func apopTimestamp(greeting string) string {
+	start := strings.IndexByte(greeting, '<')
+	if start < 0 {
+		return ""
+	}
+	end := strings.IndexByte(greeting[start:], '>')
+	if end < 0 {
+		return ""
+	}
+	ts := greeting[start : start+end+1]
+	if !strings.Contains(ts, "@") || strings.ContainsAny(ts, " \t") {
+		return ""
+	}
+	return ts
+}
+
+// apopDigest returns the hex MD5 of timestamp followed by the password.
+func apopDigest(timestamp string, pass []byte) string {
+	h := md5.New()
+	h.Write([]byte(timestamp))
+	h.Write(pass)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Capabilities returns the server's capabilities, sending CAPA the first
+// time they are needed in each session state.  A server without CAPA yields
+// nil and no error; commands are then attempted as if supported.
+func (c *POP3Client) Capabilities(ctx context.Context) (POP3Capabilities, error) {
+	c.lock()
+	defer c.unlock()
+	var caps POP3Capabilities
+	err := withConn(ctx, c.conn, func() (err error) {
+		caps, err = c.capabilities()
+		return err
+	})
+	return caps, err
+}
+
+func (c *POP3Client) capabilities() (POP3Capabilities, error) {
+	c.mustHold("POP3")
+	if c.capaAsked {
+		return c.caps, nil
+	}
+	if _, err := c.cmd("CAPA"); err != nil {
+		var unsupported *POP3Error
+		if errors.As(err, &unsupported) {
+			c.capaAsked = true
+			return nil, nil
+		}
 		return nil, err
 	}
-	lines, err := c.readDot()
+	lines, err := c.readDot(false)
+	if err != nil {
+		return nil, err
+	}
+	c.caps, c.capaAsked = parseCAPA(lines), true
+	return c.caps, nil
+}
+
+// require fails with ErrNotSupported when the server's capabilities are
+// known and lack name.
+func (c *POP3Client) require(ctx context.Context, name string) error {
+	caps, err := c.Capabilities(ctx)
+	if err != nil {
+		return err
+	}
+	if caps != nil && !caps.Has(name) {
+		return fmt.Errorf("%w: %s", ErrNotSupported, name)
+	}
+	return nil
+}
+
+// List returns every message in the mailbox with its index and size.
+func (c *POP3Client) List(ctx context.Context) ([]Message, error) {
+	lines, err := c.multiline(ctx, "LIST", false)
 	if err != nil {
 		return nil, err
 	}
@@ -101,61 +374,229 @@ func (c *POP3Client) List() ([]Message, error) {
 // Top fetches the headers (and optionally the first bodyLines lines) of a
 // message without downloading the whole thing.  It returns a Message with
 // From/Subject/Date parsed out of the headers.
-func (c *POP3Client) Top(id, bodyLines int) (*Message, error) {
-	if _, err := c.cmd(fmt.Sprintf("TOP %d %d", id, bodyLines)); err != nil {
+func (c *POP3Client) Top(ctx context.Context, id, bodyLines int) (*Message, error) {
+	if err := c.require(ctx, "TOP"); err != nil {
 		return nil, err
 	}
-	lines, err := c.readDot()
+	lines, err := c.multiline(ctx, fmt.Sprintf("TOP %d %d", id, bodyLines), true)
 	if err != nil {
 		return nil, err
 	}
 	content := strings.Join(lines, "\r\n")
-	h := parseHeaders(content)
+	msg := ParsePreview(id, content)
+	if bodyLines > 0 {
+		if parts := strings.SplitN(content, "\r\n\r\n", 2); len(parts) == 2 {
+			msg.Body = parts[1]
+		}
+	}
+	return msg, nil
+}
 
+// ParsePreview reads a message's From, Subject, Date and mailing list
+// headers as Top does, from the headers alone or from the whole message as
+// Retrieve returns it, and its Snippet from whatever of the body there is.
+func ParsePreview(id int, raw string) *Message {
+	h := parseHeaders(raw)
 	msg := &Message{
 		ID:      id,
 		From:    h["from"],
 		Subject: h["subject"],
 		Date:    h["date"],
 	}
-	if bodyLines > 0 {
-		if parts := strings.SplitN(content, "\r\n\r\n", 2); len(parts) == 2 {
-			msg.Body = parts[1]
+	msg.DateParsed, _ = ParseDate(msg.Date)
+	msg.DeliveryReport = isDeliveryReport(raw)
+	msg.List = parseMailingList(raw)
+	msg.dedupKey = dedupKey(h)
+	msg.Snippet = Snippet(raw)
+	return msg
+}
+
+// UIDL returns the server's unique, session-independent identifier for the
+// message.  Unlike the message number it stays stable across sessions, so it
+// is suitable as a cache key.
+func (c *POP3Client) UIDL(ctx context.Context, id int) (string, error) {
+	if err := c.require(ctx, "UIDL"); err != nil {
+		return "", err
+	}
+	c.lock()
+	defer c.unlock()
+	var resp string
+	err := withConn(ctx, c.conn, func() (err error) {
+		resp, err = c.cmd(fmt.Sprintf("UIDL %d", id))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	// +OK <id> <uid>
+	fields := strings.Fields(resp)
+	if len(fields) != 3 {
+		return "", fmt.Errorf("pop3: malformed UIDL response %q", resp)
+	}
+	return fields[2], nil
+}
+
+// UIDLs returns the unique id of every message in the maildrop, keyed by
+// message number, using a single multi-line UIDL command.
+func (c *POP3Client) UIDLs(ctx context.Context) (map[int]string, error) {
+	if err := c.require(ctx, "UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := c.multiline(ctx, "UIDL", false)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make(map[int]string, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
 		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		uids[id] = fields[1]
 	}
-	return msg, nil
+	return uids, nil
 }
 
 // Retrieve downloads the complete raw message.
-func (c *POP3Client) Retrieve(id int) (string, error) {
-	if _, err := c.cmd(fmt.Sprintf("RETR %d", id)); err != nil {
-		return "", err
-	}
-	lines, err := c.readDot()
+func (c *POP3Client) Retrieve(ctx context.Context, id int) (string, error) {
+	lines, err := c.multiline(ctx, fmt.Sprintf("RETR %d", id), true)
 	if err != nil {
 		return "", err
 	}
 	return strings.Join(lines, "\r\n"), nil
 }
 
+// RetrieveTo copies message id to w as it arrives, in the form Retrieve
+// returns it, so that a large message is never held in memory whole.  It
+// returns the bytes written.  When w fails the rest of the reply is still
+// read and discarded, keeping the session usable, and w's error returned.
+func (c *POP3Client) RetrieveTo(ctx context.Context, id int, w io.Writer) (n int64, err error) {
+	c.lock()
+	defer c.unlock()
+	err = withConn(ctx, c.conn, func() error {
+		if _, err := c.cmd(fmt.Sprintf("RETR %d", id)); err != nil {
+			return err
+		}
+		var werr error
+		for first, count := true, 0; ; first, count = false, count+1 {
+			line, err := c.readLine()
+			if err != nil {
+				return err
+			}
+			if line == "." {
+				c.cfg.Trace.notef("[message: %d lines]", count)
+				c.cfg.Trace.received(".")
+				return werr
+			}
+			if werr != nil {
+				continue
+			}
+			if strings.HasPrefix(line, "..") {
+				line = line[1:] // dot-unstuff
+			}
+			if !first {
+				line = "\r\n" + line
+			}
+			m, err := io.WriteString(w, line)
+			n += int64(m)
+			werr = err
+		}
+	})
+	return n, err
+}
+
+// Dele marks the message for deletion.  The server removes it only when the
+// session ends with QUIT (see Close); until then message numbers stay
+// stable and a dropped connection deletes nothing.
+func (c *POP3Client) Dele(ctx context.Context, id int) error {
+	c.lock()
+	defer c.unlock()
+	return withConn(ctx, c.conn, func() error {
+		if _, err := c.cmd(fmt.Sprintf("DELE %d", id)); err != nil {
+			return fmt.Errorf("pop3 DELE: %w", err)
+		}
+		return nil
+	})
+}
+
+// Noop sends NOOP, checking that the connection is still alive and resetting
+// the server's idle timer.
+func (c *POP3Client) Noop(ctx context.Context) error {
+	c.lock()
+	defer c.unlock()
+	return withConn(ctx, c.conn, func() error {
+		if _, err := c.cmd("NOOP"); err != nil {
+			return fmt.Errorf("pop3 NOOP: %w", err)
+		}
+		return nil
+	})
+}
+
 // Close sends QUIT and tears down the connection.
 func (c *POP3Client) Close() error {
+	c.lock()
+	defer c.unlock()
+	clear(c.cfg.Pass)
 	if c.conn == nil {
 		return nil
 	}
-	c.cmd("QUIT") //nolint:errcheck
+	c.conn.SetDeadline(time.Now().Add(quitTimeout)) //nolint:errcheck
+	c.cmd("QUIT")                                   //nolint:errcheck
 	return c.conn.Close()
 }
 
 // ---------- low-level protocol helpers ----------
 
 func (c *POP3Client) cmd(command string) (string, error) {
+	c.mustHold("POP3")
+	c.cfg.Trace.sent(command)
 	if _, err := fmt.Fprintf(c.conn, "%s\r\n", command); err != nil {
 		return "", err
 	}
 	return c.readResponse()
 }
 
+// cmdSecret is cmd for a command carrying a credential.  Should the server
+// repeat the credential or the password in its reply, it is redacted from
+// the reply, the error and the trace.
+func (c *POP3Client) cmdSecret(prefix string, secret []byte) (string, error) {
+	c.mustHold("POP3")
+	c.cfg.Trace.sentSecret(prefix)
+	if err := writeSecretLine(c.conn, prefix, secret); err != nil {
+		return "", err
+	}
+	echoes := secretEchoes(secret, c.cfg.Pass)
+	defer clearEchoes(echoes)
+	c.cfg.Trace.hide(echoes)
+	defer c.cfg.Trace.hide(nil)
+	resp, err := c.readResponse()
+	var perr *POP3Error
+	if errors.As(err, &perr) {
+		perr.Reply = redactSecrets(perr.Reply, echoes)
+	}
+	return redactSecrets(resp, echoes), err
+}
+
+// multiline sends command under ctx and reads its dot-terminated reply,
+// a message when body is set.
+func (c *POP3Client) multiline(ctx context.Context, command string, body bool) (lines []string, err error) {
+	c.lock()
+	defer c.unlock()
+	err = withConn(ctx, c.conn, func() error {
+		if _, err := c.cmd(command); err != nil {
+			return err
+		}
+		lines, err = c.readDot(body)
+		return err
+	})
+	return lines, err
+}
+
 // readResponse reads a single status line.  Returns an error if the server
 // replied with -ERR.
 func (c *POP3Client) readResponse() (string, error) {
@@ -163,8 +604,9 @@ func (c *POP3Client) readResponse() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	c.cfg.Trace.received(line)
 	if strings.HasPrefix(line, "-ERR") {
-		return "", fmt.Errorf("pop3: %s", line)
+		return "", &POP3Error{Reply: line}
 	}
 	return line, nil
 }
@@ -178,7 +620,8 @@ func (c *POP3Client) readLine() (string, error) {
 }
 
 // readDot reads a dot-terminated multi-line body, handling dot-unstuffing.
-func (c *POP3Client) readDot() ([]string, error) {
+// A trace records the lines of a message (body) only as a count.
+func (c *POP3Client) readDot(body bool) ([]string, error) {
 	var lines []string
 	for {
 		line, err := c.readLine()
@@ -186,8 +629,15 @@ func (c *POP3Client) readDot() ([]string, error) {
 			return nil, err
 		}
 		if line == "." {
+			if body {
+				c.cfg.Trace.notef("[message: %d lines]", len(lines))
+			}
+			c.cfg.Trace.received(line)
 			break
 		}
+		if !body {
+			c.cfg.Trace.received(line)
+		}
 		if strings.HasPrefix(line, "..") {
 			line = line[1:] // dot-unstuff
 		}
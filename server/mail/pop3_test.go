@@ -0,0 +1,410 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// rfc1939Timestamp and rfc1939Digest are the APOP example of RFC 1939
+// section 7, for the secret "tanstaaf".
+const (
+	rfc1939Timestamp = "<1896.697170952@dbc.mtview.ca.us>"
+	rfc1939Digest    = "c4c9334bac560ecc979e58001b3e22fb"
+)
+
+func TestAPOPDigest_RFC1939(t *testing.T) {
+	if got := apopDigest(rfc1939Timestamp, []byte("tanstaaf")); got != rfc1939Digest {
+		t.Errorf("digest: want %s, got %s", rfc1939Digest, got)
+	}
+}
+
+func TestAPOPTimestamp(t *testing.T) {
+	tests := []struct {
+		greeting string
+		want     string
+	}{
+		{"+OK POP3 server ready " + rfc1939Timestamp, rfc1939Timestamp},
+		{"+OK <1.2@host> ready", "<1.2@host>"},
+		{"+OK POP3 server ready", ""},
+		{"+OK ready <no-at-sign>", ""},
+		{"+OK ready <unterminated@host", ""},
+		{"+OK ready <a b@host>", ""},
+	}
+	for _, tt := range tests {
+		if got := apopTimestamp(tt.greeting); got != tt.want {
+			t.Errorf("%q: want %q, got %q", tt.greeting, tt.want, got)
+		}
+	}
+}
+
+// startScriptedPOP3 serves one POP3 session that greets with greeting and
+// answers each command with the reply scripted for its verb, "+OK" when
+// there is none, and "-ERR" to CAPA unless scripted.  Replies are written
+// as given, so multi-line ones carry their own CRLFs and terminator.
+// Commands are sent on the returned channel as they arrive.
+func startScriptedPOP3(t *testing.T, greeting string, replies map[string]string) (string, int, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	cmds := make(chan string, 20)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(cmds)
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "%s\r\n", greeting)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmds <- line
+			verb, _, _ := strings.Cut(line, " ")
+			reply, ok := replies[verb]
+			switch {
+			case ok:
+			case verb == "CAPA":
+				reply = "-ERR unknown command\r\n"
+			default:
+				reply = "+OK\r\n"
+			}
+			if reply == "" {
+				return // hang up
+			}
+			fmt.Fprint(conn, reply)
+			if verb == "QUIT" {
+				return
+			}
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return host, portNum, cmds
+}
+
+// verbs drains cmds and returns the verb of each command other than CAPA
+// and QUIT.
+func verbs(cmds <-chan string) []string {
+	var got []string
+	for cmd := range cmds {
+		if verb, _, _ := strings.Cut(cmd, " "); verb != "CAPA" && verb != "QUIT" {
+			got = append(got, verb)
+		}
+	}
+	return got
+}
+
+func TestPOP3Auth_Mechanisms(t *testing.T) {
+	withTimestamp := "+OK POP3 server ready " + rfc1939Timestamp
+	tests := []struct {
+		name       string
+		greeting   string
+		acceptAPOP bool
+		mechanism  string
+		fallback   bool
+		wantErr    bool
+		wantCmds   []string // first word of each command, QUIT excluded
+	}{
+		{"default", withTimestamp, true, "", false, false, []string{"USER", "PASS"}},
+		{"apop", withTimestamp, true, POP3AuthAPOP, false, false, []string{"APOP"}},
+		{"apop rejected", withTimestamp, false, POP3AuthAPOP, false, true, []string{"APOP"}},
+		{"apop rejected with fallback", withTimestamp, false, POP3AuthAPOP, true, false, []string{"APOP", "USER", "PASS"}},
+		{"apop not offered", "+OK ready", true, POP3AuthAPOP, false, true, nil},
+		{"apop not offered with fallback", "+OK ready", true, POP3AuthAPOP, true, false, []string{"USER", "PASS"}},
+		{"auto offered", withTimestamp, true, POP3AuthAuto, false, false, []string{"APOP"}},
+		{"auto not offered", "+OK ready", true, POP3AuthAuto, false, false, []string{"USER", "PASS"}},
+		{"auto rejected", withTimestamp, false, POP3AuthAuto, false, true, []string{"APOP"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apop := "-ERR permission denied\r\n"
+			if tt.acceptAPOP {
+				apop = "+OK maildrop has 1 message\r\n"
+			}
+			host, port, cmds := startScriptedPOP3(t, tt.greeting, map[string]string{"APOP": apop})
+			ctx := context.Background()
+			client := NewPOP3Client(POP3Config{
+				Host: host, Port: port, User: "mrose", Pass: []byte("tanstaaf"),
+				AuthMechanism: tt.mechanism, APOPFallback: tt.fallback,
+			})
+			if err := client.Connect(ctx); err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			err := client.Auth(ctx)
+			client.Close()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Auth: wantErr %t, got %v", tt.wantErr, err)
+			}
+			if got := verbs(cmds); !slices.Equal(got, tt.wantCmds) {
+				t.Errorf("commands: want %v, got %v", tt.wantCmds, got)
+			}
+		})
+	}
+}
+
+func TestPOP3Auth_APOPDigest(t *testing.T) {
+	host, port, cmds := startScriptedPOP3(t, "+OK POP3 server ready "+rfc1939Timestamp, nil)
+	ctx := context.Background()
+	client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "mrose", Pass: []byte("tanstaaf"), AuthMechanism: POP3AuthAPOP})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if err := client.Auth(ctx); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	client.Close()
+	for cmd := range cmds {
+		if strings.HasPrefix(cmd, "APOP ") && cmd != "APOP mrose "+rfc1939Digest {
+			t.Errorf("want the RFC 1939 digest, got %q", cmd)
+		}
+	}
+}
+
+func TestPOP3Auth_APOPRejectionIsPOP3Error(t *testing.T) {
+	host, port, _ := startScriptedPOP3(t, "+OK "+rfc1939Timestamp, map[string]string{"APOP": "-ERR permission denied\r\n"})
+	ctx := context.Background()
+	client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "mrose", Pass: []byte("wrong"), AuthMechanism: POP3AuthAPOP})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+	var perr *POP3Error
+	if err := client.Auth(ctx); !errors.As(err, &perr) || perr.Reply != "-ERR permission denied" {
+		t.Errorf("want the server's -ERR reply, got %v", err)
+	}
+}
+
+func TestPOP3Noop(t *testing.T) {
+	host, port, cmds := startScriptedPOP3(t, "+OK ready", nil)
+	ctx := context.Background()
+	client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "u", Pass: []byte("p")})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if err := client.Noop(ctx); err != nil {
+		t.Errorf("Noop: %v", err)
+	}
+	if cmd := <-cmds; cmd != "NOOP" {
+		t.Errorf("command: want NOOP, got %q", cmd)
+	}
+	client.Close()
+	<-cmds // QUIT
+
+	// Once the server has hung up, Noop reports the dead connection.
+	if err := client.Noop(ctx); err == nil {
+		t.Error("Noop on a closed connection: expected error")
+	}
+}
+
+func TestPOP3Dele(t *testing.T) {
+	host, port, cmds := startScriptedPOP3(t, "+OK ready", map[string]string{"DELE": "-ERR no such message\r\n"})
+	ctx := context.Background()
+	client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "u", Pass: []byte("p")})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	var perr *POP3Error
+	if err := client.Dele(ctx, 7); !errors.As(err, &perr) {
+		t.Errorf("Dele: want the server's -ERR reply, got %v", err)
+	}
+	if cmd := <-cmds; cmd != "DELE 7" {
+		t.Errorf("command: want DELE 7, got %q", cmd)
+	}
+	client.Close()
+}
+
+// failAfter accepts n bytes and fails every write after that.
+type failAfter struct {
+	n   int
+	got []byte
+}
+
+func (f *failAfter) Write(p []byte) (int, error) {
+	if len(f.got)+len(p) > f.n {
+		return 0, errors.New("client went away")
+	}
+	f.got = append(f.got, p...)
+	return len(p), nil
+}
+
+func TestPOP3RetrieveTo(t *testing.T) {
+	msg := "+OK\r\nSubject: hi\r\n\r\n..dot\r\nbody\r\n.\r\n"
+	host, port, _ := startScriptedPOP3(t, "+OK ready", map[string]string{"RETR": msg})
+	ctx := context.Background()
+	client := NewPOP3Client(POP3Config{Host: host, Port: port})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+
+	want, err := client.Retrieve(ctx, 1)
+	if err != nil || want != "Subject: hi\r\n\r\n.dot\r\nbody" {
+		t.Fatalf("Retrieve: got %q, %v", want, err)
+	}
+	var b strings.Builder
+	n, err := client.RetrieveTo(ctx, 1, &b)
+	if err != nil || b.String() != want || n != int64(len(want)) {
+		t.Errorf("RetrieveTo: want %q as from Retrieve, got %q (%d bytes), %v", want, b.String(), n, err)
+	}
+
+	// A failing writer leaves the session in step with the server.
+	if _, err := client.RetrieveTo(ctx, 1, &failAfter{n: 14}); err == nil || err.Error() != "client went away" {
+		t.Errorf("failing writer: want its error, got %v", err)
+	}
+	if got, err := client.Retrieve(ctx, 1); err != nil || got != want {
+		t.Errorf("Retrieve after a failed copy: got %q, %v", got, err)
+	}
+}
+
+func TestValidatePOP3AuthMechanism(t *testing.T) {
+	for _, m := range []string{"", POP3AuthUser, POP3AuthAPOP, POP3AuthAuto} {
+		if err := ValidatePOP3AuthMechanism(m); err != nil {
+			t.Errorf("%q: %v", m, err)
+		}
+	}
+	if err := ValidatePOP3AuthMechanism("cram-md5"); err == nil {
+		t.Error("cram-md5: expected error")
+	}
+}
+
+func TestPOP3Capabilities(t *testing.T) {
+	caps := parseCAPA([]string{"TOP", "uidl", "SASL PLAIN LOGIN", "", "IMPLEMENTATION Example server"})
+	if !caps.Has("UIDL") || !caps.Has("top") || caps.Has("STLS") {
+		t.Errorf("Has: unexpected result for %v", caps)
+	}
+	want := []string{"IMPLEMENTATION Example server", "SASL PLAIN LOGIN", "TOP", "UIDL"}
+	if got := caps.List(); !slices.Equal(got, want) {
+		t.Errorf("List: want %v, got %v", want, got)
+	}
+}
+
+func TestPOP3_MissingCapabilityIsNotSent(t *testing.T) {
+	host, port, cmds := startScriptedPOP3(t, "+OK ready", map[string]string{
+		"CAPA": "+OK\r\nUSER\r\nTOP\r\n.\r\n",
+	})
+	ctx := context.Background()
+	client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "u", Pass: []byte("p")})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if _, err := client.UIDL(ctx, 1); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("UIDL: want ErrNotSupported, got %v", err)
+	}
+	if _, err := client.UIDLs(ctx); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("UIDLs: want ErrNotSupported, got %v", err)
+	}
+	client.Close()
+	if got := verbs(cmds); len(got) != 0 {
+		t.Errorf("unexpected commands: %v", got)
+	}
+}
+
+func TestPOP3_NoCAPAAttemptsCommands(t *testing.T) {
+	host, port, cmds := startScriptedPOP3(t, "+OK ready", map[string]string{
+		"UIDL": "+OK 1 abc\r\n",
+	})
+	ctx := context.Background()
+	client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "u", Pass: []byte("p")})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if caps, err := client.Capabilities(ctx); caps != nil || err != nil {
+		t.Errorf("Capabilities: want nil, nil, got %v, %v", caps, err)
+	}
+	if uid, err := client.UIDL(ctx, 1); err != nil || uid != "abc" {
+		t.Errorf("UIDL: want abc, got %q, %v", uid, err)
+	}
+	client.Close()
+	var capa int
+	for cmd := range cmds {
+		if cmd == "CAPA" {
+			capa++
+		}
+	}
+	if capa != 1 {
+		t.Errorf("CAPA sent %d times, want once", capa)
+	}
+}
+
+func TestPOP3Auth_STLS(t *testing.T) {
+	t.Run("refused", func(t *testing.T) {
+		host, port, cmds := startScriptedPOP3(t, "+OK ready", map[string]string{
+			"CAPA": "+OK\r\nSTLS\r\nUSER\r\n.\r\n",
+			"STLS": "-ERR not now\r\n",
+		})
+		ctx := context.Background()
+		client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "u", Pass: []byte("p")})
+		if err := client.Connect(ctx); err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		if err := client.Auth(ctx); err != nil {
+			t.Errorf("Auth: %v", err)
+		}
+		client.Close()
+		want := []string{"STLS", "USER", "PASS"}
+		if got := verbs(cmds); !slices.Equal(got, want) {
+			t.Errorf("commands: want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("handshake fails", func(t *testing.T) {
+		host, port, cmds := startScriptedPOP3(t, "+OK ready", map[string]string{
+			"CAPA": "+OK\r\nSTLS\r\n.\r\n",
+			"STLS": "+OK begin TLS\r\nnot a TLS record\r\n",
+		})
+		ctx := context.Background()
+		client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "u", Pass: []byte("p")})
+		if err := client.Connect(ctx); err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		if err := client.Auth(ctx); err == nil || !strings.Contains(err.Error(), "TLS handshake") {
+			t.Errorf("Auth: want a TLS handshake error, got %v", err)
+		}
+		client.Close()
+		for cmd := range cmds {
+			if verb, _, _ := strings.Cut(cmd, " "); verb == "USER" || verb == "PASS" {
+				t.Errorf("credentials sent after a failed upgrade: %q", cmd)
+			}
+		}
+	})
+}
+
+func TestPOP3Auth_RequeriesCapabilities(t *testing.T) {
+	host, port, cmds := startScriptedPOP3(t, "+OK ready", map[string]string{
+		"CAPA": "+OK\r\nUSER\r\nUIDL\r\n.\r\n",
+	})
+	ctx := context.Background()
+	client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "u", Pass: []byte("p")})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if err := client.Auth(ctx); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if _, err := client.Capabilities(ctx); err != nil {
+		t.Fatalf("Capabilities: %v", err)
+	}
+	client.Close()
+	var got []string
+	for cmd := range cmds {
+		got = append(got, cmd)
+	}
+	want := []string{"CAPA", "USER u", "PASS p", "CAPA", "QUIT"}
+	if !slices.Equal(got, want) {
+		t.Errorf("commands: want %v, got %v", want, got)
+	}
+}
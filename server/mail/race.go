@@ -0,0 +1,6 @@
+//go:build race
+
+package mail
+
+// raceEnabled turns on session ownership checks in race-detector builds.
+const raceEnabled = true
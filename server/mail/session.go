@@ -0,0 +1,52 @@
+package mail
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// session serialises use of one protocol connection.  Every exchange with
+// the server (a command and its complete reply, or a multi-command sequence
+// such as authentication) runs under lock, so goroutines sharing a client
+// can never interleave reads and writes on the connection.
+//
+// Clients embed a session and must not be copied (go vet reports copies of
+// the mutex).  Code that shares sessions, such as a pool, must hand out
+// exclusive leases on a client rather than clones sharing its connection.
+type session struct {
+	mu   sync.Mutex
+	held atomic.Bool // true while mu is held; checked by mustHold
+}
+
+func (s *session) lock() {
+	s.mu.Lock()
+	s.held.Store(true)
+}
+
+func (s *session) unlock() {
+	s.held.Store(false)
+	s.mu.Unlock()
+}
+
+// mustHold panics in race-detector builds when a low-level protocol helper
+// runs outside lock, where another goroutine could interleave with it.
+// Normal builds skip the check.
+func (s *session) mustHold(client string) {
+	if raceEnabled && !s.held.Load() {
+		panic("mail: " + client + " command sent outside its session lock")
+	}
+}
+
+// writeSecretLine writes prefix, secret and CRLF as a single write.  The line
+// is built in a scratch buffer that is zeroed afterwards, so the secret is
+// never copied into a string or left behind in a dead allocation.
+func writeSecretLine(w io.Writer, prefix string, secret []byte) error {
+	line := make([]byte, 0, len(prefix)+len(secret)+2)
+	line = append(line, prefix...)
+	line = append(line, secret...)
+	line = append(line, '\r', '\n')
+	defer clear(line)
+	_, err := w.Write(line)
+	return err
+}
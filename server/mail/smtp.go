@@ -2,12 +2,23 @@ package mail
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+
+	"mulamail/mail/dkim"
 )
 
 // SMTPConfig holds connection parameters for an SMTP submission server.
@@ -15,23 +26,177 @@ type SMTPConfig struct {
 	Host   string
 	Port   int
 	User   string
-	Pass   string
-	UseSSL bool // true = implicit TLS (port 465); false = STARTTLS (port 587/25)
+	Pass   []byte    // zeroed by the client once Auth returns or on Close
+	UseSSL bool      // true = implicit TLS (port 465); false = STARTTLS (port 587/25)
+	Dialer Dialer    // nil = direct connection
+	DKIM   dkim.Keys // signing keys by From domain; nil = no signing
+	Trace  *Trace    // records the session; nil = no trace
+
+	// HELOHostname is the name announced in EHLO and HELO; empty means
+	// "mulamail".  Check it with ValidateHostname.
+	HELOHostname string
 }
 
-// SendRequest is the payload passed to SMTPClient.Send.
+// SendRequest is the payload passed to SMTPClient.Send.  Bcc recipients
+// receive the message but never appear in its headers.  Display names only
+// ever appear in headers; the envelope always uses bare addresses.
 type SendRequest struct {
-	From    string
-	To      []string
-	Subject string
-	Body    string
+	From         string
+	FromName     string // optional display name for the From header
+	EnvelopeFrom string // MAIL FROM address (the bounce address); empty = From
+	To           []Address
+	Cc           []Address
+	Bcc          []Address
+	Subject      string
+	Body         string
+	HTML         string // optional HTML alternative of Body
+	Attachments  []Attachment
+
+	// ListUnsubscribe holds the List-Unsubscribe URLs (RFC 2369), a mailto:
+	// and/or an https: one; ListUnsubscribePost announces that the https:
+	// one accepts RFC 8058 one-click unsubscribe POSTs.  Check them with
+	// ValidateListUnsubscribe.
+	ListUnsubscribe     []string
+	ListUnsubscribePost bool
+
+	// DSN, when set, requests delivery status notifications; see DSN.
+	DSN *DSN
+}
+
+// EnvelopeSender returns the address sent as MAIL FROM, where bounces go.
+func (r SendRequest) EnvelopeSender() string {
+	if r.EnvelopeFrom != "" {
+		return r.EnvelopeFrom
+	}
+	return r.From
+}
+
+// Recipients returns every envelope recipient address: To, then Cc, then Bcc.
+func (r SendRequest) Recipients() []string {
+	all := make([]string, 0, len(r.To)+len(r.Cc)+len(r.Bcc))
+	all = append(all, Emails(r.To)...)
+	all = append(all, Emails(r.Cc)...)
+	return append(all, Emails(r.Bcc)...)
+}
+
+// internationalised reports whether any address of r, in the envelope or
+// the headers, is not ASCII.
+func (r SendRequest) internationalised() bool {
+	if !isASCII(r.From) {
+		return true
+	}
+	for _, addr := range append(r.Recipients(), r.EnvelopeSender()) {
+		if !isASCII(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// asciiForm returns r with every address in ASCII form, for a server
+// without SMTPUTF8; see ToASCII.
+func (r SendRequest) asciiForm() (SendRequest, error) {
+	var err error
+	if r.From, err = ToASCII(r.From); err != nil {
+		return r, err
+	}
+	if r.EnvelopeFrom != "" {
+		if r.EnvelopeFrom, err = ToASCII(r.EnvelopeFrom); err != nil {
+			return r, err
+		}
+	}
+	for _, list := range []*[]Address{&r.To, &r.Cc, &r.Bcc} {
+		ascii := make([]Address, len(*list))
+		for i, a := range *list {
+			if a.Email, err = ToASCII(a.Email); err != nil {
+				return r, err
+			}
+			ascii[i] = a
+		}
+		*list = ascii
+	}
+	return r, nil
+}
+
+// SendResult describes an accepted message.
+type SendResult struct {
+	MessageID string // Message-ID header generated for the message, with angle brackets
+	Response  string // server's final reply to the end of DATA
+	QueueID   string // queue identifier extracted from Response, when recognisable
+}
+
+// SizeLimitError is returned by Send when the message exceeds the size the
+// server advertised via the EHLO SIZE extension.
+type SizeLimitError struct {
+	Size  int // size of the rendered message in bytes
+	Limit int // server's advertised maximum
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("smtp: message of %d bytes exceeds server SIZE limit of %d", e.Size, e.Limit)
+}
+
+// SMTPError is a 4xx or 5xx reply from the server.
+type SMTPError struct {
+	Code  int    // three-digit reply code
+	Reply string // full reply text, multi-line replies joined with "\n"
+}
+
+func (e *SMTPError) Error() string {
+	return "smtp: " + e.Reply
+}
+
+// ErrDeliveryUncertain marks a failure after the end-of-data terminator was
+// written: the server may already have accepted the message, so retrying
+// risks delivering it twice.
+var ErrDeliveryUncertain = errors.New("smtp: delivery outcome unknown")
+
+// ErrorKind classifies a send failure for retry decisions.
+type ErrorKind int
+
+const (
+	KindPermanent ErrorKind = iota // 5xx reply, or a problem with the message itself
+	KindTransient                  // 4xx reply: the server asks to try again later
+	KindNetwork                    // connection failed or dropped
+)
+
+// Classify reports what kind of failure err is.  Anything unrecognised is
+// treated as permanent so callers never retry blindly.
+func Classify(err error) ErrorKind {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		if smtpErr.Code/100 == 4 {
+			return KindTransient
+		}
+		return KindPermanent
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return KindNetwork
+	}
+	return KindPermanent
+}
+
+// Retryable reports whether a fresh attempt could succeed without risking a
+// duplicate delivery.
+func Retryable(err error) bool {
+	if errors.Is(err, ErrDeliveryUncertain) {
+		return false
+	}
+	k := Classify(err)
+	return k == KindTransient || k == KindNetwork
 }
 
-// SMTPClient speaks SMTP over a single TCP connection.
+// SMTPClient speaks SMTP over a single TCP connection.  Methods that talk to
+// the server take a context; cancelling it aborts the exchange in progress
+// and closes the connection.  Like POP3Client it is safe for concurrent use;
+// each exchange holds the session lock.
 type SMTPClient struct {
-	cfg    SMTPConfig
-	conn   net.Conn
-	reader *bufio.Reader
+	session
+	cfg        SMTPConfig
+	conn       net.Conn
+	reader     *bufio.Reader
+	extensions map[string]string // EHLO keyword (upper-case) -> parameters
 }
 
 func NewSMTPClient(cfg SMTPConfig) *SMTPClient {
@@ -39,21 +204,23 @@ func NewSMTPClient(cfg SMTPConfig) *SMTPClient {
 }
 
 // Connect opens the connection and reads the server greeting.
-func (c *SMTPClient) Connect() error {
-	addr := fmt.Sprintf("%s:%d", c.cfg.Host, c.cfg.Port)
-	var err error
+func (c *SMTPClient) Connect(ctx context.Context) error {
+	c.lock()
+	defer c.unlock()
 
-	if c.cfg.UseSSL {
-		c.conn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: c.cfg.Host})
-	} else {
-		c.conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
-	}
+	addr := net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port))
+	conn, err := dial(ctx, c.cfg.Dialer, addr, c.cfg.Host, c.cfg.UseSSL)
 	if err != nil {
 		return fmt.Errorf("smtp connect %s: %w", addr, err)
 	}
+	c.conn = conn
 	c.reader = bufio.NewReader(c.conn)
 
-	if _, err := c.readResponse(); err != nil {
+	err = withConn(ctx, c.conn, func() error {
+		_, err := c.readResponse()
+		return err
+	})
+	if err != nil {
 		c.conn.Close()
 		return fmt.Errorf("smtp greeting: %w", err)
 	}
@@ -62,9 +229,23 @@ func (c *SMTPClient) Connect() error {
 
 // Handshake performs EHLO and upgrades to TLS via STARTTLS when the connection
 // is not already encrypted.
-func (c *SMTPClient) Handshake() error {
-	if _, err := c.cmd("EHLO mulamail"); err != nil {
-		if _, err := c.cmd("HELO mulamail"); err != nil {
+func (c *SMTPClient) Handshake(ctx context.Context) error {
+	// The STARTTLS upgrade layers the TLS session on the raw connection, so
+	// binding ctx to it covers both phases.
+	c.lock()
+	defer c.unlock()
+	return withConn(ctx, c.conn, func() error { return c.handshake(ctx) })
+}
+
+func (c *SMTPClient) handshake(ctx context.Context) error {
+	hello := c.cfg.HELOHostname
+	if hello == "" {
+		hello = defaultHELOHostname
+	}
+	if resp, err := c.cmd("EHLO " + hello); err == nil {
+		c.extensions = parseEHLO(resp)
+	} else {
+		if _, err := c.cmd("HELO " + hello); err != nil {
 			return fmt.Errorf("smtp EHLO/HELO: %w", err)
 		}
 	}
@@ -72,26 +253,85 @@ func (c *SMTPClient) Handshake() error {
 	if !c.cfg.UseSSL {
 		if resp, err := c.cmd("STARTTLS"); err == nil && strings.HasPrefix(resp, "220") {
 			tlsConn := tls.Client(c.conn, &tls.Config{ServerName: c.cfg.Host})
-			if err := tlsConn.Handshake(); err != nil {
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
 				return fmt.Errorf("smtp TLS handshake: %w", err)
 			}
 			c.conn = tlsConn
 			c.reader = bufio.NewReader(tlsConn)
-			c.cmd("EHLO mulamail") //nolint:errcheck // best-effort re-EHLO
+			c.cfg.Trace.notef("TLS established: %s", tls.VersionName(tlsConn.ConnectionState().Version))
+			// Best-effort re-EHLO; servers may advertise more after TLS.
+			if resp, err := c.cmd("EHLO " + hello); err == nil {
+				c.extensions = parseEHLO(resp)
+			}
 		}
 	}
 	return nil
 }
 
-// Auth attempts AUTH PLAIN and falls back to AUTH LOGIN.
-func (c *SMTPClient) Auth() error {
-	creds := fmt.Sprintf("\x00%s\x00%s", c.cfg.User, c.cfg.Pass)
-	encoded := base64.StdEncoding.EncodeToString([]byte(creds))
+// MaxSize returns the message size limit advertised via EHLO SIZE, or 0 when
+// the server did not advertise one.
+func (c *SMTPClient) MaxSize() int {
+	c.lock()
+	defer c.unlock()
+	return c.maxSize()
+}
+
+func (c *SMTPClient) maxSize() int {
+	n, _ := strconv.Atoi(c.extensions["SIZE"])
+	return n
+}
 
-	if resp, err := c.cmd("AUTH PLAIN " + encoded); err == nil && strings.HasPrefix(resp, "235") {
-		return nil
+// Extensions returns the EHLO extensions of the session as sorted lines,
+// parameters included.  It is empty before Handshake or when the server only
+// accepted HELO.
+func (c *SMTPClient) Extensions() []string {
+	c.lock()
+	defer c.unlock()
+	lines := make([]string, 0, len(c.extensions))
+	for keyword, params := range c.extensions {
+		lines = append(lines, strings.TrimSpace(keyword+" "+params))
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// parseEHLO extracts the extension keywords from a (multi-line) EHLO reply.
+// The first line is the server greeting and carries no extension.
+func parseEHLO(resp string) map[string]string {
+	ext := make(map[string]string)
+	lines := strings.Split(resp, "\n")
+	for _, line := range lines[1:] {
+		if len(line) < 4 {
+			continue
+		}
+		keyword, params, _ := strings.Cut(strings.TrimSpace(line[4:]), " ")
+		ext[strings.ToUpper(keyword)] = params
 	}
-	return c.authLogin()
+	return ext
+}
+
+// Auth attempts AUTH PLAIN and falls back to AUTH LOGIN.  The password is
+// zeroed when Auth returns, so a client authenticates at most once.
+func (c *SMTPClient) Auth(ctx context.Context) error {
+	c.lock()
+	defer c.unlock()
+	defer clear(c.cfg.Pass)
+
+	creds := make([]byte, 0, len(c.cfg.User)+len(c.cfg.Pass)+2)
+	creds = append(creds, 0)
+	creds = append(creds, c.cfg.User...)
+	creds = append(creds, 0)
+	creds = append(creds, c.cfg.Pass...)
+	encoded := encodeSecret(creds)
+	clear(creds)
+	defer clear(encoded)
+
+	return withConn(ctx, c.conn, func() error {
+		if resp, err := c.cmdSecret("AUTH PLAIN ", encoded); err == nil && strings.HasPrefix(resp, "235") {
+			return nil
+		}
+		return c.authLogin()
+	})
 }
 
 func (c *SMTPClient) authLogin() error {
@@ -99,95 +339,304 @@ func (c *SMTPClient) authLogin() error {
 		return fmt.Errorf("smtp AUTH LOGIN init: %w", err)
 	}
 	// Server sends base64("Username:") challenge – we just send the answer.
-	if _, err := c.cmd(base64.StdEncoding.EncodeToString([]byte(c.cfg.User))); err != nil {
+	if _, err := c.cmdSecret("", []byte(base64.StdEncoding.EncodeToString([]byte(c.cfg.User)))); err != nil {
 		return fmt.Errorf("smtp AUTH LOGIN user: %w", err)
 	}
-	if _, err := c.cmd(base64.StdEncoding.EncodeToString([]byte(c.cfg.Pass))); err != nil {
+	pass := encodeSecret(c.cfg.Pass)
+	defer clear(pass)
+	if _, err := c.cmdSecret("", pass); err != nil {
 		return fmt.Errorf("smtp AUTH LOGIN pass: %w", err)
 	}
 	return nil
 }
 
 // Send transmits a single message.  The connection must already be
-// authenticated.
-func (c *SMTPClient) Send(req SendRequest) error {
-	if _, err := c.cmd(fmt.Sprintf("MAIL FROM:<%s>", req.From)); err != nil {
-		return fmt.Errorf("smtp MAIL FROM: %w", err)
+// authenticated.  On success the server's final reply is returned so the
+// message can later be correlated with bounces.  Every envelope address is
+// re-validated before use; an unsafe one yields an *AddressError and nothing
+// is sent.  When cfg.DKIM has a key for the From domain, the message is
+// signed and the DKIM-Signature header leads it.
+//
+// Internationalised addresses go out as they are, with the SMTPUTF8
+// parameter, when the server advertises SMTPUTF8 (RFC 6531).  Otherwise
+// their domains are converted to ASCII form in the envelope and headers,
+// and an address with a non-ASCII local part, which has no such form, is an
+// *AddressError.
+//
+// The NOTIFY and RET parameters of req.DSN are sent when the server
+// advertises DSN (RFC 3461).  Otherwise they are left out, or, when
+// req.DSN.Require is set, nothing is sent and the error is
+// ErrDSNNotSupported.
+func (c *SMTPClient) Send(ctx context.Context, req SendRequest) (*SendResult, error) {
+	if err := ValidateAddress(req.From); err != nil {
+		return nil, err
 	}
-	for _, to := range req.To {
-		if _, err := c.cmd(fmt.Sprintf("RCPT TO:<%s>", to)); err != nil {
-			return fmt.Errorf("smtp RCPT TO %s: %w", to, err)
+	if err := ValidateAddress(req.EnvelopeSender()); err != nil {
+		return nil, err
+	}
+	for _, to := range req.Recipients() {
+		if err := ValidateAddress(to); err != nil {
+			return nil, err
 		}
 	}
-	if _, err := c.cmd("DATA"); err != nil {
-		return fmt.Errorf("smtp DATA: %w", err)
+	if err := ValidateDSN(req.DSN); err != nil {
+		return nil, err
+	}
+	if err := ValidateAttachments(req.HTML, req.Attachments); err != nil {
+		return nil, err
+	}
+
+	c.lock()
+	defer c.unlock()
+
+	if _, ok := c.extensions["DSN"]; !ok && req.DSN != nil {
+		if req.DSN.Require {
+			return nil, ErrDSNNotSupported
+		}
+		c.cfg.Trace.notef("DSN parameters left out: not supported by the server")
+		req.DSN = nil
+	}
+
+	_, smtputf8 := c.extensions["SMTPUTF8"]
+	if !smtputf8 {
+		ascii, err := req.asciiForm()
+		if err != nil {
+			return nil, err
+		}
+		req = ascii
+	}
+
+	messageID := newMessageID(req.From)
+	now := time.Now()
+	msg := buildMessage(req, messageID, now)
+	if signer := c.cfg.DKIM.For(req.From); signer != nil {
+		msg = wireLines(msg)
+		sig, err := signer.Sign(msg, now)
+		if err != nil {
+			return nil, err
+		}
+		msg = sig + msg
+	}
+	if limit := c.maxSize(); limit > 0 && len(msg) > limit {
+		return nil, &SizeLimitError{Size: len(msg), Limit: limit}
+	}
+
+	var resp string
+	err := withConn(ctx, c.conn, func() (err error) {
+		resp, err = c.transmit(req, msg, smtputf8 && req.internationalised())
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return &SendResult{
+		MessageID: messageID,
+		Response:  resp,
+		QueueID:   parseQueueID(resp),
+	}, nil
+}
 
-	// Build a minimal RFC 5322 message.
-	msg := fmt.Sprintf(
-		"From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
-		req.From,
-		strings.Join(req.To, ", "),
-		req.Subject,
-		time.Now().Format(time.RFC1123Z),
-		req.Body,
-	)
+// transmit runs the envelope and DATA exchange for an already rendered
+// message and returns the server's final reply.  With smtputf8 the
+// transaction is marked as carrying UTF-8 addresses.  The DSN parameters
+// of req, if any, go with the envelope as they are.
+func (c *SMTPClient) transmit(req SendRequest, msg string, smtputf8 bool) (string, error) {
+	mailFrom := fmt.Sprintf("MAIL FROM:<%s>", req.EnvelopeSender()) + req.DSN.mailParams()
+	if smtputf8 {
+		mailFrom += " SMTPUTF8"
+	}
+	if _, err := c.cmd(mailFrom); err != nil {
+		return "", fmt.Errorf("smtp MAIL FROM: %w", err)
+	}
+	for _, to := range req.Recipients() {
+		if _, err := c.cmd(fmt.Sprintf("RCPT TO:<%s>", to) + req.DSN.rcptParams()); err != nil {
+			return "", fmt.Errorf("smtp RCPT TO %s: %w", to, err)
+		}
+	}
+	if _, err := c.cmd("DATA"); err != nil {
+		return "", fmt.Errorf("smtp DATA: %w", err)
+	}
 
-	// Write with dot-stuffing.
-	for _, line := range strings.Split(msg, "\n") {
+	// Write with dot-stuffing.  A trace only counts the lines.
+	lines := strings.Split(msg, "\n")
+	c.cfg.Trace.notef("[message: %d lines]", len(lines))
+	for _, line := range lines {
 		line = strings.TrimRight(line, "\r")
 		if strings.HasPrefix(line, ".") {
 			line = "." + line
 		}
 		if _, err := fmt.Fprintf(c.conn, "%s\r\n", line); err != nil {
-			return err
+			return "", err
 		}
 	}
-	// Terminate the DATA phase.
+	// Terminate the DATA phase.  From here on a partial write may already
+	// have completed the message on the server side.
+	c.cfg.Trace.sent(".")
 	if _, err := fmt.Fprintf(c.conn, ".\r\n"); err != nil {
-		return err
+		return "", fmt.Errorf("smtp DATA end: %w: %w", ErrDeliveryUncertain, err)
 	}
-	if _, err := c.readResponse(); err != nil {
-		return fmt.Errorf("smtp DATA end: %w", err)
+	resp, err := c.readResponse()
+	if err != nil {
+		// A rejection reply is definitive; a lost reply is not.
+		var smtpErr *SMTPError
+		if !errors.As(err, &smtpErr) {
+			return "", fmt.Errorf("smtp DATA end: %w: %w", ErrDeliveryUncertain, err)
+		}
+		return "", fmt.Errorf("smtp DATA end: %w", err)
 	}
-	return nil
+	return resp, nil
+}
+
+// wireLines returns msg with every line ending as transmit writes it, CRLF,
+// so that a DKIM signature covers exactly the bytes sent.
+func wireLines(msg string) string {
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// MessageSize returns the size in bytes of the message Send would transmit
+// for req, so callers can enforce limits before opening a connection.
+func MessageSize(req SendRequest) int {
+	return len(buildMessage(req, newMessageID(req.From), time.Now()))
+}
+
+// buildMessage renders a minimal RFC 5322 message, its body laid out by
+// bodyEntity.  Header values are stripped of CR/LF so nothing a client
+// supplies can start a new header, and a non-ASCII Subject or display name
+// is RFC 2047 encoded.
+func buildMessage(req SendRequest, messageID string, date time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", Address{Email: req.From, Name: req.FromName}.header())
+	fmt.Fprintf(&b, "To: %s\r\n", addressList(req.To))
+	if len(req.Cc) > 0 {
+		fmt.Fprintf(&b, "Cc: %s\r\n", addressList(req.Cc))
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", headerValue(req.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: %s\r\n", messageID)
+	b.WriteString(listUnsubscribeHeaders(req))
+	body := bodyEntity(req)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString(body.header)
+	b.WriteString("\r\n")
+	b.WriteString(body.body)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// headerValue neutralises header injection by replacing CR and LF with
+// spaces.
+func headerValue(v string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(v)
+}
+
+// newMessageID generates a globally unique Message-ID whose domain part is
+// taken from the sender address, in ASCII form.
+func newMessageID(from string) string {
+	domain := "mulamail"
+	if _, d := splitAddress(from); d != "" {
+		if ascii, err := asciiDomain(d); err == nil {
+			domain = ascii
+		}
+	}
+	var b [16]byte
+	rand.Read(b[:]) //nolint:errcheck
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b[:]), domain)
+}
+
+// queuedAs matches Postfix/Sendmail style "queued as <id>" replies.
+var queuedAs = regexp.MustCompile(`(?i)queued as ([A-Za-z0-9._-]+)`)
+
+// parseQueueID extracts the queue identifier from a final DATA reply.  It
+// understands "queued as <id>" (Postfix, Sendmail, Exim variants) and the
+// Gmail "OK <ts> <id> - gsmtp" form; anything else yields "".
+func parseQueueID(resp string) string {
+	if m := queuedAs.FindStringSubmatch(resp); m != nil {
+		return m[1]
+	}
+	if strings.HasSuffix(resp, "- gsmtp") {
+		fields := strings.Fields(strings.TrimSuffix(resp, "- gsmtp"))
+		if len(fields) > 0 {
+			return fields[len(fields)-1]
+		}
+	}
+	return ""
 }
 
 // Close sends QUIT and tears down the connection.
 func (c *SMTPClient) Close() error {
+	c.lock()
+	defer c.unlock()
+	clear(c.cfg.Pass)
 	if c.conn == nil {
 		return nil
 	}
-	c.cmd("QUIT") //nolint:errcheck
+	c.conn.SetDeadline(time.Now().Add(quitTimeout)) //nolint:errcheck
+	c.cmd("QUIT")                                   //nolint:errcheck
 	return c.conn.Close()
 }
 
 // ---------- low-level protocol helpers ----------
 
 func (c *SMTPClient) cmd(command string) (string, error) {
+	c.mustHold("SMTP")
+	c.cfg.Trace.sent(command)
 	if _, err := fmt.Fprintf(c.conn, "%s\r\n", command); err != nil {
 		return "", err
 	}
 	return c.readResponse()
 }
 
-// readResponse handles both single-line and multi-line SMTP replies.
+// cmdSecret is cmd for a command carrying a credential.  Should the server
+// repeat the credential or the password in its reply, it is redacted from
+// the reply, the error and the trace.
+func (c *SMTPClient) cmdSecret(prefix string, secret []byte) (string, error) {
+	c.mustHold("SMTP")
+	c.cfg.Trace.sentSecret(prefix)
+	if err := writeSecretLine(c.conn, prefix, secret); err != nil {
+		return "", err
+	}
+	echoes := secretEchoes(secret, c.cfg.Pass)
+	defer clearEchoes(echoes)
+	c.cfg.Trace.hide(echoes)
+	defer c.cfg.Trace.hide(nil)
+	resp, err := c.readResponse()
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		smtpErr.Reply = redactSecrets(smtpErr.Reply, echoes)
+	}
+	return redactSecrets(resp, echoes), err
+}
+
+// readResponse handles both single-line and multi-line SMTP replies.  The
+// lines of a multi-line reply are joined with "\n", each keeping its status
+// code, so callers still see the code at the start of the result.
 // It returns an error for 4xx / 5xx status codes.
 func (c *SMTPClient) readResponse() (string, error) {
-	var last string
+	var lines []string
 	for {
 		line, err := c.reader.ReadString('\n')
 		if err != nil {
 			return "", err
 		}
-		last = strings.TrimRight(line, "\r\n")
+		line = strings.TrimRight(line, "\r\n")
+		c.cfg.Trace.received(line)
+		lines = append(lines, line)
 		// Multi-line reply continues while the 4th character is '-'.
-		if len(last) < 4 || last[3] != '-' {
+		if len(line) < 4 || line[3] != '-' {
 			break
 		}
 	}
-	if len(last) >= 1 && (last[0] == '4' || last[0] == '5') {
-		return last, fmt.Errorf("smtp: %s", last)
+	resp := strings.Join(lines, "\n")
+	if len(resp) >= 1 && (resp[0] == '4' || resp[0] == '5') {
+		code, err := strconv.Atoi(resp[:min(3, len(resp))])
+		if err != nil {
+			code = int(resp[0]-'0') * 100
+		}
+		return resp, &SMTPError{Code: code, Reply: resp}
 	}
-	return last, nil
+	return resp, nil
 }
@@ -0,0 +1,453 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mulamail/mail/dkim"
+)
+
+func TestSMTPReadResponse_MultiLine(t *testing.T) {
+	c := &SMTPClient{reader: bufio.NewReader(strings.NewReader(
+		"250-smtp.example.com\r\n250-SIZE 35882577\r\n250 2.0.0 OK 1696512345 x12-20020a05 - gsmtp\r\n"))}
+
+	resp, err := c.readResponse()
+	if err != nil {
+		t.Fatalf("readResponse failed: %v", err)
+	}
+	want := "250-smtp.example.com\n250-SIZE 35882577\n250 2.0.0 OK 1696512345 x12-20020a05 - gsmtp"
+	if resp != want {
+		t.Errorf("readResponse: want %q, got %q", want, resp)
+	}
+}
+
+func TestSMTPReadResponse_Error(t *testing.T) {
+	c := &SMTPClient{reader: bufio.NewReader(strings.NewReader("550-5.1.1 no such user\r\n550 5.1.1 try again\r\n"))}
+
+	resp, err := c.readResponse()
+	if err == nil {
+		t.Fatal("expected error for 5xx reply")
+	}
+	if !strings.HasPrefix(resp, "550") {
+		t.Errorf("expected reply to be returned with the error, got %q", resp)
+	}
+}
+
+func TestParseQueueID(t *testing.T) {
+	testCases := []struct {
+		resp string
+		want string
+	}{
+		{"250 2.0.0 Ok: queued as 4F1A23C0B2", "4F1A23C0B2"},
+		{"250 OK id=1qnXyZ-0004Ab-2R queued as 1qnXyZ-0004Ab-2R", "1qnXyZ-0004Ab-2R"},
+		{"250 2.0.0 OK  1696512345 x12-20020a05600c00cc00b003fe1c332810si1234567wmb.12 - gsmtp", "x12-20020a05600c00cc00b003fe1c332810si1234567wmb.12"},
+		{"250 Message accepted", ""},
+	}
+	for _, tc := range testCases {
+		if got := parseQueueID(tc.resp); got != tc.want {
+			t.Errorf("parseQueueID(%q): want %q, got %q", tc.resp, tc.want, got)
+		}
+	}
+}
+
+func TestNewMessageID(t *testing.T) {
+	a, b := newMessageID("alice@example.com"), newMessageID("alice@example.com")
+	if a == b {
+		t.Error("expected unique Message-IDs")
+	}
+	if !strings.HasPrefix(a, "<") || !strings.HasSuffix(a, "@example.com>") {
+		t.Errorf("unexpected Message-ID format %q", a)
+	}
+}
+
+func TestParseEHLO(t *testing.T) {
+	ext := parseEHLO("250-smtp.example.com Hello\n250-SIZE 35882577\n250-8BITMIME\n250 auth PLAIN LOGIN")
+
+	if ext["SIZE"] != "35882577" {
+		t.Errorf("SIZE: want %q, got %q", "35882577", ext["SIZE"])
+	}
+	if _, ok := ext["8BITMIME"]; !ok {
+		t.Error("expected 8BITMIME extension")
+	}
+	if ext["AUTH"] != "PLAIN LOGIN" {
+		t.Errorf("AUTH: want %q, got %q", "PLAIN LOGIN", ext["AUTH"])
+	}
+	if _, ok := ext["SMTP.EXAMPLE.COM"]; ok {
+		t.Error("greeting line must not be parsed as an extension")
+	}
+
+	c := &SMTPClient{extensions: ext}
+	if c.MaxSize() != 35882577 {
+		t.Errorf("MaxSize: want 35882577, got %d", c.MaxSize())
+	}
+	if got, want := c.Extensions(), []string{"8BITMIME", "AUTH PLAIN LOGIN", "SIZE 35882577"}; !slices.Equal(got, want) {
+		t.Errorf("Extensions: want %q, got %q", want, got)
+	}
+}
+
+func TestBuildMessage_NoHeaderInjection(t *testing.T) {
+	msg := buildMessage(SendRequest{
+		From:    "alice@example.com\r\nBcc: evil@example.net",
+		To:      []Address{{Email: "bob@example.org"}},
+		Bcc:     []Address{{Email: "hidden@example.org"}},
+		Subject: "hi\r\nBcc: evil@example.net",
+		Body:    "body",
+	}, "<id@example.com>", time.Unix(0, 0))
+
+	headers, _, _ := strings.Cut(msg, "\r\n\r\n")
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Errorf("unexpected header line %q", line)
+		}
+	}
+	if strings.Contains(msg, "hidden@example.org") {
+		t.Error("Bcc recipients must not appear in the message")
+	}
+}
+
+func TestSMTPReadResponse_TypedError(t *testing.T) {
+	c := &SMTPClient{reader: bufio.NewReader(strings.NewReader("421-busy\r\n421 4.3.2 try later\r\n"))}
+	_, err := c.readResponse()
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Fatalf("want *SMTPError with code 421, got %v", err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		kind      ErrorKind
+		retryable bool
+	}{
+		{"4xx", fmt.Errorf("smtp RCPT TO: %w", &SMTPError{Code: 451, Reply: "451 later"}), KindTransient, true},
+		{"5xx", &SMTPError{Code: 550, Reply: "550 no such user"}, KindPermanent, false},
+		{"eof", fmt.Errorf("smtp DATA: %w", io.EOF), KindNetwork, true},
+		{"net", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, KindNetwork, true},
+		{"uncertain", fmt.Errorf("smtp DATA end: %w: %w", ErrDeliveryUncertain, io.EOF), KindNetwork, false},
+		{"size", &SizeLimitError{Size: 2, Limit: 1}, KindPermanent, false},
+		{"other", errors.New("boom"), KindPermanent, false},
+	}
+	for _, tc := range tests {
+		if got := Classify(tc.err); got != tc.kind {
+			t.Errorf("%s: Classify: want %d, got %d", tc.name, tc.kind, got)
+		}
+		if got := Retryable(tc.err); got != tc.retryable {
+			t.Errorf("%s: Retryable: want %v, got %v", tc.name, tc.retryable, got)
+		}
+	}
+}
+
+func TestSMTPSend_CancelAwaitingReply(t *testing.T) {
+	addr, hungUp := startStalling(t, func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprintf(conn, "220 ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == ".\r\n" {
+				return // never acknowledge the end of DATA
+			}
+			switch {
+			case strings.HasPrefix(line, "MAIL"), strings.HasPrefix(line, "RCPT"):
+				fmt.Fprintf(conn, "250 OK\r\n")
+			case strings.HasPrefix(line, "DATA"):
+				fmt.Fprintf(conn, "354 go ahead\r\n")
+			}
+		}
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+
+	client := NewSMTPClient(SMTPConfig{Host: host, Port: portNum})
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	_, err := client.Send(cancelAfter(t, 50*time.Millisecond), SendRequest{
+		From: "me@example.com",
+		To:   []Address{{Email: "you@example.org"}},
+		Body: "hello",
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+	if !errors.Is(err, ErrDeliveryUncertain) {
+		t.Errorf("want ErrDeliveryUncertain after DATA was sent, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Send took %v to return after cancel", elapsed)
+	}
+	waitHungUp(t, hungUp)
+}
+
+func TestSMTPSend_DKIM(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	keys := dkim.Keys{"example.com": {Domain: "example.com", Selector: "mail", Key: key}}
+
+	send := func(from string) string {
+		t.Helper()
+		data := make(chan string, 1)
+		addr, _ := startStalling(t, func(conn net.Conn, r *bufio.Reader) {
+			fmt.Fprintf(conn, "220 ready\r\n")
+			var msg strings.Builder
+			inData := false
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				switch {
+				case inData && line == ".\r\n":
+					data <- msg.String()
+					inData = false
+					fmt.Fprintf(conn, "250 OK queued as ABC\r\n")
+				case inData:
+					msg.WriteString(line)
+				case line == "QUIT\r\n":
+					fmt.Fprintf(conn, "221 bye\r\n")
+					return
+				case strings.HasPrefix(line, "DATA"):
+					inData = true
+					fmt.Fprintf(conn, "354 go ahead\r\n")
+				default:
+					fmt.Fprintf(conn, "250 OK\r\n")
+				}
+			}
+		})
+		host, port, _ := net.SplitHostPort(addr)
+		portNum, _ := strconv.Atoi(port)
+		client := NewSMTPClient(SMTPConfig{Host: host, Port: portNum, DKIM: keys})
+		if err := client.Connect(context.Background()); err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		defer client.Close()
+		if _, err := client.Send(context.Background(), SendRequest{
+			From: from,
+			To:   []Address{{Email: "you@example.org"}},
+			Body: "line one\nline two  \n",
+		}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		return <-data
+	}
+
+	signed := send("me@example.com")
+	if !strings.HasPrefix(signed, "DKIM-Signature: v=1; a=ed25519-sha256;") || !strings.Contains(signed, "d=example.com; s=mail;") {
+		t.Errorf("message should start with the DKIM signature:\n%s", signed)
+	}
+	if plain := send("me@example.net"); strings.Contains(plain, "DKIM-Signature") {
+		t.Errorf("a domain without a key must not be signed:\n%s", plain)
+	}
+}
+
+func TestSMTPAuth_ZeroesPassword(t *testing.T) {
+	got := make(chan string, 1)
+	addr, _ := startStalling(t, func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprintf(conn, "220 ready\r\n")
+		line, _ := r.ReadString('\n')
+		got <- strings.TrimSpace(line)
+		fmt.Fprintf(conn, "235 ok\r\n")
+		r.ReadString('\n') //nolint:errcheck // QUIT
+		fmt.Fprintf(conn, "221 bye\r\n")
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+
+	pass := []byte("s3cret")
+	client := NewSMTPClient(SMTPConfig{Host: host, Port: portNum, User: "me", Pass: pass})
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.Auth(context.Background()); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if want := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00me\x00s3cret")); <-got != want {
+		t.Errorf("want %q", want)
+	}
+	if string(pass) != "\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("password not zeroed after Auth: %q", pass)
+	}
+}
+
+func TestSMTPSend_EnvelopeFrom(t *testing.T) {
+	cmds := make(chan string, 10)
+	addr, _ := startStalling(t, func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprintf(conn, "220 ready\r\n")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case inData && line == ".\r\n":
+				inData = false
+				fmt.Fprintf(conn, "250 OK\r\n")
+			case inData:
+				if strings.HasPrefix(line, "From: ") {
+					cmds <- strings.TrimRight(line, "\r\n")
+				}
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				fmt.Fprintf(conn, "354 go ahead\r\n")
+			default:
+				cmds <- strings.TrimRight(line, "\r\n")
+				fmt.Fprintf(conn, "250 OK\r\n")
+			}
+		}
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+	client := NewSMTPClient(SMTPConfig{Host: host, Port: portNum})
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+
+	req := SendRequest{
+		From:         "me@example.com",
+		EnvelopeFrom: "bounce+42@example.com",
+		To:           []Address{{Email: "you@example.org"}},
+		Body:         "hello",
+	}
+	unsafe := req
+	unsafe.EnvelopeFrom = "a@example.com>\r\nRCPT TO:<evil@example.net"
+	var addrErr *AddressError
+	if _, err := client.Send(context.Background(), unsafe); !errors.As(err, &addrErr) {
+		t.Errorf("unsafe envelope sender: want *AddressError, got %v", err)
+	}
+	if _, err := client.Send(context.Background(), req); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	want := []string{"MAIL FROM:<bounce+42@example.com>", "RCPT TO:<you@example.org>", "From: me@example.com"}
+	for _, w := range want {
+		if got := <-cmds; got != w {
+			t.Errorf("want %q, got %q", w, got)
+		}
+	}
+}
+
+func TestSMTPSend_SMTPUTF8(t *testing.T) {
+	// send delivers req to a server that does or does not advertise
+	// SMTPUTF8 and returns the envelope commands and address headers it saw.
+	send := func(t *testing.T, smtputf8 bool, req SendRequest) ([]string, error) {
+		t.Helper()
+		seen := make(chan []string, 1)
+		addr, _ := startStalling(t, func(conn net.Conn, r *bufio.Reader) {
+			fmt.Fprintf(conn, "220 ready\r\n")
+			var lines []string
+			defer func() { seen <- lines }()
+			inData := false
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\r\n")
+				switch {
+				case inData && line == ".":
+					inData = false
+					fmt.Fprintf(conn, "250 OK\r\n")
+				case inData:
+					if strings.HasPrefix(line, "From: ") || strings.HasPrefix(line, "To: ") || strings.HasPrefix(line, "Message-ID: ") {
+						lines = append(lines, line)
+					}
+				case strings.HasPrefix(line, "EHLO"):
+					if smtputf8 {
+						fmt.Fprintf(conn, "250-hello\r\n250-8BITMIME\r\n250 SMTPUTF8\r\n")
+					} else {
+						fmt.Fprintf(conn, "250-hello\r\n250 8BITMIME\r\n")
+					}
+				case line == "STARTTLS":
+					fmt.Fprintf(conn, "454 TLS not available\r\n")
+				case line == "DATA":
+					inData = true
+					fmt.Fprintf(conn, "354 go ahead\r\n")
+				case line == "QUIT":
+					fmt.Fprintf(conn, "221 bye\r\n")
+					return
+				default:
+					lines = append(lines, line)
+					fmt.Fprintf(conn, "250 OK\r\n")
+				}
+			}
+		})
+		host, port, _ := net.SplitHostPort(addr)
+		portNum, _ := strconv.Atoi(port)
+		client := NewSMTPClient(SMTPConfig{Host: host, Port: portNum})
+		if err := client.Connect(context.Background()); err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		if err := client.Handshake(context.Background()); err != nil {
+			t.Fatalf("Handshake: %v", err)
+		}
+		_, err := client.Send(context.Background(), req)
+		client.Close()
+		return <-seen, err
+	}
+
+	tests := []struct {
+		name     string
+		smtputf8 bool
+		from, to string
+		want     []string
+	}{
+		{"utf8 passes through", true, "me@例え.jp", "用户@例え.jp", []string{
+			"MAIL FROM:<me@例え.jp> SMTPUTF8", "RCPT TO:<用户@例え.jp>", "From: me@例え.jp", "To: 用户@例え.jp",
+		}},
+		{"ascii without the parameter", true, "me@example.com", "you@example.org", []string{
+			"MAIL FROM:<me@example.com>", "RCPT TO:<you@example.org>", "From: me@example.com", "To: you@example.org",
+		}},
+		{"domains to punycode", false, "me@例え.jp", "user@Bücher.de", []string{
+			"MAIL FROM:<me@xn--r8jz45g.jp>", "RCPT TO:<user@xn--bcher-kva.de>", "From: me@xn--r8jz45g.jp", "To: user@xn--bcher-kva.de",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := send(t, tt.smtputf8, SendRequest{From: tt.from, To: []Address{{Email: tt.to}}, Body: "hi"})
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			var msgID string
+			got = slices.DeleteFunc(got, func(line string) bool {
+				if strings.HasPrefix(line, "Message-ID: ") {
+					msgID = line
+					return true
+				}
+				return false
+			})
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("want %q, got %q", tt.want, got)
+			}
+			if !isASCII(msgID) {
+				t.Errorf("Message-ID must be ASCII: %q", msgID)
+			}
+		})
+	}
+
+	t.Run("utf8 local part without SMTPUTF8", func(t *testing.T) {
+		got, err := send(t, false, SendRequest{From: "me@example.com", To: []Address{{Email: "用户@例え.jp"}}, Body: "hi"})
+		var addrErr *AddressError
+		if !errors.As(err, &addrErr) {
+			t.Errorf("want *AddressError, got %v", err)
+		}
+		if len(got) != 0 {
+			t.Errorf("nothing may be sent, got %q", got)
+		}
+	})
+}
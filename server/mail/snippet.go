@@ -0,0 +1,154 @@
+package mail
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// SnippetLines is the number of body lines to fetch with Top for a
+	// Snippet: enough for the opening sentences of most messages.
+	SnippetLines = 10
+
+	// snippetMax caps the characters of a snippet.
+	snippetMax = 140
+
+	// snippetReadMax caps the decoded bytes of the first part read.
+	snippetReadMax = 16 << 10
+
+	// snippetDepth bounds the nested multiparts descended into.
+	snippetDepth = 8
+)
+
+// Snippet returns a one-line excerpt of a message's text, from the whole
+// message or from its headers and first lines as Top fetches them: the
+// start of its first MIME part, with the transfer encoding undone, quoted
+// lines left out and the text cut at a signature or the attribution line
+// of a quoted reply, whitespace collapsed and at most 140 characters long.
+// A body cut short is read as far as it goes.  It is empty when the
+// message has no body or its first part is not text/plain or text/html.
+func Snippet(raw string) string {
+	msg, err := netmail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	h, body := textproto.MIMEHeader(msg.Header), io.Reader(msg.Body)
+	for depth := 0; ; depth++ {
+		mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+		if err != nil {
+			mediaType, params = "text/plain", nil
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			if params["boundary"] == "" || depth == snippetDepth {
+				return ""
+			}
+			p, err := multipart.NewReader(body, params["boundary"]).NextRawPart()
+			if err != nil {
+				return ""
+			}
+			h, body = p.Header, p
+			continue
+		}
+		if disposition, _, _ := mime.ParseMediaType(h.Get("Content-Disposition")); disposition == "attachment" {
+			return ""
+		}
+		if mediaType != "text/plain" && mediaType != "text/html" {
+			return ""
+		}
+		// A body cut short ends in an error; what was read still counts.
+		content, _ := io.ReadAll(io.LimitReader(decodeTransfer(h.Get("Content-Transfer-Encoding"), body), snippetReadMax))
+		text := decodeCharset(content, params["charset"])
+		if mediaType == "text/html" {
+			text = htmlText(text)
+		}
+		return excerpt(text)
+	}
+}
+
+// decodeCharset converts text in charset to UTF-8: ISO-8859-1 by mapping
+// each byte to its code point, anything else by dropping invalid bytes.
+func decodeCharset(b []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		var s strings.Builder
+		for _, c := range b {
+			s.WriteRune(rune(c))
+		}
+		return s.String()
+	}
+	return strings.ToValidUTF8(string(b), "")
+}
+
+// htmlText returns the text of an HTML body, a line per block, without
+// scripts, styles or quoted blockquotes.
+func htmlText(src string) string {
+	var b strings.Builder
+	skip := 0 // depth within elements whose text is left out
+	z := html.NewTokenizer(strings.NewReader(src))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return b.String()
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "title", "head", "blockquote":
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			case "br", "p", "div", "tr", "li", "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// excerpt reduces text to a snippet line: quoted lines are left out, a
+// signature delimiter or the attribution or separator line of a quoted
+// reply ends the text, and the rest is joined on single spaces and cut.
+func excerpt(text string) string {
+	var words []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if line == "-- " || trimmed == "--" || isReplySeparator(trimmed) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		words = append(words, strings.Fields(trimmed)...)
+		if len(words) > snippetMax {
+			break // enough text already
+		}
+	}
+	s := strings.Join(words, " ")
+	if utf8.RuneCountInString(s) <= snippetMax {
+		return s
+	}
+	r := []rune(s)[:snippetMax-1]
+	return strings.TrimRight(string(r), " ") + "…"
+}
+
+// isReplySeparator reports whether a trimmed line introduces a quoted
+// message: "On <date>, <someone> wrote:", or the separators Outlook puts
+// above one.
+func isReplySeparator(line string) bool {
+	return (strings.HasPrefix(line, "On ") && strings.HasSuffix(line, "wrote:")) ||
+		strings.HasPrefix(line, "-----Original Message-----") ||
+		(len(line) >= 10 && strings.Trim(line, "_") == "")
+}
@@ -0,0 +1,39 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+	tests := []struct {
+		name, raw, want string
+	}{
+		{"headers only", "Subject: hi\r\n", ""},
+		{"plain", "Subject: hi\r\n\r\nHello Bob,\r\n\r\n  see you   tomorrow.\r\n", "Hello Bob, see you tomorrow."},
+		{"reply", "Subject: Re: hi\r\n\r\nSounds good.\r\n\r\nOn Mon, 2 Jan 2006, Bob wrote:\r\n> see you tomorrow\r\n", "Sounds good."},
+		{"quoted inline", "Subject: Re: hi\r\n\r\n> Are you in?\r\nYes.\r\n", "Yes."},
+		{"signature", "Subject: hi\r\n\r\nThanks!\r\n-- \r\nAlice\r\nACME Corp\r\n", "Thanks!"},
+		{"outlook", "Subject: RE: hi\r\n\r\nDone.\r\n\r\n-----Original Message-----\r\nFrom: Bob\r\n", "Done."},
+		{"quoted-printable", "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nCaf=C3=A9 at n=\r\noon?\r\n", "Café at noon?"},
+		{"latin-1", "Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nCaf=E9\r\n", "Café"},
+		{"html cut short", "Content-Type: multipart/alternative; boundary=b\r\n\r\nThis is a MIME message.\r\n--b\r\n" +
+			"Content-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			"PGh0bWw+PGhlYWQ+PHRpdGxlPlQ8L3RpdGxlPjwvaGVhZD48Ym9keT48cD5IaSAmYW1wOyB3ZWxj\r\nb21lPC9wPjxibG9ja3F1b3RlPm9sZDwvYmxvY2txdW90ZT4=\r\n",
+			"Hi & welcome"},
+		{"nested", "Content-Type: multipart/mixed; boundary=o\r\n\r\n--o\r\nContent-Type: multipart/alternative; boundary=i\r\n\r\n--i\r\nContent-Type: text/plain\r\n\r\nInner text\r\n--i--\r\n--o--\r\n", "Inner text"},
+		{"first part not text", "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: image/png\r\n\r\nPNG\r\n--b\r\nContent-Type: text/plain\r\n\r\nCaption\r\n--b--\r\n", ""},
+		{"attachment", "Content-Type: text/plain\r\nContent-Disposition: attachment; filename=a.txt\r\n\r\nfile\r\n", ""},
+		{"long", "Subject: hi\r\n\r\n" + long + "\r\n", strings.TrimSpace(long[:139]) + "…"},
+	}
+	for _, tt := range tests {
+		if got := Snippet(tt.raw); got != tt.want {
+			t.Errorf("%s: want %q, got %q", tt.name, tt.want, got)
+		}
+	}
+	if got := Snippet("Subject: hi\r\n\r\n" + strings.Repeat("é", 500)); utf8.RuneCountInString(got) != snippetMax {
+		t.Errorf("want at most %d characters, got %d", snippetMax, utf8.RuneCountInString(got))
+	}
+}
@@ -0,0 +1,169 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Trace directions for TraceEntry.Dir.
+const (
+	TraceClient = "C" // a line sent to the server
+	TraceServer = "S" // a line received from the server
+	TraceNote   = "-" // something the client did or left out, not a line on the wire
+)
+
+const (
+	// traceLineMax caps the bytes of a line kept in a trace.
+	traceLineMax = 512
+
+	// traceRedacted stands in for what a trace leaves out.
+	traceRedacted = "[redacted]"
+)
+
+// TraceEntry is one line of a protocol exchange.
+type TraceEntry struct {
+	Time time.Time `json:"time"`
+	Dir  string    `json:"dir"` // TraceClient, TraceServer or TraceNote
+	Line string    `json:"line"`
+}
+
+// Trace records a POP3 or SMTP session for debugging: each command and
+// reply line, timestamped, keeping the latest limit of them.  It never
+// holds a credential or message content: the arguments of PASS, APOP and
+// AUTH exchanges are replaced with "[redacted]", as is any echo of them in
+// the server's replies, and message bodies are recorded as a line count.
+// Set POP3Config.Trace or SMTPConfig.Trace to trace a client; a nil Trace
+// records nothing.  A Trace is safe for concurrent use.
+type Trace struct {
+	// OnEntry, when set, is called with every entry as it is recorded, for
+	// instance to write the session to the log.  It must not block.
+	OnEntry func(TraceEntry)
+
+	mu      sync.Mutex
+	limit   int
+	entries []TraceEntry // ring of the latest entries, oldest at next once full
+	next    int
+	dropped int
+	hidden  [][]byte // secrets masked in received lines while set
+}
+
+// NewTrace returns a trace keeping the latest limit entries.
+func NewTrace(limit int) *Trace {
+	return &Trace{limit: max(limit, 1)}
+}
+
+// Entries returns the entries kept, oldest first.
+func (t *Trace) Entries() []TraceEntry {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]TraceEntry, 0, len(t.entries))
+	out = append(out, t.entries[t.next:]...)
+	return append(out, t.entries[:t.next]...)
+}
+
+// Dropped returns how many of the earliest entries were discarded to stay
+// within the limit.
+func (t *Trace) Dropped() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropped
+}
+
+func (t *Trace) sent(line string)     { t.record(TraceClient, line) }
+func (t *Trace) received(line string) { t.record(TraceServer, line) }
+
+// sentSecret records a line carrying a credential after prefix.
+func (t *Trace) sentSecret(prefix string) { t.record(TraceClient, prefix+traceRedacted) }
+
+// notef records a note.
+func (t *Trace) notef(format string, args ...any) {
+	if t != nil {
+		t.record(TraceNote, fmt.Sprintf(format, args...))
+	}
+}
+
+// hide masks secrets in the lines received until it is called again.  The
+// trace keeps no copy: the caller clears them only after the next call.
+func (t *Trace) hide(secrets [][]byte) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.hidden = secrets
+	t.mu.Unlock()
+}
+
+func (t *Trace) record(dir, line string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if dir == TraceServer {
+		line = redactSecrets(line, t.hidden)
+	}
+	if len(line) > traceLineMax {
+		line = line[:traceLineMax] + "..."
+	}
+	e := TraceEntry{Time: time.Now(), Dir: dir, Line: line}
+	if len(t.entries) < t.limit {
+		t.entries = append(t.entries, e)
+	} else {
+		t.entries[t.next] = e
+		t.next = (t.next + 1) % t.limit
+		t.dropped++
+	}
+	onEntry := t.OnEntry
+	t.mu.Unlock()
+	if onEntry != nil {
+		onEntry(e)
+	}
+}
+
+// secretEchoes returns the forms in which a server might repeat a credential
+// back in its reply: each secret as it was sent, and base64-encoded.  They
+// are copies for the caller to clear once the reply is handled.
+func secretEchoes(secrets ...[]byte) [][]byte {
+	var echoes [][]byte
+	for _, s := range secrets {
+		if len(s) > 0 {
+			echoes = append(echoes, bytes.Clone(s), encodeSecret(s))
+		}
+	}
+	return echoes
+}
+
+// clearEchoes zeroes the secrets returned by secretEchoes.
+func clearEchoes(echoes [][]byte) {
+	for _, e := range echoes {
+		clear(e)
+	}
+}
+
+// redactSecrets replaces every occurrence of the secrets in line with
+// "[redacted]".
+func redactSecrets(line string, secrets [][]byte) string {
+	if len(secrets) == 0 {
+		return line
+	}
+	b := []byte(line)
+	for _, s := range secrets {
+		b = bytes.ReplaceAll(b, s, []byte(traceRedacted))
+	}
+	return string(b)
+}
+
+// encodeSecret base64-encodes a credential without going through a string.
+func encodeSecret(secret []byte) []byte {
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(secret)))
+	base64.StdEncoding.Encode(out, secret)
+	return out
+}
@@ -0,0 +1,185 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// traceLines renders a trace as "dir line" strings.
+func traceLines(tr *Trace) []string {
+	var lines []string
+	for _, e := range tr.Entries() {
+		lines = append(lines, e.Dir+" "+e.Line)
+	}
+	return lines
+}
+
+// assertNoSecret fails the test if s carries secret in the clear or
+// base64-encoded, on its own or within the AUTH PLAIN credentials of user.
+func assertNoSecret(t *testing.T, what, s, user, secret string) {
+	t.Helper()
+	for _, form := range []string{
+		secret,
+		base64.StdEncoding.EncodeToString([]byte(secret)),
+		base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + secret)),
+	} {
+		if strings.Contains(s, form) {
+			t.Errorf("%s leaks %q: %s", what, form, s)
+		}
+	}
+}
+
+func TestTrace_KeepsLatest(t *testing.T) {
+	tr := NewTrace(3)
+	var seen int
+	tr.OnEntry = func(TraceEntry) { seen++ }
+	for i := range 5 {
+		tr.sent(strconv.Itoa(i))
+	}
+	if got := traceLines(tr); !slices.Equal(got, []string{"C 2", "C 3", "C 4"}) {
+		t.Errorf("want the latest 3 entries, got %v", got)
+	}
+	if tr.Dropped() != 2 || seen != 5 {
+		t.Errorf("want 2 dropped and 5 reported, got %d and %d", tr.Dropped(), seen)
+	}
+
+	tr.received(strings.Repeat("x", 2*traceLineMax))
+	if e := tr.Entries()[2]; len(e.Line) != traceLineMax+3 {
+		t.Errorf("want a long line truncated, got %d bytes", len(e.Line))
+	}
+
+	var none *Trace
+	none.sent("USER me")
+	if none.Entries() != nil || none.Dropped() != 0 {
+		t.Error("a nil trace must record nothing")
+	}
+}
+
+func TestPOP3Trace_RedactsSecrets(t *testing.T) {
+	host, port, _ := startScriptedPOP3(t, "+OK ready", map[string]string{
+		"PASS": "-ERR invalid password tanstaaf for mrose\r\n",
+		"RETR": "+OK 2 octets\r\nSubject: secret plans\r\n\r\nmeet at dawn\r\n.\r\n",
+	})
+	ctx := context.Background()
+	tr := NewTrace(50)
+	client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "mrose", Pass: []byte("tanstaaf"), Trace: tr})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	err := client.Auth(ctx)
+	if err == nil {
+		t.Fatal("Auth: want the rejection")
+	}
+	assertNoSecret(t, "error", err.Error(), "mrose", "tanstaaf")
+	if _, err := client.RetrieveTo(ctx, 1, new(strings.Builder)); err != nil {
+		t.Fatalf("RetrieveTo: %v", err)
+	}
+	if _, err := client.Retrieve(ctx, 1); err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	client.Close()
+
+	lines := traceLines(tr)
+	all := strings.Join(lines, "\n")
+	assertNoSecret(t, "trace", all, "mrose", "tanstaaf")
+	for _, want := range []string{"C PASS [redacted]", "S -ERR invalid password [redacted] for mrose", "C RETR 1", "- [message: 3 lines]", "C QUIT"} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("trace: want %q, got\n%s", want, all)
+		}
+	}
+	if strings.Contains(all, "secret plans") || strings.Contains(all, "meet at dawn") {
+		t.Errorf("trace holds the message:\n%s", all)
+	}
+}
+
+func TestPOP3Trace_APOP(t *testing.T) {
+	host, port, _ := startScriptedPOP3(t, "+OK POP3 server ready "+rfc1939Timestamp, map[string]string{
+		"APOP": "-ERR digest " + rfc1939Digest + " does not match\r\n",
+	})
+	ctx := context.Background()
+	tr := NewTrace(50)
+	client := NewPOP3Client(POP3Config{Host: host, Port: port, User: "mrose", Pass: []byte("tanstaaf"), AuthMechanism: POP3AuthAPOP, Trace: tr})
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	client.Auth(ctx) //nolint:errcheck
+	client.Close()
+	all := strings.Join(traceLines(tr), "\n")
+	if strings.Contains(all, rfc1939Digest) || !strings.Contains(all, "C APOP mrose [redacted]") {
+		t.Errorf("want the APOP digest redacted, got\n%s", all)
+	}
+}
+
+func TestSMTPTrace_RedactsSecrets(t *testing.T) {
+	pass := base64.StdEncoding.EncodeToString([]byte("s3cret"))
+	addr, _ := startStalling(t, func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprintf(conn, "220 ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case strings.HasPrefix(line, "AUTH PLAIN "):
+				fmt.Fprintf(conn, "535-5.7.8 credentials %s rejected\r\n535 5.7.8 password was s3cret\r\n", strings.TrimPrefix(line, "AUTH PLAIN "))
+			case line == "AUTH LOGIN":
+				fmt.Fprintf(conn, "334 VXNlcm5hbWU6\r\n")
+			case line == base64.StdEncoding.EncodeToString([]byte("me")):
+				fmt.Fprintf(conn, "334 UGFzc3dvcmQ6\r\n")
+			case line == pass:
+				fmt.Fprintf(conn, "535 5.7.8 bad password %s\r\n", line)
+			case line == "DATA":
+				fmt.Fprintf(conn, "354 go ahead\r\n")
+				for line != "." {
+					line, _ = r.ReadString('\n')
+					line = strings.TrimRight(line, "\r\n")
+				}
+				fmt.Fprintf(conn, "250 queued\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				fmt.Fprintf(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "250 OK\r\n")
+			}
+		}
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+
+	tr := NewTrace(50)
+	client := NewSMTPClient(SMTPConfig{Host: host, Port: portNum, User: "me", Pass: []byte("s3cret"), Trace: tr})
+	ctx := context.Background()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	err := client.Auth(ctx)
+	if err == nil {
+		t.Fatal("Auth: want the rejection")
+	}
+	assertNoSecret(t, "error", err.Error(), "me", "s3cret")
+	req := SendRequest{From: "me@example.com", To: []Address{{Email: "you@example.org"}}, Subject: "secret plans", Body: "meet at dawn"}
+	if _, err := client.Send(ctx, req); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	client.Close()
+
+	lines := traceLines(tr)
+	all := strings.Join(lines, "\n")
+	assertNoSecret(t, "trace", all, "me", "s3cret")
+	for _, want := range []string{"C AUTH PLAIN [redacted]", "S 535-5.7.8 credentials [redacted] rejected", "S 535 5.7.8 password was [redacted]", "C [redacted]", "S 535 5.7.8 bad password [redacted]", "C DATA", "C ."} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("trace: want %q, got\n%s", want, all)
+		}
+	}
+	if strings.Contains(all, "secret plans") || strings.Contains(all, "meet at dawn") {
+		t.Errorf("trace holds the message:\n%s", all)
+	}
+}
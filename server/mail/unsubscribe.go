@@ -0,0 +1,81 @@
+package mail
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// maxUnsubscribeURL bounds each List-Unsubscribe URL, so that the header,
+// folded one URL per line, stays within the 998-byte line limit.
+const maxUnsubscribeURL = 900
+
+// ValidateListUnsubscribe checks the List-Unsubscribe URLs of a message
+// (RFC 2369): at most one mailto: URL, with a single valid address, and at
+// most one https: URL.  oneClick, announcing RFC 8058 one-click unsubscribe,
+// requires the https: URL, which receives the unsubscribe POST.  URLs must
+// be percent-encoded ASCII without spaces or angle brackets, so they cannot
+// break out of the header.
+func ValidateListUnsubscribe(urls []string, oneClick bool) error {
+	var mailto, https bool
+	for _, raw := range urls {
+		if len(raw) > maxUnsubscribeURL {
+			return fmt.Errorf("List-Unsubscribe: URL longer than %d bytes", maxUnsubscribeURL)
+		}
+		if strings.ContainsFunc(raw, func(r rune) bool { return r <= ' ' || r >= 0x7f || r == '<' || r == '>' }) {
+			return fmt.Errorf("List-Unsubscribe: %q must be a percent-encoded URL", raw)
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return fmt.Errorf("List-Unsubscribe: %q is not a URL", raw)
+		}
+		switch u.Scheme {
+		case "mailto":
+			if mailto {
+				return fmt.Errorf("List-Unsubscribe: more than one mailto: URL")
+			}
+			mailto = true
+			addr, err := url.PathUnescape(u.Opaque)
+			if err != nil || ValidateAddress(addr) != nil {
+				return fmt.Errorf("List-Unsubscribe: %q does not name one valid address", raw)
+			}
+		case "https":
+			if https {
+				return fmt.Errorf("List-Unsubscribe: more than one https: URL")
+			}
+			https = true
+			if u.Host == "" || u.User != nil {
+				return fmt.Errorf("List-Unsubscribe: %q is not a valid https: URL", raw)
+			}
+		default:
+			return fmt.Errorf("List-Unsubscribe: %q is not a mailto: or https: URL", raw)
+		}
+	}
+	if oneClick && !https {
+		return fmt.Errorf("List-Unsubscribe-Post: one-click unsubscribe needs an https: List-Unsubscribe URL")
+	}
+	return nil
+}
+
+// listUnsubscribeHeaders renders the List-Unsubscribe and, for one-click
+// unsubscribe, List-Unsubscribe-Post header fields of req, or "" when it
+// has no unsubscribe URLs.  The URLs are folded onto lines of their own
+// when they do not fit on one.
+func listUnsubscribeHeaders(req SendRequest) string {
+	if len(req.ListUnsubscribe) == 0 {
+		return ""
+	}
+	urls := make([]string, len(req.ListUnsubscribe))
+	for i, u := range req.ListUnsubscribe {
+		urls[i] = "<" + headerValue(u) + ">"
+	}
+	sep := ", "
+	if len("List-Unsubscribe: ")+len(strings.Join(urls, sep)) > 78 {
+		sep = ",\r\n "
+	}
+	h := "List-Unsubscribe: " + strings.Join(urls, sep) + "\r\n"
+	if req.ListUnsubscribePost {
+		h += "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n"
+	}
+	return h
+}
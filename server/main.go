@@ -2,64 +2,628 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/gagliardetto/solana-go"
+
+	"mulamail/alert"
 	"mulamail/api"
 	"mulamail/blockchain"
 	"mulamail/config"
 	"mulamail/db"
+	"mulamail/mail"
+	"mulamail/mail/dkim"
 	"mulamail/vault"
 )
 
+const usage = `usage: %[1]s [command] [flags]
+
+Commands:
+  serve                                   run the HTTP server (default)
+  migrate                                 run data migrations, then exit
+  rotate-keys --new-key <hex>             re-encrypt stored credentials under a new ENCRYPTION_KEY
+  verify-account --owner <pubkey> --email <address>
+                                          log in to an account's POP3 and SMTP servers
+  identity lookup --email <address> [--exact]
+                                          show the identity an email resolves to
+  decrypt-export --in <file> [--out <file>]
+                                          decrypt a downloaded data export ($EXPORT_PASSPHRASE)
+  vault-gc [--dry-run] [--grace <duration>]
+                                          delete vault blobs no record refers to
+
+Maintenance commands accept --json for machine-readable output.
+`
+
+// errUsage marks command-line mistakes; they exit with status 2.
+var errUsage = errors.New("usage")
+
 func main() {
-	cfg := config.Load()
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
 
-	// MongoDB
-	dbClient, err := db.Connect(cfg.MongoURI, cfg.MongoDBName)
+	var err error
+	switch cmd {
+	case "serve":
+		err = serve(args)
+	case "migrate":
+		err = migrate(args)
+	case "rotate-keys":
+		err = rotateKeys(args)
+	case "verify-account":
+		err = verifyAccount(args)
+	case "identity":
+		err = identity(args)
+	case "decrypt-export":
+		err = decryptExport(args)
+	case "vault-gc":
+		err = vaultGC(args)
+	case "help":
+		fmt.Fprintf(os.Stdout, usage, os.Args[0])
+		return
+	default:
+		err = fmt.Errorf("%w: unknown command %q", errUsage, cmd)
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, errUsage):
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+// parseFlags parses args into fs, rejecting stray positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%w: unexpected argument %q", errUsage, fs.Arg(0))
+	}
+	return nil
+}
+
+// dbOptions reads the MongoDB write settings.
+func dbOptions(cfg *config.Config) (db.Options, error) {
+	wc, err := db.ParseWriteConcern(cfg.MongoDurableWriteConcern, time.Duration(cfg.MongoDurableWTimeoutSeconds)*time.Second)
 	if err != nil {
-		log.Fatalf("MongoDB connect: %v", err)
+		return db.Options{}, fmt.Errorf("MONGO_DURABLE_WRITE_CONCERN: %w", err)
 	}
-	defer dbClient.Close()
+	return db.Options{DurableWriteConcern: wc, RetryWrites: cfg.MongoRetryWrites}, nil
+}
 
-	// Solana RPC
-	solanaClient := blockchain.NewClient(cfg.SolanaRPC)
+// connectDB opens the configured MongoDB database for a maintenance command.
+func connectDB(cfg *config.Config) (*db.Client, error) {
+	opts, err := dbOptions(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Config: %w", err)
+	}
+	dbClient, err := db.Connect(cfg.MongoURI.Reveal(), cfg.MongoDBName, opts)
+	if err != nil {
+		return nil, fmt.Errorf("MongoDB connect: %s", cfg.MongoURI.Redact(err.Error()))
+	}
+	return dbClient, nil
+}
 
-	// Storage (local or S3)
-	var storage vault.Storage
-	switch cfg.StorageType {
+// openStorage opens the configured vault storage, encrypting every object
+// under ENCRYPTION_KEY.
+func openStorage(cfg *config.Config) (vault.Storage, error) {
+	inner, err := openRawStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ring, err := vault.NewKeyRing(cfg.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("vault key ring: %w", err)
+	}
+	storage := vault.NewEncryptedStorage(inner, ring)
+	storage.AllowLegacy = cfg.VaultAllowLegacyBlobs
+	return storage, nil
+}
+
+// openRawStorage opens the configured backend (local or S3), or with
+// STORAGE_ROUTES set, each backend the routes name behind one composite.
+func openRawStorage(cfg *config.Config) (vault.Storage, error) {
+	if len(cfg.StorageRoutes) > 0 {
+		backends := make(map[string]vault.Storage)
+		for _, r := range cfg.StorageRoutes {
+			if backends[r.Backend] != nil {
+				continue
+			}
+			b, err := openBackend(cfg, r.Backend)
+			if err != nil {
+				return nil, err
+			}
+			backends[r.Backend] = b
+		}
+		return vault.NewCompositeStorage(cfg.StorageRoutes, backends)
+	}
+	return openBackend(cfg, cfg.StorageType)
+}
+
+// openBackend opens one storage backend of the given type.
+func openBackend(cfg *config.Config, storageType string) (vault.Storage, error) {
+	switch storageType {
 	case "s3":
-		log.Printf("Using S3 storage: region=%s bucket=%s", cfg.AWSRegion, cfg.S3Bucket)
 		s3Client, err := vault.NewS3Client(cfg.AWSRegion, cfg.S3Bucket)
 		if err != nil {
-			log.Fatalf("S3 init: %v", err)
+			return nil, fmt.Errorf("S3 init: %w", err)
 		}
-		storage = s3Client
+		s3Client.VerifyChecksums = cfg.VaultVerifyChecksums
+		return s3Client, nil
 	case "local":
-		log.Printf("Using local storage: path=%s", cfg.LocalDataPath)
 		localStorage, err := vault.NewLocalStorage(cfg.LocalDataPath)
 		if err != nil {
-			log.Fatalf("Local storage init: %v", err)
+			return nil, fmt.Errorf("local storage init: %w", err)
+		}
+		localStorage.VerifyChecksums = cfg.VaultVerifyChecksums
+		return localStorage, nil
+	default:
+		return nil, fmt.Errorf("invalid storage type: %s (must be 'local' or 's3')", storageType)
+	}
+}
+
+// alertChecks builds the dependency checks the alert monitor runs.
+func alertChecks(cfg *config.Config, dbClient *db.Client, solanaClient *blockchain.Client) ([]alert.Check, error) {
+	interval := time.Duration(cfg.AlertCheckIntervalSeconds) * time.Second
+	checks := []alert.Check{
+		alert.PingCheck("mongo", cfg.AlertMongoPingFailures, func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, interval/2)
+			defer cancel()
+			return dbClient.Ping(ctx)
+		}),
+		alert.DecryptFailureCheck(uint64(cfg.AlertDecryptFailures), vault.DecryptFailures),
+	}
+	if cfg.AlertRelayerWallet != "" {
+		wallet, err := solana.PublicKeyFromBase58(cfg.AlertRelayerWallet)
+		if err != nil {
+			return nil, fmt.Errorf("ALERT_RELAYER_WALLET: %w", err)
+		}
+		checks = append(checks, alert.BalanceCheck(cfg.AlertRelayerWallet, uint64(cfg.AlertRelayerMinLamports),
+			func(ctx context.Context) (uint64, error) { return solanaClient.GetBalance(ctx, wallet) }))
+	}
+	if cfg.AlertTLSCerts != "" {
+		var paths []string
+		for _, p := range strings.Split(cfg.AlertTLSCerts, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths = append(paths, p)
+			}
+		}
+		checks = append(checks, alert.CertExpiryCheck(paths, time.Duration(cfg.AlertCertExpiryDays)*24*time.Hour))
+	}
+	return checks, nil
+}
+
+// report writes v as JSON when asJSON is set, and text otherwise.
+func report(asJSON bool, v any, text string) error {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	_, err := fmt.Fprintln(os.Stdout, text)
+	return err
+}
+
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	dbClient, err := connectDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	n, err := api.MigrateMessageCache(context.Background(), dbClient, cfg)
+	if err != nil {
+		return fmt.Errorf("message cache migration: %w", err)
+	}
+	res, err := api.CanonicalizeIdentities(context.Background(), dbClient, cfg)
+	if err != nil {
+		return fmt.Errorf("identity canonicalisation: %w", err)
+	}
+	text := fmt.Sprintf("Encrypted %d plaintext message cache documents\nCanonicalised %d of %d identity emails", n, res.Updated, res.Identities)
+	for _, c := range res.Collisions {
+		text += fmt.Sprintf("\n  collision on %s: kept %s, left %s to exact matching", c.CanonicalEmail, c.Kept, strings.Join(c.Skipped, ", "))
+	}
+	return report(*asJSON, map[string]any{"message_cache_encrypted": n, "identities": res}, text)
+}
+
+func rotateKeys(args []string) error {
+	fs := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	newKey := fs.String("new-key", os.Getenv("NEW_ENCRYPTION_KEY"), "hex-encoded 32-byte key to rotate to (default $NEW_ENCRYPTION_KEY)")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *newKey == "" {
+		return fmt.Errorf("%w: rotate-keys needs --new-key or NEW_ENCRYPTION_KEY", errUsage)
+	}
+	next, err := vault.ParseKey(*newKey)
+	if err != nil {
+		return fmt.Errorf("%w: new key: %v", errUsage, err)
+	}
+	defer next.Zero()
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if vault.IsWeakKey(*newKey) && !cfg.DevMode() {
+		return fmt.Errorf("%w: new key is publicly known or guessable; generate one with `openssl rand -hex 32`", errUsage)
+	}
+	dbClient, err := connectDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	res, err := api.RotateEncryptionKey(context.Background(), dbClient, cfg.EncryptionKey, next)
+	if err != nil {
+		return err
+	}
+	return report(*asJSON, res, fmt.Sprintf(
+		"Re-encrypted %d mail accounts, %d scheduled and %d outbox messages (%d already rotated)\nSet ENCRYPTION_KEY to the new key before restarting the server.",
+		res.Accounts, res.Scheduled, res.Outbox, res.Skipped))
+}
+
+func vaultGC(args []string) error {
+	fs := flag.NewFlagSet("vault-gc", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report unreferenced blobs without deleting them")
+	grace := fs.Duration("grace", -1, "keep unreferenced blobs modified more recently than this (default $VAULT_GC_GRACE_HOURS)")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	storage, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+	dbClient, err := connectDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	opts := api.VaultGCOptions{
+		DryRun:           *dryRun,
+		Grace:            time.Duration(cfg.VaultGCGraceHours) * time.Hour,
+		DeletesPerSecond: cfg.VaultGCDeletesPerSecond,
+	}
+	if *grace >= 0 {
+		opts.Grace = *grace
+	}
+	res, err := api.CollectVaultGarbage(context.Background(), dbClient, storage, opts)
+	if err != nil {
+		return err
+	}
+	verb := "Deleted"
+	if res.DryRun {
+		verb = "Would delete"
+	}
+	return report(*asJSON, res, fmt.Sprintf(
+		"Scanned %d vault blobs: %d unreferenced (%d within the grace period)\n%s %d blobs, %d bytes",
+		res.Scanned, res.Orphaned+res.Recent, res.Recent, verb, res.Orphaned, res.BytesReclaimed))
+}
+
+// decryptExport decrypts an archive downloaded from /api/v1/export.  It
+// needs no configuration, so users can run it away from the server.
+func decryptExport(args []string) error {
+	fs := flag.NewFlagSet("decrypt-export", flag.ContinueOnError)
+	in := fs.String("in", "", "encrypted archive (mulamail-export-<id>.zip.enc)")
+	out := fs.String("out", "", "where to write the zip archive (default: --in without .enc)")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return fmt.Errorf("%w: decrypt-export needs --in", errUsage)
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(*in, ".enc")
+		if *out == *in {
+			*out += ".zip"
 		}
-		storage = localStorage
+	}
+	passphrase := os.Getenv("EXPORT_PASSPHRASE")
+	if passphrase == "" {
+		return fmt.Errorf("%w: set EXPORT_PASSPHRASE to the passphrase the export was requested with", errUsage)
+	}
+
+	blob, err := os.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	archive, err := vault.DecryptWithPassphrase(passphrase, blob)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, archive, 0o600); err != nil {
+		return err
+	}
+	return report(*asJSON, map[string]any{"out": *out, "bytes": len(archive)},
+		fmt.Sprintf("Wrote %d bytes to %s", len(archive), *out))
+}
+
+func verifyAccount(args []string) error {
+	fs := flag.NewFlagSet("verify-account", flag.ContinueOnError)
+	owner := fs.String("owner", "", "owner pubkey of the mail account")
+	email := fs.String("email", "", "email address of the mail account")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *owner == "" || *email == "" {
+		return fmt.Errorf("%w: verify-account needs --owner and --email", errUsage)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	dbClient, err := connectDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	check, err := api.VerifyAccount(context.Background(), dbClient, cfg, *owner, *email)
+	if errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("no mail account %s for owner %s", *email, *owner)
+	}
+	if err != nil {
+		return err
+	}
+
+	pop3, smtp := fmt.Sprintf("ok (%d messages)", check.Messages), "ok"
+	switch {
+	case check.POP3Error != "":
+		pop3 = "FAILED: " + check.POP3Error
+	case len(check.POP3Capabilities) > 0:
+		pop3 += "\n  POP3 capabilities: " + strings.Join(check.POP3Capabilities, ", ")
 	default:
-		log.Fatalf("Invalid storage type: %s (must be 'local' or 's3')", cfg.StorageType)
+		pop3 += "\n  POP3 capabilities: CAPA not supported"
+	}
+	if check.SMTPError != "" {
+		smtp = "FAILED: " + check.SMTPError
+	}
+	if err := report(*asJSON, check, fmt.Sprintf("%s (owner %s)\n  POP3: %s\n  SMTP: %s", *email, *owner, pop3, smtp)); err != nil {
+		return err
+	}
+	if !check.OK() {
+		return errors.New("account verification failed")
+	}
+	return nil
+}
+
+func identity(args []string) error {
+	if len(args) == 0 || args[0] != "lookup" {
+		return fmt.Errorf("%w: identity needs the lookup subcommand", errUsage)
+	}
+	fs := flag.NewFlagSet("identity lookup", flag.ContinueOnError)
+	email := fs.String("email", "", "email address to look up")
+	exact := fs.Bool("exact", false, "match the stored email exactly instead of by its canonical form")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if *email == "" {
+		return fmt.Errorf("%w: identity lookup needs --email", errUsage)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	rules, err := mail.ParseCanonicalRules(cfg.EmailCanonicalRules)
+	if err != nil {
+		return fmt.Errorf("EMAIL_CANONICAL_RULES: %w", err)
+	}
+	dbClient, err := connectDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	var id *db.Identity
+	if *exact {
+		id, err = dbClient.GetIdentityByEmail(context.Background(), *email)
+	} else {
+		id, err = dbClient.GetIdentityByCanonicalEmail(context.Background(), rules.Canonical(*email), *email)
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("no identity registered for %s", *email)
+	}
+	if err != nil {
+		return err
+	}
+	return report(*asJSON, id, fmt.Sprintf("%s\n  pubkey:   %s\n  verified: %t\n  tx:       %s\n  created:  %s",
+		id.Email, id.PubKey, id.Verified, id.TxHash, id.CreatedAt.Format(time.RFC3339)))
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	reconcile := fs.Bool("reconcile", false, "restore identities from the on-chain memo history of the pubkeys given as arguments, then exit")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Config: %v", err)
+	}
+	defer cfg.EncryptionKey.Zero()
+	if cfg.WeakEncryptionKey {
+		if !cfg.DevMode() {
+			log.Fatalf("Config: ENCRYPTION_KEY is a publicly known or guessable key; generate one with `openssl rand -hex 32` and move stored credentials to it with rotate-keys (set ENV=dev to allow it in development)")
+		}
+		log.Printf("WARNING: ENCRYPTION_KEY is a publicly known or guessable key; never use it outside development")
+	}
+	if cfg.LogLevel != "info" && cfg.LogLevel != "debug" {
+		log.Fatalf("Config: LOG_LEVEL must be info or debug, got %q", cfg.LogLevel)
+	}
+	canonicalRules, err := mail.ParseCanonicalRules(cfg.EmailCanonicalRules)
+	if err != nil {
+		log.Fatalf("Config: EMAIL_CANONICAL_RULES: %v", err)
+	}
+	if _, err := mail.ParseDomainList(cfg.SendAllowedDomains); err != nil {
+		log.Fatalf("Config: SEND_ALLOWED_DOMAINS: %v", err)
+	}
+	if _, err := mail.ParseDomainList(cfg.SendBlockedDomains); err != nil {
+		log.Fatalf("Config: SEND_BLOCKED_DOMAINS: %v", err)
+	}
+	if _, err := api.ParseTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Config: TRUSTED_PROXIES: %v", err)
+	}
+	dbOpts, err := dbOptions(cfg)
+	if err != nil {
+		log.Fatalf("Config: %v", err)
+	}
+
+	// MongoDB
+	dbClient, err := db.Connect(cfg.MongoURI.Reveal(), cfg.MongoDBName, dbOpts)
+	if err != nil {
+		log.Fatalf("MongoDB connect: %s", cfg.MongoURI.Redact(err.Error()))
+	}
+	defer dbClient.Close()
+
+	// Solana RPC
+	solanaClient := blockchain.NewClient(cfg.SolanaRPC)
+	solanaClient.Timeout = time.Duration(cfg.SolanaRPCTimeoutSeconds) * time.Second
+
+	if *reconcile {
+		if fs.NArg() == 0 {
+			return fmt.Errorf("%w: --reconcile needs at least one pubkey", errUsage)
+		}
+		pubkeys, err := api.ParsePubKeys(fs.Args())
+		if err != nil {
+			log.Fatalf("Invalid pubkey: %v", err)
+		}
+		res, err := api.ReconcileIdentities(context.Background(), dbClient, solanaClient, canonicalRules, pubkeys)
+		if err != nil {
+			log.Fatalf("Reconcile identities: %v", err)
+		}
+		log.Printf("Reconciled %d pubkeys: %d identity memos found, %d identities restored", res.PubKeys, res.Found, res.Inserted)
+		return nil
+	}
+
+	// Storage (local or S3)
+	switch {
+	case len(cfg.StorageRoutes) > 0:
+		log.Printf("Using routed storage: %s (local path=%s, S3 region=%s bucket=%s)",
+			os.Getenv("STORAGE_ROUTES"), cfg.LocalDataPath, cfg.AWSRegion, cfg.S3Bucket)
+	case cfg.StorageType == "s3":
+		log.Printf("Using S3 storage: region=%s bucket=%s", cfg.AWSRegion, cfg.S3Bucket)
+	case cfg.StorageType == "local":
+		log.Printf("Using local storage: path=%s", cfg.LocalDataPath)
+	}
+	storage, err := openStorage(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Operator alerts
+	sinks, err := alert.SinksFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Alerts: %v", err)
+	}
+	alerts := alert.NewBus(time.Duration(cfg.AlertDedupMinutes)*time.Minute, sinks...)
+	checks, err := alertChecks(cfg, dbClient, solanaClient)
+	if err != nil {
+		log.Fatalf("Alerts: %v", err)
+	}
+	storage = alert.WatchStorage(storage, alerts)
+
+	// Outbound mail connections (validated here; handlers build their own)
+	if _, err := mail.NewDialer(cfg.OutboundProxy.Reveal(), cfg.OutboundBindIP); err != nil {
+		log.Fatalf("Outbound dialer: %s", cfg.OutboundProxy.Redact(err.Error()))
+	}
+	if cfg.OutboundProxy != "" {
+		log.Printf("Routing mail connections through outbound proxy")
+	}
+	dkimKeys, err := dkim.LoadKeys(cfg.DKIMKeys)
+	if err != nil {
+		log.Fatalf("DKIM keys: %v", err)
+	}
+	for domain, signer := range dkimKeys {
+		log.Printf("Signing mail from %s with DKIM selector %s", domain, signer.Selector)
+	}
+
+	// Encrypt any preview cache documents written before field encryption
+	if n, err := api.MigrateMessageCache(context.Background(), dbClient, cfg); err != nil {
+		log.Printf("Message cache migration: %v", err)
+	} else if n > 0 {
+		log.Printf("Encrypted %d plaintext message cache documents", n)
+	}
+
+	// Canonicalise identity emails stored before canonicalisation or under
+	// other EMAIL_CANONICAL_RULES
+	if res, err := api.CanonicalizeIdentities(context.Background(), dbClient, cfg); err != nil {
+		log.Printf("Identity canonicalisation: %v", err)
+	} else {
+		if res.Updated > 0 {
+			log.Printf("Canonicalised %d identity emails", res.Updated)
+		}
+		for _, c := range res.Collisions {
+			log.Printf("WARNING: identities %v collide with %s on canonical email %s; they resolve by exact email only",
+				c.Skipped, c.Kept, c.CanonicalEmail)
+		}
 	}
 
 	// HTTP server
 	mux := api.NewRouter(dbClient, solanaClient, storage, cfg)
-	server := &http.Server{
-		Addr:    ":" + cfg.Port,
-		Handler: mux,
-	}
+	server := api.NewHTTPServer(":"+cfg.Port, mux, cfg)
 
 	// Graceful shutdown on SIGINT / SIGTERM
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	// Outbox and scheduled-send delivery, data exports, mailbox archives,
+	// owner deletions, vault and preview cache GC and checks that identity
+	// transactions landed
+	go api.NewOutbox(dbClient, cfg).Run(ctx)
+	go api.NewScheduler(dbClient, cfg).Run(ctx)
+	go api.NewExporter(dbClient, storage, cfg).Run(ctx)
+	go api.NewArchiver(dbClient, storage, cfg).Run(ctx)
+	go api.NewEraser(dbClient, storage, cfg).Run(ctx)
+	go api.NewVaultGC(dbClient, storage, cfg).Run(ctx)
+	go api.NewCacheGC(dbClient, storage, cfg).Run(ctx)
+	go api.NewChainChecker(dbClient, solanaClient, alerts, cfg).Run(ctx)
+
+	// Operator alerting
+	go alerts.Run(ctx)
+	go alert.NewMonitor(alerts, time.Duration(cfg.AlertCheckIntervalSeconds)*time.Second, checks...).Run(ctx)
+
 	go func() {
 		log.Printf("MulaMail server listening on :%s", cfg.Port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -76,4 +640,5 @@ func main() {
 		log.Printf("shutdown: %v", err)
 	}
 	log.Println("stopped")
+	return nil
 }
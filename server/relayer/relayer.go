@@ -6,6 +6,13 @@ package relayer
 // Phase 1 stub — Phase 2 will load a funded keypair, intercept unsigned
 // transactions from the identity and mail flows, attach the fee-payer
 // account, and broadcast.
+//
+// Sponsoring must not ship without per-pubkey spend accounting (count and
+// lamports per rolling window, persisted in Mongo), configurable limits
+// enforced with 429 before a transaction is signed, and an operator status
+// endpoint reporting the fee payer's balance and recent spend, with an alert
+// when the balance runs low.  Otherwise any client can drain the wallet by
+// requesting sponsored transactions in a loop.
 
 // Relayer holds the state needed to sponsor fees.
 type Relayer struct{}
@@ -131,6 +131,7 @@ if [ -z "$ENCRYPTION_KEY" ]; then
     else
         echo "Using insecure default key (DO NOT USE IN PRODUCTION)"
         export ENCRYPTION_KEY="0000000000000000000000000000000000000000000000000000000000000000"
+        export ENV="dev"  # the server refuses the default key otherwise
     fi
 else
     echo -e "${GREEN}✓${NC} ENCRYPTION_KEY is set"
@@ -153,7 +154,7 @@ echo "MONGO_DB:       $MONGO_DB"
 echo "SOLANA_RPC:     $SOLANA_RPC"
 echo "AWS_REGION:     $AWS_REGION"
 echo "S3_BUCKET:      $S3_BUCKET"
-echo "ENCRYPTION_KEY: ${ENCRYPTION_KEY:0:16}... (hidden)"
+echo "ENCRYPTION_KEY: (set, hidden)"
 echo ""
 
 # Install dependencies
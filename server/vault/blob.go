@@ -0,0 +1,99 @@
+package vault
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Blob formats, recorded in the first byte of every blob written by
+// EncryptBlob and authenticated along with the ciphertext.  Neither value is
+// a hex digit, which is how DecryptBlob tells them from blobs written as
+// Key.Encrypt hex before blobs had a header.
+const (
+	blobRaw  byte = 0x01 // nonce || AES-GCM(data)
+	blobGzip byte = 0x02 // nonce || AES-GCM(gzip(data))
+)
+
+// EncryptBlob encrypts data for the vault.  Data that gzip shrinks is
+// compressed before encryption; data that does not shrink, such as an
+// already compressed attachment, is stored as is.  Unlike Encrypt the
+// result is binary, not hex.
+func (k Key) EncryptBlob(data []byte) ([]byte, error) {
+	if k.IsZero() {
+		return nil, errNoKey
+	}
+	format, payload := compressBlob(data)
+	header := []byte{format}
+	sealed, err := EncryptBytes(k.b, payload, header)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+// DecryptBlob is the inverse of EncryptBlob.  It also reads blobs written
+// as Key.Encrypt hex ciphertext, so vaults written before EncryptBlob
+// existed stay readable.
+func (k Key) DecryptBlob(blob []byte) ([]byte, error) {
+	if k.IsZero() {
+		return nil, errNoKey
+	}
+	if len(blob) == 0 {
+		return nil, errors.New("empty blob")
+	}
+	format := blob[0]
+	if isHexDigit(format) {
+		return k.Decrypt(string(blob))
+	}
+	if format != blobRaw && format != blobGzip {
+		return nil, fmt.Errorf("unknown blob format %#x", format)
+	}
+	data, err := DecryptBytes(k.b, blob[1:], blob[:1])
+	if err != nil {
+		return nil, err
+	}
+	if format == blobGzip {
+		return gunzipBytes(data)
+	}
+	return data, nil
+}
+
+// compressBlob returns data gzipped if that shrinks it, or else as is,
+// along with the blob format that says which.
+func compressBlob(data []byte) (byte, []byte) {
+	if z, err := gzipBytes(data); err == nil && len(z) < len(data) {
+		return blobGzip, z
+	}
+	return blobRaw, data
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(z []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		return nil, fmt.Errorf("decompress blob: %w", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompress blob: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,128 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// corpus returns the sample messages in testdata/corpus.
+func corpus(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "corpus", "*.eml"))
+	if err != nil || len(paths) == 0 {
+		tb.Fatalf("no sample messages: %v", err)
+	}
+	msgs := make(map[string][]byte, len(paths))
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		msgs[filepath.Base(p)] = data
+	}
+	return msgs
+}
+
+func TestEncryptBlob_RoundTrip(t *testing.T) {
+	key := MustParseKey(generateTestKey(t))
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	for name, data := range map[string][]byte{"text": bytes.Repeat([]byte("Subject: hello\r\n"), 100), "random": random, "empty": {}} {
+		blob, err := key.EncryptBlob(data)
+		if err != nil {
+			t.Fatalf("%s: EncryptBlob failed: %v", name, err)
+		}
+		got, err := key.DecryptBlob(blob)
+		if err != nil {
+			t.Fatalf("%s: DecryptBlob failed: %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: round trip mismatch", name)
+		}
+		if name == "random" && blob[0] != blobRaw {
+			t.Errorf("incompressible data should be stored raw, got format %#x", blob[0])
+		}
+		if name == "text" && blob[0] != blobGzip {
+			t.Errorf("text should be compressed, got format %#x", blob[0])
+		}
+	}
+}
+
+func TestDecryptBlob_Legacy(t *testing.T) {
+	key := MustParseKey(generateTestKey(t))
+	legacy, _ := key.EncryptString("From: a@example.com\r\n\r\nbody")
+	got, err := key.DecryptBlob([]byte(legacy))
+	if err != nil || string(got) != "From: a@example.com\r\n\r\nbody" {
+		t.Errorf("legacy hex blob: got %q, %v", got, err)
+	}
+}
+
+func TestDecryptBlob_RejectsTamperedHeader(t *testing.T) {
+	key := MustParseKey(generateTestKey(t))
+	blob, _ := key.EncryptBlob(bytes.Repeat([]byte("compressible "), 50))
+	blob[0] = blobRaw
+	if _, err := key.DecryptBlob(blob); err == nil {
+		t.Error("a blob whose format byte was changed must not decrypt")
+	}
+	if _, err := key.DecryptBlob([]byte{0x7f, 1, 2, 3}); err == nil {
+		t.Error("unknown format: expected error")
+	}
+}
+
+func TestEncryptBlob_Corpus(t *testing.T) {
+	key := MustParseKey(generateTestKey(t))
+	var in, hex, out int
+	for name, msg := range corpus(t) {
+		blob, err := key.EncryptBlob(msg)
+		if err != nil {
+			t.Fatalf("%s: EncryptBlob failed: %v", name, err)
+		}
+		if got, err := key.DecryptBlob(blob); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s: round trip failed: %v", name, err)
+		}
+		legacy, _ := key.Encrypt(msg)
+		in += len(msg)
+		hex += len(legacy)
+		out += len(blob)
+	}
+	// The attachment in the corpus is incompressible, so most of the gain on
+	// it comes from dropping hex.
+	if out >= in || out*2 > hex {
+		t.Errorf("corpus of %d bytes (%d as hex) stored in %d", in, hex, out)
+	}
+}
+
+// BenchmarkEncryptBlob reports the stored size of each sample message
+// relative to the old hex format (EncryptString) and to the raw message.
+func BenchmarkEncryptBlob(b *testing.B) {
+	key := MustParseKey("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	for name, msg := range corpus(b) {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(msg)))
+			var blob []byte
+			for i := 0; i < b.N; i++ {
+				blob, _ = key.EncryptBlob(msg)
+			}
+			legacy, _ := key.Encrypt(msg)
+			b.ReportMetric(float64(len(msg))/float64(len(blob)), "x_vs_raw")
+			b.ReportMetric(float64(len(legacy))/float64(len(blob)), "x_vs_hex")
+		})
+	}
+}
+
+func BenchmarkDecryptBlob(b *testing.B) {
+	key := MustParseKey("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	for name, msg := range corpus(b) {
+		blob, _ := key.EncryptBlob(msg)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(msg)))
+			for i := 0; i < b.N; i++ {
+				key.DecryptBlob(blob)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package vault
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// metaVersion is the version of ObjectMeta that backends write.
+const metaVersion = 1
+
+// ErrChecksumMismatch is returned for an object whose bytes no longer
+// match the checksum recorded when it was stored: it was corrupted at
+// rest or only partly written.
+var ErrChecksumMismatch = errors.New("vault object does not match its checksum")
+
+// ErrNoChecksum is returned by Verify for an object stored without a
+// checksum, before backends recorded them, or by a backend that does not.
+var ErrNoChecksum = errors.New("vault object has no checksum")
+
+// ObjectMeta is the integrity record a backend keeps with each object:
+// LocalStorage in a sidecar file, S3Client in the object's user metadata.
+// The checksum covers the bytes as stored, which behind an EncryptedStorage
+// is the ciphertext: that is what can rot, and it can be checked without
+// the key, so a corrupted object is told apart from one encrypted under a
+// key that is not in the ring.
+type ObjectMeta struct {
+	Version int    `json:"v"`      // metaVersion when written
+	SHA256  string `json:"sha256"` // hex SHA-256 of the stored bytes
+}
+
+// newObjectMeta returns the integrity record of data.
+func newObjectMeta(data []byte) ObjectMeta {
+	sum := sha256.Sum256(data)
+	return ObjectMeta{Version: metaVersion, SHA256: hex.EncodeToString(sum[:])}
+}
+
+// parseObjectMeta decodes an integrity record of a version this package
+// reads.
+func parseObjectMeta(raw []byte) (ObjectMeta, error) {
+	var m ObjectMeta
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return ObjectMeta{}, fmt.Errorf("parse object metadata: %w", err)
+	}
+	if m.Version != metaVersion {
+		return ObjectMeta{}, fmt.Errorf("object metadata version %d is not supported", m.Version)
+	}
+	return m, nil
+}
+
+// check verifies the object at key against m.
+func (m ObjectMeta) check(key string, data []byte) error {
+	want := newObjectMeta(data)
+	if subtle.ConstantTimeCompare([]byte(m.SHA256), []byte(want.SHA256)) != 1 {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, key)
+	}
+	return nil
+}
+
+// Verifier is implemented by storages that can check an object against the
+// checksum recorded with it.
+type Verifier interface {
+	// Verify returns nil when the object at key matches its checksum,
+	// ErrChecksumMismatch when it does not and ErrNoChecksum when it has
+	// none.
+	Verify(ctx context.Context, key string) error
+}
+
+// VerifyObject verifies the object at key if s is a Verifier, and returns
+// ErrNoChecksum otherwise.
+func VerifyObject(ctx context.Context, s Storage, key string) error {
+	if v, ok := s.(Verifier); ok {
+		return v.Verify(ctx, key)
+	}
+	return fmt.Errorf("%w: %s", ErrNoChecksum, key)
+}
@@ -0,0 +1,300 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrNoRoute is returned for a key that no storage route covers.
+var ErrNoRoute = errors.New("no storage route for key")
+
+// StorageRoute sends the keys under Prefix to the named backend.  The
+// prefix "*" covers every key.
+type StorageRoute struct {
+	Prefix  string
+	Backend string
+}
+
+// ParseStorageRoutes parses comma-separated "prefix -> backend" rules, such
+// as "messages/ -> s3, exports/ -> s3, * -> local".  A key goes to the rule
+// with the longest prefix it starts with; "*" matches what no other rule
+// does.
+func ParseStorageRoutes(s string) ([]StorageRoute, error) {
+	var routes []StorageRoute
+	seen := make(map[string]bool)
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		prefix, backend, ok := strings.Cut(rule, "->")
+		prefix, backend = strings.TrimSpace(prefix), strings.TrimSpace(backend)
+		if !ok || prefix == "" || backend == "" {
+			return nil, fmt.Errorf("storage route %q: want \"prefix -> backend\"", rule)
+		}
+		if strings.Contains(prefix, "..") {
+			return nil, fmt.Errorf("storage route %q: prefix contains '..'", rule)
+		}
+		if seen[prefix] {
+			return nil, fmt.Errorf("storage route %q: prefix %q is routed twice", rule, prefix)
+		}
+		seen[prefix] = true
+		routes = append(routes, StorageRoute{Prefix: prefix, Backend: backend})
+	}
+	return routes, nil
+}
+
+// CompositeStorage implements Storage over several backends, sending each
+// key to the backend its route names.  Listings merge the backends whose
+// routes overlap the prefix, and only report the keys each backend owns, so
+// objects left behind in a backend after a route change stay invisible.
+type CompositeStorage struct {
+	routes   []StorageRoute // longest prefix first; "*" is stored as ""
+	backends map[string]Storage
+}
+
+// NewCompositeStorage routes keys to backends by routes.  Every route must
+// name one of backends.
+func NewCompositeStorage(routes []StorageRoute, backends map[string]Storage) (*CompositeStorage, error) {
+	if len(routes) == 0 {
+		return nil, errors.New("no storage routes")
+	}
+	c := &CompositeStorage{backends: backends}
+	for _, r := range routes {
+		if backends[r.Backend] == nil {
+			return nil, fmt.Errorf("storage route %q: unknown backend %q", r.Prefix, r.Backend)
+		}
+		if r.Prefix == "*" {
+			r.Prefix = ""
+		}
+		c.routes = append(c.routes, r)
+	}
+	slices.SortStableFunc(c.routes, func(a, b StorageRoute) int { return len(b.Prefix) - len(a.Prefix) })
+	return c, nil
+}
+
+// route returns the name of the backend that owns key.
+func (c *CompositeStorage) route(key string) (string, bool) {
+	for _, r := range c.routes {
+		if strings.HasPrefix(key, r.Prefix) {
+			return r.Backend, true
+		}
+	}
+	return "", false
+}
+
+// backend returns the backend that owns key.
+func (c *CompositeStorage) backend(key string) (Storage, error) {
+	name, ok := c.route(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoRoute, key)
+	}
+	return c.backends[name], nil
+}
+
+// listBackends returns, sorted, the backends that can own keys under
+// prefix: the one the prefix itself routes to and those of the routes
+// nested inside it.
+func (c *CompositeStorage) listBackends(prefix string) []string {
+	var names []string
+	if name, ok := c.route(prefix); ok {
+		names = append(names, name)
+	}
+	for _, r := range c.routes {
+		if strings.HasPrefix(r.Prefix, prefix) && !slices.Contains(names, r.Backend) {
+			names = append(names, r.Backend)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// owns reports whether key is routed to backend name.
+func (c *CompositeStorage) owns(name, key string) bool {
+	owner, ok := c.route(key)
+	return ok && owner == name
+}
+
+func (c *CompositeStorage) Put(ctx context.Context, key string, data []byte) error {
+	b, err := c.backend(key)
+	if err != nil {
+		return err
+	}
+	return b.Put(ctx, key, data)
+}
+
+func (c *CompositeStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := c.backend(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.Get(ctx, key)
+}
+
+func (c *CompositeStorage) Delete(ctx context.Context, key string) error {
+	b, err := c.backend(key)
+	if err != nil {
+		return err
+	}
+	return b.Delete(ctx, key)
+}
+
+func (c *CompositeStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	b, err := c.backend(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return b.Stat(ctx, key)
+}
+
+// Verify checks the object at key in the backend that owns it; see
+// Verifier.
+func (c *CompositeStorage) Verify(ctx context.Context, key string) error {
+	b, err := c.backend(key)
+	if err != nil {
+		return err
+	}
+	return VerifyObject(ctx, b, key)
+}
+
+// List returns the keys under prefix from every backend that can own them,
+// merged in lexicographic order.
+func (c *CompositeStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for _, name := range c.listBackends(prefix) {
+		found, err := c.backends[name].List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, key := range found {
+			if c.owns(name, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// compositeCursor is where the listing of one backend stands: the backend's
+// token for the page being read, and the last key already returned from it.
+type compositeCursor struct {
+	Token string `json:"t,omitempty"`
+	After string `json:"a,omitempty"`
+}
+
+// ListPage returns a page of keys under prefix; see Storage.  When several
+// backends can own keys under prefix their pages are merged in key order.
+// The token records, per unfinished backend, the backend's own token for the
+// page being read and the last key returned from it, so a page that was
+// only partly consumed is read again from there.
+func (c *CompositeStorage) ListPage(ctx context.Context, prefix string, limit int, token string) ([]string, string, error) {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	names := c.listBackends(prefix)
+	if len(names) == 0 {
+		return nil, "", nil
+	}
+	if len(names) == 1 {
+		// Every key under prefix belongs to this backend.
+		return c.backends[names[0]].ListPage(ctx, prefix, limit, token)
+	}
+
+	cursors := make(map[string]compositeCursor)
+	if token == "" {
+		for _, name := range names {
+			cursors[name] = compositeCursor{}
+		}
+	} else {
+		raw, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || json.Unmarshal(raw, &cursors) != nil {
+			return nil, "", fmt.Errorf("invalid page token")
+		}
+	}
+
+	// Read at least one key, or the end, from every unfinished backend.
+	type pending struct {
+		keys []string
+		next string // the backend's token for the page after keys
+	}
+	heads := make(map[string]*pending)
+	for name, cur := range cursors {
+		b := c.backends[name]
+		if b == nil || !slices.Contains(names, name) {
+			return nil, "", fmt.Errorf("invalid page token")
+		}
+		for {
+			keys, next, err := b.ListPage(ctx, prefix, limit, cur.Token)
+			if err != nil {
+				return nil, "", fmt.Errorf("%s: %w", name, err)
+			}
+			var own []string
+			for _, key := range keys {
+				if key > cur.After && c.owns(name, key) {
+					own = append(own, key)
+				}
+			}
+			if len(own) > 0 || next == "" {
+				heads[name] = &pending{keys: own, next: next}
+				cursors[name] = cur
+				break
+			}
+			cur.Token = next
+		}
+	}
+
+	// Merge until the limit, or until a backend runs out of read keys while
+	// it has more pages: its next keys may sort before the others' heads.
+	var keys []string
+	for len(keys) < limit {
+		best := ""
+		stalled := false
+		for name, p := range heads {
+			if len(p.keys) == 0 {
+				if p.next != "" {
+					stalled = true
+				}
+				continue
+			}
+			if best == "" || p.keys[0] < heads[best].keys[0] {
+				best = name
+			}
+		}
+		if best == "" || stalled {
+			break
+		}
+		p := heads[best]
+		keys = append(keys, p.keys[0])
+		p.keys = p.keys[1:]
+		cur := cursors[best]
+		cur.After = keys[len(keys)-1]
+		cursors[best] = cur
+	}
+
+	for name, p := range heads {
+		switch {
+		case len(p.keys) > 0:
+			// Read the same page again next time, after cur.After.
+		case p.next == "":
+			delete(cursors, name)
+		default:
+			cur := cursors[name]
+			cur.Token = p.next
+			cursors[name] = cur
+		}
+	}
+	if len(cursors) == 0 {
+		return keys, "", nil
+	}
+	raw, err := json.Marshal(cursors)
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, base64.RawURLEncoding.EncodeToString(raw), nil
+}
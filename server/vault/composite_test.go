@@ -0,0 +1,179 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// newTestComposite routes messages/ and exports/ to one local store and
+// everything else to another, and returns the composite and both stores.
+func newTestComposite(t *testing.T) (*CompositeStorage, *LocalStorage, *LocalStorage) {
+	t.Helper()
+	remote, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := ParseStorageRoutes("messages/ -> remote, exports/ -> remote, * -> local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCompositeStorage(routes, map[string]Storage{"remote": remote, "local": local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, remote, local
+}
+
+func TestParseStorageRoutes(t *testing.T) {
+	routes, err := ParseStorageRoutes(" messages/ -> s3 ,* -> local,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StorageRoute{{"messages/", "s3"}, {"*", "local"}}
+	if !slices.Equal(routes, want) {
+		t.Errorf("want %v, got %v", want, routes)
+	}
+	for _, bad := range []string{"messages/", "-> s3", "messages/ ->", "a/ -> s3, a/ -> local", "../ -> local"} {
+		if _, err := ParseStorageRoutes(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestNewCompositeStorage_UnknownBackend(t *testing.T) {
+	local, _ := NewLocalStorage(t.TempDir())
+	routes := []StorageRoute{{"messages/", "s3"}, {"*", "local"}}
+	if _, err := NewCompositeStorage(routes, map[string]Storage{"local": local}); err == nil {
+		t.Error("expected an error for a route to an unconfigured backend")
+	}
+}
+
+func TestCompositeStorage_Routes(t *testing.T) {
+	ctx := context.Background()
+	c, remote, local := newTestComposite(t)
+
+	c.Put(ctx, "messages/a", []byte("m"))
+	c.Put(ctx, "tmp/b", []byte("t"))
+	if _, err := remote.Get(ctx, "messages/a"); err != nil {
+		t.Errorf("messages/a not in the remote store: %v", err)
+	}
+	if _, err := local.Get(ctx, "tmp/b"); err != nil {
+		t.Errorf("tmp/b not in the local store: %v", err)
+	}
+	if _, err := local.Get(ctx, "messages/a"); err == nil {
+		t.Error("messages/a must not reach the local store")
+	}
+	if got, err := c.Get(ctx, "messages/a"); err != nil || string(got) != "m" {
+		t.Errorf("Get: %q, %v", got, err)
+	}
+	if info, err := c.Stat(ctx, "tmp/b"); err != nil || info.Size != 1 {
+		t.Errorf("Stat: %+v, %v", info, err)
+	}
+	if err := c.Delete(ctx, "messages/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Get(ctx, "messages/a"); err == nil {
+		t.Error("Delete must remove the object from its backend")
+	}
+}
+
+func TestCompositeStorage_NoRoute(t *testing.T) {
+	remote, _ := NewLocalStorage(t.TempDir())
+	c, err := NewCompositeStorage([]StorageRoute{{"messages/", "remote"}}, map[string]Storage{"remote": remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(context.Background(), "exports/x", []byte("x")); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("want ErrNoRoute, got %v", err)
+	}
+}
+
+func TestCompositeStorage_ListMerges(t *testing.T) {
+	ctx := context.Background()
+	c, _, local := newTestComposite(t)
+	for _, key := range []string{"messages/a", "exports/b", "tmp/c", "z"} {
+		c.Put(ctx, key, []byte("x"))
+	}
+	// A leftover from before a route change is not the local store's to list.
+	local.Put(ctx, "messages/stale", []byte("x"))
+
+	keys, err := c.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"exports/b", "messages/a", "tmp/c", "z"}; !slices.Equal(keys, want) {
+		t.Errorf("List: want %v, got %v", want, keys)
+	}
+	if keys, _ := c.List(ctx, "messages/"); !slices.Equal(keys, []string{"messages/a"}) {
+		t.Errorf("List messages/: got %v", keys)
+	}
+}
+
+func TestCompositeStorage_ListPageMerges(t *testing.T) {
+	ctx := context.Background()
+	c, _, local := newTestComposite(t)
+	var want []string
+	for i := range 7 {
+		for _, prefix := range []string{"exports/", "messages/", "a/", "n/"} {
+			key := fmt.Sprintf("%s%02d", prefix, i)
+			c.Put(ctx, key, []byte("x"))
+			want = append(want, key)
+		}
+	}
+	local.Put(ctx, "messages/stale", []byte("x"))
+	slices.Sort(want)
+
+	for _, limit := range []int{1, 3, 5, 100} {
+		var got []string
+		token := ""
+		for {
+			keys, next, err := c.ListPage(ctx, "", limit, token)
+			if err != nil {
+				t.Fatalf("limit %d: %v", limit, err)
+			}
+			if len(keys) > limit {
+				t.Fatalf("limit %d: page of %d keys", limit, len(keys))
+			}
+			got = append(got, keys...)
+			if next == "" {
+				break
+			}
+			token = next
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("limit %d: want %v, got %v", limit, want, got)
+		}
+	}
+}
+
+func TestCompositeStorage_ForEachPageDelete(t *testing.T) {
+	ctx := context.Background()
+	c, _, _ := newTestComposite(t)
+	for i := range 25 {
+		c.Put(ctx, fmt.Sprintf("messages/%02d", i), []byte("x"))
+		c.Put(ctx, fmt.Sprintf("tmp/%02d", i), []byte("x"))
+	}
+	seen := 0
+	err := ForEachPage(ctx, c, "", func(keys []string) error {
+		seen += len(keys)
+		for _, key := range keys {
+			if err := c.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := c.List(ctx, ""); seen != 50 || len(keys) != 0 {
+		t.Errorf("want 50 keys seen and none left, got %d seen and %v left", seen, keys)
+	}
+}
@@ -7,65 +7,91 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"sync/atomic"
 )
 
-// EncryptAESGCM encrypts plaintext with AES-256-GCM.
-// key must be a hex-encoded 32-byte value (64 hex characters).
-// Returns the nonce+ciphertext as a hex string.
-func EncryptAESGCM(key, plaintext string) (string, error) {
-	keyBytes, err := hex.DecodeString(key)
+// decryptFailures counts ciphertexts that failed authentication.
+var decryptFailures atomic.Uint64
+
+// DecryptFailures returns how many ciphertexts have failed authentication
+// since the process started: a wrong key, or tampered or corrupted data.  A
+// sudden rise usually means the server runs with the wrong ENCRYPTION_KEY.
+func DecryptFailures() uint64 { return decryptFailures.Load() }
+
+// EncryptBytes encrypts plaintext with AES-GCM under key (16, 24 or 32
+// bytes; 32 selects AES-256), authenticating aad along with it.  Returns
+// nonce||ciphertext.  aad may be nil, and must be passed again to decrypt.
+func EncryptBytes(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		return "", fmt.Errorf("decode encryption key: %w", err)
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
 	}
+	// Seal appends ciphertext to nonce so the output is nonce||ciphertext.
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
 
-	block, err := aes.NewCipher(keyBytes)
+// DecryptBytes is the inverse of EncryptBytes.  The caller owns the
+// returned plaintext and may zero it once done.
+func DecryptBytes(key, ciphertext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	gcm, err := cipher.NewGCM(block)
+	nonceSize := gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], aad)
 	if err != nil {
-		return "", err
+		decryptFailures.Add(1)
+		return nil, err
 	}
+	return plaintext, nil
+}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
 	}
-
-	// Seal appends ciphertext to nonce so the output is nonce||ciphertext.
-	out := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-	return hex.EncodeToString(out), nil
+	return cipher.NewGCM(block)
 }
 
-// DecryptAESGCM is the inverse of EncryptAESGCM.
-func DecryptAESGCM(key, ciphertextHex string) (string, error) {
+// EncryptAESGCM encrypts plaintext with AES-256-GCM.
+// key must be a hex-encoded 32-byte value (64 hex characters).
+// Returns the nonce+ciphertext as a hex string.
+//
+// Prefer Key.Encrypt, which does not decode the key on every call and
+// leaves no copies of it or of the plaintext in strings.
+func EncryptAESGCM(key, plaintext string) (string, error) {
 	keyBytes, err := hex.DecodeString(key)
 	if err != nil {
 		return "", fmt.Errorf("decode encryption key: %w", err)
 	}
-
-	data, err := hex.DecodeString(ciphertextHex)
+	defer clear(keyBytes)
+	out, err := EncryptBytes(keyBytes, []byte(plaintext), nil)
 	if err != nil {
 		return "", err
 	}
+	return hex.EncodeToString(out), nil
+}
 
-	block, err := aes.NewCipher(keyBytes)
+// DecryptAESGCM is the inverse of EncryptAESGCM.
+func DecryptAESGCM(key, ciphertextHex string) (string, error) {
+	keyBytes, err := hex.DecodeString(key)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("decode encryption key: %w", err)
 	}
-
-	gcm, err := cipher.NewGCM(block)
+	defer clear(keyBytes)
+	data, err := hex.DecodeString(ciphertextHex)
 	if err != nil {
 		return "", err
 	}
-
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return "", fmt.Errorf("ciphertext too short")
-	}
-
-	plaintext, err := gcm.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	plaintext, err := DecryptBytes(keyBytes, data, nil)
 	if err != nil {
 		return "", err
 	}
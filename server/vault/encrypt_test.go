@@ -200,10 +200,14 @@ func TestDecryptAESGCM_TamperedCiphertext(t *testing.T) {
 	tamperedCT := hex.EncodeToString(ctBytes)
 
 	// Decryption should fail due to authentication tag mismatch
+	before := DecryptFailures()
 	_, err = DecryptAESGCM(key, tamperedCT)
 	if err == nil {
 		t.Error("expected error with tampered ciphertext (GCM auth should fail)")
 	}
+	if got := DecryptFailures(); got != before+1 {
+		t.Errorf("DecryptFailures: want %d, got %d", before+1, got)
+	}
 }
 
 func TestEncryptDecrypt_MultipleKeys(t *testing.T) {
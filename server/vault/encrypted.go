@@ -0,0 +1,159 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Objects written by EncryptedStorage start with a header of storageMagic,
+// the blob format (blobRaw or blobGzip) and the big-endian ID of the key
+// they are encrypted under, followed by nonce || AES-GCM ciphertext.  The
+// header and the object key are authenticated with the ciphertext, so an
+// object copied or renamed to another key no longer decrypts.
+var storageMagic = []byte("MMSE\x01")
+
+const storageHeaderLen = 5 + 1 + 4 // magic, format, key ID
+
+// ErrLegacyBlob is returned for an object that was not written by an
+// EncryptedStorage, unless legacy reads are allowed.
+var ErrLegacyBlob = errors.New("vault object is not in the encrypted storage format")
+
+// EncryptedStorage encrypts every object on its way into inner and
+// decrypts it on the way out, so no caller can store plaintext by
+// forgetting to encrypt.  Delete, List, ListPage, Stat and Verify pass
+// through; the size Stat reports, and the checksum Verify checks, are those
+// of the stored ciphertext.
+type EncryptedStorage struct {
+	inner Storage
+	keys  *KeyRing
+
+	// AllowLegacy makes Get read objects stored before EncryptedStorage
+	// existed: blobs encrypted with Key.EncryptBlob under a key of the ring
+	// are decrypted, and anything else is returned as stored.  Without it
+	// such objects fail with ErrLegacyBlob.
+	AllowLegacy bool
+}
+
+// NewEncryptedStorage wraps inner so that objects are encrypted with the
+// current key of keys.
+func NewEncryptedStorage(inner Storage, keys *KeyRing) *EncryptedStorage {
+	return &EncryptedStorage{inner: inner, keys: keys}
+}
+
+// objectAAD returns the data authenticated along with the object at key.
+func objectAAD(header []byte, key string) []byte {
+	return append(header[:len(header):len(header)], key...)
+}
+
+// Put encrypts data and stores it at key.
+func (e *EncryptedStorage) Put(ctx context.Context, key string, data []byte) error {
+	format, payload := compressBlob(data)
+	header := append(append(make([]byte, 0, storageHeaderLen), storageMagic...), format)
+	header = binary.BigEndian.AppendUint32(header, e.keys.current)
+	sealed, err := EncryptBytes(e.keys.keys[e.keys.current].b, payload, objectAAD(header, key))
+	if err != nil {
+		return fmt.Errorf("encrypt %s: %w", key, err)
+	}
+	return e.inner.Put(ctx, key, append(header, sealed...))
+}
+
+// Get returns the decrypted object at key.
+func (e *EncryptedStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	blob, err := e.inner.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(blob, storageMagic) {
+		return e.getLegacy(key, blob)
+	}
+	if len(blob) < storageHeaderLen {
+		return nil, fmt.Errorf("decrypt %s: truncated header", key)
+	}
+	header := blob[:storageHeaderLen]
+	format := header[len(storageMagic)]
+	if format != blobRaw && format != blobGzip {
+		return nil, fmt.Errorf("decrypt %s: unknown blob format %#x", key, format)
+	}
+	id := binary.BigEndian.Uint32(header[len(storageMagic)+1:])
+	k, ok := e.keys.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("decrypt %s: key %08x is not in the key ring", key, id)
+	}
+	data, err := DecryptBytes(k.b, blob[storageHeaderLen:], objectAAD(header, key))
+	if err != nil {
+		return nil, e.decryptFailure(ctx, key, err)
+	}
+	if format == blobGzip {
+		return gunzipBytes(data)
+	}
+	return data, nil
+}
+
+// decryptFailure explains why the object at key failed to decrypt with
+// err: the checksum of the stored bytes tells a corrupted object from one
+// sealed under a key that differs from the ring's key of the same ID.
+func (e *EncryptedStorage) decryptFailure(ctx context.Context, key string, err error) error {
+	switch verr := VerifyObject(ctx, e.inner, key); {
+	case verr == nil:
+		return fmt.Errorf("decrypt %s: %w (the object matches its checksum, so the key is wrong)", key, err)
+	case errors.Is(verr, ErrChecksumMismatch):
+		return fmt.Errorf("decrypt %s: %w", key, verr)
+	default:
+		return fmt.Errorf("decrypt %s: %w", key, err)
+	}
+}
+
+// Verify checks the stored ciphertext at key against its checksum, without
+// decrypting it; see Verifier.
+func (e *EncryptedStorage) Verify(ctx context.Context, key string) error {
+	return VerifyObject(ctx, e.inner, key)
+}
+
+// getLegacy reads an object stored without the EncryptedStorage header.
+func (e *EncryptedStorage) getLegacy(key string, blob []byte) ([]byte, error) {
+	if !e.AllowLegacy {
+		return nil, fmt.Errorf("%w: %s", ErrLegacyBlob, key)
+	}
+	if !isKeyBlob(blob) {
+		return blob, nil
+	}
+	for _, k := range e.keys.masters {
+		if data, err := k.DecryptBlob(blob); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("decrypt legacy %s: no key in the ring opens it", key)
+}
+
+// isKeyBlob reports whether blob has the shape of Key.EncryptBlob output,
+// including the hex ciphertexts written before blobs had a header.
+func isKeyBlob(blob []byte) bool {
+	if len(blob) == 0 {
+		return false
+	}
+	if blob[0] == blobRaw || blob[0] == blobGzip {
+		return true
+	}
+	_, err := hex.DecodeString(string(blob))
+	return err == nil
+}
+
+func (e *EncryptedStorage) Delete(ctx context.Context, key string) error {
+	return e.inner.Delete(ctx, key)
+}
+
+func (e *EncryptedStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	return e.inner.List(ctx, prefix)
+}
+
+func (e *EncryptedStorage) ListPage(ctx context.Context, prefix string, limit int, token string) ([]string, string, error) {
+	return e.inner.ListPage(ctx, prefix, limit, token)
+}
+
+func (e *EncryptedStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return e.inner.Stat(ctx, key)
+}
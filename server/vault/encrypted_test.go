@@ -0,0 +1,154 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestEncrypted returns encrypted storage over a fresh local store under
+// a ring of key and previous, and the local store itself.
+func newTestEncrypted(t *testing.T, key Key, previous ...Key) (*EncryptedStorage, *LocalStorage) {
+	t.Helper()
+	local, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := NewKeyRing(key, previous...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEncryptedStorage(local, ring), local
+}
+
+func TestNewKeyRing(t *testing.T) {
+	key := MustParseKey(generateTestKey(t))
+	if _, err := NewKeyRing(Key{}); err == nil {
+		t.Error("expected an error for a zero key")
+	}
+	if _, err := NewKeyRing(key, key); err == nil {
+		t.Error("expected an error for a repeated key")
+	}
+}
+
+func TestEncryptedStorage_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	e, local := newTestEncrypted(t, MustParseKey(generateTestKey(t)))
+
+	for name, data := range map[string][]byte{
+		"text":  bytes.Repeat([]byte("Subject: a secret\r\n"), 50),
+		"short": []byte("a secret"),
+		"empty": {},
+	} {
+		key := "messages/" + name
+		if err := e.Put(ctx, key, data); err != nil {
+			t.Fatalf("%s: Put: %v", name, err)
+		}
+		got, err := e.Get(ctx, key)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: Get: %q, %v", name, got, err)
+		}
+		stored, _ := local.Get(ctx, key)
+		if bytes.Contains(stored, []byte("secret")) || !bytes.HasPrefix(stored, storageMagic) {
+			t.Errorf("%s: stored bytes are readable: %q", name, stored)
+		}
+	}
+}
+
+func TestEncryptedStorage_BindsObjectKey(t *testing.T) {
+	ctx := context.Background()
+	e, local := newTestEncrypted(t, MustParseKey(generateTestKey(t)))
+	e.Put(ctx, "messages/a", []byte("for a only"))
+
+	// A blob moved to another key must not decrypt there.
+	stored, _ := local.Get(ctx, "messages/a")
+	local.Put(ctx, "messages/b", stored)
+	if _, err := e.Get(ctx, "messages/b"); err == nil {
+		t.Error("expected a moved object to fail authentication")
+	}
+}
+
+func TestEncryptedStorage_Checksums(t *testing.T) {
+	ctx := context.Background()
+	e, local := newTestEncrypted(t, MustParseKey(generateTestKey(t)))
+	e.Put(ctx, "messages/a", []byte("for a only"))
+	if err := e.Verify(ctx, "messages/a"); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	// Stored intact under the wrong key, the object fails to decrypt but
+	// matches its checksum.
+	stored, _ := local.Get(ctx, "messages/a")
+	local.Put(ctx, "messages/b", stored)
+	if _, err := e.Get(ctx, "messages/b"); err == nil || errors.Is(err, ErrChecksumMismatch) || !strings.Contains(err.Error(), "matches its checksum") {
+		t.Errorf("intact object: got %v", err)
+	}
+
+	// Corrupted at rest, it is reported as such.
+	stored[len(stored)-1] ^= 1
+	os.WriteFile(filepath.Join(local.baseDir, "messages", "a"), stored, 0600)
+	if _, err := e.Get(ctx, "messages/a"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("corrupted object: want ErrChecksumMismatch, got %v", err)
+	}
+	if err := e.Verify(ctx, "messages/a"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Verify: want ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestEncryptedStorage_KeyRotation(t *testing.T) {
+	ctx := context.Background()
+	oldKey, newKey := MustParseKey(generateTestKey(t)), MustParseKey(generateTestKey(t))
+	old, local := newTestEncrypted(t, oldKey)
+	old.Put(ctx, "messages/old", []byte("written under the old key"))
+
+	ring, _ := NewKeyRing(newKey, oldKey)
+	rotated := NewEncryptedStorage(local, ring)
+	if got, err := rotated.Get(ctx, "messages/old"); err != nil || string(got) != "written under the old key" {
+		t.Errorf("old object after rotation: %q, %v", got, err)
+	}
+
+	ring, _ = NewKeyRing(newKey)
+	if _, err := NewEncryptedStorage(local, ring).Get(ctx, "messages/old"); err == nil {
+		t.Error("expected an error once the old key has left the ring")
+	}
+}
+
+func TestEncryptedStorage_LegacyBlobs(t *testing.T) {
+	ctx := context.Background()
+	key := MustParseKey(generateTestKey(t))
+	e, local := newTestEncrypted(t, key)
+
+	blob, _ := key.EncryptBlob([]byte("cached before the wrapper"))
+	local.Put(ctx, "messages/blob", blob)
+	hexBlob, _ := key.Encrypt([]byte("cached as hex"))
+	local.Put(ctx, "messages/hex", []byte(hexBlob))
+	local.Put(ctx, "exports/archive", []byte("MMPE\x01already encrypted"))
+
+	for _, k := range []string{"messages/blob", "messages/hex", "exports/archive"} {
+		if _, err := e.Get(ctx, k); !errors.Is(err, ErrLegacyBlob) {
+			t.Errorf("%s: want ErrLegacyBlob, got %v", k, err)
+		}
+	}
+
+	e.AllowLegacy = true
+	for k, want := range map[string]string{
+		"messages/blob":   "cached before the wrapper",
+		"messages/hex":    "cached as hex",
+		"exports/archive": "MMPE\x01already encrypted",
+	} {
+		if got, err := e.Get(ctx, k); err != nil || string(got) != want {
+			t.Errorf("%s: want %q, got %q, %v", k, want, got, err)
+		}
+	}
+
+	other := MustParseKey(generateTestKey(t))
+	blob, _ = other.EncryptBlob([]byte("someone else's key"))
+	local.Put(ctx, "messages/foreign", blob)
+	if _, err := e.Get(ctx, "messages/foreign"); err == nil {
+		t.Error("expected an error for a legacy blob under a key outside the ring")
+	}
+}
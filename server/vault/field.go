@@ -0,0 +1,56 @@
+package vault
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// FieldCipher encrypts individual document fields so that metadata stored in
+// MongoDB is never plaintext.  Separate keys for encryption and for blind
+// indexes are derived from the master key, so an index never reveals
+// anything the ciphertext key could be used for and vice versa.
+type FieldCipher struct {
+	encKey   Key    // AES-256 key for field ciphertexts
+	indexKey []byte // HMAC-SHA256 key for BlindIndex
+}
+
+// NewFieldCipher derives field keys from master, the credential encryption
+// key.
+func NewFieldCipher(master Key) (*FieldCipher, error) {
+	if master.IsZero() {
+		return nil, errNoKey
+	}
+	return &FieldCipher{
+		encKey:   Key{b: deriveKey(master.b, "mulamail/field-encryption/v1")},
+		indexKey: deriveKey(master.b, "mulamail/blind-index/v1"),
+	}, nil
+}
+
+// deriveKey returns HMAC-SHA256(master, label), a 32-byte subkey.
+func deriveKey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Encrypt encrypts a non-searchable field with a random nonce; equal inputs
+// produce different ciphertexts.
+func (f *FieldCipher) Encrypt(plaintext string) (string, error) {
+	return f.encKey.EncryptString(plaintext)
+}
+
+// Decrypt is the inverse of Encrypt.
+func (f *FieldCipher) Decrypt(ciphertextHex string) (string, error) {
+	return f.encKey.DecryptString(ciphertextHex)
+}
+
+// BlindIndex returns a deterministic keyed hash of value for exact-match
+// lookups.  Values are trimmed and lower-cased first so that equivalent
+// addresses index identically.
+func (f *FieldCipher) BlindIndex(value string) string {
+	mac := hmac.New(sha256.New, f.indexKey)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(value))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,60 @@
+package vault
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFieldCipher_RoundTrip(t *testing.T) {
+	key := generateTestKey(t)
+	fc, err := NewFieldCipher(MustParseKey(key))
+	if err != nil {
+		t.Fatalf("NewFieldCipher failed: %v", err)
+	}
+
+	a, err := fc.Encrypt("Quarterly report")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	b, _ := fc.Encrypt("Quarterly report")
+	if a == b {
+		t.Error("field encryption must use a random nonce")
+	}
+	if strings.Contains(a, "Quarterly") {
+		t.Error("ciphertext leaks plaintext")
+	}
+
+	got, err := fc.Decrypt(a)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if got != "Quarterly report" {
+		t.Errorf("want %q, got %q", "Quarterly report", got)
+	}
+
+	// The derived key is not the master key.
+	if _, err := DecryptAESGCM(key, a); err == nil {
+		t.Error("field ciphertext must not decrypt with the master key")
+	}
+}
+
+func TestFieldCipher_BlindIndex(t *testing.T) {
+	fc, _ := NewFieldCipher(MustParseKey(generateTestKey(t)))
+	other, _ := NewFieldCipher(MustParseKey(generateTestKey(t)))
+
+	if fc.BlindIndex("Alice@Example.com ") != fc.BlindIndex("alice@example.com") {
+		t.Error("blind index must be case and whitespace insensitive")
+	}
+	if fc.BlindIndex("alice@example.com") == fc.BlindIndex("bob@example.com") {
+		t.Error("different values must index differently")
+	}
+	if fc.BlindIndex("alice@example.com") == other.BlindIndex("alice@example.com") {
+		t.Error("blind index must depend on the key")
+	}
+}
+
+func TestNewFieldCipher_UnsetKey(t *testing.T) {
+	if _, err := NewFieldCipher(Key{}); err == nil {
+		t.Error("NewFieldCipher with an unset key: expected error")
+	}
+}
@@ -0,0 +1,128 @@
+package vault
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params are the Argon2id cost parameters of a key derivation.
+type Argon2Params struct {
+	Time    uint32 `json:"time"`    // passes over memory
+	Memory  uint32 `json:"memory"`  // KiB
+	Threads uint8  `json:"threads"` // lanes
+}
+
+// DefaultArgon2Params are the parameters EncryptWithPassphrase uses.
+var DefaultArgon2Params = Argon2Params{Time: passphraseTime, Memory: passphraseMemory, Threads: passphraseThreads}
+
+// MinSaltSize is the shortest salt DeriveKey accepts.
+const MinSaltSize = 16
+
+func (p Argon2Params) validate() error {
+	if p.Time == 0 || p.Time > passphraseMaxTime || p.Threads == 0 ||
+		p.Memory < 8*uint32(p.Threads) || p.Memory > passphraseMaxMemory {
+		return fmt.Errorf("unsupported key derivation parameters %+v", p)
+	}
+	return nil
+}
+
+// DeriveKey derives a KeySize-byte key from passphrase and salt with
+// Argon2id.  The same passphrase, salt and params always give the same key,
+// so all three must be kept to derive it again.
+func DeriveKey(passphrase string, salt []byte, params Argon2Params) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	if len(salt) < MinSaltSize {
+		return nil, fmt.Errorf("salt must be at least %d bytes, got %d", MinSaltSize, len(salt))
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, KeySize), nil
+}
+
+// saltFile is the JSON document KeyFromPassphrase keeps next to the data.
+// It records the parameters along with the salt, so changing
+// DefaultArgon2Params never changes the key of an existing deployment.
+type saltFile struct {
+	Salt string `json:"salt"` // hex
+	Argon2Params
+}
+
+// KeyFromPassphrase derives the server key from an operator passphrase and
+// the salt stored at saltPath.  On first use it creates saltPath with a
+// random salt and DefaultArgon2Params; losing the file loses the key, so it
+// must be backed up with the data.
+func KeyFromPassphrase(passphrase, saltPath string) (Key, error) {
+	sf, err := readSaltFile(saltPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		sf, err = createSaltFile(saltPath)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	salt, err := hex.DecodeString(sf.Salt)
+	if err != nil {
+		return Key{}, fmt.Errorf("salt file %s: %w", saltPath, err)
+	}
+	b, err := DeriveKey(passphrase, salt, sf.Argon2Params)
+	if err != nil {
+		return Key{}, fmt.Errorf("derive key: %w", err)
+	}
+	return Key{b: b}, nil
+}
+
+func readSaltFile(path string) (*saltFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sf saltFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return nil, fmt.Errorf("salt file %s: %w", path, err)
+	}
+	return &sf, nil
+}
+
+func createSaltFile(path string) (*saltFile, error) {
+	salt := make([]byte, MinSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	sf := &saltFile{Salt: hex.EncodeToString(salt), Argon2Params: DefaultArgon2Params}
+	data, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("create salt directory: %w", err)
+	}
+	// O_EXCL: if another process created the file first, use its salt.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return readSaltFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create salt file: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("write salt file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("write salt file: %w", err)
+	}
+	return sf, nil
+}
@@ -0,0 +1,114 @@
+package vault
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeySize is the length of a Key: AES-256.
+const KeySize = 32
+
+// errNoKey is returned when a zero Key is used.
+var errNoKey = errors.New("encryption key not set")
+
+// Key is an AES-256 key, decoded and validated once (ParseKey) and then
+// only ever handled as bytes, so it can be wiped with Zero.  Ciphertexts
+// are hex strings of nonce||ciphertext, interchangeable with
+// EncryptAESGCM and DecryptAESGCM under the key's hex form.
+//
+// Key is a reference: copies share the bytes, and Zero wipes them all.  The
+// zero Key is unset and fails every operation.  Printing a Key never shows
+// the key.
+type Key struct {
+	b []byte
+}
+
+// ParseKey decodes a hex-encoded 32-byte key.
+func ParseKey(hexKey string) (Key, error) {
+	b, err := hex.DecodeString(hexKey)
+	if err != nil {
+		// The hex error quotes the offending character of the key.
+		clear(b)
+		return Key{}, errors.New("decode encryption key: not a hex string")
+	}
+	if len(b) != KeySize {
+		clear(b)
+		return Key{}, fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(b))
+	}
+	return Key{b: b}, nil
+}
+
+// MustParseKey is ParseKey for keys known to be valid, such as constants in
+// tests.  It panics on an invalid key.
+func MustParseKey(hexKey string) Key {
+	k, err := ParseKey(hexKey)
+	if err != nil {
+		panic("vault: " + err.Error())
+	}
+	return k
+}
+
+// IsZero reports whether k is unset.
+func (k Key) IsZero() bool { return k.b == nil }
+
+// Equal reports, in constant time, whether k and other are the same key.
+func (k Key) Equal(other Key) bool {
+	return subtle.ConstantTimeCompare(k.b, other.b) == 1
+}
+
+// Zero overwrites the key bytes.  k, and every copy of it, is unusable
+// afterwards.
+func (k Key) Zero() { clear(k.b) }
+
+// String redacts the key.
+func (k Key) String() string { return "vault.Key(redacted)" }
+
+// GoString redacts the key from %#v.
+func (k Key) GoString() string { return k.String() }
+
+// Format redacts the key under every verb, including %d, which would
+// otherwise print its bytes.
+func (k Key) Format(f fmt.State, _ rune) { io.WriteString(f, k.String()) } //nolint:errcheck
+
+// Encrypt encrypts plaintext under k and returns the hex ciphertext.
+func (k Key) Encrypt(plaintext []byte) (string, error) {
+	if k.IsZero() {
+		return "", errNoKey
+	}
+	out, err := EncryptBytes(k.b, plaintext, nil)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(out), nil
+}
+
+// Decrypt is the inverse of Encrypt.  The caller owns the plaintext and
+// should zero it once done if it is a secret.
+func (k Key) Decrypt(ciphertextHex string) ([]byte, error) {
+	if k.IsZero() {
+		return nil, errNoKey
+	}
+	data, err := hex.DecodeString(ciphertextHex)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptBytes(k.b, data, nil)
+}
+
+// EncryptString is Encrypt for data that is already a string, such as a
+// cached message; secrets should go through Encrypt.
+func (k Key) EncryptString(plaintext string) (string, error) {
+	return k.Encrypt([]byte(plaintext))
+}
+
+// DecryptString is the inverse of EncryptString.
+func (k Key) DecryptString(ciphertextHex string) (string, error) {
+	plaintext, err := k.Decrypt(ciphertextHex)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
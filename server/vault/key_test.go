@@ -0,0 +1,85 @@
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseKey_Invalid(t *testing.T) {
+	for _, key := range []string{"", "not-hex", "abcd", strings.Repeat("ab", 33)} {
+		if _, err := ParseKey(key); err == nil {
+			t.Errorf("ParseKey(%q): expected error", key)
+		}
+	}
+}
+
+func TestKey_CompatibleWithStringFunctions(t *testing.T) {
+	hexKey := generateTestKey(t)
+	key := MustParseKey(hexKey)
+
+	ct, err := key.Encrypt([]byte("pop3-password"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if got, err := DecryptAESGCM(hexKey, ct); err != nil || got != "pop3-password" {
+		t.Errorf("DecryptAESGCM of a Key ciphertext: got %q, %v", got, err)
+	}
+
+	ct, _ = EncryptAESGCM(hexKey, "smtp-password")
+	got, err := key.Decrypt(ct)
+	if err != nil || string(got) != "smtp-password" {
+		t.Errorf("Key.Decrypt of an EncryptAESGCM ciphertext: got %q, %v", got, err)
+	}
+}
+
+func TestKey_Zero(t *testing.T) {
+	hexKey := generateTestKey(t)
+	key := MustParseKey(hexKey)
+	if !key.Equal(MustParseKey(hexKey)) {
+		t.Fatal("a key must equal itself")
+	}
+	ct, _ := key.Encrypt([]byte("secret"))
+
+	copied := key
+	key.Zero()
+	if !bytes.Equal(copied.b, make([]byte, KeySize)) {
+		t.Error("Zero must wipe every copy of the key")
+	}
+	if _, err := key.Decrypt(ct); err == nil {
+		t.Error("a zeroed key must not decrypt")
+	}
+	if _, err := (Key{}).Encrypt([]byte("x")); err == nil {
+		t.Error("an unset key must not encrypt")
+	}
+}
+
+func TestKey_Redacted(t *testing.T) {
+	hexKey := generateTestKey(t)
+	key := MustParseKey(hexKey)
+	for _, s := range []string{fmt.Sprint(key), fmt.Sprintf("%v %+v %#v", key, key, key), fmt.Sprintf("%+v", struct{ K Key }{key})} {
+		if strings.Contains(s, hexKey[:16]) {
+			t.Errorf("formatted key leaks material: %s", s)
+		}
+	}
+	for _, verb := range []string{"%d", "%x", "%X", "%s", "%q", "%v"} {
+		if got := fmt.Sprintf(verb, key); got != key.String() {
+			t.Errorf("%s: got %s", verb, got)
+		}
+	}
+}
+
+func TestEncryptBytes_AAD(t *testing.T) {
+	key := MustParseKey(generateTestKey(t)).b
+	ct, err := EncryptBytes(key, []byte("body"), []byte("messages/1"))
+	if err != nil {
+		t.Fatalf("EncryptBytes failed: %v", err)
+	}
+	if got, err := DecryptBytes(key, ct, []byte("messages/1")); err != nil || string(got) != "body" {
+		t.Errorf("DecryptBytes: got %q, %v", got, err)
+	}
+	if _, err := DecryptBytes(key, ct, []byte("messages/2")); err == nil {
+		t.Error("DecryptBytes with different associated data must fail")
+	}
+}
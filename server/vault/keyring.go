@@ -0,0 +1,43 @@
+package vault
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// KeyRing holds the keys vault objects are encrypted under: the current
+// key, which encrypts everything new, and any previous keys still needed to
+// read older objects.  Each key is known by an ID derived from it, so
+// objects record which key they need without the ring storing IDs.
+type KeyRing struct {
+	current uint32
+	keys    map[uint32]Key // storage subkeys by key ID
+	masters []Key          // the keys the ring was made from, for legacy blobs
+}
+
+// NewKeyRing returns a ring that encrypts under current and also decrypts
+// with previous.  Object keys are derived from the given master keys, so
+// they never encrypt anything else.
+func NewKeyRing(current Key, previous ...Key) (*KeyRing, error) {
+	r := &KeyRing{keys: make(map[uint32]Key)}
+	for i, k := range append([]Key{current}, previous...) {
+		if k.IsZero() {
+			return nil, errNoKey
+		}
+		id := keyID(k)
+		if _, dup := r.keys[id]; dup {
+			return nil, fmt.Errorf("key %d duplicates an earlier key", i)
+		}
+		if i == 0 {
+			r.current = id
+		}
+		r.keys[id] = Key{b: deriveKey(k.b, "mulamail/storage-encryption/v1")}
+		r.masters = append(r.masters, k)
+	}
+	return r, nil
+}
+
+// keyID returns the 32-bit ID of master key k.
+func keyID(k Key) uint32 {
+	return binary.BigEndian.Uint32(deriveKey(k.b, "mulamail/key-id/v1"))
+}
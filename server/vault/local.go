@@ -2,16 +2,111 @@ package vault
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
+// metaSuffix names the sidecar file holding the ObjectMeta of the file
+// whose name it extends.
+const metaSuffix = ".meta"
+
+// windowsReserved are the device names Windows resolves whatever the
+// directory, with or without an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeKey checks a storage key and returns it in the form every
+// Storage uses: "/"-separated, with backslashes taken for separators, and
+// without empty or "." elements.  It rejects keys that could name a file
+// outside the base directory, or a different file on another platform:
+// absolute paths, ".." elements, colons (drive letters and NTFS streams),
+// control characters including NUL, Windows device names such as CON or
+// LPT1, elements ending in a dot or space, which Windows drops, and keys
+// ending in ".meta", which LocalStorage keeps its checksums under.  The
+// rules are the same on every platform, so that a vault can move between
+// them and keys read the same as in S3.
+func sanitizeKey(key string) (string, error) {
+	key = strings.ReplaceAll(key, "\\", "/")
+	if strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("invalid key %q: absolute path", key)
+	}
+	if strings.ContainsFunc(key, func(r rune) bool { return r < ' ' || r == 0x7f }) {
+		return "", fmt.Errorf("invalid key %q: control character", key)
+	}
+	if strings.Contains(key, ":") {
+		return "", fmt.Errorf("invalid key %q: contains ':'", key)
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == "" || elem == "." {
+			continue
+		}
+		if elem == ".." {
+			return "", fmt.Errorf("invalid key %q: contains '..'", key)
+		}
+		if strings.HasSuffix(elem, ".") || strings.HasSuffix(elem, " ") {
+			return "", fmt.Errorf("invalid key %q: element ends in a dot or space", key)
+		}
+		base, _, _ := strings.Cut(elem, ".")
+		if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+			return "", fmt.Errorf("invalid key %q: reserved name %q", key, elem)
+		}
+	}
+	key = path.Clean(key)
+	if key == "." {
+		return "", errors.New("invalid key: empty")
+	}
+	if strings.HasSuffix(key, metaSuffix) {
+		return "", fmt.Errorf("invalid key %q: the %s suffix is reserved", key, metaSuffix)
+	}
+	return key, nil
+}
+
+// sanitizePrefix is sanitizeKey for a listing prefix, which may be empty
+// and keeps a trailing "/".  An element after the last "/" may be the
+// start of a name, so it is only checked for what no key may hold.
+func sanitizePrefix(prefix string) (string, error) {
+	prefix = strings.ReplaceAll(prefix, "\\", "/")
+	dir, partial := "", prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir, partial = prefix[:i], prefix[i+1:]
+	}
+	if strings.ContainsFunc(partial, func(r rune) bool { return r < ' ' || r == 0x7f || r == ':' }) || partial == ".." {
+		return "", fmt.Errorf("invalid prefix %q", prefix)
+	}
+	if dir == "" && !strings.HasPrefix(prefix, "/") {
+		return partial, nil
+	}
+	dir, err := sanitizeKey(dir)
+	if err != nil {
+		return "", err
+	}
+	return dir + "/" + partial, nil
+}
+
 // LocalStorage implements the Storage interface using local filesystem.
-// Files are stored in a configurable directory with the key as the relative path.
+// Files are stored in a configurable directory with the key as the relative
+// path.  Keys are checked with sanitizeKey, and listed with "/" separators
+// on every platform.  Each file has a sidecar, its name followed by ".meta",
+// holding its ObjectMeta as JSON; listings leave sidecars out.
 type LocalStorage struct {
 	baseDir string
+
+	// VerifyChecksums makes Get check each file against its recorded
+	// checksum, failing with ErrChecksumMismatch.  Files stored without one
+	// are returned unchecked.
+	VerifyChecksums bool
 }
 
 // NewLocalStorage creates a new local file storage.
@@ -36,38 +131,45 @@ func NewLocalStorage(baseDir string) (*LocalStorage, error) {
 
 // Put stores raw bytes at the given key (filepath).
 func (l *LocalStorage) Put(ctx context.Context, key string, data []byte) error {
-	// Sanitize key to prevent directory traversal
-	key = filepath.Clean(key)
-	if strings.Contains(key, "..") {
-		return fmt.Errorf("invalid key: contains '..'")
+	fullPath, err := l.path(key)
+	if err != nil {
+		return err
 	}
 
-	fullPath := filepath.Join(l.baseDir, key)
-
 	// Create parent directories if needed
 	dir := filepath.Dir(fullPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("create directory: %w", err)
 	}
 
+	// Drop the old checksum first: a write cut short then leaves a file
+	// without a checksum rather than one that seems corrupted.
+	if err := os.Remove(fullPath + metaSuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove checksum: %w", err)
+	}
+
 	// Write file with secure permissions (owner read/write only)
 	if err := os.WriteFile(fullPath, data, 0600); err != nil {
 		return fmt.Errorf("write file: %w", err)
 	}
 
+	meta, err := json.Marshal(newObjectMeta(data))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(fullPath+metaSuffix, meta, 0600); err != nil {
+		return fmt.Errorf("write checksum: %w", err)
+	}
 	return nil
 }
 
 // Get retrieves the object at the given key (filepath).
 func (l *LocalStorage) Get(ctx context.Context, key string) ([]byte, error) {
-	// Sanitize key
-	key = filepath.Clean(key)
-	if strings.Contains(key, "..") {
-		return nil, fmt.Errorf("invalid key: contains '..'")
+	fullPath, err := l.path(key)
+	if err != nil {
+		return nil, err
 	}
 
-	fullPath := filepath.Join(l.baseDir, key)
-
 	data, err := os.ReadFile(fullPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -76,25 +178,68 @@ func (l *LocalStorage) Get(ctx context.Context, key string) ([]byte, error) {
 		return nil, fmt.Errorf("read file: %w", err)
 	}
 
+	if l.VerifyChecksums {
+		meta, err := readObjectMeta(fullPath)
+		if err == nil {
+			err = meta.check(key, data)
+		}
+		if err != nil && !errors.Is(err, ErrNoChecksum) {
+			return nil, err
+		}
+	}
 	return data, nil
 }
 
+// Verify checks the file at key against its recorded checksum; see
+// Verifier.
+func (l *LocalStorage) Verify(ctx context.Context, key string) error {
+	fullPath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("file not found: %s", key)
+		}
+		return fmt.Errorf("read file: %w", err)
+	}
+	meta, err := readObjectMeta(fullPath)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, key)
+	}
+	return meta.check(key, data)
+}
+
+// readObjectMeta reads the sidecar of the file at fullPath, returning
+// ErrNoChecksum when it has none.
+func readObjectMeta(fullPath string) (ObjectMeta, error) {
+	raw, err := os.ReadFile(fullPath + metaSuffix)
+	if os.IsNotExist(err) {
+		return ObjectMeta{}, ErrNoChecksum
+	}
+	if err != nil {
+		return ObjectMeta{}, fmt.Errorf("read checksum: %w", err)
+	}
+	return parseObjectMeta(raw)
+}
+
 // Delete removes the object at the given key.
 func (l *LocalStorage) Delete(ctx context.Context, key string) error {
-	// Sanitize key
-	key = filepath.Clean(key)
-	if strings.Contains(key, "..") {
-		return fmt.Errorf("invalid key: contains '..'")
+	fullPath, err := l.path(key)
+	if err != nil {
+		return err
 	}
 
-	fullPath := filepath.Join(l.baseDir, key)
-
 	if err := os.Remove(fullPath); err != nil {
 		if os.IsNotExist(err) {
 			return nil // Already deleted, consider it success
 		}
 		return fmt.Errorf("delete file: %w", err)
 	}
+	if err := os.Remove(fullPath + metaSuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("delete checksum: %w", err)
+	}
 
 	// Try to remove empty parent directories (optional cleanup)
 	dir := filepath.Dir(fullPath)
@@ -108,18 +253,34 @@ func (l *LocalStorage) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+// Stat returns the size and modification time of the file at the given key.
+func (l *LocalStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	fullPath, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ObjectInfo{}, fmt.Errorf("file not found: %s", key)
+		}
+		return ObjectInfo{}, fmt.Errorf("stat file: %w", err)
+	}
+	return ObjectInfo{Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
 // List returns all keys with the given prefix.
 func (l *LocalStorage) List(ctx context.Context, prefix string) ([]string, error) {
-	// Sanitize prefix
-	prefix = filepath.Clean(prefix)
-	if strings.Contains(prefix, "..") {
-		return nil, fmt.Errorf("invalid prefix: contains '..'")
+	prefix, err := sanitizePrefix(prefix)
+	if err != nil {
+		return nil, err
 	}
 
-	searchPath := filepath.Join(l.baseDir, prefix)
+	searchPath := filepath.Join(l.baseDir, filepath.FromSlash(prefix))
 	var keys []string
 
-	err := filepath.Walk(searchPath, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(searchPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			// If the prefix path doesn't exist, return empty list
 			if os.IsNotExist(err) {
@@ -128,8 +289,8 @@ func (l *LocalStorage) List(ctx context.Context, prefix string) ([]string, error
 			return err
 		}
 
-		// Skip directories
-		if info.IsDir() {
+		// Skip directories and checksum sidecars
+		if info.IsDir() || strings.HasSuffix(path, metaSuffix) {
 			return nil
 		}
 
@@ -139,7 +300,7 @@ func (l *LocalStorage) List(ctx context.Context, prefix string) ([]string, error
 			return err
 		}
 
-		keys = append(keys, relPath)
+		keys = append(keys, filepath.ToSlash(relPath))
 		return nil
 	})
 
@@ -150,6 +311,101 @@ func (l *LocalStorage) List(ctx context.Context, prefix string) ([]string, error
 	return keys, nil
 }
 
+// ListPage returns a page of keys under prefix; see Storage.  Unlike List,
+// prefix is matched as a string, as S3 does: "messages/ab" also matches
+// "messages/abc/1".  The token is the last key of the previous page.
+func (l *LocalStorage) ListPage(ctx context.Context, prefix string, limit int, token string) ([]string, string, error) {
+	prefix, err := sanitizePrefix(prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	after, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid page token")
+	}
+
+	// Walk from the deepest directory the prefix names, collecting one key
+	// more than asked for to learn whether another page follows.
+	p := &localPage{prefix: prefix, after: string(after), max: limit + 1}
+	if err := l.walkPage(ctx, prefix[:strings.LastIndex(prefix, "/")+1], p); err != nil {
+		return nil, "", fmt.Errorf("walk directory: %w", err)
+	}
+	if len(p.keys) <= limit {
+		return p.keys, "", nil
+	}
+	keys := p.keys[:limit]
+	return keys, base64.RawURLEncoding.EncodeToString([]byte(keys[limit-1])), nil
+}
+
+// localPage collects the keys of one ListPage call.
+type localPage struct {
+	prefix string
+	after  string // keys up to and including this were on earlier pages
+	max    int
+	keys   []string
+}
+
+// walkPage visits dir, a key prefix that is empty or ends in "/", in key
+// order.  Siblings are sorted with directories as "name/", which makes the
+// depth-first order the lexicographic order of the keys, so whole
+// subdirectories before p.after can be skipped without reading them.
+func (l *LocalStorage) walkPage(ctx context.Context, dir string, p *localPage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(l.baseDir, filepath.FromSlash(dir)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		switch {
+		case e.IsDir():
+			names = append(names, dir+e.Name()+"/")
+		case !strings.HasSuffix(e.Name(), metaSuffix):
+			names = append(names, dir+e.Name())
+		}
+	}
+	slices.Sort(names)
+
+	for _, key := range names {
+		if len(p.keys) >= p.max {
+			return nil
+		}
+		if !strings.HasPrefix(key, p.prefix) && !strings.HasPrefix(p.prefix, key) {
+			continue
+		}
+		if strings.HasSuffix(key, "/") {
+			if key < p.after && !strings.HasPrefix(p.after, key) {
+				continue // every key inside sorts before p.after
+			}
+			if err := l.walkPage(ctx, key, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if key > p.after && strings.HasPrefix(key, p.prefix) {
+			p.keys = append(p.keys, key)
+		}
+	}
+	return nil
+}
+
+// path returns the file path of key.
+func (l *LocalStorage) path(key string) (string, error) {
+	key, err := sanitizeKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.baseDir, filepath.FromSlash(key)), nil
+}
+
 // BaseDir returns the base directory where files are stored.
 func (l *LocalStorage) BaseDir() string {
 	return l.baseDir
@@ -2,9 +2,15 @@ package vault
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewLocalStorage_Success(t *testing.T) {
@@ -110,6 +116,24 @@ func TestLocalStorage_Delete_NotFound(t *testing.T) {
 	}
 }
 
+func TestLocalStorage_Stat(t *testing.T) {
+	storage, _ := NewLocalStorage(t.TempDir())
+	ctx := context.Background()
+
+	before := time.Now().Add(-time.Second)
+	storage.Put(ctx, "messages/a/b", []byte("twelve bytes"))
+	info, err := storage.Stat(ctx, "messages/a/b")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size != 12 || info.Modified.Before(before) {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if _, err := storage.Stat(ctx, "messages/missing"); err == nil {
+		t.Error("Stat of a missing key: expected error")
+	}
+}
+
 func TestLocalStorage_List_Success(t *testing.T) {
 	tmpDir := filepath.Join(os.TempDir(), "mulamail-test-list")
 	defer os.RemoveAll(tmpDir)
@@ -179,6 +203,12 @@ func TestLocalStorage_SecurityPathTraversal(t *testing.T) {
 		"../../../etc/passwd",
 		"..\\..\\..\\windows\\system32",
 		"subdir/../../escape",
+		"/etc/passwd",
+		"\\\\server\\share\\file",
+		"C:\\Windows\\win.ini",
+		"C:escape",
+		"messages/CON",
+		"file\x00.txt",
 	}
 
 	for _, key := range maliciousKeys {
@@ -202,6 +232,175 @@ func TestLocalStorage_SecurityPathTraversal(t *testing.T) {
 	}
 }
 
+func TestSanitizeKey(t *testing.T) {
+	for _, tt := range []struct {
+		key, want string
+	}{
+		{"messages/a/b", "messages/a/b"},
+		{"messages\\a\\b", "messages/a/b"},
+		{"./messages//a/", "messages/a"},
+		{"exports/x.mbox/0001", "exports/x.mbox/0001"},
+		{"a..b/.hidden", "a..b/.hidden"},
+		{"console/confirm.txt", "console/confirm.txt"},
+	} {
+		if got, err := sanitizeKey(tt.key); err != nil || got != tt.want {
+			t.Errorf("%q: want %q, got %q (%v)", tt.key, tt.want, got, err)
+		}
+	}
+	for _, key := range []string{
+		"", ".", "/", "..", "a/../b", "..\\a", "/etc/passwd", "\\etc\\passwd",
+		"C:\\Windows", "c:/x", "C:x", "a/file.txt:stream",
+		"nul", "a/CON", "a/con.txt", "a/Com1.log", "a/LPT9", "a/AUX .txt",
+		"a/b.", "a/b ", "a\x00b", "a\nb", "a\x7fb",
+	} {
+		if got, err := sanitizeKey(key); err == nil {
+			t.Errorf("%q: want an error, got %q", key, got)
+		}
+	}
+}
+
+func TestSanitizePrefix(t *testing.T) {
+	for _, tt := range []struct {
+		prefix, want string
+	}{
+		{"", ""},
+		{"messages/", "messages/"},
+		{"messages\\ab", "messages/ab"},
+		{"exports/x.", "exports/x."},
+		{"a//b/", "a/b/"},
+		{"CO", "CO"},
+	} {
+		if got, err := sanitizePrefix(tt.prefix); err != nil || got != tt.want {
+			t.Errorf("%q: want %q, got %q (%v)", tt.prefix, tt.want, got, err)
+		}
+	}
+	for _, prefix := range []string{"/", "/etc/", "../", "a/../", "..", "C:", "CON/", "a\x00"} {
+		if got, err := sanitizePrefix(prefix); err == nil {
+			t.Errorf("%q: want an error, got %q", prefix, got)
+		}
+	}
+}
+
+func TestLocalStorage_ListUsesSlashes(t *testing.T) {
+	storage, _ := NewLocalStorage(t.TempDir())
+	ctx := context.Background()
+
+	storage.Put(ctx, "messages\\a\\1", []byte("x"))
+	storage.Put(ctx, "messages/b/2", []byte("x"))
+	want := []string{"messages/a/1", "messages/b/2"}
+	if keys, err := storage.List(ctx, "messages\\"); err != nil || !slices.Equal(keys, want) {
+		t.Errorf("List: want %v, got %v (%v)", want, keys, err)
+	}
+	if keys, _, err := storage.ListPage(ctx, "messages\\", 10, ""); err != nil || !slices.Equal(keys, want) {
+		t.Errorf("ListPage: want %v, got %v (%v)", want, keys, err)
+	}
+	if data, err := storage.Get(ctx, "messages/a/1"); err != nil || string(data) != "x" {
+		t.Errorf("a key put with backslashes must read back with slashes: %v", err)
+	}
+}
+
+func TestLocalStorage_Checksums(t *testing.T) {
+	dir := t.TempDir()
+	storage, _ := NewLocalStorage(dir)
+	ctx := context.Background()
+	file := filepath.Join(dir, "messages", "1")
+
+	if err := storage.Put(ctx, "messages/1", []byte("hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := os.Stat(file + metaSuffix); err != nil {
+		t.Fatalf("no checksum sidecar: %v", err)
+	}
+	if keys, _ := storage.List(ctx, ""); !slices.Equal(keys, []string{"messages/1"}) {
+		t.Errorf("List: sidecars must be hidden, got %v", keys)
+	}
+	if keys, _, _ := storage.ListPage(ctx, "messages/", 10, ""); !slices.Equal(keys, []string{"messages/1"}) {
+		t.Errorf("ListPage: sidecars must be hidden, got %v", keys)
+	}
+	if err := storage.Verify(ctx, "messages/1"); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	// Rot one byte: Get only notices with VerifyChecksums, Verify always.
+	os.WriteFile(file, []byte("hellp"), 0600)
+	if err := storage.Verify(ctx, "messages/1"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Verify: want ErrChecksumMismatch, got %v", err)
+	}
+	if data, err := storage.Get(ctx, "messages/1"); err != nil || string(data) != "hellp" {
+		t.Errorf("Get without verification: %q, %v", data, err)
+	}
+	storage.VerifyChecksums = true
+	if _, err := storage.Get(ctx, "messages/1"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Get with verification: want ErrChecksumMismatch, got %v", err)
+	}
+
+	// An object stored before checksums were recorded still reads.
+	os.Remove(file + metaSuffix)
+	if err := storage.Verify(ctx, "messages/1"); !errors.Is(err, ErrNoChecksum) {
+		t.Errorf("Verify without a sidecar: want ErrNoChecksum, got %v", err)
+	}
+	if _, err := storage.Get(ctx, "messages/1"); err != nil {
+		t.Errorf("Get without a sidecar: %v", err)
+	}
+
+	os.WriteFile(file+metaSuffix, []byte(`{"v":2,"sha256":"00"}`), 0600)
+	if err := storage.Verify(ctx, "messages/1"); err == nil || errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Verify with an unknown metadata version: got %v", err)
+	}
+
+	storage.Put(ctx, "messages/1", []byte("hello"))
+	storage.Delete(ctx, "messages/1")
+	if _, err := os.Stat(file + metaSuffix); !os.IsNotExist(err) {
+		t.Errorf("Delete left the sidecar behind: %v", err)
+	}
+	if err := storage.Put(ctx, "messages/1.meta", []byte("x")); err == nil {
+		t.Error("Put: want keys ending in .meta rejected")
+	}
+}
+
+func TestLocalStorage_WindowsPaths(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("native separators are backslashes only on Windows")
+	}
+	dir := t.TempDir()
+	storage, _ := NewLocalStorage(dir)
+	storage.Put(context.Background(), "messages/a/1", []byte("x"))
+	if _, err := os.Stat(dir + `\messages\a\1`); err != nil {
+		t.Errorf("want the key stored under native separators: %v", err)
+	}
+}
+
+func FuzzSanitizeKey(f *testing.F) {
+	for _, seed := range []string{
+		"messages/a/b", "../x", "a\\..\\..\\b", "C:\\x", "//server/share", "a/CON.txt",
+		"a/./b//", "a\x00b", "exports/x.mbox/0001", "..", " /..", "a/ .. /b",
+	} {
+		f.Add(seed)
+	}
+	base := filepath.Join(string(filepath.Separator), "vault")
+	f.Fuzz(func(t *testing.T, key string) {
+		got, err := sanitizeKey(key)
+		if err != nil {
+			return
+		}
+		if got == "" || strings.HasPrefix(got, "/") || strings.ContainsAny(got, "\\:\x00") {
+			t.Fatalf("%q: unsafe key %q", key, got)
+		}
+		for _, elem := range strings.Split(got, "/") {
+			if elem == "" || elem == "." || elem == ".." {
+				t.Fatalf("%q: key %q has element %q", key, got, elem)
+			}
+		}
+		if again, err := sanitizeKey(got); err != nil || again != got {
+			t.Fatalf("%q: sanitizing %q again gave %q (%v)", key, got, again, err)
+		}
+		rel, err := filepath.Rel(base, filepath.Join(base, filepath.FromSlash(got)))
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("%q: key %q leaves the base directory (%q)", key, got, rel)
+		}
+	})
+}
+
 func TestLocalStorage_NestedDirectories(t *testing.T) {
 	tmpDir := filepath.Join(os.TempDir(), "mulamail-test-nested")
 	defer os.RemoveAll(tmpDir)
@@ -321,3 +520,73 @@ func TestLocalStorage_LargeFile(t *testing.T) {
 		t.Errorf("size mismatch: want %d, got %d", size, len(retrieved))
 	}
 }
+
+func TestLocalStorage_ListPage(t *testing.T) {
+	storage, _ := NewLocalStorage(t.TempDir())
+	ctx := context.Background()
+
+	// "a-c" sorts before "a/..." ('-' < '/'), which a plain directory walk
+	// would get wrong.
+	want := []string{"a-c", "a/b/1", "a/b/2", "a/c", "b/1", "b/2", "b/3"}
+	for _, key := range []string{"b/3", "a/c", "a/b/2", "b/1", "a-c", "a/b/1", "b/2"} {
+		storage.Put(ctx, key, []byte(key))
+	}
+
+	var got []string
+	token, pages := "", 0
+	for {
+		keys, next, err := storage.ListPage(ctx, "", 3, token)
+		if err != nil {
+			t.Fatalf("ListPage failed: %v", err)
+		}
+		if len(keys) > 3 {
+			t.Fatalf("page of %d keys exceeds the limit", len(keys))
+		}
+		got = append(got, keys...)
+		pages++
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if !slices.Equal(got, want) || pages != 3 {
+		t.Errorf("paged listing: want %v in 3 pages, got %v in %d", want, got, pages)
+	}
+
+	keys, next, _ := storage.ListPage(ctx, "a/b", 10, "")
+	if !slices.Equal(keys, []string{"a/b/1", "a/b/2"}) || next != "" {
+		t.Errorf("prefix a/b: got %v, token %q", keys, next)
+	}
+	if keys, _, _ := storage.ListPage(ctx, "missing/", 10, ""); len(keys) != 0 {
+		t.Errorf("missing prefix: got %v", keys)
+	}
+	if _, _, err := storage.ListPage(ctx, "", 10, "not base64!"); err == nil {
+		t.Error("invalid token: expected error")
+	}
+}
+
+func TestForEachPage_DeleteWhileListing(t *testing.T) {
+	storage, _ := NewLocalStorage(t.TempDir())
+	ctx := context.Background()
+	for i := 0; i < 2*DefaultPageSize+5; i++ {
+		storage.Put(ctx, fmt.Sprintf("messages/%05d", i), []byte("x"))
+	}
+	storage.Put(ctx, "exports/keep", []byte("x"))
+
+	n := 0
+	err := ForEachPage(ctx, storage, "messages/", func(keys []string) error {
+		for _, key := range keys {
+			if err := storage.Delete(ctx, key); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil || n != 2*DefaultPageSize+5 {
+		t.Fatalf("ForEachPage: deleted %d, err %v", n, err)
+	}
+	if keys, _ := storage.List(ctx, ""); !slices.Equal(keys, []string{"exports/keep"}) {
+		t.Errorf("left behind: %v", keys)
+	}
+}
@@ -0,0 +1,112 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id cost parameters for EncryptWithPassphrase (RFC 9106's second
+// recommended option: 64 MiB of memory, 3 passes).  They are recorded in
+// every blob, so raising them later does not break older blobs.
+const (
+	passphraseTime    = 3
+	passphraseMemory  = 64 * 1024 // KiB
+	passphraseThreads = 4
+	passphraseSaltLen = 16
+
+	// Upper bounds accepted when decrypting, so a forged header cannot
+	// make DecryptWithPassphrase allocate without limit.
+	passphraseMaxTime   = 16
+	passphraseMaxMemory = 1024 * 1024 // KiB
+)
+
+// passphraseMagic starts every passphrase-encrypted blob.
+var passphraseMagic = []byte("MMPE\x01")
+
+// passphraseHeaderLen is the length of the blob header: magic, time (4
+// bytes), memory in KiB (4 bytes), threads (1 byte) and salt.
+var passphraseHeaderLen = len(passphraseMagic) + 4 + 4 + 1 + passphraseSaltLen
+
+// ErrPassphrase is returned by DecryptWithPassphrase when the passphrase is
+// wrong or the blob has been tampered with.
+var ErrPassphrase = errors.New("wrong passphrase or corrupted data")
+
+// EncryptWithPassphrase encrypts data with AES-256-GCM under a key derived
+// from passphrase with Argon2id and a random salt.  The output is
+//
+//	"MMPE\x01" | time (uint32 BE) | memory KiB (uint32 BE) | threads (uint8) |
+//	salt (16 bytes) | nonce (12 bytes) | ciphertext and tag
+//
+// with everything before the nonce authenticated as additional data, so it
+// can be decrypted with nothing but the passphrase.
+func EncryptWithPassphrase(passphrase string, data []byte) ([]byte, error) {
+	header := make([]byte, 0, passphraseHeaderLen)
+	header = append(header, passphraseMagic...)
+	header = binary.BigEndian.AppendUint32(header, passphraseTime)
+	header = binary.BigEndian.AppendUint32(header, passphraseMemory)
+	header = append(header, passphraseThreads)
+	salt := make([]byte, passphraseSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+
+	gcm, err := passphraseGCM(passphrase, salt, passphraseTime, passphraseMemory, passphraseThreads)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, data, header), nil
+}
+
+// DecryptWithPassphrase is the inverse of EncryptWithPassphrase.
+func DecryptWithPassphrase(passphrase string, blob []byte) ([]byte, error) {
+	if len(blob) < passphraseHeaderLen || !bytes.HasPrefix(blob, passphraseMagic) {
+		return nil, fmt.Errorf("not a passphrase-encrypted blob")
+	}
+	header := blob[:passphraseHeaderLen]
+	params := header[len(passphraseMagic):]
+	time := binary.BigEndian.Uint32(params[0:4])
+	memory := binary.BigEndian.Uint32(params[4:8])
+	threads := params[8]
+	salt := params[9:]
+	if time == 0 || time > passphraseMaxTime || memory == 0 || memory > passphraseMaxMemory || threads == 0 {
+		return nil, fmt.Errorf("unsupported key derivation parameters")
+	}
+
+	gcm, err := passphraseGCM(passphrase, salt, time, memory, threads)
+	if err != nil {
+		return nil, err
+	}
+	rest := blob[passphraseHeaderLen:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	data, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], header)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return data, nil
+}
+
+// passphraseGCM returns an AES-256-GCM cipher keyed with Argon2id.
+func passphraseGCM(passphrase string, salt []byte, time, memory uint32, threads uint8) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, time, memory, threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,60 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptWithPassphrase_RoundTrip(t *testing.T) {
+	data := []byte("PK\x03\x04 archive bytes")
+	blob, err := EncryptWithPassphrase("correct horse battery staple", data)
+	if err != nil {
+		t.Fatalf("EncryptWithPassphrase failed: %v", err)
+	}
+	if bytes.Contains(blob, data) {
+		t.Error("blob contains the plaintext")
+	}
+
+	got, err := DecryptWithPassphrase("correct horse battery staple", blob)
+	if err != nil {
+		t.Fatalf("DecryptWithPassphrase failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("round trip: want %q, got %q", data, got)
+	}
+
+	again, _ := EncryptWithPassphrase("correct horse battery staple", data)
+	if bytes.Equal(again, blob) {
+		t.Error("two encryptions of the same data should differ (random salt and nonce)")
+	}
+}
+
+func TestDecryptWithPassphrase_Rejects(t *testing.T) {
+	blob, err := EncryptWithPassphrase("secret passphrase", []byte("data"))
+	if err != nil {
+		t.Fatalf("EncryptWithPassphrase failed: %v", err)
+	}
+
+	if _, err := DecryptWithPassphrase("wrong passphrase", blob); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("wrong passphrase: want ErrPassphrase, got %v", err)
+	}
+
+	// The header is authenticated: lowering the cost parameters is caught.
+	tampered := bytes.Clone(blob)
+	tampered[len(passphraseMagic)+3]--
+	if _, err := DecryptWithPassphrase("secret passphrase", tampered); err == nil {
+		t.Error("tampered header should not decrypt")
+	}
+
+	// Absurd parameters are refused before any key derivation.
+	huge := bytes.Clone(blob)
+	copy(huge[len(passphraseMagic)+4:], []byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := DecryptWithPassphrase("secret passphrase", huge); err == nil || errors.Is(err, ErrPassphrase) {
+		t.Errorf("oversized memory parameter: want a parameter error, got %v", err)
+	}
+
+	if _, err := DecryptWithPassphrase("secret passphrase", []byte("not a blob")); err == nil {
+		t.Error("short input should be rejected")
+	}
+}
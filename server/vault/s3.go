@@ -3,6 +3,9 @@ package vault
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -10,10 +13,19 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-// S3Client provides put/get for the MulaMail encrypted-mail vault.
+// metaHeader is the user metadata entry holding an object's ObjectMeta.
+const metaHeader = "mulamail-meta"
+
+// S3Client provides put/get for the MulaMail encrypted-mail vault.  Each
+// object carries its ObjectMeta as JSON in the mulamail-meta user metadata.
 type S3Client struct {
 	client *s3.Client
 	bucket string
+
+	// VerifyChecksums makes Get check each object against its recorded
+	// checksum, failing with ErrChecksumMismatch.  Objects stored without
+	// one are returned unchecked.
+	VerifyChecksums bool
 }
 
 func NewS3Client(region, bucket string) (*S3Client, error) {
@@ -29,10 +41,15 @@ func NewS3Client(region, bucket string) (*S3Client, error) {
 
 // Put stores raw bytes at the given key.
 func (v *S3Client) Put(ctx context.Context, key string, data []byte) error {
-	_, err := v.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(v.bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(data),
+	meta, err := json.Marshal(newObjectMeta(data))
+	if err != nil {
+		return err
+	}
+	_, err = v.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(v.bucket),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(data),
+		Metadata: map[string]string{metaHeader: string(meta)},
 	})
 	return err
 }
@@ -47,7 +64,46 @@ func (v *S3Client) Get(ctx context.Context, key string) ([]byte, error) {
 		return nil, err
 	}
 	defer out.Body.Close()
-	return io.ReadAll(out.Body)
+	data, err := io.ReadAll(out.Body)
+	if err != nil || !v.VerifyChecksums {
+		return data, err
+	}
+	if err := checkS3Meta(key, out.Metadata, data); err != nil && !errors.Is(err, ErrNoChecksum) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Verify checks the object at key against its recorded checksum; see
+// Verifier.
+func (v *S3Client) Verify(ctx context.Context, key string) error {
+	out, err := v.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(v.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return err
+	}
+	return checkS3Meta(key, out.Metadata, data)
+}
+
+// checkS3Meta checks data against the ObjectMeta in the user metadata of
+// the object at key, returning ErrNoChecksum when it has none.
+func checkS3Meta(key string, metadata map[string]string, data []byte) error {
+	raw, ok := metadata[metaHeader]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoChecksum, key)
+	}
+	meta, err := parseObjectMeta([]byte(raw))
+	if err != nil {
+		return err
+	}
+	return meta.check(key, data)
 }
 
 // Delete removes the object at the given key.
@@ -59,6 +115,19 @@ func (v *S3Client) Delete(ctx context.Context, key string) error {
 	return err
 }
 
+// Stat returns the size and last modification time of the object at the
+// given key, without downloading it.
+func (v *S3Client) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := v.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(v.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: aws.ToInt64(out.ContentLength), Modified: aws.ToTime(out.LastModified)}, nil
+}
+
 // List returns all keys with the given prefix.
 func (v *S3Client) List(ctx context.Context, prefix string) ([]string, error) {
 	var keys []string
@@ -82,3 +151,35 @@ func (v *S3Client) List(ctx context.Context, prefix string) ([]string, error) {
 
 	return keys, nil
 }
+
+// ListPage returns a page of keys under prefix; see Storage.  The token is
+// S3's own continuation token.
+func (v *S3Client) ListPage(ctx context.Context, prefix string, limit int, token string) ([]string, string, error) {
+	if limit <= 0 || limit > DefaultPageSize {
+		limit = DefaultPageSize
+	}
+	in := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(v.bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(int32(limit)),
+	}
+	if token != "" {
+		in.ContinuationToken = aws.String(token)
+	}
+	out, err := v.client.ListObjectsV2(ctx, in)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]string, 0, len(out.Contents))
+	for _, obj := range out.Contents {
+		if obj.Key != nil {
+			keys = append(keys, *obj.Key)
+		}
+	}
+	next := ""
+	if aws.ToBool(out.IsTruncated) {
+		next = aws.ToString(out.NextContinuationToken)
+	}
+	return keys, next, nil
+}
@@ -1,6 +1,13 @@
 package vault
 
-import "context"
+import (
+	"context"
+	"time"
+)
+
+// DefaultPageSize is the page size ListPage uses when limit is not positive.
+// It is also the most S3 returns per request.
+const DefaultPageSize = 1000
 
 // Storage defines the interface for storing encrypted mail data.
 // Implementations include local file storage and cloud storage (S3, etc.).
@@ -16,8 +23,47 @@ type Storage interface {
 
 	// List returns all keys with the given prefix (optional, can return empty if not implemented)
 	List(ctx context.Context, prefix string) ([]string, error)
+
+	// ListPage returns up to limit keys that start with prefix, in
+	// lexicographic order, continuing after the page token came from ("" for
+	// the first page).  The returned token is opaque and empty after the
+	// last page.
+	ListPage(ctx context.Context, prefix string, limit int, token string) ([]string, string, error)
+
+	// Stat returns the size and last modification time of the object at
+	// the given key
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Size     int64
+	Modified time.Time
+}
+
+// ForEachPage calls fn with every page of keys under prefix until the
+// listing ends or fn returns an error.  fn may delete the keys it is given.
+func ForEachPage(ctx context.Context, s Storage, prefix string, fn func(keys []string) error) error {
+	token := ""
+	for {
+		keys, next, err := s.ListPage(ctx, prefix, DefaultPageSize, token)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		token = next
+	}
 }
 
 // Ensure S3Client implements Storage interface
 var _ Storage = (*S3Client)(nil)
 var _ Storage = (*LocalStorage)(nil)
+var _ Storage = (*CompositeStorage)(nil)
+var _ Storage = (*EncryptedStorage)(nil)
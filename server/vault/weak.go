@@ -0,0 +1,99 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+)
+
+// weakKeyBytes is the least key material, in bytes, a key must carry by the
+// heuristics of IsWeakKey.
+const weakKeyBytes = 16
+
+// exampleKeys are keys published in documentation and tests, and so known
+// to anyone.  IsWeakKey flags them as repeated patterns too.
+var exampleKeys = []string{
+	"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+}
+
+// IsWeakKey reports whether the hex key keyHex is publicly known or
+// guessable: the all-zero default, a key of one repeated byte, a short
+// pattern repeated, a run of bytes counting up or down, or a key whose
+// byte distribution carries less than 16 bytes of entropy.  These are
+// heuristics; a key that passes them is not proven strong.  A keyHex that
+// is not hex is not a key at all, and ParseKey rejects it.
+func IsWeakKey(keyHex string) bool {
+	b, err := hex.DecodeString(keyHex)
+	if err != nil || len(b) == 0 {
+		clear(b)
+		return false
+	}
+	defer clear(b)
+	for period := 1; period < weakKeyBytes && period < len(b); period++ {
+		if bytes.Equal(b[period:], b[:len(b)-period]) {
+			return true
+		}
+	}
+	return counts(b) || entropyBits(b) < weakKeyBytes*8
+}
+
+// counts reports whether each byte of b differs from the one before by the
+// same step, as in 000102... or fffefd....
+func counts(b []byte) bool {
+	for i := 2; i < len(b); i++ {
+		if b[i]-b[i-1] != b[1]-b[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// entropyBits estimates the entropy of b from the frequency of its bytes.
+func entropyBits(b []byte) float64 {
+	var freq [256]int
+	for _, c := range b {
+		freq[c]++
+	}
+	var bits float64
+	for _, n := range freq {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits * float64(len(b))
+}
+
+// WeakKeys returns the weak keys anyone could try: the 256 keys of one
+// repeated byte, the all-zero default first, and the published example
+// keys.
+func WeakKeys() []Key {
+	keys := make([]Key, 0, 256+len(exampleKeys))
+	for c := range 256 {
+		keys = append(keys, Key{b: bytes.Repeat([]byte{byte(c)}, KeySize)})
+	}
+	for _, example := range exampleKeys {
+		keys = append(keys, MustParseKey(example))
+	}
+	return keys
+}
+
+// Opens reports whether ciphertextHex, as returned by Encrypt, was
+// encrypted under k.  Unlike Decrypt it is meant for trying keys, so a
+// mismatch is not counted as a decryption failure.
+func (k Key) Opens(ciphertextHex string) bool {
+	if k.IsZero() {
+		return false
+	}
+	data, err := hex.DecodeString(ciphertextHex)
+	if err != nil {
+		return false
+	}
+	gcm, err := newGCM(k.b)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return false
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	clear(plaintext)
+	return err == nil
+}
@@ -0,0 +1,67 @@
+package vault
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsWeakKey(t *testing.T) {
+	weak := []string{
+		strings.Repeat("00", KeySize),
+		strings.Repeat("ff", KeySize),
+		strings.Repeat("deadbeef", KeySize/4),
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		"1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100",
+		// 12 distinct bytes in no simple pattern.
+		"a1b2c3d4e5f6a7b8c9d0e1f2a1b2c3d4e5f6a7b8c9d0e1f2f2e1d0c9b8a7f6e5",
+	}
+	for _, key := range weak {
+		if !IsWeakKey(key) {
+			t.Errorf("IsWeakKey(%s): want true", key)
+		}
+	}
+	for range 100 {
+		if key := generateTestKey(t); IsWeakKey(key) {
+			t.Errorf("IsWeakKey(%s): a random key must pass", key)
+		}
+	}
+	if IsWeakKey("not-hex") {
+		t.Error("IsWeakKey of a non-hex string: want false")
+	}
+}
+
+func TestWeakKeys(t *testing.T) {
+	keys := WeakKeys()
+	if !keys[0].Equal(MustParseKey(strings.Repeat("00", KeySize))) {
+		t.Error("want the all-zero default first")
+	}
+	for _, example := range exampleKeys {
+		found := false
+		for _, k := range keys {
+			found = found || k.Equal(MustParseKey(example))
+		}
+		if !found {
+			t.Errorf("example key %s missing", example)
+		}
+	}
+}
+
+func TestKey_Opens(t *testing.T) {
+	key, other := MustParseKey(strings.Repeat("00", KeySize)), MustParseKey(generateTestKey(t))
+	ct, err := key.Encrypt([]byte("pop3-password"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	before := DecryptFailures()
+	if !key.Opens(ct) {
+		t.Error("want the ciphertext to open under its key")
+	}
+	if other.Opens(ct) || key.Opens("not-hex") || key.Opens("00") {
+		t.Error("want no other key or malformed ciphertext to open")
+	}
+	if DecryptFailures() != before {
+		t.Error("trying keys must not count as decryption failures")
+	}
+}